@@ -0,0 +1,49 @@
+package ratelimiter
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// KeyFunc returns the key a request is limited by
+type KeyFunc func(r *http.Request) string
+
+// ClientIP keys requests by the address of the client, without its port.
+// Behind a proxy that address is the proxy's: key by a header it sets
+// instead.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Middleware returns a wrapper of handlers that answers the requests over
+// the limit with 429 Too Many Requests and a Retry-After header in whole
+// seconds. A nil key limits by ClientIP.
+func Middleware(l Limiter, key KeyFunc) func(http.Handler) http.Handler {
+	if key == nil {
+		key = ClientIP
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ok, wait := l.Allow(key(r))
+			if !ok {
+				w.Header().Set("Retry-After", retryAfter(wait))
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// retryAfter rounds a wait up to the whole seconds of Retry-After, never
+// saying 0 which would invite an immediate retry
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(max(1, int(math.Ceil(wait.Seconds()))))
+}
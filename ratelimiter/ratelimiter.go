@@ -0,0 +1,94 @@
+// Package ratelimiter limits how often each client, identified by a key
+// such as its address, may do something, with a token bucket or a sliding
+// window, and wraps HTTP handlers to answer the clients over the limit
+// with 429 Too Many Requests.
+//
+//	limiter, err := ratelimiter.NewTokenBucket(10, 20)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	http.ListenAndServe(":8080", ratelimiter.Middleware(limiter, nil)(mux))
+//
+// The limiters are safe for concurrent use, and forget the clients idle
+// long enough to start over anyway, so memory follows the active clients.
+package ratelimiter
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often a limiter forgets its idle clients
+const sweepInterval = time.Minute
+
+// Limiter decides whether the client with a key may go ahead now
+type Limiter interface {
+	// Allow reports whether the client is within the limit, counting this
+	// attempt when it is, and otherwise how long until it will be
+	Allow(key string) (ok bool, retryAfter time.Duration)
+}
+
+// TokenBucket allows each client a sustained rate with bursts: a bucket of
+// burst tokens refills at rate per second, and each attempt takes one
+type TokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+// bucket holds the attempts a client may still make right away
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a limiter of rate attempts per second per client,
+// allowing up to burst at once
+func NewTokenBucket(rate float64, burst int) (*TokenBucket, error) {
+	switch {
+	case rate <= 0:
+		return nil, fmt.Errorf("rate must be positive")
+	case burst < 1:
+		return nil, fmt.Errorf("burst must be at least 1")
+	}
+	return &TokenBucket{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}, nil
+}
+
+// Allow takes a token from the client's bucket, returning false and how
+// long until the next one when it is empty
+func (l *TokenBucket) Allow(key string) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.swept) > sweepInterval {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep forgets the clients whose buckets have filled up again, as they
+// would start over from a full bucket anyway
+func (l *TokenBucket) sweep(now time.Time) {
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+	l.swept = now
+}
@@ -0,0 +1,95 @@
+package ratelimiter
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SlidingWindow allows each client limit attempts in any window of time.
+// Rather than remembering every attempt, it counts them in fixed windows
+// and weighs the previous window by how much of it the sliding one still
+// covers, which is close enough while taking two counters per client.
+type SlidingWindow struct {
+	limit  float64
+	window time.Duration
+
+	mu      sync.Mutex
+	windows map[string]*counter
+	swept   time.Time
+}
+
+// counter holds the attempts of a client in the current fixed window and
+// the one before
+type counter struct {
+	start      time.Time
+	prev, curr float64
+}
+
+// NewSlidingWindow returns a limiter of limit attempts per client in any
+// window
+func NewSlidingWindow(limit int, window time.Duration) (*SlidingWindow, error) {
+	switch {
+	case limit < 1:
+		return nil, fmt.Errorf("limit must be at least 1")
+	case window <= 0:
+		return nil, fmt.Errorf("window must be positive")
+	}
+	return &SlidingWindow{limit: float64(limit), window: window, windows: make(map[string]*counter)}, nil
+}
+
+// Allow counts an attempt of the client unless the window already holds
+// limit of them, returning false and how long until one slides out then
+func (l *SlidingWindow) Allow(key string) (bool, time.Duration) {
+	now := time.Now()
+	start := now.Truncate(l.window)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.swept) > sweepInterval {
+		l.sweep(now)
+	}
+	c, ok := l.windows[key]
+	if !ok {
+		c = &counter{start: start}
+		l.windows[key] = c
+	}
+	switch {
+	case start.Equal(c.start):
+	case start.Sub(c.start) == l.window:
+		c.start, c.prev, c.curr = start, c.curr, 0
+	default:
+		c.start, c.prev, c.curr = start, 0, 0
+	}
+
+	elapsed := now.Sub(start)
+	weight := 1 - float64(elapsed)/float64(l.window)
+	if c.prev*weight+c.curr+1 <= l.limit {
+		c.curr++
+		return true, 0
+	}
+	return false, l.retryAfter(c, elapsed)
+}
+
+// retryAfter returns how long until the estimate of a full window drops
+// low enough for one more attempt
+func (l *SlidingWindow) retryAfter(c *counter, elapsed time.Duration) time.Duration {
+	room := l.limit - 1
+	if c.curr <= room {
+		// The previous window slides out enough before this one ends
+		return time.Duration(float64(l.window)*(1-(room-c.curr)/c.prev)) - elapsed
+	}
+	// This window becomes the previous one, and has to slide out in turn
+	return l.window - elapsed + time.Duration(float64(l.window)*(1-room/c.curr))
+}
+
+// sweep forgets the clients without attempts in the current or previous
+// window, as they would start over from nothing anyway
+func (l *SlidingWindow) sweep(now time.Time) {
+	start := now.Truncate(l.window)
+	for key, c := range l.windows {
+		if start.Sub(c.start) > l.window {
+			delete(l.windows, key)
+		}
+	}
+	l.swept = now
+}
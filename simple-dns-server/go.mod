@@ -0,0 +1,5 @@
+module github.com/jeffersfp/golang-studies/simple-dns-server
+
+go 1.26.0
+
+require golang.org/x/net v0.59.0
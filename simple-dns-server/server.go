@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Sizes of UDP responses: the limit of plain DNS, and the largest one
+// offered to clients announcing more with EDNS(0)
+const (
+	udpMinSize = 512
+	udpMaxSize = 4096
+)
+
+// tcpIdleTimeout closes TCP connections sending no query for this long
+const tcpIdleTimeout = 10 * time.Second
+
+// dnsServer answers the queries for the names of its zone over UDP and
+// TCP
+type dnsServer struct {
+	zone    atomic.Pointer[zone]
+	ttl     uint32
+	udp     net.PacketConn
+	tcp     net.Listener
+	closing atomic.Bool
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// serveUDP answers the queries arriving on the UDP socket until it is
+// closed
+func (s *dnsServer) serveUDP() {
+	buf := make([]byte, udpMaxSize)
+	for {
+		n, from, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			if !s.closing.Load() {
+				log.Printf("Error reading UDP query: %v", err)
+			}
+			return
+		}
+		if resp := s.answer(buf[:n], "udp", from); resp != nil {
+			if _, err := s.udp.WriteTo(resp, from); err != nil {
+				log.Printf("Error answering %s: %v", from, err)
+			}
+		}
+	}
+}
+
+// serveTCP accepts TCP connections until the listener is closed
+func (s *dnsServer) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			if !s.closing.Load() {
+				log.Printf("Error accepting TCP connection: %v", err)
+			}
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.handleTCP(conn)
+	}
+}
+
+// handleTCP answers the queries of a connection, each prefixed with its
+// length, until the client closes it or goes idle
+func (s *dnsServer) handleTCP(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		s.wg.Done()
+	}()
+	for !s.closing.Load() {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		resp := s.answer(query, "tcp", conn.RemoteAddr())
+		if resp == nil {
+			return
+		}
+		conn.SetWriteDeadline(time.Now().Add(tcpIdleTimeout))
+		if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// answer returns the response to a query, or nil for packets not worth
+// one. UDP responses too large for the client are truncated, telling it
+// to ask again over TCP.
+func (s *dnsServer) answer(query []byte, network string, from net.Addr) []byte {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil || header.Response {
+		return nil
+	}
+	resp := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: header.ID, Response: true, OpCode: header.OpCode, RecursionDesired: header.RecursionDesired},
+	}
+	questions, err := p.AllQuestions()
+	switch {
+	case err != nil:
+		resp.RCode = dnsmessage.RCodeFormatError
+	case header.OpCode != 0:
+		resp.RCode = dnsmessage.RCodeNotImplemented
+	case len(questions) != 1:
+		resp.RCode = dnsmessage.RCodeFormatError
+	}
+	limit := udpMinSize
+	var edns bool
+	if err == nil {
+		p.SkipAllAnswers()
+		p.SkipAllAuthorities()
+		additionals, _ := p.AllAdditionals()
+		for _, rr := range additionals {
+			if rr.Header.Type == dnsmessage.TypeOPT {
+				edns = true
+				limit = min(max(int(rr.Header.Class), udpMinSize), udpMaxSize)
+			}
+		}
+	}
+
+	question, rcode := "-", resp.RCode
+	if resp.RCode == dnsmessage.RCodeSuccess {
+		q := questions[0]
+		resp.Questions = questions
+		resp.Authoritative = true
+		question = q.Type.String() + " " + q.Name.String()
+		// A known name asked for a type the file cannot hold gets an empty
+		// answer rather than NXDOMAIN
+		answers, exists := s.zone.Load().lookup(q, s.ttl)
+		if !exists {
+			resp.RCode = dnsmessage.RCodeNameError
+		}
+		resp.Answers = answers
+		rcode = resp.RCode
+	}
+	if edns {
+		var opt dnsmessage.Resource
+		opt.Header.Name = dnsmessage.MustNewName(".")
+		opt.Header.SetEDNS0(udpMaxSize, dnsmessage.RCodeSuccess, false)
+		opt.Body = &dnsmessage.OPTResource{}
+		resp.Additionals = []dnsmessage.Resource{opt}
+	}
+	packet, err := resp.Pack()
+	if err != nil {
+		log.Printf("Error packing the answer to %s: %v", from, err)
+		return nil
+	}
+	if network == "udp" && len(packet) > limit {
+		resp.Truncated, resp.Answers = true, nil
+		if packet, err = resp.Pack(); err != nil {
+			log.Printf("Error packing the answer to %s: %v", from, err)
+			return nil
+		}
+	}
+	log.Printf("%s %s %s %s %d answers%s", network, from, question, rcodeName(rcode), len(resp.Answers), truncatedNote(resp.Truncated))
+	return packet
+}
+
+func rcodeName(rcode dnsmessage.RCode) string {
+	switch rcode {
+	case dnsmessage.RCodeSuccess:
+		return "NOERROR"
+	case dnsmessage.RCodeFormatError:
+		return "FORMERR"
+	case dnsmessage.RCodeNameError:
+		return "NXDOMAIN"
+	case dnsmessage.RCodeNotImplemented:
+		return "NOTIMP"
+	}
+	return rcode.String()
+}
+
+func truncatedNote(truncated bool) string {
+	if truncated {
+		return " (truncated)"
+	}
+	return ""
+}
+
+// shutdown stops answering: the sockets are closed, and the TCP
+// connections once the query they are answering is done
+func (s *dnsServer) shutdown(timeout time.Duration) error {
+	s.closing.Store(true)
+	err := errors.Join(s.udp.Close(), s.tcp.Close())
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		<-done
+	}
+	return err
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	// Parse CLI arguments
+	addr := flag.String("addr", "0.0.0.0", "IP Address to bind to")
+	port := flag.String("port", "5353", "Port to bind to, over UDP and TCP (53 usually needs root)")
+	hosts := flag.String("hosts", "hosts", "Hosts-style file of the A, AAAA and TXT records to answer, read again on SIGHUP")
+	ttl := flag.Duration("ttl", time.Minute, "How long resolvers may cache the answers")
+	flag.Parse()
+
+	// Load the records
+	z, err := loadZone(*hosts)
+	if err != nil {
+		log.Fatalf("Error loading hosts file: %v", err)
+	}
+
+	// Listen on the same port over both protocols
+	address := net.JoinHostPort(*addr, *port)
+	udp, err := net.ListenPacket("udp", address)
+	if err != nil {
+		log.Fatalf("Error starting server: %v", err)
+	}
+	tcp, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatalf("Error starting server: %v", err)
+	}
+	s := &dnsServer{ttl: uint32(ttl.Seconds()), udp: udp, tcp: tcp, conns: make(map[net.Conn]struct{})}
+	s.zone.Store(z)
+
+	names, records := z.size()
+	log.Printf("Starting DNS server on %s (udp and tcp) answering %d names with %d records from %s", address, names, records, *hosts)
+	go s.serveUDP()
+	go s.serveTCP()
+
+	// Set up graceful shutdown, and reloading on SIGHUP
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	// Wait for CTRL+C
+	for waiting := true; waiting; {
+		select {
+		case <-reload:
+			z, err := loadZone(*hosts)
+			if err != nil {
+				log.Printf("Error reloading hosts file, keeping the previous records: %v", err)
+				continue
+			}
+			s.zone.Store(z)
+			names, records := z.size()
+			log.Printf("Reloaded %s: %d names with %d records", *hosts, names, records)
+		case <-stop:
+			waiting = false
+		}
+	}
+
+	log.Println("Shutting down server...")
+	if err := s.shutdown(5 * time.Second); err != nil {
+		log.Fatalf("Error shutting down server: %v", err)
+	}
+	log.Println("Server stopped")
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// maxTXTString is the longest character string a TXT record holds; longer
+// texts are split across several
+const maxTXTString = 255
+
+// zone holds the records read from the hosts file, by lowercase name with
+// the final dot
+type zone struct {
+	a    map[string][][4]byte
+	aaaa map[string][][16]byte
+	txt  map[string][][]string
+}
+
+// loadZone reads a hosts-style file: lines of an address followed by the
+// names it answers for, and lines of txt, a name and the text of a TXT
+// record. # starts a comment.
+//
+//	192.168.1.10  nas.home nas
+//	fd00::10      nas.home
+//	txt           nas.home  "v=spf1 -all"
+func loadZone(name string) (*zone, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	z := &zone{a: make(map[string][][4]byte), aaaa: make(map[string][][16]byte), txt: make(map[string][][]string)}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected an address and names, or txt, a name and a text", name, n)
+		}
+		if strings.EqualFold(fields[0], "txt") {
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("%s:%d: expected txt, a name and a text", name, n)
+			}
+			// The text is the rest of the line, spaces included
+			text := strings.TrimSpace(strings.TrimSpace(line)[len(fields[0]):])
+			text = strings.TrimSpace(text[len(fields[1]):])
+			host := canonicalName(fields[1])
+			z.txt[host] = append(z.txt[host], splitTXT(unquote(text)))
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid address %q", name, n, fields[0])
+		}
+		for _, host := range fields[1:] {
+			host = canonicalName(host)
+			if _, err := dnsmessage.NewName(host); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid name %q", name, n, host)
+			}
+			if addr.Unmap().Is4() {
+				z.a[host] = append(z.a[host], addr.Unmap().As4())
+			} else {
+				z.aaaa[host] = append(z.aaaa[host], addr.As16())
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, ".")) + "."
+}
+
+func unquote(text string) string {
+	if len(text) >= 2 && text[0] == '"' && text[len(text)-1] == '"' {
+		return text[1 : len(text)-1]
+	}
+	return text
+}
+
+// splitTXT splits a text into the character strings of a TXT record
+func splitTXT(text string) []string {
+	var parts []string
+	for len(text) > maxTXTString {
+		parts, text = append(parts, text[:maxTXTString]), text[maxTXTString:]
+	}
+	return append(parts, text)
+}
+
+// size returns the number of names and records, for the startup log
+func (z *zone) size() (names, records int) {
+	seen := make(map[string]bool)
+	for name, rrs := range z.a {
+		seen[name], records = true, records+len(rrs)
+	}
+	for name, rrs := range z.aaaa {
+		seen[name], records = true, records+len(rrs)
+	}
+	for name, rrs := range z.txt {
+		seen[name], records = true, records+len(rrs)
+	}
+	return len(seen), records
+}
+
+// lookup returns the records of a question, and whether the name exists
+// at all, to tell an empty answer from NXDOMAIN
+func (z *zone) lookup(q dnsmessage.Question, ttl uint32) ([]dnsmessage.Resource, bool) {
+	name := strings.ToLower(q.Name.String())
+	header := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: ttl}
+	var answers []dnsmessage.Resource
+	if q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeALL {
+		for _, a := range z.a[name] {
+			answers = append(answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: a}})
+		}
+	}
+	if q.Type == dnsmessage.TypeAAAA || q.Type == dnsmessage.TypeALL {
+		for _, aaaa := range z.aaaa[name] {
+			answers = append(answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AAAAResource{AAAA: aaaa}})
+		}
+	}
+	if q.Type == dnsmessage.TypeTXT || q.Type == dnsmessage.TypeALL {
+		for _, txt := range z.txt[name] {
+			answers = append(answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.TXTResource{TXT: txt}})
+		}
+	}
+	exists := len(z.a[name]) > 0 || len(z.aaaa[name]) > 0 || len(z.txt[name]) > 0
+	return answers, exists
+}
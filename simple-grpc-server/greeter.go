@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// greeterService is the name of the service defined in greeter.proto
+const greeterService = protoPackage + ".Greeter"
+
+// Limits of SayHelloStream
+const (
+	defaultCount    = 5
+	maxCount        = 100
+	defaultInterval = time.Second
+)
+
+// helloRequest is the HelloRequest and HelloStreamRequest messages, the
+// first being a subset of the second
+type helloRequest struct {
+	name       string
+	count      int
+	intervalMS int
+}
+
+// decodeHelloRequest reads a HelloRequest or HelloStreamRequest message
+func decodeHelloRequest(msg []byte) (helloRequest, error) {
+	var req helloRequest
+	err := protoDecode(msg, func(field int, v uint64, data []byte) {
+		switch field {
+		case 1:
+			req.name = string(data)
+		case 2:
+			req.count = int(int32(v))
+		case 3:
+			req.intervalMS = int(int32(v))
+		}
+	})
+	if err == nil && req.name == "" {
+		err = statusErrorf(codeInvalidArgument, "name is required")
+	}
+	return req, err
+}
+
+// helloReply encodes a HelloReply message
+func helloReply(message string) []byte {
+	return protoAppendString(nil, 1, message)
+}
+
+// sayHello implements the unary SayHello method
+func sayHello(s *stream) error {
+	msg, err := s.recvOne()
+	if err != nil {
+		return err
+	}
+	req, err := decodeHelloRequest(msg)
+	if err != nil {
+		return err
+	}
+	return s.send(helloReply("Hello, " + req.name + "!"))
+}
+
+// sayHelloStream implements the server-streaming SayHelloStream method,
+// ending early when the client goes away, the deadline passes or the
+// server shuts down
+func sayHelloStream(s *stream) error {
+	msg, err := s.recvOne()
+	if err != nil {
+		return err
+	}
+	req, err := decodeHelloRequest(msg)
+	if err != nil {
+		return err
+	}
+	count := req.count
+	switch {
+	case count == 0:
+		count = defaultCount
+	case count < 0 || count > maxCount:
+		return statusErrorf(codeInvalidArgument, "count must be from 1 to %d", maxCount)
+	}
+	interval := defaultInterval
+	switch {
+	case req.intervalMS > 0:
+		interval = time.Duration(req.intervalMS) * time.Millisecond
+	case req.intervalMS < 0:
+		return statusErrorf(codeInvalidArgument, "interval_ms must not be negative")
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for i := 1; i <= count; i++ {
+		if err := s.send(helloReply(fmt.Sprintf("Hello, %s! (%d/%d)", req.name, i, count))); err != nil {
+			return err
+		}
+		if i == count {
+			break
+		}
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			return s.ended()
+		case <-s.shutdown.Done():
+			return s.ended()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gRPC status codes returned by the services
+const (
+	codeOK                = 0
+	codeCanceled          = 1
+	codeInvalidArgument   = 3
+	codeDeadlineExceeded  = 4
+	codeNotFound          = 5
+	codeResourceExhausted = 8
+	codeUnimplemented     = 12
+	codeInternal          = 13
+	codeUnavailable       = 14
+)
+
+// maxMessageSize bounds the size of a received message
+const maxMessageSize = 4 << 20
+
+// statusError is a failed call with its gRPC status
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string { return e.msg }
+
+// statusErrorf returns a statusError with a formatted message
+func statusErrorf(code int, format string, args ...any) error {
+	return &statusError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// method is a handler of a call, reading its requests from the stream and
+// writing its responses to it
+type method func(s *stream) error
+
+// grpcServer routes gRPC calls over HTTP/2 to the methods registered by
+// their full name, such as /greeter.v1.Greeter/SayHello
+type grpcServer struct {
+	methods  map[string]method
+	shutdown context.Context // done once the server starts shutting down
+}
+
+// ServeHTTP runs a call and reports its status in the trailers
+func (g *grpcServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if r.ProtoMajor != 2 || r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC requires HTTP/2 POST requests of application/grpc", http.StatusUnsupportedMediaType)
+		log.Printf("%s %s %d", r.Method, r.URL.Path, http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+
+	ctx := r.Context()
+	if timeout, ok := parseTimeout(r.Header.Get("Grpc-Timeout")); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	s := &stream{w: w, r: r, rc: http.NewResponseController(w), ctx: ctx, shutdown: g.shutdown}
+
+	var err error
+	if m, ok := g.methods[r.URL.Path]; ok {
+		err = m(s)
+	} else {
+		err = statusErrorf(codeUnimplemented, "unknown method %s", r.URL.Path)
+	}
+
+	code, msg := codeOK, ""
+	var serr *statusError
+	switch {
+	case errors.As(err, &serr):
+		code, msg = serr.code, serr.msg
+	case err != nil:
+		code, msg = codeInternal, err.Error()
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set("Grpc-Message", encodeMessage(msg))
+	}
+	log.Printf("%s %d %s", r.URL.Path, code, time.Since(start).Round(time.Microsecond))
+}
+
+// parseTimeout reads a grpc-timeout header, such as 100m for 100
+// milliseconds
+func parseTimeout(v string) (time.Duration, bool) {
+	if len(v) < 2 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	units := map[byte]time.Duration{'H': time.Hour, 'M': time.Minute, 'S': time.Second, 'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond}
+	unit, ok := units[v[len(v)-1]]
+	return time.Duration(n) * unit, ok
+}
+
+// encodeMessage percent-encodes a status message as the protocol requires
+func encodeMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// stream reads and writes the length-prefixed messages of a call
+type stream struct {
+	w        http.ResponseWriter
+	r        *http.Request
+	rc       *http.ResponseController
+	ctx      context.Context // ends with the call, or at its deadline
+	shutdown context.Context
+}
+
+// ended returns the status of a call whose context is done: the server
+// shutting down, the deadline passing or the client giving up
+func (s *stream) ended() error {
+	switch {
+	case s.shutdown.Err() != nil:
+		return statusErrorf(codeUnavailable, "server shutting down")
+	case errors.Is(s.ctx.Err(), context.DeadlineExceeded):
+		return statusErrorf(codeDeadlineExceeded, "deadline exceeded")
+	default:
+		return statusErrorf(codeCanceled, "call canceled by the client")
+	}
+}
+
+// recv returns the next message, or io.EOF once the client is done
+func (s *stream) recv() ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(s.r.Body, header[:]); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, statusErrorf(codeInvalidArgument, "reading request: %v", err)
+	}
+	if header[0] != 0 {
+		return nil, statusErrorf(codeUnimplemented, "compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxMessageSize {
+		return nil, statusErrorf(codeResourceExhausted, "message of %d bytes exceeds the limit of %d", size, maxMessageSize)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(s.r.Body, msg); err != nil {
+		return nil, statusErrorf(codeInvalidArgument, "reading request: %v", err)
+	}
+	return msg, nil
+}
+
+// recvOne returns the only message of a unary or server-streaming call
+func (s *stream) recvOne() ([]byte, error) {
+	msg, err := s.recv()
+	if err == io.EOF {
+		return nil, statusErrorf(codeInvalidArgument, "missing request message")
+	}
+	return msg, err
+}
+
+// send writes a message and flushes it to the client
+func (s *stream) send(msg []byte) error {
+	frame := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg)))
+	if _, err := s.w.Write(append(frame, msg...)); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+// protoAppendVarint appends a varint field
+func protoAppendVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+// protoAppendBytes appends a length-delimited field
+func protoAppendBytes(b []byte, field int, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// protoAppendString appends a string field, leaving out empty ones
+func protoAppendString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return protoAppendBytes(b, field, []byte(s))
+}
+
+// protoDecode calls fn with the number and value of every varint and
+// length-delimited field of a message, skipping fixed-size ones
+func protoDecode(msg []byte, fn func(field int, v uint64, data []byte)) error {
+	malformed := statusErrorf(codeInvalidArgument, "malformed request message")
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return malformed
+		}
+		msg = msg[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return malformed
+			}
+			msg = msg[n:]
+			fn(field, v, nil)
+		case 1:
+			if len(msg) < 8 {
+				return malformed
+			}
+			msg = msg[8:]
+		case 2:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || size > uint64(len(msg)-n) {
+				return malformed
+			}
+			fn(field, 0, msg[n:n+int(size)])
+			msg = msg[n+int(size):]
+		case 5:
+			if len(msg) < 4 {
+				return malformed
+			}
+			msg = msg[4:]
+		default:
+			return malformed
+		}
+	}
+	return nil
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// This file reads the subset of proto3 used by greeter.proto, messages of
+// scalar or message fields and services, and generates its
+// FileDescriptorProto, so reflection always describes the file as written.
+
+// protoFile is a parsed .proto file
+type protoFile struct {
+	pkg      string
+	messages []protoMessage
+	services []protoService
+}
+
+type protoMessage struct {
+	name   string
+	fields []protoField
+}
+
+type protoField struct {
+	name     string
+	number   int
+	typ      int
+	typeName string // message fields only
+	repeated bool
+}
+
+type protoService struct {
+	name    string
+	methods []protoMethod
+}
+
+type protoMethod struct {
+	name, input, output string
+	clientStreaming     bool
+	serverStreaming     bool
+}
+
+// protoScalarTypes maps the scalar types of proto3 to their
+// FieldDescriptorProto.Type
+var protoScalarTypes = map[string]int{
+	"double": 1, "float": 2, "int64": 3, "uint64": 4, "int32": 5,
+	"fixed64": 6, "fixed32": 7, "bool": 8, "string": 9, "bytes": 12,
+	"uint32": 13, "sfixed32": 15, "sfixed64": 16, "sint32": 17, "sint64": 18,
+}
+
+// Field labels and the message type of descriptor.proto
+const (
+	typeMessage   = 11
+	labelOptional = 1
+	labelRepeated = 3
+)
+
+// mustParseProto parses an embedded .proto file, which can only fail when
+// the file was edited beyond the supported subset
+func mustParseProto(src string) *protoFile {
+	f, err := parseProto(src)
+	if err != nil {
+		panic(fmt.Sprintf("greeter.proto: %v", err))
+	}
+	return f
+}
+
+// parseProto parses src, returning an error for anything outside the
+// subset described above
+func parseProto(src string) (f *protoFile, err error) {
+	p := &protoParser{toks: protoTokens(src)}
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(protoSyntaxError)
+			if !ok {
+				panic(r)
+			}
+			f, err = nil, e
+		}
+	}()
+	f = &protoFile{}
+	p.expect("syntax")
+	p.expect("=")
+	if p.next() != `"proto3"` {
+		p.fail("only proto3 is supported")
+	}
+	p.expect(";")
+	for p.peek() != "" {
+		switch tok := p.next(); tok {
+		case "package":
+			f.pkg = p.next()
+			p.expect(";")
+		case "message":
+			f.messages = append(f.messages, p.message())
+		case "service":
+			f.services = append(f.services, p.service())
+		default:
+			p.fail("unsupported %q", tok)
+		}
+	}
+	messages := make(map[string]bool)
+	for _, m := range f.messages {
+		messages[m.name] = true
+	}
+	for i, m := range f.messages {
+		for j, fd := range m.fields {
+			if fd.typ != typeMessage {
+				continue
+			}
+			if !messages[fd.typeName] {
+				return nil, fmt.Errorf("message %s: unknown type %s", m.name, fd.typeName)
+			}
+			f.messages[i].fields[j].typeName = "." + f.pkg + "." + fd.typeName
+		}
+	}
+	for _, s := range f.services {
+		for _, m := range s.methods {
+			if !messages[m.input] || !messages[m.output] {
+				return nil, fmt.Errorf("rpc %s.%s: unknown message type", s.name, m.name)
+			}
+		}
+	}
+	return f, nil
+}
+
+// protoTokens splits src into identifiers, numbers, strings and
+// punctuation, dropping the comments
+func protoTokens(src string) []string {
+	var toks []string
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case strings.HasPrefix(src[i:], "//"):
+			if n := strings.IndexByte(src[i:], '\n'); n >= 0 {
+				i += n
+			} else {
+				i = len(src)
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			if n := strings.Index(src[i+2:], "*/"); n >= 0 {
+				i += n + 4
+			} else {
+				i = len(src)
+			}
+		case c == '"':
+			n := strings.IndexByte(src[i+1:], '"')
+			if n < 0 {
+				n = len(src) - i - 1
+			}
+			toks = append(toks, src[i:min(i+n+2, len(src))])
+			i += n + 2
+		case c == '_' || c == '.' || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)):
+			j := i
+			for j < len(src) && (src[j] == '_' || src[j] == '.' || unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j]))) {
+				j++
+			}
+			toks = append(toks, src[i:j])
+			i = j
+		default:
+			toks = append(toks, src[i:i+1])
+			i++
+		}
+	}
+	return toks
+}
+
+// protoSyntaxError reports a failed parse, raised as a panic
+type protoSyntaxError string
+
+func (e protoSyntaxError) Error() string { return string(e) }
+
+type protoParser struct {
+	toks []string
+	pos  int
+}
+
+func (p *protoParser) fail(format string, args ...any) {
+	panic(protoSyntaxError(fmt.Sprintf("token %d: %s", p.pos, fmt.Sprintf(format, args...))))
+}
+
+func (p *protoParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *protoParser) next() string {
+	tok := p.peek()
+	if tok == "" {
+		p.fail("unexpected end")
+	}
+	p.pos++
+	return tok
+}
+
+func (p *protoParser) expect(tok string) {
+	if got := p.next(); got != tok {
+		p.fail("expected %q, found %q", tok, got)
+	}
+}
+
+// message parses a message after its keyword
+func (p *protoParser) message() protoMessage {
+	m := protoMessage{name: p.next()}
+	p.expect("{")
+	for p.peek() != "}" {
+		var fd protoField
+		typ := p.next()
+		if typ == "repeated" {
+			fd.repeated, typ = true, p.next()
+		}
+		if t, ok := protoScalarTypes[typ]; ok {
+			fd.typ = t
+		} else {
+			fd.typ, fd.typeName = typeMessage, typ
+		}
+		fd.name = p.next()
+		p.expect("=")
+		n, err := strconv.Atoi(p.next())
+		if err != nil || n < 1 || n > 1<<29-1 {
+			p.fail("invalid field number of %s.%s", m.name, fd.name)
+		}
+		fd.number = n
+		p.expect(";")
+		m.fields = append(m.fields, fd)
+	}
+	p.expect("}")
+	return m
+}
+
+// service parses a service after its keyword
+func (p *protoParser) service() protoService {
+	s := protoService{name: p.next()}
+	p.expect("{")
+	for p.peek() != "}" {
+		p.expect("rpc")
+		m := protoMethod{name: p.next()}
+		p.expect("(")
+		if p.peek() == "stream" {
+			p.next()
+			m.clientStreaming = true
+		}
+		m.input = p.next()
+		p.expect(")")
+		p.expect("returns")
+		p.expect("(")
+		if p.peek() == "stream" {
+			p.next()
+			m.serverStreaming = true
+		}
+		m.output = p.next()
+		p.expect(")")
+		p.expect(";")
+		s.methods = append(s.methods, m)
+	}
+	p.expect("}")
+	return s
+}
+
+// descriptor returns the file as a serialized FileDescriptorProto
+func (f *protoFile) descriptor(name string) []byte {
+	b := protoAppendString(nil, 1, name)
+	b = protoAppendString(b, 2, f.pkg)
+	for _, m := range f.messages {
+		msg := protoAppendString(nil, 1, m.name)
+		for _, fd := range m.fields {
+			field := protoAppendString(nil, 1, fd.name)
+			field = protoAppendVarint(field, 3, uint64(fd.number))
+			label := labelOptional
+			if fd.repeated {
+				label = labelRepeated
+			}
+			field = protoAppendVarint(field, 4, uint64(label))
+			field = protoAppendVarint(field, 5, uint64(fd.typ))
+			field = protoAppendString(field, 6, fd.typeName)
+			field = protoAppendString(field, 10, protoJSONName(fd.name))
+			msg = protoAppendBytes(msg, 2, field)
+		}
+		b = protoAppendBytes(b, 4, msg)
+	}
+	for _, s := range f.services {
+		service := protoAppendString(nil, 1, s.name)
+		for _, m := range s.methods {
+			method := protoAppendString(nil, 1, m.name)
+			method = protoAppendString(method, 2, "."+f.pkg+"."+m.input)
+			method = protoAppendString(method, 3, "."+f.pkg+"."+m.output)
+			if m.clientStreaming {
+				method = protoAppendVarint(method, 5, 1)
+			}
+			if m.serverStreaming {
+				method = protoAppendVarint(method, 6, 1)
+			}
+			service = protoAppendBytes(service, 2, method)
+		}
+		b = protoAppendBytes(b, 6, service)
+	}
+	return protoAppendString(b, 12, "proto3")
+}
+
+// symbols returns the fully qualified names the file defines
+func (f *protoFile) symbols() []string {
+	var names []string
+	for _, s := range f.services {
+		names = append(names, f.pkg+"."+s.name)
+		for _, m := range s.methods {
+			names = append(names, f.pkg+"."+s.name+"."+m.name)
+		}
+	}
+	for _, m := range f.messages {
+		names = append(names, f.pkg+"."+m.name)
+	}
+	return names
+}
+
+// protoJSONName is the lowerCamelCase name protoc gives a field in JSON
+func protoJSONName(name string) string {
+	var b strings.Builder
+	upper := false
+	for _, c := range name {
+		if c == '_' {
+			upper = true
+			continue
+		}
+		if upper {
+			c = unicode.ToUpper(c)
+		}
+		upper = false
+		b.WriteRune(c)
+	}
+	return b.String()
+}
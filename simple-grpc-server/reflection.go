@@ -0,0 +1,113 @@
+package main
+
+import (
+	_ "embed"
+	"io"
+	"slices"
+	"strings"
+)
+
+// The reflection services answering clients such as grpcurl and Postman
+// that have no copy of greeter.proto. Both versions share their messages.
+const (
+	reflectionService      = "grpc.reflection.v1.ServerReflection"
+	reflectionServiceAlpha = "grpc.reflection.v1alpha.ServerReflection"
+)
+
+// greeterFile is the name under which greeter.proto is described
+const greeterFile = "greeter.proto"
+
+// protoPackage is the package of greeter.proto
+const protoPackage = "greeter.v1"
+
+//go:embed greeter.proto
+var greeterSource string
+
+// greeterProto is greeter.proto parsed at startup. The descriptor sent by
+// reflection is generated from it rather than kept by hand, so it always
+// matches the file.
+var greeterProto = mustParseProto(greeterSource)
+
+var (
+	// greeterDescriptor is greeter.proto as a serialized FileDescriptorProto
+	greeterDescriptor = greeterProto.descriptor(greeterFile)
+	// greeterSymbols are the fully qualified names defined by greeter.proto
+	greeterSymbols = greeterProto.symbols()
+)
+
+func init() {
+	// The methods are routed by name, which greeter.proto must still define
+	for _, name := range []string{greeterService + ".SayHello", greeterService + ".SayHelloStream"} {
+		if !slices.Contains(greeterSymbols, name) {
+			panic("greeter.proto does not define " + name)
+		}
+	}
+}
+
+// serverReflectionInfo implements the bidirectional ServerReflectionInfo
+// method, answering each request of the client as it comes
+func serverReflectionInfo(s *stream) error {
+	for {
+		msg, err := s.recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var host, filename, symbol, extendee string
+		var listServices, extension bool
+		err = protoDecode(msg, func(field int, v uint64, data []byte) {
+			switch field {
+			case 1:
+				host = string(data)
+			case 3:
+				filename = string(data)
+			case 4:
+				symbol = strings.TrimPrefix(string(data), ".")
+			case 5:
+				extension = true
+			case 6:
+				extendee = strings.TrimPrefix(string(data), ".")
+			case 7:
+				listServices = true
+			}
+		})
+		if err != nil {
+			return err
+		}
+
+		resp := protoAppendString(nil, 1, host)
+		resp = protoAppendBytes(resp, 2, msg)
+		switch {
+		case listServices:
+			// The reflection services are left out, as they have no
+			// descriptor to describe them with
+			service := protoAppendString(nil, 1, greeterService)
+			resp = protoAppendBytes(resp, 6, protoAppendBytes(nil, 1, service))
+		case filename == greeterFile, symbol != "" && slices.Contains(greeterSymbols, symbol):
+			resp = protoAppendBytes(resp, 4, protoAppendBytes(nil, 1, greeterDescriptor))
+		case extendee != "" && slices.Contains(greeterSymbols, extendee):
+			// greeter.proto declares no extensions
+			resp = protoAppendBytes(resp, 5, protoAppendString(nil, 1, extendee))
+		case filename != "":
+			resp = reflectionError(resp, codeNotFound, "file "+filename+" not found")
+		case symbol != "":
+			resp = reflectionError(resp, codeNotFound, "symbol "+symbol+" not found")
+		case extension, extendee != "":
+			resp = reflectionError(resp, codeNotFound, "extension not found")
+		default:
+			resp = reflectionError(resp, codeUnimplemented, "unsupported reflection request")
+		}
+		if err := s.send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// reflectionError appends the ErrorResponse of a failed request
+func reflectionError(resp []byte, code int, msg string) []byte {
+	e := protoAppendVarint(nil, 1, uint64(code))
+	e = protoAppendString(e, 2, msg)
+	return protoAppendBytes(resp, 7, e)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	// Parse CLI arguments
+	addr := flag.String("addr", "0.0.0.0", "IP Address to bind to")
+	port := flag.String("port", "50051", "Port to bind to")
+	reflection := flag.Bool("reflection", true, "Answer server reflection requests, so clients such as grpcurl need no copy of greeter.proto")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "How long to wait for calls in progress when shutting down")
+	flag.Parse()
+
+	// Register the methods by their full name
+	shutdown, beginShutdown := context.WithCancel(context.Background())
+	grpc := &grpcServer{
+		methods: map[string]method{
+			"/" + greeterService + "/SayHello":       sayHello,
+			"/" + greeterService + "/SayHelloStream": sayHelloStream,
+		},
+		shutdown: shutdown,
+	}
+	if *reflection {
+		grpc.methods["/"+reflectionService+"/ServerReflectionInfo"] = serverReflectionInfo
+		grpc.methods["/"+reflectionServiceAlpha+"/ServerReflectionInfo"] = serverReflectionInfo
+	}
+
+	// Configure server, speaking HTTP/2 without TLS as gRPC clients do
+	// unless told otherwise
+	server := &http.Server{
+		Addr:      net.JoinHostPort(*addr, *port),
+		Handler:   grpc,
+		Protocols: new(http.Protocols),
+	}
+	server.Protocols.SetUnencryptedHTTP2(true)
+
+	// Start server in a goroutine
+	go func() {
+		log.Printf("Starting gRPC server on %s (reflection %t)", server.Addr, *reflection)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalf("Error starting server: %v", err)
+		}
+	}()
+
+	// Set up graceful shutdown
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	// Wait for CTRL+C
+	<-stop
+
+	// Streams in progress end with UNAVAILABLE, and unary calls are given
+	// the time to finish
+	log.Println("Shutting down server...")
+	beginShutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down server, closing the remaining connections: %v", err)
+		server.Close()
+	}
+	log.Println("Server stopped")
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeffersfp/golang-studies/simple-http-server/httpserve"
+)
+
+// benchResult collects what a single load-testing worker observed
+type benchResult struct {
+	latencies []time.Duration
+	statuses  map[int]int
+	errors    int
+	bytes     int64
+}
+
+// runBench implements the bench subcommand, which sends requests to a
+// running server from several workers and reports throughput and latency
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	target := fs.String("url", "", "URL to request (required)")
+	concurrency := fs.Int("concurrency", 10, "Number of concurrent workers")
+	duration := fs.Duration("duration", 10*time.Second, "How long to send requests")
+	method := fs.String("method", http.MethodGet, "Request method")
+	timeout := fs.Duration("timeout", 30*time.Second, "Timeout of each request")
+	keepAlive := fs.Bool("keep-alive", true, "Reuse connections between requests")
+	var headers []string
+	fs.Func("header", "Extra request header as 'Name: value' (repeatable)", func(value string) error {
+		headers = append(headers, value)
+		return nil
+	})
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s bench --url URL [options]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *target == "" || *concurrency < 1 || *duration <= 0 {
+		fs.Usage()
+		return 2
+	}
+	req, err := http.NewRequest(*method, *target, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error in bench options: %v\n", err)
+		return 2
+	}
+	for _, h := range headers {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			fmt.Fprintf(os.Stderr, "Error in bench options: invalid header %q\n", h)
+			return 2
+		}
+		req.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	transport := &http.Transport{
+		MaxIdleConnsPerHost: *concurrency,
+		DisableKeepAlives:   !*keepAlive,
+		DisableCompression:  true,
+	}
+	client := &http.Client{Transport: transport, Timeout: *timeout}
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+
+	fmt.Printf("Benchmarking %s %s with %d workers for %s\n", *method, *target, *concurrency, *duration)
+	results := make([]benchResult, *concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range results {
+		wg.Add(1)
+		go func(res *benchResult) {
+			defer wg.Done()
+			res.statuses = make(map[int]int)
+			for ctx.Err() == nil {
+				began := time.Now()
+				resp, err := client.Do(req.Clone(ctx))
+				if err != nil {
+					if !errors.Is(err, context.DeadlineExceeded) {
+						res.errors++
+					}
+					continue
+				}
+				n, err := io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if err != nil && ctx.Err() != nil {
+					continue
+				}
+				res.bytes += n
+				res.latencies = append(res.latencies, time.Since(began))
+				res.statuses[resp.StatusCode]++
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	transport.CloseIdleConnections()
+
+	printBenchReport(results, elapsed)
+	return 0
+}
+
+// printBenchReport merges the worker results and prints the summary
+func printBenchReport(results []benchResult, elapsed time.Duration) {
+	var latencies []time.Duration
+	statuses := make(map[int]int)
+	errs := 0
+	var bytes int64
+	for _, res := range results {
+		latencies = append(latencies, res.latencies...)
+		for code, n := range res.statuses {
+			statuses[code] += n
+		}
+		errs += res.errors
+		bytes += res.bytes
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	seconds := elapsed.Seconds()
+	fmt.Printf("\nRequests:    %d completed, %d failed in %s\n", len(latencies), errs, elapsed.Round(time.Millisecond))
+	fmt.Printf("Throughput:  %.1f req/s, %s/s\n", float64(len(latencies))/seconds, httpserve.FormatSize(int64(float64(bytes)/seconds)))
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Printf("Status %d:  %d\n", code, statuses[code])
+	}
+	if len(latencies) == 0 {
+		return
+	}
+	fmt.Println("Latency:")
+	for _, p := range []float64{50, 90, 95, 99, 99.9} {
+		fmt.Printf("  p%-5g %s\n", p, percentile(latencies, p).Round(time.Microsecond))
+	}
+	fmt.Printf("  max    %s\n", latencies[len(latencies)-1].Round(time.Microsecond))
+}
+
+// percentile returns the p-th percentile of sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(float64(len(sorted))*p/100+0.5) - 1
+	return sorted[min(max(i, 0), len(sorted)-1)]
+}
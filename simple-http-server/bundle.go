@@ -0,0 +1,255 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// serverSource is the source of this program, written out by the bundle
+// subcommand next to the embedded content
+//
+//go:embed *.go httpserve/*.go
+var serverSource embed.FS
+
+// bundleFile is the generated file embedding the content of a bundle
+const bundleFile = "bundle_content.go"
+
+// bundledContent and bundledArgs are set by the generated bundle file.
+// When bundledContent is set the server serves it instead of --dir, with
+// bundledArgs applied before the command line arguments.
+var (
+	bundledContent fs.FS
+	bundledArgs    []string
+)
+
+// bundleTemplate is the generated file embedding the content directory
+const bundleTemplate = `// Code generated by simple-http-server bundle. DO NOT EDIT.
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed all:content
+var bundleFiles embed.FS
+
+func init() {
+	bundledContent, _ = fs.Sub(bundleFiles, "content")
+	bundledArgs = %s
+}
+`
+
+// runBundle implements the bundle subcommand, which writes a copy of this
+// program embedding a directory and builds it into a single binary
+func runBundle(args []string) int {
+	flags := flag.NewFlagSet("bundle", flag.ContinueOnError)
+	dir := flags.String("dir", ".", "Directory to embed")
+	output := flags.String("output", "", "Binary to build (default: the directory name with a -server suffix)")
+	src := flags.String("src", "", "Write the generated Go program to this directory and keep it (default: a temporary directory)")
+	goCmd := flags.String("go", "go", "Go command used to build the binary")
+	noBuild := flags.Bool("no-build", false, "Only write the Go program to --src, without building it")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s bundle --dir DIR [options] [-- server flags]\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Server flags after -- become the defaults of the bundled binary.\n\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	serverArgs := flags.Args()
+	if len(serverArgs) > 0 && serverArgs[0] == "--" {
+		serverArgs = serverArgs[1:]
+	}
+	if *noBuild && *src == "" {
+		fmt.Fprintln(os.Stderr, "Error in bundle options: --no-build requires --src")
+		return 2
+	}
+
+	absDir, err := filepath.Abs(*dir)
+	if err == nil {
+		_, err = os.Stat(absDir)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error in bundle options: %v\n", err)
+		return 2
+	}
+	if *output == "" {
+		*output = filepath.Base(absDir) + "-server"
+	}
+	if !*noBuild {
+		if _, err := exec.LookPath(*goCmd); err != nil {
+			fmt.Fprintf(os.Stderr, "Error in bundle options: building needs the Go toolchain (%v), use --src and --no-build to only write the program\n", err)
+			return 2
+		}
+	}
+
+	srcDir := *src
+	if srcDir == "" {
+		srcDir, err = os.MkdirTemp("", "simple-http-server-bundle-*")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating bundle: %v\n", err)
+			return 1
+		}
+		defer os.RemoveAll(srcDir)
+	}
+	files, err := writeBundle(srcDir, absDir, serverArgs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating bundle: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Embedded %d files from %s\n", files, absDir)
+	if *noBuild {
+		fmt.Printf("Wrote the Go program to %s, build it with: cd %s && go mod tidy && go build\n", srcDir, srcDir)
+		return 0
+	}
+
+	absOutput, err := filepath.Abs(*output)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating bundle: %v\n", err)
+		return 1
+	}
+	for _, step := range [][]string{{"mod", "tidy"}, {"build", "-trimpath", "-o", absOutput, "."}} {
+		cmd := exec.Command(*goCmd, step...)
+		cmd.Dir = srcDir
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+		if err := cmd.Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error building bundle: go %s: %v\n", strings.Join(step, " "), err)
+			return 1
+		}
+	}
+	fmt.Printf("Built %s\n", absOutput)
+	return 0
+}
+
+// writeBundle writes the server source, a go.mod pinning the dependencies
+// this binary was built with and the embedded copy of dir into srcDir,
+// returning the number of files embedded
+func writeBundle(srcDir, dir string, serverArgs []string) (int, error) {
+	contentDir := filepath.Join(srcDir, "content")
+	if err := os.RemoveAll(contentDir); err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(contentDir, 0o755); err != nil {
+		return 0, err
+	}
+
+	err := fs.WalkDir(serverSource, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || name == bundleFile {
+			return err
+		}
+		if d.IsDir() {
+			return os.MkdirAll(filepath.Join(srcDir, name), 0o755)
+		}
+		data, err := serverSource.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(srcDir, name), data, 0o644)
+	})
+	if err != nil {
+		return 0, err
+	}
+	quoted := make([]string, len(serverArgs))
+	for i, arg := range serverArgs {
+		quoted[i] = strconv.Quote(arg)
+	}
+	generated := fmt.Sprintf(bundleTemplate, "[]string{"+strings.Join(quoted, ", ")+"}")
+	if err := os.WriteFile(filepath.Join(srcDir, bundleFile), []byte(generated), 0o644); err != nil {
+		return 0, err
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "go.mod"), []byte(bundleGoMod()), 0o644); err != nil {
+		return 0, err
+	}
+	return copyTree(dir, contentDir)
+}
+
+// bundleGoMod returns a go.mod requiring the module versions recorded in
+// this binary's build information, named like this module so the program
+// builds against its own copy of the httpserve package
+func bundleGoMod() string {
+	var b strings.Builder
+	b.WriteString("module github.com/jeffersfp/golang-studies/simple-http-server\n\n")
+	goVersion := "1.24"
+	info, ok := debug.ReadBuildInfo()
+	if ok && strings.HasPrefix(info.GoVersion, "go") {
+		goVersion = strings.TrimPrefix(info.GoVersion, "go")
+	}
+	fmt.Fprintf(&b, "go %s\n", goVersion)
+	if !ok {
+		return b.String()
+	}
+	for _, dep := range info.Deps {
+		fmt.Fprintf(&b, "\nrequire %s %s\n", dep.Path, dep.Version)
+		if r := dep.Replace; r != nil {
+			// Directory replacements have no version, or (devel)
+			if r.Version == "" || r.Version == "(devel)" {
+				fmt.Fprintf(&b, "replace %s => %s\n", dep.Path, r.Path)
+			} else {
+				fmt.Fprintf(&b, "replace %s => %s %s\n", dep.Path, r.Path, r.Version)
+			}
+		}
+	}
+	return b.String()
+}
+
+// copyTree copies the regular files below src into dst, following
+// symlinks to files, and returns how many it copied
+func copyTree(src, dst string) (int, error) {
+	files := 0
+	err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0o755)
+		}
+		info, err := os.Stat(p)
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		if err := copyFile(p, target); err != nil {
+			return err
+		}
+		files++
+		return nil
+	})
+	if err == nil && files == 0 {
+		err = errors.New("no files to embed")
+	}
+	return files, err
+}
+
+// copyFile copies the contents of the file src to dst
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
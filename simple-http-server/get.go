@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jeffersfp/golang-studies/simple-http-server/httpserve"
+)
+
+// getMinPart is the smallest part fetched by a connection of its own
+const getMinPart = 1 << 20
+
+// errChanged is returned when If-Range finds the file changed since the
+// first parts were fetched
+var errChanged = errors.New("the file changed on the server")
+
+// getState is kept next to a partial download to resume it
+type getState struct {
+	URL       string    `json:"url"`
+	Size      int64     `json:"size"`
+	Validator string    `json:"validator"` // ETag or Last-Modified of the fetched parts
+	Parts     []getPart `json:"parts"`
+}
+
+// getPart is a byte range fetched by one connection
+type getPart struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"` // exclusive
+	Done  int64 `json:"done"`
+}
+
+// getChecksum is the checksum a download is verified against
+type getChecksum struct {
+	algo string
+	new  func() hash.Hash
+	want []byte
+}
+
+// getAlgorithms are the --checksum algorithms, by name and digest length
+var getAlgorithms = []struct {
+	name string
+	new  func() hash.Hash
+	size int
+}{
+	{"sha256", sha256.New, sha256.Size},
+	{"sha512", sha512.New, sha512.Size},
+	{"sha1", sha1.New, sha1.Size},
+	{"md5", md5.New, md5.Size},
+}
+
+// parseChecksum parses ALGO:HEX, or a bare hex digest named by its length
+func parseChecksum(spec string) (*getChecksum, error) {
+	algo, digest, ok := strings.Cut(spec, ":")
+	if !ok {
+		algo, digest = "", spec
+	}
+	want, err := hex.DecodeString(strings.TrimSpace(digest))
+	if err != nil {
+		return nil, fmt.Errorf("invalid --checksum %q: %v", spec, err)
+	}
+	for _, a := range getAlgorithms {
+		if strings.EqualFold(algo, a.name) || algo == "" && len(want) == a.size {
+			if len(want) != a.size {
+				return nil, fmt.Errorf("invalid --checksum %q: a %s digest has %d hex digits", spec, a.name, 2*a.size)
+			}
+			return &getChecksum{algo: a.name, new: a.new, want: want}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid --checksum %q, expected sha256, sha512, sha1 or md5", spec)
+}
+
+// getDownload is a download in progress
+type getDownload struct {
+	client    *http.Client
+	url       string
+	header    http.Header
+	statePath string
+	f         *os.File
+
+	mu    sync.Mutex
+	state getState
+}
+
+// runGet implements the get subcommand, which downloads a file over
+// parallel range requests and resumes where an interrupted run stopped
+func runGet(args []string) int {
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	output := fs.String("output", "", "File to write (default: the last element of the URL path)")
+	connections := fs.Int("connections", 4, "Number of parallel range requests")
+	checksum := fs.String("checksum", "", "Verify the download against ALGO:HEX, with sha256, sha512, sha1 or md5 (a bare digest is told by its length)")
+	retries := fs.Int("retries", 3, "Times to retry a part after a failed request")
+	timeout := fs.Duration("timeout", 30*time.Second, "Timeout waiting for each response to start")
+	quiet := fs.Bool("quiet", false, "Don't print progress")
+	var headers []string
+	fs.Func("header", "Extra request header as 'Name: value' (repeatable)", func(value string) error {
+		headers = append(headers, value)
+		return nil
+	})
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s get [options] URL\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 || *connections < 1 || *retries < 0 {
+		fs.Usage()
+		return 2
+	}
+	u, err := url.Parse(fs.Arg(0))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fmt.Fprintf(os.Stderr, "Error in get options: invalid URL %q, expected an http or https URL\n", fs.Arg(0))
+		return 2
+	}
+	var sum *getChecksum
+	if *checksum != "" {
+		if sum, err = parseChecksum(*checksum); err != nil {
+			fmt.Fprintf(os.Stderr, "Error in get options: %v\n", err)
+			return 2
+		}
+	}
+	header := make(http.Header)
+	for _, h := range headers {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			fmt.Fprintf(os.Stderr, "Error in get options: invalid header %q\n", h)
+			return 2
+		}
+		header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	out := *output
+	if out == "" {
+		out = path.Base(u.Path)
+		if out == "/" || out == "." {
+			out = "index.html"
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	d := &getDownload{
+		client: &http.Client{Transport: &http.Transport{
+			MaxIdleConnsPerHost:   *connections,
+			ResponseHeaderTimeout: *timeout,
+			DisableCompression:    true,
+		}},
+		url:       u.String(),
+		header:    header,
+		statePath: out + ".part.json",
+	}
+	start := time.Now()
+	err = d.run(ctx, out+".part", *connections, *retries, *quiet)
+	if errors.Is(err, errChanged) {
+		fmt.Fprintln(os.Stderr, "The file changed on the server, starting over")
+		os.Remove(d.statePath)
+		err = d.run(ctx, out+".part", *connections, *retries, *quiet)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			fmt.Fprintf(os.Stderr, "Interrupted after %s; run the same command again to resume\n", httpserve.FormatSize(d.done()))
+		} else {
+			fmt.Fprintf(os.Stderr, "Error downloading %s: %v\n", d.url, err)
+		}
+		return 1
+	}
+	if sum != nil {
+		if err := sum.verify(out + ".part"); err != nil {
+			// A resume can't fix what was fetched wrong, so start over next time
+			os.Remove(out + ".part")
+			fmt.Fprintf(os.Stderr, "Error verifying %s: %v\n", out, err)
+			return 1
+		}
+	}
+	if err := os.Rename(out+".part", out); err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving %s: %v\n", out, err)
+		return 1
+	}
+	fmt.Printf("Saved %s (%s) in %s\n", out, httpserve.FormatSize(d.done()), time.Since(start).Round(time.Millisecond))
+	if sum != nil {
+		fmt.Printf("Checksum %s %s ok\n", sum.algo, hex.EncodeToString(sum.want))
+	}
+	return 0
+}
+
+// run downloads the file into part, resuming from the saved state when it
+// is for the same file
+func (d *getDownload) run(ctx context.Context, part string, connections, retries int, quiet bool) error {
+	// A one byte range tells the size and whether ranges are supported
+	req, err := d.request(ctx, "bytes=0-0", "")
+	if err != nil {
+		return err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	size := int64(-1)
+	switch resp.StatusCode {
+	case http.StatusRequestedRangeNotSatisfiable:
+		// No range fits in an empty file
+		if resp.Header.Get("Content-Range") == "bytes */0" {
+			size = 0
+		}
+	case http.StatusPartialContent:
+		_, total, _ := strings.Cut(resp.Header.Get("Content-Range"), "/")
+		if size, err = strconv.ParseInt(total, 10, 64); err != nil {
+			size = -1
+		}
+	}
+	if size < 0 {
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("server answered %s", resp.Status)
+		}
+		// Without ranges the body is the whole file, fetched in one go
+		defer resp.Body.Close()
+		return d.stream(ctx, part, resp, quiet)
+	}
+	resp.Body.Close()
+
+	validator := resp.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		// If-Range only takes strong validators, or a date
+		validator = resp.Header.Get("Last-Modified")
+	}
+	d.state = getState{}
+	if validator != "" {
+		if data, err := os.ReadFile(d.statePath); err == nil {
+			var saved getState
+			if json.Unmarshal(data, &saved) == nil && saved.URL == d.url && saved.Size == size && saved.Validator == validator {
+				d.state = saved
+			}
+		}
+	}
+	flags := os.O_RDWR | os.O_CREATE
+	if d.state.Parts == nil {
+		flags |= os.O_TRUNC
+		d.state = getState{URL: d.url, Size: size, Validator: validator, Parts: splitParts(size, connections)}
+	}
+	if d.f, err = os.OpenFile(part, flags, 0o644); err != nil {
+		return err
+	}
+	defer d.f.Close()
+	if err := d.f.Truncate(size); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make([]error, len(d.state.Parts))
+	var wg sync.WaitGroup
+	for i := range d.state.Parts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for attempt := 0; ; attempt++ {
+				err := d.fetch(ctx, i)
+				if err == nil || errors.Is(err, errChanged) || ctx.Err() != nil || attempt == retries {
+					if err != nil {
+						errs[i] = err
+						cancel()
+					}
+					return
+				}
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Duration(attempt+1) * time.Second):
+				}
+			}
+		}(i)
+	}
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	p := newGetProgress(size, d.done(), quiet)
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for running := true; running; {
+		select {
+		case <-finished:
+			running = false
+		case <-ticker.C:
+			p.print(d.done())
+			if validator != "" {
+				d.save()
+			}
+		}
+	}
+	p.finish(d.done())
+	err = errors.Join(errs...)
+	for _, e := range errs {
+		if errors.Is(e, errChanged) {
+			err = errChanged
+		}
+	}
+	if err != nil {
+		if validator != "" && !errors.Is(err, errChanged) {
+			d.save()
+		}
+		return err
+	}
+	os.Remove(d.statePath)
+	return d.f.Sync()
+}
+
+// splitParts divides size bytes between at most n connections
+func splitParts(size int64, n int) []getPart {
+	n = int(min(int64(n), max(size/getMinPart, 1)))
+	parts := make([]getPart, n)
+	for i := range parts {
+		parts[i] = getPart{Start: size * int64(i) / int64(n), End: size * int64(i+1) / int64(n)}
+	}
+	return parts
+}
+
+// fetch fetches what is left of part i
+func (d *getDownload) fetch(ctx context.Context, i int) error {
+	d.mu.Lock()
+	p := d.state.Parts[i]
+	d.mu.Unlock()
+	offset := p.Start + p.Done
+	if offset >= p.End {
+		return nil
+	}
+	req, err := d.request(ctx, fmt.Sprintf("bytes=%d-%d", offset, p.End-1), d.state.Validator)
+	if err != nil {
+		return err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			return fmt.Errorf("server answered range %q for bytes %d-", resp.Header.Get("Content-Range"), offset)
+		}
+	case http.StatusOK:
+		if d.state.Validator != "" {
+			return errChanged
+		}
+		return errors.New("server stopped answering range requests")
+	default:
+		return fmt.Errorf("server answered %s", resp.Status)
+	}
+	buf := make([]byte, 32<<10)
+	for offset < p.End {
+		n, err := resp.Body.Read(buf[:min(int64(len(buf)), p.End-offset)])
+		if n > 0 {
+			if _, err := d.f.WriteAt(buf[:n], offset); err != nil {
+				return err
+			}
+			offset += int64(n)
+			d.mu.Lock()
+			d.state.Parts[i].Done += int64(n)
+			d.mu.Unlock()
+		}
+		if err == io.EOF && offset < p.End {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+	return nil
+}
+
+// stream writes the whole body of resp into part
+func (d *getDownload) stream(ctx context.Context, part string, resp *http.Response, quiet bool) error {
+	f, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	d.state = getState{Size: resp.ContentLength, Parts: []getPart{{End: resp.ContentLength}}}
+	p := newGetProgress(resp.ContentLength, 0, quiet)
+	buf := make([]byte, 32<<10)
+	last := time.Now()
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := f.Write(buf[:n]); err != nil {
+				return err
+			}
+			d.mu.Lock()
+			d.state.Parts[0].Done += int64(n)
+			d.mu.Unlock()
+		}
+		if time.Since(last) >= 500*time.Millisecond {
+			p.print(d.done())
+			last = time.Now()
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				// Nothing can be resumed without ranges
+				os.Remove(part)
+			}
+			return err
+		}
+	}
+	p.finish(d.done())
+	return f.Sync()
+}
+
+// request builds a request for a range of the file
+func (d *getDownload) request(ctx context.Context, byteRange, ifRange string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = d.header.Clone()
+	req.Header.Set("Range", byteRange)
+	if ifRange != "" {
+		req.Header.Set("If-Range", ifRange)
+	}
+	return req, nil
+}
+
+// done returns the bytes fetched
+func (d *getDownload) done() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var n int64
+	for _, p := range d.state.Parts {
+		n += p.Done
+	}
+	return n
+}
+
+// save writes the state next to the partial file, only counting what was
+// written to it
+func (d *getDownload) save() {
+	d.mu.Lock()
+	data, err := json.Marshal(d.state)
+	d.mu.Unlock()
+	if err == nil {
+		tmp := d.statePath + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o644); err == nil {
+			err = os.Rename(tmp, d.statePath)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nError saving %s: %v\n", d.statePath, err)
+	}
+}
+
+// verify compares the checksum of a file with the expected one
+func (c *getChecksum) verify(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := c.new()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := h.Sum(nil); !bytes.Equal(got, c.want) {
+		return fmt.Errorf("%s is %x, expected %x", c.algo, got, c.want)
+	}
+	return nil
+}
+
+// getProgress prints the progress of a download on stderr
+type getProgress struct {
+	size  int64 // -1 when unknown
+	from  int64 // bytes fetched by an earlier run
+	start time.Time
+	quiet bool
+}
+
+func newGetProgress(size, from int64, quiet bool) *getProgress {
+	if !quiet && from > 0 {
+		fmt.Fprintf(os.Stderr, "Resuming from %s\n", httpserve.FormatSize(from))
+	}
+	return &getProgress{size: size, from: from, start: time.Now(), quiet: quiet}
+}
+
+func (p *getProgress) print(done int64) {
+	if p.quiet {
+		return
+	}
+	elapsed := time.Since(p.start).Seconds()
+	rate := float64(done-p.from) / max(elapsed, 0.001)
+	line := fmt.Sprintf("%s  %s/s", httpserve.FormatSize(done), httpserve.FormatSize(int64(rate)))
+	if p.size > 0 {
+		line = fmt.Sprintf("%s / %s  %3d%%  %s/s", httpserve.FormatSize(done), httpserve.FormatSize(p.size),
+			done*100/p.size, httpserve.FormatSize(int64(rate)))
+		if rate > 0 && done < p.size {
+			eta := time.Duration(float64(p.size-done) / rate * float64(time.Second))
+			line += "  ETA " + eta.Round(time.Second).String()
+		}
+	}
+	fmt.Fprintf(os.Stderr, "\r%-60s", line)
+}
+
+func (p *getProgress) finish(done int64) {
+	if p.quiet {
+		return
+	}
+	p.print(done)
+	fmt.Fprintln(os.Stderr)
+}
@@ -0,0 +1,11 @@
+module github.com/jeffersfp/golang-studies/simple-http-server
+
+go 1.26.0
+
+require (
+	github.com/fsnotify/fsnotify v1.10.1
+	golang.org/x/net v0.59.0
+	golang.org/x/text v0.42.0
+)
+
+require golang.org/x/sys v0.48.0
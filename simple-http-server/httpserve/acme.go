@@ -0,0 +1,506 @@
+package httpserve
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// letsEncryptDirectory is the production ACME directory of Let's Encrypt
+const letsEncryptDirectory = "https://acme-v02.api.letsencrypt.org/directory"
+
+// acmeRenewBefore is how long before expiry certificates are renewed
+const acmeRenewBefore = 30 * 24 * time.Hour
+
+// acmeOptions configure automatic certificates
+type acmeOptions struct {
+	domains   []string
+	email     string
+	directory string
+	cacheDir  string
+	provider  dnsProvider
+	// propagation bounds the wait for the TXT records to show up in DNS
+	// before the CA is asked to look, 0 to not wait
+	propagation time.Duration
+}
+
+// acmeManager keeps a certificate for the domains, obtained and renewed
+// from an ACME CA with DNS-01 challenges, so the server needs no port
+// reachable from the internet
+type acmeManager struct {
+	opts acmeOptions
+	log  *serverLog
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// newACMEManager loads the cached certificate, or obtains a new one when
+// there is none or it is due for renewal
+func newACMEManager(opts acmeOptions, log *serverLog) (*acmeManager, error) {
+	for _, d := range opts.domains {
+		if strings.Count(d, "*") > 1 || strings.Contains(d, "*") && !strings.HasPrefix(d, "*.") || !strings.Contains(d, ".") {
+			return nil, fmt.Errorf("invalid domain %q", d)
+		}
+	}
+	if err := os.MkdirAll(opts.cacheDir, 0o700); err != nil {
+		return nil, err
+	}
+	m := &acmeManager{opts: opts, log: log}
+	if cert, err := tls.LoadX509KeyPair(m.certPath(), m.certPath()); err == nil && m.covers(cert.Leaf) {
+		m.cert = &cert
+		log.logf("ACME: loaded certificate for %s, valid until %s", strings.Join(opts.domains, ", "), cert.Leaf.NotAfter.Format(time.DateOnly))
+	}
+	if m.cert == nil || time.Until(m.cert.Leaf.NotAfter) < acmeRenewBefore {
+		if err := m.obtain(); err != nil {
+			return nil, err
+		}
+	}
+	go m.renewLoop()
+	return m, nil
+}
+
+// certPath is the PEM file holding the private key and certificate chain
+func (m *acmeManager) certPath() string {
+	name := strings.ReplaceAll(m.opts.domains[0], "*", "_wildcard")
+	return filepath.Join(m.opts.cacheDir, name+".pem")
+}
+
+// covers tells whether a certificate names every configured domain
+func (m *acmeManager) covers(leaf *x509.Certificate) bool {
+	for _, d := range m.opts.domains {
+		if !slices.Contains(leaf.DNSNames, d) {
+			return false
+		}
+	}
+	return true
+}
+
+// getCertificate hands the current certificate to TLS handshakes
+func (m *acmeManager) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cert, nil
+}
+
+// renewLoop renews the certificate when it gets close to expiring,
+// retrying twice a day after failures
+func (m *acmeManager) renewLoop() {
+	for {
+		m.mu.RLock()
+		renewAt := m.cert.Leaf.NotAfter.Add(-acmeRenewBefore)
+		m.mu.RUnlock()
+		time.Sleep(max(time.Until(renewAt), 0))
+		if err := m.obtain(); err != nil {
+			m.log.logf("ACME: error renewing certificate, retrying in 12h: %v", err)
+			time.Sleep(12 * time.Hour)
+		}
+	}
+}
+
+// obtain orders a new certificate and stores it in the cache
+func (m *acmeManager) obtain() error {
+	m.log.logf("ACME: requesting a certificate for %s from %s", strings.Join(m.opts.domains, ", "), m.opts.directory)
+	accountKey, err := m.accountKey()
+	if err != nil {
+		return err
+	}
+	c, err := newACMEClient(m.opts.directory, accountKey, m.log)
+	if err != nil {
+		return err
+	}
+	if err := c.register(m.opts.email); err != nil {
+		return fmt.Errorf("registering account: %v", err)
+	}
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	chain, err := c.order(m.opts.domains, certKey, m.opts.provider, m.opts.propagation)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(certKey)
+	if err != nil {
+		return err
+	}
+	data := append(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), chain...)
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return fmt.Errorf("parsing issued certificate: %v", err)
+	}
+	if err := os.WriteFile(m.certPath(), data, 0o600); err != nil {
+		m.log.logf("ACME: error caching certificate: %v", err)
+	}
+	m.mu.Lock()
+	m.cert = &cert
+	m.mu.Unlock()
+	m.log.logf("ACME: obtained certificate for %s, valid until %s", strings.Join(m.opts.domains, ", "), cert.Leaf.NotAfter.Format(time.DateOnly))
+	return nil
+}
+
+// accountKey loads the cached account key, creating it the first time
+func (m *acmeManager) accountKey() (*ecdsa.PrivateKey, error) {
+	path := filepath.Join(m.opts.cacheDir, "account.key")
+	if data, err := os.ReadFile(path); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s holds no PEM key", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// acmeClient speaks RFC 8555 to a CA with requests signed by the
+// account key
+type acmeClient struct {
+	client *http.Client
+	key    *ecdsa.PrivateKey
+	log    *serverLog
+	dir    struct {
+		NewNonce   string `json:"newNonce"`
+		NewAccount string `json:"newAccount"`
+		NewOrder   string `json:"newOrder"`
+	}
+	nonce string
+	kid   string
+}
+
+// acmeProblem is an error document of the CA
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+// Error formats the problem for the logs
+func (p *acmeProblem) Error() string {
+	return strings.TrimPrefix(p.Type, "urn:ietf:params:acme:error:") + ": " + p.Detail
+}
+
+// acmeOrder is an order for a certificate
+type acmeOrder struct {
+	Status         string       `json:"status"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate"`
+	Error          *acmeProblem `json:"error"`
+}
+
+// acmeAuthorization is the proof of control the CA asks for a domain
+type acmeAuthorization struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+// acmeChallenge is one way of proving control of a domain
+type acmeChallenge struct {
+	Type  string       `json:"type"`
+	URL   string       `json:"url"`
+	Token string       `json:"token"`
+	Error *acmeProblem `json:"error"`
+}
+
+// newACMEClient fetches the directory of the CA
+func newACMEClient(directory string, key *ecdsa.PrivateKey, log *serverLog) (*acmeClient, error) {
+	c := &acmeClient{client: storageClient(), key: key, log: log}
+	resp, err := c.client.Get(directory)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ACME directory %s: %s", directory, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&c.dir); err != nil {
+		return nil, fmt.Errorf("decoding ACME directory: %v", err)
+	}
+	return c, nil
+}
+
+// register creates the account of the key, or finds the existing one
+func (c *acmeClient) register(email string) error {
+	payload := map[string]any{"termsOfServiceAgreed": true}
+	if email != "" {
+		payload["contact"] = []string{"mailto:" + email}
+	}
+	resp, err := c.post(c.dir.NewAccount, payload, nil)
+	if err != nil {
+		return err
+	}
+	c.kid = resp.Header.Get("Location")
+	return nil
+}
+
+// order goes through an order for the domains: it proves control of
+// each one with a DNS-01 challenge, then has the CA sign a request for
+// certKey and returns the PEM certificate chain
+func (c *acmeClient) order(domains []string, certKey *ecdsa.PrivateKey, provider dnsProvider, propagation time.Duration) ([]byte, error) {
+	type identifier struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+	ids := make([]identifier, len(domains))
+	for i, d := range domains {
+		ids[i] = identifier{"dns", d}
+	}
+	var order acmeOrder
+	resp, err := c.post(c.dir.NewOrder, map[string]any{"identifiers": ids}, &order)
+	if err != nil {
+		return nil, fmt.Errorf("creating order: %v", err)
+	}
+	orderURL := resp.Header.Get("Location")
+
+	if err := c.authorize(order.Authorizations, provider, propagation); err != nil {
+		return nil, err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: domains}, certKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.post(order.Finalize, map[string]string{"csr": base64.RawURLEncoding.EncodeToString(csr)}, &order); err != nil {
+		return nil, fmt.Errorf("finalizing order: %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Minute); order.Status != "valid"; {
+		if order.Status == "invalid" || time.Now().After(deadline) {
+			return nil, fmt.Errorf("order is %s: %v", order.Status, order.Error)
+		}
+		time.Sleep(2 * time.Second)
+		if _, err := c.post(orderURL, nil, &order); err != nil {
+			return nil, err
+		}
+	}
+	resp, err = c.post(order.Certificate, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("downloading certificate: %v", err)
+	}
+	return resp.body, nil
+}
+
+// authorize answers the pending authorizations by publishing their TXT
+// records, which are removed again once the CA has looked at them
+func (c *acmeClient) authorize(urls []string, provider dnsProvider, propagation time.Duration) error {
+	thumbprint := sha256.Sum256([]byte(c.jwk()))
+	type pending struct {
+		url, challenge, fqdn, value string
+	}
+	var challenges []pending
+	defer func() {
+		for _, p := range challenges {
+			if err := provider.cleanup(p.fqdn, p.value); err != nil {
+				c.log.logf("ACME: error removing TXT record %s: %v", p.fqdn, err)
+			}
+		}
+	}()
+	for _, u := range urls {
+		var authz acmeAuthorization
+		if _, err := c.post(u, nil, &authz); err != nil {
+			return err
+		}
+		if authz.Status == "valid" {
+			continue
+		}
+		i := slices.IndexFunc(authz.Challenges, func(ch acmeChallenge) bool { return ch.Type == "dns-01" })
+		if i < 0 {
+			return fmt.Errorf("the CA offers no dns-01 challenge for %s", authz.Identifier.Value)
+		}
+		ch := authz.Challenges[i]
+		keyAuth := ch.Token + "." + base64.RawURLEncoding.EncodeToString(thumbprint[:])
+		sum := sha256.Sum256([]byte(keyAuth))
+		p := pending{
+			url:       u,
+			challenge: ch.URL,
+			fqdn:      "_acme-challenge." + strings.TrimPrefix(authz.Identifier.Value, "*.") + ".",
+			value:     base64.RawURLEncoding.EncodeToString(sum[:]),
+		}
+		if err := provider.present(p.fqdn, p.value); err != nil {
+			return fmt.Errorf("publishing TXT record %s: %v", p.fqdn, err)
+		}
+		challenges = append(challenges, p)
+	}
+	for _, p := range challenges {
+		waitForTXT(p.fqdn, p.value, propagation)
+	}
+	for _, p := range challenges {
+		if _, err := c.post(p.challenge, struct{}{}, nil); err != nil {
+			return fmt.Errorf("starting challenge for %s: %v", p.fqdn, err)
+		}
+	}
+	for _, p := range challenges {
+		deadline := time.Now().Add(5 * time.Minute)
+		for {
+			var authz acmeAuthorization
+			if _, err := c.post(p.url, nil, &authz); err != nil {
+				return err
+			}
+			if authz.Status == "valid" {
+				break
+			}
+			if authz.Status != "pending" || time.Now().After(deadline) {
+				for _, ch := range authz.Challenges {
+					if ch.Error != nil {
+						return fmt.Errorf("authorization of %s is %s: %v", authz.Identifier.Value, authz.Status, ch.Error)
+					}
+				}
+				return fmt.Errorf("authorization of %s is %s", authz.Identifier.Value, authz.Status)
+			}
+			time.Sleep(2 * time.Second)
+		}
+	}
+	return nil
+}
+
+// waitForTXT polls DNS until the record is visible or timeout passes.
+// Resolvers may cache the missing record, so the CA gets its turn anyway.
+func waitForTXT(fqdn, value string, timeout time.Duration) {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(5 * time.Second) {
+		values, _ := net.LookupTXT(fqdn)
+		if slices.Contains(values, value) {
+			return
+		}
+	}
+}
+
+// acmeResponse is a response of the CA with its body read
+type acmeResponse struct {
+	*http.Response
+	body []byte
+}
+
+// post sends a JWS signed request, a POST-as-GET when payload is nil, and
+// decodes the JSON response into result. A rejected nonce is retried once
+// with the fresh one the CA sends along.
+func (c *acmeClient) post(url string, payload any, result any) (*acmeResponse, error) {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		if c.nonce == "" {
+			if err := c.fetchNonce(); err != nil {
+				return nil, err
+			}
+		}
+		req, err := c.sign(url, body)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.client.Post(url, "application/jose+json", bytes.NewReader(req))
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		c.nonce = resp.Header.Get("Replay-Nonce")
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 400 {
+			problem := &acmeProblem{}
+			if json.Unmarshal(data, problem) != nil || problem.Type == "" {
+				return nil, fmt.Errorf("%s: %s", url, resp.Status)
+			}
+			if problem.Type == "urn:ietf:params:acme:error:badNonce" && attempt == 0 {
+				continue
+			}
+			return nil, problem
+		}
+		if result != nil {
+			if err := json.Unmarshal(data, result); err != nil {
+				return nil, fmt.Errorf("decoding %s: %v", url, err)
+			}
+		}
+		return &acmeResponse{resp, data}, nil
+	}
+}
+
+// fetchNonce gets a fresh anti-replay nonce
+func (c *acmeClient) fetchNonce() error {
+	resp, err := c.client.Head(c.dir.NewNonce)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if c.nonce = resp.Header.Get("Replay-Nonce"); c.nonce == "" {
+		return errors.New("the CA sent no nonce")
+	}
+	return nil
+}
+
+// sign wraps the payload in a flattened JWS signed with ES256, naming
+// the account by its URL once registered and by its public key before
+func (c *acmeClient) sign(url string, payload []byte) ([]byte, error) {
+	protected := map[string]any{"alg": "ES256", "nonce": c.nonce, "url": url}
+	if c.kid != "" {
+		protected["kid"] = c.kid
+	} else {
+		protected["jwk"] = json.RawMessage(c.jwk())
+	}
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	signingInput := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return json.Marshal(map[string]string{
+		"protected": b64(header),
+		"payload":   b64(payload),
+		"signature": b64(signature),
+	})
+}
+
+// jwk is the public account key as a JSON Web Key, with its members in
+// the order RFC 7638 thumbprints need
+func (c *acmeClient) jwk() string {
+	pub, err := c.key.PublicKey.ECDH()
+	if err != nil {
+		panic(err)
+	}
+	// The uncompressed point is 0x04, then X and Y
+	raw := pub.Bytes()
+	b64 := base64.RawURLEncoding.EncodeToString
+	return fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, b64(raw[1:33]), b64(raw[33:]))
+}
@@ -0,0 +1,446 @@
+package httpserve
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// adminSecretFlags are the flags whose whole value is a secret
+var adminSecretFlags = map[string]bool{"admin-token": true, "webhook-secret": true, "link-secret": true}
+
+// adminURLPassword matches the password in the userinfo of URLs
+var adminURLPassword = regexp.MustCompile(`(://[^/:@\s]*):[^/@\s]*@`)
+
+// adminStatus is the body of GET /status
+type adminStatus struct {
+	PID         int       `json:"pid"`
+	Started     time.Time `json:"started"`
+	Uptime      string    `json:"uptime"`
+	Draining    bool      `json:"draining"`
+	Connections int       `json:"connections"`
+	Goroutines  int       `json:"goroutines"`
+}
+
+// adminConnection describes an open client connection in GET /connections
+type adminConnection struct {
+	Remote   string    `json:"remote"`
+	Local    string    `json:"local"`
+	State    string    `json:"state"`
+	Opened   time.Time `json:"opened"`
+	Requests int64     `json:"requests"`
+}
+
+// connTracker keeps the open client connections of the servers for the
+// admin API, from their ConnContext and ConnState hooks
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]*trackedConn
+}
+
+type trackedConn struct {
+	info  *connInfo
+	state http.ConnState
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[net.Conn]*trackedConn)}
+}
+
+// connContext attaches a connInfo like the package connContext, also
+// remembering the connection
+func (t *connTracker) connContext(ctx context.Context, c net.Conn) context.Context {
+	ctx = connContext(ctx, c)
+	info := ctx.Value(connInfoKey{}).(*connInfo)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conns[c] = &trackedConn{info: info, state: http.StateNew}
+	return ctx
+}
+
+// connState follows a connection through its states, forgetting it once
+// closed or hijacked
+func (t *connTracker) connState(c net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch state {
+	case http.StateClosed, http.StateHijacked:
+		delete(t.conns, c)
+	default:
+		if tc, ok := t.conns[c]; ok {
+			tc.state = state
+		}
+	}
+}
+
+// count returns the number of open connections
+func (t *connTracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// list describes the open connections, oldest first
+func (t *connTracker) list() []adminConnection {
+	t.mu.Lock()
+	conns := make([]adminConnection, 0, len(t.conns))
+	for c, tc := range t.conns {
+		conns = append(conns, adminConnection{
+			Remote:   c.RemoteAddr().String(),
+			Local:    c.LocalAddr().String(),
+			State:    tc.state.String(),
+			Opened:   tc.info.opened.UTC(),
+			Requests: tc.info.requests.Load(),
+		})
+	}
+	t.mu.Unlock()
+	slices.SortFunc(conns, func(a, b adminConnection) int { return a.Opened.Compare(b.Opened) })
+	return conns
+}
+
+// adminPrefix is where the admin API is mounted on the file servers when
+// it has no --admin-addr
+const adminPrefix = "/_admin/"
+
+// adminServer is the admin API, served on --admin-addr apart from the
+// files, or at adminPrefix next to them
+type adminServer struct {
+	token    [sha256.Size]byte
+	cfg      Config
+	started  time.Time
+	servers  []*http.Server
+	conns    *connTracker
+	logFile  *logFile
+	restart  func() error // nil where graceful restarts are unavailable
+	stats    *dashboardStats
+	settings *runtimeSettings
+	ui       uiOptions
+	log      *serverLog
+	draining atomic.Bool
+	stop     chan time.Duration // asks Run to shut down, waiting up to the duration (0 for no limit)
+	mux      *http.ServeMux
+}
+
+func newAdminServer(cfg Config, servers []*http.Server, conns *connTracker, stats *dashboardStats, settings *runtimeSettings, logs *logFile, ui uiOptions, log *serverLog) *adminServer {
+	a := &adminServer{
+		token:    sha256.Sum256([]byte(cfg.AdminToken)),
+		cfg:      cfg,
+		started:  time.Now(),
+		servers:  servers,
+		conns:    conns,
+		stats:    stats,
+		settings: settings,
+		logFile:  logs,
+		ui:       ui,
+		log:      log,
+		stop:     make(chan time.Duration, 1),
+		mux:      http.NewServeMux(),
+	}
+	a.mux.HandleFunc("GET /{$}", a.serveDashboard)
+	a.mux.HandleFunc("GET /stats", a.serveStats)
+	a.mux.HandleFunc("GET /har", a.serveHAR)
+	a.mux.HandleFunc("GET /status", a.serveStatus)
+	a.mux.HandleFunc("GET /config", a.serveConfig)
+	a.mux.HandleFunc("GET /connections", a.serveConnections)
+	a.mux.HandleFunc("GET /settings", a.serveSettings)
+	a.mux.HandleFunc("PATCH /settings", a.serveChangeSettings)
+	a.mux.HandleFunc("POST /deny", a.serveAddDeny)
+	a.mux.HandleFunc("DELETE /deny/{id}", a.serveRemoveDeny)
+	a.mux.HandleFunc("GET /journal", a.serveJournal)
+	a.mux.HandleFunc("POST /journal/{id}/revert", a.serveRevert)
+	a.mux.HandleFunc("POST /reload", a.serveReload)
+	a.mux.HandleFunc("POST /rotate-logs", a.serveRotateLogs)
+	a.mux.HandleFunc("POST /drain", a.serveDrain)
+	a.mux.HandleFunc("POST /shutdown", a.serveShutdown)
+	return a
+}
+
+// ServeHTTP checks the token before routing the request. It comes as a
+// bearer token, or as the password of basic auth from browsers opening the
+// dashboard.
+func (a *adminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = withRequestID(w, r)
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		_, token, ok = r.BasicAuth()
+	}
+	got := sha256.Sum256([]byte(token))
+	if !ok || subtle.ConstantTimeCompare(got[:], a.token[:]) != 1 {
+		a.log.logf("audit: admin request %s %s from %s rejected: bad token", r.Method, r.URL.Path, r.RemoteAddr)
+		w.Header().Add("WWW-Authenticate", `Bearer realm="admin"`)
+		w.Header().Add("WWW-Authenticate", `Basic realm="admin", charset="UTF-8"`)
+		renderError(w, r, http.StatusUnauthorized, a.ui)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		a.log.logf("audit: admin %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+// mountAdmin serves the admin API at adminPrefix ahead of next, so the
+// token is checked before any of the file stack runs
+func mountAdmin(admin *adminServer, next http.Handler) http.Handler {
+	api := http.StripPrefix(strings.TrimSuffix(adminPrefix, "/"), admin)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path+"/" == adminPrefix:
+			// The dashboard polls paths relative to its own
+			http.Redirect(w, r, adminPrefix, http.StatusMovedPermanently)
+		case strings.HasPrefix(r.URL.Path, adminPrefix):
+			api.ServeHTTP(w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// serveStatus reports the uptime and load of the server
+func (a *adminServer) serveStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, adminStatus{
+		PID:         os.Getpid(),
+		Started:     a.started.UTC(),
+		Uptime:      time.Since(a.started).Round(time.Second).String(),
+		Draining:    a.draining.Load(),
+		Connections: a.conns.count(),
+		Goroutines:  runtime.NumGoroutine(),
+	})
+}
+
+// serveConfig returns the value of every flag, secrets redacted
+func (a *adminServer) serveConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, effectiveConfig(a.cfg))
+}
+
+// serveConnections lists the open client connections
+func (a *adminServer) serveConnections(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.conns.list())
+}
+
+// serveReload starts a graceful restart, the new process reading the
+// command line and files again before taking over the listeners
+func (a *adminServer) serveReload(w http.ResponseWriter, r *http.Request) {
+	if a.restart == nil {
+		renderError(w, r, http.StatusNotImplemented, a.ui)
+		return
+	}
+	if err := a.restart(); err != nil {
+		a.log.logf("Error starting new process for graceful restart: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "restarting"})
+}
+
+// serveRotateLogs reopens --log-file
+func (a *adminServer) serveRotateLogs(w http.ResponseWriter, r *http.Request) {
+	if a.logFile == nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "no --log-file to reopen"})
+		return
+	}
+	if err := a.logFile.reopen(); err != nil {
+		a.log.logf("Error reopening log file: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	a.log.logf("Reopened log file %s", a.logFile.path)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "reopened"})
+}
+
+// serveDrain stops keeping connections alive, closing the idle ones, so
+// clients move elsewhere ahead of a shutdown
+func (a *adminServer) serveDrain(w http.ResponseWriter, r *http.Request) {
+	if !a.draining.Swap(true) {
+		for _, server := range a.servers {
+			server.SetKeepAlivesEnabled(false)
+		}
+		a.log.logf("Draining connections")
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"status": "draining", "connections": a.conns.count()})
+}
+
+// serveShutdown stops the server as SIGTERM does. The requests in flight
+// get the optional drain parameter to finish, timeout being its older
+// name, before their connections are closed.
+func (a *adminServer) serveShutdown(w http.ResponseWriter, r *http.Request) {
+	var drain time.Duration
+	q := r.URL.Query()
+	value := q.Get("drain")
+	if value == "" {
+		value = q.Get("timeout")
+	}
+	if value != "" {
+		var err error
+		if drain, err = time.ParseDuration(value); err != nil || drain < 0 {
+			renderError(w, r, http.StatusBadRequest, a.ui)
+			return
+		}
+	}
+	select {
+	case a.stop <- drain:
+	default:
+	}
+	reply := map[string]any{"status": "shutting down", "connections": a.conns.count()}
+	if drain > 0 {
+		reply["drain"] = drain.String()
+	}
+	writeJSON(w, http.StatusAccepted, reply)
+}
+
+// adminSettingsPatch is the body of PATCH /settings, changing the settings
+// it gives
+type adminSettingsPatch struct {
+	LogLevel    json.RawMessage `json:"log_level"`
+	RateLimit   json.RawMessage `json:"rate_limit"`
+	Maintenance json.RawMessage `json:"maintenance"`
+}
+
+// adminDenyRequest is the body of POST /deny
+type adminDenyRequest struct {
+	Client string `json:"client"`
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+	TTL    string `json:"ttl"` // how long the rule lasts, forever when empty
+}
+
+// serveSettings returns the runtime settings
+func (a *adminServer) serveSettings(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.settings.view())
+}
+
+// serveChangeSettings changes the settings given in the body, one journal
+// entry each, stopping at the first invalid one
+func (a *adminServer) serveChangeSettings(w http.ResponseWriter, r *http.Request) {
+	var patch adminSettingsPatch
+	if err := decodeAPIBody(w, r, &patch); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	changes := []settingsChange{}
+	for _, s := range []struct {
+		name  string
+		value json.RawMessage
+	}{
+		{settingLogLevel, patch.LogLevel},
+		{settingRateLimit, patch.RateLimit},
+		{settingMaintenance, patch.Maintenance},
+	} {
+		if s.value == nil {
+			continue
+		}
+		change, err := a.settings.set(s.name, s.value, 0, r.RemoteAddr)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"error": err.Error(), "changes": changes})
+			return
+		}
+		changes = append(changes, change)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"settings": a.settings.view(), "changes": changes})
+}
+
+// serveAddDeny adds a deny rule
+func (a *adminServer) serveAddDeny(w http.ResponseWriter, r *http.Request) {
+	var req adminDenyRequest
+	if err := decodeAPIBody(w, r, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	rule := denyRule{Client: req.Client, Path: req.Path, Reason: req.Reason}
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid ttl %q", req.TTL)})
+			return
+		}
+		rule.Expires = time.Now().Add(ttl).UTC()
+	}
+	rule, err := a.settings.addDeny(rule, r.RemoteAddr)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusCreated, rule)
+}
+
+// serveRemoveDeny removes a deny rule
+func (a *adminServer) serveRemoveDeny(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		renderError(w, r, http.StatusNotFound, a.ui)
+		return
+	}
+	change, err := a.settings.removeDeny(id, 0, r.RemoteAddr)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, change)
+}
+
+// serveJournal lists the settings changes
+func (a *adminServer) serveJournal(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.settings.history())
+}
+
+// serveRevert undoes a settings change
+func (a *adminServer) serveRevert(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		renderError(w, r, http.StatusNotFound, a.ui)
+		return
+	}
+	change, err := a.settings.revert(id, r.RemoteAddr)
+	if err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, change)
+}
+
+// effectiveConfig returns the value of every flag for cfg, with passwords,
+// tokens and secrets replaced by ***
+func effectiveConfig(cfg Config) map[string]any {
+	flags := flag.NewFlagSet("config", flag.ContinueOnError)
+	cfg.RegisterFlags(flags)
+	values := make(map[string]any)
+	flags.VisitAll(func(f *flag.Flag) {
+		if list, ok := f.Value.(*stringList); ok {
+			redacted := make([]string, len(*list))
+			for i, value := range *list {
+				redacted[i] = redactFlag(f.Name, value)
+			}
+			values[f.Name] = redacted
+			return
+		}
+		values[f.Name] = redactFlag(f.Name, f.Value.String())
+	})
+	return values
+}
+
+// redactFlag hides the secrets in a value of the named flag
+func redactFlag(name, value string) string {
+	switch {
+	case value == "":
+		return value
+	case adminSecretFlags[name]:
+		return "***"
+	case name == "auth":
+		user, _, _ := strings.Cut(value, ":")
+		return user + ":***"
+	}
+	return adminURLPassword.ReplaceAllString(value, "$1:***@")
+}
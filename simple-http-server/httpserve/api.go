@@ -0,0 +1,321 @@
+package httpserve
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiPrefix is the URL prefix of the JSON file-management API
+const apiPrefix = "/_api/v1/"
+
+// apiMaxPerPage caps the page size clients may request from the list endpoint
+const apiMaxPerPage = 1000
+
+// apiEntry describes a file or directory
+type apiEntry struct {
+	Name     string    `json:"name"`
+	Path     string    `json:"path"`
+	Type     string    `json:"type"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	SHA256   string    `json:"sha256,omitempty"` // with checksum=sha256
+}
+
+// apiListing is a page of a directory's entries
+type apiListing struct {
+	Path    string     `json:"path"`
+	Entries []apiEntry `json:"entries"`
+	Page    int        `json:"page"`
+	Pages   int        `json:"pages"`
+	PerPage int        `json:"per_page"`
+	Total   int        `json:"total"`
+	Next    string     `json:"next,omitempty"`
+}
+
+// apiMoveRequest is the body of POST move
+type apiMoveRequest struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Overwrite bool   `json:"overwrite"`
+}
+
+// apiMkdirRequest is the body of POST mkdir
+type apiMkdirRequest struct {
+	Path string `json:"path"`
+}
+
+// newAPIEntry converts file info found at urlPath
+func newAPIEntry(urlPath string, info fs.FileInfo) apiEntry {
+	e := apiEntry{Name: info.Name(), Path: urlPath, Type: "file", Size: info.Size(), Modified: info.ModTime().UTC()}
+	if info.IsDir() {
+		e.Type, e.Size = "dir", 0
+	}
+	if urlPath == "/" {
+		e.Name = "/"
+	}
+	return e
+}
+
+// serveAPI routes the endpoints below apiPrefix:
+//
+//	GET    list/<dir>      directory entries, with sort, order, page and per_page
+//	GET    stat/<path>     a single entry
+//	                       (both hash the files given checksum=sha256)
+//	GET    files/<path>    file contents
+//	PUT    files/<path>    upload (needs --upload)
+//	DELETE files/<path>    delete (needs --allow-delete)
+//	POST   move            {"from", "to", "overwrite"} (needs --allow-manage)
+//	POST   mkdir           {"path"} (needs --allow-manage)
+//	GET    trash           deleted files kept in the recycle bin (needs --allow-delete)
+//	POST   trash/<id>/restore  put a deleted file back (needs --allow-delete)
+//
+// Every error is returned as the JSON error body.
+func (h *fileHandler) serveAPI(w http.ResponseWriter, r *http.Request) {
+	// Reuse the regular handlers, which answer in JSON for such clients
+	r.Header.Set("Accept", "application/json")
+	endpoint, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, apiPrefix), "/")
+	target := path.Clean("/" + rest)
+	if isTrashPath(target) && endpoint != "trash" || isMaintenancePath(target) || h.mirror != nil && isMirrorPath(target) {
+		renderError(w, r, http.StatusNotFound, h.ui)
+		return
+	}
+
+	switch {
+	case endpoint == "list" && r.Method == http.MethodGet:
+		h.serveAPIList(w, r, target)
+	case endpoint == "stat" && r.Method == http.MethodGet:
+		h.serveAPIStat(w, r, target)
+	case endpoint == "files" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		h.serveAPIDownload(w, r, target)
+	case endpoint == "files" && r.Method == http.MethodPut && h.upload.enabled:
+		h.servePut(w, apiRequest(r, target))
+	case endpoint == "files" && r.Method == http.MethodDelete && h.delete:
+		h.serveDelete(w, apiRequest(r, target))
+	case endpoint == "move" && rest == "" && r.Method == http.MethodPost && h.manage:
+		h.serveAPIMove(w, r)
+	case endpoint == "mkdir" && rest == "" && r.Method == http.MethodPost && h.manage:
+		h.serveAPIMkdir(w, r)
+	case endpoint == "trash" && h.delete && h.trash != nil:
+		h.serveAPITrash(w, r, rest)
+	case endpoint == "list" || endpoint == "stat" || endpoint == "files" || endpoint == "move" || endpoint == "mkdir":
+		renderError(w, r, http.StatusMethodNotAllowed, h.ui)
+	default:
+		renderError(w, r, http.StatusNotFound, h.ui)
+	}
+}
+
+// apiRequest rewrites an API request to target the file at urlPath
+func apiRequest(r *http.Request, urlPath string) *http.Request {
+	r2 := r.Clone(r.Context())
+	r2.URL.Path, r2.URL.RawPath = urlPath, ""
+	return r2
+}
+
+// serveAPIList returns a page of the entries of the directory at dirPath
+func (h *fileHandler) serveAPIList(w http.ResponseWriter, r *http.Request, dirPath string) {
+	f, err := h.root.Open(dirPath)
+	if err != nil {
+		renderError(w, apiRequest(r, dirPath), http.StatusNotFound, h.ui)
+		return
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || !info.IsDir() {
+		renderError(w, apiRequest(r, dirPath), http.StatusBadRequest, h.ui)
+		return
+	}
+	infos, err := f.Readdir(-1)
+	if err != nil {
+		h.log.logf("Error reading directory %s: %v", dirPath, err)
+		renderError(w, apiRequest(r, dirPath), http.StatusInternalServerError, h.ui)
+		return
+	}
+
+	q := r.URL.Query()
+	opts := h.listing
+	if perPage, err := strconv.Atoi(q.Get("per_page")); err == nil && perPage > 0 {
+		opts.pageSize = min(perPage, apiMaxPerPage)
+	}
+	page := buildListing(dirPath, infos, q, catalogs["en"], opts)
+	data := apiListing{
+		Path:    dirPath,
+		Entries: make([]apiEntry, 0, len(page.Entries)),
+		Page:    page.Page,
+		Pages:   page.Pages,
+		PerPage: opts.pageSize,
+		Total:   page.Total,
+	}
+	byName := make(map[string]fs.FileInfo, len(infos))
+	for _, info := range infos {
+		byName[info.Name()] = info
+	}
+	withSums, ok := apiChecksum(q)
+	if !ok {
+		renderError(w, apiRequest(r, dirPath), http.StatusBadRequest, h.ui)
+		return
+	}
+	for _, e := range page.Entries {
+		name := strings.TrimSuffix(e.Name, "/")
+		entry := newAPIEntry(path.Join(dirPath, name), byName[name])
+		if withSums && entry.Type == "file" {
+			if entry.SHA256, err = fileChecksum(h.root, entry.Path); err != nil {
+				h.log.logf("Error hashing %s: %v", entry.Path, err)
+				renderError(w, apiRequest(r, dirPath), http.StatusInternalServerError, h.ui)
+				return
+			}
+		}
+		data.Entries = append(data.Entries, entry)
+	}
+	if page.Page < page.Pages {
+		v := url.Values{}
+		v.Set("sort", page.SortBy)
+		v.Set("order", page.Order)
+		v.Set("page", strconv.Itoa(page.Page+1))
+		v.Set("per_page", strconv.Itoa(opts.pageSize))
+		if withSums {
+			v.Set("checksum", "sha256")
+		}
+		data.Next = (&url.URL{Path: r.URL.Path, RawQuery: v.Encode()}).String()
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+// serveAPIStat describes the entry at urlPath
+func (h *fileHandler) serveAPIStat(w http.ResponseWriter, r *http.Request, urlPath string) {
+	f, err := h.root.Open(urlPath)
+	if err != nil {
+		renderError(w, apiRequest(r, urlPath), http.StatusNotFound, h.ui)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		renderError(w, apiRequest(r, urlPath), http.StatusInternalServerError, h.ui)
+		return
+	}
+	withSum, ok := apiChecksum(r.URL.Query())
+	if !ok {
+		renderError(w, apiRequest(r, urlPath), http.StatusBadRequest, h.ui)
+		return
+	}
+	entry := newAPIEntry(urlPath, info)
+	if withSum && entry.Type == "file" {
+		if entry.SHA256, err = fileChecksum(h.root, urlPath); err != nil {
+			h.log.logf("Error hashing %s: %v", urlPath, err)
+			renderError(w, apiRequest(r, urlPath), http.StatusInternalServerError, h.ui)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, entry)
+}
+
+// apiChecksum reports whether the checksum parameter asks for the hashes of
+// files, and whether it names a supported one
+func apiChecksum(q url.Values) (withSums, ok bool) {
+	switch q.Get("checksum") {
+	case "":
+		return false, true
+	case "sha256":
+		return true, true
+	}
+	return false, false
+}
+
+// fileChecksum returns the hex SHA-256 of the contents of a file
+func fileChecksum(root http.FileSystem, name string) (string, error) {
+	f, err := root.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// serveAPIDownload sends the contents of the file at urlPath, supporting
+// range and conditional requests
+func (h *fileHandler) serveAPIDownload(w http.ResponseWriter, r *http.Request, urlPath string) {
+	f, err := h.root.Open(urlPath)
+	if err != nil {
+		renderError(w, apiRequest(r, urlPath), http.StatusNotFound, h.ui)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		renderError(w, apiRequest(r, urlPath), http.StatusBadRequest, h.ui)
+		return
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// serveAPIMove renames an entry, refusing to replace an existing file
+// unless overwrite is set
+func (h *fileHandler) serveAPIMove(w http.ResponseWriter, r *http.Request) {
+	var req apiMoveRequest
+	if err := decodeAPIBody(w, r, &req); err != nil || req.From == "" || req.To == "" {
+		renderError(w, r, http.StatusBadRequest, h.ui)
+		return
+	}
+	from, err := sanitizePath(&url.URL{Path: req.From}, h.policy)
+	if err != nil {
+		renderError(w, r, http.StatusBadRequest, h.ui)
+		return
+	}
+	r2 := apiRequest(r, from)
+	r2.Header.Set("Destination", (&url.URL{Path: req.To}).String())
+	r2.Header.Set("Overwrite", "F")
+	if req.Overwrite {
+		r2.Header.Set("Overwrite", "T")
+	}
+	h.serveMove(w, r2)
+}
+
+// serveAPIMkdir creates a directory whose parent exists
+func (h *fileHandler) serveAPIMkdir(w http.ResponseWriter, r *http.Request) {
+	var req apiMkdirRequest
+	if err := decodeAPIBody(w, r, &req); err != nil || req.Path == "" {
+		renderError(w, r, http.StatusBadRequest, h.ui)
+		return
+	}
+	dirPath, err := sanitizePath(&url.URL{Path: req.Path}, h.policy)
+	if err != nil || dirPath == "/" || isTrashPath(dirPath) || isMaintenancePath(dirPath) || h.mirror != nil && isMirrorPath(dirPath) {
+		renderError(w, r, http.StatusBadRequest, h.ui)
+		return
+	}
+	dirPath = strings.TrimSuffix(dirPath, "/")
+	h.serveMkdir(w, apiRequest(r, dirPath), dirPath)
+}
+
+// decodeAPIBody parses a small JSON request body into v
+func decodeAPIBody(w http.ResponseWriter, r *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("unexpected data after the request body")
+	}
+	return nil
+}
+
+// writeJSON sends v as a JSON response
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,383 @@
+package httpserve
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// archiveExtensions are the file name suffixes served as archives by --dir
+var archiveExtensions = []string{".zip", ".tar", ".tar.gz", ".tgz"}
+
+// isArchive reports whether name is an archive file rather than a directory
+func isArchive(name string) bool {
+	lower := strings.ToLower(name)
+	for _, ext := range archiveExtensions {
+		if strings.HasSuffix(lower, ext) {
+			info, err := os.Stat(name)
+			return err == nil && info.Mode().IsRegular()
+		}
+	}
+	return false
+}
+
+// archiveEntry is a file of an archive. Entries stored uncompressed are
+// read through a section of the archive, which seeks freely; compressed
+// ones are decompressed from the start on every backwards seek.
+type archiveEntry struct {
+	info    objectInfo
+	section *io.SectionReader
+	open    func() (io.ReadCloser, error)
+}
+
+// archiveFS serves the contents of a zip or tar archive without extracting
+// it. The tree is indexed once when the archive is opened.
+type archiveFS struct {
+	files map[string]*archiveEntry
+	dirs  map[string][]fs.DirEntry
+}
+
+// newArchiveFS returns an empty tree holding only the root directory
+func newArchiveFS() *archiveFS {
+	return &archiveFS{files: make(map[string]*archiveEntry), dirs: map[string][]fs.DirEntry{".": nil}}
+}
+
+// openArchive indexes the archive at name. Gzip compressed tar archives
+// are first decompressed into an unlinked temporary file, as they cannot
+// be read at random.
+func openArchive(name string, log *serverLog) (*archiveFS, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	a := newArchiveFS()
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		err = a.indexZip(f, info.Size())
+	case strings.HasSuffix(lower, ".tar"):
+		err = a.indexTar(f)
+	default:
+		var tmp *os.File
+		if tmp, err = gunzipToTemp(f); err == nil {
+			f.Close()
+			f = tmp
+			err = a.indexTar(f)
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading archive %s: %v", name, err)
+	}
+	// The archive stays open for as long as the server runs
+	a.stripTopDir()
+	a.sortDirs()
+	log.logf("Indexed %d files in archive %s", len(a.files), name)
+	return a, nil
+}
+
+// gunzipToTemp decompresses src into a temporary file that is removed
+// right away, so it disappears once closed
+func gunzipToTemp(src io.Reader) (*os.File, error) {
+	zr, err := gzip.NewReader(src)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp("", "simple-http-server-*.tar")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, zr); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// archiveReader is the random access an archive is indexed and read with:
+// the archive file, or its copy in memory
+type archiveReader interface {
+	io.ReadSeeker
+	io.ReaderAt
+}
+
+// indexZip records the entries of a zip archive
+func (a *archiveFS) indexZip(f io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return err
+	}
+	for _, zf := range zr.File {
+		name, ok := archivePath(zf.Name)
+		if !ok {
+			continue
+		}
+		if zf.FileInfo().IsDir() {
+			a.addDir(name, zf.Modified)
+			continue
+		}
+		if !zf.Mode().IsRegular() {
+			continue
+		}
+		entry := &archiveEntry{
+			info: objectInfo{name: path.Base(name), size: int64(zf.UncompressedSize64), modTime: zf.Modified},
+			open: zf.Open,
+		}
+		if zf.Method == zip.Store {
+			offset, err := zf.DataOffset()
+			if err != nil {
+				return err
+			}
+			entry.section = io.NewSectionReader(f, offset, entry.info.size)
+		}
+		a.addFile(name, entry)
+	}
+	return nil
+}
+
+// indexTar records the entries of an uncompressed tar archive along with
+// the offsets of their contents
+func (a *archiveFS) indexTar(f archiveReader) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name, ok := archivePath(hdr.Name)
+		if !ok {
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			a.addDir(name, hdr.ModTime)
+		case tar.TypeReg:
+			// The reader stops right after the header, at the contents
+			offset, err := f.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return err
+			}
+			a.addFile(name, &archiveEntry{
+				info:    objectInfo{name: path.Base(name), size: hdr.Size, modTime: hdr.ModTime},
+				section: io.NewSectionReader(f, offset, hdr.Size),
+			})
+		case tar.TypeLink:
+			target, ok := archivePath(hdr.Linkname)
+			if linked, found := a.files[target]; ok && found {
+				entry := *linked
+				entry.info.name = path.Base(name)
+				a.addFile(name, &entry)
+			}
+		}
+	}
+}
+
+// archivePath cleans the name of an archive member, rejecting names that
+// would escape the archive root
+func archivePath(name string) (string, bool) {
+	name = path.Clean("/" + strings.ReplaceAll(name, `\`, "/"))
+	name = strings.TrimPrefix(name, "/")
+	if name == "" || strings.HasPrefix(name, "../") {
+		return "", false
+	}
+	return name, true
+}
+
+// addFile records a file and the directories leading to it
+func (a *archiveFS) addFile(name string, entry *archiveEntry) {
+	dir := path.Dir(name)
+	if _, exists := a.files[name]; exists {
+		// Later members replace earlier ones, as when extracting
+		a.files[name] = entry
+		for i, e := range a.dirs[dir] {
+			if e.Name() == entry.info.name {
+				a.dirs[dir][i] = entry.info
+			}
+		}
+		return
+	}
+	a.files[name] = entry
+	a.addDir(dir, time.Time{})
+	a.dirs[dir] = append(a.dirs[dir], entry.info)
+}
+
+// addDir records a directory and its parents, keeping the first known
+// modification time
+func (a *archiveFS) addDir(name string, modTime time.Time) {
+	if name == "." {
+		return
+	}
+	if _, exists := a.dirs[name]; exists {
+		return
+	}
+	a.dirs[name] = nil
+	parent := path.Dir(name)
+	a.addDir(parent, time.Time{})
+	a.dirs[parent] = append(a.dirs[parent], objectInfo{name: path.Base(name), dir: true, modTime: modTime})
+}
+
+// stripTopDir serves the only directory of archives that wrap everything
+// in one, as produced by archiving a site's folder
+func (a *archiveFS) stripTopDir() {
+	root := a.dirs["."]
+	if len(root) != 1 || !root[0].IsDir() {
+		return
+	}
+	prefix := root[0].Name() + "/"
+	files := make(map[string]*archiveEntry, len(a.files))
+	for name, entry := range a.files {
+		files[strings.TrimPrefix(name, prefix)] = entry
+	}
+	dirs := make(map[string][]fs.DirEntry, len(a.dirs))
+	for name, entries := range a.dirs {
+		switch {
+		case name == root[0].Name():
+			dirs["."] = entries
+		case name != ".":
+			dirs[strings.TrimPrefix(name, prefix)] = entries
+		}
+	}
+	a.files, a.dirs = files, dirs
+}
+
+// sortDirs orders directory entries by name, as os.ReadDir does
+func (a *archiveFS) sortDirs() {
+	for _, entries := range a.dirs {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	}
+}
+
+// Open returns the file or directory at name
+func (a *archiveFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if entry, ok := a.files[name]; ok {
+		f := &archiveFile{entry: entry}
+		if entry.section != nil {
+			f.section = io.NewSectionReader(entry.section, 0, entry.info.size)
+		}
+		return f, nil
+	}
+	if entries, ok := a.dirs[name]; ok {
+		return &archiveDir{info: objectInfo{name: path.Base(name), dir: true}, entries: entries}, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// archiveFile reads an archive member
+type archiveFile struct {
+	entry   *archiveEntry
+	section *io.SectionReader
+	offset  int64
+	stream  io.ReadCloser
+	pos     int64
+}
+
+func (f *archiveFile) Stat() (fs.FileInfo, error) { return f.entry.info, nil }
+
+// Read reads from the current offset, decompressing up to it if needed
+func (f *archiveFile) Read(p []byte) (int, error) {
+	if f.section != nil {
+		return f.section.Read(p)
+	}
+	if f.offset >= f.entry.info.size {
+		return 0, io.EOF
+	}
+	if f.stream == nil || f.pos > f.offset {
+		if f.stream != nil {
+			f.stream.Close()
+		}
+		stream, err := f.entry.open()
+		if err != nil {
+			return 0, err
+		}
+		f.stream, f.pos = stream, 0
+	}
+	if f.pos < f.offset {
+		n, err := io.CopyN(io.Discard, f.stream, f.offset-f.pos)
+		f.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.stream.Read(p)
+	f.pos += int64(n)
+	f.offset = f.pos
+	return n, err
+}
+
+// Seek moves the read position without touching the archive
+func (f *archiveFile) Seek(offset int64, whence int) (int64, error) {
+	if f.section != nil {
+		return f.section.Seek(offset, whence)
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.entry.info.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the file")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Close releases the decompression stream, if any
+func (f *archiveFile) Close() error {
+	if f.stream != nil {
+		return f.stream.Close()
+	}
+	return nil
+}
+
+// archiveDir lists a directory of an archive
+type archiveDir struct {
+	info    objectInfo
+	entries []fs.DirEntry
+	pos     int
+}
+
+func (d *archiveDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *archiveDir) Close() error               { return nil }
+
+// Read fails, as directories have no contents of their own
+func (d *archiveDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir returns the next n entries, or all remaining ones when n <= 0
+func (d *archiveDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.pos:]
+	if n > 0 && len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n <= 0 || n > len(remaining) {
+		n = len(remaining)
+	}
+	d.pos += n
+	return remaining[:n:n], nil
+}
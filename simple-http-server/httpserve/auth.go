@@ -0,0 +1,75 @@
+package httpserve
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type authUserKey struct{}
+
+// credentials holds the accepted user names and password hashes
+type credentials map[string][sha256.Size]byte
+
+// parseCredentials parses --auth values of the form user:password
+func parseCredentials(values []string) (credentials, error) {
+	creds := make(credentials, len(values))
+	for _, value := range values {
+		user, password, ok := strings.Cut(value, ":")
+		if !ok || user == "" || password == "" {
+			return nil, fmt.Errorf("invalid credentials %q (expected user:password)", user)
+		}
+		creds[user] = sha256.Sum256([]byte(password))
+	}
+	return creds, nil
+}
+
+// authenticate checks the request's basic auth credentials, returning the
+// request with the authenticated user attached
+func (c credentials) authenticate(r *http.Request) (*http.Request, bool) {
+	user, password, ok := r.BasicAuth()
+	if !ok || !c.verify(user, password) {
+		return r, false
+	}
+	return withUser(r, user), true
+}
+
+// authenticateProxy checks the Proxy-Authorization header of a forward
+// proxy request against the credentials
+func (c credentials) authenticateProxy(r *http.Request) (*http.Request, bool) {
+	header := &http.Request{Header: http.Header{"Authorization": r.Header.Values("Proxy-Authorization")}}
+	user, password, ok := header.BasicAuth()
+	if !ok || !c.verify(user, password) {
+		return r, false
+	}
+	return withUser(r, user), true
+}
+
+// withUser returns the request with user attached as its authenticated
+// user, also noting it for the access log
+func withUser(r *http.Request, user string) *http.Request {
+	if lrw := loggedResponse(r); lrw != nil {
+		lrw.user = user
+	}
+	return r.WithContext(context.WithValue(r.Context(), authUserKey{}, user))
+}
+
+// verify reports whether password is the one of user
+func (c credentials) verify(user, password string) bool {
+	// Compare hashes so the comparison time doesn't leak the password length
+	want, known := c[user]
+	got := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(got[:], want[:]) == 1 && known
+}
+
+// RequestUser returns the authenticated user of the request, or "-" before
+// the auth stage or without --auth
+func RequestUser(r *http.Request) string {
+	if user, ok := r.Context().Value(authUserKey{}).(string); ok {
+		return user
+	}
+	return "-"
+}
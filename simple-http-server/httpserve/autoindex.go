@@ -0,0 +1,156 @@
+package httpserve
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Auto index modes for directories lacking an index.html
+const (
+	autoIndexOff     = "off"
+	autoIndexVirtual = "virtual"
+	autoIndexWrite   = "write"
+)
+
+// generatedMarker identifies index.html files written by this server, so
+// they can be refreshed without touching hand-written ones
+const generatedMarker = `<meta name="generator" content="simple-http-server auto-index">`
+
+// validateAutoIndex checks the --auto-index-file mode
+func validateAutoIndex(mode string) error {
+	switch mode {
+	case autoIndexOff, autoIndexVirtual, autoIndexWrite:
+		return nil
+	}
+	return fmt.Errorf("invalid auto index mode %q (expected off, virtual or write)", mode)
+}
+
+// serveVirtualIndex renders the listing for requests of a missing
+// index.html inside an existing directory, reporting whether it did so
+func serveVirtualIndex(w http.ResponseWriter, r *http.Request, root http.FileSystem, opts listingOptions) bool {
+	if path.Base(r.URL.Path) != "index.html" {
+		return false
+	}
+	if f, err := root.Open(r.URL.Path); err == nil {
+		f.Close()
+		return false
+	}
+	dirPath := path.Dir(r.URL.Path)
+	dir, err := root.Open(dirPath)
+	if err != nil {
+		return false
+	}
+	defer dir.Close()
+	if info, err := dir.Stat(); err != nil || !info.IsDir() {
+		return false
+	}
+	if dirPath != "/" {
+		dirPath += "/"
+	}
+	serveListing(w, r, dirPath, dir, opts)
+	return true
+}
+
+// materializeIndexes writes a generated index.html into every directory
+// under root that lacks a hand-written one
+func materializeIndexes(root string, opts listingOptions) (int, error) {
+	// Static pages cannot paginate or re-sort, so list everything at once
+	opts.pageSize = math.MaxInt
+	msg := catalogs[opts.ui.lang]
+	written := 0
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		if p == filepath.Join(root, trashDir) || p == filepath.Join(root, mirrorDir) {
+			return filepath.SkipDir
+		}
+		indexFile := filepath.Join(p, "index.html")
+		if !isGeneratedIndex(indexFile) {
+			return nil
+		}
+
+		dirEntries, err := os.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		infos := make([]fs.FileInfo, 0, len(dirEntries))
+		for _, e := range dirEntries {
+			if e.Name() == "index.html" {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				return err
+			}
+			infos = append(infos, info)
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		dirPath := "/"
+		if rel != "." {
+			dirPath += filepath.ToSlash(rel) + "/"
+		}
+		data := buildListing(dirPath, infos, url.Values{}, msg, opts)
+		data.Static = true
+		var buf bytes.Buffer
+		if err := listingTemplate.Execute(&buf, data); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(indexFile, buf.Bytes()); err != nil {
+			return err
+		}
+		written++
+		return nil
+	})
+	return written, err
+}
+
+// isGeneratedIndex reports whether indexFile is missing or was generated by
+// a previous run, and can therefore be (re)written
+func isGeneratedIndex(indexFile string) bool {
+	f, err := os.Open(indexFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := f.Read(head)
+	return strings.Contains(string(head[:n]), generatedMarker)
+}
+
+// writeFileAtomic writes data to a temporary file next to name and renames
+// it into place, so readers never observe a partial file
+func writeFileAtomic(name string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
@@ -0,0 +1,287 @@
+package httpserve
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Azure Storage REST API details
+const (
+	azureVersion     = "2021-08-06"
+	azureResource    = "https://storage.azure.com/"
+	azureMetadataURL = "http://169.254.169.254/metadata/identity/oauth2/token"
+)
+
+// azureStore reads an Azure Blob Storage container through the REST API,
+// authorizing requests with a shared key, a SAS token or a Microsoft Entra
+// access token
+type azureStore struct {
+	client     *http.Client
+	base       string
+	account    string
+	accountKey []byte
+	sas        url.Values
+	token      *bearerToken
+}
+
+// openAzureFS serves the container of an azblob://container/prefix URL.
+// The account and credentials come from AZURE_STORAGE_CONNECTION_STRING,
+// or AZURE_STORAGE_ACCOUNT with AZURE_STORAGE_KEY or
+// AZURE_STORAGE_SAS_TOKEN, then a service principal in AZURE_TENANT_ID,
+// AZURE_CLIENT_ID and AZURE_CLIENT_SECRET, then the managed identity of the
+// VM. Without any the container is read anonymously. account and endpoint
+// URL parameters override the environment, e.g. for Azurite.
+func openAzureFS(u *url.URL, log *serverLog) (fs.FS, error) {
+	s := &azureStore{client: storageClient()}
+	settings := parseConnectionString(os.Getenv("AZURE_STORAGE_CONNECTION_STRING"))
+	q := u.Query()
+	s.account = firstNonEmpty(q.Get("account"), settings["AccountName"], os.Getenv("AZURE_STORAGE_ACCOUNT"))
+	endpoint := firstNonEmpty(q.Get("endpoint"), settings["BlobEndpoint"])
+	if endpoint == "" {
+		if s.account == "" {
+			return nil, fmt.Errorf("no storage account, set AZURE_STORAGE_ACCOUNT or the account URL parameter")
+		}
+		endpoint = "https://" + s.account + ".blob.core.windows.net"
+	}
+	s.base = strings.TrimSuffix(endpoint, "/") + "/" + url.PathEscape(u.Host)
+
+	var source string
+	if key := firstNonEmpty(settings["AccountKey"], os.Getenv("AZURE_STORAGE_KEY")); key != "" {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid storage account key: %v", err)
+		}
+		if s.account == "" {
+			return nil, fmt.Errorf("a storage account key needs the account name")
+		}
+		s.accountKey, source = decoded, "the storage account key"
+	} else if sas := firstNonEmpty(settings["SharedAccessSignature"], os.Getenv("AZURE_STORAGE_SAS_TOKEN")); sas != "" {
+		values, err := url.ParseQuery(strings.TrimPrefix(sas, "?"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid SAS token: %v", err)
+		}
+		s.sas, source = values, "a SAS token"
+	} else {
+		s.token, source = azureCredentials(s.client)
+	}
+	log.logf("Reading azblob://%s with %s", u.Host, source)
+	return &objectFS{store: s, prefix: strings.Trim(u.Path, "/")}, nil
+}
+
+// parseConnectionString splits a storage connection string into its
+// settings
+func parseConnectionString(conn string) map[string]string {
+	settings := make(map[string]string)
+	for _, part := range strings.Split(conn, ";") {
+		if name, value, ok := strings.Cut(part, "="); ok {
+			settings[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+	return settings
+}
+
+// azureCredentials returns a token source for a service principal or the
+// managed identity, or nil for anonymous access, and a description of it
+func azureCredentials(client *http.Client) (*bearerToken, string) {
+	tenant, clientID, secret := os.Getenv("AZURE_TENANT_ID"), os.Getenv("AZURE_CLIENT_ID"), os.Getenv("AZURE_CLIENT_SECRET")
+	if tenant != "" && clientID != "" && secret != "" {
+		authority := firstNonEmpty(os.Getenv("AZURE_AUTHORITY_HOST"), "https://login.microsoftonline.com")
+		endpoint := strings.TrimSuffix(authority, "/") + "/" + url.PathEscape(tenant) + "/oauth2/v2.0/token"
+		return &bearerToken{fetch: func() (string, time.Duration, error) {
+			return postTokenForm(client, endpoint, url.Values{
+				"grant_type":    {"client_credentials"},
+				"client_id":     {clientID},
+				"client_secret": {secret},
+				"scope":         {azureResource + ".default"},
+			})
+		}}, "service principal " + clientID
+	}
+	query := url.Values{"api-version": {"2018-02-01"}, "resource": {azureResource}}
+	if clientID != "" {
+		// Selects a user assigned identity
+		query.Set("client_id", clientID)
+	}
+	metadataURL := azureMetadataURL + "?" + query.Encode()
+	header := http.Header{"Metadata": {"true"}}
+	if probeMetadata(metadataURL, header) {
+		return &bearerToken{fetch: func() (string, time.Duration, error) {
+			req, err := http.NewRequest(http.MethodGet, metadataURL, nil)
+			if err != nil {
+				return "", 0, err
+			}
+			req.Header = header
+			return requestToken(client, req)
+		}}, "the managed identity"
+	}
+	return nil, "anonymous access"
+}
+
+// head returns the size and modification time of a blob
+func (s *azureStore) head(key string) (objectInfo, error) {
+	resp, err := s.do(http.MethodHead, key, nil, nil)
+	if err != nil {
+		return objectInfo{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return objectInfo{name: key, size: resp.ContentLength, modTime: modTime}, nil
+}
+
+// get streams a blob from offset on
+func (s *azureStore) get(key string, offset int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("X-Ms-Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	resp, err := s.do(http.MethodGet, key, nil, header)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// azureListResult is the response of List Blobs
+type azureListResult struct {
+	Blobs struct {
+		Blob []struct {
+			Name       string
+			Properties struct {
+				ContentLength int64  `xml:"Content-Length"`
+				LastModified  string `xml:"Last-Modified"`
+			}
+		}
+		BlobPrefix []struct {
+			Name string
+		}
+	}
+	NextMarker string
+}
+
+// list returns one page of the blobs below prefix, delimited by slashes
+func (s *azureStore) list(prefix, token string, limit int) (objectPage, error) {
+	query := url.Values{"restype": {"container"}, "comp": {"list"}, "delimiter": {"/"}}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	if token != "" {
+		query.Set("marker", token)
+	}
+	if limit > 0 {
+		query.Set("maxresults", strconv.Itoa(limit))
+	}
+	resp, err := s.do(http.MethodGet, "", query, nil)
+	if err != nil {
+		return objectPage{}, err
+	}
+	defer resp.Body.Close()
+	var result azureListResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return objectPage{}, fmt.Errorf("decoding container listing: %v", err)
+	}
+	page := objectPage{next: result.NextMarker}
+	for _, b := range result.Blobs.Blob {
+		modTime, _ := http.ParseTime(b.Properties.LastModified)
+		page.objects = append(page.objects, objectInfo{name: b.Name, size: b.Properties.ContentLength, modTime: modTime})
+	}
+	for _, p := range result.Blobs.BlobPrefix {
+		page.prefixes = append(page.prefixes, p.Name)
+	}
+	return page, nil
+}
+
+// do sends an authorized request for a blob, or for the container itself
+// when key is empty, and turns error responses into errors
+func (s *azureStore) do(method, key string, query url.Values, header http.Header) (*http.Response, error) {
+	target := s.base
+	if key != "" {
+		target += "/" + s3Escape(key, true)
+	}
+	req, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if header != nil {
+		req.Header = header
+	}
+	if query == nil {
+		query = url.Values{}
+	}
+	for name, values := range s.sas {
+		query[name] = values
+	}
+	req.URL.RawQuery = query.Encode()
+	req.Header.Set("X-Ms-Version", azureVersion)
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	switch {
+	case s.accountKey != nil:
+		req.Header.Set("Authorization", "SharedKey "+s.account+":"+s.sharedKeySignature(req, query))
+	case s.token != nil:
+		token, err := s.token.get()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var azErr struct {
+		Code    string
+		Message string
+	}
+	xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&azErr)
+	if azErr.Code == "" {
+		azErr.Code = resp.Header.Get("X-Ms-Error-Code")
+	}
+	return nil, storageStatusError(resp, "azure "+method+" "+req.URL.Path, azErr.Code+" "+azErr.Message)
+}
+
+// sharedKeySignature signs a request without a body with the storage
+// account key
+func (s *azureStore) sharedKeySignature(req *http.Request, query url.Values) string {
+	var names []string
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			names = append(names, lower)
+		}
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	// Verb, then the standard headers from Content-Encoding to Range, all
+	// of which are empty for these requests
+	canonical.WriteString(req.Method + strings.Repeat("\n", 12))
+	for _, name := range names {
+		canonical.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+	canonical.WriteString("/" + s.account + req.URL.EscapedPath())
+	params := make([]string, 0, len(query))
+	for name := range query {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		canonical.WriteString("\n" + strings.ToLower(name) + ":" + strings.Join(values, ","))
+	}
+	mac := hmac.New(sha256.New, s.accountKey)
+	mac.Write([]byte(canonical.String()))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,274 @@
+package httpserve
+
+import (
+	"cmp"
+	"html/template"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsTopPath is the report of the paths using the most bandwidth
+const statsTopPath = "/_stats/top"
+
+// bandwidthBucket is the time span each count of bytes served covers
+const bandwidthBucket = 10 * time.Minute
+
+// bandwidthMaxPaths bounds the paths counted in a bucket, the bytes of
+// any other path going to bandwidthOther
+const bandwidthMaxPaths = 10000
+
+// bandwidthOther stands for the paths past bandwidthMaxPaths
+const bandwidthOther = "(other)"
+
+// Defaults and bounds of the report parameters
+const (
+	bandwidthDefaultWindow = 24 * time.Hour
+	bandwidthDefaultLimit  = 50
+	bandwidthMaxLimit      = 1000
+)
+
+// bandwidthWindows are the windows the HTML report links to
+var bandwidthWindows = []time.Duration{time.Hour, 24 * time.Hour, 7 * 24 * time.Hour}
+
+// pathUsage is what was served from a path
+type pathUsage struct {
+	Bytes    int64 `json:"bytes"`
+	Requests int64 `json:"requests"`
+}
+
+// bandwidthSpan counts the bytes served from each path over a bucket
+type bandwidthSpan struct {
+	start time.Time
+	paths map[string]*pathUsage
+}
+
+// bandwidthStats counts the response bytes of every path of a site over
+// the retention, for the top paths report
+type bandwidthStats struct {
+	retention time.Duration
+
+	mu    sync.Mutex
+	spans []bandwidthSpan // oldest first
+}
+
+// bandwidthEntry is a row of the report
+type bandwidthEntry struct {
+	Path string `json:"path"`
+	pathUsage
+	Share float64 `json:"share"` // of the bytes served in the window
+}
+
+// bandwidthReport is the body of the report
+type bandwidthReport struct {
+	Window        string           `json:"window"`
+	Since         time.Time        `json:"since"`
+	TotalBytes    int64            `json:"total_bytes"`
+	TotalRequests int64            `json:"total_requests"`
+	Paths         []bandwidthEntry `json:"paths"`
+}
+
+func newBandwidthStats(retention time.Duration) *bandwidthStats {
+	return &bandwidthStats{retention: retention}
+}
+
+// record counts a response of n body bytes from urlPath
+func (b *bandwidthStats) record(urlPath string, n int64, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	start := now.Truncate(bandwidthBucket)
+	if len(b.spans) == 0 || b.spans[len(b.spans)-1].start.Before(start) {
+		b.spans = append(b.spans, bandwidthSpan{start: start, paths: make(map[string]*pathUsage)})
+		expired := now.Add(-b.retention - bandwidthBucket)
+		i := 0
+		for i < len(b.spans) && b.spans[i].start.Before(expired) {
+			i++
+		}
+		b.spans = slices.Delete(b.spans, 0, i)
+	}
+	paths := b.spans[len(b.spans)-1].paths
+	u, ok := paths[urlPath]
+	if !ok {
+		if len(paths) >= bandwidthMaxPaths {
+			urlPath = bandwidthOther
+		}
+		if u, ok = paths[urlPath]; !ok {
+			u = &pathUsage{}
+			paths[urlPath] = u
+		}
+	}
+	u.Bytes += n
+	u.Requests++
+}
+
+// top returns the limit paths that were sent the most bytes over window
+func (b *bandwidthStats) top(window time.Duration, limit int, now time.Time) bandwidthReport {
+	since := now.Add(-window)
+	report := bandwidthReport{Window: shortDuration(window), Since: since.UTC(), Paths: []bandwidthEntry{}}
+	totals := make(map[string]*pathUsage)
+	b.mu.Lock()
+	for _, span := range b.spans {
+		// A bucket counts once any of it is within the window
+		if span.start.Add(bandwidthBucket).Before(since) {
+			continue
+		}
+		for p, u := range span.paths {
+			t, ok := totals[p]
+			if !ok {
+				t = &pathUsage{}
+				totals[p] = t
+			}
+			t.Bytes += u.Bytes
+			t.Requests += u.Requests
+		}
+	}
+	b.mu.Unlock()
+	for p, u := range totals {
+		report.TotalBytes += u.Bytes
+		report.TotalRequests += u.Requests
+		report.Paths = append(report.Paths, bandwidthEntry{Path: p, pathUsage: *u})
+	}
+	slices.SortFunc(report.Paths, func(a, b bandwidthEntry) int {
+		return cmp.Or(cmp.Compare(b.Bytes, a.Bytes), cmp.Compare(b.Requests, a.Requests), strings.Compare(a.Path, b.Path))
+	})
+	report.Paths = report.Paths[:min(len(report.Paths), limit)]
+	for i := range report.Paths {
+		if report.TotalBytes > 0 {
+			report.Paths[i].Share = float64(report.Paths[i].Bytes) / float64(report.TotalBytes)
+		}
+	}
+	return report
+}
+
+// recordResponse counts the response of the request once it is served,
+// from what the logging stage saw written
+func (b *bandwidthStats) recordResponse(r *http.Request) {
+	if lrw := loggedResponse(r); lrw != nil && r.Method != http.MethodHead {
+		b.record(r.URL.Path, lrw.written, time.Now())
+	}
+}
+
+// bandwidthPage is the data of the HTML report
+type bandwidthPage struct {
+	UI      uiOptions
+	Msg     catalog
+	Report  bandwidthReport
+	Window  time.Duration
+	Windows []bandwidthWindow
+}
+
+// bandwidthWindow is a link to the report over another window
+type bandwidthWindow struct {
+	Label   string
+	URL     string
+	Current bool
+}
+
+// serveBandwidth answers the report, as JSON or as a page as negotiated
+func (h *fileHandler) serveBandwidth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		renderError(w, r, http.StatusMethodNotAllowed, h.ui)
+		return
+	}
+	q := r.URL.Query()
+	window := bandwidthDefaultWindow
+	if v := q.Get("window"); v != "" {
+		d, err := parseWindow(v)
+		if err != nil || d <= 0 {
+			renderError(w, r, http.StatusBadRequest, h.ui)
+			return
+		}
+		window = min(d, h.bandwidth.retention)
+	}
+	limit := bandwidthDefaultLimit
+	if n, err := strconv.Atoi(q.Get("limit")); err == nil && n > 0 {
+		limit = min(n, bandwidthMaxLimit)
+	}
+	report := h.bandwidth.top(window, limit, time.Now())
+	w.Header().Set("Cache-Control", "no-store")
+	if q.Get("format") == "json" || prefersJSON(r) {
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+	msg := negotiateCatalog(r, h.ui.lang)
+	data := bandwidthPage{UI: h.ui, Msg: msg, Report: report, Window: window, Windows: reportWindows(statsTopPath, q, window, h.bandwidth.retention)}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Language", msg.Lang)
+	if err := bandwidthTemplate.Execute(w, data); err != nil {
+		h.log.logf("Error rendering the bandwidth report: %v", err)
+	}
+}
+
+// reportWindows links the report at reportPath over each of
+// bandwidthWindows within retention, keeping the other parameters of q
+func reportWindows(reportPath string, q url.Values, window, retention time.Duration) []bandwidthWindow {
+	var windows []bandwidthWindow
+	for _, d := range bandwidthWindows {
+		if d > retention {
+			continue
+		}
+		q.Set("window", shortDuration(d))
+		windows = append(windows, bandwidthWindow{Label: shortDuration(d), URL: reportPath + "?" + q.Encode(), Current: d == window})
+	}
+	return windows
+}
+
+// parseWindow parses a report window, as a time.Duration or a number of
+// days such as 7d
+func parseWindow(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// shortDuration formats whole hours and days as 1h or 7d, and other
+// durations as time.Duration does
+func shortDuration(d time.Duration) string {
+	switch {
+	case d >= 24*time.Hour && d%(24*time.Hour) == 0:
+		return strconv.Itoa(int(d/(24*time.Hour))) + "d"
+	case d >= time.Hour && d%time.Hour == 0:
+		return strconv.Itoa(int(d/time.Hour)) + "h"
+	}
+	return d.String()
+}
+
+var bandwidthTemplate = template.Must(template.Must(uiTemplates.Clone()).New("bandwidth").Funcs(template.FuncMap{
+	"size":     FormatSize,
+	"duration": shortDuration,
+	"percent":  func(f float64) string { return strconv.FormatFloat(f*100, 'f', 1, 64) + "%" },
+}).Parse(`<!DOCTYPE html>
+<html lang="{{.Msg.Lang}}">
+<head>
+{{template "head"}}
+<title>{{.Msg.T "stats.title" (duration .Window)}}{{if .UI.Title}} - {{.UI.Title}}{{end}}</title>
+<style>
+table { border-collapse: collapse; width: 100%; }
+td, th { text-align: left; padding: 0.25em 0.5em; border-bottom: 1px solid var(--border); }
+td.n, th.n { text-align: right; font-variant-numeric: tabular-nums; }
+.bar { background: var(--link); height: 0.6em; border-radius: 2px; }
+nav.windows a.current { font-weight: bold; text-decoration: none; color: var(--fg); }
+</style>
+</head>
+<body>
+{{template "header" .}}
+<h1>{{.Msg.T "stats.title" (duration .Window)}}</h1>
+<nav class="windows">{{range .Windows}}<a href="{{.URL}}"{{if .Current}} class="current"{{end}}>{{.Label}}</a> {{end}}</nav>
+<p class="muted">{{.Msg.T "stats.total" (size .Report.TotalBytes) .Report.TotalRequests}}</p>
+{{if .Report.Paths}}<table>
+<tr><th>{{.Msg.T "stats.path"}}</th><th class="n">{{.Msg.T "stats.bytes"}}</th><th class="n">{{.Msg.T "stats.requests"}}</th><th class="n">%</th><th></th></tr>
+{{range .Report.Paths}}<tr><td><a href="{{.Path}}">{{.Path}}</a></td><td class="n">{{size .Bytes}}</td><td class="n">{{.Requests}}</td><td class="n">{{percent .Share}}</td><td style="width: 20%"><div class="bar" style="width: {{percent .Share}}"></div></td></tr>
+{{end}}</table>{{else}}<p>{{.Msg.T "stats.empty"}}</p>{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,143 @@
+package httpserve
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cachedFile is a file held in memory with the headers needed to serve it
+type cachedFile struct {
+	key         string
+	data        []byte
+	modTime     time.Time
+	contentType string
+	etag        string
+}
+
+// fileCache is an LRU cache of small files, bounded by the total size of
+// their contents. It is shared by every site.
+type fileCache struct {
+	maxBytes int64
+	maxFile  int64
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+// newFileCache returns a cache holding up to maxBytes of files no larger
+// than maxFile, or nil when caching is disabled
+func newFileCache(maxBytes, maxFile int64) *fileCache {
+	if maxBytes <= 0 {
+		return nil
+	}
+	return &fileCache{
+		maxBytes: maxBytes,
+		maxFile:  min(maxFile, maxBytes),
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// get returns the cached copy of key if it still matches the file on disk
+func (c *fileCache) get(key string, size int64, modTime time.Time) (*cachedFile, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	f := el.Value.(*cachedFile)
+	if int64(len(f.data)) != size || !f.modTime.Equal(modTime) {
+		c.removeElement(el)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return f, true
+}
+
+// put stores f, evicting the least recently used files to make room
+func (c *fileCache) put(f *cachedFile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[f.key]; ok {
+		c.removeElement(el)
+	}
+	c.entries[f.key] = c.lru.PushFront(f)
+	c.size += int64(len(f.data))
+	for c.size > c.maxBytes {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+func (c *fileCache) removeElement(el *list.Element) {
+	f := c.lru.Remove(el).(*cachedFile)
+	delete(c.entries, f.key)
+	c.size -= int64(len(f.data))
+}
+
+// serveCached answers GET and HEAD requests for small regular files from
+// the cache, loading them on a miss, and reports whether it handled the
+// request. Requests for a directory use its index.html.
+func (h *fileHandler) serveCached(w http.ResponseWriter, r *http.Request) bool {
+	name := r.URL.Path
+	if strings.HasSuffix(name, "/index.html") {
+		// Leave the redirect to the directory to the file server
+		return false
+	}
+	if strings.HasSuffix(name, "/") {
+		name = path.Join(name, "index.html")
+	}
+	f, err := h.root.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() || info.Size() > h.cache.maxFile {
+		return false
+	}
+
+	key := filepath.Join(h.dir, filepath.FromSlash(name))
+	cached, hit := h.cache.get(key, info.Size(), info.ModTime())
+	if !hit {
+		data, err := io.ReadAll(io.LimitReader(f, h.cache.maxFile+1))
+		if err != nil || int64(len(data)) != info.Size() {
+			return false
+		}
+		contentType := mime.TypeByExtension(path.Ext(name))
+		if contentType == "" {
+			contentType = http.DetectContentType(data)
+		}
+		sum := sha256.Sum256(data)
+		cached = &cachedFile{
+			key:         key,
+			data:        data,
+			modTime:     info.ModTime(),
+			contentType: contentType,
+			etag:        `"` + hex.EncodeToString(sum[:8]) + `"`,
+		}
+		h.cache.put(cached)
+	}
+
+	w.Header().Set("Content-Type", cached.contentType)
+	w.Header().Set("ETag", cached.etag)
+	if hit {
+		w.Header().Set("X-Cache", "HIT")
+	} else {
+		w.Header().Set("X-Cache", "MISS")
+	}
+	http.ServeContent(w, r, path.Base(name), cached.modTime, bytes.NewReader(cached.data))
+	return true
+}
@@ -0,0 +1,68 @@
+package httpserve
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// caseInsensitiveFS resolves paths against the real directory entries
+// ignoring case, for links created on case-insensitive filesystems
+type caseInsensitiveFS struct {
+	fs http.FileSystem
+}
+
+// Open tries the exact path first and falls back to a case-insensitive
+// lookup of each path segment
+func (c caseInsensitiveFS) Open(name string) (http.File, error) {
+	f, err := c.fs.Open(name)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return f, err
+	}
+	resolved, ok := c.resolve(name)
+	if !ok {
+		return nil, err
+	}
+	return c.fs.Open(resolved)
+}
+
+// resolve walks name one segment at a time, picking the matching entry in
+// each directory. When several entries differ only by case the exact match
+// wins, otherwise the lexically smallest name is chosen so the result is
+// deterministic.
+func (c caseInsensitiveFS) resolve(name string) (string, bool) {
+	current := "/"
+	for _, segment := range strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/") {
+		if segment == "" {
+			continue
+		}
+		dir, err := c.fs.Open(current)
+		if err != nil {
+			return "", false
+		}
+		infos, err := dir.Readdir(-1)
+		dir.Close()
+		if err != nil {
+			return "", false
+		}
+		var matches []string
+		for _, info := range infos {
+			if info.Name() == segment {
+				matches = []string{segment}
+				break
+			}
+			if strings.EqualFold(info.Name(), segment) {
+				matches = append(matches, info.Name())
+			}
+		}
+		if len(matches) == 0 {
+			return "", false
+		}
+		sort.Strings(matches)
+		current = path.Join(current, matches[0])
+	}
+	return current, true
+}
@@ -0,0 +1,136 @@
+package httpserve
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cgroupCPULimit returns the CPU quota of the process's cgroup in cores
+func cgroupCPULimit() (float64, bool) {
+	// cgroup v2: "max 100000" or "<quota> <period>"
+	if data, ok := readCgroupFile("", "cpu.max"); ok {
+		fields := strings.Fields(data)
+		if len(fields) == 2 && fields[0] != "max" {
+			return cpuRatio(fields[0], fields[1])
+		}
+		return 0, false
+	}
+	// cgroup v1: a quota of -1 means unlimited
+	quota, ok := readCgroupFile("cpu", "cpu.cfs_quota_us")
+	if !ok || strings.HasPrefix(quota, "-") {
+		return 0, false
+	}
+	period, ok := readCgroupFile("cpu", "cpu.cfs_period_us")
+	if !ok {
+		return 0, false
+	}
+	return cpuRatio(quota, period)
+}
+
+// cgroupMemoryLimit returns the memory limit of the process's cgroup
+func cgroupMemoryLimit() (int64, bool) {
+	data, ok := readCgroupFile("", "memory.max")
+	if !ok {
+		data, ok = readCgroupFile("memory", "memory.limit_in_bytes")
+	}
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(data, 10, 64)
+	// cgroup v1 reports no limit as a huge page-aligned number
+	if err != nil || n <= 0 || n >= 1<<62 {
+		return 0, false
+	}
+	return n, true
+}
+
+func cpuRatio(quota, period string) (float64, bool) {
+	q, err1 := strconv.ParseFloat(quota, 64)
+	p, err2 := strconv.ParseFloat(period, 64)
+	if err1 != nil || err2 != nil || q <= 0 || p <= 0 {
+		return 0, false
+	}
+	return q / p, true
+}
+
+// readCgroupFile reads a file of the cgroup the process belongs to, for the
+// given cgroup v1 controller, or for the unified cgroup v2 hierarchy when
+// controller is empty
+func readCgroupFile(controller, name string) (string, bool) {
+	cgPath, ok := cgroupPath(controller)
+	if !ok {
+		return "", false
+	}
+	mountPoint, root, ok := cgroupMount(controller)
+	if !ok {
+		return "", false
+	}
+	rel, err := filepath.Rel(root, cgPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = "."
+	}
+	data, err := os.ReadFile(filepath.Join(mountPoint, rel, name))
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(data)), true
+}
+
+// cgroupPath finds the process's cgroup in /proc/self/cgroup
+func cgroupPath(controller string) (string, bool) {
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// hierarchy-ID:controller-list:path
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if controller == "" && parts[0] == "0" && parts[1] == "" {
+			return parts[2], true
+		}
+		for _, c := range strings.Split(parts[1], ",") {
+			if controller != "" && c == controller {
+				return parts[2], true
+			}
+		}
+	}
+	return "", false
+}
+
+// cgroupMount finds the mount point and root of a cgroup hierarchy in
+// /proc/self/mountinfo
+func cgroupMount(controller string) (string, string, bool) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", "", false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// ID parent major:minor root mount-point options ... - type source super-options
+		pre, post, ok := strings.Cut(scanner.Text(), " - ")
+		fields, postFields := strings.Fields(pre), strings.Fields(post)
+		if !ok || len(fields) < 5 || len(postFields) < 3 {
+			continue
+		}
+		switch {
+		case controller == "" && postFields[0] == "cgroup2":
+			return fields[4], fields[3], true
+		case controller != "" && postFields[0] == "cgroup":
+			for _, opt := range strings.Split(postFields[2], ",") {
+				if opt == controller {
+					return fields[4], fields[3], true
+				}
+			}
+		}
+	}
+	return "", "", false
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package httpserve
+
+// cgroupCPULimit reports no limit where cgroups do not exist
+func cgroupCPULimit() (float64, bool) { return 0, false }
+
+// cgroupMemoryLimit reports no limit where cgroups do not exist
+func cgroupMemoryLimit() (int64, bool) { return 0, false }
@@ -0,0 +1,96 @@
+package httpserve
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// chaosLatency is a flag.Value for an injected delay such as 200ms or
+// 200ms±100ms, the second form adding uniformly distributed jitter
+type chaosLatency struct {
+	base   time.Duration
+	jitter time.Duration
+}
+
+// String formats the delay the way it is given on the command line
+func (l *chaosLatency) String() string {
+	if l.jitter == 0 {
+		return l.base.String()
+	}
+	return l.base.String() + "±" + l.jitter.String()
+}
+
+// Set parses a delay with optional jitter, accepting "+-" in place of "±"
+func (l *chaosLatency) Set(value string) error {
+	value = strings.ReplaceAll(strings.TrimSpace(value), "+-", "±")
+	base, jitter, hasJitter := strings.Cut(value, "±")
+	d, err := time.ParseDuration(base)
+	if err != nil || d < 0 {
+		return fmt.Errorf("invalid latency %q", value)
+	}
+	l.base, l.jitter = d, 0
+	if hasJitter {
+		j, err := time.ParseDuration(jitter)
+		if err != nil || j < 0 || j > d {
+			return fmt.Errorf("invalid jitter %q, it must be a duration no larger than the latency", jitter)
+		}
+		l.jitter = j
+	}
+	return nil
+}
+
+// delay picks the latency to inject into one request
+func (l chaosLatency) delay() time.Duration {
+	if l.jitter == 0 {
+		return l.base
+	}
+	return l.base - l.jitter + rand.N(2*l.jitter+1)
+}
+
+// chaosMonkey slows down and fails a share of requests to simulate slow or
+// flaky asset delivery during development
+type chaosMonkey struct {
+	latency   chaosLatency
+	errorRate float64
+	log       *serverLog
+}
+
+// newChaosMonkey returns a fault injector, or nil when neither latency nor
+// errors are requested
+func newChaosMonkey(latency chaosLatency, errorRate float64, log *serverLog) (*chaosMonkey, error) {
+	if errorRate < 0 || errorRate > 1 {
+		return nil, fmt.Errorf("--chaos-error-rate must be between 0 and 1")
+	}
+	if latency.base == 0 && errorRate == 0 {
+		return nil, nil
+	}
+	return &chaosMonkey{latency: latency, errorRate: errorRate, log: log}, nil
+}
+
+// inject delays the request and, at the configured rate, answers it with a
+// 500 error instead of serving it. It returns false when the request was
+// answered or the client went away while waiting.
+func (c *chaosMonkey) inject(w http.ResponseWriter, r *http.Request, ui uiOptions) bool {
+	if c == nil {
+		return true
+	}
+	if d := c.latency.delay(); d > 0 {
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-r.Context().Done():
+			t.Stop()
+			return false
+		}
+	}
+	if c.errorRate > 0 && rand.Float64() < c.errorRate {
+		w.Header().Set("X-Chaos", "error")
+		renderError(w, r, http.StatusInternalServerError, ui)
+		c.log.logf("%s %s %d (injected)", r.Method, r.URL.Path, http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
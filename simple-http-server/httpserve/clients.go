@@ -0,0 +1,370 @@
+package httpserve
+
+import (
+	"cmp"
+	"hash/maphash"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsClientsPath is the report of the clients of a site and of the sites
+// referring them
+const statsClientsPath = "/_stats/clients"
+
+// clientsMaxKeys bounds the agent families and referrers counted in a
+// bucket, the requests of any other going to bandwidthOther
+const clientsMaxKeys = 1000
+
+// clientsMaxVisitors bounds the clients told apart in a bucket, so the
+// unique count of a window with more is a lower bound
+const clientsMaxVisitors = 100000
+
+// agentFamilies name the browsers by the products of their User-Agent,
+// matched in order: Edge and Opera name Chrome too, and Chrome names Safari
+var agentFamilies = []struct{ token, family string }{
+	{"Edg/", "Edge"},
+	{"EdgA/", "Edge"},
+	{"EdgiOS/", "Edge"},
+	{"OPR/", "Opera"},
+	{"SamsungBrowser/", "Samsung Internet"},
+	{"Firefox/", "Firefox"},
+	{"FxiOS/", "Firefox"},
+	{"CriOS/", "Chrome"},
+	{"Chrome/", "Chrome"},
+	{"Safari/", "Safari"},
+	{"Trident/", "Internet Explorer"},
+	{"MSIE ", "Internet Explorer"},
+}
+
+// botWords mark the products of crawlers and other robots
+var botWords = []string{"bot", "crawl", "spider", "slurp"}
+
+// agentUsage is what was served to an agent family
+type agentUsage struct {
+	Requests int64 `json:"requests"`
+	Bot      bool  `json:"bot,omitempty"`
+}
+
+// clientsSpan counts the clients of a bucket. Clients are hashed with a
+// per-process seed, so no address is kept.
+type clientsSpan struct {
+	start    time.Time
+	requests int64
+	direct   int64 // without a referrer from another site
+	agents   map[string]*agentUsage
+	referers map[string]int64
+	visitors map[uint64]struct{}
+	capped   bool // visitors reached clientsMaxVisitors
+}
+
+// clientStats counts the agent families, referrers and unique clients of
+// every request of a site over the retention, for the clients report
+type clientStats struct {
+	retention time.Duration
+	seed      maphash.Seed
+
+	mu    sync.Mutex
+	spans []clientsSpan // oldest first
+}
+
+// agentEntry is an agent family of the report
+type agentEntry struct {
+	Agent string `json:"agent"`
+	agentUsage
+	Share float64 `json:"share"` // of the requests in the window
+}
+
+// refererEntry is a referring site of the report
+type refererEntry struct {
+	Referer  string  `json:"referer"`
+	Requests int64   `json:"requests"`
+	Share    float64 `json:"share"`
+}
+
+// clientsReport is the body of the report
+type clientsReport struct {
+	Window        string         `json:"window"`
+	Since         time.Time      `json:"since"`
+	TotalRequests int64          `json:"total_requests"`
+	UniqueClients int            `json:"unique_clients"`
+	Capped        bool           `json:"capped,omitempty"` // unique_clients is a lower bound
+	Direct        int64          `json:"direct"`
+	Agents        []agentEntry   `json:"agents"`
+	Referers      []refererEntry `json:"referers"`
+}
+
+func newClientStats(retention time.Duration) *clientStats {
+	return &clientStats{retention: retention, seed: maphash.MakeSeed()}
+}
+
+// record counts a request from client with the agent family and the
+// referring host, "" for none
+func (c *clientStats) record(client, family string, bot bool, referer string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	start := now.Truncate(bandwidthBucket)
+	if len(c.spans) == 0 || c.spans[len(c.spans)-1].start.Before(start) {
+		c.spans = append(c.spans, clientsSpan{
+			start:    start,
+			agents:   make(map[string]*agentUsage),
+			referers: make(map[string]int64),
+			visitors: make(map[uint64]struct{}),
+		})
+		expired := now.Add(-c.retention - bandwidthBucket)
+		i := 0
+		for i < len(c.spans) && c.spans[i].start.Before(expired) {
+			i++
+		}
+		c.spans = slices.Delete(c.spans, 0, i)
+	}
+	span := &c.spans[len(c.spans)-1]
+	span.requests++
+	u, ok := span.agents[family]
+	if !ok {
+		if len(span.agents) >= clientsMaxKeys {
+			family, bot = bandwidthOther, false
+		}
+		if u, ok = span.agents[family]; !ok {
+			u = &agentUsage{Bot: bot}
+			span.agents[family] = u
+		}
+	}
+	u.Requests++
+	if referer == "" {
+		span.direct++
+	} else {
+		if _, ok := span.referers[referer]; !ok && len(span.referers) >= clientsMaxKeys {
+			referer = bandwidthOther
+		}
+		span.referers[referer]++
+	}
+	visitor := maphash.String(c.seed, client)
+	if _, ok := span.visitors[visitor]; !ok {
+		if len(span.visitors) >= clientsMaxVisitors {
+			span.capped = true
+		} else {
+			span.visitors[visitor] = struct{}{}
+		}
+	}
+}
+
+// report returns the limit agent families and referrers with the most
+// requests over window
+func (c *clientStats) report(window time.Duration, limit int, now time.Time) clientsReport {
+	since := now.Add(-window)
+	report := clientsReport{Window: shortDuration(window), Since: since.UTC(), Agents: []agentEntry{}, Referers: []refererEntry{}}
+	agents := make(map[string]*agentUsage)
+	referers := make(map[string]int64)
+	visitors := make(map[uint64]struct{})
+	c.mu.Lock()
+	for _, span := range c.spans {
+		// A bucket counts once any of it is within the window
+		if span.start.Add(bandwidthBucket).Before(since) {
+			continue
+		}
+		report.TotalRequests += span.requests
+		report.Direct += span.direct
+		report.Capped = report.Capped || span.capped
+		for family, u := range span.agents {
+			t, ok := agents[family]
+			if !ok {
+				t = &agentUsage{Bot: u.Bot}
+				agents[family] = t
+			}
+			t.Requests += u.Requests
+		}
+		for host, n := range span.referers {
+			referers[host] += n
+		}
+		for v := range span.visitors {
+			visitors[v] = struct{}{}
+		}
+	}
+	c.mu.Unlock()
+	report.UniqueClients = len(visitors)
+	for family, u := range agents {
+		report.Agents = append(report.Agents, agentEntry{Agent: family, agentUsage: *u})
+	}
+	slices.SortFunc(report.Agents, func(a, b agentEntry) int {
+		return cmp.Or(cmp.Compare(b.Requests, a.Requests), strings.Compare(a.Agent, b.Agent))
+	})
+	report.Agents = report.Agents[:min(len(report.Agents), limit)]
+	for host, n := range referers {
+		report.Referers = append(report.Referers, refererEntry{Referer: host, Requests: n})
+	}
+	slices.SortFunc(report.Referers, func(a, b refererEntry) int {
+		return cmp.Or(cmp.Compare(b.Requests, a.Requests), strings.Compare(a.Referer, b.Referer))
+	})
+	report.Referers = report.Referers[:min(len(report.Referers), limit)]
+	if report.TotalRequests > 0 {
+		for i := range report.Agents {
+			report.Agents[i].Share = float64(report.Agents[i].Requests) / float64(report.TotalRequests)
+		}
+		for i := range report.Referers {
+			report.Referers[i].Share = float64(report.Referers[i].Requests) / float64(report.TotalRequests)
+		}
+	}
+	return report
+}
+
+// recordRequest counts the client, agent and referrer of a request
+func (c *clientStats) recordRequest(r *http.Request) {
+	if r.Method == http.MethodHead {
+		return
+	}
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	family, bot := agentFamily(r.UserAgent())
+	c.record(client, family, bot, refererHost(r), time.Now())
+}
+
+// agentFamily names the browser or robot of a User-Agent: robots by their
+// product, other clients such as curl by their first product
+func agentFamily(ua string) (string, bool) {
+	if ua == "" {
+		return "(none)", false
+	}
+	products := strings.FieldsFunc(ua, func(r rune) bool {
+		return r == ' ' || r == ';' || r == '(' || r == ')' || r == ','
+	})
+	for _, p := range products {
+		name, _, _ := strings.Cut(p, "/")
+		lower := strings.ToLower(name)
+		if strings.Contains(lower, "://") || strings.HasPrefix(lower, "+") {
+			continue
+		}
+		for _, word := range botWords {
+			if strings.Contains(lower, word) {
+				return truncateLabel(name), true
+			}
+		}
+	}
+	for _, f := range agentFamilies {
+		if strings.Contains(ua, f.token) {
+			return f.family, false
+		}
+	}
+	if name, _, _ := strings.Cut(products[0], "/"); name != "Mozilla" && name != "" {
+		return truncateLabel(name), false
+	}
+	return "Other", false
+}
+
+// truncateLabel bounds the names taken from headers
+func truncateLabel(s string) string {
+	if len(s) > 64 {
+		return s[:64]
+	}
+	return s
+}
+
+// refererHost returns the host of the referrer of a request from another
+// site, or ""
+func refererHost(r *http.Request) string {
+	ref := r.Referer()
+	if ref == "" {
+		return ""
+	}
+	u, err := url.Parse(ref)
+	if err != nil || u.Hostname() == "" {
+		return ""
+	}
+	host := strings.ToLower(u.Hostname())
+	self := r.Host
+	if h, _, err := net.SplitHostPort(self); err == nil {
+		self = h
+	}
+	if strings.EqualFold(host, self) {
+		return ""
+	}
+	return truncateLabel(host)
+}
+
+// clientsPage is the data of the HTML report
+type clientsPage struct {
+	UI      uiOptions
+	Msg     catalog
+	Report  clientsReport
+	Window  time.Duration
+	Windows []bandwidthWindow
+}
+
+// serveClients answers the report, as JSON or as a page as negotiated
+func (h *fileHandler) serveClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		renderError(w, r, http.StatusMethodNotAllowed, h.ui)
+		return
+	}
+	q := r.URL.Query()
+	window := bandwidthDefaultWindow
+	if v := q.Get("window"); v != "" {
+		d, err := parseWindow(v)
+		if err != nil || d <= 0 {
+			renderError(w, r, http.StatusBadRequest, h.ui)
+			return
+		}
+		window = min(d, h.clients.retention)
+	}
+	limit := bandwidthDefaultLimit
+	if n, err := strconv.Atoi(q.Get("limit")); err == nil && n > 0 {
+		limit = min(n, bandwidthMaxLimit)
+	}
+	report := h.clients.report(window, limit, time.Now())
+	w.Header().Set("Cache-Control", "no-store")
+	if q.Get("format") == "json" || prefersJSON(r) {
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+	msg := negotiateCatalog(r, h.ui.lang)
+	data := clientsPage{UI: h.ui, Msg: msg, Report: report, Window: window, Windows: reportWindows(statsClientsPath, q, window, h.clients.retention)}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Language", msg.Lang)
+	if err := clientsTemplate.Execute(w, data); err != nil {
+		h.log.logf("Error rendering the clients report: %v", err)
+	}
+}
+
+var clientsTemplate = template.Must(template.Must(uiTemplates.Clone()).New("clients").Funcs(template.FuncMap{
+	"duration": shortDuration,
+	"percent":  func(f float64) string { return strconv.FormatFloat(f*100, 'f', 1, 64) + "%" },
+}).Parse(`<!DOCTYPE html>
+<html lang="{{.Msg.Lang}}">
+<head>
+{{template "head"}}
+<title>{{.Msg.T "clients.title" (duration .Window)}}{{if .UI.Title}} - {{.UI.Title}}{{end}}</title>
+<style>
+table { border-collapse: collapse; width: 100%; }
+td, th { text-align: left; padding: 0.25em 0.5em; border-bottom: 1px solid var(--border); }
+td.n, th.n { text-align: right; font-variant-numeric: tabular-nums; }
+.bar { background: var(--link); height: 0.6em; border-radius: 2px; }
+nav.windows a.current { font-weight: bold; text-decoration: none; color: var(--fg); }
+</style>
+</head>
+<body>
+{{template "header" .}}
+<h1>{{.Msg.T "clients.title" (duration .Window)}}</h1>
+<nav class="windows">{{range .Windows}}<a href="{{.URL}}"{{if .Current}} class="current"{{end}}>{{.Label}}</a> {{end}}</nav>
+<p class="muted">{{.Msg.T "clients.total" .Report.UniqueClients .Report.TotalRequests .Report.Direct}}</p>
+{{if .Report.TotalRequests}}<h2>{{.Msg.T "clients.agents"}}</h2>
+<table>
+<tr><th>{{.Msg.T "clients.agent"}}</th><th class="n">{{.Msg.T "stats.requests"}}</th><th class="n">%</th><th></th></tr>
+{{range .Report.Agents}}<tr><td>{{.Agent}}{{if .Bot}} <span class="muted">({{$.Msg.T "clients.bot"}})</span>{{end}}</td><td class="n">{{.Requests}}</td><td class="n">{{percent .Share}}</td><td style="width: 20%"><div class="bar" style="width: {{percent .Share}}"></div></td></tr>
+{{end}}</table>
+<h2>{{.Msg.T "clients.referers"}}</h2>
+{{if .Report.Referers}}<table>
+<tr><th>{{.Msg.T "clients.referer"}}</th><th class="n">{{.Msg.T "stats.requests"}}</th><th class="n">%</th><th></th></tr>
+{{range .Report.Referers}}<tr><td>{{.Referer}}</td><td class="n">{{.Requests}}</td><td class="n">{{percent .Share}}</td><td style="width: 20%"><div class="bar" style="width: {{percent .Share}}"></div></td></tr>
+{{end}}</table>{{else}}<p>{{.Msg.T "clients.noreferers"}}</p>{{end}}{{else}}<p>{{.Msg.T "stats.empty"}}</p>{{end}}
+</body>
+</html>
+`))
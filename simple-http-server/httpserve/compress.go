@@ -0,0 +1,250 @@
+package httpserve
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultCompressTypes are the media types compressed unless --compress-types
+// says otherwise
+const defaultCompressTypes = "text/*,application/javascript,application/json,application/xml,image/svg+xml"
+
+// compressor negotiates and applies response compression, reusing encoders
+// through one pool per algorithm
+type compressor struct {
+	minSize int
+	types   []string
+	gzip    sync.Pool
+	deflate sync.Pool
+}
+
+// newCompressor checks the levels and returns a compressor for responses
+// of at least minSize bytes whose media type matches types
+func newCompressor(gzipLevel, deflateLevel, minSize int, types string) (*compressor, error) {
+	for name, level := range map[string]int{"gzip": gzipLevel, "deflate": deflateLevel} {
+		if level < flate.HuffmanOnly || level > flate.BestCompression {
+			return nil, fmt.Errorf("invalid %s level %d (expected -2 to 9)", name, level)
+		}
+	}
+	c := &compressor{minSize: minSize}
+	for _, t := range strings.Split(types, ",") {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			c.types = append(c.types, t)
+		}
+	}
+	if len(c.types) == 0 {
+		return nil, fmt.Errorf("no media types to compress")
+	}
+	c.gzip.New = func() any {
+		w, _ := gzip.NewWriterLevel(io.Discard, gzipLevel)
+		return w
+	}
+	c.deflate.New = func() any {
+		w, _ := flate.NewWriter(io.Discard, deflateLevel)
+		return w
+	}
+	return c, nil
+}
+
+// compressible reports whether responses of contentType may be compressed
+func (c *compressor) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range c.types {
+		if prefix, ok := strings.CutSuffix(t, "*"); ok && strings.HasPrefix(mediaType, prefix) || mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiate picks gzip or deflate from the Accept-Encoding header,
+// preferring gzip on equal weights
+func negotiate(header string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "*" {
+			coding = "gzip"
+		}
+		if (coding == "gzip" || coding == "deflate") && (q > bestQ || q == bestQ && coding == "gzip") {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// wrap returns a writer compressing the response when the client accepts
+// it, or nil when the response is sent as is
+func (c *compressor) wrap(w http.ResponseWriter, r *http.Request) *compressWriter {
+	// Upgraded connections are taken over, not written through
+	if c == nil || r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" {
+		return nil
+	}
+	encoding := negotiate(r.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		return nil
+	}
+	return &compressWriter{ResponseWriter: w, c: c, encoding: encoding, status: http.StatusOK}
+}
+
+// compressWriter holds the start of the body back until it knows whether
+// the response is worth compressing, then either streams it through a
+// pooled encoder or passes it, and any sendfile fast path, through untouched
+type compressWriter struct {
+	http.ResponseWriter
+	c        *compressor
+	encoding string
+	status   int
+	decided  bool
+	buf      []byte
+	enc      interface {
+		io.WriteCloser
+		Flush() error
+		Reset(io.Writer)
+	}
+}
+
+// WriteHeader records the status, sending error and partial responses
+// uncompressed
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.decided {
+		return
+	}
+	cw.status = code
+	if code != http.StatusOK || cw.Header().Get("Content-Encoding") != "" {
+		cw.decide(false)
+		return
+	}
+	if n, err := strconv.Atoi(cw.Header().Get("Content-Length")); err == nil {
+		cw.decide(n >= cw.c.minSize && cw.c.compressible(cw.Header().Get("Content-Type")))
+	}
+}
+
+// Write buffers the body until minSize bytes have arrived
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.decided {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) < cw.c.minSize {
+			return len(b), nil
+		}
+		if err := cw.decideFromBody(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// ReadFrom keeps the sendfile path for bodies that are not compressed
+func (cw *compressWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !cw.decided && len(cw.buf) == 0 {
+		if n, err := strconv.Atoi(cw.Header().Get("Content-Length")); err == nil {
+			cw.decide(cw.status == http.StatusOK && n >= cw.c.minSize && cw.c.compressible(cw.Header().Get("Content-Type")))
+		}
+	}
+	if cw.decided && cw.enc == nil {
+		return readFrom(cw.ResponseWriter, src)
+	}
+	return io.Copy(writerOnly{cw}, src)
+}
+
+// Flush sends what has been written so far, compressing it if the body
+// already qualified
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decideFromBody()
+	}
+	if cw.enc != nil {
+		cw.enc.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close finishes the response and returns the encoder to its pool
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if err := cw.decideFromBody(); err != nil {
+			return err
+		}
+	}
+	if cw.enc == nil {
+		return nil
+	}
+	err := cw.enc.Close()
+	if cw.encoding == "gzip" {
+		cw.c.gzip.Put(cw.enc)
+	} else {
+		cw.c.deflate.Put(cw.enc)
+	}
+	cw.enc = nil
+	return err
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// decideFromBody decides based on the buffered start of the body, sniffing
+// its type when the handler set none, and writes the buffer out
+func (cw *compressWriter) decideFromBody() error {
+	if cw.Header().Get("Content-Type") == "" && len(cw.buf) > 0 {
+		cw.Header().Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	cw.decide(cw.status == http.StatusOK && len(cw.buf) >= cw.c.minSize && cw.c.compressible(cw.Header().Get("Content-Type")))
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := cw.Write(buf)
+	return err
+}
+
+// decide sends the headers, switching to the encoder when compress is set
+func (cw *compressWriter) decide(compress bool) {
+	cw.decided = true
+	h := cw.Header()
+	if cw.c.compressible(h.Get("Content-Type")) {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	if compress {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", cw.encoding)
+		// The compressed body is a different representation of the same file
+		if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+			h.Set("ETag", "W/"+etag)
+		}
+		if cw.encoding == "gzip" {
+			cw.enc = cw.c.gzip.Get().(*gzip.Writer)
+		} else {
+			cw.enc = cw.c.deflate.Get().(*flate.Writer)
+		}
+		cw.enc.Reset(cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+}
@@ -0,0 +1,424 @@
+package httpserve
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"flag"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Config holds every option of the server. Each field mirrors the command
+// line flag named in its comment, documented by RegisterFlags; start from
+// DefaultConfig, as the zero value of some fields is not their default.
+type Config struct {
+	// Content is served instead of Dir when set, read-only. The bundle
+	// subcommand sets it to the embedded files.
+	Content fs.FS
+
+	// Middleware is inserted into the request pipeline between the
+	// built-in stages, see Hook.
+	Middleware []Hook
+
+	// Logger receives the log output, StdLogger when nil.
+	Logger Logger
+
+	// Metrics receives the measurements of the server, none when nil.
+	Metrics Metrics
+
+	// Listening and connections
+	Addr                 string        // --addr
+	Network              string        // --network
+	Listen               []string      // --listen
+	ACMEDomains          []string      // --acme-domain
+	ACMEDNS              string        // --acme-dns
+	ACMEEmail            string        // --acme-email
+	ACMEDirectory        string        // --acme-directory
+	ACMECache            string        // --acme-cache
+	ACMEDNSPropagation   time.Duration // --acme-dns-propagation
+	SocketMode           os.FileMode   // --socket-mode
+	Port                 string        // --port
+	ReusePort            int           // --reuseport
+	ReadyFile            string        // --ready-file
+	ReadyFD              int           // --ready-fd
+	KeepAlive            bool          // --keep-alive
+	ReadHeaderTimeout    time.Duration // --read-header-timeout
+	MinReadRate          int64         // --min-read-rate
+	MinReadRateGrace     time.Duration // --min-read-rate-grace
+	IdleTimeout          time.Duration // --idle-timeout
+	RequestTimeout       time.Duration // --request-timeout
+	MaxConnRequests      int64         // --max-conn-requests
+	MaxConnLifetime      time.Duration // --max-conn-lifetime
+	TCPNoDelay           bool          // --tcp-nodelay
+	TCPSendBuffer        int64         // --tcp-send-buffer
+	TCPReceiveBuffer     int64         // --tcp-receive-buffer
+	TCPKeepAlive         bool          // --tcp-keepalive
+	TCPKeepAliveIdle     time.Duration // --tcp-keepalive-idle
+	TCPKeepAliveInterval time.Duration // --tcp-keepalive-interval
+	TCPKeepAliveCount    int           // --tcp-keepalive-count
+
+	// Go runtime
+	GoMaxProcs int    // --gomaxprocs
+	GoMemLimit string // --gomemlimit
+	GoGC       int    // --gogc
+
+	// Served files
+	Dir       string        // --dir
+	Backend   string        // --backend
+	Mirror    string        // --mirror
+	MirrorTTL time.Duration // --mirror-ttl
+	Overlays  []string      // --overlay
+
+	// Listings and pages
+	Sort                   string // --sort
+	Order                  string // --order
+	PageSize               int    // --page-size
+	ListingStreamThreshold int    // --listing-stream-threshold
+	ListingCSS             string // --listing-css
+	Title                  string // --title
+	Logo                   string // --logo
+	Lang                   string // --lang
+
+	// Request paths
+	PathNFC              bool   // --path-nfc
+	RejectEncodedSlashes bool   // --reject-encoded-slashes
+	CaseInsensitive      bool   // --case-insensitive
+	AutoIndexFile        string // --auto-index-file
+
+	// Forced downloads
+	DownloadExtensions string // --download-extensions
+	DownloadNoRanges   bool   // --download-no-ranges
+
+	// Uploads and other writes
+	Mode                  string // --mode
+	Upload                bool   // --upload
+	UploadOverwrite       bool   // --upload-overwrite
+	UploadMaxSize         int64  // --upload-max-size
+	UploadAllow           string // --upload-allow
+	UploadDenyExecutables bool   // --upload-deny-executables
+	ScanClamd             string // --scan-clamd
+	ScanCommand           string // --scan-command
+	ScanQuarantine        string // --scan-quarantine
+	ScanFailOpen          bool   // --scan-fail-open
+
+	// Notifications
+	WebhookURL          string // --webhook-url
+	WebhookSecret       string // --webhook-secret
+	WebhookDownloadSize int64  // --webhook-download-size
+
+	// Caching
+	CacheSize    int64 // --cache-size
+	CacheMaxFile int64 // --cache-max-file
+
+	// Load shedding and fault injection
+	ShedMaxInFlight  int           // --shed-max-inflight
+	ShedQueueTimeout time.Duration // --shed-queue-timeout
+	ShedMaxMemory    int64         // --shed-max-memory
+	ShedRetryAfter   time.Duration // --shed-retry-after
+	RateLimit        float64       // --rate-limit
+	RateBurst        int           // --rate-burst
+	ChaosLatency     string        // --chaos-latency
+	ChaosErrorRate   float64       // --chaos-error-rate
+
+	// Compression and response copying
+	Compress        bool   // --compress
+	GzipLevel       int    // --gzip-level
+	DeflateLevel    int    // --deflate-level
+	CompressMinSize int64  // --compress-min-size
+	CompressTypes   string // --compress-types
+	IOBufferSize    int64  // --io-buffer-size
+
+	// Debugging
+	Debug             bool   // --debug
+	LogFile           string // --log-file
+	TUI               bool   // --tui
+	Record            string // --record
+	RecordMaxBody     int64  // --record-max-body
+	RecordCredentials bool   // --record-credentials
+
+	// Administration
+	AdminAddr    string // --admin-addr
+	AdminToken   string // --admin-token
+	AdminJournal string // --admin-journal
+
+	// Maintenance and health checks
+	Maintenance           bool          // --maintenance
+	MaintenancePage       string        // --maintenance-page
+	MaintenanceRetryAfter time.Duration // --maintenance-retry-after
+	Health                bool          // --health
+
+	// Metadata caching, preindexing and memory mapping
+	MetaCache   int   // --meta-cache
+	Preindex    bool  // --preindex
+	MmapMinSize int64 // --mmap-min-size
+
+	// Upload quotas
+	UploadQuota    int64 // --upload-quota
+	UploadDirQuota int64 // --upload-dir-quota
+	MinFreeSpace   int64 // --min-free-space
+
+	// Resumable uploads, deletion and file management
+	TusDir         string        // --tus-dir
+	TusExpire      time.Duration // --tus-expire
+	AllowDelete    bool          // --allow-delete
+	TrashRetention time.Duration // --trash-retention
+	AllowManage    bool          // --allow-manage
+	WebDAV         bool          // --webdav
+	WebDAVPrefix   string        // --webdav-prefix
+	WebDAVReadOnly bool          // --webdav-readonly
+
+	// Access, routing and proxies
+	Auth           []string      // --auth
+	LinkSecret     string        // --link-secret
+	LinkExpiry     time.Duration // --link-expiry
+	Vhosts         []string      // --vhost
+	Userdir        string        // --userdir
+	UserdirUsers   string        // --userdir-users
+	UserdirQuota   int64         // --userdir-quota
+	UserdirPrivate bool          // --userdir-private
+	Proxies        []string      // --proxy
+	ForwardProxy   []string      // --forward-proxy
+	Headers        []string      // --header
+	Plugins        []string      // --plugin
+	Script         string        // --script
+	ScriptMaxSteps int           // --script-max-steps
+	Wasm           []string      // --wasm
+	WasmFuel       int64         // --wasm-fuel
+	WasmMaxMemory  int64         // --wasm-max-memory
+
+	// Extra endpoints and protocols
+	LiveReload      bool          // --live-reload
+	Watch           bool          // --watch
+	GraphQL         bool          // --graphql
+	Diff            bool          // --diff
+	Stats           bool          // --stats
+	Mock            string        // --mock
+	DebugEcho       bool          // --debug-echo
+	Templates       bool          // --templates
+	TemplateData    string        // --template-data
+	TemplateEnv     string        // --template-env
+	SSI             bool          // --ssi
+	GRPC            bool          // --grpc
+	QR              bool          // --qr
+	UPnP            bool          // --upnp
+	MDNS            string        // --mdns
+	Expose          string        // --expose
+	ExposeSubdomain string        // --expose-subdomain
+	FTP             string        // --ftp
+	FTPPassivePorts string        // --ftp-passive-ports
+	FTPTLSCert      string        // --ftp-tls-cert
+	FTPTLSKey       string        // --ftp-tls-key
+	GRPCAddr        string        // --grpc-addr
+	StatsRetention  time.Duration // --stats-retention
+}
+
+// metrics returns the Metrics of c, or the default discarding them
+func (c Config) metrics() Metrics {
+	if c.Metrics == nil {
+		return noMetrics{}
+	}
+	return c.Metrics
+}
+
+// DefaultConfig returns the configuration the flags default to
+func DefaultConfig() Config {
+	return Config{
+		Addr:                   "0.0.0.0",
+		Network:                "tcp",
+		ACMEDirectory:          letsEncryptDirectory,
+		ACMEDNSPropagation:     2 * time.Minute,
+		SocketMode:             0o660,
+		Port:                   "8080",
+		KeepAlive:              true,
+		ReadHeaderTimeout:      10 * time.Second,
+		MinReadRate:            240,
+		MinReadRateGrace:       5 * time.Second,
+		TCPNoDelay:             true,
+		TCPKeepAlive:           true,
+		Dir:                    ".",
+		Sort:                   "name",
+		Order:                  "asc",
+		PageSize:               500,
+		ListingStreamThreshold: 10000,
+		Lang:                   "en",
+		PathNFC:                true,
+		RejectEncodedSlashes:   true,
+		AutoIndexFile:          autoIndexOff,
+		Mode:                   modeReadOnly,
+		UploadDenyExecutables:  true,
+		WebhookDownloadSize:    100 << 20,
+		CacheMaxFile:           1 << 20,
+		RecordMaxBody:          64 << 10,
+		ShedRetryAfter:         5 * time.Second,
+		RateBurst:              20,
+		ScriptMaxSteps:         10000,
+		WasmFuel:               10000000,
+		WasmMaxMemory:          64 << 20,
+		GzipLevel:              gzip.DefaultCompression,
+		DeflateLevel:           flate.DefaultCompression,
+		CompressMinSize:        1 << 10,
+		CompressTypes:          defaultCompressTypes,
+		IOBufferSize:           32 << 10,
+		TusDir:                 filepath.Join(os.TempDir(), "simple-http-server-tus"),
+		TusExpire:              24 * time.Hour,
+		TrashRetention:         7 * 24 * time.Hour,
+		StatsRetention:         7 * 24 * time.Hour,
+		MaintenanceRetryAfter:  time.Minute,
+		WebDAVPrefix:           "/_dav/",
+		LinkExpiry:             24 * time.Hour,
+	}
+}
+
+// RegisterFlags defines a flag for every field of c on fs, defaulting to
+// its current value, so parsing the command line fills c in
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Addr, "addr", c.Addr, "IP Address to bind to (:: for all with --network tcp6), or unix:<path> to listen on a Unix domain socket instead")
+	fs.StringVar(&c.Network, "network", c.Network, "Listen over tcp (IPv4 and IPv6), tcp4 (IPv4 only) or tcp6 (IPv6 only)")
+	fs.Var((*stringList)(&c.Listen), "listen", "Listen on ADDR[,cert=FILE,key=FILE] or ADDR,acme instead of --addr and --port, serving HTTPS when given a certificate (repeatable, e.g. --listen :8080 --listen :8443,cert=cert.pem,key=key.pem)")
+	fs.Var((*stringList)(&c.ACMEDomains), "acme-domain", "Serve HTTPS with a certificate for this domain (repeatable, wildcards allowed) from an ACME CA, proving control with DNS-01 challenges; applies to --addr and --port, or to the --listen addresses marked acme")
+	fs.StringVar(&c.ACMEDNS, "acme-dns", c.ACMEDNS, "DNS provider publishing the challenge records: cloudflare (CLOUDFLARE_DNS_API_TOKEN), route53 (AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY) or exec:<program>, run as <program> present|cleanup <fqdn> <value>")
+	fs.StringVar(&c.ACMEEmail, "acme-email", c.ACMEEmail, "Contact email of the ACME account, for expiry notices")
+	fs.StringVar(&c.ACMEDirectory, "acme-directory", c.ACMEDirectory, "Directory URL of the ACME CA")
+	fs.StringVar(&c.ACMECache, "acme-cache", c.ACMECache, "Directory keeping the ACME account key and certificates (default simple-http-server/acme in the user cache directory)")
+	fs.DurationVar(&c.ACMEDNSPropagation, "acme-dns-propagation", c.ACMEDNSPropagation, "Wait up to this long for the challenge records to be visible in DNS before asking the CA to check them (0 to not wait)")
+	fs.Var((*fileMode)(&c.SocketMode), "socket-mode", "Permissions of the Unix domain socket of --addr unix:<path>")
+	fs.StringVar(&c.Port, "port", c.Port, "Port to bind to")
+	fs.IntVar(&c.ReusePort, "reuseport", c.ReusePort, "Open this many listening sockets with SO_REUSEPORT on each TCP address and accept on each in parallel (0 uses a single listener)")
+	fs.StringVar(&c.ReadyFile, "ready-file", c.ReadyFile, "Once listening, write the bound addresses to this file, one per line, and remove it on shutdown; with --port 0 it tells test harnesses the port picked. The server exits with 3 when it cannot listen, 1 when it fails later")
+	fs.IntVar(&c.ReadyFD, "ready-fd", c.ReadyFD, "Once listening, write the bound addresses to this inherited file descriptor, one per line, and close it (0 for none)")
+	fs.BoolVar(&c.KeepAlive, "keep-alive", c.KeepAlive, "Keep client connections open between requests")
+	fs.DurationVar(&c.ReadHeaderTimeout, "read-header-timeout", c.ReadHeaderTimeout, "Close connections that take longer than this to send the request headers (0 for no limit)")
+	fs.Var((*byteSize)(&c.MinReadRate), "min-read-rate", "Abort requests whose headers or body arrive slower than this many bytes per second with 408, once --min-read-rate-grace has passed (0 for no limit; headers are only checked on plain HTTP listeners)")
+	fs.DurationVar(&c.MinReadRateGrace, "min-read-rate-grace", c.MinReadRateGrace, "How long headers and bodies may arrive below --min-read-rate before the request is aborted")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "Close keep-alive connections idle for this long (0 for no limit)")
+	fs.DurationVar(&c.RequestTimeout, "request-timeout", c.RequestTimeout, "Cancel requests not done within this time, answering 503 if nothing was sent yet (0 for no limit; streams and WebSockets are exempt)")
+	fs.Int64Var(&c.MaxConnRequests, "max-conn-requests", c.MaxConnRequests, "Close connections after serving this many requests (0 for no limit)")
+	fs.DurationVar(&c.MaxConnLifetime, "max-conn-lifetime", c.MaxConnLifetime, "Close connections at the end of the first response after they have been open this long (0 for no limit)")
+	fs.BoolVar(&c.TCPNoDelay, "tcp-nodelay", c.TCPNoDelay, "Send small writes immediately (TCP_NODELAY)")
+	fs.Var((*byteSize)(&c.TCPSendBuffer), "tcp-send-buffer", "Socket send buffer size (SO_SNDBUF), e.g. 4M (0 keeps the OS default)")
+	fs.Var((*byteSize)(&c.TCPReceiveBuffer), "tcp-receive-buffer", "Socket receive buffer size (SO_RCVBUF), e.g. 4M (0 keeps the OS default)")
+	fs.BoolVar(&c.TCPKeepAlive, "tcp-keepalive", c.TCPKeepAlive, "Probe idle connections with TCP keepalives")
+	fs.DurationVar(&c.TCPKeepAliveIdle, "tcp-keepalive-idle", c.TCPKeepAliveIdle, "Idle time before the first keepalive probe (0 for 15s)")
+	fs.DurationVar(&c.TCPKeepAliveInterval, "tcp-keepalive-interval", c.TCPKeepAliveInterval, "Time between keepalive probes (0 for 15s)")
+	fs.IntVar(&c.TCPKeepAliveCount, "tcp-keepalive-count", c.TCPKeepAliveCount, "Unanswered probes before a connection is dropped (0 for 9)")
+	fs.IntVar(&c.GoMaxProcs, "gomaxprocs", c.GoMaxProcs, "Number of OS threads running Go code (0 follows the container CPU quota)")
+	fs.StringVar(&c.GoMemLimit, "gomemlimit", c.GoMemLimit, "Soft memory limit for the Go runtime, e.g. 512M, or auto for 90% of the container limit")
+	fs.IntVar(&c.GoGC, "gogc", c.GoGC, "GC target percentage, as GOGC (0 keeps the default, -1 disables the GC)")
+	fs.StringVar(&c.Dir, "dir", c.Dir, "Directory, or .zip, .tar, .tar.gz or .tgz archive, to serve files from")
+	fs.StringVar(&c.Backend, "backend", c.Backend, "Serve read-only from remote storage instead of --dir: s3://bucket/prefix, gs://bucket/prefix, azblob://container/prefix or sftp://user@host/path; mem serves a copy of --dir from memory, reading a tarball from stdin with --dir -")
+	fs.StringVar(&c.Mirror, "mirror", c.Mirror, "Fill --dir from this origin URL: missing files are fetched on first request and served from disk afterwards")
+	fs.DurationVar(&c.MirrorTTL, "mirror-ttl", c.MirrorTTL, "Revalidate mirrored files with the origin once they are older than this (0 never does, suiting immutable release artifacts)")
+	fs.StringVar(&c.Sort, "sort", c.Sort, "Default listing sort key (name, size or mtime)")
+	fs.StringVar(&c.Order, "order", c.Order, "Default listing sort order (asc or desc)")
+	fs.IntVar(&c.PageSize, "page-size", c.PageSize, "Number of entries per directory listing page")
+	fs.IntVar(&c.ListingStreamThreshold, "listing-stream-threshold", c.ListingStreamThreshold, "Stream directories with more entries than this unsorted, in pages with a load more link (0 always sorts)")
+	fs.StringVar(&c.ListingCSS, "listing-css", c.ListingCSS, "Path to a stylesheet injected into directory listings")
+	fs.StringVar(&c.Title, "title", c.Title, "Title shown on listing and error pages")
+	fs.StringVar(&c.Logo, "logo", c.Logo, "URL of a logo image shown on listing and error pages")
+	fs.StringVar(&c.Lang, "lang", c.Lang, "Default language for listing and error pages")
+	fs.BoolVar(&c.PathNFC, "path-nfc", c.PathNFC, "Normalize request paths to Unicode NFC")
+	fs.BoolVar(&c.RejectEncodedSlashes, "reject-encoded-slashes", c.RejectEncodedSlashes, "Reject request paths containing encoded slashes or backslashes")
+	fs.BoolVar(&c.CaseInsensitive, "case-insensitive", c.CaseInsensitive, "Resolve request paths case-insensitively")
+	fs.StringVar(&c.AutoIndexFile, "auto-index-file", c.AutoIndexFile, "Generate index.html for directories lacking one (off, virtual or write)")
+	fs.StringVar(&c.DownloadExtensions, "download-extensions", c.DownloadExtensions, "Comma separated extensions sent with Content-Disposition: attachment, so browsers save rather than display them, e.g. '.zip,.iso,.apk'; any file is with ?dl=1")
+	fs.BoolVar(&c.DownloadNoRanges, "download-no-ranges", c.DownloadNoRanges, "Send forced downloads whole, without Accept-Ranges, so browsers can't stream them instead")
+	fs.StringVar(&c.Mode, "mode", c.Mode, "Operating mode: ro refuses every modifying request, rw enables the write features below")
+	fs.BoolVar(&c.Upload, "upload", c.Upload, "Allow uploading files with PUT and multipart POST")
+	fs.BoolVar(&c.UploadOverwrite, "upload-overwrite", c.UploadOverwrite, "Allow uploads to replace existing files")
+	fs.Int64Var(&c.UploadMaxSize, "upload-max-size", c.UploadMaxSize, "Maximum upload size in bytes (0 for no limit)")
+	fs.StringVar(&c.UploadAllow, "upload-allow", c.UploadAllow, "Comma separated extensions and MIME types uploads may store, e.g. '.png,.pdf,image/*' (empty allows all)")
+	fs.BoolVar(&c.UploadDenyExecutables, "upload-deny-executables", c.UploadDenyExecutables, "Reject uploads of executables and scripts")
+	fs.StringVar(&c.ScanClamd, "scan-clamd", c.ScanClamd, "Scan uploads with clamd before storing them (unix:/path or tcp:host:port)")
+	fs.StringVar(&c.ScanCommand, "scan-command", c.ScanCommand, "Scan uploads with a command given the file path (exit 0 clean, 1 infected)")
+	fs.StringVar(&c.ScanQuarantine, "scan-quarantine", c.ScanQuarantine, "Move infected uploads to this directory instead of discarding them")
+	fs.BoolVar(&c.ScanFailOpen, "scan-fail-open", c.ScanFailOpen, "Accept uploads when the virus scanner is unavailable")
+	fs.StringVar(&c.WebhookURL, "webhook-url", c.WebhookURL, "POST JSON notifications of uploads, deletions and large downloads to this URL")
+	fs.StringVar(&c.WebhookSecret, "webhook-secret", c.WebhookSecret, "Sign webhook bodies with HMAC-SHA256 in the X-Signature-256 header")
+	fs.Var((*byteSize)(&c.WebhookDownloadSize), "webhook-download-size", "Minimum size of completed downloads reported to the webhook")
+	fs.Var((*byteSize)(&c.CacheSize), "cache-size", "Keep up to this much of the most requested small files in memory, e.g. 64M (0 disables the cache)")
+	fs.Var((*byteSize)(&c.CacheMaxFile), "cache-max-file", "Largest file held in the in-memory cache")
+	fs.IntVar(&c.ShedMaxInFlight, "shed-max-inflight", c.ShedMaxInFlight, "Reject requests with 503 beyond this many in flight (0 for no limit)")
+	fs.DurationVar(&c.ShedQueueTimeout, "shed-queue-timeout", c.ShedQueueTimeout, "How long a request may wait for an in-flight slot before it is rejected")
+	fs.Var((*byteSize)(&c.ShedMaxMemory), "shed-max-memory", "Reject requests with 503 while the process uses more memory than this, e.g. 1G (0 for no limit)")
+	fs.DurationVar(&c.ShedRetryAfter, "shed-retry-after", c.ShedRetryAfter, "Retry-After sent with rejected requests")
+	fs.Float64Var(&c.RateLimit, "rate-limit", c.RateLimit, "Reject requests with 429 beyond this many per second from each client address (0 for no limit)")
+	fs.IntVar(&c.RateBurst, "rate-burst", c.RateBurst, "Requests a client may send at once before --rate-limit applies")
+	fs.StringVar(&c.ChaosLatency, "chaos-latency", c.ChaosLatency, "Delay every request by this much for development, e.g. 200ms or 200ms±100ms")
+	fs.Float64Var(&c.ChaosErrorRate, "chaos-error-rate", c.ChaosErrorRate, "Fail this fraction of requests with 500 for development, e.g. 0.01")
+	fs.BoolVar(&c.Compress, "compress", c.Compress, "Compress responses with gzip or deflate when the client accepts it")
+	fs.IntVar(&c.GzipLevel, "gzip-level", c.GzipLevel, "gzip compression level (-2 Huffman only, -1 default, 1 fastest to 9 best)")
+	fs.IntVar(&c.DeflateLevel, "deflate-level", c.DeflateLevel, "deflate compression level (-2 Huffman only, -1 default, 1 fastest to 9 best)")
+	fs.Var((*byteSize)(&c.CompressMinSize), "compress-min-size", "Smallest response body worth compressing")
+	fs.StringVar(&c.CompressTypes, "compress-types", c.CompressTypes, "Comma separated media types to compress, with type/* wildcards")
+	fs.Var((*byteSize)(&c.IOBufferSize), "io-buffer-size", "Buffer size for copying response bodies that cannot be sent with sendfile")
+	fs.BoolVar(&c.Debug, "debug", c.Debug, "Log debug details, such as whether each response body was sent with sendfile")
+	fs.BoolVar(&c.TUI, "tui", c.TUI, "Show a terminal dashboard of the requests, counters and transfers in progress instead of the log (keys: p pause, c clear, q quit)")
+	fs.StringVar(&c.LogFile, "log-file", c.LogFile, "Append the log to this file instead of stderr, reopened by POST /rotate-logs on the admin API")
+	fs.StringVar(&c.Record, "record", c.Record, "Record every request and response (headers, timings and the start of the bodies) to this HAR file, only readable by its owner, to play them again with the replay subcommand")
+	fs.Var((*byteSize)(&c.RecordMaxBody), "record-max-body", "How much of each request and response body --record keeps")
+	fs.BoolVar(&c.RecordCredentials, "record-credentials", c.RecordCredentials, "Keep the Authorization and Cookie headers and the link tokens in the --record file instead of redacting them, so requests to a server with --auth can be replayed")
+	fs.StringVar(&c.AdminAddr, "admin-addr", c.AdminAddr, "Serve the admin API on this separate address, e.g. 127.0.0.1:9000, instead of at /_admin/ on the file listeners: a dashboard at /, GET /stats, /har, /status, /config and /connections, GET and PATCH /settings, POST and DELETE /deny, GET /journal, POST /journal/{id}/revert, POST /reload, /rotate-logs, /drain and /shutdown?drain=30s")
+	fs.StringVar(&c.AdminToken, "admin-token", c.AdminToken, "Bearer token required by the admin API, which it turns on")
+	fs.StringVar(&c.AdminJournal, "admin-journal", c.AdminJournal, "Journal the settings changed through the admin API to this file, applying them again on start")
+	fs.BoolVar(&c.Maintenance, "maintenance", c.Maintenance, "Start in maintenance mode, answering 503 to every request but the admin API and --health; also on while a .maintenance file exists at the top of --dir")
+	fs.StringVar(&c.MaintenancePage, "maintenance-page", c.MaintenancePage, "HTML file answered in maintenance mode instead of the default page")
+	fs.DurationVar(&c.MaintenanceRetryAfter, "maintenance-retry-after", c.MaintenanceRetryAfter, "Retry-After of the 503 answered in maintenance mode")
+	fs.BoolVar(&c.Health, "health", c.Health, "Answer health checks at /_health, 200 while the server runs, and /_ready, 503 in maintenance mode")
+	fs.IntVar(&c.MetaCache, "meta-cache", c.MetaCache, "Cache stat results and directory listings of up to this many paths, invalidated by filesystem events (0 disables)")
+	fs.BoolVar(&c.Preindex, "preindex", c.Preindex, "Hash every file at startup to answer conditional requests and 404s from memory (with --mode ro, changes made on disk afterwards are only seen after a restart)")
+	fs.Var((*byteSize)(&c.MmapMinSize), "mmap-min-size", "Serve files at least this large from shared memory mappings, e.g. 64M (0 disables mmap)")
+	fs.Var((*byteSize)(&c.UploadQuota), "upload-quota", "Maximum total size of the served tree accepted by uploads, e.g. 10G (0 for no limit)")
+	fs.Var((*byteSize)(&c.UploadDirQuota), "upload-dir-quota", "Maximum size of the files in a single directory accepted by uploads (0 for no limit)")
+	fs.Var((*byteSize)(&c.MinFreeSpace), "min-free-space", "Refuse uploads that would leave less free disk space than this (0 to disable)")
+	fs.StringVar(&c.TusDir, "tus-dir", c.TusDir, "Directory storing in-progress resumable uploads")
+	fs.DurationVar(&c.TusExpire, "tus-expire", c.TusExpire, "Discard resumable uploads not completed within this time")
+	fs.BoolVar(&c.AllowDelete, "allow-delete", c.AllowDelete, "Allow deleting files with DELETE (requires --auth)")
+	fs.DurationVar(&c.TrashRetention, "trash-retention", c.TrashRetention, "Keep deleted files in a hidden .trash directory for this long (0 deletes immediately)")
+	fs.BoolVar(&c.AllowManage, "allow-manage", c.AllowManage, "Allow creating directories and moving entries (requires --auth)")
+	fs.BoolVar(&c.WebDAV, "webdav", c.WebDAV, "Expose the served directory over WebDAV")
+	fs.StringVar(&c.WebDAVPrefix, "webdav-prefix", c.WebDAVPrefix, "URL prefix of the WebDAV endpoint")
+	fs.BoolVar(&c.WebDAVReadOnly, "webdav-readonly", c.WebDAVReadOnly, "Only allow read operations over WebDAV (always on with --mode ro)")
+	fs.Var((*stringList)(&c.Auth), "auth", "Require basic auth with the given user:password (repeatable)")
+	fs.StringVar(&c.LinkSecret, "link-secret", c.LinkSecret, "Only let in visitors who opened a link signed with this secret, printed on startup and valid for --link-expiry")
+	fs.DurationVar(&c.LinkExpiry, "link-expiry", c.LinkExpiry, "How long the --link-secret link printed on startup stays valid")
+	fs.Var((*stringList)(&c.Vhosts), "vhost", "Serve a directory for a host name, as host=dir (repeatable; other hosts get --dir)")
+	fs.StringVar(&c.Userdir, "userdir", c.Userdir, "Serve the subdirectory name of this directory at /~name/, writable only by the user authenticated as name (must be outside --dir)")
+	fs.StringVar(&c.UserdirUsers, "userdir-users", c.UserdirUsers, "File of the --userdir users, a line of name:password per user, optionally followed by root=dir and quota=size; only they get homes, created when missing, and log in like --auth users")
+	fs.Var((*byteSize)(&c.UserdirQuota), "userdir-quota", "Maximum total size of each --userdir home accepted by uploads, e.g. 1G (0 for no limit; quota= in --userdir-users overrides it)")
+	fs.BoolVar(&c.UserdirPrivate, "userdir-private", c.UserdirPrivate, "Only let the owner of a --userdir home read it")
+	fs.Var((*stringList)(&c.Proxies), "proxy", "Reverse proxy a path prefix to an upstream server, as /prefix=http://host:port (repeatable; a target path such as http://host:port/ replaces the prefix)")
+	fs.Var((*stringList)(&c.ForwardProxy), "forward-proxy", "Also act as a forward proxy (CONNECT and absolute URLs) for destinations matching this host[:port] pattern, e.g. *.staging.example.com; ports 80 and 443 when none is given (repeatable)")
+	fs.Var((*stringList)(&c.Headers), "header", "Add a response header, as 'Name: value' (repeatable)")
+	fs.StringVar(&c.Script, "script", c.Script, "Run this Lua script for every request to inspect it, set headers, deny, redirect or rewrite it")
+	fs.IntVar(&c.ScriptMaxSteps, "script-max-steps", c.ScriptMaxSteps, "Fail requests whose --script run takes more than this many evaluation steps")
+	fs.Var((*stringList)(&c.Wasm), "wasm", "Filter request and response headers with this proxy-wasm module, as FILE or FILE,config=FILE (repeatable, run in the order given)")
+	fs.Int64Var(&c.WasmFuel, "wasm-fuel", c.WasmFuel, "Fail requests whose --wasm filter runs more than this many instructions in one callback")
+	fs.Var((*byteSize)(&c.WasmMaxMemory), "wasm-max-memory", "Memory limit of each --wasm filter instance")
+	fs.Var((*stringList)(&c.Plugins), "plugin", "Run this program as a plugin, given request, auth and upload events as JSON lines on its stdin and answering them on its stdout (repeatable)")
+	fs.BoolVar(&c.LiveReload, "live-reload", c.LiveReload, "Reload HTML pages in the browser when files change, over server-sent events at /_livereload, for development")
+	fs.BoolVar(&c.Watch, "watch", c.Watch, "Stream created, modified and deleted paths as JSON over a WebSocket at /_watch, or /_watch/<dir> for a subtree")
+	fs.BoolVar(&c.GraphQL, "graphql", c.GraphQL, "Answer GraphQL queries over the file tree (paths, sizes, times, checksums, listings) at /graphql; GET it for the schema")
+	fs.BoolVar(&c.Diff, "diff", c.Diff, "Compare two directories at /_diff?a=/v1&b=/v2, listing the added, removed and changed files by size and SHA-256 (compare=size skips hashing)")
+	fs.BoolVar(&c.Stats, "stats", c.Stats, "Count the bytes served from each path and report the top ones at /_stats/top?window=24h, and the browsers, referring sites and unique clients at /_stats/clients, as HTML or JSON")
+	fs.StringVar(&c.Mock, "mock", c.Mock, "Answer the API routes of this YAML or JSON file (method, path pattern such as /api/users/{id}, status, latency, headers, and a body or fixture file) alongside the files, reloading it when it changes")
+	fs.BoolVar(&c.DebugEcho, "debug-echo", c.DebugEcho, "Answer any request to /_debug/echo with its method, headers, client and local addresses, forwarding headers and TLS details as JSON, to debug proxies and CORS")
+	fs.DurationVar(&c.StatsRetention, "stats-retention", c.StatsRetention, "How far back the --stats report can go")
+	fs.BoolVar(&c.Templates, "templates", c.Templates, "Render .tmpl and .gohtml files as Go templates, given the query as .Query, the request as .Request, .Env and .Data; index.gohtml and index.html.tmpl index directories")
+	fs.StringVar(&c.TemplateData, "template-data", c.TemplateData, "YAML or JSON file given to --templates as .Data, read again on every render")
+	fs.StringVar(&c.TemplateEnv, "template-env", c.TemplateEnv, "Give --templates the environment variables starting with this prefix as .Env (none when empty)")
+	fs.BoolVar(&c.SSI, "ssi", c.SSI, "Expand server-side includes (<!--#include file=\"header.html\" -->, include virtual and echo var) in .html, .htm and .shtml pages")
+	fs.BoolVar(&c.GRPC, "grpc", c.GRPC, "Also serve the gRPC FileService of fileservice.proto on the HTTP port, over cleartext HTTP/2")
+	fs.BoolVar(&c.QR, "qr", c.QR, "Print a QR code of the LAN URL on startup, to open it from a phone")
+	fs.BoolVar(&c.UPnP, "upnp", c.UPnP, "Ask the router to forward the port with NAT-PMP or UPnP and print the public URL, to share across the internet")
+	fs.StringVar(&c.Expose, "expose", c.Expose, "Expose the server through a tunnel to this relay speaking the localtunnel protocol, e.g. https://localtunnel.me or a self-hosted one, and print its public URL, to share from behind NAT")
+	fs.StringVar(&c.ExposeSubdomain, "expose-subdomain", c.ExposeSubdomain, "Ask the --expose relay for this subdomain instead of a random one")
+	fs.StringVar(&c.MDNS, "mdns", c.MDNS, "Advertise the server on the local network over mDNS/Bonjour as an _http._tcp service with this name, also answering for <name>.local")
+	fs.StringVar(&c.FTP, "ftp", c.FTP, "Also serve the files read-only over FTP on this address, e.g. :2121, with the same --auth credentials (anonymous without them)")
+	fs.StringVar(&c.FTPPassivePorts, "ftp-passive-ports", c.FTPPassivePorts, "Port range for passive FTP data connections, e.g. 50000-50100 (any free port when empty)")
+	fs.StringVar(&c.FTPTLSCert, "ftp-tls-cert", c.FTPTLSCert, "Certificate file offering explicit FTPS (AUTH TLS) on the FTP listener")
+	fs.StringVar(&c.FTPTLSKey, "ftp-tls-key", c.FTPTLSKey, "Private key file of --ftp-tls-cert")
+	fs.StringVar(&c.GRPCAddr, "grpc-addr", c.GRPCAddr, "Serve the gRPC FileService on this separate address instead, e.g. :9090")
+	fs.Var((*stringList)(&c.Overlays), "overlay", "Layer a directory or archive over --dir, each one taking precedence over the layers before it (repeatable)")
+}
@@ -0,0 +1,44 @@
+package httpserve
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// connOptions controls how long client connections are kept open
+type connOptions struct {
+	maxRequests int64
+	maxLifetime time.Duration
+}
+
+// connInfo tracks a client connection across its requests
+type connInfo struct {
+	opened   time.Time
+	requests atomic.Int64
+	guarded  *guardedConn // when --min-read-rate guards its headers
+}
+
+type connInfoKey struct{}
+
+// connContext attaches a connInfo to every connection accepted by the server
+func connContext(ctx context.Context, c net.Conn) context.Context {
+	info := &connInfo{opened: time.Now()}
+	info.guarded, _ = c.(*guardedConn)
+	return context.WithValue(ctx, connInfoKey{}, info)
+}
+
+// recycle asks the client to close the connection after this response once
+// it has served its maximum number of requests or reached its lifetime
+func (o connOptions) recycle(w http.ResponseWriter, r *http.Request) {
+	info, ok := r.Context().Value(connInfoKey{}).(*connInfo)
+	if !ok {
+		return
+	}
+	n := info.requests.Add(1)
+	if (o.maxRequests > 0 && n >= o.maxRequests) || (o.maxLifetime > 0 && time.Since(info.opened) >= o.maxLifetime) {
+		w.Header().Set("Connection", "close")
+	}
+}
@@ -0,0 +1,423 @@
+package httpserve
+
+import (
+	"cmp"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dashboardWindow is how many seconds of request rate the dashboard shows
+const dashboardWindow = 60
+
+// dashboardMaxPaths bounds the paths counted for the top paths table; past
+// it every count is halved and the paths dropping to zero are forgotten
+const dashboardMaxPaths = 1000
+
+// dashboardTopPaths and dashboardErrors are how many of each are shown
+const (
+	dashboardTopPaths = 10
+	dashboardErrors   = 20
+)
+
+// dashboardRecent is how many access records are kept for GET /har
+const dashboardRecent = 1000
+
+// dashboardDiskTTL is how long a measurement of the served tree is reused
+const dashboardDiskTTL = time.Minute
+
+// dashboardPath is a row of the top paths table
+type dashboardPath struct {
+	Path     string `json:"path"`
+	Requests int64  `json:"requests"`
+}
+
+// dashboardError is a failed request or an error message of the log
+type dashboardError struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// dashboardDisk is the disk usage of the served tree
+type dashboardDisk struct {
+	Dir      string    `json:"dir"`
+	Used     int64     `json:"used"`
+	Files    int64     `json:"files"`
+	Free     int64     `json:"free"` // -1 when unknown
+	Measured time.Time `json:"measured"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// dashboardSnapshot is the body of GET /stats
+type dashboardSnapshot struct {
+	Requests int64            `json:"requests"`
+	Rate     []int64          `json:"rate"` // requests of each of the last seconds, oldest first
+	Statuses map[string]int64 `json:"statuses"`
+	TopPaths []dashboardPath  `json:"top_paths"`
+	Errors   []dashboardError `json:"errors"` // newest first
+	Disk     *dashboardDisk   `json:"disk,omitempty"`
+}
+
+// dashboardStats is the Logger of a server with an admin API, counting the
+// requests of the access log and keeping the recent errors for the
+// dashboard before passing everything on
+type dashboardStats struct {
+	Logger
+	dir string // the served directory, empty when not on disk
+
+	mu       sync.Mutex
+	requests int64
+	seconds  [dashboardWindow]int64
+	counts   [dashboardWindow]int64
+	statuses map[int]int64
+	paths    map[string]int64
+	errors   []dashboardError
+	recent   [dashboardRecent]AccessEntry // ring of the last requests
+	next     int                          // where the next one goes in recent
+
+	diskMu    sync.Mutex
+	disk      *dashboardDisk
+	measuring bool
+}
+
+func newDashboardStats(logger Logger) *dashboardStats {
+	return &dashboardStats{Logger: logger, statuses: make(map[int]int64), paths: make(map[string]int64)}
+}
+
+// Printf logs a message, keeping the error messages
+func (d *dashboardStats) Printf(format string, args ...any) {
+	d.Logger.Printf(format, args...)
+	if strings.HasPrefix(format, "Error") {
+		d.addError(time.Now(), fmt.Sprintf(format, args...))
+	}
+}
+
+// Access logs a request and counts it
+func (d *dashboardStats) Access(e AccessEntry) {
+	d.Logger.Access(e)
+	d.mu.Lock()
+	d.requests++
+	second := e.Time.Unix()
+	if i := second % dashboardWindow; d.seconds[i] != second {
+		d.seconds[i], d.counts[i] = second, 1
+	} else {
+		d.counts[i]++
+	}
+	d.statuses[e.Status]++
+	if _, ok := d.paths[e.Path]; !ok && len(d.paths) >= dashboardMaxPaths {
+		for p, n := range d.paths {
+			if n /= 2; n == 0 {
+				delete(d.paths, p)
+			} else {
+				d.paths[p] = n
+			}
+		}
+	}
+	d.paths[e.Path]++
+	d.recent[d.next%dashboardRecent] = e
+	d.next++
+	d.mu.Unlock()
+	if e.Status >= 500 {
+		message := fmt.Sprintf("%s %s %d", e.Method, e.Path, e.Status)
+		if e.Note != "" {
+			message += " (" + e.Note + ")"
+		}
+		d.addError(e.Time, message)
+	}
+}
+
+// addError keeps an error, dropping the oldest past dashboardErrors
+func (d *dashboardStats) addError(t time.Time, message string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.errors) == dashboardErrors {
+		d.errors = slices.Delete(d.errors, 0, 1)
+	}
+	d.errors = append(d.errors, dashboardError{Time: t.UTC(), Message: message})
+}
+
+// snapshot returns the figures shown by the dashboard
+func (d *dashboardStats) snapshot() dashboardSnapshot {
+	d.mu.Lock()
+	now := time.Now().Unix()
+	s := dashboardSnapshot{
+		Requests: d.requests,
+		Rate:     make([]int64, dashboardWindow),
+		Statuses: make(map[string]int64, len(d.statuses)),
+		TopPaths: make([]dashboardPath, 0, len(d.paths)),
+		Errors:   make([]dashboardError, 0, len(d.errors)),
+	}
+	for i := range s.Rate {
+		second := now - dashboardWindow + 1 + int64(i)
+		if j := second % dashboardWindow; d.seconds[j] == second {
+			s.Rate[i] = d.counts[j]
+		}
+	}
+	for code, n := range d.statuses {
+		s.Statuses[strconv.Itoa(code)] = n
+	}
+	for p, n := range d.paths {
+		s.TopPaths = append(s.TopPaths, dashboardPath{Path: p, Requests: n})
+	}
+	for i := len(d.errors) - 1; i >= 0; i-- {
+		s.Errors = append(s.Errors, d.errors[i])
+	}
+	d.mu.Unlock()
+	slices.SortFunc(s.TopPaths, func(a, b dashboardPath) int {
+		return cmp.Or(cmp.Compare(b.Requests, a.Requests), strings.Compare(a.Path, b.Path))
+	})
+	s.TopPaths = s.TopPaths[:min(len(s.TopPaths), dashboardTopPaths)]
+	s.Disk = d.diskUsage()
+	return s
+}
+
+// diskUsage returns the last measurement of the served tree, measuring it
+// again in the background once older than dashboardDiskTTL
+func (d *dashboardStats) diskUsage() *dashboardDisk {
+	if d.dir == "" {
+		return nil
+	}
+	d.diskMu.Lock()
+	defer d.diskMu.Unlock()
+	if !d.measuring && (d.disk == nil || time.Since(d.disk.Measured) > dashboardDiskTTL) {
+		d.measuring = true
+		go d.measureDisk()
+	}
+	return d.disk
+}
+
+// measureDisk walks the served tree, adding up the sizes of its files
+func (d *dashboardStats) measureDisk() {
+	disk := &dashboardDisk{Dir: d.dir}
+	err := filepath.WalkDir(d.dir, func(p string, e fs.DirEntry, err error) error {
+		if err != nil || !e.Type().IsRegular() {
+			// Unreadable parts of the tree are left out of the total
+			return nil
+		}
+		if info, err := e.Info(); err == nil {
+			disk.Used += info.Size()
+			disk.Files++
+		}
+		return nil
+	})
+	if err != nil {
+		disk.Error = err.Error()
+	}
+	if disk.Free, err = freeSpace(d.dir); err != nil {
+		disk.Free = -1
+	}
+	disk.Measured = time.Now().UTC()
+	d.diskMu.Lock()
+	d.disk, d.measuring = disk, false
+	d.diskMu.Unlock()
+}
+
+// serveDashboard renders the dashboard page, which polls GET /stats
+func (a *adminServer) serveDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-store")
+	data := struct {
+		UI  uiOptions
+		Msg catalog
+	}{a.ui, catalogs["en"]}
+	if err := dashboardTemplate.Execute(w, data); err != nil {
+		a.log.logf("Error rendering the dashboard: %v", err)
+	}
+}
+
+// serveStats returns the figures of the dashboard
+func (a *adminServer) serveStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, a.stats.snapshot())
+}
+
+// recentAccess returns the last n access records at most, oldest first
+func (d *dashboardStats) recentAccess(n int) []AccessEntry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n = min(n, d.next, dashboardRecent)
+	entries := make([]AccessEntry, 0, n)
+	for i := d.next - n; i < d.next; i++ {
+		entries = append(entries, d.recent[i%dashboardRecent])
+	}
+	return entries
+}
+
+// serveHAR exports the recent access records as a HAR file, the last
+// ?limit= of them, for browser devtools and HAR analyzers. Access records
+// keep no headers nor bodies, so the entries have only their sizes.
+func (a *adminServer) serveHAR(w http.ResponseWriter, r *http.Request) {
+	limit := dashboardRecent
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be a positive number"})
+			return
+		}
+		limit = n
+	}
+	type harFile struct {
+		Log struct {
+			harLog
+			Entries []harEntry `json:"entries"`
+		} `json:"log"`
+	}
+	var f harFile
+	f.Log.harLog = newHARLog()
+	f.Log.Entries = []harEntry{}
+	for _, e := range a.stats.recentAccess(limit) {
+		f.Log.Entries = append(f.Log.Entries, harEntryOf(e))
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Disposition", `attachment; filename="access.har"`)
+	writeJSON(w, http.StatusOK, f)
+}
+
+// harEntryOf describes an access record as a HAR entry, the whole time of
+// the request counted as waiting for the response
+func harEntryOf(e AccessEntry) harEntry {
+	he := harEntry{
+		StartedDateTime: e.Time.UTC(),
+		Time:            milliseconds(e.Duration),
+		Request: harRequest{
+			Method:      e.Method,
+			URL:         e.URL,
+			HTTPVersion: e.Proto,
+			Cookies:     []harNameVal{},
+			Headers:     []harNameVal{},
+			QueryString: []harNameVal{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Response: harResponse{
+			Status:      e.Status,
+			StatusText:  http.StatusText(e.Status),
+			HTTPVersion: e.Proto,
+			Cookies:     []harNameVal{},
+			Headers:     []harNameVal{},
+			Content:     harContent{Size: e.Bytes},
+			HeadersSize: -1,
+			BodySize:    e.Bytes,
+		},
+		Timings:       harTimings{Wait: milliseconds(e.Duration)},
+		ClientAddress: e.Remote,
+		RequestID:     e.RequestID,
+	}
+	if he.Request.URL == "" {
+		he.Request.URL = e.Path
+	}
+	if u, err := url.Parse(he.Request.URL); err == nil {
+		if u.Host != "" {
+			he.Request.Headers = append(he.Request.Headers, harNameVal{Name: "Host", Value: u.Host})
+		}
+		for name, values := range u.Query() {
+			for _, value := range values {
+				he.Request.QueryString = append(he.Request.QueryString, harNameVal{Name: name, Value: value})
+			}
+		}
+		slices.SortStableFunc(he.Request.QueryString, func(a, b harNameVal) int { return strings.Compare(a.Name, b.Name) })
+	}
+	return he
+}
+
+var dashboardTemplate = template.Must(template.Must(uiTemplates.Clone()).New("dashboard").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+{{template "head"}}
+<title>Dashboard{{if .UI.Title}} - {{.UI.Title}}{{end}}</title>
+<style>
+.tiles { display: flex; flex-wrap: wrap; gap: 1em; margin-bottom: 1.5em; }
+.tile { border: 1px solid var(--border); border-radius: 6px; padding: 0.75em 1em; min-width: 10em; }
+.tile .value { font-size: 1.6em; font-weight: bold; }
+#rate { display: flex; align-items: flex-end; gap: 2px; height: 80px; border-bottom: 1px solid var(--border); margin-bottom: 1.5em; }
+#rate div { flex: 1; background: var(--link); min-height: 1px; }
+.columns { display: flex; flex-wrap: wrap; gap: 2em; }
+.columns section { flex: 1; min-width: 18em; }
+table { border-collapse: collapse; width: 100%; }
+td, th { text-align: left; padding: 0.2em 0.5em; border-bottom: 1px solid var(--border); }
+td.n { text-align: right; font-variant-numeric: tabular-nums; }
+.s5 { color: #cf222e; } .s4 { color: #bc4c00; }
+</style>
+</head>
+<body>
+{{template "header" .}}
+<div class="tiles">
+<div class="tile"><div class="muted">Requests/s (last 10s)</div><div class="value" id="current">-</div></div>
+<div class="tile"><div class="muted">Requests</div><div class="value" id="total">-</div></div>
+<div class="tile"><div class="muted">Served tree</div><div class="value" id="used">-</div><div class="muted" id="files"></div></div>
+<div class="tile"><div class="muted">Free disk space</div><div class="value" id="free">-</div></div>
+</div>
+<h2>Requests per second, last minute</h2>
+<div id="rate"></div>
+<div class="columns">
+<section><h2>Status codes</h2><table id="statuses"></table></section>
+<section><h2>Top paths</h2><table id="paths"></table></section>
+</div>
+<section><h2>Recent errors</h2><table id="errors"></table></section>
+<script>
+(function () {
+  function size(n) {
+    if (n < 0) return "unknown";
+    var units = ["B", "KB", "MB", "GB", "TB"], i = 0;
+    while (n >= 1024 && i < units.length - 1) { n /= 1024; i++; }
+    return (i ? n.toFixed(1) : n) + " " + units[i];
+  }
+  function rows(id, items, cells) {
+    var table = document.getElementById(id);
+    table.textContent = "";
+    items.forEach(function (item) {
+      var tr = table.insertRow();
+      cells(item).forEach(function (c) {
+        var td = tr.insertCell();
+        td.textContent = c.text;
+        if (c.className) td.className = c.className;
+      });
+    });
+    if (!items.length) table.insertRow().insertCell().textContent = "None";
+  }
+  function refresh() {
+    fetch("stats", {cache: "no-store"}).then(function (r) { return r.json(); }).then(function (s) {
+      var last = s.rate.slice(-10).reduce(function (a, b) { return a + b; }, 0);
+      document.getElementById("current").textContent = (last / 10).toFixed(1);
+      document.getElementById("total").textContent = s.requests;
+      var peak = Math.max.apply(null, s.rate.concat([1]));
+      var rate = document.getElementById("rate");
+      rate.textContent = "";
+      s.rate.forEach(function (n) {
+        var bar = document.createElement("div");
+        bar.style.height = (100 * n / peak) + "%";
+        bar.title = n + " requests";
+        rate.appendChild(bar);
+      });
+      var codes = Object.keys(s.statuses).sort();
+      rows("statuses", codes, function (c) {
+        return [{text: c, className: "s" + c[0]}, {text: s.statuses[c], className: "n"}];
+      });
+      rows("paths", s.top_paths, function (p) {
+        return [{text: p.path}, {text: p.requests, className: "n"}];
+      });
+      rows("errors", s.errors, function (e) {
+        return [{text: new Date(e.time).toLocaleTimeString(), className: "muted"}, {text: e.message}];
+      });
+      if (s.disk) {
+        document.getElementById("used").textContent = size(s.disk.used);
+        document.getElementById("files").textContent = s.disk.files + " files in " + s.disk.dir;
+        document.getElementById("free").textContent = size(s.disk.free);
+      }
+    }).catch(function () {}).then(function () { setTimeout(refresh, 2000); });
+  }
+  refresh();
+})();
+</script>
+</body>
+</html>
+`))
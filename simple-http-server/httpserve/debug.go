@@ -0,0 +1,137 @@
+package httpserve
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// debugEchoPath reflects the request back with --debug-echo
+const debugEchoPath = "/_debug/echo"
+
+// debugMaxBody bounds the request body echoed back
+const debugMaxBody = 64 << 10
+
+// debugEcho describes a request as the server received it
+type debugEcho struct {
+	Method        string              `json:"method"`
+	URI           string              `json:"uri"`
+	Proto         string              `json:"proto"`
+	Host          string              `json:"host"`
+	Headers       map[string][]string `json:"headers"`
+	RemoteAddr    string              `json:"remote_addr"`
+	ClientIP      string              `json:"client_ip"`
+	LocalAddr     string              `json:"local_addr,omitempty"`
+	Forwarded     debugForwarded      `json:"forwarded"`
+	TLS           *debugTLS           `json:"tls"`
+	ContentLength int64               `json:"content_length"`
+	Body          string              `json:"body,omitempty"`
+	BodyEncoding  string              `json:"body_encoding,omitempty"` // base64 unless UTF-8
+	BodyTruncated bool                `json:"body_truncated,omitempty"`
+	User          string              `json:"user,omitempty"`
+	RequestID     string              `json:"request_id,omitempty"`
+	Time          time.Time           `json:"time"`
+}
+
+// debugForwarded is what proxies in front of the server said about the
+// request, the X-Forwarded-For chain split from the client onwards
+type debugForwarded struct {
+	For       []string `json:"for,omitempty"`
+	Proto     string   `json:"proto,omitempty"`
+	Host      string   `json:"host,omitempty"`
+	RealIP    string   `json:"real_ip,omitempty"`
+	Forwarded []string `json:"forwarded,omitempty"`
+	Via       []string `json:"via,omitempty"`
+}
+
+// debugTLS describes the TLS connection of a request
+type debugTLS struct {
+	Version            string   `json:"version"`
+	CipherSuite        string   `json:"cipher_suite"`
+	ServerName         string   `json:"server_name,omitempty"`
+	NegotiatedProtocol string   `json:"negotiated_protocol,omitempty"`
+	Resumed            bool     `json:"resumed"`
+	ClientCertificates []string `json:"client_certificates,omitempty"`
+}
+
+// serveDebugEcho is the debug stage, answering debugEchoPath with any
+// method before the methods stage can turn it away
+func serveDebugEcho(enabled bool, ui uiOptions) Middleware {
+	if !enabled {
+		return nil
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != debugEchoPath {
+				next.ServeHTTP(w, r)
+				return
+			}
+			echo := debugEcho{
+				Method:        r.Method,
+				URI:           r.RequestURI,
+				Proto:         r.Proto,
+				Host:          r.Host,
+				Headers:       r.Header,
+				RemoteAddr:    r.RemoteAddr,
+				ClientIP:      r.RemoteAddr,
+				ContentLength: r.ContentLength,
+				User:          RequestUser(r),
+				RequestID:     RequestID(r),
+				Time:          time.Now().UTC(),
+			}
+			if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+				echo.ClientIP = host
+			}
+			if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+				echo.LocalAddr = addr.String()
+			}
+			for _, v := range r.Header.Values("X-Forwarded-For") {
+				for _, hop := range strings.Split(v, ",") {
+					if hop = strings.TrimSpace(hop); hop != "" {
+						echo.Forwarded.For = append(echo.Forwarded.For, hop)
+					}
+				}
+			}
+			echo.Forwarded.Proto = r.Header.Get("X-Forwarded-Proto")
+			echo.Forwarded.Host = r.Header.Get("X-Forwarded-Host")
+			echo.Forwarded.RealIP = r.Header.Get("X-Real-IP")
+			echo.Forwarded.Forwarded = r.Header.Values("Forwarded")
+			echo.Forwarded.Via = r.Header.Values("Via")
+			if cs := r.TLS; cs != nil {
+				t := &debugTLS{
+					Version:            tls.VersionName(cs.Version),
+					CipherSuite:        tls.CipherSuiteName(cs.CipherSuite),
+					ServerName:         cs.ServerName,
+					NegotiatedProtocol: cs.NegotiatedProtocol,
+					Resumed:            cs.DidResume,
+				}
+				for _, cert := range cs.PeerCertificates {
+					t.ClientCertificates = append(t.ClientCertificates, cert.Subject.String())
+				}
+				echo.TLS = t
+			}
+			if r.Body != nil {
+				body, err := io.ReadAll(io.LimitReader(r.Body, debugMaxBody+1))
+				if err != nil {
+					renderError(w, r, http.StatusBadRequest, ui)
+					return
+				}
+				if len(body) > debugMaxBody {
+					body, echo.BodyTruncated = body[:debugMaxBody], true
+				}
+				if utf8.Valid(body) {
+					echo.Body = string(body)
+				} else {
+					echo.Body, echo.BodyEncoding = base64.StdEncoding.EncodeToString(body), "base64"
+				}
+			}
+			w.Header().Set("Cache-Control", "no-store")
+			writeJSON(w, http.StatusOK, echo)
+		})
+	}
+}
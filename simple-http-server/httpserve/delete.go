@@ -0,0 +1,47 @@
+package httpserve
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+)
+
+// serveDelete removes the file at the request path
+func (h *fileHandler) serveDelete(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/" {
+		renderError(w, r, http.StatusForbidden, h.ui)
+		return
+	}
+	target := h.localPath(r.URL.Path)
+	info, err := os.Lstat(target)
+	if errors.Is(err, fs.ErrNotExist) {
+		renderError(w, r, http.StatusNotFound, h.ui)
+		return
+	}
+	if err == nil && info.IsDir() {
+		h.log.logf("audit: %s refused to delete directory %s from %s", RequestUser(r), r.URL.Path, r.RemoteAddr)
+		renderError(w, r, http.StatusConflict, h.ui)
+		return
+	}
+	// Keep the file in the recycle bin when one is configured
+	var item trashItem
+	if err == nil && h.trash != nil {
+		item, err = h.trash.put(target, r.URL.Path, info.Size(), r)
+	} else if err == nil {
+		err = os.Remove(target)
+	}
+	if err != nil {
+		h.log.logf("audit: %s failed to delete %s from %s: %v", RequestUser(r), r.URL.Path, r.RemoteAddr, err)
+		renderError(w, r, http.StatusInternalServerError, h.ui)
+		return
+	}
+	if h.trash != nil {
+		h.log.logf("audit: %s moved %s (%d bytes) to trash as %s from %s", RequestUser(r), r.URL.Path, info.Size(), item.ID, r.RemoteAddr)
+		w.Header().Set("X-Trash-ID", item.ID)
+	} else {
+		h.log.logf("audit: %s deleted %s (%d bytes) from %s", RequestUser(r), r.URL.Path, info.Size(), r.RemoteAddr)
+	}
+	h.webhook.notify(r, eventDelete, r.URL.Path, info.Size())
+	w.WriteHeader(http.StatusNoContent)
+}
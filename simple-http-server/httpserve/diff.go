@@ -0,0 +1,239 @@
+package httpserve
+
+import (
+	"errors"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// diffPath compares the files of two directories of the site
+const diffPath = "/_diff"
+
+// diffMaxFiles bounds the files walked for a comparison, across both trees
+const diffMaxFiles = 100000
+
+// errDiffLimit is returned when the trees hold more than diffMaxFiles
+var errDiffLimit = errors.New("too many files to compare")
+
+// diffFile is a file found in only one of the directories
+type diffFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// diffChange is a file that differs between the directories
+type diffChange struct {
+	Path    string `json:"path"`
+	ASize   int64  `json:"a_size"`
+	BSize   int64  `json:"b_size"`
+	ASHA256 string `json:"a_sha256,omitempty"`
+	BSHA256 string `json:"b_sha256,omitempty"`
+}
+
+// diffReport is the body of the comparison, with paths relative to the
+// compared directories
+type diffReport struct {
+	A         string       `json:"a"`
+	B         string       `json:"b"`
+	Compare   string       `json:"compare"` // size, or hash for same-size files too
+	Added     []diffFile   `json:"added"`
+	Removed   []diffFile   `json:"removed"`
+	Changed   []diffChange `json:"changed"`
+	Unchanged int          `json:"unchanged"`
+}
+
+// diffPage is the data of the HTML comparison
+type diffPage struct {
+	UI     uiOptions
+	Msg    catalog
+	Report diffReport
+}
+
+// diffTree lists the files below dir by path relative to it, counting them
+// against the limit left
+func diffTree(root http.FileSystem, dir string, left *int) (map[string]fs.FileInfo, error) {
+	files := make(map[string]fs.FileInfo)
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		f, err := root.Open(path.Join(dir, rel))
+		if err != nil {
+			return err
+		}
+		infos, err := f.Readdir(-1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			name := path.Join(rel, info.Name())
+			if hiddenEntry(path.Join(dir, rel), info.Name()) {
+				continue
+			}
+			if info.IsDir() {
+				if err := walk(name); err != nil {
+					return err
+				}
+				continue
+			}
+			if *left--; *left < 0 {
+				return errDiffLimit
+			}
+			files[name] = info
+		}
+		return nil
+	}
+	return files, walk("")
+}
+
+// serveDiff answers which files were added, removed or changed from
+// directory a to directory b
+func (h *fileHandler) serveDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		renderError(w, r, http.StatusMethodNotAllowed, h.ui)
+		return
+	}
+	q := r.URL.Query()
+	var dirs [2]string
+	for i, name := range []string{"a", "b"} {
+		p, err := sanitizePath(&url.URL{Path: q.Get(name)}, h.policy)
+		if err != nil || q.Get(name) == "" || isTrashPath(p) {
+			renderError(w, r, http.StatusBadRequest, h.ui)
+			return
+		}
+		dirs[i] = strings.TrimSuffix(p, "/")
+		if dirs[i] == "" {
+			dirs[i] = "/"
+		}
+	}
+	compare := q.Get("compare")
+	switch compare {
+	case "":
+		compare = "hash"
+	case "hash", "size":
+	default:
+		renderError(w, r, http.StatusBadRequest, h.ui)
+		return
+	}
+
+	left := diffMaxFiles
+	var trees [2]map[string]fs.FileInfo
+	for i, dir := range dirs {
+		if f, err := h.root.Open(dir); err != nil {
+			renderError(w, r, http.StatusNotFound, h.ui)
+			return
+		} else {
+			info, err := f.Stat()
+			f.Close()
+			if err != nil || !info.IsDir() {
+				renderError(w, r, http.StatusBadRequest, h.ui)
+				return
+			}
+		}
+		tree, err := diffTree(h.root, dir, &left)
+		if errors.Is(err, errDiffLimit) {
+			renderErrorMessage(w, r, http.StatusRequestEntityTooLarge, h.ui, "error.difflimit")
+			return
+		}
+		if err != nil {
+			h.log.logf("Error reading directory %s: %v", dir, err)
+			renderError(w, r, http.StatusInternalServerError, h.ui)
+			return
+		}
+		trees[i] = tree
+	}
+
+	report := diffReport{A: dirs[0], B: dirs[1], Compare: compare, Added: []diffFile{}, Removed: []diffFile{}, Changed: []diffChange{}}
+	for rel, a := range trees[0] {
+		b, ok := trees[1][rel]
+		if !ok {
+			report.Removed = append(report.Removed, diffFile{Path: rel, Size: a.Size()})
+			continue
+		}
+		change := diffChange{Path: rel, ASize: a.Size(), BSize: b.Size()}
+		if a.Size() == b.Size() {
+			if compare == "size" {
+				report.Unchanged++
+				continue
+			}
+			var err error
+			if change.ASHA256, err = fileChecksum(h.root, path.Join(dirs[0], rel)); err == nil {
+				change.BSHA256, err = fileChecksum(h.root, path.Join(dirs[1], rel))
+			}
+			if err != nil {
+				h.log.logf("Error hashing %s: %v", rel, err)
+				renderError(w, r, http.StatusInternalServerError, h.ui)
+				return
+			}
+			if change.ASHA256 == change.BSHA256 {
+				report.Unchanged++
+				continue
+			}
+		}
+		report.Changed = append(report.Changed, change)
+	}
+	for rel, b := range trees[1] {
+		if _, ok := trees[0][rel]; !ok {
+			report.Added = append(report.Added, diffFile{Path: rel, Size: b.Size()})
+		}
+	}
+	sort.Slice(report.Added, func(i, j int) bool { return report.Added[i].Path < report.Added[j].Path })
+	sort.Slice(report.Removed, func(i, j int) bool { return report.Removed[i].Path < report.Removed[j].Path })
+	sort.Slice(report.Changed, func(i, j int) bool { return report.Changed[i].Path < report.Changed[j].Path })
+
+	w.Header().Set("Cache-Control", "no-store")
+	if q.Get("format") == "json" || prefersJSON(r) {
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+	msg := negotiateCatalog(r, h.ui.lang)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Language", msg.Lang)
+	if err := diffTemplate.Execute(w, diffPage{UI: h.ui, Msg: msg, Report: report}); err != nil {
+		h.log.logf("Error rendering the diff of %s and %s: %v", dirs[0], dirs[1], err)
+	}
+}
+
+var diffTemplate = template.Must(template.Must(uiTemplates.Clone()).New("diff").Funcs(template.FuncMap{
+	"size": FormatSize,
+	"join": path.Join,
+}).Parse(`<!DOCTYPE html>
+<html lang="{{.Msg.Lang}}">
+<head>
+{{template "head"}}
+<title>{{.Msg.T "diff.title" .Report.A .Report.B}}{{if .UI.Title}} - {{.UI.Title}}{{end}}</title>
+<style>
+table { border-collapse: collapse; width: 100%; margin-bottom: 1.5em; }
+td, th { text-align: left; padding: 0.25em 0.5em; border-bottom: 1px solid var(--border); }
+td.n, th.n { text-align: right; font-variant-numeric: tabular-nums; }
+</style>
+</head>
+<body>
+{{template "header" .}}
+<h1>{{.Msg.T "diff.title" .Report.A .Report.B}}</h1>
+<p class="muted">{{.Msg.T "diff.summary" (len .Report.Added) (len .Report.Removed) (len .Report.Changed) .Report.Unchanged}}</p>
+{{$r := .Report}}
+{{if .Report.Added}}<h2>{{.Msg.T "diff.added"}}</h2>
+<table>
+<tr><th>{{.Msg.T "stats.path"}}</th><th class="n">{{.Msg.T "listing.size"}}</th></tr>
+{{range .Report.Added}}<tr><td><a href="{{join $r.B .Path}}">{{.Path}}</a></td><td class="n">{{size .Size}}</td></tr>
+{{end}}</table>{{end}}
+{{if .Report.Removed}}<h2>{{.Msg.T "diff.removed"}}</h2>
+<table>
+<tr><th>{{.Msg.T "stats.path"}}</th><th class="n">{{.Msg.T "listing.size"}}</th></tr>
+{{range .Report.Removed}}<tr><td><a href="{{join $r.A .Path}}">{{.Path}}</a></td><td class="n">{{size .Size}}</td></tr>
+{{end}}</table>{{end}}
+{{if .Report.Changed}}<h2>{{.Msg.T "diff.changed"}}</h2>
+<table>
+<tr><th>{{.Msg.T "stats.path"}}</th><th class="n">{{$r.A}}</th><th class="n">{{$r.B}}</th></tr>
+{{range .Report.Changed}}<tr><td>{{.Path}}</td><td class="n"><a href="{{join $r.A .Path}}">{{size .ASize}}</a></td><td class="n"><a href="{{join $r.B .Path}}">{{size .BSize}}</a></td></tr>
+{{end}}</table>{{end}}
+{{if not (or .Report.Added .Report.Removed .Report.Changed)}}<p>{{.Msg.T "diff.same"}}</p>{{end}}
+</body>
+</html>
+`))
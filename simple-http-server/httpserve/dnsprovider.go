@@ -0,0 +1,330 @@
+package httpserve
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dnsProvider publishes and removes the TXT records of DNS-01 challenges.
+// Names are fully qualified with a trailing dot.
+type dnsProvider interface {
+	present(fqdn, value string) error
+	cleanup(fqdn, value string) error
+}
+
+// newDNSProvider returns the provider named by --acme-dns, taking its
+// credentials from the environment: cloudflare, route53, or
+// exec:<program> to run "<program> present|cleanup <fqdn> <value>"
+func newDNSProvider(name string) (dnsProvider, error) {
+	switch {
+	case name == "cloudflare":
+		token := firstNonEmpty(os.Getenv("CLOUDFLARE_DNS_API_TOKEN"), os.Getenv("CF_DNS_API_TOKEN"), os.Getenv("CLOUDFLARE_API_TOKEN"))
+		if token == "" {
+			return nil, fmt.Errorf("cloudflare needs an API token with DNS edit permission in CLOUDFLARE_DNS_API_TOKEN")
+		}
+		return &cloudflareDNS{client: storageClient(), base: "https://api.cloudflare.com/client/v4", token: token, records: map[string]string{}}, nil
+	case name == "route53":
+		r := &route53DNS{
+			client:       storageClient(),
+			base:         "https://route53.amazonaws.com/2013-04-01",
+			accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+			values:       map[string][]string{},
+		}
+		if r.accessKey == "" || r.secretKey == "" {
+			return nil, fmt.Errorf("route53 needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+		return r, nil
+	case strings.HasPrefix(name, "exec:"):
+		return execDNS(strings.TrimPrefix(name, "exec:")), nil
+	}
+	return nil, fmt.Errorf("unknown DNS provider %q, expected cloudflare, route53 or exec:<program>", name)
+}
+
+// zoneCandidates lists fqdn and its parent domains, longest first, down to
+// the second level, the names the zone holding fqdn may have
+func zoneCandidates(fqdn string) []string {
+	labels := strings.Split(strings.TrimSuffix(fqdn, "."), ".")
+	var names []string
+	for i := 0; i < len(labels)-1; i++ {
+		names = append(names, strings.Join(labels[i:], "."))
+	}
+	return names
+}
+
+// execDNS runs a program to change the records, for DNS hosts without a
+// built-in provider
+type execDNS string
+
+// present runs "<program> present <fqdn> <value>"
+func (e execDNS) present(fqdn, value string) error {
+	return e.run("present", fqdn, value)
+}
+
+// cleanup runs "<program> cleanup <fqdn> <value>"
+func (e execDNS) cleanup(fqdn, value string) error {
+	return e.run("cleanup", fqdn, value)
+}
+
+// run runs the program, passing its output through to the logs on failure
+func (e execDNS) run(action, fqdn, value string) error {
+	out, err := exec.Command(string(e), action, fqdn, value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v: %s", e, action, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// cloudflareDNS changes records through the Cloudflare API with an API
+// token
+type cloudflareDNS struct {
+	client *http.Client
+	base   string
+	token  string
+	mu     sync.Mutex
+	// records maps fqdn and value to the zone and id of the record
+	records map[string]string
+}
+
+// present creates a TXT record in the zone holding fqdn
+func (c *cloudflareDNS) present(fqdn, value string) error {
+	var zone string
+	for _, name := range zoneCandidates(fqdn) {
+		var zones []struct {
+			ID string `json:"id"`
+		}
+		if err := c.do(http.MethodGet, "/zones?"+url.Values{"name": {name}}.Encode(), nil, &zones); err != nil {
+			return err
+		}
+		if len(zones) > 0 {
+			zone = zones[0].ID
+			break
+		}
+	}
+	if zone == "" {
+		return fmt.Errorf("no Cloudflare zone holds %s", fqdn)
+	}
+	var record struct {
+		ID string `json:"id"`
+	}
+	body := map[string]any{"type": "TXT", "name": strings.TrimSuffix(fqdn, "."), "content": value, "ttl": 120}
+	if err := c.do(http.MethodPost, "/zones/"+zone+"/dns_records", body, &record); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.records[fqdn+" "+value] = zone + "/dns_records/" + record.ID
+	c.mu.Unlock()
+	return nil
+}
+
+// cleanup deletes the record present created
+func (c *cloudflareDNS) cleanup(fqdn, value string) error {
+	c.mu.Lock()
+	path, ok := c.records[fqdn+" "+value]
+	delete(c.records, fqdn+" "+value)
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return c.do(http.MethodDelete, "/zones/"+path, nil, nil)
+}
+
+// do sends an API request and decodes the result of the response envelope
+func (c *cloudflareDNS) do(method, path string, body any, result any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.base+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var envelope struct {
+		Success bool            `json:"success"`
+		Result  json.RawMessage `json:"result"`
+		Errors  []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&envelope); err != nil {
+		return fmt.Errorf("cloudflare %s %s: %s", method, path, resp.Status)
+	}
+	if !envelope.Success {
+		var messages []string
+		for _, e := range envelope.Errors {
+			messages = append(messages, e.Message)
+		}
+		return fmt.Errorf("cloudflare %s %s: %s %s", method, path, resp.Status, strings.Join(messages, "; "))
+	}
+	if result != nil {
+		return json.Unmarshal(envelope.Result, result)
+	}
+	return nil
+}
+
+// route53DNS changes records of an Amazon Route 53 hosted zone, signing
+// requests with the AWS credentials of the environment
+type route53DNS struct {
+	client       *http.Client
+	base         string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	mu           sync.Mutex
+	// values are the challenge values each name holds, as Route 53 keeps
+	// all values of a name in one record set
+	values map[string][]string
+}
+
+// present adds the value to the TXT record set of fqdn and waits until
+// the change reached every Route 53 name server
+func (r *route53DNS) present(fqdn, value string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	values := append(r.values[fqdn], value)
+	if err := r.change("UPSERT", fqdn, values); err != nil {
+		return err
+	}
+	r.values[fqdn] = values
+	return nil
+}
+
+// cleanup removes the value, deleting the record set with the last one
+func (r *route53DNS) cleanup(fqdn, value string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	values := r.values[fqdn]
+	rest := slices.DeleteFunc(slices.Clone(values), func(v string) bool { return v == value })
+	var err error
+	if len(rest) == 0 {
+		err = r.change("DELETE", fqdn, values)
+	} else {
+		err = r.change("UPSERT", fqdn, rest)
+	}
+	r.values[fqdn] = rest
+	return err
+}
+
+// change applies one change to the TXT record set of fqdn
+func (r *route53DNS) change(action, fqdn string, values []string) error {
+	zone, err := r.zone(fqdn)
+	if err != nil {
+		return err
+	}
+	type resourceRecord struct {
+		Value string
+	}
+	var request struct {
+		XMLName xml.Name `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ChangeResourceRecordSetsRequest"`
+		Change  struct {
+			Action            string
+			ResourceRecordSet struct {
+				Name            string
+				Type            string
+				TTL             int
+				ResourceRecords []resourceRecord `xml:"ResourceRecords>ResourceRecord"`
+			}
+		} `xml:"ChangeBatch>Changes>Change"`
+	}
+	request.Change.Action = action
+	set := &request.Change.ResourceRecordSet
+	set.Name, set.Type, set.TTL = fqdn, "TXT", 60
+	for _, v := range values {
+		set.ResourceRecords = append(set.ResourceRecords, resourceRecord{`"` + v + `"`})
+	}
+	body, err := xml.Marshal(request)
+	if err != nil {
+		return err
+	}
+	var info struct {
+		ID     string `xml:"ChangeInfo>Id"`
+		Status string `xml:"ChangeInfo>Status"`
+	}
+	if err := r.do(http.MethodPost, zone+"/rrset", append([]byte(xml.Header), body...), &info); err != nil {
+		return err
+	}
+	for deadline := time.Now().Add(5 * time.Minute); info.Status != "INSYNC"; {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("route53 change %s is still %s", info.ID, info.Status)
+		}
+		time.Sleep(5 * time.Second)
+		if err := r.do(http.MethodGet, info.ID, nil, &info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zone finds the id of the hosted zone holding fqdn, such as
+// /hostedzone/Z123
+func (r *route53DNS) zone(fqdn string) (string, error) {
+	for _, name := range zoneCandidates(fqdn) {
+		var result struct {
+			HostedZones []struct {
+				ID   string `xml:"Id"`
+				Name string
+			} `xml:"HostedZones>HostedZone"`
+		}
+		query := url.Values{"dnsname": {name}, "maxitems": {"1"}}
+		if err := r.do(http.MethodGet, "/hostedzonesbyname?"+query.Encode(), nil, &result); err != nil {
+			return "", err
+		}
+		if len(result.HostedZones) > 0 && strings.EqualFold(result.HostedZones[0].Name, name+".") {
+			return result.HostedZones[0].ID, nil
+		}
+	}
+	return "", fmt.Errorf("no Route 53 hosted zone holds %s", fqdn)
+}
+
+// do sends a signed API request and decodes the XML response
+func (r *route53DNS) do(method, path string, body []byte, result any) error {
+	req, err := http.NewRequest(method, r.base+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+	signAWS(req, hex.EncodeToString(sum[:]), "us-east-1", "route53", r.accessKey, r.secretKey, r.sessionToken, time.Now().UTC())
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		xml.Unmarshal(data, &apiErr)
+		return fmt.Errorf("route53 %s %s: %s %s %s", method, path, resp.Status, apiErr.Code, apiErr.Message)
+	}
+	return xml.Unmarshal(data, result)
+}
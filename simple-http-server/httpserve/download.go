@@ -0,0 +1,154 @@
+package httpserve
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// downloadQuery forces the download of any file with ?dl=1
+const downloadQuery = "dl"
+
+// downloadOptions makes browsers save files rather than display them
+type downloadOptions struct {
+	exts     []string // lower case suffixes, such as .zip or .tar.gz
+	noRanges bool     // answer whole files, without Accept-Ranges
+}
+
+// parseDownloadExtensions parses the --download-extensions list
+func parseDownloadExtensions(list string) ([]string, error) {
+	var exts []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		switch {
+		case item == "":
+		case strings.HasPrefix(item, ".") && len(item) > 1 && !strings.Contains(item, "/"):
+			exts = append(exts, item)
+		default:
+			return nil, fmt.Errorf("invalid --download-extensions entry %q (expected .ext)", item)
+		}
+	}
+	return exts, nil
+}
+
+// forced reports whether the file answering r is sent as an attachment
+func (d downloadOptions) forced(r *http.Request) bool {
+	if strings.HasSuffix(r.URL.Path, "/") {
+		return false
+	}
+	if r.URL.Query().Get(downloadQuery) == "1" {
+		return true
+	}
+	name := strings.ToLower(r.URL.Path)
+	for _, ext := range d.exts {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// wrap returns the writer and request serving r as an attachment. Without
+// ranges the request loses its Range, so the whole file is sent.
+func (d downloadOptions) wrap(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request) {
+	if d.noRanges && (r.Header.Get("Range") != "" || r.Header.Get("If-Range") != "") {
+		r = r.Clone(r.Context())
+		r.Header.Del("Range")
+		r.Header.Del("If-Range")
+	}
+	return &downloadWriter{ResponseWriter: w, name: path.Base(r.URL.Path), noRanges: d.noRanges}, r
+}
+
+// downloadWriter adds Content-Disposition: attachment to successful
+// responses, leaving errors and redirects displayed
+type downloadWriter struct {
+	http.ResponseWriter
+	name        string
+	noRanges    bool
+	wroteHeader bool
+}
+
+// WriteHeader sets the headers of the attachment
+func (dw *downloadWriter) WriteHeader(code int) {
+	if dw.wroteHeader {
+		return
+	}
+	dw.wroteHeader = true
+	if code == http.StatusOK || code == http.StatusPartialContent {
+		dw.Header().Set("Content-Disposition", attachmentDisposition(dw.name))
+		if dw.noRanges {
+			dw.Header().Set("Accept-Ranges", "none")
+		}
+	}
+	dw.ResponseWriter.WriteHeader(code)
+}
+
+// Write sends the body through, writing the header first if needed
+func (dw *downloadWriter) Write(b []byte) (int, error) {
+	if !dw.wroteHeader {
+		dw.WriteHeader(http.StatusOK)
+	}
+	return dw.ResponseWriter.Write(b)
+}
+
+// ReadFrom keeps the sendfile path
+func (dw *downloadWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !dw.wroteHeader {
+		dw.WriteHeader(http.StatusOK)
+	}
+	return readFrom(dw.ResponseWriter, src)
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (dw *downloadWriter) Unwrap() http.ResponseWriter {
+	return dw.ResponseWriter
+}
+
+// attachmentDisposition returns the Content-Disposition saving a file as
+// name: a plain ASCII filename for every client, and the UTF-8 one of RFC
+// 6266 when they differ. Control characters, quotes and separators, which
+// could end the header or place the file elsewhere, are replaced.
+func attachmentDisposition(name string) string {
+	var clean, ascii strings.Builder
+	for _, c := range name {
+		switch {
+		case c == utf8.RuneError, c < 0x20, c == 0x7f, c == '"', c == '\\', c == '/':
+			c = '_'
+		}
+		clean.WriteRune(c)
+		if c > 0x7e {
+			c = '_'
+		}
+		ascii.WriteRune(c)
+	}
+	plain := strings.Trim(ascii.String(), " .")
+	if plain == "" || plain == "_" {
+		plain = "download"
+	}
+	header := `attachment; filename="` + plain + `"`
+	if clean.String() != plain {
+		header += "; filename*=UTF-8''" + encodeExtValue(clean.String())
+	}
+	return header
+}
+
+// encodeExtValue percent-encodes the bytes of s outside the attr-char set
+// of RFC 8187
+func encodeExtValue(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&15])
+	}
+	return b.String()
+}
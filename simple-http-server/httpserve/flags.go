@@ -0,0 +1,67 @@
+package httpserve
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// stringList is a flag.Value collecting every occurrence of a repeatable flag
+type stringList []string
+
+// String returns the collected values separated by commas
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+// Set appends a value each time the flag is given
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// byteSize is a flag.Value for sizes such as 512K, 100M or 2G
+type byteSize int64
+
+// String formats the size in bytes
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+// Set parses a size with an optional binary unit suffix
+func (b *byteSize) Set(value string) error {
+	units := map[byte]int64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+	value = strings.ToUpper(strings.TrimSuffix(strings.TrimSpace(value), "B"))
+	multiplier := int64(1)
+	if value != "" {
+		if m, ok := units[value[len(value)-1]]; ok {
+			multiplier = m
+			value = value[:len(value)-1]
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	*b = byteSize(n * multiplier)
+	return nil
+}
+
+// fileMode is a flag.Value for octal permissions such as 0660
+type fileMode os.FileMode
+
+// String formats the permissions in octal
+func (m *fileMode) String() string {
+	return fmt.Sprintf("%#o", uint32(*m))
+}
+
+// Set parses octal permissions
+func (m *fileMode) Set(value string) error {
+	n, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || n > 0o777 {
+		return fmt.Errorf("invalid permissions %q, expected an octal mode such as 0660", value)
+	}
+	*m = fileMode(n)
+	return nil
+}
@@ -0,0 +1,156 @@
+package httpserve
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"path"
+	"strings"
+	"time"
+)
+
+// forwardProxy relays CONNECT tunnels and absolute-form HTTP requests to
+// an allowlist of destinations, next to the files served from disk
+type forwardProxy struct {
+	allow   []string
+	creds   credentials
+	ui      uiOptions
+	buffers *bufferPool
+	log     *serverLog
+	dialer  net.Dialer
+	relayer *httputil.ReverseProxy
+}
+
+// newForwardProxy returns a forward proxy for the destinations matching
+// the host[:port] patterns, or nil when there are none. Patterns without a
+// port allow ports 80 and 443. With credentials, clients have to send
+// them in Proxy-Authorization.
+func newForwardProxy(allow []string, creds credentials, ui uiOptions, buffers *bufferPool, log *serverLog) (*forwardProxy, error) {
+	if len(allow) == 0 {
+		return nil, nil
+	}
+	for _, pattern := range allow {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" || strings.Contains(pattern, "/") {
+			return nil, fmt.Errorf("invalid forward proxy destination %q, expected host[:port] with optional * wildcards", pattern)
+		}
+	}
+	p := &forwardProxy{allow: allow, creds: creds, ui: ui, buffers: buffers, log: log, dialer: net.Dialer{Timeout: 10 * time.Second}}
+	p.relayer = &httputil.ReverseProxy{
+		// The request already names its destination
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.Header.Del("Proxy-Authorization")
+		},
+		Transport: &http.Transport{DialContext: p.dialer.DialContext, ResponseHeaderTimeout: 60 * time.Second},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			p.log.logf("forward proxy: %s %s: %v", r.Method, r.URL, err)
+			renderError(w, r, http.StatusBadGateway, ui)
+		},
+	}
+	return p, nil
+}
+
+// handles reports whether a request is meant for the proxy rather than
+// for this server
+func (p *forwardProxy) handles(r *http.Request) bool {
+	return p != nil && (r.Method == http.MethodConnect || r.URL.IsAbs())
+}
+
+// allowed reports whether the destination host:port is on the allowlist
+func (p *forwardProxy) allowed(hostport string) bool {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range p.allow {
+		patternHost, patternPort, err := net.SplitHostPort(pattern)
+		if err != nil {
+			patternHost, patternPort = pattern, ""
+		}
+		if ok, _ := path.Match(strings.ToLower(patternHost), host); !ok {
+			continue
+		}
+		if patternPort == port || patternPort == "" && (port == "80" || port == "443") {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP relays a proxy request after checking the credentials and the
+// destination
+func (p *forwardProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.String()
+	if r.Method == http.MethodConnect {
+		target = r.Host
+	}
+	status := http.StatusProxyAuthRequired
+	if len(p.creds) > 0 {
+		var ok bool
+		if r, ok = p.creds.authenticateProxy(r); !ok {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="simple-http-server", charset="UTF-8"`)
+			renderError(w, r, status, p.ui)
+			p.log.logf("%s %s %d (forward proxy)", r.Method, target, status)
+			return
+		}
+	}
+	status = p.serve(w, r)
+	p.log.logf("%s %s %d (forward proxy, %s)", r.Method, target, status, RequestUser(r))
+}
+
+// serve relays an authorized proxy request and returns the status it
+// answered with
+func (p *forwardProxy) serve(w http.ResponseWriter, r *http.Request) int {
+	destination := r.Host
+	if r.Method != http.MethodConnect {
+		destination = r.URL.Host
+		if r.URL.Port() == "" {
+			port := "80"
+			if r.URL.Scheme == "https" {
+				port = "443"
+			}
+			destination = net.JoinHostPort(r.URL.Hostname(), port)
+		}
+	}
+	if !p.allowed(destination) {
+		renderError(w, r, http.StatusForbidden, p.ui)
+		return http.StatusForbidden
+	}
+	if r.Method != http.MethodConnect {
+		lrw := &loggingResponseWriter{ResponseWriter: w, statusCode: http.StatusOK, buffers: p.buffers, body: bodyNone}
+		p.relayer.ServeHTTP(lrw, r)
+		return lrw.statusCode
+	}
+
+	upstream, err := p.dialer.DialContext(r.Context(), "tcp", destination)
+	if err != nil {
+		p.log.logf("forward proxy: CONNECT %s: %v", destination, err)
+		renderError(w, r, http.StatusBadGateway, p.ui)
+		return http.StatusBadGateway
+	}
+	conn, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		// HTTP/2 connections cannot be taken over
+		upstream.Close()
+		renderError(w, r, http.StatusHTTPVersionNotSupported, p.ui)
+		return http.StatusHTTPVersionNotSupported
+	}
+	conn.SetDeadline(time.Time{})
+	io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+	done := make(chan struct{})
+	go func() {
+		// Bytes the client sent right after the request come first
+		io.Copy(upstream, buffered)
+		if tcp, ok := upstream.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+		close(done)
+	}()
+	io.Copy(conn, upstream)
+	conn.Close()
+	upstream.Close()
+	<-done
+	return http.StatusOK
+}
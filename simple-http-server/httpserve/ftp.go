@@ -0,0 +1,629 @@
+package httpserve
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ftpIdleTimeout closes control connections that stay silent this long
+const ftpIdleTimeout = 5 * time.Minute
+
+// ftpServer serves the same tree as HTTP, read-only, over FTP. With a
+// certificate it also offers explicit FTPS through AUTH TLS.
+type ftpServer struct {
+	h         *fileHandler
+	creds     credentials
+	tls       *tls.Config
+	portRange [2]int
+
+	mu sync.Mutex
+	ln net.Listener
+}
+
+// newFTPServer returns an FTP server for the files of h. Passive data
+// connections use ports from portRange, "low-high", or any free port when
+// it is empty.
+func newFTPServer(h *fileHandler, creds credentials, portRange, certFile, keyFile string) (*ftpServer, error) {
+	s := &ftpServer{h: h, creds: creds}
+	if portRange != "" {
+		low, high, ok := strings.Cut(portRange, "-")
+		lo, err1 := strconv.Atoi(low)
+		hi, err2 := strconv.Atoi(high)
+		if !ok || err1 != nil || err2 != nil || lo < 1 || hi > 65535 || lo > hi {
+			return nil, fmt.Errorf("invalid passive port range %q, expected low-high", portRange)
+		}
+		s.portRange = [2]int{lo, hi}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading FTPS certificate: %v", err)
+		}
+		s.tls = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	return s, nil
+}
+
+// serve accepts control connections until the listener is closed
+func (s *ftpServer) serve(ln net.Listener) {
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.h.log.logf("FTP accept error: %v", err)
+			}
+			return
+		}
+		go s.newSession(conn).run()
+	}
+}
+
+// close stops accepting connections
+func (s *ftpServer) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ln != nil {
+		s.ln.Close()
+	}
+}
+
+// ftpSession is the state of one control connection
+type ftpSession struct {
+	s      *ftpServer
+	conn   net.Conn
+	r      *bufio.Reader
+	user   string
+	authed bool
+	cwd    string
+	// Data connection settings: a passive listener or an active address
+	passive    net.Listener
+	active     string
+	protect    bool
+	restart    int64
+	loginTries int
+}
+
+// newSession starts a session on a control connection
+func (s *ftpServer) newSession(conn net.Conn) *ftpSession {
+	return &ftpSession{s: s, conn: conn, r: bufio.NewReader(conn), cwd: "/"}
+}
+
+// reply sends a single line reply
+func (c *ftpSession) reply(code int, format string, args ...any) {
+	c.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	fmt.Fprintf(c.conn, "%d %s\r\n", code, fmt.Sprintf(format, args...))
+}
+
+// remoteIP is the address of the client on the control connection
+func (c *ftpSession) remoteIP() net.IP {
+	if addr, ok := c.conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// run reads commands until the client quits or goes quiet
+func (c *ftpSession) run() {
+	defer func() {
+		c.closeData()
+		c.conn.Close()
+	}()
+	c.reply(220, "simple-http-server FTP ready")
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(ftpIdleTimeout))
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if len(line) > 4096 {
+			c.reply(500, "Command too long")
+			return
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		cmd = strings.ToUpper(cmd)
+		if !c.authed && !ftpPreLoginCommands[cmd] {
+			c.reply(530, "Please log in with USER and PASS")
+			continue
+		}
+		if !c.handle(cmd, arg) {
+			return
+		}
+	}
+}
+
+// ftpPreLoginCommands are accepted before logging in
+var ftpPreLoginCommands = map[string]bool{
+	"USER": true, "PASS": true, "AUTH": true, "PBSZ": true, "PROT": true,
+	"FEAT": true, "SYST": true, "OPTS": true, "NOOP": true, "QUIT": true,
+}
+
+// ftpWriteCommands change the tree and are refused
+var ftpWriteCommands = map[string]bool{
+	"STOR": true, "STOU": true, "APPE": true, "DELE": true, "MKD": true, "XMKD": true,
+	"RMD": true, "XRMD": true, "RNFR": true, "RNTO": true, "SITE": true,
+}
+
+// handle runs a command, returning false to end the session
+func (c *ftpSession) handle(cmd, arg string) bool {
+	switch cmd {
+	case "USER":
+		c.user, c.authed = arg, false
+		if len(c.s.creds) == 0 {
+			c.reply(331, "Anonymous access, any password will do")
+		} else {
+			c.reply(331, "Password required for %s", arg)
+		}
+	case "PASS":
+		if c.user == "" {
+			c.reply(503, "Send USER first")
+			break
+		}
+		if len(c.s.creds) > 0 && !c.s.creds.verify(c.user, arg) {
+			c.loginTries++
+			c.s.h.log.logf("FTP login failed for %q from %s", c.user, c.conn.RemoteAddr())
+			time.Sleep(time.Second)
+			c.reply(530, "Login incorrect")
+			return c.loginTries < 3
+		}
+		c.authed = true
+		c.s.h.log.logf("FTP login %q from %s", c.user, c.conn.RemoteAddr())
+		c.reply(230, "Logged in, read-only access")
+	case "AUTH":
+		if c.s.tls == nil || !strings.EqualFold(arg, "TLS") && !strings.EqualFold(arg, "SSL") {
+			c.reply(504, "AUTH %s not supported", arg)
+			break
+		}
+		if _, ok := c.conn.(*tls.Conn); ok {
+			c.reply(503, "Already using TLS")
+			break
+		}
+		c.reply(234, "Starting TLS")
+		tlsConn := tls.Server(c.conn, c.s.tls)
+		tlsConn.SetDeadline(time.Now().Add(30 * time.Second))
+		if err := tlsConn.Handshake(); err != nil {
+			c.s.h.log.logf("FTP TLS handshake with %s failed: %v", c.conn.RemoteAddr(), err)
+			return false
+		}
+		tlsConn.SetDeadline(time.Time{})
+		c.conn, c.r = tlsConn, bufio.NewReader(tlsConn)
+		// Credentials sent in the clear no longer count
+		c.user, c.authed = "", false
+	case "PBSZ":
+		c.reply(200, "PBSZ=0")
+	case "PROT":
+		switch strings.ToUpper(arg) {
+		case "C":
+			c.protect = false
+			c.reply(200, "Data connections in the clear")
+		case "P":
+			if _, ok := c.conn.(*tls.Conn); !ok {
+				c.reply(503, "Use AUTH TLS first")
+				break
+			}
+			c.protect = true
+			c.reply(200, "Data connections protected")
+		default:
+			c.reply(504, "PROT %s not supported", arg)
+		}
+	case "FEAT":
+		features := []string{"EPSV", "MDTM", "MLST type*;size*;modify*;", "PASV", "REST STREAM", "SIZE", "UTF8"}
+		if c.s.tls != nil {
+			features = append(features, "AUTH TLS", "PBSZ", "PROT")
+			sort.Strings(features)
+		}
+		fmt.Fprintf(c.conn, "211-Features:\r\n %s\r\n211 End\r\n", strings.Join(features, "\r\n "))
+	case "SYST":
+		c.reply(215, "UNIX Type: L8")
+	case "OPTS":
+		if strings.EqualFold(arg, "UTF8 ON") {
+			c.reply(200, "UTF8 is always on")
+		} else {
+			c.reply(501, "Option not supported")
+		}
+	case "NOOP", "ALLO", "CLNT":
+		c.reply(200, "OK")
+	case "QUIT":
+		c.reply(221, "Goodbye")
+		return false
+	case "PWD", "XPWD":
+		c.reply(257, "\"%s\" is the current directory", strings.ReplaceAll(c.cwd, `"`, `""`))
+	case "CWD", "XCWD", "CDUP", "XCUP":
+		if cmd == "CDUP" || cmd == "XCUP" {
+			arg = ".."
+		}
+		name := c.resolve(arg)
+		if info, err := c.stat(name); err != nil || !info.IsDir() {
+			c.reply(550, "No such directory")
+			break
+		}
+		c.cwd = name
+		c.reply(250, "Directory changed to %s", name)
+	case "TYPE":
+		// Files are always sent as they are stored
+		typ, _, _ := strings.Cut(strings.TrimSpace(arg), " ")
+		switch strings.ToUpper(typ) {
+		case "A", "I", "L":
+			c.reply(200, "Type set to %s", arg)
+		default:
+			c.reply(504, "Type %s not supported", arg)
+		}
+	case "MODE":
+		c.replyOnly(arg, "S", "Mode")
+	case "STRU":
+		c.replyOnly(arg, "F", "Structure")
+	case "PASV", "EPSV":
+		c.openPassive(cmd == "EPSV")
+	case "PORT", "EPRT":
+		c.setActive(cmd, arg)
+	case "REST":
+		offset, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || offset < 0 {
+			c.reply(501, "Invalid offset")
+			break
+		}
+		c.restart = offset
+		c.reply(350, "Restarting at %d", offset)
+	case "SIZE", "MDTM":
+		info, err := c.stat(c.resolve(arg))
+		switch {
+		case err != nil || info.IsDir():
+			c.reply(550, "No such file")
+		case cmd == "SIZE":
+			c.reply(213, "%d", info.Size())
+		default:
+			c.reply(213, "%s", info.ModTime().UTC().Format("20060102150405"))
+		}
+	case "MLST":
+		name := c.resolve(arg)
+		info, err := c.stat(name)
+		if err != nil {
+			c.reply(550, "No such file or directory")
+			break
+		}
+		fmt.Fprintf(c.conn, "250-Listing %s\r\n %s%s\r\n250 End\r\n", name, mlsxFacts(info), name)
+	case "LIST", "NLST", "MLSD":
+		c.list(cmd, arg)
+	case "RETR":
+		c.retrieve(c.resolve(arg))
+	case "ABOR":
+		c.closeData()
+		c.reply(226, "No transfer in progress")
+	case "STAT":
+		if arg != "" {
+			c.reply(502, "STAT with a path is not supported, use LIST")
+			break
+		}
+		c.reply(211, "Logged in as %s, read-only", c.user)
+	case "HELP":
+		c.reply(214, "See FEAT for the supported extensions")
+	default:
+		if ftpWriteCommands[cmd] {
+			c.reply(550, "Read-only server")
+		} else {
+			c.reply(502, "Command %s not implemented", cmd)
+		}
+	}
+	return true
+}
+
+// replyOnly accepts a MODE or STRU argument when it is the only one
+// supported
+func (c *ftpSession) replyOnly(arg, supported, what string) {
+	if strings.EqualFold(arg, supported) {
+		c.reply(200, "%s set to %s", what, supported)
+	} else {
+		c.reply(504, "%s %s not supported", what, arg)
+	}
+}
+
+// resolve turns a path argument into a clean absolute path
+func (c *ftpSession) resolve(arg string) string {
+	if strings.HasPrefix(arg, "/") {
+		return path.Clean(arg)
+	}
+	return path.Join(c.cwd, arg)
+}
+
+// fsName converts a clean absolute path to an fs.FS name
+func fsName(name string) string {
+	if name == "/" {
+		return "."
+	}
+	return strings.TrimPrefix(name, "/")
+}
+
+// hidden reports whether a path is kept out of reach, as over HTTP
+func (c *ftpSession) hidden(name string) bool {
+	return isTrashPath(name) || isMaintenancePath(name) || c.s.h.mirror != nil && isMirrorPath(name)
+}
+
+// stat describes the file or directory at a clean absolute path
+func (c *ftpSession) stat(name string) (fs.FileInfo, error) {
+	if c.hidden(name) {
+		return nil, fs.ErrNotExist
+	}
+	return fs.Stat(c.s.h.storage, fsName(name))
+}
+
+// openPassive listens for the next data connection
+func (c *ftpSession) openPassive(extended bool) {
+	c.closeData()
+	local := c.conn.LocalAddr().(*net.TCPAddr)
+	ip := local.IP.To4()
+	if !extended && ip == nil {
+		c.reply(425, "PASV needs IPv4, use EPSV")
+		return
+	}
+	ln, err := c.s.listenData(local.IP)
+	if err != nil {
+		c.s.h.log.logf("FTP passive listen failed: %v", err)
+		c.reply(425, "Cannot open data connection")
+		return
+	}
+	c.passive = ln
+	port := ln.Addr().(*net.TCPAddr).Port
+	if extended {
+		c.reply(229, "Entering Extended Passive Mode (|||%d|)", port)
+	} else {
+		c.reply(227, "Entering Passive Mode (%d,%d,%d,%d,%d,%d)", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff)
+	}
+}
+
+// listenData listens on a port of the passive range on the given address
+func (s *ftpServer) listenData(ip net.IP) (net.Listener, error) {
+	if s.portRange[0] == 0 {
+		return net.Listen("tcp", net.JoinHostPort(ip.String(), "0"))
+	}
+	n := s.portRange[1] - s.portRange[0] + 1
+	start := rand.IntN(n)
+	var err error
+	for i := range n {
+		port := s.portRange[0] + (start+i)%n
+		var ln net.Listener
+		if ln, err = net.Listen("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port))); err == nil {
+			return ln, nil
+		}
+	}
+	return nil, fmt.Errorf("no free port in %d-%d: %v", s.portRange[0], s.portRange[1], err)
+}
+
+// setActive records where to connect for the next transfer. Only the
+// client's own address is accepted, so the server cannot be used to reach
+// third parties.
+func (c *ftpSession) setActive(cmd, arg string) {
+	c.closeData()
+	var ip net.IP
+	var port int
+	if cmd == "PORT" {
+		parts := strings.Split(arg, ",")
+		if len(parts) == 6 {
+			ip = net.ParseIP(strings.Join(parts[:4], "."))
+			hi, err1 := strconv.Atoi(parts[4])
+			lo, err2 := strconv.Atoi(parts[5])
+			if err1 == nil && err2 == nil && hi >= 0 && hi < 256 && lo >= 0 && lo < 256 {
+				port = hi<<8 | lo
+			}
+		}
+	} else if len(arg) > 1 {
+		// EPRT |proto|address|port|
+		parts := strings.Split(arg, arg[:1])
+		if len(parts) == 5 {
+			ip = net.ParseIP(parts[2])
+			port, _ = strconv.Atoi(parts[3])
+		}
+	}
+	if ip == nil || port < 1 || port > 65535 {
+		c.reply(501, "Invalid address")
+		return
+	}
+	if !ip.Equal(c.remoteIP()) {
+		c.reply(504, "Data connections only go to the client's own address")
+		return
+	}
+	c.active = net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	c.reply(200, "%s command successful", cmd)
+}
+
+// openData establishes the data connection set up by PASV or PORT
+func (c *ftpSession) openData() (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	switch {
+	case c.passive != nil:
+		ln := c.passive
+		c.passive = nil
+		defer ln.Close()
+		ln.(*net.TCPListener).SetDeadline(time.Now().Add(30 * time.Second))
+		conn, err = ln.Accept()
+		if err == nil && !conn.RemoteAddr().(*net.TCPAddr).IP.Equal(c.remoteIP()) {
+			conn.Close()
+			return nil, errors.New("data connection from another address")
+		}
+	case c.active != "":
+		conn, err = net.DialTimeout("tcp", c.active, 30*time.Second)
+		c.active = ""
+	default:
+		return nil, errors.New("use PASV or PORT first")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.protect {
+		tlsConn := tls.Server(conn, c.s.tls)
+		tlsConn.SetDeadline(time.Now().Add(30 * time.Second))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+	return conn, nil
+}
+
+// closeData drops a data connection that was set up but not used
+func (c *ftpSession) closeData() {
+	if c.passive != nil {
+		c.passive.Close()
+		c.passive = nil
+	}
+	c.active = ""
+}
+
+// list sends a directory listing, or the single entry of a file
+func (c *ftpSession) list(cmd, arg string) {
+	// Clients commonly pass ls options such as -la, which are ignored
+	fields := strings.Fields(arg)
+	for len(fields) > 0 && strings.HasPrefix(fields[0], "-") {
+		fields = fields[1:]
+	}
+	name := c.resolve(strings.Join(fields, " "))
+	info, err := c.stat(name)
+	if err != nil {
+		c.closeData()
+		c.reply(550, "No such file or directory")
+		return
+	}
+	var infos []fs.FileInfo
+	if info.IsDir() {
+		entries, err := fs.ReadDir(c.s.h.storage, fsName(name))
+		if err != nil {
+			c.closeData()
+			c.reply(550, "Cannot read directory")
+			return
+		}
+		for _, entry := range entries {
+			if hiddenEntry(name, entry.Name()) {
+				continue
+			}
+			if info, err := entry.Info(); err == nil {
+				infos = append(infos, info)
+			}
+		}
+	} else if cmd == "MLSD" {
+		c.closeData()
+		c.reply(501, "Not a directory")
+		return
+	} else {
+		infos = []fs.FileInfo{info}
+	}
+
+	c.reply(150, "Sending listing of %s", name)
+	conn, err := c.openData()
+	if err != nil {
+		c.reply(425, "Cannot open data connection: %v", err)
+		return
+	}
+	w := bufio.NewWriter(conn)
+	now := time.Now()
+	for _, info := range infos {
+		switch cmd {
+		case "NLST":
+			fmt.Fprintf(w, "%s\r\n", info.Name())
+		case "MLSD":
+			fmt.Fprintf(w, "%s%s\r\n", mlsxFacts(info), info.Name())
+		default:
+			fmt.Fprintf(w, "%s\r\n", lsLine(info, now))
+		}
+	}
+	err = w.Flush()
+	conn.Close()
+	if err != nil {
+		c.reply(426, "Transfer aborted")
+		return
+	}
+	c.reply(226, "Listing sent")
+}
+
+// lsLine formats an entry as ls -l does, which is what clients parse
+func lsLine(info fs.FileInfo, now time.Time) string {
+	mode := info.Mode()
+	perm := "-rw-r--r--"
+	if mode.IsDir() {
+		perm = "drwxr-xr-x"
+	}
+	size := info.Size()
+	if mode.IsDir() {
+		size = 0
+	}
+	mtime := info.ModTime()
+	stamp := mtime.Format("Jan _2 15:04")
+	if now.Sub(mtime) > 180*24*time.Hour || mtime.After(now.Add(time.Hour)) {
+		stamp = mtime.Format("Jan _2  2006")
+	}
+	return fmt.Sprintf("%s 1 ftp ftp %12d %s %s", perm, size, stamp, info.Name())
+}
+
+// mlsxFacts formats the MLST facts of an entry, up to its name
+func mlsxFacts(info fs.FileInfo) string {
+	kind := "file"
+	if info.IsDir() {
+		kind = "dir"
+	}
+	return fmt.Sprintf("type=%s;size=%d;modify=%s; ", kind, info.Size(), info.ModTime().UTC().Format("20060102150405"))
+}
+
+// retrieve sends a file, from the offset given by REST if any
+func (c *ftpSession) retrieve(name string) {
+	offset := c.restart
+	c.restart = 0
+	info, err := c.stat(name)
+	if err != nil || info.IsDir() {
+		c.closeData()
+		c.reply(550, "No such file")
+		return
+	}
+	f, err := c.s.h.storage.Open(fsName(name))
+	if err != nil {
+		c.closeData()
+		c.reply(550, "Cannot open file")
+		return
+	}
+	defer f.Close()
+	if offset > 0 {
+		if seeker, ok := f.(io.Seeker); ok {
+			_, err = seeker.Seek(offset, io.SeekStart)
+		} else {
+			_, err = io.CopyN(io.Discard, f, offset)
+		}
+		if err != nil {
+			c.closeData()
+			c.reply(554, "Cannot restart at %d", offset)
+			return
+		}
+	}
+
+	c.reply(150, "Sending %s (%d bytes)", name, info.Size()-offset)
+	conn, err := c.openData()
+	if err != nil {
+		c.reply(425, "Cannot open data connection: %v", err)
+		return
+	}
+	start := time.Now()
+	n, err := io.Copy(conn, f)
+	if closeErr := conn.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		c.s.h.log.logf("FTP RETR %s (%s) aborted after %d bytes: %v", name, c.user, n, err)
+		c.reply(426, "Transfer aborted")
+		return
+	}
+	c.s.h.log.logf("FTP RETR %s (%s) %d bytes in %v", name, c.user, n, time.Since(start).Round(time.Millisecond))
+	c.reply(226, "Transfer complete")
+}
@@ -0,0 +1,301 @@
+package httpserve
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gcsReadScope is the OAuth scope requested for reading buckets
+const gcsReadScope = "https://www.googleapis.com/auth/devstorage.read_only"
+
+// gcsMetadataURL is the instance metadata service of Compute Engine, GKE
+// and Cloud Run
+const gcsMetadataURL = "http://metadata.google.internal/computeMetadata/v1/"
+
+// gcsStore reads a Google Cloud Storage bucket through the JSON API
+type gcsStore struct {
+	client *http.Client
+	base   string
+	bucket string
+	token  *bearerToken
+}
+
+// openGCSFS serves the bucket of a gs://bucket/prefix URL. Credentials are
+// looked up like Application Default Credentials: the key file named by
+// GOOGLE_APPLICATION_CREDENTIALS, the gcloud user credentials, then the
+// metadata service. Without any the bucket is read anonymously.
+// STORAGE_EMULATOR_HOST or an endpoint URL parameter point it at an
+// emulator.
+func openGCSFS(u *url.URL, log *serverLog) (fs.FS, error) {
+	s := &gcsStore{client: storageClient(), base: "https://storage.googleapis.com", bucket: u.Host}
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+		s.base = host
+	}
+	if endpoint := u.Query().Get("endpoint"); endpoint != "" {
+		s.base = endpoint
+	}
+	s.base = strings.TrimSuffix(s.base, "/")
+	token, source, err := gcsCredentials(s.client)
+	if err != nil {
+		return nil, err
+	}
+	s.token = token
+	log.logf("Reading gs://%s with %s", s.bucket, source)
+	return &objectFS{store: s, prefix: strings.Trim(u.Path, "/")}, nil
+}
+
+// gcsCredentials finds the credentials to read buckets with, returning a
+// nil token for anonymous access and a description of the source
+func gcsCredentials(client *http.Client) (*bearerToken, string, error) {
+	file := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if file == "" {
+		if dir, err := os.UserConfigDir(); err == nil {
+			adc := filepath.Join(dir, "gcloud", "application_default_credentials.json")
+			if _, err := os.Stat(adc); err == nil {
+				file = adc
+			}
+		}
+	}
+	if file != "" {
+		token, err := gcsFileCredentials(client, file)
+		if err != nil {
+			return nil, "", fmt.Errorf("credentials in %s: %v", file, err)
+		}
+		return token, "credentials from " + file, nil
+	}
+	header := http.Header{"Metadata-Flavor": {"Google"}}
+	if probeMetadata(gcsMetadataURL, header) {
+		return &bearerToken{fetch: func() (string, time.Duration, error) {
+			req, err := http.NewRequest(http.MethodGet, gcsMetadataURL+"instance/service-accounts/default/token", nil)
+			if err != nil {
+				return "", 0, err
+			}
+			req.Header = header
+			return requestToken(client, req)
+		}}, "the instance service account", nil
+	}
+	return nil, "anonymous access", nil
+}
+
+// gcsKeyFile holds the fields used from service account keys and gcloud
+// user credentials
+type gcsKeyFile struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// gcsFileCredentials returns a token source for a credentials file
+func gcsFileCredentials(client *http.Client, file string) (*bearerToken, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var key gcsKeyFile
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, err
+	}
+	tokenURI := firstNonEmpty(key.TokenURI, "https://oauth2.googleapis.com/token")
+	switch key.Type {
+	case "service_account":
+		block, _ := pem.Decode([]byte(key.PrivateKey))
+		if block == nil {
+			return nil, errors.New("private key is not PEM encoded")
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("private key is not an RSA key")
+		}
+		return &bearerToken{fetch: func() (string, time.Duration, error) {
+			assertion, err := gcsAssertion(key.ClientEmail, tokenURI, rsaKey)
+			if err != nil {
+				return "", 0, err
+			}
+			return postTokenForm(client, tokenURI, url.Values{
+				"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+				"assertion":  {assertion},
+			})
+		}}, nil
+	case "authorized_user":
+		return &bearerToken{fetch: func() (string, time.Duration, error) {
+			return postTokenForm(client, tokenURI, url.Values{
+				"grant_type":    {"refresh_token"},
+				"client_id":     {key.ClientID},
+				"client_secret": {key.ClientSecret},
+				"refresh_token": {key.RefreshToken},
+			})
+		}}, nil
+	}
+	return nil, fmt.Errorf("unsupported credentials type %q", key.Type)
+}
+
+// gcsAssertion signs the JWT a service account exchanges for a token
+func gcsAssertion(email, audience string, key *rsa.PrivateKey) (string, error) {
+	now := time.Now()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]any{
+		"iss":   email,
+		"scope": gcsReadScope,
+		"aud":   audience,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// postTokenForm requests an access token from an OAuth token endpoint
+func postTokenForm(client *http.Client, endpoint string, form url.Values) (string, time.Duration, error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return requestToken(client, req)
+}
+
+// gcsObject is the metadata of an object in the JSON API
+type gcsObject struct {
+	Name    string    `json:"name"`
+	Size    string    `json:"size"`
+	Updated time.Time `json:"updated"`
+}
+
+// info converts the metadata to an objectInfo
+func (o gcsObject) info() objectInfo {
+	size, _ := strconv.ParseInt(o.Size, 10, 64)
+	return objectInfo{name: o.Name, size: size, modTime: o.Updated}
+}
+
+// head returns the size and modification time of an object
+func (s *gcsStore) head(key string) (objectInfo, error) {
+	resp, err := s.do(s.objectURL(key), nil, nil)
+	if err != nil {
+		return objectInfo{}, err
+	}
+	defer resp.Body.Close()
+	var obj gcsObject
+	if err := json.NewDecoder(resp.Body).Decode(&obj); err != nil {
+		return objectInfo{}, err
+	}
+	return obj.info(), nil
+}
+
+// get streams an object from offset on
+func (s *gcsStore) get(key string, offset int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	resp, err := s.do(s.objectURL(key), url.Values{"alt": {"media"}}, header)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// list returns one page of the keys below prefix, delimited by slashes
+func (s *gcsStore) list(prefix, token string, limit int) (objectPage, error) {
+	query := url.Values{"delimiter": {"/"}, "fields": {"items(name,size,updated),prefixes,nextPageToken"}}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	if token != "" {
+		query.Set("pageToken", token)
+	}
+	if limit > 0 {
+		query.Set("maxResults", strconv.Itoa(limit))
+	}
+	resp, err := s.do(s.base+"/storage/v1/b/"+url.PathEscape(s.bucket)+"/o", query, nil)
+	if err != nil {
+		return objectPage{}, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Items         []gcsObject `json:"items"`
+		Prefixes      []string    `json:"prefixes"`
+		NextPageToken string      `json:"nextPageToken"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return objectPage{}, fmt.Errorf("decoding bucket listing: %v", err)
+	}
+	page := objectPage{prefixes: result.Prefixes, next: result.NextPageToken}
+	for _, item := range result.Items {
+		page.objects = append(page.objects, item.info())
+	}
+	return page, nil
+}
+
+// objectURL returns the JSON API URL of an object
+func (s *gcsStore) objectURL(key string) string {
+	return s.base + "/storage/v1/b/" + url.PathEscape(s.bucket) + "/o/" + url.PathEscape(key)
+}
+
+// do sends an authorized GET request and turns error responses into errors
+func (s *gcsStore) do(target string, query url.Values, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if header != nil {
+		req.Header = header
+	}
+	req.URL.RawQuery = query.Encode()
+	if s.token != nil {
+		token, err := s.token.get()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var gcsErr struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&gcsErr)
+	return nil, storageStatusError(resp, "gcs "+req.URL.Path, gcsErr.Error.Message)
+}
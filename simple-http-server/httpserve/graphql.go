@@ -0,0 +1,1090 @@
+package httpserve
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// graphqlPath is where --graphql answers queries over the file tree
+const graphqlPath = "/graphql"
+
+// Limits keeping a single query from crawling the whole disk
+const (
+	graphqlMaxDepth = 16
+	graphqlMaxNodes = 10000
+)
+
+// graphqlSchema describes the schema, and is served on GET requests
+// without a query
+const graphqlSchema = `# 64-bit integer
+scalar Long
+
+type Query {
+  # The file or directory at path, or null when there is none
+  file(path: String = "/"): File
+  # Entries below path whose name matches the glob pattern
+  files(path: String = "/", pattern: String, recursive: Boolean = false, limit: Int = 1000): [File!]!
+}
+
+type File {
+  name: String!
+  path: String!
+  size: Long!
+  isDir: Boolean!
+  # RFC 3339
+  modTime: String!
+  contentType: String
+  # Hex SHA-256 of the contents, null for directories
+  sha256: String
+  # Entries of a directory sorted by name, null for files
+  children(pattern: String, limit: Int, offset: Int = 0): [File!]
+}
+`
+
+// graphqlField is a field of the schema: its type, the object type it
+// resolves to if any, and the types of its arguments
+type graphqlField struct {
+	typ    string
+	object string
+	args   map[string]string
+}
+
+// graphqlTypes are the object types of graphqlSchema
+var graphqlTypes = map[string]map[string]graphqlField{
+	"Query": {
+		"file":  {typ: "File", object: "File", args: map[string]string{"path": "String"}},
+		"files": {typ: "[File!]!", object: "File", args: map[string]string{"path": "String", "pattern": "String", "recursive": "Boolean", "limit": "Int"}},
+	},
+	"File": {
+		"name":        {typ: "String!"},
+		"path":        {typ: "String!"},
+		"size":        {typ: "Long!"},
+		"isDir":       {typ: "Boolean!"},
+		"modTime":     {typ: "String!"},
+		"contentType": {typ: "String"},
+		"sha256":      {typ: "String"},
+		"children":    {typ: "[File!]", object: "File", args: map[string]string{"pattern": "String", "limit": "Int", "offset": "Int"}},
+	},
+}
+
+// graphqlRequest is a query sent as JSON or URL parameters
+type graphqlRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+// graphqlError is an entry of the errors of a response
+type graphqlError struct {
+	Message string `json:"message"`
+	Path    []any  `json:"path,omitempty"`
+}
+
+// graphqlResponse is the body of every answer
+type graphqlResponse struct {
+	Data   any            `json:"data"`
+	Errors []graphqlError `json:"errors,omitempty"`
+}
+
+// serveGraphQL answers GET and POST queries over the file tree. Only
+// queries are supported: the tree is changed through the other endpoints.
+func (h *fileHandler) serveGraphQL(w http.ResponseWriter, r *http.Request) {
+	var req graphqlRequest
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		q := r.URL.Query()
+		if !q.Has("query") {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			io.WriteString(w, graphqlSchema)
+			return
+		}
+		req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+		if vars := q.Get("variables"); vars != "" {
+			if err := json.Unmarshal([]byte(vars), &req.Variables); err != nil {
+				writeGraphQLError(w, http.StatusBadRequest, "variables are not a JSON object")
+				return
+			}
+		}
+	case http.MethodPost:
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			writeGraphQLError(w, http.StatusBadRequest, "reading request: "+err.Error())
+			return
+		}
+		if mediaType(r.Header.Get("Content-Type")) == "application/graphql" {
+			req.Query = string(body)
+		} else if err := json.Unmarshal(body, &req); err != nil {
+			writeGraphQLError(w, http.StatusBadRequest, "request body is not valid JSON")
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		writeGraphQLError(w, http.StatusMethodNotAllowed, "use GET or POST")
+		return
+	}
+
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		writeGraphQLError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	exec := &graphqlExecutor{h: h, doc: doc}
+	op, err := exec.prepare(req.OperationName, req.Variables)
+	if err != nil {
+		writeGraphQLError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	data, err := exec.resolveObject("Query", nil, op.sel, nil)
+	if err != nil {
+		exec.errors = append(exec.errors, graphqlError{Message: err.Error()})
+		writeJSON(w, http.StatusOK, graphqlResponse{Errors: exec.errors})
+		return
+	}
+	writeJSON(w, http.StatusOK, graphqlResponse{Data: data, Errors: exec.errors})
+}
+
+// writeGraphQLError answers with a request error and no data
+func writeGraphQLError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, graphqlResponse{Errors: []graphqlError{{Message: msg}}})
+}
+
+// graphqlDocument is a parsed query document
+type graphqlDocument struct {
+	operations []*graphqlOperation
+	fragments  map[string]*graphqlFragment
+}
+
+// graphqlOperation is an operation of a document
+type graphqlOperation struct {
+	kind string
+	name string
+	vars []graphqlVariableDef
+	sel  []*graphqlSelection
+}
+
+// graphqlVariableDef declares a variable of an operation
+type graphqlVariableDef struct {
+	name   string
+	typ    string
+	def    any
+	hasDef bool
+}
+
+// graphqlFragment is a named fragment
+type graphqlFragment struct {
+	on  string
+	sel []*graphqlSelection
+}
+
+// graphqlSelection is a field, a fragment spread or an inline fragment
+type graphqlSelection struct {
+	alias, name string
+	args        map[string]any
+	directives  map[string]map[string]any
+	sel         []*graphqlSelection
+	spread      string
+	inline      bool
+	on          string
+}
+
+// responseKey is the name the selection has in the response
+func (s *graphqlSelection) responseKey() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.name
+}
+
+// graphqlVariable and graphqlEnum are argument values that are not
+// literals of a JSON type
+type (
+	graphqlVariable string
+	graphqlEnum     string
+)
+
+// graphqlToken is a lexical token: a punctuator, name, number or string
+type graphqlToken struct {
+	kind byte // 'p', 'n', 'i', 'f', 's' or 0 at the end
+	text string
+	pos  int
+}
+
+// String describes the token in syntax errors
+func (t graphqlToken) String() string {
+	if t.kind == 0 {
+		return "the end of the query"
+	}
+	return strconv.Quote(t.text)
+}
+
+// graphqlParser is a recursive descent parser of executable documents
+type graphqlParser struct {
+	src  string
+	pos  int
+	tok  graphqlToken
+	errs error
+}
+
+// parseGraphQL parses a query document
+func parseGraphQL(src string) (*graphqlDocument, error) {
+	p := &graphqlParser{src: src}
+	p.next()
+	doc := &graphqlDocument{fragments: make(map[string]*graphqlFragment)}
+	for p.tok.kind != 0 && p.errs == nil {
+		switch {
+		case p.is('p', "{"):
+			doc.operations = append(doc.operations, &graphqlOperation{kind: "query", sel: p.selectionSet(1)})
+		case p.is('n', "query"), p.is('n', "mutation"), p.is('n', "subscription"):
+			doc.operations = append(doc.operations, p.operation())
+		case p.is('n', "fragment"):
+			p.next()
+			name := p.name()
+			if p.expectName("on") {
+				frag := &graphqlFragment{on: p.name()}
+				p.directives(1)
+				frag.sel = p.selectionSet(1)
+				doc.fragments[name] = frag
+			}
+		default:
+			p.fail("unexpected %s", p.tok)
+		}
+	}
+	if p.errs != nil {
+		return nil, p.errs
+	}
+	if len(doc.operations) == 0 {
+		return nil, errors.New("the document has no operation")
+	}
+	return doc, nil
+}
+
+// fail records the first syntax error
+func (p *graphqlParser) fail(format string, args ...any) {
+	if p.errs == nil {
+		p.errs = fmt.Errorf("syntax error at offset %d: %s", p.tok.pos, fmt.Sprintf(format, args...))
+	}
+	p.tok = graphqlToken{}
+}
+
+// is reports whether the current token has the given kind and text
+func (p *graphqlParser) is(kind byte, text string) bool {
+	return p.tok.kind == kind && p.tok.text == text
+}
+
+// expect consumes the given punctuator
+func (p *graphqlParser) expect(punct string) bool {
+	if !p.is('p', punct) {
+		p.fail("expected %q, found %s", punct, p.tok)
+		return false
+	}
+	p.next()
+	return true
+}
+
+// expectName consumes the given keyword
+func (p *graphqlParser) expectName(name string) bool {
+	if !p.is('n', name) {
+		p.fail("expected %q, found %s", name, p.tok)
+		return false
+	}
+	p.next()
+	return true
+}
+
+// name consumes a name
+func (p *graphqlParser) name() string {
+	if p.tok.kind != 'n' {
+		p.fail("expected a name, found %s", p.tok)
+		return ""
+	}
+	name := p.tok.text
+	p.next()
+	return name
+}
+
+// next reads the following token, skipping whitespace, commas and comments
+func (p *graphqlParser) next() {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' && p.src[p.pos] != '\r' {
+				p.pos++
+			}
+			continue
+		}
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' && c != ',' && c != 0xef && c != 0xbb && c != 0xbf {
+			break
+		}
+		p.pos++
+	}
+	start := p.pos
+	if p.pos >= len(p.src) {
+		p.tok = graphqlToken{pos: start}
+		return
+	}
+	c := p.src[p.pos]
+	switch {
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.pos += 3
+		p.tok = graphqlToken{kind: 'p', text: "...", pos: start}
+	case strings.IndexByte("!$&()=:@[]{}|", c) >= 0:
+		p.pos++
+		p.tok = graphqlToken{kind: 'p', text: string(c), pos: start}
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		for p.pos < len(p.src) && isNameByte(p.src[p.pos]) {
+			p.pos++
+		}
+		p.tok = graphqlToken{kind: 'n', text: p.src[start:p.pos], pos: start}
+	case c == '-' || c >= '0' && c <= '9':
+		kind := byte('i')
+		p.pos++
+		for p.pos < len(p.src) {
+			d := p.src[p.pos]
+			if d == '.' || d == 'e' || d == 'E' || (d == '+' || d == '-') && (p.src[p.pos-1] == 'e' || p.src[p.pos-1] == 'E') {
+				kind = 'f'
+			} else if d < '0' || d > '9' {
+				break
+			}
+			p.pos++
+		}
+		p.tok = graphqlToken{kind: kind, text: p.src[start:p.pos], pos: start}
+	case c == '"':
+		p.tok = graphqlToken{kind: 's', text: p.stringLiteral(), pos: start}
+	default:
+		p.tok = graphqlToken{kind: 'p', text: string(c), pos: start}
+		p.fail("unexpected character %q", c)
+	}
+}
+
+// isNameByte reports whether c can continue a name
+func isNameByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// stringLiteral reads a quoted or block string starting at the cursor
+func (p *graphqlParser) stringLiteral() string {
+	if strings.HasPrefix(p.src[p.pos:], `"""`) {
+		end := strings.Index(p.src[p.pos+3:], `"""`)
+		if end < 0 {
+			p.pos = len(p.src)
+			p.fail("unterminated block string")
+			return ""
+		}
+		s := p.src[p.pos+3 : p.pos+3+end]
+		p.pos += end + 6
+		return strings.TrimSpace(strings.ReplaceAll(s, `\"""`, `"""`))
+	}
+	// Quoted strings use the escapes of JSON strings
+	end := p.pos + 1
+	for end < len(p.src) && p.src[end] != '"' && p.src[end] != '\n' {
+		if p.src[end] == '\\' {
+			end++
+		}
+		end++
+	}
+	if end >= len(p.src) || p.src[end] != '"' {
+		p.pos = len(p.src)
+		p.fail("unterminated string")
+		return ""
+	}
+	var s string
+	if err := json.Unmarshal([]byte(p.src[p.pos:end+1]), &s); err != nil {
+		p.fail("invalid string")
+	}
+	p.pos = end + 1
+	return s
+}
+
+// operation parses an operation with its keyword
+func (p *graphqlParser) operation() *graphqlOperation {
+	op := &graphqlOperation{kind: p.name()}
+	if p.tok.kind == 'n' {
+		op.name = p.name()
+	}
+	if p.is('p', "(") {
+		p.next()
+		for !p.is('p', ")") && p.tok.kind != 0 {
+			var def graphqlVariableDef
+			if !p.expect("$") {
+				break
+			}
+			def.name = p.name()
+			p.expect(":")
+			def.typ = p.typeRef(1)
+			if p.is('p', "=") {
+				p.next()
+				def.def, def.hasDef = p.value(true, 1), true
+			}
+			p.directives(1)
+			op.vars = append(op.vars, def)
+		}
+		p.expect(")")
+	}
+	p.directives(1)
+	op.sel = p.selectionSet(1)
+	return op
+}
+
+// typeRef parses a type such as String, [File!] or Int!
+func (p *graphqlParser) typeRef(depth int) string {
+	if depth > graphqlMaxDepth {
+		p.fail("types are nested more than %d levels deep", graphqlMaxDepth)
+		return ""
+	}
+	var typ string
+	if p.is('p', "[") {
+		p.next()
+		typ = "[" + p.typeRef(depth+1) + "]"
+		p.expect("]")
+	} else {
+		typ = p.name()
+	}
+	if p.is('p', "!") {
+		p.next()
+		typ += "!"
+	}
+	return typ
+}
+
+// selectionSet parses the selections between braces
+func (p *graphqlParser) selectionSet(depth int) []*graphqlSelection {
+	if depth > graphqlMaxDepth {
+		p.fail("selections are nested more than %d levels deep", graphqlMaxDepth)
+		return nil
+	}
+	if !p.expect("{") {
+		return nil
+	}
+	var sels []*graphqlSelection
+	for !p.is('p', "}") && p.tok.kind != 0 {
+		sel := &graphqlSelection{}
+		if p.is('p', "...") {
+			p.next()
+			switch {
+			case p.is('n', "on"):
+				p.next()
+				sel.inline, sel.on = true, p.name()
+			case p.tok.kind == 'n':
+				sel.spread = p.name()
+			default:
+				sel.inline = true
+			}
+			sel.directives = p.directives(depth)
+			if sel.inline {
+				sel.sel = p.selectionSet(depth + 1)
+			}
+		} else {
+			sel.name = p.name()
+			if p.is('p', ":") {
+				p.next()
+				sel.alias, sel.name = sel.name, p.name()
+			}
+			sel.args = p.arguments(depth)
+			sel.directives = p.directives(depth)
+			if p.is('p', "{") {
+				sel.sel = p.selectionSet(depth + 1)
+			}
+		}
+		sels = append(sels, sel)
+	}
+	p.expect("}")
+	return sels
+}
+
+// arguments parses an optional argument list, whose values count towards
+// the nesting depth of the selection holding them
+func (p *graphqlParser) arguments(depth int) map[string]any {
+	if !p.is('p', "(") {
+		return nil
+	}
+	p.next()
+	args := make(map[string]any)
+	for !p.is('p', ")") && p.tok.kind != 0 {
+		name := p.name()
+		p.expect(":")
+		args[name] = p.value(false, depth)
+	}
+	p.expect(")")
+	return args
+}
+
+// directives parses the directives of a selection, keyed by name
+func (p *graphqlParser) directives(depth int) map[string]map[string]any {
+	var directives map[string]map[string]any
+	for p.is('p', "@") {
+		p.next()
+		if directives == nil {
+			directives = make(map[string]map[string]any)
+		}
+		name := p.name()
+		directives[name] = p.arguments(depth)
+	}
+	return directives
+}
+
+// value parses an argument value; constant values cannot use variables.
+// Lists and objects nest one level deeper than the value holding them.
+func (p *graphqlParser) value(constant bool, depth int) any {
+	tok := p.tok
+	if (p.is('p', "[") || p.is('p', "{")) && depth >= graphqlMaxDepth {
+		p.fail("values are nested more than %d levels deep", graphqlMaxDepth)
+		return nil
+	}
+	switch {
+	case p.is('p', "$") && !constant:
+		p.next()
+		return graphqlVariable(p.name())
+	case tok.kind == 's':
+		p.next()
+		return tok.text
+	case tok.kind == 'i':
+		p.next()
+		n, err := strconv.ParseInt(tok.text, 10, 64)
+		if err != nil {
+			p.fail("invalid integer %q", tok.text)
+		}
+		return n
+	case tok.kind == 'f':
+		p.next()
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			p.fail("invalid number %q", tok.text)
+		}
+		return f
+	case tok.kind == 'n':
+		p.next()
+		switch tok.text {
+		case "true":
+			return true
+		case "false":
+			return false
+		case "null":
+			return nil
+		}
+		return graphqlEnum(tok.text)
+	case p.is('p', "["):
+		p.next()
+		list := []any{}
+		for !p.is('p', "]") && p.tok.kind != 0 {
+			list = append(list, p.value(constant, depth+1))
+		}
+		p.expect("]")
+		return list
+	case p.is('p', "{"):
+		p.next()
+		obj := make(map[string]any)
+		for !p.is('p', "}") && p.tok.kind != 0 {
+			name := p.name()
+			p.expect(":")
+			obj[name] = p.value(constant, depth+1)
+		}
+		p.expect("}")
+		return obj
+	}
+	p.fail("expected a value, found %s", tok)
+	return nil
+}
+
+// graphqlExecutor runs the operation of a document against a site
+type graphqlExecutor struct {
+	h      *fileHandler
+	doc    *graphqlDocument
+	vars   map[string]any
+	nodes  int
+	errors []graphqlError
+}
+
+// prepare selects the operation to run, coerces its variables and checks
+// its selections against the schema
+func (e *graphqlExecutor) prepare(name string, vars map[string]any) (*graphqlOperation, error) {
+	var op *graphqlOperation
+	for _, candidate := range e.doc.operations {
+		if name == "" && len(e.doc.operations) > 1 {
+			return nil, errors.New("the document has several operations, operationName is required")
+		}
+		if name == "" || candidate.name == name {
+			op = candidate
+			break
+		}
+	}
+	if op == nil {
+		return nil, fmt.Errorf("unknown operation %q", name)
+	}
+	if op.kind != "query" {
+		return nil, fmt.Errorf("only queries are supported, not %ss", op.kind)
+	}
+	e.vars = make(map[string]any)
+	for _, def := range op.vars {
+		v, given := vars[def.name]
+		switch {
+		case !given && def.hasDef:
+			v = def.def
+		case !given && strings.HasSuffix(def.typ, "!"):
+			return nil, fmt.Errorf("variable $%s of type %s is required", def.name, def.typ)
+		}
+		if v == nil && strings.HasSuffix(def.typ, "!") {
+			return nil, fmt.Errorf("variable $%s of type %s cannot be null", def.name, def.typ)
+		}
+		e.vars[def.name] = v
+	}
+	if err := e.validate("Query", op.sel, make(map[string]bool)); err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+// validate checks selections against the fields and arguments of typ
+func (e *graphqlExecutor) validate(typ string, sels []*graphqlSelection, spreading map[string]bool) error {
+	for _, sel := range sels {
+		switch {
+		case sel.spread != "":
+			frag, ok := e.doc.fragments[sel.spread]
+			if !ok {
+				return fmt.Errorf("unknown fragment %q", sel.spread)
+			}
+			if spreading[sel.spread] {
+				return fmt.Errorf("fragment %q spreads itself", sel.spread)
+			}
+			spreading[sel.spread] = true
+			err := e.validate(frag.on, frag.sel, spreading)
+			delete(spreading, sel.spread)
+			if err != nil {
+				return err
+			}
+		case sel.inline:
+			on := sel.on
+			if on == "" {
+				on = typ
+			}
+			if err := e.validate(on, sel.sel, spreading); err != nil {
+				return err
+			}
+		default:
+			if sel.name == "__typename" {
+				continue
+			}
+			fields, ok := graphqlTypes[typ]
+			if !ok {
+				return fmt.Errorf("unknown type %q", typ)
+			}
+			field, ok := fields[sel.name]
+			if !ok {
+				return fmt.Errorf("cannot query field %q on type %s", sel.name, typ)
+			}
+			for arg := range sel.args {
+				if _, ok := field.args[arg]; !ok {
+					return fmt.Errorf("unknown argument %q on field %s.%s", arg, typ, sel.name)
+				}
+			}
+			switch {
+			case field.object != "" && len(sel.sel) == 0:
+				return fmt.Errorf("field %s.%s of type %s needs a selection of subfields", typ, sel.name, field.typ)
+			case field.object == "" && len(sel.sel) > 0:
+				return fmt.Errorf("field %s.%s of type %s has no subfields", typ, sel.name, field.typ)
+			case field.object != "":
+				if err := e.validate(field.object, sel.sel, spreading); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// collect flattens the fragments of a selection set for an object of typ,
+// leaving out skipped fields and repeated response keys
+func (e *graphqlExecutor) collect(typ string, sels []*graphqlSelection, seen map[string]bool, out []*graphqlSelection) []*graphqlSelection {
+	for _, sel := range sels {
+		if !e.included(sel) {
+			continue
+		}
+		switch {
+		case sel.spread != "":
+			frag := e.doc.fragments[sel.spread]
+			if frag.on == typ {
+				out = e.collect(typ, frag.sel, seen, out)
+			}
+		case sel.inline:
+			if sel.on == "" || sel.on == typ {
+				out = e.collect(typ, sel.sel, seen, out)
+			}
+		case !seen[sel.responseKey()]:
+			seen[sel.responseKey()] = true
+			out = append(out, sel)
+		}
+	}
+	return out
+}
+
+// included applies the @skip and @include directives
+func (e *graphqlExecutor) included(sel *graphqlSelection) bool {
+	if args, ok := sel.directives["skip"]; ok {
+		if skip, _ := e.resolve(args["if"]).(bool); skip {
+			return false
+		}
+	}
+	if args, ok := sel.directives["include"]; ok {
+		include, _ := e.resolve(args["if"]).(bool)
+		return include
+	}
+	return true
+}
+
+// resolve substitutes the variables of a value
+func (e *graphqlExecutor) resolve(v any) any {
+	switch v := v.(type) {
+	case graphqlVariable:
+		return e.vars[string(v)]
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = e.resolve(item)
+		}
+		return out
+	}
+	return v
+}
+
+// stringArg returns a String argument of a field, or def
+func (e *graphqlExecutor) stringArg(sel *graphqlSelection, name, def string) (string, error) {
+	switch v := e.resolve(sel.args[name]).(type) {
+	case nil:
+		return def, nil
+	case string:
+		return v, nil
+	}
+	return "", fmt.Errorf("argument %q of %s must be a String", name, sel.name)
+}
+
+// intArg returns an Int argument of a field, or def
+func (e *graphqlExecutor) intArg(sel *graphqlSelection, name string, def int) (int, error) {
+	switch v := e.resolve(sel.args[name]).(type) {
+	case nil:
+		return def, nil
+	case int64:
+		if v >= math.MinInt32 && v <= math.MaxInt32 {
+			return int(v), nil
+		}
+	case float64:
+		// Variables decoded from JSON
+		if v == math.Trunc(v) && v >= math.MinInt32 && v <= math.MaxInt32 {
+			return int(v), nil
+		}
+	}
+	return 0, fmt.Errorf("argument %q of %s must be an Int", name, sel.name)
+}
+
+// boolArg returns a Boolean argument of a field, or def
+func (e *graphqlExecutor) boolArg(sel *graphqlSelection, name string, def bool) (bool, error) {
+	switch v := e.resolve(sel.args[name]).(type) {
+	case nil:
+		return def, nil
+	case bool:
+		return v, nil
+	}
+	return false, fmt.Errorf("argument %q of %s must be a Boolean", name, sel.name)
+}
+
+// graphqlFile is a File object being resolved
+type graphqlFile struct {
+	path string
+	info fs.FileInfo
+}
+
+// graphqlObject is a response object, keeping the order of its fields
+type graphqlObject struct {
+	keys   []string
+	values []any
+}
+
+// MarshalJSON writes the fields in selection order
+func (o *graphqlObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		b.Write(k)
+		b.WriteByte(':')
+		v, err := json.Marshal(o.values[i])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// resolveObject resolves the selections of a Query or File object.
+// Failing fields are reported in the errors and set to null; errors that
+// abort the whole query are returned.
+func (e *graphqlExecutor) resolveObject(typ string, file *graphqlFile, sels []*graphqlSelection, at []any) (*graphqlObject, error) {
+	obj := &graphqlObject{}
+	for _, sel := range e.collect(typ, sels, make(map[string]bool), nil) {
+		fieldPath := append(append([]any(nil), at...), sel.responseKey())
+		var v any
+		var err error
+		if sel.name == "__typename" {
+			v = typ
+		} else if typ == "Query" {
+			v, err = e.resolveQueryField(sel, fieldPath)
+		} else {
+			v, err = e.resolveFileField(file, sel, fieldPath)
+		}
+		var fieldErr *graphqlFieldError
+		if errors.As(err, &fieldErr) {
+			e.errors = append(e.errors, graphqlError{Message: fieldErr.msg, Path: fieldPath})
+			v, err = nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		obj.keys = append(obj.keys, sel.responseKey())
+		obj.values = append(obj.values, v)
+	}
+	return obj, nil
+}
+
+// graphqlFieldError is an error of a single field, which becomes null
+type graphqlFieldError struct {
+	msg string
+}
+
+func (e *graphqlFieldError) Error() string { return e.msg }
+
+// fieldError wraps err as an error of the field being resolved
+func fieldError(err error) error {
+	return &graphqlFieldError{msg: err.Error()}
+}
+
+// resolveQueryField resolves a field of the Query type
+func (e *graphqlExecutor) resolveQueryField(sel *graphqlSelection, at []any) (any, error) {
+	name, err := e.stringArg(sel, "path", "/")
+	if err != nil {
+		return nil, fieldError(err)
+	}
+	name = path.Clean("/" + name)
+	if sel.name == "file" {
+		file, err := e.stat(name)
+		if err != nil || file == nil {
+			return nil, err
+		}
+		return e.resolveObject("File", file, sel.sel, at)
+	}
+
+	pattern, err := e.stringArg(sel, "pattern", "")
+	if err != nil {
+		return nil, fieldError(err)
+	}
+	recursive, err := e.boolArg(sel, "recursive", false)
+	if err != nil {
+		return nil, fieldError(err)
+	}
+	limit, err := e.intArg(sel, "limit", 1000)
+	if err != nil {
+		return nil, fieldError(err)
+	}
+	var files []*graphqlFile
+	queue := []string{name}
+	for len(queue) > 0 && len(files) < limit {
+		dir := queue[0]
+		queue = queue[1:]
+		entries, err := e.readDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if recursive && entry.info.IsDir() {
+				queue = append(queue, entry.path)
+			}
+			if match, err := nameMatches(pattern, entry.info.Name()); err != nil {
+				return nil, fieldError(err)
+			} else if match && len(files) < limit {
+				files = append(files, entry)
+			}
+		}
+	}
+	return e.resolveList(files, sel, at)
+}
+
+// nameMatches matches a file name against an optional glob pattern
+func nameMatches(pattern, name string) (bool, error) {
+	if pattern == "" {
+		return true, nil
+	}
+	ok, err := path.Match(pattern, name)
+	if err != nil {
+		return false, fmt.Errorf("invalid pattern %q", pattern)
+	}
+	return ok, nil
+}
+
+// resolveList resolves the selections of every file of a list
+func (e *graphqlExecutor) resolveList(files []*graphqlFile, sel *graphqlSelection, at []any) (any, error) {
+	list := make([]any, len(files))
+	for i, file := range files {
+		obj, err := e.resolveObject("File", file, sel.sel, append(append([]any(nil), at...), i))
+		if err != nil {
+			return nil, err
+		}
+		list[i] = obj
+	}
+	return list, nil
+}
+
+// resolveFileField resolves a field of the File type
+func (e *graphqlExecutor) resolveFileField(file *graphqlFile, sel *graphqlSelection, at []any) (any, error) {
+	switch sel.name {
+	case "name":
+		if file.path == "/" {
+			return "/", nil
+		}
+		return file.info.Name(), nil
+	case "path":
+		return file.path, nil
+	case "size":
+		if file.info.IsDir() {
+			return int64(0), nil
+		}
+		return file.info.Size(), nil
+	case "isDir":
+		return file.info.IsDir(), nil
+	case "modTime":
+		return file.info.ModTime().UTC().Format(time.RFC3339), nil
+	case "contentType":
+		if file.info.IsDir() {
+			return nil, nil
+		}
+		if contentType := mime.TypeByExtension(path.Ext(file.path)); contentType != "" {
+			return contentType, nil
+		}
+		return "application/octet-stream", nil
+	case "sha256":
+		if file.info.IsDir() {
+			return nil, nil
+		}
+		return e.checksum(file.path)
+	case "children":
+		if !file.info.IsDir() {
+			return nil, nil
+		}
+		pattern, err := e.stringArg(sel, "pattern", "")
+		if err != nil {
+			return nil, fieldError(err)
+		}
+		limit, err := e.intArg(sel, "limit", -1)
+		if err != nil {
+			return nil, fieldError(err)
+		}
+		offset, err := e.intArg(sel, "offset", 0)
+		if err != nil {
+			return nil, fieldError(err)
+		}
+		entries, err := e.readDir(file.path)
+		if err != nil {
+			return nil, err
+		}
+		var files []*graphqlFile
+		for _, entry := range entries {
+			match, err := nameMatches(pattern, entry.info.Name())
+			if err != nil {
+				return nil, fieldError(err)
+			}
+			if match {
+				files = append(files, entry)
+			}
+		}
+		files = files[min(max(offset, 0), len(files)):]
+		if limit >= 0 && limit < len(files) {
+			files = files[:limit]
+		}
+		return e.resolveList(files, sel, at)
+	}
+	return nil, fmt.Errorf("cannot query field %q on type File", sel.name)
+}
+
+// count accounts for visited entries, aborting queries that visit too many
+func (e *graphqlExecutor) count(n int) error {
+	e.nodes += n
+	if e.nodes > graphqlMaxNodes {
+		return fmt.Errorf("the query visits more than %d entries, narrow it down", graphqlMaxNodes)
+	}
+	return nil
+}
+
+// hidden reports whether a path is kept out of reach, as in listings
+func (e *graphqlExecutor) hidden(name string) bool {
+	return isTrashPath(name) || isMaintenancePath(name) || e.h.mirror != nil && isMirrorPath(name)
+}
+
+// stat returns the file at name, or nil when there is none
+func (e *graphqlExecutor) stat(name string) (*graphqlFile, error) {
+	if err := e.count(1); err != nil {
+		return nil, err
+	}
+	if e.hidden(name) {
+		return nil, nil
+	}
+	f, err := e.h.root.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fieldError(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fieldError(err)
+	}
+	return &graphqlFile{path: name, info: info}, nil
+}
+
+// readDir returns the visible entries of a directory sorted by name
+func (e *graphqlExecutor) readDir(dir string) ([]*graphqlFile, error) {
+	f, err := e.h.root.Open(dir)
+	if err != nil {
+		return nil, fieldError(err)
+	}
+	defer f.Close()
+	infos, err := f.Readdir(-1)
+	if err != nil {
+		return nil, fieldError(err)
+	}
+	if err := e.count(len(infos)); err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	files := make([]*graphqlFile, 0, len(infos))
+	for _, info := range infos {
+		if hiddenEntry(dir, info.Name()) {
+			continue
+		}
+		files = append(files, &graphqlFile{path: path.Join(dir, info.Name()), info: info})
+	}
+	return files, nil
+}
+
+// checksum hashes the contents of a file
+func (e *graphqlExecutor) checksum(name string) (any, error) {
+	sum, err := fileChecksum(e.h.root, name)
+	if err != nil {
+		return nil, fieldError(err)
+	}
+	return sum, nil
+}
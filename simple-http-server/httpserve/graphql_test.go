@@ -0,0 +1,86 @@
+package httpserve
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseGraphQL(t *testing.T) {
+	doc, err := parseGraphQL(`query Files($dir: String = "/", $tags: [String!]) {
+		list: directory(path: $dir, sort: NAME, filter: {ext: [".md", ".txt"], min: 1.5}) @include(if: true) {
+			entries { name size ...meta }
+		}
+	}
+	fragment meta on File { modified }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.operations) != 1 || doc.fragments["meta"] == nil {
+		t.Fatalf("got %d operations and fragments %v", len(doc.operations), doc.fragments)
+	}
+	op := doc.operations[0]
+	if op.kind != "query" || op.name != "Files" || len(op.vars) != 2 {
+		t.Fatalf("got operation %q %q with %d variables", op.kind, op.name, len(op.vars))
+	}
+	if op.vars[0].def != "/" || op.vars[1].typ != "[String!]" {
+		t.Errorf("got variables %+v", op.vars)
+	}
+	field := op.sel[0]
+	if field.alias != "list" || field.name != "directory" || field.responseKey() != "list" {
+		t.Errorf("got field %q aliased %q", field.name, field.alias)
+	}
+	if field.args["path"] != graphqlVariable("dir") || field.args["sort"] != graphqlEnum("NAME") {
+		t.Errorf("got arguments %v", field.args)
+	}
+	filter, ok := field.args["filter"].(map[string]any)
+	if !ok || len(filter["ext"].([]any)) != 2 || filter["min"] != 1.5 {
+		t.Errorf("got filter %v", field.args["filter"])
+	}
+	if field.directives["include"]["if"] != true {
+		t.Errorf("got directives %v", field.directives)
+	}
+	entries := field.sel[0].sel
+	if len(entries) != 3 || entries[2].spread != "meta" {
+		t.Errorf("got entries %+v", entries)
+	}
+}
+
+func TestParseGraphQLErrors(t *testing.T) {
+	tests := []struct {
+		name, query, want string
+	}{
+		{"empty", "", "no operation"},
+		{"unclosed", "{ directory { name }", "expected"},
+		{"unterminated string", `{ file(path: "/a) { name } }`, "syntax error"},
+		{"missing value", "{ file(path: ) { name } }", "expected a value"},
+		{"variable in constant", "query($a: Int = $b) { file { name } }", "expected a value"},
+		{"bad integer", "{ file(limit: 99999999999999999999) { name } }", "invalid integer"},
+		{"stray token", "} {", "unexpected"},
+		{"deep selections", strings.Repeat("{ a ", graphqlMaxDepth+1) + strings.Repeat("}", graphqlMaxDepth+1), "selections are nested"},
+		{"deep lists", "{ a(v: " + strings.Repeat("[", graphqlMaxDepth) + strings.Repeat("]", graphqlMaxDepth) + ") }", "values are nested"},
+		{"deep objects", "{ a(v: " + strings.Repeat("{k: ", graphqlMaxDepth) + "1" + strings.Repeat("}", graphqlMaxDepth) + ") }", "values are nested"},
+		{"deep type", "query($v: " + strings.Repeat("[", graphqlMaxDepth+1) + "Int" + strings.Repeat("]", graphqlMaxDepth+1) + ") { a }", "types are nested"},
+		// Stops at the limit rather than recursing through the whole body
+		{"huge list", "{ a(v: " + strings.Repeat("[", 500000) + ") }", "values are nested"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseGraphQL(tt.query)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseGraphQLDepthLimit(t *testing.T) {
+	selections := strings.Repeat("{ a ", graphqlMaxDepth) + strings.Repeat("}", graphqlMaxDepth)
+	if _, err := parseGraphQL(selections); err != nil {
+		t.Errorf("selections %d levels deep: %v", graphqlMaxDepth, err)
+	}
+	// The field holding the argument is at depth 1
+	list := "{ a(v: " + strings.Repeat("[", graphqlMaxDepth-1) + strings.Repeat("]", graphqlMaxDepth-1) + ") }"
+	if _, err := parseGraphQL(list); err != nil {
+		t.Errorf("lists %d levels deep: %v", graphqlMaxDepth-1, err)
+	}
+}
@@ -0,0 +1,521 @@
+package httpserve
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// grpcServicePrefix is the path prefix of the FileService methods defined
+// in fileservice.proto
+const grpcServicePrefix = "/simplehttpserver.v1.FileService/"
+
+// gRPC status codes returned by the file service
+const (
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcAlreadyExists      = 6
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+// grpcMaxMessage bounds the size of a received message, and grpcChunkSize
+// is the size of the chunks sent by Download
+const (
+	grpcMaxMessage = 4 << 20
+	grpcChunkSize  = 64 << 10
+)
+
+// grpcError is a failed call with its gRPC status
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string { return e.msg }
+
+// grpcErrorf returns a grpcError with a formatted message
+func grpcErrorf(code int, format string, args ...any) error {
+	return &grpcError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// grpcService serves the FileService over HTTP/2 from the same tree, with
+// the same credentials and upload rules as the HTTP handler. The messages
+// are few and flat, so they are encoded by hand rather than generated, and
+// grpc_test.go checks their field numbers against fileservice.proto.
+type grpcService struct {
+	h     *fileHandler
+	creds credentials
+}
+
+// handles reports whether a request is a call of the file service
+func (s *grpcService) handles(r *http.Request) bool {
+	return s != nil && strings.HasPrefix(r.URL.Path, grpcServicePrefix) &&
+		strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// ServeHTTP runs a call and reports its status in the trailers
+func (s *grpcService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || r.Method != http.MethodPost {
+		http.Error(w, "gRPC requires HTTP/2 POST requests", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	stream := &grpcStream{w: w, r: r, rc: http.NewResponseController(w)}
+	method := strings.TrimPrefix(r.URL.Path, grpcServicePrefix)
+
+	var err error
+	authed, ok := r, len(s.creds) == 0
+	if !ok {
+		authed, ok = s.creds.authenticate(r)
+	}
+	if !ok {
+		err = grpcErrorf(grpcUnauthenticated, "valid basic auth credentials are required")
+	} else {
+		stream.r = authed
+		switch method {
+		case "List":
+			err = s.list(stream)
+		case "Stat":
+			err = s.stat(stream)
+		case "Download":
+			err = s.download(stream)
+		case "Upload":
+			err = s.upload(stream)
+		default:
+			err = grpcErrorf(grpcUnimplemented, "unknown method %s", method)
+		}
+	}
+
+	code, msg := grpcOK, ""
+	var gerr *grpcError
+	switch {
+	case errors.As(err, &gerr):
+		code, msg = gerr.code, gerr.msg
+	case err != nil:
+		code, msg = grpcInternal, err.Error()
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set("Grpc-Message", grpcEncodeMessage(msg))
+	}
+	s.h.log.logf("gRPC %s %s %d (%s)", method, stream.path, code, RequestUser(stream.r))
+}
+
+// grpcEncodeMessage percent-encodes a status message as the protocol
+// requires
+func grpcEncodeMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// grpcStream reads and writes the length-prefixed messages of a call
+type grpcStream struct {
+	w    http.ResponseWriter
+	r    *http.Request
+	rc   *http.ResponseController
+	path string
+}
+
+// recv returns the next message, or io.EOF once the client is done
+func (s *grpcStream) recv() ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(s.r.Body, header[:]); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, grpcErrorf(grpcInvalidArgument, "reading request: %v", err)
+	}
+	if header[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > grpcMaxMessage {
+		return nil, grpcErrorf(grpcResourceExhausted, "message of %d bytes exceeds the limit of %d", size, grpcMaxMessage)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(s.r.Body, msg); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "reading request: %v", err)
+	}
+	return msg, nil
+}
+
+// recvOne returns the only message of a unary call
+func (s *grpcStream) recvOne() ([]byte, error) {
+	msg, err := s.recv()
+	if err == io.EOF {
+		return nil, grpcErrorf(grpcInvalidArgument, "missing request message")
+	}
+	return msg, err
+}
+
+// send writes a message and flushes it to the client
+func (s *grpcStream) send(msg []byte) error {
+	frame := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg)))
+	if _, err := s.w.Write(append(frame, msg...)); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+// resolve cleans the path of a request message, keeping the hidden
+// directories of the server out of reach
+func (s *grpcService) resolve(stream *grpcStream, name string) (string, error) {
+	stream.path = path.Clean("/" + name)
+	if isTrashPath(stream.path) || isMaintenancePath(stream.path) || s.h.mirror != nil && isMirrorPath(stream.path) {
+		return "", grpcErrorf(grpcNotFound, "%s not found", stream.path)
+	}
+	return stream.path, nil
+}
+
+// openError converts a file system error to a gRPC one
+func openError(name string, err error) error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return grpcErrorf(grpcNotFound, "%s not found", name)
+	case errors.Is(err, fs.ErrPermission):
+		return grpcErrorf(grpcPermissionDenied, "%s is not readable", name)
+	}
+	return err
+}
+
+// fileInfoMessage encodes a FileInfo message
+func fileInfoMessage(name string, info fs.FileInfo) []byte {
+	var msg []byte
+	msg = protoAppendString(msg, 1, info.Name())
+	msg = protoAppendString(msg, 2, name)
+	msg = protoAppendVarint(msg, 3, uint64(info.Size()))
+	if info.IsDir() {
+		msg = protoAppendVarint(msg, 4, 1)
+	} else if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		msg = protoAppendString(msg, 6, contentType)
+	}
+	return protoAppendVarint(msg, 5, uint64(info.ModTime().Unix()))
+}
+
+// pathRequest decodes the path field shared by the List and Stat requests
+func pathRequest(msg []byte) (string, error) {
+	var name string
+	err := protoDecode(msg, func(field int, _ uint64, data []byte) {
+		if field == 1 {
+			name = string(data)
+		}
+	})
+	return name, err
+}
+
+// stat implements Stat
+func (s *grpcService) stat(stream *grpcStream) error {
+	msg, err := stream.recvOne()
+	if err != nil {
+		return err
+	}
+	name, err := pathRequest(msg)
+	if err != nil {
+		return err
+	}
+	if name, err = s.resolve(stream, name); err != nil {
+		return err
+	}
+	f, err := s.h.root.Open(name)
+	if err != nil {
+		return openError(name, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return stream.send(fileInfoMessage(name, info))
+}
+
+// list implements List
+func (s *grpcService) list(stream *grpcStream) error {
+	msg, err := stream.recvOne()
+	if err != nil {
+		return err
+	}
+	name, err := pathRequest(msg)
+	if err != nil {
+		return err
+	}
+	if name, err = s.resolve(stream, name); err != nil {
+		return err
+	}
+	f, err := s.h.root.Open(name)
+	if err != nil {
+		return openError(name, err)
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || !info.IsDir() {
+		return grpcErrorf(grpcFailedPrecondition, "%s is not a directory", name)
+	}
+	entries, err := f.Readdir(-1)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	var resp []byte
+	for _, entry := range entries {
+		if hiddenEntry(name, entry.Name()) {
+			continue
+		}
+		resp = protoAppendBytes(resp, 1, fileInfoMessage(path.Join(name, entry.Name()), entry))
+	}
+	return stream.send(resp)
+}
+
+// download implements Download
+func (s *grpcService) download(stream *grpcStream) error {
+	msg, err := stream.recvOne()
+	if err != nil {
+		return err
+	}
+	var name string
+	var offset, length int64
+	err = protoDecode(msg, func(field int, v uint64, data []byte) {
+		switch field {
+		case 1:
+			name = string(data)
+		case 2:
+			offset = int64(v)
+		case 3:
+			length = int64(v)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if offset < 0 || length < 0 {
+		return grpcErrorf(grpcInvalidArgument, "offset and length cannot be negative")
+	}
+	if name, err = s.resolve(stream, name); err != nil {
+		return err
+	}
+	f, err := s.h.root.Open(name)
+	if err != nil {
+		return openError(name, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return grpcErrorf(grpcFailedPrecondition, "%s is a directory", name)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	var src io.Reader = f
+	if length > 0 {
+		src = io.LimitReader(f, length)
+	}
+	buf := make([]byte, grpcChunkSize)
+	for {
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			chunk := protoAppendBytes(nil, 1, buf[:n])
+			if sendErr := stream.send(protoAppendVarint(chunk, 2, uint64(offset))); sendErr != nil {
+				return sendErr
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// uploadStream reads the data of the UploadRequest messages of a call,
+// failing once more than maxSize bytes arrive when it is set
+type uploadStream struct {
+	stream   *grpcStream
+	buf      []byte
+	received int64
+	maxSize  int64
+}
+
+func (u *uploadStream) Read(p []byte) (int, error) {
+	if u.maxSize > 0 && u.received+int64(len(u.buf)) > u.maxSize {
+		return 0, errUploadTooLarge
+	}
+	for len(u.buf) == 0 {
+		msg, err := u.stream.recv()
+		if err != nil {
+			return 0, err
+		}
+		if err := protoDecode(msg, func(field int, _ uint64, data []byte) {
+			if field == 2 {
+				u.buf = append(u.buf, data...)
+			}
+		}); err != nil {
+			return 0, err
+		}
+	}
+	if u.maxSize > 0 && u.received+int64(len(u.buf)) > u.maxSize {
+		return 0, errUploadTooLarge
+	}
+	n := copy(p, u.buf)
+	u.buf = u.buf[n:]
+	u.received += int64(n)
+	return n, nil
+}
+
+// upload implements Upload, storing the file like a PUT request would
+func (s *grpcService) upload(stream *grpcStream) error {
+	if !s.h.upload.enabled {
+		return grpcErrorf(grpcPermissionDenied, "uploads are disabled, start the server with --upload")
+	}
+	msg, err := stream.recvOne()
+	if err != nil {
+		return err
+	}
+	src := &uploadStream{stream: stream, maxSize: s.h.upload.maxSize}
+	var name string
+	err = protoDecode(msg, func(field int, _ uint64, data []byte) {
+		switch field {
+		case 1:
+			name = string(data)
+		case 2:
+			src.buf = append(src.buf, data...)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if name == "" || strings.HasSuffix(name, "/") {
+		return grpcErrorf(grpcInvalidArgument, "the first message needs the path of a file")
+	}
+	if name, err = s.resolve(stream, name); err != nil {
+		return err
+	}
+	target := s.h.localPath(name)
+	n, _, err := s.h.storeFile(target, "", src)
+	if err != nil {
+		s.h.log.logf("Upload of %s from %s failed: %v", name, stream.r.RemoteAddr, err)
+		return uploadError(err)
+	}
+	s.h.log.logf("Uploaded %s (%d bytes) from %s", name, n, stream.r.RemoteAddr)
+	s.h.webhook.notify(stream.r, eventUpload, name, n)
+	info, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	return stream.send(fileInfoMessage(name, info))
+}
+
+// uploadError converts an upload failure to a gRPC error
+func uploadError(err error) error {
+	var gerr *grpcError
+	var se *storageError
+	switch {
+	case errors.As(err, &gerr):
+		return err
+	case errors.As(err, &se):
+		return grpcErrorf(grpcResourceExhausted, "%v", err)
+	case errors.Is(err, errUploadExists):
+		return grpcErrorf(grpcAlreadyExists, "%v", err)
+	}
+	switch uploadStatus(err) {
+	case http.StatusConflict, http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity:
+		return grpcErrorf(grpcFailedPrecondition, "%v", err)
+	case http.StatusRequestEntityTooLarge:
+		return grpcErrorf(grpcResourceExhausted, "%v", err)
+	case http.StatusBadRequest:
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	case http.StatusServiceUnavailable:
+		return grpcErrorf(grpcUnavailable, "%v", err)
+	}
+	return err
+}
+
+// protoAppendVarint appends a varint field
+func protoAppendVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+// protoAppendBytes appends a length-delimited field
+func protoAppendBytes(b []byte, field int, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// protoAppendString appends a string field, leaving out empty ones
+func protoAppendString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return protoAppendBytes(b, field, []byte(s))
+}
+
+// protoDecode calls fn with the number and value of every varint and
+// length-delimited field of a message, skipping fixed-size ones
+func protoDecode(msg []byte, fn func(field int, v uint64, data []byte)) error {
+	malformed := grpcErrorf(grpcInvalidArgument, "malformed request message")
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return malformed
+		}
+		msg = msg[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return malformed
+			}
+			msg = msg[n:]
+			fn(field, v, nil)
+		case 1:
+			if len(msg) < 8 {
+				return malformed
+			}
+			msg = msg[8:]
+		case 2:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || size > uint64(len(msg)-n) {
+				return malformed
+			}
+			fn(field, 0, msg[n:n+int(size)])
+			msg = msg[n+int(size):]
+		case 5:
+			if len(msg) < 4 {
+				return malformed
+			}
+			msg = msg[4:]
+		default:
+			return malformed
+		}
+	}
+	return nil
+}
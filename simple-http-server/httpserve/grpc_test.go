@@ -0,0 +1,124 @@
+package httpserve
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+// protoFields reads the field numbers of every message in
+// fileservice.proto, so the hand written encoders are checked against the
+// file clients generate their stubs from
+func protoFields(t *testing.T) map[string]map[string]int {
+	t.Helper()
+	src, err := os.ReadFile("fileservice.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := make(map[string]map[string]int)
+	field := regexp.MustCompile(`(?m)^\s*(?:repeated\s+)?\w+\s+(\w+)\s*=\s*(\d+);`)
+	for _, m := range regexp.MustCompile(`(?s)message (\w+) \{(.*?)\n\}`).FindAllStringSubmatch(string(src), -1) {
+		fields := make(map[string]int)
+		for _, f := range field.FindAllStringSubmatch(m[2], -1) {
+			fields[f[1]], _ = strconv.Atoi(f[2])
+		}
+		messages[m[1]] = fields
+	}
+	return messages
+}
+
+// grpcCall runs a call of the file service with a single request message
+// and returns the response messages with the status
+func grpcCall(t *testing.T, s *grpcService, method string, req []byte) ([][]byte, string) {
+	t.Helper()
+	body := append(binary.BigEndian.AppendUint32([]byte{0}, uint32(len(req))), req...)
+	r := httptest.NewRequest(http.MethodPost, grpcServicePrefix+method, bytes.NewReader(body))
+	r.ProtoMajor = 2
+	r.Header.Set("Content-Type", "application/grpc")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, r)
+	var msgs [][]byte
+	for b := rec.Body.Bytes(); len(b) >= 5; {
+		n := int(binary.BigEndian.Uint32(b[1:5]))
+		msgs = append(msgs, b[5:5+n])
+		b = b[5+n:]
+	}
+	return msgs, rec.Header().Get("Grpc-Status")
+}
+
+// protoFieldValues decodes msg by the names of its fields in fields
+func protoFieldValues(t *testing.T, msg []byte, fields map[string]int) map[string]any {
+	t.Helper()
+	names := make(map[int]string)
+	for name, n := range fields {
+		names[n] = name
+	}
+	values := make(map[string]any)
+	err := protoDecode(msg, func(field int, v uint64, data []byte) {
+		name, ok := names[field]
+		if !ok {
+			t.Errorf("field %d is not in fileservice.proto", field)
+		} else if data != nil {
+			values[name] = string(data)
+		} else {
+			values[name] = v
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return values
+}
+
+func TestGRPCFileService(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello, world"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h, err := newFileHandler(dir, siteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &grpcService{h: h}
+	proto := protoFields(t)
+
+	msgs, status := grpcCall(t, s, "Stat", protoAppendString(nil, proto["StatRequest"]["path"], "a.txt"))
+	if status != "0" || len(msgs) != 1 {
+		t.Fatalf("Stat: status %s with %d messages", status, len(msgs))
+	}
+	info := protoFieldValues(t, msgs[0], proto["FileInfo"])
+	if info["name"] != "a.txt" || info["path"] != "/a.txt" || info["size"] != uint64(12) || info["is_dir"] != nil {
+		t.Errorf("Stat: got %v", info)
+	}
+
+	msgs, status = grpcCall(t, s, "List", protoAppendString(nil, proto["ListRequest"]["path"], "/"))
+	if status != "0" || len(msgs) != 1 {
+		t.Fatalf("List: status %s with %d messages", status, len(msgs))
+	}
+	list := protoFieldValues(t, msgs[0], proto["ListResponse"])
+	if entry, _ := list["entries"].(string); protoFieldValues(t, []byte(entry), proto["FileInfo"])["name"] != "a.txt" {
+		t.Errorf("List: got %v", list)
+	}
+
+	req := protoAppendString(nil, proto["DownloadRequest"]["path"], "/a.txt")
+	req = protoAppendVarint(req, proto["DownloadRequest"]["offset"], 7)
+	req = protoAppendVarint(req, proto["DownloadRequest"]["length"], 3)
+	msgs, status = grpcCall(t, s, "Download", req)
+	if status != "0" || len(msgs) != 1 {
+		t.Fatalf("Download: status %s with %d messages", status, len(msgs))
+	}
+	chunk := protoFieldValues(t, msgs[0], proto["Chunk"])
+	if chunk["data"] != "wor" || chunk["offset"] != uint64(7) {
+		t.Errorf("Download: got %v", chunk)
+	}
+
+	if _, status := grpcCall(t, s, "Stat", protoAppendString(nil, 1, "missing")); status != strconv.Itoa(grpcNotFound) {
+		t.Errorf("Stat of a missing file: status %s", status)
+	}
+}
@@ -0,0 +1,326 @@
+package httpserve
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// siteOptions holds the settings shared by every served directory
+type siteOptions struct {
+	listing          listingOptions
+	ui               uiOptions
+	caseInsensitive  bool
+	autoIndex        string
+	download         downloadOptions
+	upload           uploadOptions
+	tus              *tusStore
+	allowDelete      bool
+	trashRetention   time.Duration
+	mirror           mirrorOptions
+	cache            *fileCache
+	mmap             *fileMapper
+	metaCacheEntries int
+	preindex         bool
+	storage          fs.FS
+	allowManage      bool
+	policy           pathPolicy
+	webdav           webdavOptions
+	quota            quotaOptions
+	scan             scanOptions
+	plugins          plugins
+	webhook          *webhookNotifier
+	graphql          bool
+	diff             bool
+	stats            time.Duration // retention of the bandwidth report, 0 without it
+	templates        templateOptions
+	ssi              bool
+	watch            bool
+	liveReload       bool
+	log              *serverLog
+}
+
+// mirrorOptions controls filling the served directory from an origin
+type mirrorOptions struct {
+	origin string
+	ttl    time.Duration
+}
+
+// webdavOptions controls the WebDAV endpoint
+type webdavOptions struct {
+	enabled  bool
+	prefix   string
+	readOnly bool
+}
+
+// fileHandler serves a single root directory with the custom listing and
+// error pages
+type fileHandler struct {
+	dir        string
+	storage    fs.FS
+	root       http.FileSystem
+	fileServer http.Handler
+	listing    listingOptions
+	ui         uiOptions
+	autoIndex  string
+	download   downloadOptions
+	upload     uploadOptions
+	tus        *tusStore
+	delete     bool
+	manage     bool
+	policy     pathPolicy
+	davPrefix  string
+	dav        http.Handler
+	quota      *quotaTracker
+	scan       scanOptions
+	plugins    plugins
+	webhook    *webhookNotifier
+	trash      *trashBin
+	cache      *fileCache
+	mmap       *fileMapper
+	index      *assetIndex
+	mirror     *mirror
+	graphql    bool
+	diff       bool
+	bandwidth  *bandwidthStats
+	clients    *clientStats
+	templates  templateOptions
+	ssi        *ssiProcessor
+	watch      bool
+	liveReload bool
+	watcher    *treeWatcher
+	log        *serverLog
+}
+
+// newFileHandler creates a fileHandler serving the given absolute directory,
+// or the remote storage in opts.storage named by dir
+func newFileHandler(dir string, opts siteOptions) (*fileHandler, error) {
+	var root http.FileSystem = http.Dir(dir)
+	storage := opts.storage
+	if storage != nil {
+		root = http.FS(storage)
+	} else {
+		storage = os.DirFS(dir)
+	}
+	if opts.metaCacheEntries > 0 {
+		cached, err := newMetaCacheFS(dir, opts.metaCacheEntries, opts.log)
+		if err != nil {
+			opts.log.logf("Metadata cache disabled for %s: %v", dir, err)
+		} else {
+			root = cached
+		}
+	}
+	if opts.caseInsensitive {
+		root = caseInsensitiveFS{fs: root}
+	}
+	h := &fileHandler{
+		dir:        dir,
+		storage:    storage,
+		root:       root,
+		fileServer: http.FileServer(root),
+		listing:    opts.listing,
+		ui:         opts.ui,
+		autoIndex:  opts.autoIndex,
+		download:   opts.download,
+		upload:     opts.upload,
+		tus:        opts.tus,
+		delete:     opts.allowDelete,
+		manage:     opts.allowManage,
+		policy:     opts.policy,
+		quota:      newQuotaTracker(dir, opts.quota),
+		scan:       opts.scan,
+		plugins:    opts.plugins,
+		webhook:    opts.webhook,
+		cache:      opts.cache,
+		mmap:       opts.mmap,
+		graphql:    opts.graphql,
+		diff:       opts.diff,
+		templates:  opts.templates,
+		log:        opts.log,
+	}
+	if opts.allowDelete && opts.trashRetention > 0 {
+		trash, err := newTrashBin(dir, opts.trashRetention, opts.log)
+		if err != nil {
+			return nil, fmt.Errorf("creating trash in %s: %v", dir, err)
+		}
+		h.trash = trash
+	}
+	mirror, err := newMirror(opts.mirror.origin, dir, opts.mirror.ttl, opts.log)
+	if err != nil {
+		return nil, fmt.Errorf("mirror options: %v", err)
+	}
+	h.mirror = mirror
+	if opts.ssi {
+		h.ssi = newSSIProcessor(root, opts.log)
+	}
+	if opts.stats > 0 {
+		h.bandwidth = newBandwidthStats(opts.stats)
+		h.clients = newClientStats(opts.stats)
+	}
+	if opts.watch || opts.liveReload {
+		watcher, err := newTreeWatcher(dir, opts.log)
+		if err != nil {
+			return nil, fmt.Errorf("watching %s: %v", dir, err)
+		}
+		h.watch, h.liveReload, h.watcher = opts.watch, opts.liveReload, watcher
+	}
+	if opts.preindex {
+		start := time.Now()
+		// The index can only be trusted while nothing but this server could
+		// change the tree and lookups match names exactly
+		writable := mirror != nil || opts.upload.enabled || opts.allowDelete || opts.allowManage || opts.tus != nil ||
+			(opts.webdav.enabled && !opts.webdav.readOnly)
+		index, err := buildAssetIndex(storage, !writable && !opts.caseInsensitive)
+		if err != nil {
+			return nil, fmt.Errorf("indexing %s: %v", dir, err)
+		}
+		h.index = index
+		opts.log.logf("Indexed %d paths in %s in %s", len(index.assets), dir, time.Since(start).Round(time.Millisecond))
+	}
+	if opts.webdav.enabled {
+		h.davPrefix = opts.webdav.prefix
+		h.dav = newWebDAVHandler(h, opts.webdav.prefix, opts.webdav.readOnly)
+	}
+	return h, nil
+}
+
+// ServeHTTP serves directory listings and files from the root directory
+func (h *fileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.dav != nil && (r.URL.Path+"/" == h.davPrefix || strings.HasPrefix(r.URL.Path, h.davPrefix)) {
+		h.dav.ServeHTTP(w, r)
+		return
+	}
+	if isTrashPath(r.URL.Path) || isMaintenancePath(r.URL.Path) || h.mirror != nil && isMirrorPath(r.URL.Path) {
+		renderError(w, r, http.StatusNotFound, h.ui)
+		return
+	}
+	if h.tus != nil && strings.HasPrefix(r.URL.Path, tusPrefix) {
+		h.serveTus(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, apiPrefix) {
+		h.serveAPI(w, r)
+		return
+	}
+	if h.liveReload && r.URL.Path == liveReloadPath {
+		h.serveLiveReload(w, r)
+		return
+	}
+	if h.liveReload && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		lw := &liveReloadWriter{ResponseWriter: w}
+		defer lw.finish(r)
+		w = lw
+	}
+	if h.watch && (r.URL.Path == watchPrefix || strings.HasPrefix(r.URL.Path, watchPrefix+"/")) {
+		h.serveWatch(w, r)
+		return
+	}
+	if h.graphql && r.URL.Path == graphqlPath {
+		h.serveGraphQL(w, r)
+		return
+	}
+	if h.diff && r.URL.Path == diffPath {
+		h.serveDiff(w, r)
+		return
+	}
+	if h.bandwidth != nil && r.URL.Path == statsTopPath {
+		h.serveBandwidth(w, r)
+		return
+	}
+	if h.clients != nil && r.URL.Path == statsClientsPath {
+		h.serveClients(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if h.bandwidth != nil {
+			defer h.bandwidth.recordResponse(r)
+		}
+		if h.clients != nil {
+			h.clients.recordRequest(r)
+		}
+		if h.download.forced(r) {
+			w, r = h.download.wrap(w, r)
+		}
+	case http.MethodPut:
+		if !h.upload.enabled {
+			renderError(w, r, http.StatusMethodNotAllowed, h.ui)
+			return
+		}
+		h.servePut(w, r)
+		return
+	case http.MethodPost:
+		if h.manage && r.URL.Query().Has("mkdir") {
+			h.servePostMkdir(w, r)
+			return
+		}
+		if !h.upload.enabled {
+			renderError(w, r, http.StatusMethodNotAllowed, h.ui)
+			return
+		}
+		h.servePost(w, r)
+		return
+	case "MKCOL", "MOVE":
+		if !h.manage {
+			renderError(w, r, http.StatusMethodNotAllowed, h.ui)
+			return
+		}
+		if r.Method == "MKCOL" {
+			h.serveMkdir(w, r, strings.TrimSuffix(r.URL.Path, "/"))
+			return
+		}
+		h.serveMove(w, r)
+		return
+	case http.MethodDelete:
+		if h.delete {
+			h.serveDelete(w, r)
+			return
+		}
+		renderError(w, r, http.StatusMethodNotAllowed, h.ui)
+		return
+	default:
+		renderError(w, r, http.StatusMethodNotAllowed, h.ui)
+		return
+	}
+	if h.mirror != nil && h.serveMirrored(w, r) {
+		return
+	}
+	if h.templates.enabled && h.serveTemplate(w, r) {
+		return
+	}
+	if h.ssi != nil && h.serveSSI(w, r) {
+		return
+	}
+	if h.autoIndex == autoIndexVirtual && serveVirtualIndex(w, r, h.root, h.listing) {
+		return
+	}
+	if serveDirListing(w, r, h.root, h.listing) {
+		return
+	}
+	if h.index != nil && h.serveIndexed(w, r) {
+		return
+	}
+	if h.cache != nil && h.serveCached(w, r) {
+		return
+	}
+	if h.mmap != nil && h.serveMapped(w, r) {
+		return
+	}
+	h.fileServer.ServeHTTP(&errorPageWriter{ResponseWriter: w, r: r, ui: h.ui}, r)
+}
+
+// resolveDir returns the absolute path of dir, checking that it exists
+func resolveDir(dir string) (string, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("error resolving directory path: %v", err)
+	}
+	if _, err := os.Stat(absDir); os.IsNotExist(err) {
+		return "", fmt.Errorf("directory does not exist: %s", absDir)
+	}
+	return absDir, nil
+}
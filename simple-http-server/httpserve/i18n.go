@@ -0,0 +1,355 @@
+package httpserve
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// catalog holds the translated UI strings for a single language
+type catalog struct {
+	Lang     string
+	messages map[string]string
+}
+
+// T returns the translation for key, formatted with args and falling back
+// to English when the language has no entry for it
+func (c catalog) T(key string, args ...any) string {
+	msg, ok := c.messages[key]
+	if !ok {
+		msg, ok = catalogs["en"].messages[key]
+	}
+	if !ok {
+		return key
+	}
+	if len(args) == 0 {
+		return msg
+	}
+	return fmt.Sprintf(msg, args...)
+}
+
+// StatusText returns the translated reason phrase for an HTTP status code
+func (c catalog) StatusText(code int) string {
+	key := "status." + strconv.Itoa(code)
+	if _, ok := c.messages[key]; ok {
+		return c.T(key)
+	}
+	return http.StatusText(code)
+}
+
+// catalogs are the message catalogs available to the UI, keyed by language
+var catalogs = map[string]catalog{
+	"en": {Lang: "en", messages: map[string]string{
+		"listing.title":      "Index of %s",
+		"listing.name":       "Name",
+		"listing.size":       "Size",
+		"listing.modified":   "Modified",
+		"listing.previous":   "Previous",
+		"listing.next":       "Next",
+		"listing.page":       "Page %d of %d (%d entries)",
+		"listing.copy":       "Copy link",
+		"listing.copied":     "Copied!",
+		"listing.upload":     "Upload",
+		"listing.drop":       "Drop files here or choose them below",
+		"listing.failed":     "failed",
+		"listing.unsorted":   "Large directory: entries are shown unsorted, in the order stored on disk.",
+		"listing.range":      "Entries %d to %d",
+		"listing.more":       "Load more",
+		"ui.theme":           "Toggle dark mode",
+		"ui.readonly":        "Read-only",
+		"error.back":         "Back to the top",
+		"error.quota":        "The upload quota of this share is exhausted.",
+		"error.dirquota":     "The upload quota of this directory is exhausted.",
+		"error.diskfull":     "Not enough free disk space is left for this upload.",
+		"error.overloaded":   "The server is busy, please try again shortly.",
+		"error.throttled":    "Too many requests, please slow down and try again shortly.",
+		"error.maintenance":  "The server is down for maintenance, please try again later.",
+		"error.difflimit":    "The directories hold too many files to compare.",
+		"error.link":         "This link is invalid or has expired.",
+		"stats.title":        "Top paths by bandwidth, last %s",
+		"stats.path":         "Path",
+		"stats.bytes":        "Sent",
+		"stats.requests":     "Requests",
+		"stats.total":        "%s sent in %d requests",
+		"stats.empty":        "Nothing served in this window.",
+		"clients.title":      "Clients, last %s",
+		"clients.total":      "%d unique clients in %d requests, %d without a referrer from another site",
+		"clients.agents":     "Browsers and clients",
+		"clients.agent":      "Client",
+		"clients.bot":        "robot",
+		"clients.referers":   "Referring sites",
+		"clients.referer":    "Site",
+		"clients.noreferers": "No other site referred clients in this window.",
+		"diff.title":         "Differences between %s and %s",
+		"diff.added":         "Added",
+		"diff.removed":       "Removed",
+		"diff.changed":       "Changed",
+		"diff.summary":       "%d added, %d removed, %d changed, %d unchanged",
+		"diff.same":          "Both directories hold the same files.",
+	}},
+	"es": {Lang: "es", messages: map[string]string{
+		"listing.title":      "Índice de %s",
+		"listing.name":       "Nombre",
+		"listing.size":       "Tamaño",
+		"listing.modified":   "Modificado",
+		"listing.previous":   "Anterior",
+		"listing.next":       "Siguiente",
+		"listing.page":       "Página %d de %d (%d entradas)",
+		"listing.copy":       "Copiar enlace",
+		"listing.copied":     "¡Copiado!",
+		"listing.upload":     "Subir",
+		"listing.drop":       "Suelta archivos aquí o elígelos abajo",
+		"listing.failed":     "falló",
+		"listing.unsorted":   "Directorio grande: las entradas se muestran sin ordenar, en el orden del disco.",
+		"listing.range":      "Entradas %d a %d",
+		"listing.more":       "Cargar más",
+		"ui.theme":           "Cambiar modo oscuro",
+		"ui.readonly":        "Solo lectura",
+		"error.back":         "Volver al inicio",
+		"error.quota":        "Se agotó la cuota de subida de este recurso.",
+		"error.dirquota":     "Se agotó la cuota de subida de este directorio.",
+		"error.diskfull":     "No queda suficiente espacio libre en disco para esta subida.",
+		"error.overloaded":   "El servidor está ocupado, inténtalo de nuevo en breve.",
+		"error.throttled":    "Demasiadas solicitudes, espera un momento e inténtalo de nuevo.",
+		"error.maintenance":  "El servidor está en mantenimiento, inténtalo de nuevo más tarde.",
+		"error.difflimit":    "Los directorios contienen demasiados archivos para compararlos.",
+		"error.link":         "Este enlace no es válido o ha caducado.",
+		"stats.title":        "Rutas con más tráfico, últimas %s",
+		"stats.path":         "Ruta",
+		"stats.bytes":        "Enviado",
+		"stats.requests":     "Peticiones",
+		"stats.total":        "%s enviados en %d peticiones",
+		"stats.empty":        "No se sirvió nada en este periodo.",
+		"clients.title":      "Clientes, últimas %s",
+		"clients.total":      "%d clientes únicos en %d peticiones, %d sin referencia de otro sitio",
+		"clients.agents":     "Navegadores y clientes",
+		"clients.agent":      "Cliente",
+		"clients.bot":        "robot",
+		"clients.referers":   "Sitios de referencia",
+		"clients.referer":    "Sitio",
+		"clients.noreferers": "Ningún otro sitio envió clientes en este periodo.",
+		"diff.title":         "Diferencias entre %s y %s",
+		"diff.added":         "Añadidos",
+		"diff.removed":       "Eliminados",
+		"diff.changed":       "Modificados",
+		"diff.summary":       "%d añadidos, %d eliminados, %d modificados, %d sin cambios",
+		"diff.same":          "Ambos directorios contienen los mismos archivos.",
+		"status.400":         "Solicitud incorrecta",
+		"status.401":         "No autorizado",
+		"status.403":         "Prohibido",
+		"status.404":         "No encontrado",
+		"status.405":         "Método no permitido",
+		"status.500":         "Error interno del servidor",
+		"status.503":         "Servicio no disponible",
+		"status.507":         "Almacenamiento insuficiente",
+	}},
+	"pt": {Lang: "pt", messages: map[string]string{
+		"listing.title":      "Índice de %s",
+		"listing.name":       "Nome",
+		"listing.size":       "Tamanho",
+		"listing.modified":   "Modificado",
+		"listing.previous":   "Anterior",
+		"listing.next":       "Próxima",
+		"listing.page":       "Página %d de %d (%d itens)",
+		"listing.copy":       "Copiar link",
+		"listing.copied":     "Copiado!",
+		"listing.upload":     "Enviar",
+		"listing.drop":       "Solte arquivos aqui ou escolha-os abaixo",
+		"listing.failed":     "falhou",
+		"listing.unsorted":   "Diretório grande: os itens são exibidos sem ordenação, na ordem do disco.",
+		"listing.range":      "Itens %d a %d",
+		"listing.more":       "Carregar mais",
+		"ui.theme":           "Alternar modo escuro",
+		"ui.readonly":        "Somente leitura",
+		"error.back":         "Voltar ao início",
+		"error.quota":        "A cota de envio deste compartilhamento se esgotou.",
+		"error.dirquota":     "A cota de envio deste diretório se esgotou.",
+		"error.diskfull":     "Não há espaço livre em disco suficiente para este envio.",
+		"error.overloaded":   "O servidor está ocupado, tente novamente em instantes.",
+		"error.throttled":    "Solicitações demais, aguarde um pouco e tente novamente.",
+		"error.maintenance":  "O servidor está em manutenção, tente novamente mais tarde.",
+		"error.difflimit":    "Os diretórios contêm arquivos demais para comparar.",
+		"error.link":         "Este link é inválido ou expirou.",
+		"stats.title":        "Caminhos com mais tráfego, últimas %s",
+		"stats.path":         "Caminho",
+		"stats.bytes":        "Enviado",
+		"stats.requests":     "Requisições",
+		"stats.total":        "%s enviados em %d requisições",
+		"stats.empty":        "Nada foi servido neste período.",
+		"clients.title":      "Clientes, últimas %s",
+		"clients.total":      "%d clientes únicos em %d requisições, %d sem referência de outro site",
+		"clients.agents":     "Navegadores e clientes",
+		"clients.agent":      "Cliente",
+		"clients.bot":        "robô",
+		"clients.referers":   "Sites de referência",
+		"clients.referer":    "Site",
+		"clients.noreferers": "Nenhum outro site enviou clientes neste período.",
+		"diff.title":         "Diferenças entre %s e %s",
+		"diff.added":         "Adicionados",
+		"diff.removed":       "Removidos",
+		"diff.changed":       "Alterados",
+		"diff.summary":       "%d adicionados, %d removidos, %d alterados, %d inalterados",
+		"diff.same":          "Os dois diretórios contêm os mesmos arquivos.",
+		"status.400":         "Requisição inválida",
+		"status.401":         "Não autorizado",
+		"status.403":         "Proibido",
+		"status.404":         "Não encontrado",
+		"status.405":         "Método não permitido",
+		"status.500":         "Erro interno do servidor",
+		"status.503":         "Serviço indisponível",
+		"status.507":         "Armazenamento insuficiente",
+	}},
+	"fr": {Lang: "fr", messages: map[string]string{
+		"listing.title":      "Index de %s",
+		"listing.name":       "Nom",
+		"listing.size":       "Taille",
+		"listing.modified":   "Modifié",
+		"listing.previous":   "Précédent",
+		"listing.next":       "Suivant",
+		"listing.page":       "Page %d sur %d (%d entrées)",
+		"listing.copy":       "Copier le lien",
+		"listing.copied":     "Copié !",
+		"listing.upload":     "Téléverser",
+		"listing.drop":       "Déposez des fichiers ici ou choisissez-les ci-dessous",
+		"listing.failed":     "échec",
+		"listing.unsorted":   "Dossier volumineux : les entrées sont affichées sans tri, dans l'ordre du disque.",
+		"listing.range":      "Entrées %d à %d",
+		"listing.more":       "Charger plus",
+		"ui.theme":           "Basculer le mode sombre",
+		"ui.readonly":        "Lecture seule",
+		"error.back":         "Retour à l'accueil",
+		"error.quota":        "Le quota de téléversement de ce partage est épuisé.",
+		"error.dirquota":     "Le quota de téléversement de ce dossier est épuisé.",
+		"error.diskfull":     "Espace disque libre insuffisant pour ce téléversement.",
+		"error.overloaded":   "Le serveur est occupé, réessayez dans un instant.",
+		"error.throttled":    "Trop de requêtes, patientez un instant avant de réessayer.",
+		"error.maintenance":  "Le serveur est en maintenance, réessayez plus tard.",
+		"error.difflimit":    "Les répertoires contiennent trop de fichiers pour être comparés.",
+		"error.link":         "Ce lien est invalide ou a expiré.",
+		"stats.title":        "Chemins les plus consommateurs de bande passante, dernières %s",
+		"stats.path":         "Chemin",
+		"stats.bytes":        "Envoyé",
+		"stats.requests":     "Requêtes",
+		"stats.total":        "%s envoyés en %d requêtes",
+		"stats.empty":        "Rien n’a été servi sur cette période.",
+		"clients.title":      "Clients, dernières %s",
+		"clients.total":      "%d clients uniques en %d requêtes, %d sans référent d’un autre site",
+		"clients.agents":     "Navigateurs et clients",
+		"clients.agent":      "Client",
+		"clients.bot":        "robot",
+		"clients.referers":   "Sites référents",
+		"clients.referer":    "Site",
+		"clients.noreferers": "Aucun autre site n’a envoyé de clients sur cette période.",
+		"diff.title":         "Différences entre %s et %s",
+		"diff.added":         "Ajoutés",
+		"diff.removed":       "Supprimés",
+		"diff.changed":       "Modifiés",
+		"diff.summary":       "%d ajoutés, %d supprimés, %d modifiés, %d inchangés",
+		"diff.same":          "Les deux répertoires contiennent les mêmes fichiers.",
+		"status.400":         "Requête incorrecte",
+		"status.401":         "Non autorisé",
+		"status.403":         "Interdit",
+		"status.404":         "Introuvable",
+		"status.405":         "Méthode non autorisée",
+		"status.500":         "Erreur interne du serveur",
+		"status.503":         "Service indisponible",
+		"status.507":         "Espace de stockage insuffisant",
+	}},
+	"de": {Lang: "de", messages: map[string]string{
+		"listing.title":      "Inhalt von %s",
+		"listing.name":       "Name",
+		"listing.size":       "Größe",
+		"listing.modified":   "Geändert",
+		"listing.previous":   "Zurück",
+		"listing.next":       "Weiter",
+		"listing.page":       "Seite %d von %d (%d Einträge)",
+		"listing.copy":       "Link kopieren",
+		"listing.copied":     "Kopiert!",
+		"listing.upload":     "Hochladen",
+		"listing.drop":       "Dateien hier ablegen oder unten auswählen",
+		"listing.failed":     "fehlgeschlagen",
+		"listing.unsorted":   "Großes Verzeichnis: Einträge werden unsortiert in der Reihenfolge auf dem Datenträger angezeigt.",
+		"listing.range":      "Einträge %d bis %d",
+		"listing.more":       "Mehr laden",
+		"ui.theme":           "Dunkelmodus umschalten",
+		"ui.readonly":        "Schreibgeschützt",
+		"error.back":         "Zurück zum Anfang",
+		"error.quota":        "Das Upload-Kontingent dieser Freigabe ist erschöpft.",
+		"error.dirquota":     "Das Upload-Kontingent dieses Verzeichnisses ist erschöpft.",
+		"error.diskfull":     "Für diesen Upload ist nicht genügend freier Speicherplatz vorhanden.",
+		"error.overloaded":   "Der Server ist ausgelastet, bitte versuchen Sie es gleich noch einmal.",
+		"error.throttled":    "Zu viele Anfragen, bitte warten Sie kurz und versuchen Sie es dann erneut.",
+		"error.maintenance":  "Der Server wird gerade gewartet, bitte versuchen Sie es später noch einmal.",
+		"error.difflimit":    "Die Verzeichnisse enthalten zu viele Dateien für einen Vergleich.",
+		"error.link":         "Dieser Link ist ungültig oder abgelaufen.",
+		"stats.title":        "Pfade mit dem meisten Datenverkehr, letzte %s",
+		"stats.path":         "Pfad",
+		"stats.bytes":        "Gesendet",
+		"stats.requests":     "Anfragen",
+		"stats.total":        "%s gesendet in %d Anfragen",
+		"stats.empty":        "In diesem Zeitraum wurde nichts ausgeliefert.",
+		"clients.title":      "Clients, letzte %s",
+		"clients.total":      "%d eindeutige Clients in %d Anfragen, %d ohne Verweis von einer anderen Website",
+		"clients.agents":     "Browser und Clients",
+		"clients.agent":      "Client",
+		"clients.bot":        "Bot",
+		"clients.referers":   "Verweisende Websites",
+		"clients.referer":    "Website",
+		"clients.noreferers": "In diesem Zeitraum hat keine andere Website auf diese verwiesen.",
+		"diff.title":         "Unterschiede zwischen %s und %s",
+		"diff.added":         "Hinzugefügt",
+		"diff.removed":       "Entfernt",
+		"diff.changed":       "Geändert",
+		"diff.summary":       "%d hinzugefügt, %d entfernt, %d geändert, %d unverändert",
+		"diff.same":          "Beide Verzeichnisse enthalten dieselben Dateien.",
+		"status.400":         "Ungültige Anfrage",
+		"status.401":         "Nicht autorisiert",
+		"status.403":         "Verboten",
+		"status.404":         "Nicht gefunden",
+		"status.405":         "Methode nicht erlaubt",
+		"status.500":         "Interner Serverfehler",
+		"status.503":         "Dienst nicht verfügbar",
+		"status.507":         "Speicherplatz nicht ausreichend",
+	}},
+}
+
+// validateLang checks that a catalog exists for the default language
+func validateLang(lang string) error {
+	if _, ok := catalogs[lang]; !ok {
+		names := make([]string, 0, len(catalogs))
+		for name := range catalogs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unsupported language %q (available: %s)", lang, strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// negotiateCatalog picks the best catalog for the request's Accept-Language
+// header, falling back to the configured default language
+func negotiateCatalog(r *http.Request, fallback string) catalog {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		// Match on the primary language subtag, e.g. "pt" for "pt-BR"
+		primary, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		if _, ok := catalogs[primary]; ok && q > bestQ {
+			best, bestQ = primary, q
+		}
+	}
+	if best == "" {
+		best = fallback
+	}
+	return catalogs[best]
+}
@@ -0,0 +1,45 @@
+package httpserve
+
+import (
+	"path"
+	"strings"
+)
+
+// iconsByExt maps file extensions to the icon shown next to them in listings
+var iconsByExt = map[string]string{
+	".png": "🖼️", ".jpg": "🖼️", ".jpeg": "🖼️", ".gif": "🖼️", ".webp": "🖼️", ".svg": "🖼️", ".bmp": "🖼️", ".ico": "🖼️",
+	".mp3": "🎵", ".wav": "🎵", ".flac": "🎵", ".ogg": "🎵", ".m4a": "🎵",
+	".mp4": "🎬", ".mkv": "🎬", ".webm": "🎬", ".mov": "🎬", ".avi": "🎬",
+	".zip": "📦", ".tar": "📦", ".gz": "📦", ".tgz": "📦", ".bz2": "📦", ".xz": "📦", ".7z": "📦", ".rar": "📦",
+	".iso": "💿", ".img": "💿", ".dmg": "💿",
+	".pdf": "📕",
+	".doc": "📝", ".docx": "📝", ".odt": "📝", ".rtf": "📝",
+	".xls": "📊", ".xlsx": "📊", ".ods": "📊", ".csv": "📊",
+	".ppt": "📽️", ".pptx": "📽️", ".odp": "📽️",
+	".txt": "📄", ".md": "📄", ".log": "📄",
+	".go": "💻", ".c": "💻", ".h": "💻", ".py": "💻", ".js": "💻", ".ts": "💻", ".rs": "💻", ".java": "💻", ".sh": "💻",
+	".html": "🌐", ".htm": "🌐", ".css": "🌐",
+	".json": "🔧", ".yaml": "🔧", ".yml": "🔧", ".toml": "🔧", ".xml": "🔧", ".ini": "🔧",
+	".exe": "⚙️", ".msi": "⚙️", ".deb": "⚙️", ".rpm": "⚙️", ".apk": "⚙️",
+}
+
+// previewExts are the image types small enough to preview inline in browsers
+var previewExts = map[string]bool{
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true, ".svg": true, ".bmp": true, ".ico": true,
+}
+
+// fileIcon returns the icon for a listing entry
+func fileIcon(name string, isDir bool) string {
+	if isDir {
+		return "📁"
+	}
+	if icon, ok := iconsByExt[strings.ToLower(path.Ext(name))]; ok {
+		return icon
+	}
+	return "📄"
+}
+
+// isPreviewable reports whether the entry should get an inline image preview
+func isPreviewable(name string) bool {
+	return previewExts[strings.ToLower(path.Ext(name))]
+}
@@ -0,0 +1,97 @@
+package httpserve
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// copyChunkSize is how much of a file copyChunks sends at a time, each
+// chunk still going out with sendfile
+const copyChunkSize = 1 << 20
+
+// Ways a response body reached the client, reported by the debug log
+const (
+	bodyNone     = "none"
+	bodyWrite    = "write"
+	bodySendfile = "sendfile"
+	bodyBuffered = "buffered copy"
+)
+
+// bufferPool hands out copy buffers of a fixed size
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// newBufferPool returns a pool of buffers of size bytes
+func newBufferPool(size int) *bufferPool {
+	p := &bufferPool{size: size}
+	p.pool.New = func() any {
+		b := make([]byte, p.size)
+		return &b
+	}
+	return p
+}
+
+// copy writes src to dst through a pooled buffer
+func (p *bufferPool) copy(dst io.Writer, src io.Reader) (int64, error) {
+	b := p.pool.Get().(*[]byte)
+	defer p.pool.Put(b)
+	return io.CopyBuffer(writerOnly{dst}, src, *b)
+}
+
+// writerOnly hides a writer's ReadFrom method so io.CopyBuffer uses the
+// buffer it is given
+type writerOnly struct {
+	io.Writer
+}
+
+// isFileSource reports whether src is a file, or a section of one, that
+// net/http can hand to the kernel with sendfile
+func isFileSource(src io.Reader) bool {
+	if lr, ok := src.(*io.LimitedReader); ok {
+		src = lr.R
+	}
+	_, ok := src.(*os.File)
+	return ok
+}
+
+// readFrom copies src into w, keeping w's ReadFrom fast path when it has one
+func readFrom(w http.ResponseWriter, src io.Reader) (int64, error) {
+	if rf, ok := w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(writerOnly{w}, src)
+}
+
+// copyChunks copies src into w in chunks of copyChunkSize, keeping w's
+// ReadFrom fast path. Ahead of each chunk, next is told the bytes sent so
+// far and stops the copy by returning an error.
+func copyChunks(w http.ResponseWriter, src io.Reader, next func(sent int64) error) (int64, error) {
+	var n int64
+	inner, remaining := src, int64(math.MaxInt64)
+	lr, limited := src.(*io.LimitedReader)
+	if limited {
+		inner, remaining = lr.R, lr.N
+	}
+	for remaining > 0 {
+		if err := next(n); err != nil {
+			return n, err
+		}
+		chunk := &io.LimitedReader{R: inner, N: min(remaining, copyChunkSize)}
+		c, err := readFrom(w, chunk)
+		n += c
+		remaining -= c
+		if limited {
+			lr.N = remaining
+		}
+		if err != nil || chunk.N > 0 {
+			// An error, or the end of src before the end of the chunk
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,114 @@
+package httpserve
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// linkParam is the query parameter carrying a signed link token
+const linkParam = "link"
+
+// linkCookie keeps the token of a signed link once it was opened, so the
+// pages it leads to need no token of their own
+const linkCookie = "shs_link"
+
+// linkSigner signs and checks the expiring links of --link-secret
+type linkSigner struct {
+	secret []byte
+}
+
+func newLinkSigner(secret string) *linkSigner {
+	if secret == "" {
+		return nil
+	}
+	return &linkSigner{secret: []byte(secret)}
+}
+
+// token returns the token of a link valid until expires, as the expiry in
+// Unix seconds and its signature
+func (s *linkSigner) token(expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return exp + "." + s.sign(exp)
+}
+
+func (s *linkSigner) sign(exp string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(exp))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns when a token expires, if it is valid at now
+func (s *linkSigner) verify(token string, now time.Time) (time.Time, bool) {
+	exp, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(s.sign(exp))) {
+		return time.Time{}, false
+	}
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	expires := time.Unix(unix, 0)
+	return expires, now.Before(expires)
+}
+
+// ShareLink returns a URL of the site signed with secret and valid until
+// expires, as printed on startup with --link-secret
+func ShareLink(siteURL, secret string, expires time.Time) string {
+	sep := "?"
+	if strings.Contains(siteURL, "?") {
+		sep = "&"
+	}
+	return siteURL + sep + linkParam + "=" + newLinkSigner(secret).token(expires)
+}
+
+// requireLink is the link stage. Opening a signed link stores its token in
+// a cookie and redirects to the URL without it, keeping it out of the
+// history and of Referer headers.
+func requireLink(signer *linkSigner, ui uiOptions) Middleware {
+	if signer == nil {
+		return nil
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			now := time.Now()
+			q := r.URL.Query()
+			if token := q.Get(linkParam); token != "" {
+				expires, ok := signer.verify(token, now)
+				if !ok {
+					renderErrorMessage(w, r, http.StatusForbidden, ui, "error.link")
+					return
+				}
+				http.SetCookie(w, &http.Cookie{
+					Name:     linkCookie,
+					Value:    token,
+					Path:     "/",
+					Expires:  expires,
+					Secure:   r.TLS != nil,
+					HttpOnly: true,
+					SameSite: http.SameSiteLaxMode,
+				})
+				if r.Method == http.MethodGet || r.Method == http.MethodHead {
+					q.Del(linkParam)
+					u := *r.URL
+					u.RawQuery = q.Encode()
+					http.Redirect(w, r, u.RequestURI(), http.StatusSeeOther)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			if c, err := r.Cookie(linkCookie); err == nil {
+				if _, ok := signer.verify(c.Value, now); ok {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			renderErrorMessage(w, r, http.StatusForbidden, ui, "error.link")
+		})
+	}
+}
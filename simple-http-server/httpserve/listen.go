@@ -0,0 +1,111 @@
+package httpserve
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// listenSpec is an address the server listens on, serving HTTPS with
+// the given certificate when tls is set, or with the ACME one when acme is
+type listenSpec struct {
+	addr string
+	tls  *tls.Config
+	acme bool
+}
+
+// String formats the address and protocol for the logs
+func (l listenSpec) String() string {
+	if l.tls != nil {
+		return l.addr + " (https)"
+	}
+	return l.addr + " (http)"
+}
+
+// tcp tells whether the address is a TCP one rather than a Unix socket
+func (l listenSpec) tcp() bool {
+	return !strings.HasPrefix(l.addr, "unix:")
+}
+
+// reachableURLs lists the URLs ln answers on. A wildcard address expands
+// to loopback and every LAN address of the machine the network allows,
+// since 0.0.0.0 is not something to type on another device.
+func (l listenSpec) reachableURLs(ln net.Listener, network string) []string {
+	addr, ok := ln.Addr().(*net.TCPAddr)
+	if !ok {
+		return []string{l.addr}
+	}
+	scheme := "http"
+	if l.tls != nil {
+		scheme = "https"
+	}
+	ips := []net.IP{addr.IP}
+	if addr.IP.IsUnspecified() {
+		ips = append([]net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}, localIPs()...)
+	}
+	var urls []string
+	for _, ip := range ips {
+		if v4 := ip.To4() != nil; v4 && network == "tcp6" || !v4 && network == "tcp4" {
+			continue
+		}
+		urls = append(urls, fmt.Sprintf("%s://%s/", scheme, net.JoinHostPort(ip.String(), strconv.Itoa(addr.Port))))
+	}
+	return urls
+}
+
+// listenSpecs is a flag.Value collecting repeated --listen flags of the
+// form ADDR[,cert=FILE,key=FILE] or ADDR,acme
+type listenSpecs []listenSpec
+
+// String returns the collected addresses separated by spaces
+func (s *listenSpecs) String() string {
+	addrs := make([]string, len(*s))
+	for i, l := range *s {
+		addrs[i] = l.addr
+	}
+	return strings.Join(addrs, " ")
+}
+
+// Set parses an address with its optional certificate and key, loading
+// them right away so a bad file is reported before anything listens
+func (s *listenSpecs) Set(value string) error {
+	addr, options, _ := strings.Cut(value, ",")
+	l := listenSpec{addr: addr}
+	var certFile, keyFile string
+	if l.tcp() {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid address %q, expected host:port or unix:<path>", addr)
+		}
+	} else if addr == "unix:" {
+		return fmt.Errorf("invalid address %q, expected unix:<path>", addr)
+	}
+	if options != "" {
+		for _, option := range strings.Split(options, ",") {
+			key, val, _ := strings.Cut(option, "=")
+			switch key {
+			case "acme":
+				l.acme = true
+			case "cert":
+				certFile = val
+			case "key":
+				keyFile = val
+			default:
+				return fmt.Errorf("unknown listen option %q, expected cert=FILE, key=FILE or acme", option)
+			}
+		}
+	}
+	if l.acme && (certFile != "" || keyFile != "") {
+		return fmt.Errorf("%s has both a certificate and acme", addr)
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("loading certificate of %s: %v", addr, err)
+		}
+		l.tls = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	*s = append(*s, l)
+	return nil
+}
@@ -0,0 +1,637 @@
+package httpserve
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listingOptions controls how directory listings are rendered
+type listingOptions struct {
+	sortBy   string
+	order    string
+	pageSize int
+	css      template.CSS
+	ui       uiOptions
+	upload   bool
+	// streamThreshold is the entry count above which a directory is
+	// streamed unsorted instead of being read and sorted in memory
+	streamThreshold int
+}
+
+// breadcrumb is a link to one of the parent directories of a listing
+type breadcrumb struct {
+	Name string
+	URL  string
+}
+
+// listingEntry is a single row in a directory listing
+type listingEntry struct {
+	Name    string
+	URL     string
+	IsDir   bool
+	Icon    string
+	Preview bool
+	Size    int64
+	ModTime time.Time
+}
+
+// listingPage holds everything the listing template needs
+type listingPage struct {
+	UI       uiOptions
+	Msg      catalog
+	Path     string
+	Crumbs   []breadcrumb
+	CSS      template.CSS
+	Entries  []listingEntry
+	SortBy   string
+	Order    string
+	Page     int
+	Pages    int
+	Total    int
+	PrevURL  string
+	NextURL  string
+	SortURLs map[string]string
+	Static   bool
+	Upload   bool
+	Unsorted bool
+	From     int
+	To       int
+	MoreURL  string
+}
+
+// listingRow is the data of the template rendering a single entry
+type listingRow struct {
+	Entry listingEntry
+	Copy  string
+}
+
+const (
+	// listingFlushRows is how many rows are rendered between flushes
+	listingFlushRows = 200
+	// listingBatch is how many entries are read at a time when streaming
+	listingBatch = 256
+)
+
+var validSorts = map[string]bool{"name": true, "size": true, "mtime": true}
+
+// validateListingOptions checks the configured listing defaults
+func validateListingOptions(opts listingOptions) error {
+	if !validSorts[opts.sortBy] {
+		return fmt.Errorf("invalid sort %q (expected name, size or mtime)", opts.sortBy)
+	}
+	if opts.order != "asc" && opts.order != "desc" {
+		return fmt.Errorf("invalid order %q (expected asc or desc)", opts.order)
+	}
+	if opts.pageSize < 1 {
+		return fmt.Errorf("invalid page size %d", opts.pageSize)
+	}
+	return nil
+}
+
+// serveDirListing renders the custom listing when the request targets a
+// directory without an index.html, reporting whether it handled the request
+func serveDirListing(w http.ResponseWriter, r *http.Request, root http.FileSystem, opts listingOptions) bool {
+	// Let the file server handle redirects for paths missing the trailing slash
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		return false
+	}
+	f, err := root.Open(r.URL.Path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.IsDir() || hasIndex(root, r.URL.Path) {
+		return false
+	}
+	serveListing(w, r, r.URL.Path, f, opts)
+	return true
+}
+
+// serveListing renders a sortable, paginated listing of dir, or streams it
+// unsorted when it holds more than the stream threshold
+func serveListing(w http.ResponseWriter, r *http.Request, dirPath string, dir http.File, opts listingOptions) {
+	// Read one entry past the threshold to learn whether the directory is
+	// small enough to sort in memory
+	count := -1
+	if opts.streamThreshold > 0 {
+		count = opts.streamThreshold + 1
+	}
+	infos, err := dir.Readdir(count)
+	if err != nil && err != io.EOF {
+		opts.ui.log.logf("Error reading directory %s: %v", dirPath, err)
+		renderError(w, r, http.StatusInternalServerError, opts.ui)
+		return
+	}
+
+	msg := negotiateCatalog(r, opts.ui.lang)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Language", msg.Lang)
+	if count > 0 && len(infos) == count {
+		streamListing(w, r, dirPath, dir, infos, msg, opts)
+		return
+	}
+	data := buildListing(dirPath, infos, r.URL.Query(), msg, opts)
+	if mount := userdirMount(r); mount != "" {
+		data.Crumbs = breadcrumbs(mount, dirPath)
+	}
+	lw := newListingWriter(w, msg)
+	if err := lw.render(&data, func() error {
+		for _, e := range data.Entries {
+			if err := lw.row(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		opts.ui.log.logf("Error rendering listing for %s: %v", dirPath, err)
+	}
+}
+
+// streamListing renders a page of a huge directory in directory order,
+// reading and writing entries in batches so memory stays bounded. The page
+// links to the next one with an offset continuation.
+func streamListing(w http.ResponseWriter, r *http.Request, dirPath string, dir http.File, first []fs.FileInfo, msg catalog, opts listingOptions) {
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	data := listingPage{
+		UI:       opts.ui,
+		Msg:      msg,
+		Path:     dirPath,
+		Crumbs:   breadcrumbs(userdirMount(r), dirPath),
+		CSS:      opts.css,
+		Upload:   opts.upload,
+		Unsorted: true,
+		From:     offset + 1,
+	}
+	lw := newListingWriter(w, msg)
+	err = lw.render(&data, func() error {
+		seen, shown := 0, 0
+		for batch := first; ; {
+			for _, info := range batch {
+				if hiddenEntry(dirPath, info.Name()) {
+					continue
+				}
+				if seen++; seen <= offset {
+					continue
+				}
+				if shown == opts.pageSize {
+					data.MoreURL = "?offset=" + strconv.Itoa(offset+shown)
+					data.To = offset + shown
+					return nil
+				}
+				shown++
+				if err := lw.row(newListingEntry(info)); err != nil {
+					return err
+				}
+			}
+			var err error
+			if batch, err = dir.Readdir(listingBatch); err != nil {
+				data.To = offset + shown
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+		}
+	})
+	if err != nil {
+		opts.ui.log.logf("Error streaming listing for %s: %v", dirPath, err)
+	}
+}
+
+// listingWriter renders a listing in pieces, flushing rows to the client
+// as they are written
+type listingWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	copy    string
+	rows    int
+}
+
+func newListingWriter(w http.ResponseWriter, msg catalog) *listingWriter {
+	flusher, _ := w.(http.Flusher)
+	return &listingWriter{w: w, flusher: flusher, copy: msg.T("listing.copy")}
+}
+
+// render writes the top of the page, the rows written by rows, then the
+// bottom of the page, which sees any fields rows set on data
+func (lw *listingWriter) render(data *listingPage, rows func() error) error {
+	if err := listingTemplate.ExecuteTemplate(lw.w, "listing-top", data); err != nil {
+		return err
+	}
+	if err := rows(); err != nil {
+		return err
+	}
+	return listingTemplate.ExecuteTemplate(lw.w, "listing-bottom", data)
+}
+
+// row writes a single entry
+func (lw *listingWriter) row(e listingEntry) error {
+	if err := listingTemplate.ExecuteTemplate(lw.w, "listing-row", listingRow{Entry: e, Copy: lw.copy}); err != nil {
+		return err
+	}
+	if lw.rows++; lw.rows%listingFlushRows == 0 && lw.flusher != nil {
+		lw.flusher.Flush()
+	}
+	return nil
+}
+
+// buildListing sorts and paginates the directory entries according to the
+// query parameters, which override the configured defaults
+func buildListing(dirPath string, infos []fs.FileInfo, q url.Values, msg catalog, opts listingOptions) listingPage {
+	sortBy := q.Get("sort")
+	if !validSorts[sortBy] {
+		sortBy = opts.sortBy
+	}
+	order := q.Get("order")
+	if order != "asc" && order != "desc" {
+		order = opts.order
+	}
+	page, err := strconv.Atoi(q.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	entries := make([]listingEntry, 0, len(infos))
+	for _, info := range infos {
+		if !hiddenEntry(dirPath, info.Name()) {
+			entries = append(entries, newListingEntry(info))
+		}
+	}
+	sortEntries(entries, sortBy, order == "desc")
+
+	// Slice out the requested page
+	pages := (len(entries) + opts.pageSize - 1) / opts.pageSize
+	if pages == 0 {
+		pages = 1
+	}
+	if page > pages {
+		page = pages
+	}
+	start := (page - 1) * opts.pageSize
+	end := min(start+opts.pageSize, len(entries))
+
+	data := listingPage{
+		UI:       opts.ui,
+		Msg:      msg,
+		Path:     dirPath,
+		Crumbs:   breadcrumbs("", dirPath),
+		CSS:      opts.css,
+		Entries:  entries[start:end],
+		SortBy:   sortBy,
+		Order:    order,
+		Page:     page,
+		Pages:    pages,
+		Total:    len(entries),
+		SortURLs: make(map[string]string, len(validSorts)),
+		Upload:   opts.upload,
+	}
+	for s := range validSorts {
+		// Clicking the active column flips its order
+		o := "asc"
+		if s == sortBy && order == "asc" {
+			o = "desc"
+		}
+		data.SortURLs[s] = listingQuery(s, o, 1)
+	}
+	if page > 1 {
+		data.PrevURL = listingQuery(sortBy, order, page-1)
+	}
+	if page < pages {
+		data.NextURL = listingQuery(sortBy, order, page+1)
+	}
+	return data
+}
+
+// newListingEntry describes a directory entry
+func newListingEntry(info fs.FileInfo) listingEntry {
+	name := info.Name()
+	if info.IsDir() {
+		name += "/"
+	}
+	return listingEntry{
+		Name:    name,
+		URL:     (&url.URL{Path: name}).String(),
+		IsDir:   info.IsDir(),
+		Icon:    fileIcon(name, info.IsDir()),
+		Preview: !info.IsDir() && isPreviewable(name),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+}
+
+// hiddenEntry reports whether an entry is left out of listings
+func hiddenEntry(dirPath, name string) bool {
+	return dirPath == "/" && (strings.EqualFold(name, trashDir) || strings.EqualFold(name, mirrorDir))
+}
+
+// sortEntries orders entries by the given key, keeping directories first
+func sortEntries(entries []listingEntry, sortBy string, desc bool) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+		if desc {
+			a, b = b, a
+		}
+		switch sortBy {
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case "mtime":
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.Before(b.ModTime)
+			}
+		}
+		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+	})
+}
+
+// breadcrumbs splits a directory path into links to each of its parents,
+// below the /~name prefix of a home
+func breadcrumbs(mount, dirPath string) []breadcrumb {
+	current := mount + "/"
+	crumbs := []breadcrumb{{Name: current, URL: (&url.URL{Path: current}).String()}}
+	for _, part := range strings.Split(strings.Trim(dirPath, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		current += part + "/"
+		crumbs = append(crumbs, breadcrumb{
+			Name: part,
+			URL:  (&url.URL{Path: current}).String(),
+		})
+	}
+	return crumbs
+}
+
+// loadListingCSS reads a custom stylesheet to inject into listing pages
+func loadListingCSS(file string) (template.CSS, error) {
+	if file == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return template.CSS(data), nil
+}
+
+// listingQuery builds the query string for a listing link
+func listingQuery(sortBy, order string, page int) string {
+	v := url.Values{}
+	v.Set("sort", sortBy)
+	v.Set("order", order)
+	v.Set("page", strconv.Itoa(page))
+	return "?" + v.Encode()
+}
+
+// hasIndex reports whether the directory contains an index.html file
+func hasIndex(root http.FileSystem, dirPath string) bool {
+	f, err := root.Open(path.Join(dirPath, "index.html"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	return err == nil && !info.IsDir()
+}
+
+// FormatSize renders a byte count in a human friendly way
+func FormatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatInt(n, 10) + " B"
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return strconv.FormatFloat(float64(n)/float64(div), 'f', 1, 64) + " " + string("KMGTPE"[exp]) + "iB"
+}
+
+var listingTemplate = template.Must(template.Must(uiTemplates.Clone()).New("listing").Funcs(template.FuncMap{
+	"size": FormatSize,
+	"time": func(t time.Time) string { return t.Format("2006-01-02 15:04:05") },
+	"row":  func(e listingEntry, copy string) listingRow { return listingRow{Entry: e, Copy: copy} },
+}).Parse(`{{template "listing-top" .}}{{$copy := .Msg.T "listing.copy"}}{{range .Entries}}{{template "listing-row" (row . $copy)}}{{end}}{{template "listing-bottom" .}}
+
+{{define "listing-top"}}<!DOCTYPE html>
+<html lang="{{.Msg.Lang}}">
+<head>
+{{if .Static}}` + generatedMarker + `
+{{end}}{{template "head"}}
+<title>{{.Msg.T "listing.title" .Path}}{{if .UI.Title}} - {{.UI.Title}}{{end}}</title>
+<style>
+table { border-collapse: collapse; }
+th, td { padding: 0.2em 1em; text-align: left; }
+td.size { text-align: right; }
+nav.crumbs a { text-decoration: none; }
+td.icon { width: 1.5em; text-align: center; }
+img.preview { max-width: 48px; max-height: 48px; vertical-align: middle; }
+form.upload { margin: 1em 0; padding: 0.75em; border: 1px dashed var(--border); border-radius: 4px; }
+form.upload.dragover { border-color: var(--link); background: rgba(9, 105, 218, 0.08); }
+form.upload .hint { margin: 0 0 0.5em; }
+ul.progress { list-style: none; padding: 0; margin: 0.5em 0 0; }
+ul.progress li { display: flex; gap: 0.75em; align-items: center; }
+ul.progress progress { width: 12em; }
+button.copy { background: none; border: 1px solid var(--border); color: var(--muted); border-radius: 4px; cursor: pointer; font-size: 0.8em; }
+</style>
+{{if .CSS}}<style>
+{{.CSS}}
+</style>{{end}}
+</head>
+<body>
+{{template "header" .}}
+<nav class="crumbs">
+{{range $i, $c := .Crumbs}}{{if gt $i 1}} / {{end}}<a href="{{$c.URL}}">{{$c.Name}}</a>{{end}}
+</nav>
+<h1>{{.Msg.T "listing.title" .Path}}</h1>
+{{if .Unsorted}}<p class="muted">{{.Msg.T "listing.unsorted"}}</p>{{end}}
+{{if and .Upload (not .Static)}}<form class="upload" method="post" enctype="multipart/form-data">
+<p class="hint muted">{{.Msg.T "listing.drop"}}</p>
+<input type="file" name="file" multiple required>
+<button type="submit">{{.Msg.T "listing.upload"}}</button>
+<ul class="progress"></ul>
+</form>
+<script>
+(function () {
+  // Uploads go through the tus endpoint in chunks, a few files at a time,
+  // falling back to the plain form submission when scripts are disabled
+  var chunkSize = 8 * 1024 * 1024;
+  var parallel = 3;
+  var form = document.querySelector("form.upload");
+  var input = form.querySelector("input[type=file]");
+  var list = form.querySelector("ul.progress");
+  var dir = {{.Path}};
+  var failed = {{.Msg.T "listing.failed"}};
+
+  function b64(s) { return btoa(unescape(encodeURIComponent(s))); }
+
+  function request(method, url, headers, body, onprogress) {
+    return new Promise(function (resolve, reject) {
+      var xhr = new XMLHttpRequest();
+      xhr.open(method, url);
+      xhr.setRequestHeader("Tus-Resumable", "1.0.0");
+      Object.keys(headers).forEach(function (k) { xhr.setRequestHeader(k, headers[k]); });
+      if (onprogress) xhr.upload.onprogress = onprogress;
+      xhr.onload = function () { xhr.status < 300 ? resolve(xhr) : reject(xhr); };
+      xhr.onerror = function () { reject(xhr); };
+      xhr.send(body);
+    });
+  }
+
+  function upload(file) {
+    var item = document.createElement("li");
+    var bar = document.createElement("progress");
+    var label = document.createElement("span");
+    bar.max = file.size || 1;
+    bar.value = 0;
+    label.textContent = file.name;
+    item.appendChild(bar);
+    item.appendChild(label);
+    list.appendChild(item);
+
+    return request("POST", "/_tus/", {
+      "Upload-Length": String(file.size),
+      "Upload-Metadata": "filename " + b64(file.name) + ",dir " + b64(dir)
+    }, null).then(function (xhr) {
+      var location = xhr.getResponseHeader("Location");
+      function next(offset) {
+        if (offset >= file.size) return Promise.resolve();
+        var chunk = file.slice(offset, offset + chunkSize);
+        return request("PATCH", location, {
+          "Upload-Offset": String(offset),
+          "Content-Type": "application/offset+octet-stream"
+        }, chunk, function (e) { bar.value = offset + e.loaded; }).then(function (xhr) {
+          return next(parseInt(xhr.getResponseHeader("Upload-Offset"), 10));
+        });
+      }
+      return next(0);
+    }).then(function () {
+      bar.value = bar.max;
+    }, function () {
+      label.textContent = file.name + " - " + failed;
+    });
+  }
+
+  function uploadAll(files) {
+    var queue = Array.prototype.slice.call(files);
+    var workers = [];
+    for (var i = 0; i < Math.min(parallel, queue.length); i++) {
+      workers.push((function work() {
+        var file = queue.shift();
+        return file ? upload(file).then(work) : Promise.resolve();
+      })());
+    }
+    Promise.all(workers).then(function () { window.location.reload(); });
+  }
+
+  form.addEventListener("submit", function (e) {
+    e.preventDefault();
+    uploadAll(input.files);
+  });
+  ["dragenter", "dragover"].forEach(function (type) {
+    form.addEventListener(type, function (e) {
+      e.preventDefault();
+      form.classList.add("dragover");
+    });
+  });
+  ["dragleave", "drop"].forEach(function (type) {
+    form.addEventListener(type, function () { form.classList.remove("dragover"); });
+  });
+  form.addEventListener("drop", function (e) {
+    e.preventDefault();
+    uploadAll(e.dataTransfer.files);
+  });
+})();
+</script>
+{{end}}<table>
+<tr>
+<th></th>
+{{if or .Static .Unsorted}}<th>{{.Msg.T "listing.name"}}</th>
+<th>{{.Msg.T "listing.size"}}</th>
+<th>{{.Msg.T "listing.modified"}}</th>
+{{else}}<th><a href="{{index .SortURLs "name"}}">{{.Msg.T "listing.name"}}</a></th>
+<th><a href="{{index .SortURLs "size"}}">{{.Msg.T "listing.size"}}</a></th>
+<th><a href="{{index .SortURLs "mtime"}}">{{.Msg.T "listing.modified"}}</a></th>
+{{end}}
+<th></th>
+</tr>
+{{if ne .Path "/"}}<tr><td class="icon">📁</td><td><a href="../">../</a></td><td></td><td></td><td></td></tr>{{end}}
+{{end}}
+
+{{define "listing-row"}}<tr class="entry">
+<td class="icon">{{if .Entry.Preview}}<img class="preview" src="{{.Entry.URL}}" alt="" loading="lazy">{{else}}{{.Entry.Icon}}{{end}}</td>
+<td><a href="{{.Entry.URL}}">{{.Entry.Name}}</a></td>
+<td class="size">{{if not .Entry.IsDir}}{{size .Entry.Size}}{{end}}</td>
+<td>{{time .Entry.ModTime}}</td>
+<td><button type="button" class="copy" data-href="{{.Entry.URL}}">{{.Copy}}</button></td>
+</tr>
+{{end}}
+
+{{define "listing-bottom"}}</table>
+{{if .Unsorted}}<p>
+<span class="range">{{.Msg.T "listing.range" .From .To}}</span>
+{{if .MoreURL}}<a class="more" href="{{.MoreURL}}">{{.Msg.T "listing.more"}} &raquo;</a>{{end}}
+</p>
+<script>
+(function () {
+  // Append the next page's rows in place instead of navigating to it
+  var more = document.querySelector("a.more");
+  var range = document.querySelector("span.range");
+  var format = {{.Msg.T "listing.range"}};
+  var from = {{.From}};
+  if (!more) return;
+  more.addEventListener("click", function (e) {
+    e.preventDefault();
+    fetch(more.href).then(function (resp) { return resp.text(); }).then(function (html) {
+      var doc = new DOMParser().parseFromString(html, "text/html");
+      var table = document.querySelector("table");
+      doc.querySelectorAll("tr.entry").forEach(function (row) {
+        table.appendChild(document.importNode(row, true));
+      });
+      var count = document.querySelectorAll("tr.entry").length;
+      range.textContent = format.replace("%d", from).replace("%d", from + count - 1);
+      var next = doc.querySelector("a.more");
+      if (next) more.href = next.href; else more.remove();
+    });
+  });
+})();
+</script>
+{{else if not .Static}}<p>
+{{if .PrevURL}}<a href="{{.PrevURL}}">&laquo; {{.Msg.T "listing.previous"}}</a>{{end}}
+{{.Msg.T "listing.page" .Page .Pages .Total}}
+{{if .NextURL}}<a href="{{.NextURL}}">{{.Msg.T "listing.next"}} &raquo;</a>{{end}}
+</p>{{end}}
+<script>
+document.addEventListener("click", function (e) {
+  var button = e.target.closest("button.copy");
+  if (!button) return;
+  var link = new URL(button.dataset.href, window.location.href).href;
+  navigator.clipboard.writeText(link).then(function () {
+    var label = button.textContent;
+    button.textContent = {{.Msg.T "listing.copied"}};
+    setTimeout(function () { button.textContent = label; }, 1500);
+  });
+});
+</script>
+</body>
+</html>
+{{end}}`))
@@ -0,0 +1,128 @@
+package httpserve
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// liveReloadPath is the server-sent events stream pages listen on with
+// --live-reload
+const liveReloadPath = "/_livereload"
+
+// liveReloadScript is appended to HTML pages. Stylesheet changes are
+// applied in place; anything else reloads the page, as does the server
+// coming back after a restart.
+const liveReloadScript = `<script>(function(){
+var connected=false,events=new EventSource("` + liveReloadPath + `");
+events.addEventListener("hello",function(){if(connected)location.reload();connected=true});
+events.addEventListener("change",function(e){
+var paths=JSON.parse(e.data),links=document.querySelectorAll('link[rel="stylesheet"]');
+if(links.length&&paths.every(function(p){return /\.css$/i.test(p)})){
+links.forEach(function(l){var u=new URL(l.href);u.searchParams.set("livereload",Date.now());l.href=u.href});return}
+location.reload()});
+})();</script>
+`
+
+// liveReloadWriter appends liveReloadScript to successful HTML
+// responses, so it runs after the rest of the page was parsed
+type liveReloadWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	inject      bool
+}
+
+// WriteHeader decides whether the response gets the script, and makes
+// room for it in the Content-Length. Partial responses are left alone.
+func (lw *liveReloadWriter) WriteHeader(code int) {
+	if lw.wroteHeader {
+		return
+	}
+	lw.wroteHeader = true
+	h := lw.Header()
+	if code == http.StatusOK && mediaType(h.Get("Content-Type")) == "text/html" && h.Get("Content-Encoding") == "" {
+		lw.inject = true
+		if n, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil {
+			h.Set("Content-Length", strconv.FormatInt(n+int64(len(liveReloadScript)), 10))
+		}
+		// Pages must be fetched again when they reload
+		h.Set("Cache-Control", "no-cache")
+	}
+	lw.ResponseWriter.WriteHeader(code)
+}
+
+// Write sends the body through, writing the header first if needed
+func (lw *liveReloadWriter) Write(b []byte) (int, error) {
+	if !lw.wroteHeader {
+		lw.WriteHeader(http.StatusOK)
+	}
+	return lw.ResponseWriter.Write(b)
+}
+
+// ReadFrom keeps the sendfile path
+func (lw *liveReloadWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !lw.wroteHeader {
+		lw.WriteHeader(http.StatusOK)
+	}
+	return readFrom(lw.ResponseWriter, src)
+}
+
+// finish appends the script once the page has been written
+func (lw *liveReloadWriter) finish(r *http.Request) {
+	if lw.inject && r.Method != http.MethodHead {
+		lw.ResponseWriter.Write([]byte(liveReloadScript))
+	}
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (lw *liveReloadWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
+
+// serveLiveReload streams a change event with the changed paths whenever
+// the served tree changes, after a hello event on connecting
+func (h *fileHandler) serveLiveReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		renderError(w, r, http.StatusMethodNotAllowed, h.ui)
+		return
+	}
+	sub := h.watcher.subscribe("/")
+	defer h.watcher.unsubscribe(sub)
+	rc := http.NewResponseController(w)
+	// The stream outlives any write timeout
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprint(w, "event: hello\ndata: {}\n\n")
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case batch, ok := <-sub.batches:
+			if !ok {
+				// Fell behind: the page reconnects and reloads
+				return
+			}
+			paths := make([]string, len(batch))
+			for i, ev := range batch {
+				paths[i] = ev.Path
+			}
+			data, _ := json.Marshal(paths)
+			fmt.Fprintf(w, "event: change\ndata: %s\n\n", data)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
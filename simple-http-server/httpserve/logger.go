@@ -0,0 +1,197 @@
+package httpserve
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Logger receives the log output of the server: Printf the messages about
+// starting, stopping and errors, and Access an entry for every request
+// going through the logging stage
+type Logger interface {
+	Printf(format string, args ...any)
+	Access(entry AccessEntry)
+}
+
+// AccessEntry describes a request answered after the logging stage
+type AccessEntry struct {
+	Time      time.Time // when the request reached the logging stage
+	Method    string
+	Path      string
+	URL       string // absolute URL of the request, with its query
+	Proto     string
+	Status    int
+	Bytes     int64 // body bytes sent
+	Duration  time.Duration
+	Remote    string
+	User      string
+	RequestID string
+	Note      string // how the request was answered, such as "proxied to host"
+}
+
+// Metrics receives the measurements of the server, to record in the
+// embedder's registry. Labels are given as name, value pairs. The server
+// reports:
+//
+//	http_requests_total            counter, labels method and status
+//	http_request_duration_seconds  observation, label method
+//	http_response_bytes_total      counter
+//	http_requests_rejected_total   counter, label reason (shed or rate-limit)
+type Metrics interface {
+	Add(name string, delta float64, labels ...string)
+	Observe(name string, value float64, labels ...string)
+}
+
+// Log levels of StdLogger: debug adds the debug details of --debug, and
+// error leaves out everything but the error messages and the audit records,
+// which no level suppresses
+const (
+	logLevelDebug = "debug"
+	logLevelInfo  = "info"
+	logLevelError = "error"
+)
+
+// logLevel is the log level of a server, set from --debug and by the admin
+// API, info until set
+type logLevel struct {
+	v atomic.Value
+}
+
+// set changes the log level
+func (l *logLevel) set(level string) error {
+	switch level {
+	case logLevelDebug, logLevelInfo, logLevelError:
+		l.v.Store(level)
+		return nil
+	}
+	return fmt.Errorf("invalid log level %q, expected debug, info or error", level)
+}
+
+// get returns the log level, info for a nil level
+func (l *logLevel) get() string {
+	if l == nil {
+		return logLevelInfo
+	}
+	if level, ok := l.v.Load().(string); ok {
+		return level
+	}
+	return logLevelInfo
+}
+
+// StdLogger is the default Logger, writing to the standard log package
+// the messages of the log level of its server, or of the info level for
+// the zero StdLogger
+type StdLogger struct {
+	level *logLevel
+}
+
+// Printf logs a message
+func (l StdLogger) Printf(format string, args ...any) {
+	if l.level.get() == logLevelError && !strings.HasPrefix(format, "Error") && !strings.HasPrefix(format, "audit:") {
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// Access logs a request as "METHOD /path STATUS (note)"
+func (l StdLogger) Access(e AccessEntry) {
+	if l.level.get() == logLevelError {
+		return
+	}
+	if e.Note != "" {
+		log.Printf("%s %s %d (%s)", e.Method, e.Path, e.Status, e.Note)
+	} else {
+		log.Printf("%s %s %d", e.Method, e.Path, e.Status)
+	}
+}
+
+// noMetrics is the default Metrics, discarding everything
+type noMetrics struct{}
+
+func (noMetrics) Add(string, float64, ...string)     {}
+func (noMetrics) Observe(string, float64, ...string) {}
+
+// serverLog is the log of one server: the Logger of its Config, wrapped by
+// the dashboards following it, and its log level
+type serverLog struct {
+	Logger
+	level logLevel
+}
+
+// newServerLog returns the log of a server created from cfg, writing with
+// StdLogger unless cfg sets a Logger
+func newServerLog(cfg Config) *serverLog {
+	l := &serverLog{Logger: cfg.Logger}
+	if l.Logger == nil {
+		l.Logger = StdLogger{level: &l.level}
+	}
+	if cfg.Debug {
+		l.level.set(logLevelDebug)
+	}
+	return l
+}
+
+// logf logs a message to the Logger, or with the zero StdLogger for a nil
+// log
+func (l *serverLog) logf(format string, args ...any) {
+	if l == nil {
+		StdLogger{}.Printf(format, args...)
+		return
+	}
+	l.Printf(format, args...)
+}
+
+// recordRequest reports a request to the access log and metrics
+func recordRequest(logger Logger, metrics Metrics, e AccessEntry) {
+	logger.Access(e)
+	metrics.Add("http_requests_total", 1, "method", e.Method, "status", strconv.Itoa(e.Status))
+	metrics.Observe("http_request_duration_seconds", e.Duration.Seconds(), "method", e.Method)
+	metrics.Add("http_response_bytes_total", float64(e.Bytes))
+}
+
+// recordRejected reports a request turned away ahead of the logging stage
+func recordRejected(logger Logger, metrics Metrics, r *http.Request, status int, reason string) {
+	logger.Access(AccessEntry{Time: time.Now(), Method: r.Method, Path: r.URL.Path, URL: requestURL(r), Proto: r.Proto, Status: status, Remote: r.RemoteAddr, User: "-", RequestID: RequestID(r)})
+	metrics.Add("http_requests_rejected_total", 1, "reason", reason)
+}
+
+// logFile is the --log-file the standard log package writes to, reopened
+// by the admin API after the file was moved away by log rotation
+type logFile struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+// openLogFile sends the standard log output to the file at path
+func openLogFile(path string) (*logFile, error) {
+	l := &logFile{path: path}
+	if err := l.reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// reopen opens the file at the path again, appending, and switches the log
+// output over to it
+func (l *logFile) reopen() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	log.SetOutput(f)
+	if l.f != nil {
+		l.f.Close()
+	}
+	l.f = f
+	return nil
+}
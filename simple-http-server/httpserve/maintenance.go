@@ -0,0 +1,117 @@
+package httpserve
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maintenanceFile turns maintenance mode on while it exists at the top of
+// the served directory
+const maintenanceFile = ".maintenance"
+
+// isMaintenancePath reports whether a request path points at
+// maintenanceFile, which clients must not create or remove since it takes
+// the server offline
+func isMaintenancePath(urlPath string) bool {
+	first, _, _ := strings.Cut(strings.TrimPrefix(urlPath, "/"), "/")
+	return strings.EqualFold(first, maintenanceFile)
+}
+
+// maintenanceCheckInterval is how often maintenanceFile is looked for
+const maintenanceCheckInterval = time.Second
+
+// The --health endpoints. The server is healthy as long as it answers, and
+// ready unless in maintenance mode.
+const (
+	healthPath = "/_health"
+	readyPath  = "/_ready"
+)
+
+// maintenanceOptions controls the answer to requests in maintenance mode
+type maintenanceOptions struct {
+	page       []byte // HTML replacing the themed 503 page, nil for the default
+	retryAfter time.Duration
+}
+
+// maintenanceMarker reports whether maintenanceFile exists, looking for it
+// at most once per maintenanceCheckInterval
+type maintenanceMarker struct {
+	path    string
+	checked atomic.Int64 // UnixNano of the last look
+	present atomic.Bool
+}
+
+func newMaintenanceMarker(dir string) *maintenanceMarker {
+	return &maintenanceMarker{path: filepath.Join(dir, maintenanceFile)}
+}
+
+// exists reports whether the file was there at the last look
+func (m *maintenanceMarker) exists(now time.Time) bool {
+	last := m.checked.Load()
+	if now.UnixNano()-last >= int64(maintenanceCheckInterval) && m.checked.CompareAndSwap(last, now.UnixNano()) {
+		_, err := os.Stat(m.path)
+		m.present.Store(err == nil)
+	}
+	return m.present.Load()
+}
+
+// inMaintenance reports whether maintenance mode is on, through the admin
+// API, --maintenance or maintenanceFile
+func (s *runtimeSettings) inMaintenance() bool {
+	return s.maintenance.Load() || s.marker != nil && s.marker.exists(time.Now())
+}
+
+// serveMaintenance answers 503 to a request in maintenance mode
+func serveMaintenance(w http.ResponseWriter, r *http.Request, opts maintenanceOptions, ui uiOptions) {
+	if lrw := loggedResponse(r); lrw != nil {
+		lrw.note = "maintenance"
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(opts.retryAfter.Seconds())))
+	if opts.page == nil || prefersJSON(r) {
+		renderErrorMessage(w, r, http.StatusServiceUnavailable, ui, "error.maintenance")
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Content-Length", strconv.Itoa(len(opts.page)))
+	h.Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if r.Method != http.MethodHead {
+		w.Write(opts.page)
+	}
+}
+
+// healthStatus is the body of the --health endpoints
+type healthStatus struct {
+	Status      string `json:"status"`
+	Maintenance bool   `json:"maintenance"`
+}
+
+// serveHealth is the health stage, answering the --health endpoints ahead
+// of the rate limits and the log
+func serveHealth(enabled bool, settings *runtimeSettings) Middleware {
+	if !enabled {
+		return nil
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != healthPath && r.URL.Path != readyPath {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("Cache-Control", "no-store")
+			status := healthStatus{Status: "ok", Maintenance: settings.inMaintenance()}
+			if r.URL.Path == readyPath && status.Maintenance {
+				status.Status = "maintenance"
+				writeJSON(w, http.StatusServiceUnavailable, status)
+				return
+			}
+			writeJSON(w, http.StatusOK, status)
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package httpserve
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// serveMkdir creates the directory at dirPath
+func (h *fileHandler) serveMkdir(w http.ResponseWriter, r *http.Request, dirPath string) {
+	if isMaintenancePath(dirPath) {
+		renderError(w, r, http.StatusForbidden, h.ui)
+		return
+	}
+	target := h.localPath(dirPath)
+	if _, err := os.Lstat(target); err == nil {
+		renderError(w, r, http.StatusMethodNotAllowed, h.ui)
+		return
+	}
+	if err := os.Mkdir(target, 0o755); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, fs.ErrNotExist) {
+			status = http.StatusConflict
+		}
+		h.log.logf("audit: %s failed to create directory %s from %s: %v", RequestUser(r), dirPath, r.RemoteAddr, err)
+		renderError(w, r, status, h.ui)
+		return
+	}
+	h.log.logf("audit: %s created directory %s from %s", RequestUser(r), dirPath, r.RemoteAddr)
+
+	// Send browsers back to the listing they came from
+	if r.Method == http.MethodPost && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, userdirMount(r)+r.URL.Path, http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Location", userdirMount(r)+dirPath+"/")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// servePostMkdir handles POST /dir/?mkdir=name
+func (h *fileHandler) servePostMkdir(w http.ResponseWriter, r *http.Request) {
+	name, err := uploadFileName(r.URL.Query().Get("mkdir"))
+	if err != nil || strings.ContainsAny(r.URL.Query().Get("mkdir"), `/\`) {
+		renderError(w, r, http.StatusBadRequest, h.ui)
+		return
+	}
+	h.serveMkdir(w, r, path.Join(r.URL.Path, name))
+}
+
+// serveMove renames the entry at the request path to the path given by
+// the Destination header, following the WebDAV MOVE semantics
+func (h *fileHandler) serveMove(w http.ResponseWriter, r *http.Request) {
+	dest, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || dest.Path == "" || (dest.Host != "" && dest.Host != r.Host) {
+		renderError(w, r, http.StatusBadRequest, h.ui)
+		return
+	}
+	if mount := userdirMount(r); mount != "" {
+		// Inside a home the destination carries its /~name mount, and
+		// can't be in another home
+		seg, rest, _ := strings.Cut(strings.TrimPrefix(dest.EscapedPath(), "/"), "/")
+		if name, err := url.PathUnescape(seg); err != nil || "/"+name != mount {
+			renderError(w, r, http.StatusForbidden, h.ui)
+			return
+		}
+		if dest, err = url.Parse("/" + rest); err != nil {
+			renderError(w, r, http.StatusBadRequest, h.ui)
+			return
+		}
+	}
+	destPath, err := sanitizePath(dest, h.policy)
+	if err != nil {
+		h.log.logf("Rejected destination %q from %s: %v", dest.EscapedPath(), r.RemoteAddr, err)
+		renderError(w, r, http.StatusBadRequest, h.ui)
+		return
+	}
+	srcPath := strings.TrimSuffix(r.URL.Path, "/")
+	destPath = strings.TrimSuffix(destPath, "/")
+	if srcPath == "" || destPath == "" || destPath == srcPath || strings.HasPrefix(destPath, srcPath+"/") || isTrashPath(srcPath) || isTrashPath(destPath) ||
+		isMaintenancePath(srcPath) || isMaintenancePath(destPath) ||
+		h.mirror != nil && (isMirrorPath(srcPath) || isMirrorPath(destPath)) {
+		renderError(w, r, http.StatusForbidden, h.ui)
+		return
+	}
+
+	src := h.localPath(srcPath)
+	dst := h.localPath(destPath)
+	srcInfo, err := os.Lstat(src)
+	if err != nil {
+		renderError(w, r, http.StatusNotFound, h.ui)
+		return
+	}
+	// A rename must not give a file a name the upload filter refuses
+	if srcInfo.Mode().IsRegular() {
+		head, err := readHead(src)
+		if err == nil {
+			err = h.upload.filter.checkHead(destPath, "", head)
+		}
+		if err != nil {
+			h.log.logf("audit: %s failed to move %s to %s from %s: %v", RequestUser(r), srcPath, destPath, r.RemoteAddr, err)
+			h.renderUploadError(w, r, err)
+			return
+		}
+	}
+	if info, err := os.Stat(filepath.Dir(dst)); err != nil || !info.IsDir() {
+		renderError(w, r, http.StatusConflict, h.ui)
+		return
+	}
+	existing, err := os.Lstat(dst)
+	existed := err == nil
+	if existed && (r.Header.Get("Overwrite") == "F" || existing.IsDir()) {
+		renderError(w, r, http.StatusPreconditionFailed, h.ui)
+		return
+	}
+	if err := os.Rename(src, dst); err != nil {
+		h.log.logf("audit: %s failed to move %s to %s from %s: %v", RequestUser(r), srcPath, destPath, r.RemoteAddr, err)
+		renderError(w, r, http.StatusInternalServerError, h.ui)
+		return
+	}
+	h.log.logf("audit: %s moved %s to %s from %s", RequestUser(r), srcPath, destPath, r.RemoteAddr)
+	if existed {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Location", userdirMount(r)+destPath)
+	w.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,209 @@
+package httpserve
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// mdnsGroup is the IPv4 multicast address of mDNS
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// mdnsTTL is how long other machines may cache the records, in seconds
+const mdnsTTL = 120
+
+// mdnsResponder advertises the server as an _http._tcp service over
+// multicast DNS, answering for the service instance and for a host name
+// derived from it, so browsers can also open http://<name>.local:<port>/
+type mdnsResponder struct {
+	service  dnsmessage.Name
+	instance dnsmessage.Name
+	host     dnsmessage.Name
+	port     uint16
+	conn     *net.UDPConn
+	log      *serverLog
+}
+
+// newMDNSResponder joins the mDNS group to advertise the instance name on
+// the given port
+func newMDNSResponder(name string, port int, log *serverLog) (*mdnsResponder, error) {
+	if name == "" || strings.Contains(name, ".") || len(name) > 63 {
+		return nil, fmt.Errorf("invalid service name %q, expected up to 63 characters without dots", name)
+	}
+	var label strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			label.WriteRune(r)
+		} else if label.Len() > 0 && !strings.HasSuffix(label.String(), "-") {
+			label.WriteByte('-')
+		}
+	}
+	host := strings.TrimSuffix(label.String(), "-")
+	if host == "" {
+		return nil, fmt.Errorf("invalid service name %q, it needs letters or digits to form a host name", name)
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return nil, err
+	}
+	return &mdnsResponder{
+		service:  dnsmessage.MustNewName("_http._tcp.local."),
+		instance: dnsmessage.MustNewName(name + "._http._tcp.local."),
+		host:     dnsmessage.MustNewName(host + ".local."),
+		port:     uint16(port),
+		conn:     conn,
+		log:      log,
+	}, nil
+}
+
+// run announces the service and answers queries until close
+func (m *mdnsResponder) run() {
+	go func() {
+		// Announce twice, as RFC 6762 section 8.3 asks
+		m.send(m.records(mdnsTTL), mdnsGroup)
+		time.Sleep(time.Second)
+		m.send(m.records(mdnsTTL), mdnsGroup)
+	}()
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := m.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				m.log.logf("mDNS read error: %v", err)
+			}
+			return
+		}
+		m.answer(buf[:n], from)
+	}
+}
+
+// close says goodbye, so other machines forget the service right away
+func (m *mdnsResponder) close() {
+	m.send(m.records(0), mdnsGroup)
+	m.conn.Close()
+}
+
+// answer replies to the questions of a query that concern the service
+func (m *mdnsResponder) answer(packet []byte, from *net.UDPAddr) {
+	var p dnsmessage.Parser
+	header, err := p.Start(packet)
+	if err != nil || header.Response {
+		return
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return
+	}
+	records := m.records(mdnsTTL)
+	var answers []dnsmessage.Resource
+	unicast := from.Port != mdnsGroup.Port
+	for _, q := range questions {
+		// The top bit of the class asks for a unicast reply
+		if q.Class&(1<<15) != 0 {
+			unicast = true
+		}
+		for _, rr := range records {
+			if !strings.EqualFold(rr.Header.Name.String(), q.Name.String()) {
+				continue
+			}
+			if q.Type == rr.Header.Type || q.Type == dnsmessage.TypeALL {
+				answers = append(answers, rr)
+			}
+		}
+		if q.Type == dnsmessage.TypePTR && strings.EqualFold(q.Name.String(), "_services._dns-sd._udp.local.") {
+			answers = append(answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: mdnsTTL},
+				Body:   &dnsmessage.PTRResource{PTR: m.service},
+			})
+		}
+	}
+	if len(answers) == 0 {
+		return
+	}
+	to := mdnsGroup
+	if unicast {
+		to = from
+	}
+	if from.Port != mdnsGroup.Port {
+		// Legacy resolvers match the reply to their query by id
+		m.sendReply(header.ID, questions, answers, to)
+		return
+	}
+	m.send(answers, to)
+}
+
+// records are the PTR, SRV, TXT and address records of the service
+func (m *mdnsResponder) records(ttl uint32) []dnsmessage.Resource {
+	// Records this responder alone owns replace cached ones: the cache
+	// flush bit is the top bit of the class
+	unique := dnsmessage.ClassINET | 1<<15
+	header := func(name dnsmessage.Name, typ dnsmessage.Type, class dnsmessage.Class) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Type: typ, Class: class, TTL: ttl}
+	}
+	records := []dnsmessage.Resource{
+		{Header: header(m.service, dnsmessage.TypePTR, dnsmessage.ClassINET), Body: &dnsmessage.PTRResource{PTR: m.instance}},
+		{Header: header(m.instance, dnsmessage.TypeSRV, unique), Body: &dnsmessage.SRVResource{Target: m.host, Port: m.port}},
+		{Header: header(m.instance, dnsmessage.TypeTXT, unique), Body: &dnsmessage.TXTResource{TXT: []string{"path=/"}}},
+	}
+	for _, ip := range localIPs() {
+		if ip4 := ip.To4(); ip4 != nil {
+			records = append(records, dnsmessage.Resource{Header: header(m.host, dnsmessage.TypeA, unique), Body: &dnsmessage.AResource{A: [4]byte(ip4)}})
+		} else {
+			records = append(records, dnsmessage.Resource{Header: header(m.host, dnsmessage.TypeAAAA, unique), Body: &dnsmessage.AAAAResource{AAAA: [16]byte(ip)}})
+		}
+	}
+	return records
+}
+
+// send multicasts or unicasts an unsolicited response
+func (m *mdnsResponder) send(answers []dnsmessage.Resource, to *net.UDPAddr) {
+	m.sendReply(0, nil, answers, to)
+}
+
+// sendReply sends a response with the given id and echoed questions
+func (m *mdnsResponder) sendReply(id uint16, questions []dnsmessage.Question, answers []dnsmessage.Resource, to *net.UDPAddr) {
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, Response: true, Authoritative: true},
+		Questions: questions,
+		Answers:   answers,
+	}
+	packet, err := msg.Pack()
+	if err != nil {
+		m.log.logf("mDNS pack error: %v", err)
+		return
+	}
+	if _, err := m.conn.WriteToUDP(packet, to); err != nil && !errors.Is(err, net.ErrClosed) {
+		m.log.logf("mDNS send error: %v", err)
+	}
+}
+
+// localIPs returns the unicast addresses of the interfaces that are up,
+// leaving out loopback and link-local ones
+func localIPs() []net.IP {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var ips []net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips
+}
@@ -0,0 +1,113 @@
+package httpserve
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// memBackend is the --backend value serving a copy of --dir held in memory
+const memBackend = "mem"
+
+// loadMemFS copies a seed into memory and serves it from there. The seed
+// is a directory, an archive file, or "-" for a tar archive, optionally
+// gzip compressed, read from stdin.
+func loadMemFS(seed string, log *serverLog) (*archiveFS, error) {
+	a := newArchiveFS()
+	var err error
+	switch {
+	case seed == "-":
+		err = a.loadArchive(os.Stdin, false)
+	case isArchive(seed):
+		var f *os.File
+		if f, err = os.Open(seed); err == nil {
+			err = a.loadArchive(f, strings.HasSuffix(strings.ToLower(seed), ".zip"))
+			f.Close()
+		}
+	default:
+		err = a.loadDir(seed)
+	}
+	if err != nil {
+		return nil, err
+	}
+	a.sortDirs()
+	var size int64
+	for _, entry := range a.files {
+		size += entry.info.size
+	}
+	log.logf("Loaded %d files (%s) into memory", len(a.files), FormatSize(size))
+	return a, nil
+}
+
+// loadArchive reads a whole zip or tar archive into memory and indexes it
+func (a *archiveFS) loadArchive(src io.Reader, isZip bool) error {
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if data, err = io.ReadAll(zr); err != nil {
+			return err
+		}
+	}
+	if isZip || bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		err = a.indexZip(bytes.NewReader(data), int64(len(data)))
+	} else {
+		err = a.indexTar(bytes.NewReader(data))
+	}
+	if err != nil {
+		return err
+	}
+	a.stripTopDir()
+	return nil
+}
+
+// loadDir reads every regular file below dir into memory, following
+// symlinks to files
+func (a *archiveFS) loadDir(dir string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if name == "." {
+			return nil
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if hiddenEntry(path.Dir("/"+name), d.Name()) {
+				return filepath.SkipDir
+			}
+			a.addDir(name, info.ModTime())
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		a.addFile(name, &archiveEntry{
+			info:    objectInfo{name: info.Name(), size: int64(len(data)), modTime: info.ModTime()},
+			section: io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))),
+		})
+		return nil
+	})
+}
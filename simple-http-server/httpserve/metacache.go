@@ -0,0 +1,260 @@
+package httpserve
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// metaEntry is the cached metadata of a path. A nil info records that the
+// path does not exist.
+type metaEntry struct {
+	key   string
+	info  fs.FileInfo
+	infos []fs.FileInfo
+}
+
+// metaCacheFS caches stat results, missing paths and directory listings of
+// a directory served through http.Dir. Entries are dropped when fsnotify
+// reports a change in their directory; directories that cannot be watched
+// are never cached.
+type metaCacheFS struct {
+	fs         http.FileSystem
+	root       string
+	maxEntries int
+	watcher    *fsnotify.Watcher
+	log        *serverLog
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	watched map[string]bool
+}
+
+// newMetaCacheFS wraps the http.Dir of root with a metadata cache holding
+// up to maxEntries paths
+func newMetaCacheFS(root string, maxEntries int, log *serverLog) (*metaCacheFS, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	c := &metaCacheFS{
+		fs:         http.Dir(root),
+		root:       root,
+		maxEntries: maxEntries,
+		watcher:    watcher,
+		log:        log,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		watched:    make(map[string]bool),
+	}
+	go c.watch()
+	return c, nil
+}
+
+// Open serves missing paths from the cache and returns directories wrapped
+// so their Stat and Readdir results are cached. Regular files are returned
+// unwrapped to keep the sendfile path.
+func (c *metaCacheFS) Open(name string) (http.File, error) {
+	key := path.Clean("/" + name)
+	entry, ok := c.get(key)
+	if ok && entry.info == nil {
+		return nil, fs.ErrNotExist
+	}
+	f, err := c.fs.Open(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) && !ok {
+			c.put(&metaEntry{key: key})
+		}
+		return nil, err
+	}
+	if !ok {
+		info, err := f.Stat()
+		if err != nil {
+			return f, nil
+		}
+		entry = &metaEntry{key: key, info: info}
+		c.put(entry)
+	}
+	if !entry.info.IsDir() {
+		return f, nil
+	}
+	return &metaDir{File: f, cache: c, entry: entry}, nil
+}
+
+// get returns the cached entry for key
+func (c *metaCacheFS) get(key string) (*metaEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*metaEntry), true
+}
+
+// put caches an entry, provided its parent directory can be watched
+func (c *metaCacheFS) put(e *metaEntry) {
+	if !c.watchDir(path.Dir(e.key)) {
+		return
+	}
+	if e.info != nil && e.info.IsDir() && !c.watchDir(e.key) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		c.lru.Remove(el)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.maxEntries {
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.entries, el.Value.(*metaEntry).key)
+	}
+}
+
+// setListing stores the entries of a cached directory
+func (c *metaCacheFS) setListing(e *metaEntry, infos []fs.FileInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok && el.Value == e {
+		e.infos = infos
+	}
+}
+
+// watchDir adds a watch on the directory at urlPath, reporting whether
+// changes in it will be seen
+func (c *metaCacheFS) watchDir(urlPath string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.watched[urlPath] {
+		return true
+	}
+	if err := c.watcher.Add(filepath.Join(c.root, filepath.FromSlash(urlPath))); err != nil {
+		return false
+	}
+	c.watched[urlPath] = true
+	return true
+}
+
+// watch drops the cached entries affected by each filesystem event
+func (c *metaCacheFS) watch() {
+	for {
+		select {
+		case ev, ok := <-c.watcher.Events:
+			if !ok {
+				return
+			}
+			rel, err := filepath.Rel(c.root, ev.Name)
+			if err != nil || strings.HasPrefix(rel, "..") {
+				continue
+			}
+			c.invalidate(path.Clean("/"+filepath.ToSlash(rel)), ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename))
+		case err, ok := <-c.watcher.Errors:
+			if !ok {
+				return
+			}
+			// Events may have been lost, so start over
+			c.log.logf("Metadata cache watch error, clearing cache: %v", err)
+			c.mu.Lock()
+			c.entries = make(map[string]*list.Element)
+			c.lru.Init()
+			c.mu.Unlock()
+		}
+	}
+}
+
+// invalidate drops urlPath and its parent's listing, and everything below
+// urlPath when it was removed or renamed
+func (c *metaCacheFS) invalidate(urlPath string, gone bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range []string{urlPath, path.Dir(urlPath)} {
+		if el, ok := c.entries[key]; ok {
+			c.lru.Remove(el)
+			delete(c.entries, key)
+		}
+	}
+	if !gone {
+		return
+	}
+	delete(c.watched, urlPath)
+	for key, el := range c.entries {
+		if strings.HasPrefix(key, urlPath+"/") {
+			c.lru.Remove(el)
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.watched {
+		if strings.HasPrefix(key, urlPath+"/") {
+			delete(c.watched, key)
+		}
+	}
+}
+
+// metaDir is an open directory answering Stat and Readdir calls from the
+// cache. A listing read from disk is cached once every entry has been
+// seen, unless it grows past metaMaxListing entries.
+type metaDir struct {
+	http.File
+	cache *metaCacheFS
+	entry *metaEntry
+
+	pos       int
+	direct    bool
+	collected []fs.FileInfo
+}
+
+// metaMaxListing bounds the listings collected for the cache
+const metaMaxListing = 65536
+
+// Stat returns the cached directory info
+func (d *metaDir) Stat() (fs.FileInfo, error) {
+	return d.entry.info, nil
+}
+
+// Readdir returns entries from the cached listing when there is one
+func (d *metaDir) Readdir(count int) ([]fs.FileInfo, error) {
+	d.cache.mu.Lock()
+	infos := d.entry.infos
+	d.cache.mu.Unlock()
+	if infos != nil && !d.direct {
+		rest := infos[d.pos:]
+		if count > 0 {
+			if len(rest) == 0 {
+				return nil, io.EOF
+			}
+			rest = rest[:min(count, len(rest))]
+		}
+		d.pos += len(rest)
+		return append([]fs.FileInfo(nil), rest...), nil
+	}
+
+	if !d.direct {
+		d.direct = true
+		d.collected = []fs.FileInfo{}
+	}
+	batch, err := d.File.Readdir(count)
+	if d.collected != nil {
+		d.collected = append(d.collected, batch...)
+		if len(d.collected) > metaMaxListing {
+			d.collected = nil
+		}
+	}
+	// A full read, or a batched read reaching the end, has seen every entry
+	if d.collected != nil && (count <= 0 && err == nil || err == io.EOF) {
+		d.cache.setListing(d.entry, d.collected)
+		d.collected = nil
+	}
+	return batch, err
+}
@@ -0,0 +1,336 @@
+package httpserve
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Middleware wraps a handler with one stage of request processing, either
+// passing the request on to the next handler or answering it itself
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps h in middleware, the first one seeing requests first
+func Chain(h http.Handler, middleware ...Middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		if middleware[i] != nil {
+			h = middleware[i](h)
+		}
+	}
+	return h
+}
+
+// The built-in stages of the request pipeline, in the order they see each
+// request. Stages whose feature is disabled pass requests straight on.
+const (
+	StageRequestID     = "request-id"     // attaches RequestID, echoed in X-Request-ID
+	StageReadRate      = "read-rate"      // aborts requests whose headers or body arrive below --min-read-rate with 408
+	StageHealth        = "health"         // answers the --health endpoints
+	StageConnections   = "connections"    // closes connections past --max-conn-requests or --max-conn-lifetime
+	StageShedding      = "shedding"       // rejects requests over the --shed-* thresholds with 503
+	StageRateLimit     = "rate-limit"     // rejects clients over --rate-limit with 429
+	StageForwardProxy  = "forward-proxy"  // answers --forward-proxy requests
+	StageGRPC          = "grpc"           // answers --grpc calls
+	StageHeaders       = "headers"        // adds the --header response headers
+	StageRecord        = "record"         // records requests and responses to the --record HAR file
+	StageLogging       = "logging"        // logs the status of every request from here on
+	StageTimeout       = "timeout"        // cancels requests past --request-timeout with 503
+	StagePaths         = "paths"          // rejects bad paths and normalizes the rest
+	StageSettings      = "settings"       // applies the deny rules and maintenance mode
+	StagePluginRequest = "plugin-request" // gives requests to --plugin programs taking request events
+	StageLink          = "link"           // requires a link signed with --link-secret
+	StageAuth          = "auth"           // requires --auth credentials, setting RequestUser
+	StagePluginAuth    = "plugin-auth"    // gives requests to --plugin programs taking auth events
+	StageScript        = "script"         // runs the --script request script
+	StageWasm          = "wasm"           // runs the --wasm filters
+	StageChaos         = "chaos"          // injects --chaos-* latency and errors
+	StageProxy         = "proxy"          // answers --proxy routes
+	StageMock          = "mock"           // answers --mock routes
+	StageDebug         = "debug"          // answers --debug-echo requests with what was received
+	StageMethods       = "methods"        // rejects methods the enabled features don't accept
+	StageCompression   = "compression"    // compresses responses with --compress
+)
+
+// Hook inserts a Middleware into the pipeline right after the built-in
+// stage named After, or in front of every stage when After is empty.
+// Hooks after the same stage run in the order they are given.
+type Hook struct {
+	After      string
+	Middleware Middleware
+}
+
+// stage is a named Middleware of the pipeline
+type stage struct {
+	name       string
+	middleware Middleware
+}
+
+// pipeline wraps h in the built-in stages with the hooks inserted between
+// them
+func pipeline(h http.Handler, stages []stage, hooks []Hook) (http.Handler, error) {
+	var chain []Middleware
+	insert := func(after string) {
+		for _, hook := range hooks {
+			if hook.After == after {
+				chain = append(chain, hook.Middleware)
+			}
+		}
+	}
+	insert("")
+	for _, s := range stages {
+		chain = append(chain, s.middleware)
+		insert(s.name)
+	}
+	for _, hook := range hooks {
+		known := slices.ContainsFunc(stages, func(s stage) bool { return s.name == hook.After })
+		if hook.After != "" && !known {
+			return nil, fmt.Errorf("unknown stage %q", hook.After)
+		}
+	}
+	return Chain(h, chain...), nil
+}
+
+// handleIf answers the requests matched by handles with h instead of
+// passing them on
+func handleIf(handles func(*http.Request) bool, h http.Handler) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if handles(r) {
+				h.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requestIDs is the request-id stage
+func requestIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, withRequestID(w, r))
+	})
+}
+
+// recycleConns is the connections stage
+func recycleConns(conns connOptions) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conns.recycle(w, r)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// shedLoad is the shedding stage
+func shedLoad(shedder *loadShedder, ui uiOptions, logger Logger, metrics Metrics) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			release, ok := shedder.admit(w, r, ui)
+			if !ok {
+				recordRejected(logger, metrics, r, http.StatusServiceUnavailable, "shed")
+				return
+			}
+			defer release()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// limitRate is the rate-limit stage
+func limitRate(settings *runtimeSettings, ui uiOptions, logger Logger, metrics Metrics) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !settings.rateLimiter().admit(w, r, ui) {
+				recordRejected(logger, metrics, r, http.StatusTooManyRequests, "rate-limit")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// parseHeaders parses --header values given as 'Name: value'
+func parseHeaders(values []string) (http.Header, error) {
+	headers := make(http.Header)
+	for _, value := range values {
+		name, v, ok := strings.Cut(value, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("invalid header %q, expected 'Name: value'", value)
+		}
+		headers.Add(name, strings.TrimSpace(v))
+	}
+	return headers, nil
+}
+
+// addHeaders is the headers stage
+func addHeaders(headers http.Header) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for name, values := range headers {
+				w.Header()[name] = values
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type loggedResponseKey struct{}
+
+// logRequests is the logging stage. Later stages reach its writer with
+// loggedResponse, to note how the request was answered.
+func logRequests(buffers *bufferPool, log *serverLog, metrics Metrics) Middleware {
+	watcher, _ := log.Logger.(transferWatcher)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			// Create a custom ResponseWriter to capture the status code
+			lrw := &loggingResponseWriter{
+				ResponseWriter: w,
+				statusCode:     http.StatusOK,
+				buffers:        buffers,
+				body:           bodyNone,
+				user:           "-",
+			}
+			r = r.WithContext(context.WithValue(r.Context(), loggedResponseKey{}, lrw))
+			if watcher != nil {
+				watchTransfer(watcher, lrw, r, start)
+			}
+			next.ServeHTTP(lrw, r)
+			if watcher != nil {
+				watcher.finished(lrw.transfer)
+			}
+			if lrw.written == 0 && lrw.statusCode == http.StatusOK && r.Header.Get("Upgrade") != "" {
+				// Upgraded connections are hijacked before a status is written
+				lrw.statusCode = http.StatusSwitchingProtocols
+			}
+			if body, ok := r.Body.(*guardedBody); ok && lrw.note == "" && body.tooSlow() {
+				lrw.note = "body too slow"
+			}
+			if lrw.note == "" && r.Context().Err() != nil {
+				lrw.note = "client disconnected"
+			}
+			recordRequest(log, metrics, AccessEntry{
+				Time:      start,
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				URL:       requestURL(r),
+				Proto:     r.Proto,
+				Status:    lrw.statusCode,
+				Bytes:     lrw.written,
+				Duration:  time.Since(start),
+				Remote:    r.RemoteAddr,
+				User:      lrw.user,
+				RequestID: RequestID(r),
+				Note:      lrw.note,
+			})
+			if log.level.get() == logLevelDebug {
+				log.logf("debug: %s %s sent %d body bytes via %s", r.Method, r.URL.Path, lrw.written, lrw.body)
+			}
+		})
+	}
+}
+
+// loggedResponse returns the writer of the logging stage, or nil when the
+// request did not go through it
+func loggedResponse(r *http.Request) *loggingResponseWriter {
+	lrw, _ := r.Context().Value(loggedResponseKey{}).(*loggingResponseWriter)
+	return lrw
+}
+
+// cleanPaths is the paths stage
+func cleanPaths(policy pathPolicy, ui uiOptions, log *serverLog) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Sanitize the request path before it reaches the filesystem
+			cleanPath, err := sanitizePath(r.URL, policy)
+			if err != nil {
+				renderError(w, r, http.StatusBadRequest, ui)
+				log.logf("Rejected path %q from %s: %v", r.URL.EscapedPath(), r.RemoteAddr, err)
+				return
+			}
+			r.URL.Path, r.URL.RawPath = cleanPath, ""
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireAuth is the auth stage
+func requireAuth(creds credentials, ui uiOptions) Middleware {
+	if len(creds) == 0 {
+		return nil
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r, ok := creds.authenticate(r)
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Basic realm="simple-http-server", charset="UTF-8"`)
+				renderError(w, r, http.StatusUnauthorized, ui)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// injectChaos is the chaos stage
+func injectChaos(chaos *chaosMonkey, ui uiOptions) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if chaos.inject(w, r, ui) {
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// routeProxies is the proxy stage. Proxied routes take any method and are
+// passed through untouched.
+func routeProxies(proxies proxyRoutes) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := proxies.match(r.URL.Path)
+			if route == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if lrw := loggedResponse(r); lrw != nil {
+				lrw.note = "proxied to " + route.target.Host
+			}
+			route.proxy.ServeHTTP(w, r)
+		})
+	}
+}
+
+// allowMethods is the methods stage
+func allowMethods(allowed map[string]bool, ui uiOptions) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !allowed[r.Method] {
+				renderError(w, r, http.StatusMethodNotAllowed, ui)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// compressResponses is the compression stage
+func compressResponses(compression *compressor, log *serverLog) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cw := compression.wrap(w, r)
+			if cw == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(cw, r)
+			if err := cw.Close(); err != nil {
+				log.logf("Error compressing %s: %v", r.URL.Path, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package httpserve
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mirrorDir is the hidden directory at the top of a mirrored tree holding
+// the origin's validation headers of every fetched file
+const mirrorDir = ".mirror"
+
+// mirrorMeta is what is kept about a file fetched from the origin
+type mirrorMeta struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	ContentType  string    `json:"content_type,omitempty"`
+	Fetched      time.Time `json:"fetched"`
+}
+
+// mirrorFetch is a fetch from the origin that concurrent requests for the
+// same file wait on
+type mirrorFetch struct {
+	done     chan struct{}
+	status   int
+	location string
+	err      error
+}
+
+// mirror fills the served directory from an upstream origin: files missing
+// locally are downloaded on first request, then served from disk and
+// revalidated with the origin once older than ttl
+type mirror struct {
+	origin *url.URL
+	dir    string
+	ttl    time.Duration
+	client *http.Client
+	log    *serverLog
+
+	mu       sync.Mutex
+	inflight map[string]*mirrorFetch
+}
+
+// newMirror returns a mirror of origin stored in dir, or nil when origin
+// is empty
+func newMirror(origin string, dir string, ttl time.Duration, log *serverLog) (*mirror, error) {
+	if origin == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid origin %q, expected an http or https URL", origin)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	if err := os.MkdirAll(filepath.Join(dir, mirrorDir), 0o700); err != nil {
+		return nil, err
+	}
+	return &mirror{
+		origin: u,
+		dir:    dir,
+		ttl:    ttl,
+		client: &http.Client{
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, ResponseHeaderTimeout: 30 * time.Second},
+			// Redirects are passed on to the client so directories are
+			// never stored as files
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		log:      log,
+		inflight: make(map[string]*mirrorFetch),
+	}, nil
+}
+
+// isMirrorPath reports whether a request path points into the metadata
+// directory of a mirror
+func isMirrorPath(urlPath string) bool {
+	first, _, _ := strings.Cut(strings.TrimPrefix(urlPath, "/"), "/")
+	return strings.EqualFold(first, mirrorDir)
+}
+
+// metaPath returns where the metadata of the file served at urlPath is kept
+func (m *mirror) metaPath(urlPath string) string {
+	sum := sha256.Sum256([]byte(urlPath))
+	return filepath.Join(m.dir, mirrorDir, hex.EncodeToString(sum[:16])+".json")
+}
+
+// loadMeta returns the metadata of a fetched file, if any
+func (m *mirror) loadMeta(urlPath string) (mirrorMeta, bool) {
+	data, err := os.ReadFile(m.metaPath(urlPath))
+	if err != nil {
+		return mirrorMeta{}, false
+	}
+	var meta mirrorMeta
+	return meta, json.Unmarshal(data, &meta) == nil
+}
+
+// serveMirrored makes sure the file for a GET or HEAD request is on disk
+// and up to date, then sets the origin's headers for the file server. It
+// returns true when it already answered the request, with a redirect or an
+// error.
+func (h *fileHandler) serveMirrored(w http.ResponseWriter, r *http.Request) bool {
+	urlPath := path.Clean(r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") || urlPath == "/" {
+		// Directories list what has been mirrored so far
+		return false
+	}
+	status, location, err := h.mirror.ensure(urlPath)
+	switch {
+	case err != nil:
+		h.log.logf("mirror: fetching %s: %v", urlPath, err)
+		renderError(w, r, http.StatusBadGateway, h.ui)
+		return true
+	case location != "":
+		http.Redirect(w, r, location, status)
+		return true
+	case status != http.StatusOK:
+		renderError(w, r, status, h.ui)
+		return true
+	}
+	if meta, ok := h.mirror.loadMeta(urlPath); ok {
+		if meta.ContentType != "" {
+			w.Header().Set("Content-Type", meta.ContentType)
+		}
+		if meta.ETag != "" {
+			w.Header().Set("ETag", meta.ETag)
+		}
+	}
+	return false
+}
+
+// ensure fetches or revalidates the file at urlPath unless a fresh copy is
+// on disk. It returns the status to answer with, and the local location
+// to redirect to when the origin redirects within itself.
+func (m *mirror) ensure(urlPath string) (int, string, error) {
+	local := filepath.Join(m.dir, filepath.FromSlash(urlPath))
+	meta, known := m.loadMeta(urlPath)
+	info, err := os.Stat(local)
+	if err == nil && info.IsDir() {
+		return http.StatusOK, "", nil
+	}
+	if err == nil && (!known || m.ttl <= 0 || time.Since(meta.Fetched) < m.ttl) {
+		// Files placed in the directory by hand are served as they are
+		return http.StatusOK, "", nil
+	}
+
+	m.mu.Lock()
+	f, waiting := m.inflight[urlPath]
+	if !waiting {
+		f = &mirrorFetch{done: make(chan struct{})}
+		m.inflight[urlPath] = f
+	}
+	m.mu.Unlock()
+	if waiting {
+		<-f.done
+		return f.status, f.location, f.err
+	}
+
+	f.status, f.location, f.err = m.fetch(urlPath, local, meta, known && err == nil)
+	if f.err != nil && known && err == nil {
+		m.log.logf("mirror: revalidating %s failed, serving the stale copy: %v", urlPath, f.err)
+		f.status, f.err = http.StatusOK, nil
+	}
+	m.mu.Lock()
+	delete(m.inflight, urlPath)
+	m.mu.Unlock()
+	close(f.done)
+	return f.status, f.location, f.err
+}
+
+// fetch downloads urlPath from the origin into local, conditionally when a
+// copy is already there
+func (m *mirror) fetch(urlPath, local string, meta mirrorMeta, revalidate bool) (int, string, error) {
+	target := *m.origin
+	target.Path += urlPath
+	req, err := http.NewRequest(http.MethodGet, target.String(), nil)
+	if err != nil {
+		return 0, "", err
+	}
+	if revalidate {
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && revalidate:
+		meta.Fetched = time.Now().UTC()
+		return http.StatusOK, "", m.saveMeta(urlPath, meta)
+	case resp.StatusCode >= 300 && resp.StatusCode < 400:
+		location, err := resp.Location()
+		if err != nil || location.Host != m.origin.Host || !strings.HasPrefix(location.Path, m.origin.Path+"/") {
+			return 0, "", fmt.Errorf("origin redirected outside of itself (%s)", resp.Status)
+		}
+		local := &url.URL{Path: strings.TrimPrefix(location.Path, m.origin.Path), RawQuery: location.RawQuery}
+		return resp.StatusCode, local.String(), nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		if revalidate {
+			// Removed at the origin
+			os.Remove(local)
+			os.Remove(m.metaPath(urlPath))
+		}
+		return http.StatusNotFound, "", nil
+	case resp.StatusCode != http.StatusOK:
+		return 0, "", fmt.Errorf("origin answered %s", resp.Status)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(local), 0o755); err != nil {
+		return 0, "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Join(m.dir, mirrorDir), "fetch-*")
+	if err != nil {
+		return 0, "", err
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, resp.Body)
+	if err == nil && resp.ContentLength >= 0 && n != resp.ContentLength {
+		err = errors.New("origin response was cut short")
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	os.Chmod(tmp.Name(), 0o644)
+	modTime, parseErr := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if parseErr == nil {
+		os.Chtimes(tmp.Name(), modTime, modTime)
+	}
+	if err := os.Rename(tmp.Name(), local); err != nil {
+		return 0, "", err
+	}
+	meta = mirrorMeta{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		ContentType:  resp.Header.Get("Content-Type"),
+		Fetched:      time.Now().UTC(),
+	}
+	m.log.logf("mirror: fetched %s (%s)", urlPath, FormatSize(n))
+	return http.StatusOK, "", m.saveMeta(urlPath, meta)
+}
+
+// saveMeta records the metadata of a fetched file
+func (m *mirror) saveMeta(urlPath string, meta mirrorMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(m.metaPath(urlPath), data, 0o600)
+}
@@ -0,0 +1,105 @@
+package httpserve
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// mappedFile is a read-only mapping shared by every request streaming the
+// same version of a file
+type mappedFile struct {
+	key  mappingKey
+	data []byte
+	refs int
+}
+
+// mappingKey identifies a version of a file so a replaced file gets a new
+// mapping
+type mappingKey struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// fileMapper serves large files from memory mappings, keeping each mapping
+// alive while any request still reads it. Truncating a file while it is
+// mapped makes readers fault, so it suits trees that are replaced rather
+// than rewritten in place.
+type fileMapper struct {
+	minSize int64
+	log     *serverLog
+
+	mu       sync.Mutex
+	mappings map[mappingKey]*mappedFile
+}
+
+// newFileMapper returns a mapper for files of at least minSize bytes, or
+// nil when mmap serving is disabled
+func newFileMapper(minSize int64, log *serverLog) *fileMapper {
+	if minSize <= 0 {
+		return nil
+	}
+	return &fileMapper{minSize: minSize, log: log, mappings: make(map[mappingKey]*mappedFile)}
+}
+
+// acquire returns the mapping of f, creating it on first use
+func (m *fileMapper) acquire(key mappingKey, f *os.File) (*mappedFile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if mf, ok := m.mappings[key]; ok {
+		mf.refs++
+		return mf, nil
+	}
+	data, err := mapFile(f, key.size)
+	if err != nil {
+		return nil, err
+	}
+	mf := &mappedFile{key: key, data: data, refs: 1}
+	m.mappings[key] = mf
+	return mf, nil
+}
+
+// release drops a reference, unmapping the file once nobody reads it
+func (m *fileMapper) release(mf *mappedFile) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mf.refs--
+	if mf.refs > 0 {
+		return
+	}
+	delete(m.mappings, mf.key)
+	if err := unmapFile(mf.data); err != nil {
+		m.log.logf("Error unmapping %s: %v", mf.key.path, err)
+	}
+}
+
+// serveMapped answers GET and HEAD requests for large regular files from a
+// memory mapping, reporting whether it handled the request
+func (h *fileHandler) serveMapped(w http.ResponseWriter, r *http.Request) bool {
+	f, err := h.root.Open(r.URL.Path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	osFile, ok := f.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() || info.Size() < h.mmap.minSize {
+		return false
+	}
+	key := mappingKey{path: filepath.Join(h.dir, filepath.FromSlash(r.URL.Path)), size: info.Size(), modTime: info.ModTime()}
+	mf, err := h.mmap.acquire(key, osFile)
+	if err != nil {
+		h.log.logf("Error mapping %s, falling back to reads: %v", r.URL.Path, err)
+		return false
+	}
+	defer h.mmap.release(mf)
+	http.ServeContent(w, r, info.Name(), info.ModTime(), bytes.NewReader(mf.data))
+	return true
+}
@@ -0,0 +1,17 @@
+//go:build !(linux || darwin || freebsd)
+
+package httpserve
+
+import (
+	"errors"
+	"os"
+)
+
+// mapFile is unsupported here, so large files use buffered reads
+func mapFile(f *os.File, size int64) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func unmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd
+
+package httpserve
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps size bytes of f read-only into memory
+func mapFile(f *os.File, size int64) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// unmapFile releases a mapping created by mapFile
+func unmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,232 @@
+package httpserve
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// mockReloadInterval is how often the --mock file is checked for changes
+const mockReloadInterval = time.Second
+
+// mockRoute is a route of the --mock file, answering the requests matching
+// its method and path pattern with a canned response
+type mockRoute struct {
+	Method  string            `json:"method"` // any method when empty
+	Path    string            `json:"path"`   // an http.ServeMux pattern, such as /api/users/{id}
+	Status  int               `json:"status"`
+	Latency string            `json:"latency"`
+	Headers map[string]string `json:"headers"`
+	Body    json.RawMessage   `json:"body"` // a string is sent as is, anything else as JSON
+	File    string            `json:"file"` // read on every request, relative to the --mock file
+
+	latency time.Duration
+	body    []byte
+}
+
+// mockFile is the --mock file, a list of routes alone or under routes
+type mockFile struct {
+	Routes []*mockRoute `json:"routes"`
+}
+
+// mockAPI answers the --mock routes, reloading the file once it changes
+type mockAPI struct {
+	file string
+	ui   uiOptions
+	log  *serverLog
+
+	mux     atomic.Pointer[http.ServeMux]
+	checked atomic.Int64 // UnixNano of the last look at the file
+	mu      sync.Mutex   // serializes reloads
+	modTime time.Time
+}
+
+func newMockAPI(file string, ui uiOptions, log *serverLog) (*mockAPI, error) {
+	m := &mockAPI{file: file, ui: ui, log: log}
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	mux, n, err := m.load()
+	if err != nil {
+		return nil, err
+	}
+	m.mux.Store(mux)
+	m.modTime = info.ModTime()
+	m.checked.Store(time.Now().UnixNano())
+	m.log.logf("Mocking %d API route(s) from %s", n, file)
+	return m, nil
+}
+
+// load parses the file, as YAML or JSON, into a mux of its routes
+func (m *mockAPI) load() (*http.ServeMux, int, error) {
+	data, err := os.ReadFile(m.file)
+	if err != nil {
+		return nil, 0, err
+	}
+	var file mockFile
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' || isYAMLList(data) {
+		err = decodeYAML(data, &file.Routes)
+	} else {
+		err = decodeYAML(data, &file)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	mux := http.NewServeMux()
+	for i, route := range file.Routes {
+		if err := m.register(mux, route); err != nil {
+			return nil, 0, fmt.Errorf("route %d: %v", i+1, err)
+		}
+	}
+	return mux, len(file.Routes), nil
+}
+
+// isYAMLList reports whether a YAML document is a block sequence
+func isYAMLList(data []byte) bool {
+	p := &yamlParser{lines: strings.Split(string(data), "\n")}
+	_, text, ok := p.peek()
+	return ok && isYAMLSequenceItem(text)
+}
+
+// register adds a route to mux, checking it first
+func (m *mockAPI) register(mux *http.ServeMux, route *mockRoute) (err error) {
+	if route == nil {
+		return errors.New("empty route")
+	}
+	if !strings.HasPrefix(route.Path, "/") {
+		return fmt.Errorf("invalid path %q, expected a pattern such as /api/users/{id}", route.Path)
+	}
+	if route.Status == 0 {
+		route.Status = http.StatusOK
+	}
+	if route.Status < 100 || route.Status > 999 {
+		return fmt.Errorf("invalid status %d", route.Status)
+	}
+	if route.Latency != "" {
+		if route.latency, err = time.ParseDuration(route.Latency); err != nil || route.latency < 0 {
+			return fmt.Errorf("invalid latency %q", route.Latency)
+		}
+	}
+	if route.File != "" && len(route.Body) > 0 {
+		return fmt.Errorf("%s has both a body and a file", route.Path)
+	}
+	if route.File != "" && !filepath.IsAbs(route.File) {
+		route.File = filepath.Join(filepath.Dir(m.file), route.File)
+	}
+	var s string
+	if len(route.Body) > 0 && json.Unmarshal(route.Body, &s) == nil {
+		route.body = []byte(s)
+	} else if len(route.Body) > 0 && string(route.Body) != "null" {
+		route.body = append(route.Body, '\n')
+	}
+	pattern := route.Path
+	if route.Method != "" {
+		pattern = strings.ToUpper(route.Method) + " " + route.Path
+	}
+	// ServeMux panics on invalid and conflicting patterns
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	mux.Handle(pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.serve(w, r, route)
+	}))
+	return nil
+}
+
+// routes returns the mux of the current routes, reloading the file when it
+// changed since the last look
+func (m *mockAPI) routes() *http.ServeMux {
+	now := time.Now().UnixNano()
+	last := m.checked.Load()
+	if now-last < int64(mockReloadInterval) || !m.checked.CompareAndSwap(last, now) {
+		return m.mux.Load()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	info, err := os.Stat(m.file)
+	if err != nil || info.ModTime().Equal(m.modTime) {
+		return m.mux.Load()
+	}
+	m.modTime = info.ModTime()
+	mux, n, err := m.load()
+	if err != nil {
+		m.log.logf("Error reloading mock routes from %s, keeping the previous ones: %v", m.file, err)
+		return m.mux.Load()
+	}
+	m.mux.Store(mux)
+	m.log.logf("Reloaded %d mock route(s) from %s", n, m.file)
+	return mux
+}
+
+// serve answers a request with the response of its route
+func (m *mockAPI) serve(w http.ResponseWriter, r *http.Request, route *mockRoute) {
+	if route.latency > 0 {
+		timer := time.NewTimer(route.latency)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	body, contentType := route.body, "application/json"
+	if route.File != "" {
+		var err error
+		if body, err = os.ReadFile(route.File); err != nil {
+			m.log.logf("Error reading mock fixture %s: %v", route.File, err)
+			renderError(w, r, http.StatusInternalServerError, m.ui)
+			return
+		}
+		if t := mime.TypeByExtension(filepath.Ext(route.File)); t != "" {
+			contentType = t
+		}
+	} else if len(route.Body) > 0 && route.Body[0] == '"' && !json.Valid(body) {
+		contentType = "text/plain; charset=utf-8"
+	}
+	h := w.Header()
+	if body != nil {
+		h.Set("Content-Type", contentType)
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	for name, value := range route.Headers {
+		h.Set(name, value)
+	}
+	w.WriteHeader(route.Status)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+// serveMocks is the mock stage, answering the requests matching a --mock
+// route and passing the others on to the files
+func serveMocks(m *mockAPI) Middleware {
+	if m == nil {
+		return nil
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h, pattern := m.routes().Handler(r)
+			if pattern == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if lrw := loggedResponse(r); lrw != nil {
+				lrw.note = "mocked by " + pattern
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
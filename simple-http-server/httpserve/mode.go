@@ -0,0 +1,36 @@
+package httpserve
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Operating modes
+const (
+	modeReadOnly  = "ro"
+	modeReadWrite = "rw"
+)
+
+// mutatingMethods are the request methods that can modify the served tree.
+// In read-only mode they are refused before reaching any handler.
+var mutatingMethods = map[string]bool{
+	http.MethodPut: true, http.MethodPost: true, http.MethodPatch: true, http.MethodDelete: true,
+	"PROPPATCH": true, "MKCOL": true, "COPY": true, "MOVE": true, "LOCK": true, "UNLOCK": true,
+}
+
+// validateMode checks the operating mode against the write features that
+// were requested, so a read-only share cannot be made writable by a stray
+// flag
+func validateMode(mode string, writeFlags []string) error {
+	switch mode {
+	case modeReadOnly:
+		if len(writeFlags) > 0 {
+			return fmt.Errorf("%s requires --mode rw", strings.Join(writeFlags, ", "))
+		}
+	case modeReadWrite:
+	default:
+		return fmt.Errorf("invalid mode %q (must be ro or rw)", mode)
+	}
+	return nil
+}
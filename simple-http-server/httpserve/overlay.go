@@ -0,0 +1,147 @@
+package httpserve
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+)
+
+// overlayFS layers several trees: a lookup is answered by the topmost
+// layer holding the name, and directories list the union of every layer,
+// as used for themes and per-environment overrides of a site
+type overlayFS struct {
+	// layers are ordered from the top down
+	layers []fs.FS
+}
+
+// newOverlayFS stacks the overlay directories or archives over base, each
+// one taking precedence over those before it
+func newOverlayFS(base fs.FS, overlays []string, log *serverLog) (*overlayFS, error) {
+	o := &overlayFS{layers: []fs.FS{base}}
+	for _, dir := range overlays {
+		var layer fs.FS
+		if isArchive(dir) {
+			archive, err := openArchive(dir, log)
+			if err != nil {
+				return nil, err
+			}
+			layer = archive
+		} else {
+			absDir, err := resolveDir(dir)
+			if err != nil {
+				return nil, err
+			}
+			if info, err := os.Stat(absDir); err != nil || !info.IsDir() {
+				return nil, fmt.Errorf("overlay is not a directory: %s", absDir)
+			}
+			layer = os.DirFS(absDir)
+		}
+		o.layers = append([]fs.FS{layer}, o.layers...)
+	}
+	return o, nil
+}
+
+// Open returns the name from the topmost layer holding it. Directories are
+// merged with the same directory of the lower layers; a file in an upper
+// layer hides a directory below it and the other way round.
+func (o *overlayFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	var dirs []fs.File
+	for _, layer := range o.layers {
+		f, err := layer.Open(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			closeAll(dirs)
+			return nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			closeAll(dirs)
+			return nil, err
+		}
+		if !info.IsDir() {
+			if len(dirs) == 0 {
+				return f, nil
+			}
+			f.Close()
+			continue
+		}
+		dirs = append(dirs, f)
+	}
+	if len(dirs) == 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &overlayDir{name: name, layers: dirs}, nil
+}
+
+// closeAll closes the given files
+func closeAll(files []fs.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// overlayDir lists a directory merged from several layers
+type overlayDir struct {
+	name    string
+	layers  []fs.File
+	entries []fs.DirEntry
+	read    bool
+}
+
+// Stat describes the directory of the topmost layer
+func (d *overlayDir) Stat() (fs.FileInfo, error) { return d.layers[0].Stat() }
+
+// Close closes the directory in every layer
+func (d *overlayDir) Close() error {
+	closeAll(d.layers)
+	return nil
+}
+
+// Read fails, as directories have no contents of their own
+func (d *overlayDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir returns the next n entries, or all remaining ones when n <= 0.
+// Entries are merged once, sorted by name, upper layers winning.
+func (d *overlayDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		seen := make(map[string]bool)
+		for _, layer := range d.layers {
+			dir, ok := layer.(fs.ReadDirFile)
+			if !ok {
+				continue
+			}
+			entries, err := dir.ReadDir(-1)
+			if err != nil {
+				return nil, &fs.PathError{Op: "readdir", Path: d.name, Err: err}
+			}
+			for _, entry := range entries {
+				if !seen[entry.Name()] {
+					seen[entry.Name()] = true
+					d.entries = append(d.entries, entry)
+				}
+			}
+		}
+		sort.Slice(d.entries, func(i, j int) bool { return d.entries[i].Name() < d.entries[j].Name() })
+		d.read = true
+	}
+	if n > 0 && len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n <= 0 || n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
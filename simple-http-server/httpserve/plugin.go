@@ -0,0 +1,386 @@
+package httpserve
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Plugins are programs started with the server that take part in handling
+// requests. Each one talks JSON lines over its stdin and stdout: it first
+// writes the events it wants, such as {"events": ["request", "upload"]},
+// then answers every event it receives, in any order, with the same id:
+//
+//	-> {"id": 1, "event": "request", "request": {"method": "GET", "path": "/a", ...}}
+//	<- {"id": 1, "action": "deny", "status": 403, "body": "no"}
+//
+// The events are request, sent before auth; auth, sent after it, where a
+// reply may also set the authenticated user; and upload, sent before an
+// uploaded file is stored. The action is continue, or deny with an optional
+// status, headers and body, and a reason that is logged.
+const (
+	pluginEventRequest = "request"
+	pluginEventAuth    = "auth"
+	pluginEventUpload  = "upload"
+)
+
+// pluginTimeout bounds the wait for the reply to a single event
+const pluginTimeout = 10 * time.Second
+
+var (
+	errUploadRejected = errors.New("upload rejected by plugin")
+	errPluginFailed   = errors.New("plugin failed")
+)
+
+// pluginEvent is a line sent to a plugin
+type pluginEvent struct {
+	ID      int64          `json:"id"`
+	Event   string         `json:"event"`
+	Request *pluginRequest `json:"request,omitempty"`
+	Upload  *pluginUpload  `json:"upload,omitempty"`
+}
+
+// pluginRequest describes the request of a request or auth event
+type pluginRequest struct {
+	ID      string      `json:"id"`
+	Method  string      `json:"method"`
+	URL     string      `json:"url"`
+	Path    string      `json:"path"`
+	Remote  string      `json:"remote"`
+	User    string      `json:"user"`
+	Headers http.Header `json:"headers"`
+}
+
+// pluginUpload describes the file of an upload event, which the plugin
+// may read before it is stored
+type pluginUpload struct {
+	Path string `json:"path"`
+	File string `json:"file"`
+	Size int64  `json:"size"`
+}
+
+// pluginReply is a plugin's answer to an event
+type pluginReply struct {
+	ID      int64             `json:"id"`
+	Events  []string          `json:"events"`
+	Action  string            `json:"action"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+	User    string            `json:"user"`
+	Reason  string            `json:"reason"`
+}
+
+// plugin is a running plugin process
+type plugin struct {
+	name   string
+	cmd    *exec.Cmd
+	events map[string]bool
+	exited chan struct{}
+	log    *serverLog
+
+	mu      sync.Mutex
+	stdin   io.WriteCloser
+	nextID  int64
+	pending map[int64]chan pluginReply
+	err     error
+}
+
+// plugins are the running plugins, given events in the order they were
+// started
+type plugins []*plugin
+
+// startPlugins starts the --plugin programs
+func startPlugins(commands []string, log *serverLog) (plugins, error) {
+	var ps plugins
+	for _, command := range commands {
+		p, err := startPlugin(command, log)
+		if err != nil {
+			ps.close()
+			return nil, fmt.Errorf("%s: %v", command, err)
+		}
+		log.logf("Started plugin %s for %s events", p.name, strings.Join(p.subscribed(), ", "))
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// startPlugin runs command and waits for the events it subscribes to
+func startPlugin(command string, log *serverLog) (*plugin, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	p := &plugin{
+		name:    filepath.Base(args[0]),
+		cmd:     cmd,
+		events:  make(map[string]bool),
+		exited:  make(chan struct{}),
+		stdin:   stdin,
+		pending: make(map[int64]chan pluginReply),
+		log:     log,
+	}
+	lines := bufio.NewScanner(stdout)
+	lines.Buffer(nil, 1<<20)
+	hello := make(chan error, 1)
+	go func() {
+		if !lines.Scan() {
+			hello <- fmt.Errorf("exited before listing its events: %v", lines.Err())
+			return
+		}
+		var reply pluginReply
+		if err := json.Unmarshal(lines.Bytes(), &reply); err != nil {
+			hello <- fmt.Errorf("invalid events line: %v", err)
+			return
+		}
+		for _, event := range reply.Events {
+			if event != pluginEventRequest && event != pluginEventAuth && event != pluginEventUpload {
+				hello <- fmt.Errorf("unknown event %q", event)
+				return
+			}
+			p.events[event] = true
+		}
+		hello <- nil
+		p.read(lines)
+	}()
+	select {
+	case err = <-hello:
+	case <-time.After(pluginTimeout):
+		err = errors.New("timed out waiting for its events")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+	return p, nil
+}
+
+// read hands the plugin's replies to the calls waiting for them, failing
+// the pending and later calls once the plugin exits
+func (p *plugin) read(lines *bufio.Scanner) {
+	for lines.Scan() {
+		var reply pluginReply
+		if err := json.Unmarshal(lines.Bytes(), &reply); err != nil {
+			p.log.logf("Error in plugin %s: invalid reply: %v", p.name, err)
+			continue
+		}
+		p.mu.Lock()
+		if ch, ok := p.pending[reply.ID]; ok {
+			delete(p.pending, reply.ID)
+			ch <- reply
+		}
+		p.mu.Unlock()
+	}
+	err := p.cmd.Wait()
+	p.mu.Lock()
+	p.err = fmt.Errorf("plugin %s exited: %v", p.name, err)
+	for id, ch := range p.pending {
+		delete(p.pending, id)
+		close(ch)
+	}
+	p.mu.Unlock()
+	close(p.exited)
+	p.log.logf("Plugin %s exited: %v", p.name, err)
+}
+
+// subscribed lists the events the plugin takes
+func (p *plugin) subscribed() []string {
+	var events []string
+	for _, event := range []string{pluginEventRequest, pluginEventAuth, pluginEventUpload} {
+		if p.events[event] {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// call sends an event to the plugin and waits for its reply
+func (p *plugin) call(e pluginEvent) (pluginReply, error) {
+	ch := make(chan pluginReply, 1)
+	p.mu.Lock()
+	if p.err != nil {
+		p.mu.Unlock()
+		return pluginReply{}, p.err
+	}
+	p.nextID++
+	e.ID = p.nextID
+	line, err := json.Marshal(e)
+	if err == nil {
+		p.pending[e.ID] = ch
+		_, err = p.stdin.Write(append(line, '\n'))
+	}
+	p.mu.Unlock()
+	if err != nil {
+		return pluginReply{}, err
+	}
+
+	timer := time.NewTimer(pluginTimeout)
+	defer timer.Stop()
+	select {
+	case reply, ok := <-ch:
+		if !ok {
+			return pluginReply{}, p.err
+		}
+		if reply.Action != "continue" && reply.Action != "deny" {
+			return pluginReply{}, fmt.Errorf("plugin %s: invalid action %q", p.name, reply.Action)
+		}
+		return reply, nil
+	case <-timer.C:
+		p.mu.Lock()
+		delete(p.pending, e.ID)
+		p.mu.Unlock()
+		return pluginReply{}, fmt.Errorf("plugin %s did not answer within %s", p.name, pluginTimeout)
+	}
+}
+
+// handles reports whether any plugin takes event
+func (ps plugins) handles(event string) bool {
+	for _, p := range ps {
+		if p.events[event] {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatch gives e to every plugin taking it, stopping at the first that
+// denies it. A user set by one plugin is passed on to the next.
+func (ps plugins) dispatch(e pluginEvent) (pluginReply, error) {
+	var result pluginReply
+	for _, p := range ps {
+		if !p.events[e.Event] {
+			continue
+		}
+		reply, err := p.call(e)
+		if err != nil {
+			return pluginReply{}, err
+		}
+		if reply.Action == "deny" {
+			target := ""
+			if e.Request != nil {
+				target = e.Request.Path
+			} else if e.Upload != nil {
+				target = e.Upload.Path
+			}
+			p.log.logf("audit: plugin %s denied the %s event of %s: %s", p.name, e.Event, target, reply.Reason)
+			return reply, nil
+		}
+		if reply.User != "" && e.Request != nil {
+			e.Request.User = reply.User
+			result.User = reply.User
+		}
+	}
+	result.Action = "continue"
+	return result, nil
+}
+
+// vetUpload gives a completely written upload to the plugins taking
+// upload events before it is stored at urlPath, logging their errors to log
+func (ps plugins) vetUpload(file, urlPath string, log *serverLog) error {
+	if !ps.handles(pluginEventUpload) {
+		return nil
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	reply, err := ps.dispatch(pluginEvent{Event: pluginEventUpload, Upload: &pluginUpload{Path: urlPath, File: file, Size: info.Size()}})
+	switch {
+	case err != nil:
+		log.logf("Error in plugin upload event for %s: %v", urlPath, err)
+		return errPluginFailed
+	case reply.Action == "deny":
+		return errUploadRejected
+	}
+	return nil
+}
+
+// close stops the plugins, closing their stdin and killing the ones that
+// don't exit in time
+func (ps plugins) close() {
+	for _, p := range ps {
+		p.mu.Lock()
+		p.stdin.Close()
+		p.mu.Unlock()
+	}
+	for _, p := range ps {
+		select {
+		case <-p.exited:
+		case <-time.After(5 * time.Second):
+			p.cmd.Process.Kill()
+			<-p.exited
+		}
+	}
+}
+
+// pluginStage is the plugin-request or plugin-auth stage, giving each
+// request to the plugins taking event
+func pluginStage(ps plugins, event string, ui uiOptions, log *serverLog) Middleware {
+	if !ps.handles(event) {
+		return nil
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reply, err := ps.dispatch(pluginEvent{Event: event, Request: &pluginRequest{
+				ID:      RequestID(r),
+				Method:  r.Method,
+				URL:     r.URL.RequestURI(),
+				Path:    r.URL.Path,
+				Remote:  r.RemoteAddr,
+				User:    RequestUser(r),
+				Headers: r.Header,
+			}})
+			if err != nil {
+				log.logf("Error in plugin %s event for %s: %v", event, r.URL.Path, err)
+				renderError(w, r, http.StatusBadGateway, ui)
+				return
+			}
+			if reply.Action == "deny" {
+				for name, value := range reply.Headers {
+					w.Header().Set(name, value)
+				}
+				status := reply.Status
+				if status < 200 || status > 599 {
+					status = http.StatusForbidden
+				}
+				if reply.Body == "" {
+					renderError(w, r, status, ui)
+					return
+				}
+				if w.Header().Get("Content-Type") == "" {
+					w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				}
+				w.WriteHeader(status)
+				io.WriteString(w, reply.Body)
+				return
+			}
+			if reply.User != "" {
+				r = withUser(r, reply.User)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
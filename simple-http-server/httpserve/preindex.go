@@ -0,0 +1,188 @@
+package httpserve
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// indexedAsset is what the startup index knows about a single path
+type indexedAsset struct {
+	dir         bool
+	size        int64
+	modTime     time.Time
+	contentType string
+	etag        string
+}
+
+// assetIndex is an in-memory snapshot of a served tree, built once at
+// startup, that answers conditional requests and requests for missing
+// files without touching the disk
+type assetIndex struct {
+	assets map[string]*indexedAsset
+	// walked holds the directories whose complete contents are indexed,
+	// which leaves out directories reached through symlinks
+	walked map[string]bool
+	// trusted skips checking entries against the disk, which is only safe
+	// when the server itself never changes the tree
+	trusted bool
+}
+
+// buildAssetIndex walks fsys and hashes every regular file in it
+func buildAssetIndex(fsys fs.FS, trusted bool) (*assetIndex, error) {
+	idx := &assetIndex{
+		assets:  map[string]*indexedAsset{"/": {dir: true}},
+		walked:  make(map[string]bool),
+		trusted: trusted,
+	}
+	type job struct {
+		name  string
+		asset *indexedAsset
+	}
+	jobs := make(chan job)
+	var wg sync.WaitGroup
+	for range runtime.GOMAXPROCS(0) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				j.asset.etag = hashFile(fsys, j.name)
+				j.asset.contentType = mime.TypeByExtension(path.Ext(j.name))
+				if j.asset.contentType == "" {
+					j.asset.contentType = sniffFile(fsys, j.name)
+				}
+			}
+		}()
+	}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		urlPath := path.Clean("/" + name)
+		if d.IsDir() {
+			if hiddenEntry(path.Dir(urlPath), d.Name()) {
+				return fs.SkipDir
+			}
+			idx.assets[urlPath] = &indexedAsset{dir: true}
+			idx.walked[urlPath] = true
+			return nil
+		}
+		// Follow symlinks to learn what they point to
+		info, err := fs.Stat(fsys, name)
+		if err != nil {
+			return nil
+		}
+		asset := &indexedAsset{dir: info.IsDir(), size: info.Size(), modTime: info.ModTime()}
+		idx.assets[urlPath] = asset
+		if info.Mode().IsRegular() {
+			jobs <- job{name: name, asset: asset}
+		}
+		return nil
+	})
+	close(jobs)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// hashFile returns the ETag of a file's contents, or an empty string when
+// it cannot be read. It uses the same form as the in-memory file cache.
+func hashFile(fsys fs.FS, name string) string {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return ""
+	}
+	return `"` + hex.EncodeToString(sum.Sum(nil)[:8]) + `"`
+}
+
+// sniffFile detects the content type of a file from its first bytes
+func sniffFile(fsys fs.FS, name string) string {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	buf := make([]byte, 512)
+	n, _ := io.ReadFull(f, buf)
+	return http.DetectContentType(buf[:n])
+}
+
+// lookup returns the indexed asset at urlPath and whether the index is
+// sure that nothing exists there
+func (idx *assetIndex) lookup(urlPath string) (*indexedAsset, bool) {
+	if a, ok := idx.assets[urlPath]; ok {
+		return a, false
+	}
+	return nil, idx.trusted && idx.walked[path.Dir(urlPath)]
+}
+
+// serveIndexed answers GET and HEAD requests from the startup index,
+// reporting whether it handled the request. Missing files get an
+// immediate 404 and matching If-None-Match headers a 304; for anything
+// else it only sets the precomputed ETag and Content-Type before the
+// request goes on to the regular file serving.
+func (h *fileHandler) serveIndexed(w http.ResponseWriter, r *http.Request) bool {
+	name := r.URL.Path
+	if strings.HasSuffix(name, "/index.html") {
+		// Leave the redirect to the directory to the file server
+		return false
+	}
+	if strings.HasSuffix(name, "/") {
+		name = path.Join(name, "index.html")
+	}
+	asset, missing := h.index.lookup(name)
+	if missing {
+		if r.URL.Path != name {
+			// Directories without an index.html get a listing
+			return false
+		}
+		renderError(w, r, http.StatusNotFound, h.ui)
+		return true
+	}
+	if asset == nil || asset.dir || asset.etag == "" {
+		return false
+	}
+	if !h.index.trusted {
+		info, err := fs.Stat(h.storage, strings.TrimPrefix(name, "/"))
+		if err != nil || info.Size() != asset.size || !info.ModTime().Equal(asset.modTime) {
+			return false
+		}
+	}
+	w.Header().Set("ETag", asset.etag)
+	w.Header().Set("Content-Type", asset.contentType)
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagListMatches(inm, asset.etag) {
+		h := w.Header()
+		delete(h, "Content-Type")
+		h.Set("Last-Modified", asset.modTime.UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// etagListMatches reports whether an If-None-Match header matches etag,
+// using the weak comparison RFC 9110 requires for it
+func etagListMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
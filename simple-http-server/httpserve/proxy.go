@@ -0,0 +1,112 @@
+package httpserve
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// proxyRoute forwards the requests under a path prefix to an upstream
+// server
+type proxyRoute struct {
+	prefix string
+	target *url.URL
+	proxy  *httputil.ReverseProxy
+}
+
+// proxyRoutes are the --proxy routes, longest prefix first
+type proxyRoutes []*proxyRoute
+
+// parseProxyRoutes parses prefix=URL values. As with nginx, a target
+// without a path receives the full request path, while a target with one,
+// even just "/", gets it in place of the prefix.
+func parseProxyRoutes(values []string, ui uiOptions, log *serverLog) (proxyRoutes, error) {
+	var routes proxyRoutes
+	for _, value := range values {
+		prefix, target, ok := strings.Cut(value, "=")
+		if !ok || prefix == "" || target == "" {
+			return nil, fmt.Errorf("invalid proxy route %q, expected /prefix=http://host:port", value)
+		}
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy target %q, expected an http or https URL", target)
+		}
+		prefix = "/" + strings.Trim(prefix, "/")
+		if prefix == "/" {
+			return nil, fmt.Errorf("invalid proxy route %q, the prefix cannot be /", value)
+		}
+		route := &proxyRoute{prefix: prefix, target: u}
+		route.proxy = &httputil.ReverseProxy{
+			Rewrite:        route.rewrite,
+			ModifyResponse: route.rewriteResponse,
+			// Stream server-sent events and chunked responses as they come
+			FlushInterval: -1,
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				log.logf("proxy: %s %s to %s: %v", r.Method, r.URL.Path, u.Host, err)
+				renderError(w, r, http.StatusBadGateway, ui)
+			},
+		}
+		routes = append(routes, route)
+	}
+	sort.SliceStable(routes, func(i, j int) bool { return len(routes[i].prefix) > len(routes[j].prefix) })
+	return routes, nil
+}
+
+// match returns the route of a request path, or nil to serve it from disk
+func (routes proxyRoutes) match(urlPath string) *proxyRoute {
+	for _, route := range routes {
+		if urlPath == route.prefix || strings.HasPrefix(urlPath, route.prefix+"/") {
+			return route
+		}
+	}
+	return nil
+}
+
+// rewrite points the outgoing request at the target, telling it where the
+// request came from
+func (route *proxyRoute) rewrite(pr *httputil.ProxyRequest) {
+	out := pr.Out.URL
+	out.Scheme, out.Host = route.target.Scheme, route.target.Host
+	if route.target.Path != "" {
+		rest := strings.TrimPrefix(pr.In.URL.Path, route.prefix)
+		out.Path = path.Join(route.target.Path, rest)
+		if strings.HasSuffix(rest, "/") || rest == "" && strings.HasSuffix(route.target.Path, "/") {
+			out.Path += "/"
+		}
+		out.RawPath = ""
+	}
+	switch {
+	case route.target.RawQuery == "":
+	case out.RawQuery == "":
+		out.RawQuery = route.target.RawQuery
+	default:
+		out.RawQuery = route.target.RawQuery + "&" + out.RawQuery
+	}
+	pr.Out.Host = ""
+	pr.SetXForwarded()
+	pr.Out.Header.Set("X-Request-Id", RequestID(pr.In))
+}
+
+// rewriteResponse maps redirects to the target back under the prefix, so
+// clients stay on this server
+func (route *proxyRoute) rewriteResponse(resp *http.Response) error {
+	location, err := resp.Location()
+	if err != nil || location.Host != route.target.Host {
+		return nil
+	}
+	rest := location.Path
+	if route.target.Path != "" {
+		base := strings.TrimSuffix(route.target.Path, "/")
+		if rest != base && !strings.HasPrefix(rest, base+"/") {
+			return nil
+		}
+		rest = route.prefix + strings.TrimPrefix(rest, base)
+	}
+	local := url.URL{Path: rest, RawQuery: location.RawQuery, Fragment: location.Fragment}
+	resp.Header.Set("Location", local.String())
+	return nil
+}
@@ -0,0 +1,449 @@
+package httpserve
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// qrVersion describes the blocks of a QR code version at error correction
+// level M: the EC codewords per block and the data codewords of each block
+type qrVersion struct {
+	ecPerBlock int
+	blocks     []int
+	alignment  []int
+}
+
+// qrVersions are versions 1 to 10, enough for URLs of up to 213 bytes
+var qrVersions = []qrVersion{
+	{10, []int{16}, nil},
+	{16, []int{28}, []int{6, 18}},
+	{26, []int{44}, []int{6, 22}},
+	{18, []int{32, 32}, []int{6, 26}},
+	{24, []int{43, 43}, []int{6, 30}},
+	{16, []int{27, 27, 27, 27}, []int{6, 34}},
+	{18, []int{31, 31, 31, 31}, []int{6, 22, 38}},
+	{22, []int{38, 38, 39, 39}, []int{6, 24, 42}},
+	{22, []int{36, 36, 36, 37, 37}, []int{6, 26, 46}},
+	{26, []int{43, 43, 43, 43, 44}, []int{6, 28, 50}},
+}
+
+// qrVersionBits are the BCH coded version numbers of versions 7 and up
+var qrVersionBits = map[int]int{7: 0x07c94, 8: 0x085bc, 9: 0x09a99, 10: 0x0a4d3}
+
+// qrCode is a matrix of modules, true for dark ones, with the function
+// patterns marked so masks leave them alone
+type qrCode struct {
+	size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+// encodeQR encodes data in byte mode with error correction level M, in the
+// smallest version it fits
+func encodeQR(data []byte) (*qrCode, error) {
+	for i, v := range qrVersions {
+		version := i + 1
+		capacity := 0
+		for _, n := range v.blocks {
+			capacity += n
+		}
+		countBits := 8
+		if version >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) > capacity*8 {
+			continue
+		}
+
+		// Mode, length, data, terminator and padding
+		var bits qrBits
+		bits.append(0b0100, 4)
+		bits.append(len(data), countBits)
+		for _, b := range data {
+			bits.append(int(b), 8)
+		}
+		bits.append(0, min(4, capacity*8-len(bits)))
+		for len(bits)%8 != 0 {
+			bits = append(bits, false)
+		}
+		codewords := bits.bytes()
+		for pad := byte(0xec); len(codewords) < capacity; pad ^= 0xec ^ 0x11 {
+			codewords = append(codewords, pad)
+		}
+
+		q := newQRCode(version, v)
+		q.place(interleave(codewords, v))
+		q.applyBestMask()
+		return q, nil
+	}
+	return nil, errors.New("too long for a QR code")
+}
+
+// qrBits is a bit stream, most significant bit first
+type qrBits []bool
+
+func (b *qrBits) append(value, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, value>>i&1 == 1)
+	}
+}
+
+func (b qrBits) bytes() []byte {
+	out := make([]byte, len(b)/8)
+	for i, bit := range b {
+		if bit {
+			out[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return out
+}
+
+// interleave splits the data into blocks, adds their Reed-Solomon codes and
+// interleaves both, as the final message is laid out
+func interleave(data []byte, v qrVersion) []byte {
+	var blocks, ecBlocks [][]byte
+	for _, n := range v.blocks {
+		block := data[:n]
+		data = data[n:]
+		blocks = append(blocks, block)
+		ecBlocks = append(ecBlocks, reedSolomon(block, v.ecPerBlock))
+	}
+	var out []byte
+	for i := range v.blocks[len(v.blocks)-1] {
+		for _, block := range blocks {
+			if i < len(block) {
+				out = append(out, block[i])
+			}
+		}
+	}
+	for i := range v.ecPerBlock {
+		for _, ec := range ecBlocks {
+			out = append(out, ec[i])
+		}
+	}
+	return out
+}
+
+// gfMul multiplies in GF(256) with the QR polynomial x^8+x^4+x^3+x^2+1
+func gfMul(a, b byte) byte {
+	var p byte
+	for ; b > 0; b >>= 1 {
+		if b&1 != 0 {
+			p ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1d
+		}
+	}
+	return p
+}
+
+// reedSolomon returns the n error correction codewords of data
+func reedSolomon(data []byte, n int) []byte {
+	// Generator polynomial (x-1)(x-2)...(x-2^(n-1)), leading term implied
+	gen := make([]byte, n)
+	gen[n-1] = 1
+	root := byte(1)
+	for range n {
+		for j := range n {
+			gen[j] = gfMul(gen[j], root)
+			if j+1 < n {
+				gen[j] ^= gen[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	ec := make([]byte, n)
+	for _, b := range data {
+		factor := b ^ ec[0]
+		copy(ec, ec[1:])
+		ec[n-1] = 0
+		for j := range n {
+			ec[j] ^= gfMul(gen[j], factor)
+		}
+	}
+	return ec
+}
+
+// newQRCode draws the function patterns of a version
+func newQRCode(version int, v qrVersion) *qrCode {
+	size := 17 + 4*version
+	q := &qrCode{size: size, modules: make([][]bool, size), function: make([][]bool, size)}
+	for i := range size {
+		q.modules[i] = make([]bool, size)
+		q.function[i] = make([]bool, size)
+	}
+	for i := range size {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+	for _, corner := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := corner[0]+dx, corner[1]+dy
+				if x < 0 || y < 0 || x >= size || y >= size {
+					continue
+				}
+				d := max(absInt(dx), absInt(dy))
+				q.set(x, y, d != 2 && d != 4)
+			}
+		}
+	}
+	last := len(v.alignment) - 1
+	for i, cy := range v.alignment {
+		for j, cx := range v.alignment {
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				// Overlaps a finder pattern
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(cx+dx, cy+dy, max(absInt(dx), absInt(dy)) != 1)
+				}
+			}
+		}
+	}
+	// Reserve the format areas, drawn once the mask is known
+	q.drawFormat(0)
+	if bits, ok := qrVersionBits[version]; ok {
+		for i := range 18 {
+			dark := bits>>i&1 == 1
+			a, b := size-11+i%3, i/3
+			q.set(a, b, dark)
+			q.set(b, a, dark)
+		}
+	}
+	return q
+}
+
+func absInt(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// set draws a function module
+func (q *qrCode) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+// drawFormat draws both copies of the format information for level M and
+// the mask
+func (q *qrCode) drawFormat(mask int) {
+	data := 0b00<<3 | mask
+	rem := data
+	for range 10 {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+	for i := range 8 {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	// Always dark
+	q.set(8, q.size-8, true)
+}
+
+// place lays the codewords out in the two-module wide zigzag columns
+func (q *qrCode) place(codewords []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			// The vertical timing pattern shifts the columns
+			right = 5
+		}
+		for vert := range q.size {
+			for j := range 2 {
+				x := right - j
+				upward := (right+1)&2 == 0
+				y := vert
+				if upward {
+					y = q.size - 1 - vert
+				}
+				if q.function[y][x] {
+					continue
+				}
+				if i < len(codewords)*8 {
+					q.modules[y][x] = codewords[i/8]>>(7-i%8)&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+// qrMasks are the eight mask conditions
+var qrMasks = []func(x, y int) bool{
+	func(x, y int) bool { return (x+y)%2 == 0 },
+	func(x, y int) bool { return y%2 == 0 },
+	func(x, y int) bool { return x%3 == 0 },
+	func(x, y int) bool { return (x+y)%3 == 0 },
+	func(x, y int) bool { return (x/3+y/2)%2 == 0 },
+	func(x, y int) bool { return x*y%2+x*y%3 == 0 },
+	func(x, y int) bool { return (x*y%2+x*y%3)%2 == 0 },
+	func(x, y int) bool { return ((x+y)%2+x*y%3)%2 == 0 },
+}
+
+// applyMask flips the data modules selected by a mask; applying it twice
+// undoes it
+func (q *qrCode) applyMask(mask int) {
+	for y := range q.size {
+		for x := range q.size {
+			if !q.function[y][x] && qrMasks[mask](x, y) {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// applyBestMask applies the mask with the lowest penalty score
+func (q *qrCode) applyBestMask() {
+	best, bestScore := 0, -1
+	for mask := range qrMasks {
+		q.applyMask(mask)
+		q.drawFormat(mask)
+		if score := q.penalty(); bestScore < 0 || score < bestScore {
+			best, bestScore = mask, score
+		}
+		q.applyMask(mask)
+	}
+	q.applyMask(best)
+	q.drawFormat(best)
+}
+
+// penalty scores the symbol with the four rules of the standard: runs,
+// 2x2 blocks, finder-like patterns and the balance of dark modules
+func (q *qrCode) penalty() int {
+	score, dark := 0, 0
+	at := func(x, y int, transposed bool) bool {
+		if transposed {
+			return q.modules[x][y]
+		}
+		return q.modules[y][x]
+	}
+	for _, transposed := range []bool{false, true} {
+		for y := range q.size {
+			run := 0
+			for x := range q.size {
+				if x > 0 && at(x, y, transposed) == at(x-1, y, transposed) {
+					run++
+				} else {
+					run = 1
+				}
+				if run == 5 {
+					score += 3
+				} else if run > 5 {
+					score++
+				}
+				if x+6 < q.size {
+					var pattern [7]bool
+					for k := range 7 {
+						pattern[k] = at(x+k, y, transposed)
+					}
+					if pattern == [7]bool{true, false, true, true, true, false, true} {
+						light := func(from, to int) bool {
+							for k := from; k < to; k++ {
+								if k >= 0 && k < q.size && at(k, y, transposed) {
+									return false
+								}
+							}
+							return true
+						}
+						if light(x-4, x) || light(x+7, x+11) {
+							score += 40
+						}
+					}
+				}
+			}
+		}
+	}
+	for y := range q.size {
+		for x := range q.size {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x+1 < q.size && y+1 < q.size {
+				c := q.modules[y][x]
+				if c == q.modules[y][x+1] && c == q.modules[y+1][x] && c == q.modules[y+1][x+1] {
+					score += 3
+				}
+			}
+		}
+	}
+	total := q.size * q.size
+	deviation := absInt(dark*20-total*10) / total
+	return score + deviation*10
+}
+
+// render draws the code with half block characters, two rows per line,
+// in black on white whatever the terminal colors, with a quiet zone
+func (q *qrCode) render() string {
+	const quiet = 4
+	dark := func(x, y int) bool {
+		x, y = x-quiet, y-quiet
+		return x >= 0 && y >= 0 && x < q.size && y < q.size && q.modules[y][x]
+	}
+	var b strings.Builder
+	width := q.size + 2*quiet
+	for y := 0; y < width; y += 2 {
+		b.WriteString("\x1b[30;47m")
+		for x := range width {
+			top, bottom := dark(x, y), y+1 < width && dark(x, y+1)
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString("\x1b[0m\n")
+	}
+	return b.String()
+}
+
+// lanURL returns the URL other machines on the local network can open:
+// the bound address or, when bound to all, the first private IPv4 address
+// (any IPv4 one otherwise), or IPv6 address on the tcp6 network
+func lanURL(addr string, port int, network string) string {
+	host := "localhost"
+	if ip := net.ParseIP(addr); ip != nil && !ip.IsUnspecified() {
+		host = ip.String()
+	} else if addr != "" && ip == nil {
+		host = addr
+	} else {
+		for _, ip := range localIPs() {
+			if (ip.To4() == nil) != (network == "tcp6") {
+				continue
+			}
+			if ip.IsPrivate() || host == "localhost" {
+				host = ip.String()
+				if ip.IsPrivate() {
+					break
+				}
+			}
+		}
+	}
+	return fmt.Sprintf("http://%s/", net.JoinHostPort(host, fmt.Sprint(port)))
+}
@@ -0,0 +1,178 @@
+package httpserve
+
+import (
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// quotaOptions limits how much data uploads may add to the served tree
+type quotaOptions struct {
+	total   int64
+	perDir  int64
+	minFree int64
+}
+
+// storageError is an upload refusal answered with 507 Insufficient Storage
+type storageError struct {
+	messageKey string
+}
+
+func (e *storageError) Error() string {
+	return catalogs["en"].T(e.messageKey)
+}
+
+var (
+	errQuotaExceeded    = &storageError{"error.quota"}
+	errDirQuotaExceeded = &storageError{"error.dirquota"}
+	errDiskFull         = &storageError{"error.diskfull"}
+)
+
+// quotaUsageTTL is how long a measured tree size is trusted before the
+// tree is walked again
+const quotaUsageTTL = 30 * time.Second
+
+// quotaTracker enforces the upload quotas of a single served directory
+type quotaTracker struct {
+	root string
+	opts quotaOptions
+
+	mu       sync.Mutex
+	used     int64
+	measured time.Time
+}
+
+// newQuotaTracker returns nil when no limit is configured
+func newQuotaTracker(root string, opts quotaOptions) *quotaTracker {
+	if opts.total <= 0 && opts.perDir <= 0 && opts.minFree <= 0 {
+		return nil
+	}
+	return &quotaTracker{root: root, opts: opts}
+}
+
+// budget returns how many bytes may still be written into dir
+func (q *quotaTracker) budget(dir string) (int64, error) {
+	remaining, limit, err := q.remaining(dir)
+	if err != nil {
+		return 0, err
+	}
+	if remaining <= 0 {
+		return 0, limit
+	}
+	return remaining, nil
+}
+
+// exceeded returns the error for an upload into dir that went over budget
+func (q *quotaTracker) exceeded(dir string) error {
+	_, limit, err := q.remaining(dir)
+	if err != nil {
+		return err
+	}
+	if limit != nil {
+		return limit
+	}
+	return errQuotaExceeded
+}
+
+// add accounts for a newly stored file
+func (q *quotaTracker) add(n int64) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	q.used += n
+	q.mu.Unlock()
+}
+
+// remaining computes the tightest of the configured limits for dir and
+// the error describing it
+func (q *quotaTracker) remaining(dir string) (int64, *storageError, error) {
+	// Leave room for the extra byte used to detect oversized uploads
+	remaining := int64(math.MaxInt64 - 1)
+	var limit *storageError
+	if q == nil {
+		return remaining, nil, nil
+	}
+	if q.opts.total > 0 {
+		used, err := q.usage()
+		if err != nil {
+			return 0, nil, err
+		}
+		if left := q.opts.total - used; left < remaining {
+			remaining, limit = left, errQuotaExceeded
+		}
+	}
+	if q.opts.perDir > 0 {
+		used, err := dirUsage(dir)
+		if err != nil {
+			return 0, nil, err
+		}
+		if left := q.opts.perDir - used; left < remaining {
+			remaining, limit = left, errDirQuotaExceeded
+		}
+	}
+	if q.opts.minFree > 0 {
+		free, err := freeSpace(dir)
+		if err != nil {
+			return 0, nil, err
+		}
+		if free >= 0 {
+			if left := free - q.opts.minFree; left < remaining {
+				remaining, limit = left, errDiskFull
+			}
+		}
+	}
+	return remaining, limit, nil
+}
+
+// usage returns the total size of the tree, walking it again once the
+// cached value is older than quotaUsageTTL
+func (q *quotaTracker) usage() (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if time.Since(q.measured) < quotaUsageTTL {
+		return q.used, nil
+	}
+	var total int64
+	err := filepath.WalkDir(q.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			total += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	q.used, q.measured = total, time.Now()
+	return total, nil
+}
+
+// dirUsage returns the total size of the files directly inside dir
+func dirUsage(dir string) (int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return 0, err
+		}
+		total += info.Size()
+	}
+	return total, nil
+}
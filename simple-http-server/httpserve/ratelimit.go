@@ -0,0 +1,94 @@
+package httpserve
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter allows each client address a sustained rate of requests
+// with bursts up to a limit, using a token bucket per client
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	clients map[string]*tokenBucket
+	swept   time.Time
+}
+
+// tokenBucket holds the requests a client may still send right away
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter of rate requests per second per
+// client, or nil when rate is 0
+func newRateLimiter(rate float64, burst int) (*rateLimiter, error) {
+	switch {
+	case rate < 0:
+		return nil, fmt.Errorf("--rate-limit must not be negative")
+	case rate == 0:
+		return nil, nil
+	case burst < 1:
+		return nil, fmt.Errorf("--rate-burst must be at least 1")
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), clients: make(map[string]*tokenBucket)}, nil
+}
+
+// allow takes a token from the client's bucket, returning false and how
+// long until the next one when it is empty
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.swept) > time.Minute {
+		l.sweep(now)
+	}
+	b, ok := l.clients[client]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.clients[client] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep forgets the clients whose buckets have filled up again, as they
+// would start over from a full bucket anyway
+func (l *rateLimiter) sweep(now time.Time) {
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for client, b := range l.clients {
+		if now.Sub(b.last) >= full {
+			delete(l.clients, client)
+		}
+	}
+	l.swept = now
+}
+
+// admit answers the request with 429 Too Many Requests and returns false
+// when its client is over the limit
+func (l *rateLimiter) admit(w http.ResponseWriter, r *http.Request, ui uiOptions) bool {
+	if l == nil {
+		return true
+	}
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	ok, wait := l.allow(client, time.Now())
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(wait.Seconds())))))
+		renderErrorMessage(w, r, http.StatusTooManyRequests, ui, "error.throttled")
+	}
+	return ok
+}
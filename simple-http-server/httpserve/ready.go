@@ -0,0 +1,55 @@
+package httpserve
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ListenError is returned by Run when the server could not listen on its
+// addresses, telling bind failures apart from those of a running server
+type ListenError struct {
+	Err error
+}
+
+func (e *ListenError) Error() string { return e.Err.Error() }
+func (e *ListenError) Unwrap() error { return e.Err }
+
+// signalReady writes the bound addresses, one per line, to the file of
+// --ready-file and the descriptor of --ready-fd. The file is written under
+// a temporary name and renamed, so it never appears half written.
+func signalReady(cfg Config, addrs []string) error {
+	data := []byte(strings.Join(addrs, "\n") + "\n")
+	if cfg.ReadyFile != "" {
+		tmp, err := os.CreateTemp(filepath.Dir(cfg.ReadyFile), ".ready-*")
+		if err != nil {
+			return err
+		}
+		_, err = tmp.Write(data)
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), cfg.ReadyFile)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	if cfg.ReadyFD > 0 {
+		f := os.NewFile(uintptr(cfg.ReadyFD), "ready-fd")
+		if f == nil {
+			return errors.New("invalid --ready-fd")
+		}
+		_, err := f.Write(data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,363 @@
+package httpserve
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// harTrailer closes the entries of the HAR file, rewritten after each one
+// so the file stays valid while it grows
+const harTrailer = "\n]}}\n"
+
+// harRedacted replaces the credentials left out of the HAR file
+const harRedacted = "***"
+
+// harCredentialHeaders are the headers carrying credentials, recorded only
+// with --record-credentials
+var harCredentialHeaders = map[string]bool{"Authorization": true, "Proxy-Authorization": true, "Cookie": true, "Set-Cookie": true}
+
+// HAR 1.2 structures, the subset written by --record
+type (
+	harLog struct {
+		Version string     `json:"version"`
+		Creator harCreator `json:"creator"`
+	}
+	harCreator struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	harEntry struct {
+		StartedDateTime time.Time   `json:"startedDateTime"`
+		Time            float64     `json:"time"`
+		Request         harRequest  `json:"request"`
+		Response        harResponse `json:"response"`
+		Cache           struct{}    `json:"cache"`
+		Timings         harTimings  `json:"timings"`
+		ClientAddress   string      `json:"_clientAddress,omitempty"`
+		RequestID       string      `json:"_requestId,omitempty"`
+	}
+	harRequest struct {
+		Method      string       `json:"method"`
+		URL         string       `json:"url"`
+		HTTPVersion string       `json:"httpVersion"`
+		Cookies     []harNameVal `json:"cookies"`
+		Headers     []harNameVal `json:"headers"`
+		QueryString []harNameVal `json:"queryString"`
+		PostData    *harPostData `json:"postData,omitempty"`
+		HeadersSize int          `json:"headersSize"`
+		BodySize    int64        `json:"bodySize"`
+	}
+	harResponse struct {
+		Status      int          `json:"status"`
+		StatusText  string       `json:"statusText"`
+		HTTPVersion string       `json:"httpVersion"`
+		Cookies     []harNameVal `json:"cookies"`
+		Headers     []harNameVal `json:"headers"`
+		Content     harContent   `json:"content"`
+		RedirectURL string       `json:"redirectURL"`
+		HeadersSize int          `json:"headersSize"`
+		BodySize    int64        `json:"bodySize"`
+	}
+	harNameVal struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	harPostData struct {
+		MimeType  string `json:"mimeType"`
+		Text      string `json:"text"`
+		Encoding  string `json:"_encoding,omitempty"`
+		Truncated bool   `json:"_truncated,omitempty"`
+	}
+	harContent struct {
+		Size      int64  `json:"size"`
+		MimeType  string `json:"mimeType"`
+		Text      string `json:"text,omitempty"`
+		Encoding  string `json:"encoding,omitempty"`
+		Truncated bool   `json:"_truncated,omitempty"`
+	}
+	harTimings struct {
+		Send    float64 `json:"send"`
+		Wait    float64 `json:"wait"`
+		Receive float64 `json:"receive"`
+	}
+)
+
+// newHARLog returns the log fields of a HAR file, naming the server as
+// its creator
+func newHARLog() harLog {
+	creator := harCreator{Name: "simple-http-server", Version: "devel"}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		creator.Version = info.Main.Version
+	}
+	return harLog{Version: "1.2", Creator: creator}
+}
+
+// harRecorder appends the requests it is given to a HAR file
+type harRecorder struct {
+	maxBody     int64
+	credentials bool // keep the credentials of the requests
+	log         *serverLog
+
+	mu      sync.Mutex
+	f       *os.File
+	entries int
+}
+
+// newHARRecorder creates the HAR file, replacing any previous one. Only
+// its owner can read it, as it may hold credentials and the bodies.
+func newHARRecorder(path string, maxBody int64, credentials bool, log *serverLog) (*harRecorder, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	head, err := json.Marshal(newHARLog())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	// The entries go after the other fields of the log
+	head = append(head[:len(head)-1], `,"entries":[`...)
+	if _, err := f.Write(append([]byte(`{"log":`), append(head, harTrailer...)...)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	// OpenFile keeps the mode of an existing file
+	if err := f.Chmod(0o600); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &harRecorder{maxBody: maxBody, credentials: credentials, log: log, f: f}, nil
+}
+
+// add appends an entry, in place of the trailer
+func (h *harRecorder) add(e *harEntry) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		h.log.logf("Error recording %s %s: %v", e.Request.Method, e.Request.URL, err)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sep := ",\n"
+	if h.entries == 0 {
+		sep = "\n"
+	}
+	if _, err := h.f.Seek(-int64(len(harTrailer)), io.SeekEnd); err == nil {
+		_, err = h.f.Write(append(append([]byte(sep), data...), harTrailer...))
+	}
+	if err != nil {
+		h.log.logf("Error recording %s %s: %v", e.Request.Method, e.Request.URL, err)
+		return
+	}
+	h.entries++
+}
+
+func (h *harRecorder) close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.f.Close()
+}
+
+// harCapture keeps the first bytes of a body, counting all of them
+type harCapture struct {
+	buf   bytes.Buffer
+	limit int64
+	size  int64
+}
+
+func (c *harCapture) keep(b []byte) {
+	c.size += int64(len(b))
+	if room := c.limit - int64(c.buf.Len()); room > 0 {
+		c.buf.Write(b[:min(int64(len(b)), room)])
+	}
+}
+
+func (c *harCapture) truncated() bool {
+	return c.size > int64(c.buf.Len())
+}
+
+// text returns the kept bytes, base64 encoded unless valid UTF-8
+func (c *harCapture) text() (text, encoding string) {
+	if utf8.Valid(c.buf.Bytes()) {
+		return c.buf.String(), ""
+	}
+	return base64.StdEncoding.EncodeToString(c.buf.Bytes()), "base64"
+}
+
+// recordBody keeps the request body as the handler reads it
+type recordBody struct {
+	io.ReadCloser
+	capture *harCapture
+}
+
+func (b *recordBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.capture.keep(p[:n])
+	return n, err
+}
+
+// recordWriter keeps the status, time to first byte and body of a response
+type recordWriter struct {
+	http.ResponseWriter
+	status    int
+	firstByte time.Time
+	capture   *harCapture
+}
+
+func (rw *recordWriter) WriteHeader(code int) {
+	if rw.status == 0 {
+		rw.status = code
+		rw.firstByte = time.Now()
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *recordWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.capture.keep(b[:n])
+	return n, err
+}
+
+func (rw *recordWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (rw *recordWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// recordRequests is the record stage
+func recordRequests(h *harRecorder) Middleware {
+	if h == nil {
+		return nil
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			e := &harEntry{StartedDateTime: start.UTC(), ClientAddress: r.RemoteAddr, RequestID: RequestID(r)}
+			e.Request = harRequestOf(r, h.credentials)
+			var reqBody *harCapture
+			if r.Body != nil && r.Body != http.NoBody {
+				reqBody = &harCapture{limit: h.maxBody}
+				r.Body = &recordBody{ReadCloser: r.Body, capture: reqBody}
+			}
+			rw := &recordWriter{ResponseWriter: w, capture: &harCapture{limit: h.maxBody}}
+			next.ServeHTTP(rw, r)
+			end := time.Now()
+			if rw.status == 0 {
+				// Hijacked connections never write a status
+				rw.status, rw.firstByte = http.StatusOK, end
+				if r.Header.Get("Upgrade") != "" {
+					rw.status = http.StatusSwitchingProtocols
+				}
+			}
+			if reqBody != nil {
+				e.Request.BodySize = reqBody.size
+				text, encoding := reqBody.text()
+				e.Request.PostData = &harPostData{MimeType: r.Header.Get("Content-Type"), Text: text, Encoding: encoding, Truncated: reqBody.truncated()}
+			}
+			header := w.Header()
+			text, encoding := rw.capture.text()
+			e.Response = harResponse{
+				Status:      rw.status,
+				StatusText:  http.StatusText(rw.status),
+				HTTPVersion: r.Proto,
+				Cookies:     []harNameVal{},
+				Headers:     harHeaders(header, h.credentials),
+				Content:     harContent{Size: rw.capture.size, MimeType: header.Get("Content-Type"), Text: text, Encoding: encoding, Truncated: rw.capture.truncated()},
+				RedirectURL: header.Get("Location"),
+				HeadersSize: -1,
+				BodySize:    rw.capture.size,
+			}
+			e.Time = milliseconds(end.Sub(start))
+			e.Timings = harTimings{Wait: milliseconds(rw.firstByte.Sub(start)), Receive: milliseconds(end.Sub(rw.firstByte))}
+			h.add(e)
+		})
+	}
+}
+
+// harRequestOf describes a request as it came in, redacting its
+// credentials unless told to keep them
+func harRequestOf(r *http.Request, credentials bool) harRequest {
+	req := harRequest{
+		Method:      r.Method,
+		URL:         requestURL(r),
+		HTTPVersion: r.Proto,
+		Cookies:     []harNameVal{},
+		Headers:     harHeaders(r.Header, credentials),
+		QueryString: []harNameVal{},
+		HeadersSize: -1,
+	}
+	query := r.URL.Query()
+	if !credentials && query.Has(linkParam) {
+		query.Set(linkParam, harRedacted)
+		u := *r.URL
+		u.RawQuery = query.Encode()
+		req.URL = requestURL(&http.Request{URL: &u, Host: r.Host, TLS: r.TLS})
+	}
+	for name, values := range query {
+		for _, value := range values {
+			req.QueryString = append(req.QueryString, harNameVal{Name: name, Value: value})
+		}
+	}
+	sort.Slice(req.QueryString, func(i, j int) bool { return req.QueryString[i].Name < req.QueryString[j].Name })
+	for _, c := range r.Cookies() {
+		value := c.Value
+		if !credentials {
+			value = harRedacted
+		}
+		req.Cookies = append(req.Cookies, harNameVal{Name: c.Name, Value: value})
+	}
+	if r.Host != "" {
+		req.Headers = append([]harNameVal{{Name: "Host", Value: r.Host}}, req.Headers...)
+	}
+	return req
+}
+
+// requestURL returns the absolute URL of a request as it came in
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.RequestURI()
+}
+
+// harHeaders lists the headers by name, redacting harCredentialHeaders
+// unless told to keep them
+func harHeaders(h http.Header, credentials bool) []harNameVal {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := []harNameVal{}
+	for _, name := range names {
+		for _, value := range h[name] {
+			if !credentials && harCredentialHeaders[name] {
+				value = harRedacted
+			}
+			list = append(list, harNameVal{Name: name, Value: value})
+		}
+	}
+	return list
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,78 @@
+package httpserve
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Environment variables passed to the process started by a graceful restart
+const (
+	envListeners = "SIMPLE_HTTP_SERVER_LISTENERS"
+	envParentPID = "SIMPLE_HTTP_SERVER_PARENT_PID"
+)
+
+// openListeners returns the listeners of each address, inherited from a
+// restarting parent or opened anew. TCP addresses get reusePort sockets
+// with SO_REUSEPORT, or a single plain one when it is 0; an address of
+// unix:<path> opens a Unix domain socket with the given permissions.
+func openListeners(addrs []string, opts socketOptions, reusePort int, socketMode os.FileMode) ([][]net.Listener, error) {
+	counts := make([]int, len(addrs))
+	total := 0
+	for i, addr := range addrs {
+		counts[i] = max(reusePort, 1)
+		if strings.HasPrefix(addr, "unix:") {
+			counts[i] = 1
+		}
+		total += counts[i]
+	}
+	inherited, err := inheritedListeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(inherited) > 0 {
+		if len(inherited) != total {
+			return nil, fmt.Errorf("inherited %d listeners where %d were expected, the listen options changed", len(inherited), total)
+		}
+		groups := make([][]net.Listener, len(addrs))
+		for i, ln := range inherited {
+			if unixLn, ok := ln.(*net.UnixListener); ok {
+				// The socket file is ours to remove now
+				unixLn.SetUnlinkOnClose(true)
+			} else {
+				inherited[i] = tunedListener{ln, opts}
+			}
+		}
+		for i, n := range counts {
+			groups[i], inherited = inherited[:n], inherited[n:]
+		}
+		return groups, nil
+	}
+	groups := make([][]net.Listener, 0, len(addrs))
+	closeAll := func() {
+		for _, group := range groups {
+			for _, ln := range group {
+				ln.Close()
+			}
+		}
+	}
+	for i, addr := range addrs {
+		group := make([]net.Listener, 0, counts[i])
+		groups = append(groups, group)
+		for j := 0; j < counts[i]; j++ {
+			var ln net.Listener
+			if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+				ln, err = listenUnix(path, socketMode)
+			} else {
+				ln, err = listen(addr, opts, reusePort > 0)
+			}
+			if err != nil {
+				closeAll()
+				return nil, fmt.Errorf("listening on %s: %v", addr, err)
+			}
+			groups[i] = append(groups[i], ln)
+		}
+	}
+	return groups, nil
+}
@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || freebsd)
+
+package httpserve
+
+import "net"
+
+// Graceful restarts need SIGUSR2 and inherited file descriptors, so they
+// are unavailable on this platform
+
+func inheritedListeners() ([]net.Listener, error) { return nil, nil }
+
+func handleRestarts(listeners []net.Listener, log *serverLog) func() error { return nil }
+
+func finishRestart(log *serverLog) {}
@@ -0,0 +1,111 @@
+//go:build linux || darwin || freebsd
+
+package httpserve
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+)
+
+// inheritedListeners rebuilds the listeners passed as file descriptors
+// 3 and up by a parent performing a graceful restart
+func inheritedListeners() ([]net.Listener, error) {
+	n, err := strconv.Atoi(os.Getenv(envListeners))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	os.Unsetenv(envListeners)
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		f := os.NewFile(uintptr(3+i), "listener")
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inheriting listener %d: %v", i, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// handleRestarts starts a new copy of the running binary on SIGUSR2,
+// handing it the listeners. The new process tells this one to drain and
+// exit once it is serving; if it fails to start, this one keeps serving.
+// The returned function restarts the same way, for the admin API.
+func handleRestarts(listeners []net.Listener, log *serverLog) func() error {
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	go func() {
+		for range usr2 {
+			if err := startChild(listeners, log); err != nil {
+				log.logf("Error starting new process for graceful restart: %v", err)
+			}
+		}
+	}()
+	return func() error { return startChild(listeners, log) }
+}
+
+// startChild forks and execs the current binary with the same arguments
+func startChild(listeners []net.Listener, log *serverLog) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	var sockets []*net.UnixListener
+	for _, ln := range listeners {
+		if tuned, ok := ln.(tunedListener); ok {
+			ln = tuned.Listener
+		}
+		var f *os.File
+		var err error
+		switch l := ln.(type) {
+		case *net.TCPListener:
+			f, err = l.File()
+		case *net.UnixListener:
+			f, err = l.File()
+			sockets = append(sockets, l)
+		default:
+			return fmt.Errorf("cannot pass listener %s", ln.Addr())
+		}
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+	env := append(os.Environ(),
+		envListeners+"="+strconv.Itoa(len(listeners)),
+		envParentPID+"="+strconv.Itoa(os.Getpid()),
+	)
+	proc, err := os.StartProcess(exe, os.Args, &os.ProcAttr{Env: env, Files: files})
+	if err != nil {
+		return err
+	}
+	// The new process keeps serving on the socket files after this one
+	// closes its listeners
+	for _, l := range sockets {
+		l.SetUnlinkOnClose(false)
+	}
+	log.logf("Graceful restart: started process %d", proc.Pid)
+	return nil
+}
+
+// finishRestart asks the parent that started this process to drain its
+// connections and exit
+func finishRestart(log *serverLog) {
+	pid, err := strconv.Atoi(os.Getenv(envParentPID))
+	if err != nil || pid != os.Getppid() {
+		return
+	}
+	os.Unsetenv(envParentPID)
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		log.logf("Error stopping previous process %d: %v", pid, err)
+		return
+	}
+	log.logf("Graceful restart: took over the listeners from process %d", pid)
+}
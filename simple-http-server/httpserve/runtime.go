@@ -0,0 +1,61 @@
+package httpserve
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// runtimeOptions tunes the Go scheduler and garbage collector
+type runtimeOptions struct {
+	maxProcs  int
+	memLimit  string
+	gcPercent int
+}
+
+// tuneRuntime sizes GOMAXPROCS to the container's CPU quota unless it was
+// given explicitly, and applies the GC settings. Since Go 1.25 the runtime
+// follows the quota by itself, in which case this only lowers it for older
+// toolchains.
+func tuneRuntime(opts runtimeOptions, log *serverLog) error {
+	switch {
+	case opts.maxProcs > 0:
+		runtime.GOMAXPROCS(opts.maxProcs)
+	case os.Getenv("GOMAXPROCS") == "":
+		if cores, ok := cgroupCPULimit(); ok {
+			n := max(1, int(math.Ceil(cores)))
+			if n < runtime.GOMAXPROCS(0) {
+				runtime.GOMAXPROCS(n)
+			}
+			log.logf("Detected a CPU quota of %.2f cores", cores)
+		}
+	}
+
+	if opts.memLimit != "" {
+		var limit int64
+		if strings.EqualFold(opts.memLimit, "auto") {
+			// Leave headroom for memory the Go runtime does not manage
+			cgroupLimit, ok := cgroupMemoryLimit()
+			if !ok {
+				return fmt.Errorf("--gomemlimit auto: no cgroup memory limit found")
+			}
+			limit = cgroupLimit / 10 * 9
+		} else {
+			var size byteSize
+			if err := size.Set(opts.memLimit); err != nil {
+				return fmt.Errorf("--gomemlimit: %v", err)
+			}
+			limit = int64(size)
+		}
+		debug.SetMemoryLimit(limit)
+		log.logf("Set the Go memory limit to %s", FormatSize(limit))
+	}
+	if opts.gcPercent != 0 {
+		debug.SetGCPercent(opts.gcPercent)
+	}
+	log.logf("Using GOMAXPROCS=%d", runtime.GOMAXPROCS(0))
+	return nil
+}
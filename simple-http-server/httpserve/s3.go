@@ -0,0 +1,266 @@
+package httpserve
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// emptyPayloadHash is the SHA-256 of an empty request body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Store talks to an S3 compatible bucket, signing requests with AWS
+// Signature Version 4 unless no credentials are configured
+type s3Store struct {
+	client       *http.Client
+	base         string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// openS3FS serves the bucket of an s3://bucket/prefix URL. Credentials and
+// the region come from the usual AWS_* environment variables, and the
+// region and endpoint can be given as URL parameters for S3 compatible
+// services, e.g. s3://bucket?endpoint=http://localhost:9000.
+func openS3FS(u *url.URL, _ *serverLog) (fs.FS, error) {
+	q := u.Query()
+	s := &s3Store{
+		region:       firstNonEmpty(q.Get("region"), os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if (s.accessKey == "") != (s.secretKey == "") {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set together")
+	}
+	bucket := u.Host
+	if endpoint := firstNonEmpty(q.Get("endpoint"), os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL")); endpoint != "" {
+		// Custom endpoints are addressed path style
+		s.base = strings.TrimSuffix(endpoint, "/") + "/" + s3Escape(bucket, false)
+	} else if strings.Contains(bucket, ".") {
+		// Dotted bucket names break TLS for virtual hosted style
+		s.base = "https://s3." + s.region + ".amazonaws.com/" + bucket
+	} else {
+		s.base = "https://" + bucket + ".s3." + s.region + ".amazonaws.com"
+	}
+	s.client = storageClient()
+	return &objectFS{store: s, prefix: strings.Trim(u.Path, "/")}, nil
+}
+
+// firstNonEmpty returns the first of values that is not empty
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// head returns the size and modification time of an object
+func (s *s3Store) head(key string) (objectInfo, error) {
+	resp, err := s.do(http.MethodHead, key, nil, nil)
+	if err != nil {
+		return objectInfo{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return objectInfo{name: key, size: resp.ContentLength, modTime: modTime}, nil
+}
+
+// get streams an object from offset on
+func (s *s3Store) get(key string, offset int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	resp, err := s.do(http.MethodGet, key, nil, header)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// s3ListResult is the response of ListObjectsV2
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	NextContinuationToken string
+}
+
+// list returns one page of the keys below prefix, delimited by slashes
+func (s *s3Store) list(prefix, token string, limit int) (objectPage, error) {
+	query := url.Values{"list-type": {"2"}, "delimiter": {"/"}}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	if limit > 0 {
+		query.Set("max-keys", strconv.Itoa(limit))
+	}
+	resp, err := s.do(http.MethodGet, "", query, nil)
+	if err != nil {
+		return objectPage{}, err
+	}
+	defer resp.Body.Close()
+	var result s3ListResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return objectPage{}, fmt.Errorf("decoding bucket listing: %v", err)
+	}
+	page := objectPage{next: result.NextContinuationToken}
+	for _, c := range result.Contents {
+		page.objects = append(page.objects, objectInfo{name: c.Key, size: c.Size, modTime: c.LastModified})
+	}
+	for _, p := range result.CommonPrefixes {
+		page.prefixes = append(page.prefixes, p.Prefix)
+	}
+	return page, nil
+}
+
+// do sends a signed request for key, or for the bucket itself when key is
+// empty, and turns error responses into errors
+func (s *s3Store) do(method, key string, query url.Values, header http.Header) (*http.Response, error) {
+	target := s.base + "/" + s3Escape(key, true)
+	req, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if header != nil {
+		req.Header = header
+	}
+	req.URL.RawQuery = s3CanonicalQuery(query)
+	s.sign(req, time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var s3Err struct {
+		Code    string
+		Message string
+	}
+	xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&s3Err)
+	return nil, storageStatusError(resp, "s3 "+method+" /"+key, s3Err.Code+" "+s3Err.Message)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to a request
+// without a body
+func (s *s3Store) sign(req *http.Request, now time.Time) {
+	if s.accessKey == "" {
+		return
+	}
+	signAWS(req, emptyPayloadHash, s.region, "s3", s.accessKey, s.secretKey, s.sessionToken, now)
+}
+
+// signAWS adds an AWS Signature Version 4 Authorization header for service
+// to a request whose body has the given SHA-256
+func signAWS(req *http.Request, payloadHash, region, service, accessKey, secretKey, sessionToken string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	signed := []string{"host"}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			signed = append(signed, lower)
+		}
+	}
+	sort.Strings(signed)
+	var headers strings.Builder
+	for _, name := range signed {
+		value := req.URL.Host
+		if name != "host" {
+			value = strings.TrimSpace(req.Header.Get(name))
+		}
+		headers.WriteString(name + ":" + value + "\n")
+	}
+	signedHeaders := strings.Join(signed, ";")
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{day, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data under key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but the unreserved characters of
+// RFC 3986, and slashes when keepSlash is set, as Signature Version 4
+// requires
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3CanonicalQuery encodes query parameters sorted by name, the form that
+// is both sent and signed
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
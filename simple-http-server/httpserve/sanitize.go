@@ -0,0 +1,63 @@
+package httpserve
+
+import (
+	"errors"
+	"net/url"
+	"path"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// pathPolicy configures how request paths are sanitized before serving
+type pathPolicy struct {
+	nfc                  bool
+	rejectEncodedSlashes bool
+}
+
+var (
+	errEncodedTraversal = errors.New("encoded traversal sequence")
+	errDoubleEncoding   = errors.New("double percent-encoding")
+	errEncodedSlash     = errors.New("encoded path separator")
+	errTraversal        = errors.New("parent directory reference")
+	errInvalidChar      = errors.New("invalid character")
+)
+
+// sanitizePath validates the path of u and returns its normalized form
+func sanitizePath(u *url.URL, policy pathPolicy) (string, error) {
+	raw := strings.ToLower(u.EscapedPath())
+
+	// Reject sequences that only have a meaning once decoded
+	switch {
+	case strings.Contains(raw, "%25"):
+		return "", errDoubleEncoding
+	case strings.Contains(raw, "%2e"), strings.Contains(raw, "%00"):
+		return "", errEncodedTraversal
+	case policy.rejectEncodedSlashes && (strings.Contains(raw, "%2f") || strings.Contains(raw, "%5c")):
+		return "", errEncodedSlash
+	}
+
+	p := u.Path
+	for _, c := range p {
+		if c == '\\' || unicode.IsControl(c) || c == unicode.ReplacementChar {
+			return "", errInvalidChar
+		}
+	}
+	for _, segment := range strings.Split(p, "/") {
+		if segment == ".." {
+			return "", errTraversal
+		}
+	}
+
+	// Normalize Unicode and collapse duplicate slashes, keeping the trailing
+	// slash that marks a directory
+	if policy.nfc {
+		p = norm.NFC.String(p)
+	}
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned, nil
+}
@@ -0,0 +1,52 @@
+package httpserve
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestSanitizePath(t *testing.T) {
+	strict := pathPolicy{nfc: true, rejectEncodedSlashes: true}
+	tests := []struct {
+		name   string
+		target string // request target, as sent on the wire
+		policy pathPolicy
+		want   string
+		err    error
+	}{
+		{"root", "/", pathPolicy{}, "/", nil},
+		{"file", "/docs/a.txt", pathPolicy{}, "/docs/a.txt", nil},
+		{"directory keeps its slash", "/docs/", pathPolicy{}, "/docs/", nil},
+		{"duplicate slashes", "//docs///a.txt", pathPolicy{}, "/docs/a.txt", nil},
+		{"dot segments", "/docs/./a.txt", pathPolicy{}, "/docs/a.txt", nil},
+		{"encoded space", "/my%20file.txt", pathPolicy{}, "/my file.txt", nil},
+		{"traversal", "/docs/../etc/passwd", pathPolicy{}, "", errTraversal},
+		{"traversal at the start", "/../a", pathPolicy{}, "", errTraversal},
+		{"dots in a name", "/a..b/c", pathPolicy{}, "/a..b/c", nil},
+		{"encoded dot", "/%2e%2e/etc/passwd", pathPolicy{}, "", errEncodedTraversal},
+		{"encoded dot upper case", "/%2E%2E/etc/passwd", pathPolicy{}, "", errEncodedTraversal},
+		{"encoded NUL", "/a%00.txt", pathPolicy{}, "", errEncodedTraversal},
+		{"double encoding", "/%252e%252e/etc", pathPolicy{}, "", errDoubleEncoding},
+		{"backslash", "/a%5cb", pathPolicy{}, "", errInvalidChar},
+		{"control character", "/a%0ab", pathPolicy{}, "", errInvalidChar},
+		{"invalid UTF-8", "/a%ffb", pathPolicy{}, "", errInvalidChar},
+		{"encoded slash allowed", "/a%2fb", pathPolicy{}, "/a/b", nil},
+		{"encoded slash rejected", "/a%2Fb", strict, "", errEncodedSlash},
+		{"encoded backslash rejected", "/a%5Cb", strict, "", errEncodedSlash},
+		{"NFD kept without --path-nfc", "/cafe%CC%81", pathPolicy{}, "/cafe\u0301", nil},
+		{"NFD normalized", "/cafe%CC%81", strict, "/caf\u00e9", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.ParseRequestURI(tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := sanitizePath(u, tt.policy)
+			if !errors.Is(err, tt.err) || got != tt.want {
+				t.Errorf("sanitizePath(%q) = %q, %v, want %q, %v", tt.target, got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
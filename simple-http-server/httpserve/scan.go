@@ -0,0 +1,184 @@
+package httpserve
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	errUploadInfected = errors.New("file flagged by virus scanner")
+	errScanFailed     = errors.New("virus scan failed")
+)
+
+// scanTimeout bounds a single scan of an uploaded file
+const scanTimeout = 2 * time.Minute
+
+// scanVerdict is the outcome of scanning a file
+type scanVerdict struct {
+	infected  bool
+	signature string
+}
+
+// virusScanner checks a file before it is committed into the served tree
+type virusScanner interface {
+	scan(ctx context.Context, file string) (scanVerdict, error)
+	name() string
+}
+
+// scanOptions configures the upload scanning hook
+type scanOptions struct {
+	scanner    virusScanner
+	quarantine string
+	failOpen   bool
+}
+
+// newVirusScanner builds the scanner from the --scan-clamd and
+// --scan-command flags; at most one of them may be set
+func newVirusScanner(clamd, command string) (virusScanner, error) {
+	switch {
+	case clamd != "" && command != "":
+		return nil, errors.New("--scan-clamd and --scan-command are mutually exclusive")
+	case clamd != "":
+		network, addr, ok := strings.Cut(clamd, ":")
+		if !ok || (network != "unix" && network != "tcp") || addr == "" {
+			return nil, fmt.Errorf("invalid clamd address %q (expected unix:/path or tcp:host:port)", clamd)
+		}
+		return clamdScanner{network: network, addr: addr}, nil
+	case command != "":
+		args := strings.Fields(command)
+		if _, err := exec.LookPath(args[0]); err != nil {
+			return nil, err
+		}
+		return commandScanner{args: args}, nil
+	}
+	return nil, nil
+}
+
+// clamdScanner streams files to a clamd daemon using INSTREAM
+type clamdScanner struct {
+	network string
+	addr    string
+}
+
+func (c clamdScanner) name() string { return "clamd" }
+
+func (c clamdScanner) scan(ctx context.Context, file string) (scanVerdict, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return scanVerdict{}, err
+	}
+	defer f.Close()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.network, c.addr)
+	if err != nil {
+		return scanVerdict{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	chunk := make([]byte, 64*1024)
+	size := make([]byte, 4)
+	for {
+		n, err := f.Read(chunk)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			w.Write(size)
+			w.Write(chunk[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return scanVerdict{}, err
+		}
+	}
+	// A zero length chunk terminates the stream
+	w.Write([]byte{0, 0, 0, 0})
+	if err := w.Flush(); err != nil {
+		return scanVerdict{}, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return scanVerdict{}, err
+	}
+	reply = strings.TrimRight(strings.TrimPrefix(reply, "stream: "), "\x00\n")
+	switch {
+	case reply == "OK":
+		return scanVerdict{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return scanVerdict{infected: true, signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	}
+	return scanVerdict{}, fmt.Errorf("clamd: %s", reply)
+}
+
+// commandScanner runs an external command with the file path appended;
+// exit status 0 means clean and 1 means infected, as with clamdscan
+type commandScanner struct {
+	args []string
+}
+
+func (c commandScanner) name() string { return c.args[0] }
+
+func (c commandScanner) scan(ctx context.Context, file string) (scanVerdict, error) {
+	cmd := exec.CommandContext(ctx, c.args[0], append(c.args[1:], file)...)
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return scanVerdict{}, nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		return scanVerdict{infected: true, signature: strings.TrimSpace(string(out))}, nil
+	}
+	return scanVerdict{}, err
+}
+
+// scanUpload scans a fully written upload before it is committed to
+// target, quarantining or discarding it when flagged
+func (h *fileHandler) scanUpload(tmpName, target string) error {
+	if h.scan.scanner == nil {
+		return nil
+	}
+	rel, _ := filepath.Rel(h.dir, target)
+	ctx, cancel := context.WithTimeout(context.Background(), scanTimeout)
+	defer cancel()
+	verdict, err := h.scan.scanner.scan(ctx, tmpName)
+	if err != nil {
+		h.log.logf("audit: scan of %s by %s failed: %v", rel, h.scan.scanner.name(), err)
+		if h.scan.failOpen {
+			return nil
+		}
+		return errScanFailed
+	}
+	if !verdict.infected {
+		h.log.logf("audit: scan of %s by %s: clean", rel, h.scan.scanner.name())
+		return nil
+	}
+
+	h.log.logf("audit: scan of %s by %s: infected (%s)", rel, h.scan.scanner.name(), verdict.signature)
+	if h.scan.quarantine != "" {
+		name := fmt.Sprintf("%s-%s", time.Now().UTC().Format("20060102T150405"), filepath.Base(target))
+		dest := filepath.Join(h.scan.quarantine, name)
+		if err := os.Rename(tmpName, dest); err != nil {
+			h.log.logf("Error quarantining %s: %v", rel, err)
+		} else {
+			h.log.logf("audit: quarantined %s as %s", rel, dest)
+		}
+	}
+	return errUploadInfected
+}
@@ -0,0 +1,1173 @@
+package httpserve
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Request scripts are written in a small subset of Lua: nil, booleans,
+// integers, strings and lists; local and global assignments; if, while,
+// numeric for and for over ipairs loops; break and return; and the
+// operators or, and, not, comparisons, .., + - * / % and #. Locals are
+// visible to the rest of the script, and match uses Go regular expressions
+// instead of Lua patterns.
+//
+// A script runs for every request with these variables set:
+//
+//	method, path, query, host, remote, user (nil without one), request_id
+//
+// and these functions:
+//
+//	header(name), param(name), cookie(name)   read the request, nil when absent
+//	set_header(name, value)                   set a response header
+//	set_request_header(name, value)           set a request header, nil deletes it
+//	deny(status[, body])                      answer the request and stop
+//	redirect(url[, status])                   redirect, with 302 by default, and stop
+//	rewrite(path)                             serve another path, with ?query to replace it
+//	log(...)                                  log the values
+//	lower, upper, trim, starts_with, ends_with, contains, match, split,
+//	tostring, tonumber, ipairs
+
+// scriptMaxString bounds the strings a script can build
+const scriptMaxString = 1 << 20
+
+// errScriptExit stops a script after deny or redirect
+var errScriptExit = errors.New("exit")
+
+// scriptList is a list value, indexed from 1
+type scriptList []any
+
+// Statements
+type (
+	scriptAssign struct {
+		name  string
+		value scriptExpr
+	}
+	scriptIf struct {
+		conds  []scriptExpr
+		blocks [][]scriptStmt
+		orElse []scriptStmt
+	}
+	scriptWhile struct {
+		cond scriptExpr
+		body []scriptStmt
+	}
+	scriptNumericFor struct {
+		name              string
+		start, stop, step scriptExpr
+		body              []scriptStmt
+	}
+	scriptListFor struct {
+		index, value string
+		list         scriptExpr
+		body         []scriptStmt
+	}
+	scriptCallStmt struct{ call *scriptCall }
+	scriptReturn   struct{}
+	scriptBreak    struct{}
+)
+
+// Expressions
+type (
+	scriptLiteral struct{ value any }
+	scriptName    struct{ name string }
+	scriptCall    struct {
+		name string
+		args []scriptExpr
+	}
+	scriptIndex struct{ list, key scriptExpr }
+	scriptUnary struct {
+		op string
+		x  scriptExpr
+	}
+	scriptBinary struct {
+		op   string
+		x, y scriptExpr
+	}
+)
+
+type scriptExpr any
+
+// scriptStmt is a statement with the line it starts on, for errors
+type scriptStmt struct {
+	line int
+	node any
+}
+
+// script is a parsed request script
+type script struct {
+	name  string
+	body  []scriptStmt
+	steps int
+	log   *serverLog
+
+	mu      sync.Mutex
+	regexps map[string]*regexp.Regexp
+}
+
+// loadScript parses the script file at name, to run with at most steps
+// evaluation steps per request
+func loadScript(name string, steps int, log *serverLog) (*script, error) {
+	if steps < 1 {
+		return nil, errors.New("--script-max-steps must be at least 1")
+	}
+	src, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	body, err := parseScript(string(src))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return &script{name: name, body: body, steps: steps, log: log, regexps: make(map[string]*regexp.Regexp)}, nil
+}
+
+// scriptToken is a lexical token: a punctuator, name, integer or string
+type scriptToken struct {
+	kind byte // 'p', 'n', 'i', 's' or 0 at the end
+	text string
+	line int
+}
+
+// String describes the token in syntax errors
+func (t scriptToken) String() string {
+	if t.kind == 0 {
+		return "the end of the script"
+	}
+	return strconv.Quote(t.text)
+}
+
+// scriptParser is a recursive descent parser of scripts
+type scriptParser struct {
+	src  string
+	pos  int
+	line int
+	tok  scriptToken
+	errs error
+}
+
+// parseScript parses the statements of a script
+func parseScript(src string) ([]scriptStmt, error) {
+	p := &scriptParser{src: src, line: 1}
+	p.next()
+	body := p.block()
+	if p.tok.kind != 0 {
+		p.fail("unexpected %s", p.tok)
+	}
+	if p.errs != nil {
+		return nil, p.errs
+	}
+	return body, nil
+}
+
+// fail records the first syntax error
+func (p *scriptParser) fail(format string, args ...any) {
+	if p.errs == nil {
+		p.errs = fmt.Errorf("syntax error on line %d: %s", p.tok.line, fmt.Sprintf(format, args...))
+	}
+	p.tok = scriptToken{line: p.tok.line}
+}
+
+// is reports whether the current token has the given kind and text
+func (p *scriptParser) is(kind byte, text string) bool {
+	return p.tok.kind == kind && p.tok.text == text
+}
+
+// expect consumes the given punctuator or keyword
+func (p *scriptParser) expect(kind byte, text string) {
+	if !p.is(kind, text) {
+		p.fail("expected %q, found %s", text, p.tok)
+		return
+	}
+	p.next()
+}
+
+// name consumes a name that is not a keyword
+func (p *scriptParser) name() string {
+	if p.tok.kind != 'n' || scriptKeywords[p.tok.text] {
+		p.fail("expected a name, found %s", p.tok)
+		return ""
+	}
+	name := p.tok.text
+	p.next()
+	return name
+}
+
+var scriptKeywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true, "end": true,
+	"false": true, "for": true, "if": true, "in": true, "local": true, "nil": true,
+	"not": true, "or": true, "return": true, "then": true, "true": true, "while": true,
+}
+
+// next reads the following token, skipping whitespace and comments
+func (p *scriptParser) next() {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if strings.HasPrefix(p.src[p.pos:], "--") {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+			continue
+		}
+		if c == '\n' {
+			p.line++
+		} else if c != ' ' && c != '\t' && c != '\r' {
+			break
+		}
+		p.pos++
+	}
+	start := p.pos
+	if p.pos >= len(p.src) {
+		p.tok = scriptToken{line: p.line}
+		return
+	}
+	c := p.src[p.pos]
+	switch {
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		for p.pos < len(p.src) && isNameByte(p.src[p.pos]) {
+			p.pos++
+		}
+		p.tok = scriptToken{kind: 'n', text: p.src[start:p.pos], line: p.line}
+	case c >= '0' && c <= '9':
+		for p.pos < len(p.src) && p.src[p.pos] >= '0' && p.src[p.pos] <= '9' {
+			p.pos++
+		}
+		p.tok = scriptToken{kind: 'i', text: p.src[start:p.pos], line: p.line}
+	case c == '"' || c == '\'':
+		p.tok = scriptToken{kind: 's', text: p.stringLiteral(c), line: p.line}
+	default:
+		for _, punct := range []string{"==", "~=", "<=", ">=", ".."} {
+			if strings.HasPrefix(p.src[p.pos:], punct) {
+				p.pos += 2
+				p.tok = scriptToken{kind: 'p', text: punct, line: p.line}
+				return
+			}
+		}
+		p.pos++
+		p.tok = scriptToken{kind: 'p', text: string(c), line: p.line}
+		if strings.IndexByte("+-*/%#<>=()[],", c) < 0 {
+			p.fail("unexpected character %q", c)
+		}
+	}
+}
+
+// stringLiteral reads a string quoted with quote starting at the cursor
+func (p *scriptParser) stringLiteral(quote byte) string {
+	var b strings.Builder
+	for p.pos++; p.pos < len(p.src); p.pos++ {
+		c := p.src[p.pos]
+		switch {
+		case c == quote:
+			p.pos++
+			return b.String()
+		case c == '\n':
+			p.pos = len(p.src)
+		case c == '\\' && p.pos+1 < len(p.src):
+			p.pos++
+			switch e := p.src[p.pos]; e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '\\', '"', '\'':
+				b.WriteByte(e)
+			default:
+				p.fail("invalid escape \\%c", e)
+				return ""
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	p.fail("unterminated string")
+	return ""
+}
+
+// block parses statements up to a closing keyword or the end
+func (p *scriptParser) block() []scriptStmt {
+	var body []scriptStmt
+	for p.tok.kind != 0 && !p.is('n', "end") && !p.is('n', "else") && !p.is('n', "elseif") {
+		if s, ok := p.statement(); ok {
+			body = append(body, s)
+		}
+	}
+	return body
+}
+
+// statement parses a single statement
+func (p *scriptParser) statement() (scriptStmt, bool) {
+	line := p.tok.line
+	var node any
+	switch {
+	case p.is('n', "local"):
+		p.next()
+		name := p.name()
+		p.expect('p', "=")
+		node = &scriptAssign{name: name, value: p.expr()}
+	case p.is('n', "if"):
+		n := &scriptIf{}
+		for {
+			p.next()
+			n.conds = append(n.conds, p.expr())
+			p.expect('n', "then")
+			n.blocks = append(n.blocks, p.block())
+			if !p.is('n', "elseif") {
+				break
+			}
+		}
+		if p.is('n', "else") {
+			p.next()
+			n.orElse = p.block()
+		}
+		p.expect('n', "end")
+		node = n
+	case p.is('n', "while"):
+		p.next()
+		n := &scriptWhile{cond: p.expr()}
+		p.expect('n', "do")
+		n.body = p.body()
+		node = n
+	case p.is('n', "for"):
+		p.next()
+		name := p.name()
+		if p.is('p', "=") {
+			p.next()
+			n := &scriptNumericFor{name: name, start: p.expr(), step: &scriptLiteral{int64(1)}}
+			p.expect('p', ",")
+			n.stop = p.expr()
+			if p.is('p', ",") {
+				p.next()
+				n.step = p.expr()
+			}
+			p.expect('n', "do")
+			n.body = p.body()
+			node = n
+			break
+		}
+		n := &scriptListFor{index: name}
+		if p.is('p', ",") {
+			p.next()
+			n.value = p.name()
+		}
+		p.expect('n', "in")
+		n.list = p.expr()
+		p.expect('n', "do")
+		n.body = p.body()
+		node = n
+	case p.is('n', "return"):
+		p.next()
+		node = scriptReturn{}
+	case p.is('n', "break"):
+		p.next()
+		node = scriptBreak{}
+	default:
+		switch x := p.postfix().(type) {
+		case *scriptName:
+			p.expect('p', "=")
+			node = &scriptAssign{name: x.name, value: p.expr()}
+		case *scriptCall:
+			node = &scriptCallStmt{call: x}
+		default:
+			if p.errs == nil {
+				p.fail("expected a statement, found %s", p.tok)
+			}
+			return scriptStmt{}, false
+		}
+	}
+	return scriptStmt{line: line, node: node}, p.errs == nil
+}
+
+// body parses the block of a loop up to its end
+func (p *scriptParser) body() []scriptStmt {
+	body := p.block()
+	p.expect('n', "end")
+	return body
+}
+
+// scriptPrecedence lists the binary operators from the loosest binding
+var scriptPrecedence = [][]string{
+	{"or"},
+	{"and"},
+	{"<", ">", "<=", ">=", "~=", "=="},
+	{".."},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+// expr parses an expression
+func (p *scriptParser) expr() scriptExpr {
+	return p.binary(0)
+}
+
+// binary parses the operators of the given precedence level and above,
+// with .. associating to the right like in Lua
+func (p *scriptParser) binary(level int) scriptExpr {
+	if level == len(scriptPrecedence) {
+		return p.unary()
+	}
+	x := p.binary(level + 1)
+	for p.tok.kind == 'p' || p.tok.kind == 'n' {
+		op := p.tok.text
+		if !slices.Contains(scriptPrecedence[level], op) {
+			break
+		}
+		p.next()
+		if op == ".." {
+			return &scriptBinary{op: op, x: x, y: p.binary(level)}
+		}
+		x = &scriptBinary{op: op, x: x, y: p.binary(level + 1)}
+	}
+	return x
+}
+
+// unary parses not, # and negation
+func (p *scriptParser) unary() scriptExpr {
+	if p.is('n', "not") || p.is('p', "#") || p.is('p', "-") {
+		op := p.tok.text
+		p.next()
+		return &scriptUnary{op: op, x: p.unary()}
+	}
+	return p.postfix()
+}
+
+// postfix parses a primary expression followed by any indexes
+func (p *scriptParser) postfix() scriptExpr {
+	x := p.primary()
+	for p.is('p', "[") {
+		p.next()
+		x = &scriptIndex{list: x, key: p.expr()}
+		p.expect('p', "]")
+	}
+	return x
+}
+
+// primary parses a literal, name, call or parenthesized expression
+func (p *scriptParser) primary() scriptExpr {
+	switch {
+	case p.is('n', "nil"):
+		p.next()
+		return &scriptLiteral{nil}
+	case p.is('n', "true"), p.is('n', "false"):
+		v := p.tok.text == "true"
+		p.next()
+		return &scriptLiteral{v}
+	case p.tok.kind == 'i':
+		n, err := strconv.ParseInt(p.tok.text, 10, 64)
+		if err != nil {
+			p.fail("invalid number %s", p.tok)
+			return nil
+		}
+		p.next()
+		return &scriptLiteral{n}
+	case p.tok.kind == 's':
+		s := p.tok.text
+		p.next()
+		return &scriptLiteral{s}
+	case p.is('p', "("):
+		p.next()
+		x := p.expr()
+		p.expect('p', ")")
+		return x
+	}
+	name := p.name()
+	if !p.is('p', "(") {
+		return &scriptName{name: name}
+	}
+	p.next()
+	call := &scriptCall{name: name}
+	for !p.is('p', ")") && p.tok.kind != 0 {
+		call.args = append(call.args, p.expr())
+		if !p.is('p', ",") {
+			break
+		}
+		p.next()
+	}
+	p.expect('p', ")")
+	return call
+}
+
+// scriptFlow tells the enclosing statements how a statement ended
+type scriptFlow int
+
+const (
+	flowNext scriptFlow = iota
+	flowBreak
+	flowReturn
+)
+
+// scriptRun is a single run of a script for a request
+type scriptRun struct {
+	script *script
+	vars   map[string]any
+	steps  int
+	line   int
+
+	r        *http.Request
+	w        http.ResponseWriter
+	status   int
+	body     string
+	location string
+	rewrite  string
+}
+
+// step counts an evaluation step, failing once the script used them all
+func (run *scriptRun) step() error {
+	run.steps++
+	if run.steps > run.script.steps {
+		return fmt.Errorf("exceeded %d steps", run.script.steps)
+	}
+	return nil
+}
+
+// exec runs a block of statements
+func (run *scriptRun) exec(body []scriptStmt) (scriptFlow, error) {
+	for _, s := range body {
+		run.line = s.line
+		if err := run.step(); err != nil {
+			return flowReturn, err
+		}
+		flow, err := run.stmt(s.node)
+		if err != nil || flow != flowNext {
+			return flow, err
+		}
+	}
+	return flowNext, nil
+}
+
+// stmt runs a single statement
+func (run *scriptRun) stmt(node any) (scriptFlow, error) {
+	switch n := node.(type) {
+	case *scriptAssign:
+		v, err := run.eval(n.value)
+		if err != nil {
+			return flowReturn, err
+		}
+		run.vars[n.name] = v
+	case *scriptCallStmt:
+		if _, err := run.eval(n.call); err != nil {
+			return flowReturn, err
+		}
+	case *scriptIf:
+		for i, cond := range n.conds {
+			v, err := run.eval(cond)
+			if err != nil {
+				return flowReturn, err
+			}
+			if scriptTruthy(v) {
+				return run.exec(n.blocks[i])
+			}
+		}
+		return run.exec(n.orElse)
+	case *scriptWhile:
+		for {
+			v, err := run.eval(n.cond)
+			if err != nil || !scriptTruthy(v) {
+				return flowNext, err
+			}
+			if done, flow, err := run.loop(n.body); done {
+				return flow, err
+			}
+		}
+	case *scriptNumericFor:
+		var bounds [3]int64
+		for i, x := range []scriptExpr{n.start, n.stop, n.step} {
+			v, err := run.eval(x)
+			if err != nil {
+				return flowReturn, err
+			}
+			if bounds[i], err = scriptInt(v); err != nil {
+				return flowReturn, fmt.Errorf("for bounds: %v", err)
+			}
+		}
+		if bounds[2] == 0 {
+			return flowReturn, errors.New("for step is 0")
+		}
+		for i := bounds[0]; bounds[2] > 0 && i <= bounds[1] || bounds[2] < 0 && i >= bounds[1]; i += bounds[2] {
+			run.vars[n.name] = i
+			if done, flow, err := run.loop(n.body); done {
+				return flow, err
+			}
+		}
+	case *scriptListFor:
+		v, err := run.eval(n.list)
+		if err != nil {
+			return flowReturn, err
+		}
+		list, ok := v.(scriptList)
+		if !ok {
+			return flowReturn, fmt.Errorf("cannot iterate over %s", scriptType(v))
+		}
+		for i, item := range list {
+			run.vars[n.index] = int64(i + 1)
+			if n.value != "" {
+				run.vars[n.value] = item
+			}
+			if done, flow, err := run.loop(n.body); done {
+				return flow, err
+			}
+		}
+	case scriptBreak:
+		return flowBreak, nil
+	case scriptReturn:
+		return flowReturn, nil
+	}
+	return flowNext, nil
+}
+
+// loop runs the body of a loop, reporting whether the loop ends and how
+// the enclosing block goes on
+func (run *scriptRun) loop(body []scriptStmt) (bool, scriptFlow, error) {
+	flow, err := run.exec(body)
+	switch {
+	case err != nil || flow == flowReturn:
+		return true, flowReturn, err
+	case flow == flowBreak:
+		return true, flowNext, nil
+	}
+	return false, flowNext, nil
+}
+
+// eval evaluates an expression
+func (run *scriptRun) eval(x scriptExpr) (any, error) {
+	if err := run.step(); err != nil {
+		return nil, err
+	}
+	switch x := x.(type) {
+	case *scriptLiteral:
+		return x.value, nil
+	case *scriptName:
+		return run.vars[x.name], nil
+	case *scriptCall:
+		fn, ok := scriptBuiltins[x.name]
+		if !ok {
+			return nil, fmt.Errorf("unknown function %s", x.name)
+		}
+		args := make([]any, len(x.args))
+		for i, arg := range x.args {
+			v, err := run.eval(arg)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = v
+		}
+		v, err := fn(run, args)
+		if err != nil && err != errScriptExit {
+			err = fmt.Errorf("%s: %v", x.name, err)
+		}
+		return v, err
+	case *scriptIndex:
+		v, err := run.eval(x.list)
+		if err != nil {
+			return nil, err
+		}
+		k, err := run.eval(x.key)
+		if err != nil {
+			return nil, err
+		}
+		list, ok := v.(scriptList)
+		if !ok {
+			return nil, fmt.Errorf("cannot index %s", scriptType(v))
+		}
+		i, err := scriptInt(k)
+		if err != nil {
+			return nil, fmt.Errorf("index: %v", err)
+		}
+		if i < 1 || i > int64(len(list)) {
+			return nil, nil
+		}
+		return list[i-1], nil
+	case *scriptUnary:
+		v, err := run.eval(x.x)
+		if err != nil {
+			return nil, err
+		}
+		switch x.op {
+		case "not":
+			return !scriptTruthy(v), nil
+		case "#":
+			switch v := v.(type) {
+			case string:
+				return int64(len(v)), nil
+			case scriptList:
+				return int64(len(v)), nil
+			}
+			return nil, fmt.Errorf("cannot take the length of %s", scriptType(v))
+		}
+		n, err := scriptInt(v)
+		return -n, err
+	case *scriptBinary:
+		return run.binary(x)
+	}
+	return nil, fmt.Errorf("invalid expression")
+}
+
+// binary evaluates a binary operator, short-circuiting and and or
+func (run *scriptRun) binary(x *scriptBinary) (any, error) {
+	a, err := run.eval(x.x)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case x.op == "and" && !scriptTruthy(a), x.op == "or" && scriptTruthy(a):
+		return a, nil
+	case x.op == "and", x.op == "or":
+		return run.eval(x.y)
+	}
+	b, err := run.eval(x.y)
+	if err != nil {
+		return nil, err
+	}
+	switch x.op {
+	case "==":
+		return scriptEqual(a, b), nil
+	case "~=":
+		return !scriptEqual(a, b), nil
+	case "..":
+		s, err := scriptConcat(a)
+		if err != nil {
+			return nil, err
+		}
+		t, err := scriptConcat(b)
+		if err != nil {
+			return nil, err
+		}
+		if len(s)+len(t) > scriptMaxString {
+			return nil, fmt.Errorf("string longer than %d bytes", scriptMaxString)
+		}
+		return s + t, nil
+	case "<", ">", "<=", ">=":
+		c, err := scriptCompare(a, b)
+		if err != nil {
+			return nil, err
+		}
+		return x.op == "<" && c < 0 || x.op == ">" && c > 0 || x.op == "<=" && c <= 0 || x.op == ">=" && c >= 0, nil
+	}
+	m, err := scriptInt(a)
+	if err != nil {
+		return nil, err
+	}
+	n, err := scriptInt(b)
+	if err != nil {
+		return nil, err
+	}
+	switch x.op {
+	case "+":
+		return m + n, nil
+	case "-":
+		return m - n, nil
+	case "*":
+		return m * n, nil
+	}
+	if n == 0 {
+		return nil, errors.New("division by zero")
+	}
+	if x.op == "/" {
+		return m / n, nil
+	}
+	return m % n, nil
+}
+
+// scriptTruthy reports whether v counts as true, which all values but nil
+// and false do
+func scriptTruthy(v any) bool {
+	return v != nil && v != false
+}
+
+// scriptType names the type of v in errors
+func scriptType(v any) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "a boolean"
+	case int64:
+		return "a number"
+	case string:
+		return "a string"
+	}
+	return "a list"
+}
+
+// scriptInt returns v as an integer
+func scriptInt(v any) (int64, error) {
+	n, ok := v.(int64)
+	if !ok {
+		return 0, fmt.Errorf("expected a number, found %s", scriptType(v))
+	}
+	return n, nil
+}
+
+// scriptString returns v as a string
+func scriptString(v any) (string, error) {
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("expected a string, found %s", scriptType(v))
+	}
+	return s, nil
+}
+
+// scriptConcat converts an operand of .., which may be a string or number
+func scriptConcat(v any) (string, error) {
+	if n, ok := v.(int64); ok {
+		return strconv.FormatInt(n, 10), nil
+	}
+	return scriptString(v)
+}
+
+// scriptEqual compares values for == and ~=, lists never being equal
+func scriptEqual(a, b any) bool {
+	switch a.(type) {
+	case nil, bool, int64, string:
+		return a == b
+	}
+	return false
+}
+
+// scriptCompare orders two numbers or two strings
+func scriptCompare(a, b any) (int, error) {
+	switch a := a.(type) {
+	case int64:
+		if b, ok := b.(int64); ok {
+			return cmp.Compare(a, b), nil
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), nil
+		}
+	}
+	return 0, fmt.Errorf("cannot compare %s with %s", scriptType(a), scriptType(b))
+}
+
+// scriptTostring formats v like Lua's tostring
+func scriptTostring(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case string:
+		return v
+	}
+	return fmt.Sprintf("list of %d", len(v.(scriptList)))
+}
+
+// scriptArgs checks the number of arguments of a function and that the
+// first ones are strings
+func scriptArgs(args []any, least, most, strs int) ([]string, error) {
+	if len(args) < least || len(args) > most {
+		if least == most {
+			return nil, fmt.Errorf("expected %d arguments, found %d", least, len(args))
+		}
+		return nil, fmt.Errorf("expected %d to %d arguments, found %d", least, most, len(args))
+	}
+	s := make([]string, min(strs, len(args)))
+	for i := range s {
+		var err error
+		if s[i], err = scriptString(args[i]); err != nil {
+			return nil, fmt.Errorf("argument %d: %v", i+1, err)
+		}
+	}
+	return s, nil
+}
+
+// scriptStringFunc adapts a function of strings to a builtin
+func scriptStringFunc(n int, fn func([]string) any) func(*scriptRun, []any) (any, error) {
+	return func(_ *scriptRun, args []any) (any, error) {
+		s, err := scriptArgs(args, n, n, n)
+		if err != nil {
+			return nil, err
+		}
+		return fn(s), nil
+	}
+}
+
+// scriptOptional returns s, or nil when it is not set
+func scriptOptional(s string, ok bool) any {
+	if !ok {
+		return nil
+	}
+	return s
+}
+
+// scriptBuiltins are the functions scripts can call
+var scriptBuiltins map[string]func(*scriptRun, []any) (any, error)
+
+func init() {
+	scriptBuiltins = map[string]func(*scriptRun, []any) (any, error){
+		"header": func(run *scriptRun, args []any) (any, error) {
+			s, err := scriptArgs(args, 1, 1, 1)
+			if err != nil {
+				return nil, err
+			}
+			values := run.r.Header.Values(s[0])
+			return scriptOptional(strings.Join(values, ", "), len(values) > 0), nil
+		},
+		"param": func(run *scriptRun, args []any) (any, error) {
+			s, err := scriptArgs(args, 1, 1, 1)
+			if err != nil {
+				return nil, err
+			}
+			values, ok := run.r.URL.Query()[s[0]]
+			return scriptOptional(strings.Join(values, ","), ok), nil
+		},
+		"cookie": func(run *scriptRun, args []any) (any, error) {
+			s, err := scriptArgs(args, 1, 1, 1)
+			if err != nil {
+				return nil, err
+			}
+			c, err := run.r.Cookie(s[0])
+			if err != nil {
+				return nil, nil
+			}
+			return c.Value, nil
+		},
+		"set_header": func(run *scriptRun, args []any) (any, error) {
+			s, err := scriptArgs(args, 2, 2, 2)
+			if err != nil {
+				return nil, err
+			}
+			run.w.Header().Set(s[0], s[1])
+			return nil, nil
+		},
+		"set_request_header": func(run *scriptRun, args []any) (any, error) {
+			s, err := scriptArgs(args, 2, 2, 1)
+			if err != nil {
+				return nil, err
+			}
+			if args[1] == nil {
+				run.r.Header.Del(s[0])
+				return nil, nil
+			}
+			value, err := scriptString(args[1])
+			if err != nil {
+				return nil, fmt.Errorf("argument 2: %v", err)
+			}
+			run.r.Header.Set(s[0], value)
+			return nil, nil
+		},
+		"deny": func(run *scriptRun, args []any) (any, error) {
+			if _, err := scriptArgs(args, 1, 2, 0); err != nil {
+				return nil, err
+			}
+			status, err := scriptInt(args[0])
+			if err != nil || status < 400 || status > 599 {
+				return nil, errors.New("argument 1: expected a status from 400 to 599")
+			}
+			run.status = int(status)
+			if len(args) == 2 {
+				if run.body, err = scriptString(args[1]); err != nil {
+					return nil, fmt.Errorf("argument 2: %v", err)
+				}
+			}
+			return nil, errScriptExit
+		},
+		"redirect": func(run *scriptRun, args []any) (any, error) {
+			s, err := scriptArgs(args, 1, 2, 1)
+			if err != nil {
+				return nil, err
+			}
+			run.status, run.location = http.StatusFound, s[0]
+			if len(args) == 2 {
+				status, err := scriptInt(args[1])
+				if err != nil || status < 300 || status > 399 {
+					return nil, errors.New("argument 2: expected a status from 300 to 399")
+				}
+				run.status = int(status)
+			}
+			return nil, errScriptExit
+		},
+		"rewrite": func(run *scriptRun, args []any) (any, error) {
+			s, err := scriptArgs(args, 1, 1, 1)
+			if err != nil {
+				return nil, err
+			}
+			if !strings.HasPrefix(s[0], "/") {
+				return nil, errors.New("the path must start with /")
+			}
+			run.rewrite = s[0]
+			return nil, nil
+		},
+		"log": func(run *scriptRun, args []any) (any, error) {
+			s := make([]string, len(args))
+			for i, arg := range args {
+				s[i] = scriptTostring(arg)
+			}
+			run.script.log.logf("script %s: %s", run.script.name, strings.Join(s, " "))
+			return nil, nil
+		},
+		"lower": scriptStringFunc(1, func(s []string) any { return strings.ToLower(s[0]) }),
+		"upper": scriptStringFunc(1, func(s []string) any { return strings.ToUpper(s[0]) }),
+		"trim":  scriptStringFunc(1, func(s []string) any { return strings.TrimSpace(s[0]) }),
+		"starts_with": scriptStringFunc(2, func(s []string) any {
+			return strings.HasPrefix(s[0], s[1])
+		}),
+		"ends_with": scriptStringFunc(2, func(s []string) any {
+			return strings.HasSuffix(s[0], s[1])
+		}),
+		"contains": scriptStringFunc(2, func(s []string) any {
+			return strings.Contains(s[0], s[1])
+		}),
+		"split": scriptStringFunc(2, func(s []string) any {
+			var list scriptList
+			for _, part := range strings.Split(s[0], s[1]) {
+				list = append(list, part)
+			}
+			return list
+		}),
+		"match": func(run *scriptRun, args []any) (any, error) {
+			s, err := scriptArgs(args, 2, 2, 2)
+			if err != nil {
+				return nil, err
+			}
+			re, err := run.script.regexp(s[1])
+			if err != nil {
+				return nil, err
+			}
+			m := re.FindStringSubmatch(s[0])
+			if m == nil {
+				return nil, nil
+			}
+			if len(m) == 1 {
+				return m[0], nil
+			}
+			// Like Lua, return the captures when the expression has any
+			list := make(scriptList, len(m)-1)
+			for i, c := range m[1:] {
+				list[i] = c
+			}
+			return list, nil
+		},
+		"tostring": func(_ *scriptRun, args []any) (any, error) {
+			if _, err := scriptArgs(args, 1, 1, 0); err != nil {
+				return nil, err
+			}
+			return scriptTostring(args[0]), nil
+		},
+		"tonumber": func(_ *scriptRun, args []any) (any, error) {
+			if _, err := scriptArgs(args, 1, 1, 0); err != nil {
+				return nil, err
+			}
+			switch v := args[0].(type) {
+			case int64:
+				return v, nil
+			case string:
+				if n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+					return n, nil
+				}
+			}
+			return nil, nil
+		},
+		"ipairs": func(_ *scriptRun, args []any) (any, error) {
+			if _, err := scriptArgs(args, 1, 1, 0); err != nil {
+				return nil, err
+			}
+			if _, ok := args[0].(scriptList); !ok {
+				return nil, fmt.Errorf("expected a list, found %s", scriptType(args[0]))
+			}
+			return args[0], nil
+		},
+	}
+}
+
+// regexp compiles a regular expression of match once
+func (s *script) regexp(expr string) (*regexp.Regexp, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if re, ok := s.regexps[expr]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.regexps) < 1000 {
+		s.regexps[expr] = re
+	}
+	return re, nil
+}
+
+// run runs the script for a request
+func (s *script) run(w http.ResponseWriter, r *http.Request) (*scriptRun, error) {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	var user any
+	if u := RequestUser(r); u != "-" {
+		user = u
+	}
+	run := &scriptRun{script: s, r: r, w: w, vars: map[string]any{
+		"method":     r.Method,
+		"path":       r.URL.Path,
+		"query":      r.URL.RawQuery,
+		"host":       r.Host,
+		"remote":     remote,
+		"user":       user,
+		"request_id": RequestID(r),
+	}}
+	if _, err := run.exec(s.body); err != nil && err != errScriptExit {
+		return nil, fmt.Errorf("line %d: %v", run.line, err)
+	}
+	return run, nil
+}
+
+// runScript is the script stage
+func runScript(s *script, policy pathPolicy, ui uiOptions) Middleware {
+	if s == nil {
+		return nil
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			run, err := s.run(w, r)
+			if err != nil {
+				s.log.logf("Error in script %s for %s: %v", s.name, r.URL.Path, err)
+				renderError(w, r, http.StatusInternalServerError, ui)
+				return
+			}
+			switch {
+			case run.location != "":
+				http.Redirect(w, r, run.location, run.status)
+				return
+			case run.status != 0 && run.body != "":
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				w.WriteHeader(run.status)
+				fmt.Fprint(w, run.body)
+				return
+			case run.status != 0:
+				renderError(w, r, run.status, ui)
+				return
+			case run.rewrite != "":
+				target, err := url.Parse(run.rewrite)
+				if err == nil {
+					var cleanPath string
+					if cleanPath, err = sanitizePath(target, policy); err == nil {
+						r.URL.Path, r.URL.RawPath = cleanPath, ""
+						if strings.Contains(run.rewrite, "?") {
+							r.URL.RawQuery = target.RawQuery
+						}
+					}
+				}
+				if err != nil {
+					s.log.logf("Error in script %s for %s: rewrite to %q: %v", s.name, r.URL.Path, run.rewrite, err)
+					renderError(w, r, http.StatusInternalServerError, ui)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package httpserve
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// testScript parses src into a script allowed steps evaluation steps
+func testScript(t *testing.T, src string, steps int) *script {
+	t.Helper()
+	body, err := parseScript(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &script{name: "test.lua", body: body, steps: steps, regexps: make(map[string]*regexp.Regexp)}
+}
+
+func TestParseScriptErrors(t *testing.T) {
+	tests := []struct {
+		name, src, want string
+	}{
+		{"missing end", "if path == '/' then deny(403)", `expected "end"`},
+		{"missing then", "if path == '/' deny(403) end", `expected "then"`},
+		{"missing do", "while true break end", `expected "do"`},
+		{"unterminated string", `log("a)`, "syntax error on line 1"},
+		{"bare expression", "1 + 2", "expected a statement"},
+		{"stray end", "end", "unexpected"},
+		{"missing index bracket", "local a = split(path, '/')[1", `expected "]"`},
+		{"error line", "local a = 1\nlocal b = = 2", "line 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseScript(tt.src)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunScript(t *testing.T) {
+	tests := []struct {
+		name, src, target string
+		status            int
+		check             func(t *testing.T, rec *httptest.ResponseRecorder, served string)
+	}{
+		{
+			name:   "passes through",
+			src:    "local n = 0\nfor i = 1, 10 do n = n + i end\nif n ~= 55 then deny(500) end",
+			target: "/a.txt",
+			status: http.StatusOK,
+		},
+		{
+			name:   "deny with a body",
+			src:    `if starts_with(path, "/private/") then deny(403, "no " .. path) end`,
+			target: "/private/x",
+			status: http.StatusForbidden,
+			check: func(t *testing.T, rec *httptest.ResponseRecorder, served string) {
+				if rec.Body.String() != "no /private/x" {
+					t.Errorf("got body %q", rec.Body)
+				}
+			},
+		},
+		{
+			name:   "redirect",
+			src:    `if param("old") then redirect("/new?id=" .. param("old"), 301) end`,
+			target: "/?old=7",
+			status: http.StatusMovedPermanently,
+			check: func(t *testing.T, rec *httptest.ResponseRecorder, served string) {
+				if rec.Header().Get("Location") != "/new?id=7" {
+					t.Errorf("got Location %q", rec.Header().Get("Location"))
+				}
+			},
+		},
+		{
+			name:   "rewrite and header",
+			src:    "local parts = split(path, '/')\nset_header('X-Parts', tostring(#parts))\nrewrite('/v2/' .. parts[#parts])",
+			target: "/v1/a/b.txt",
+			status: http.StatusOK,
+			check: func(t *testing.T, rec *httptest.ResponseRecorder, served string) {
+				if served != "/v2/b.txt" || rec.Header().Get("X-Parts") == "" {
+					t.Errorf("served %q with X-Parts %q", served, rec.Header().Get("X-Parts"))
+				}
+			},
+		},
+		{
+			name:   "rewrite refuses traversal",
+			src:    "rewrite('/../etc/passwd')",
+			target: "/",
+			status: http.StatusInternalServerError,
+		},
+		{
+			name:   "runtime error",
+			src:    "local a = 1 + 'x'",
+			target: "/",
+			status: http.StatusInternalServerError,
+		},
+		{
+			name:   "step limit",
+			src:    "while true do end",
+			target: "/",
+			status: http.StatusInternalServerError,
+		},
+		{
+			name:   "string limit",
+			src:    "local s = 'xxxxxxxxxxxxxxxx'\nwhile true do s = s .. s end",
+			target: "/",
+			status: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var served string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				served = r.URL.Path
+			})
+			h := runScript(testScript(t, tt.src, 1000), pathPolicy{}, uiOptions{})(next)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if rec.Code != tt.status {
+				t.Fatalf("got status %d, want %d", rec.Code, tt.status)
+			}
+			if tt.check != nil {
+				tt.check(t, rec, served)
+			}
+		})
+	}
+}
@@ -0,0 +1,1039 @@
+package httpserve
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// stack is the handler built from a Config, along with the parts Run
+// also serves on their own listeners
+type stack struct {
+	handler  http.Handler
+	ftp      *ftpServer
+	files    *grpcService
+	ui       uiOptions
+	absDir   string
+	diskDir  string // absDir when the files are served from disk
+	plugins  plugins
+	settings *runtimeSettings
+	recorder *harRecorder // nil without --record
+	readRate *readRateGuard
+}
+
+// New returns the handler serving cfg.Dir, or cfg.Content, with the
+// logging, auth and every other feature enabled in cfg, for programs that
+// run their own http.Server. Plugins started for cfg run until the program
+// exits.
+func New(cfg Config) (http.Handler, error) {
+	s, err := newStack(cfg, newServerLog(cfg))
+	if err != nil {
+		return nil, err
+	}
+	return s.handler, nil
+}
+
+// newStack validates cfg and builds the request handling stack, logging
+// to log
+func newStack(cfg Config, log *serverLog) (_ *stack, err error) {
+	metrics := cfg.metrics()
+
+	// Validate UI options
+	if err := validateLang(cfg.Lang); err != nil {
+		return nil, fmt.Errorf("UI options: %v", err)
+	}
+
+	// Validate the operating mode before any write feature is set up
+	var writeFlags []string
+	if cfg.Upload {
+		writeFlags = append(writeFlags, "--upload")
+	}
+	if cfg.AllowDelete {
+		writeFlags = append(writeFlags, "--allow-delete")
+	}
+	if cfg.AllowManage {
+		writeFlags = append(writeFlags, "--allow-manage")
+	}
+	if err := validateMode(cfg.Mode, writeFlags); err != nil {
+		return nil, fmt.Errorf("mode options: %v", err)
+	}
+	readOnly := cfg.Mode == modeReadOnly
+	if readOnly {
+		cfg.WebDAVReadOnly = true
+	}
+	ui := uiOptions{Title: cfg.Title, Logo: cfg.Logo, lang: cfg.Lang, ReadOnly: readOnly, log: log}
+
+	// Validate listing options
+	listing := listingOptions{sortBy: cfg.Sort, order: cfg.Order, pageSize: cfg.PageSize, ui: ui, upload: cfg.Upload, streamThreshold: cfg.ListingStreamThreshold}
+	if err := validateListingOptions(listing); err != nil {
+		return nil, fmt.Errorf("listing options: %v", err)
+	}
+	css, err := loadListingCSS(cfg.ListingCSS)
+	if err != nil {
+		return nil, fmt.Errorf("loading listing stylesheet: %v", err)
+	}
+	listing.css = css
+
+	if err := validateAutoIndex(cfg.AutoIndexFile); err != nil {
+		return nil, fmt.Errorf("listing options: %v", err)
+	}
+
+	proxies, err := parseProxyRoutes(cfg.Proxies, ui, log)
+	if err != nil {
+		return nil, fmt.Errorf("proxy options: %v", err)
+	}
+
+	// Validate credentials
+	creds, err := parseCredentials(cfg.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("auth options: %v", err)
+	}
+
+	// Validate the homes, whose users file adds to the credentials
+	var userdir string
+	var homes map[string]*userHome
+	if cfg.UserdirUsers != "" && cfg.Userdir == "" {
+		return nil, errors.New("userdir options: --userdir-users needs --userdir")
+	}
+	if cfg.Userdir != "" {
+		if userdir, err = resolveDir(cfg.Userdir); err != nil {
+			return nil, fmt.Errorf("userdir options: %v", err)
+		}
+	}
+	if cfg.UserdirUsers != "" {
+		var users credentials
+		users, homes, err = parseUsersFile(cfg.UserdirUsers, userdir, int64(cfg.UserdirQuota))
+		if err != nil {
+			return nil, fmt.Errorf("userdir options: %v", err)
+		}
+		for user, hash := range users {
+			if _, dup := creds[user]; dup {
+				return nil, fmt.Errorf("userdir options: user %s is also given by --auth", user)
+			}
+			creds[user] = hash
+		}
+		for _, home := range homes {
+			if err := os.MkdirAll(home.dir, 0o750); err != nil {
+				return nil, fmt.Errorf("userdir options: %v", err)
+			}
+		}
+	}
+	if cfg.LinkSecret != "" && cfg.LinkExpiry <= 0 {
+		return nil, errors.New("auth options: --link-expiry must be positive")
+	}
+	if cfg.AllowDelete && len(creds) == 0 {
+		return nil, errors.New("auth options: --allow-delete requires --auth")
+	}
+	if cfg.AllowManage && len(creds) == 0 {
+		return nil, errors.New("auth options: --allow-manage requires --auth")
+	}
+	if cfg.WebDAV && !cfg.WebDAVReadOnly && len(creds) == 0 {
+		return nil, errors.New("auth options: writable --webdav requires --auth (or use --webdav-readonly)")
+	}
+	davPrefix := "/" + strings.Trim(cfg.WebDAVPrefix, "/") + "/"
+
+	// Validate directory, or the read-only file system replacing it
+	var absDir string
+	var storage fs.FS
+	archive := isArchive(cfg.Dir)
+	if cfg.Backend != "" || cfg.Content != nil || archive || len(cfg.Overlays) > 0 {
+		switch {
+		case !readOnly:
+			return nil, errors.New("backend options: --backend, --overlay, archives and bundled content require --mode ro")
+		case cfg.WebDAV, cfg.MetaCache > 0, cfg.AutoIndexFile == autoIndexWrite, cfg.Watch, cfg.LiveReload:
+			return nil, errors.New("backend options: --backend, --overlay, archives and bundled content cannot be combined with --webdav, --meta-cache, --watch, --live-reload or --auto-index-file write")
+		case cfg.Mirror != "":
+			return nil, errors.New("mirror options: --mirror stores files in --dir and cannot be combined with --backend, --overlay, archives or bundled content")
+		}
+	}
+	switch {
+	case cfg.Content != nil:
+		storage, absDir = cfg.Content, "the embedded bundle"
+	case cfg.Backend == memBackend:
+		storage, err = loadMemFS(cfg.Dir, log)
+		if err != nil {
+			return nil, fmt.Errorf("backend options: loading %s into memory: %v", cfg.Dir, err)
+		}
+		absDir = "memory (loaded from " + cfg.Dir + ")"
+		if cfg.Dir == "-" {
+			absDir = "memory (loaded from stdin)"
+		}
+	case cfg.Backend != "":
+		storage, err = openBackend(cfg.Backend, log)
+		if err != nil {
+			return nil, fmt.Errorf("backend options: %v", err)
+		}
+		absDir = cfg.Backend
+	case archive:
+		absDir, err = filepath.Abs(cfg.Dir)
+		if err == nil {
+			storage, err = openArchive(absDir, log)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("directory: %v", err)
+		}
+	default:
+		absDir, err = resolveDir(cfg.Dir)
+		if err != nil {
+			return nil, fmt.Errorf("directory: %v", err)
+		}
+	}
+	diskDir := absDir
+	if storage != nil || len(cfg.Overlays) > 0 {
+		diskDir = ""
+	}
+	if len(cfg.Overlays) > 0 {
+		base := storage
+		if base == nil {
+			base = os.DirFS(absDir)
+		}
+		storage, err = newOverlayFS(base, cfg.Overlays, log)
+		if err != nil {
+			return nil, fmt.Errorf("overlay options: %v", err)
+		}
+		absDir = fmt.Sprintf("%s with %d overlay(s)", absDir, len(cfg.Overlays))
+	}
+	uploadFilter, err := parseUploadFilter(cfg.UploadAllow, cfg.UploadDenyExecutables)
+	if err != nil {
+		return nil, fmt.Errorf("upload options: %v", err)
+	}
+	scanner, err := newVirusScanner(cfg.ScanClamd, cfg.ScanCommand)
+	if err != nil {
+		return nil, fmt.Errorf("scan options: %v", err)
+	}
+	if cfg.ScanQuarantine != "" {
+		if err := os.MkdirAll(cfg.ScanQuarantine, 0o700); err != nil {
+			return nil, fmt.Errorf("scan options: %v", err)
+		}
+	}
+	var tus *tusStore
+	if cfg.Upload {
+		tus, err = newTusStore(cfg.TusDir, cfg.TusExpire, log)
+		if err != nil {
+			return nil, fmt.Errorf("resumable upload storage: %v", err)
+		}
+	}
+	var requestScript *script
+	if cfg.Script != "" {
+		requestScript, err = loadScript(cfg.Script, cfg.ScriptMaxSteps, log)
+		if err != nil {
+			return nil, fmt.Errorf("script options: %v", err)
+		}
+	}
+	wasmFilters, err := loadWasmFilters(cfg.Wasm, cfg.WasmFuel, cfg.WasmMaxMemory, log)
+	if err != nil {
+		return nil, fmt.Errorf("wasm options: %v", err)
+	}
+	plugins, err := startPlugins(cfg.Plugins, log)
+	if err != nil {
+		return nil, fmt.Errorf("plugin options: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			plugins.close()
+		}
+	}()
+	webhook := newWebhookNotifier(cfg.WebhookURL, cfg.WebhookSecret, int64(cfg.WebhookDownloadSize), log)
+	var statsRetention time.Duration
+	if cfg.Stats {
+		if cfg.StatsRetention <= 0 {
+			return nil, errors.New("stats options: --stats-retention must be positive")
+		}
+		statsRetention = cfg.StatsRetention
+	}
+	downloadExts, err := parseDownloadExtensions(cfg.DownloadExtensions)
+	if err != nil {
+		return nil, fmt.Errorf("download options: %v", err)
+	}
+	policy := pathPolicy{nfc: cfg.PathNFC, rejectEncodedSlashes: cfg.RejectEncodedSlashes}
+	siteOpts := siteOptions{
+		listing:          listing,
+		ui:               ui,
+		caseInsensitive:  cfg.CaseInsensitive,
+		autoIndex:        cfg.AutoIndexFile,
+		download:         downloadOptions{exts: downloadExts, noRanges: cfg.DownloadNoRanges},
+		upload:           uploadOptions{enabled: cfg.Upload, overwrite: cfg.UploadOverwrite, maxSize: cfg.UploadMaxSize, filter: uploadFilter},
+		tus:              tus,
+		allowDelete:      cfg.AllowDelete,
+		trashRetention:   cfg.TrashRetention,
+		mirror:           mirrorOptions{origin: cfg.Mirror, ttl: cfg.MirrorTTL},
+		allowManage:      cfg.AllowManage,
+		policy:           policy,
+		webdav:           webdavOptions{enabled: cfg.WebDAV, prefix: davPrefix, readOnly: cfg.WebDAVReadOnly},
+		webhook:          webhook,
+		graphql:          cfg.GraphQL,
+		diff:             cfg.Diff,
+		stats:            statsRetention,
+		templates:        templateOptions{enabled: cfg.Templates, dataFile: cfg.TemplateData, envPrefix: cfg.TemplateEnv},
+		ssi:              cfg.SSI,
+		watch:            cfg.Watch,
+		liveReload:       cfg.LiveReload,
+		cache:            newFileCache(int64(cfg.CacheSize), int64(cfg.CacheMaxFile)),
+		mmap:             newFileMapper(int64(cfg.MmapMinSize), log),
+		metaCacheEntries: cfg.MetaCache,
+		preindex:         cfg.Preindex,
+		scan:             scanOptions{scanner: scanner, quarantine: cfg.ScanQuarantine, failOpen: cfg.ScanFailOpen},
+		plugins:          plugins,
+		quota:            quotaOptions{total: int64(cfg.UploadQuota), perDir: int64(cfg.UploadDirQuota), minFree: int64(cfg.MinFreeSpace)},
+		log:              log,
+	}
+	newSite := func(dir string, storage fs.FS) (*fileHandler, error) {
+		if cfg.AutoIndexFile == autoIndexWrite {
+			n, err := materializeIndexes(dir, listing)
+			if err != nil {
+				return nil, fmt.Errorf("generating index files in %s: %v", dir, err)
+			}
+			log.logf("Generated %d index files in %s", n, dir)
+		}
+		opts := siteOpts
+		opts.storage = storage
+		return newFileHandler(dir, opts)
+	}
+	files, err := newSite(absDir, storage)
+	if err != nil {
+		return nil, err
+	}
+	var site http.Handler = files
+	var ftp *ftpServer
+	if cfg.FTP != "" {
+		ftp, err = newFTPServer(files, creds, cfg.FTPPassivePorts, cfg.FTPTLSCert, cfg.FTPTLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("FTP options: %v", err)
+		}
+	}
+	var fileService *grpcService
+	if cfg.GRPC || cfg.GRPCAddr != "" {
+		fileService = &grpcService{h: files, creds: creds}
+	}
+
+	// Set up virtual hosts, with --dir serving any other host
+	if len(cfg.Vhosts) > 0 {
+		router := &vhostRouter{hosts: make(map[string]http.Handler), fallback: site}
+		for _, value := range cfg.Vhosts {
+			host, vhostDir, err := parseVhost(value)
+			if err != nil {
+				return nil, fmt.Errorf("vhost: %v", err)
+			}
+			absVhostDir, err := resolveDir(vhostDir)
+			if err != nil {
+				return nil, fmt.Errorf("vhost %s: %v", host, err)
+			}
+			if router.hosts[host], err = newSite(absVhostDir, nil); err != nil {
+				return nil, err
+			}
+			log.logf("Serving host %s from %s", host, absVhostDir)
+		}
+		site = router
+	}
+
+	// Set up the homes, with the sites above serving the other paths
+	if userdir != "" {
+		if diskDir != "" {
+			if rel, err := filepath.Rel(absDir, userdir); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return nil, errors.New("userdir options: --userdir must be outside --dir, which would serve every home to anyone")
+			}
+		}
+		// Homes are served below their prefix, which the WebDAV endpoint
+		// can't be
+		homeOpts := siteOpts
+		homeOpts.webdav = webdavOptions{}
+		router := &userdirRouter{
+			opts:     userdirOptions{dir: userdir, quota: int64(cfg.UserdirQuota), private: cfg.UserdirPrivate},
+			listed:   homes != nil,
+			homes:    homes,
+			ui:       ui,
+			fallback: site,
+			log:      log,
+			newSite: func(home userHome) (*fileHandler, error) {
+				opts := homeOpts
+				opts.quota.total = home.quota
+				return newFileHandler(home.dir, opts)
+			},
+		}
+		if router.homes == nil {
+			router.homes = make(map[string]*userHome)
+		}
+		site = router
+		if homes != nil {
+			log.logf("Serving %d homes at /~name/ from %s", len(homes), cfg.UserdirUsers)
+		} else {
+			log.logf("Serving homes at /~name/ from %s", userdir)
+		}
+	}
+
+	if cfg.IOBufferSize < 512 || cfg.IOBufferSize > 64<<20 {
+		return nil, errors.New("I/O options: --io-buffer-size must be between 512 and 64M")
+	}
+	buffers := newBufferPool(int(cfg.IOBufferSize))
+	forward, err := newForwardProxy(cfg.ForwardProxy, creds, ui, buffers, log)
+	if err != nil {
+		return nil, fmt.Errorf("forward proxy options: %v", err)
+	}
+	shedder := newLoadShedder(sheddingOptions{
+		maxInFlight:  cfg.ShedMaxInFlight,
+		queueTimeout: cfg.ShedQueueTimeout,
+		maxMemory:    int64(cfg.ShedMaxMemory),
+		retryAfter:   cfg.ShedRetryAfter,
+	}, log)
+	var latency chaosLatency
+	if cfg.ChaosLatency != "" {
+		if err := latency.Set(cfg.ChaosLatency); err != nil {
+			return nil, fmt.Errorf("chaos options: %v", err)
+		}
+	}
+	chaos, err := newChaosMonkey(latency, cfg.ChaosErrorRate, log)
+	if err != nil {
+		return nil, fmt.Errorf("chaos options: %v", err)
+	}
+	if chaos != nil {
+		log.logf("Chaos mode: injecting %s latency and a %g error rate", latency.String(), cfg.ChaosErrorRate)
+	}
+	var compression *compressor
+	if cfg.Compress {
+		compression, err = newCompressor(cfg.GzipLevel, cfg.DeflateLevel, int(cfg.CompressMinSize), cfg.CompressTypes)
+		if err != nil {
+			return nil, fmt.Errorf("compression options: %v", err)
+		}
+	}
+	conns := connOptions{maxRequests: cfg.MaxConnRequests, maxLifetime: cfg.MaxConnLifetime}
+
+	// Create custom file server handler
+	allowedMethods := map[string]bool{http.MethodGet: true}
+	if cfg.Upload {
+		allowedMethods[http.MethodPut] = true
+		allowedMethods[http.MethodPost] = true
+		// Used by the tus resumable upload endpoints
+		allowedMethods[http.MethodHead] = true
+		allowedMethods[http.MethodPatch] = true
+		allowedMethods[http.MethodOptions] = true
+		allowedMethods[http.MethodDelete] = true
+	}
+	if cfg.AllowDelete {
+		allowedMethods[http.MethodDelete] = true
+	}
+	if cfg.WebDAV {
+		for _, method := range webdavMethods {
+			allowedMethods[method] = true
+		}
+	}
+	if cfg.AllowManage {
+		allowedMethods[http.MethodPost] = true
+		allowedMethods["MKCOL"] = true
+		allowedMethods["MOVE"] = true
+	}
+	if readOnly {
+		for method := range mutatingMethods {
+			delete(allowedMethods, method)
+		}
+	}
+	if cfg.GraphQL {
+		// Queries are posted, but never change anything
+		allowedMethods[http.MethodPost] = true
+	}
+	headers, err := parseHeaders(cfg.Headers)
+	if err != nil {
+		return nil, fmt.Errorf("header options: %v", err)
+	}
+	limiter, err := newRateLimiter(cfg.RateLimit, cfg.RateBurst)
+	if err != nil {
+		return nil, fmt.Errorf("rate limit options: %v", err)
+	}
+	readRate, err := newReadRateGuard(cfg.MinReadRate, cfg.MinReadRateGrace, log)
+	if err != nil {
+		return nil, fmt.Errorf("timeout options: %v", err)
+	}
+	if !cfg.Templates && (cfg.TemplateData != "" || cfg.TemplateEnv != "") {
+		return nil, errors.New("template options: --template-data and --template-env require --templates")
+	}
+	if cfg.TemplateData != "" {
+		// Its changes are read on every render, but it has to start out valid
+		src, err := os.ReadFile(cfg.TemplateData)
+		if err == nil {
+			_, err = parseYAML(src)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("template options: %v", err)
+		}
+	}
+	var recorder *harRecorder
+	if cfg.Record != "" {
+		if recorder, err = newHARRecorder(cfg.Record, int64(cfg.RecordMaxBody), cfg.RecordCredentials, log); err != nil {
+			return nil, fmt.Errorf("record options: %v", err)
+		}
+		log.logf("Recording requests to %s", cfg.Record)
+	}
+	var mock *mockAPI
+	if cfg.Mock != "" {
+		if mock, err = newMockAPI(cfg.Mock, ui, log); err != nil {
+			return nil, fmt.Errorf("mock options: %v", err)
+		}
+	}
+	settings := newRuntimeSettings(limiter, rateSetting{Rate: cfg.RateLimit, Burst: cfg.RateBurst}, log)
+	settings.maintenance.Store(cfg.Maintenance)
+	if diskDir != "" {
+		settings.marker = newMaintenanceMarker(diskDir)
+	}
+	maintenance := maintenanceOptions{retryAfter: cfg.MaintenanceRetryAfter}
+	if cfg.MaintenanceRetryAfter < 0 {
+		return nil, errors.New("maintenance options: --maintenance-retry-after cannot be negative")
+	}
+	if cfg.MaintenancePage != "" {
+		if maintenance.page, err = os.ReadFile(cfg.MaintenancePage); err != nil {
+			return nil, fmt.Errorf("maintenance options: %v", err)
+		}
+	}
+	serve := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		site.ServeHTTP(w, r)
+		if lrw := loggedResponse(r); lrw != nil {
+			webhook.notifyDownload(r, lrw.statusCode, lrw.written)
+		}
+	})
+	handler, err := pipeline(serve, []stage{
+		{StageRequestID, requestIDs},
+		{StageReadRate, guardReadRate(readRate)},
+		{StageHealth, serveHealth(cfg.Health, settings)},
+		{StageConnections, recycleConns(conns)},
+		{StageShedding, shedLoad(shedder, ui, log, metrics)},
+		{StageRateLimit, limitRate(settings, ui, log, metrics)},
+		{StageForwardProxy, handleIf(forward.handles, forward)},
+		{StageGRPC, handleIf(func(r *http.Request) bool { return cfg.GRPC && fileService.handles(r) }, fileService)},
+		{StageHeaders, addHeaders(headers)},
+		{StageRecord, recordRequests(recorder)},
+		{StageLogging, logRequests(buffers, log, metrics)},
+		{StageTimeout, requestTimeout(cfg.RequestTimeout, ui)},
+		{StagePaths, cleanPaths(policy, ui, log)},
+		{StageSettings, applySettings(settings, maintenance, ui)},
+		{StagePluginRequest, pluginStage(plugins, pluginEventRequest, ui, log)},
+		{StageLink, requireLink(newLinkSigner(cfg.LinkSecret), ui)},
+		{StageAuth, requireAuth(creds, ui)},
+		{StagePluginAuth, pluginStage(plugins, pluginEventAuth, ui, log)},
+		{StageScript, runScript(requestScript, policy, ui)},
+		{StageWasm, filterWasm(wasmFilters, policy, ui)},
+		{StageChaos, injectChaos(chaos, ui)},
+		{StageProxy, routeProxies(proxies)},
+		{StageMock, serveMocks(mock)},
+		{StageDebug, serveDebugEcho(cfg.DebugEcho, ui)},
+		{StageMethods, allowMethods(allowedMethods, ui)},
+		{StageCompression, compressResponses(compression, log)},
+	}, cfg.Middleware)
+	if err != nil {
+		return nil, fmt.Errorf("middleware options: %v", err)
+	}
+
+	return &stack{handler: handler, ftp: ftp, files: fileService, ui: ui, absDir: absDir, diskDir: diskDir, plugins: plugins, settings: settings, recorder: recorder, readRate: readRate}, nil
+}
+
+// Run serves cfg on its listen addresses, along with the FTP, gRPC and
+// LAN extras it enables, until the process receives SIGINT or SIGTERM
+func Run(cfg Config) error {
+	log := newServerLog(cfg)
+	if cfg.AdminAddr != "" && cfg.AdminToken == "" {
+		return errors.New("admin options: --admin-addr requires --admin-token")
+	}
+	if cfg.ExposeSubdomain != "" && cfg.Expose == "" {
+		return errors.New("tunnel options: --expose-subdomain needs --expose")
+	}
+	if cfg.ReadyFD < 0 {
+		return errors.New("listen options: --ready-fd must not be negative")
+	}
+	adminOn := cfg.AdminToken != ""
+	var logs *logFile
+	if cfg.LogFile != "" {
+		var err error
+		if logs, err = openLogFile(cfg.LogFile); err != nil {
+			return fmt.Errorf("log options: %v", err)
+		}
+	}
+
+	// The dashboard of the admin API follows the log, and the terminal
+	// dashboard replaces it unless it goes to a file or the embedder
+	var stats *dashboardStats
+	if cfg.TUI && cfg.Logger == nil && cfg.LogFile == "" {
+		log.Logger = discardLogger{}
+	}
+	if adminOn {
+		stats = newDashboardStats(log.Logger)
+		log.Logger = stats
+	}
+	var tui *terminalUI
+	var tuiStop chan struct{}
+	if cfg.TUI {
+		if cfg.QR {
+			return errors.New("UI options: --qr cannot be combined with --tui")
+		}
+		var err error
+		if tui, err = startTerminalUI(log.Logger); err != nil {
+			return fmt.Errorf("UI options: %v", err)
+		}
+		defer tui.close()
+		log.Logger, tuiStop = tui, tui.quit
+	}
+	if err := tuneRuntime(runtimeOptions{maxProcs: cfg.GoMaxProcs, memLimit: cfg.GoMemLimit, gcPercent: cfg.GoGC}, log); err != nil {
+		return fmt.Errorf("runtime options: %v", err)
+	}
+	if cfg.Network != "tcp" && cfg.Network != "tcp4" && cfg.Network != "tcp6" {
+		return fmt.Errorf("listen options: invalid network %q, expected tcp, tcp4 or tcp6", cfg.Network)
+	}
+	sockets := socketOptions{
+		network:           cfg.Network,
+		noDelay:           cfg.TCPNoDelay,
+		sendBuffer:        int(cfg.TCPSendBuffer),
+		receiveBuffer:     int(cfg.TCPReceiveBuffer),
+		keepAlive:         cfg.TCPKeepAlive,
+		keepAliveIdle:     cfg.TCPKeepAliveIdle,
+		keepAliveInterval: cfg.TCPKeepAliveInterval,
+		keepAliveCount:    cfg.TCPKeepAliveCount,
+		log:               log,
+	}
+
+	s, err := newStack(cfg, log)
+	if err != nil {
+		return err
+	}
+	if stats != nil {
+		stats.dir = s.diskDir
+	}
+	if tui != nil {
+		tui.setDir(s.absDir)
+	}
+	if cfg.AdminJournal != "" {
+		if err := s.settings.openJournal(cfg.AdminJournal); err != nil {
+			return fmt.Errorf("admin options: reading the journal: %v", err)
+		}
+	}
+
+	// Configure a server for each listen address, so each one shuts down
+	// on its own
+	var listens listenSpecs
+	for _, value := range cfg.Listen {
+		if err := listens.Set(value); err != nil {
+			return fmt.Errorf("listen options: %v", err)
+		}
+	}
+	if len(listens) == 0 {
+		host := cfg.Addr
+		if host == "0.0.0.0" && cfg.Network == "tcp6" {
+			host = "::"
+		}
+		spec := listenSpec{addr: net.JoinHostPort(host, cfg.Port), acme: len(cfg.ACMEDomains) > 0}
+		if strings.HasPrefix(cfg.Addr, "unix:") {
+			spec.addr = cfg.Addr
+		}
+		listens = append(listens, spec)
+	}
+	if len(cfg.ACMEDomains) > 0 {
+		if cfg.ACMEDNS == "" {
+			return errors.New("ACME options: --acme-domain needs --acme-dns")
+		}
+		if !slices.ContainsFunc(listens, func(l listenSpec) bool { return l.acme }) {
+			return errors.New("ACME options: no --listen address is marked acme")
+		}
+		provider, err := newDNSProvider(cfg.ACMEDNS)
+		if err != nil {
+			return fmt.Errorf("ACME options: %v", err)
+		}
+		if cfg.ACMECache == "" {
+			cacheDir, err := os.UserCacheDir()
+			if err != nil {
+				return fmt.Errorf("ACME options: %v, set --acme-cache", err)
+			}
+			cfg.ACMECache = filepath.Join(cacheDir, "simple-http-server", "acme")
+		}
+		acme, err := newACMEManager(acmeOptions{
+			domains:     cfg.ACMEDomains,
+			email:       cfg.ACMEEmail,
+			directory:   cfg.ACMEDirectory,
+			cacheDir:    cfg.ACMECache,
+			provider:    provider,
+			propagation: cfg.ACMEDNSPropagation,
+		}, log)
+		if err != nil {
+			return fmt.Errorf("obtaining ACME certificate: %v", err)
+		}
+		for i := range listens {
+			if listens[i].acme {
+				listens[i].tls = &tls.Config{GetCertificate: acme.getCertificate, MinVersion: tls.VersionTLS12}
+			}
+		}
+	} else if slices.ContainsFunc(listens, func(l listenSpec) bool { return l.acme }) {
+		return errors.New("ACME options: --listen addresses marked acme need --acme-domain")
+	}
+	addrs := make([]string, len(listens))
+	servers := make([]*http.Server, len(listens))
+	conns := newConnTracker()
+	for i, l := range listens {
+		addrs[i] = l.addr
+		servers[i] = &http.Server{
+			Addr:              l.addr,
+			Handler:           s.handler,
+			ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+			IdleTimeout:       cfg.IdleTimeout,
+			ConnContext:       connContext,
+			TLSConfig:         l.tls,
+		}
+		if adminOn {
+			servers[i].ConnContext = conns.connContext
+			servers[i].ConnState = conns.connState
+		}
+		if s.readRate != nil {
+			track := servers[i].ConnState
+			servers[i].ConnState = func(c net.Conn, state http.ConnState) {
+				s.readRate.connState(c, state)
+				if track != nil {
+					track(c, state)
+				}
+			}
+		}
+		servers[i].SetKeepAlivesEnabled(cfg.KeepAlive)
+		if cfg.GRPC {
+			// gRPC clients speak HTTP/2 without TLS unless told otherwise
+			servers[i].Protocols = new(http.Protocols)
+			servers[i].Protocols.SetHTTP1(true)
+			servers[i].Protocols.SetHTTP2(true)
+			servers[i].Protocols.SetUnencryptedHTTP2(true)
+		}
+	}
+	// Without an address of its own the admin API shares the listeners
+	var admin *adminServer
+	if adminOn {
+		admin = newAdminServer(cfg, servers, conns, stats, s.settings, logs, s.ui, log)
+		if cfg.AdminAddr == "" {
+			for _, server := range servers {
+				server.Handler = mountAdmin(admin, server.Handler)
+			}
+		}
+	}
+	// The LAN features need a plain HTTP port
+	lan := slices.IndexFunc(listens, func(l listenSpec) bool { return l.tcp() && l.tls == nil })
+	if lan < 0 && (cfg.QR || cfg.UPnP || cfg.MDNS != "") {
+		return errors.New("listen options: --qr, --upnp and --mdns need a TCP address serving plain HTTP")
+	}
+
+	// Start serving on each listener, inherited from the previous process
+	// during a graceful restart. The admin listener comes last, so it is
+	// handed over as well.
+	if cfg.AdminAddr != "" {
+		addrs = append(addrs, cfg.AdminAddr)
+	}
+	groups, err := openListeners(addrs, sockets, cfg.ReusePort, os.FileMode(cfg.SocketMode))
+	if err != nil {
+		return &ListenError{fmt.Errorf("starting server: %v", err)}
+	}
+	var listeners []net.Listener
+	failed := make(chan error, 1)
+	fail := func(err error) {
+		select {
+		case failed <- err:
+		default:
+		}
+	}
+	for i, l := range listens {
+		for _, ln := range groups[i] {
+			listeners = append(listeners, ln)
+			go func() {
+				var err error
+				if l.tls != nil {
+					err = servers[i].ServeTLS(ln, "", "")
+				} else {
+					err = servers[i].Serve(s.readRate.listener(ln))
+				}
+				if err != http.ErrServerClosed {
+					fail(fmt.Errorf("starting server on %s: %v", l.addr, err))
+				}
+			}()
+		}
+	}
+	names := make([]string, len(listens))
+	for i, l := range listens {
+		names[i] = l.String()
+	}
+	log.logf("Starting server on %s with %d listener(s) serving files from %s (mode %s)", strings.Join(names, ", "), len(listeners), s.absDir, cfg.Mode)
+	for i, l := range listens {
+		log.logf("Reachable at %s", strings.Join(l.reachableURLs(groups[i][0], cfg.Network), " "))
+	}
+	var lanHost string
+	var listenPort int
+	if lan >= 0 {
+		lanHost, _, _ = net.SplitHostPort(listens[lan].addr)
+		listenPort = groups[lan][0].Addr().(*net.TCPAddr).Port
+	}
+	var link string
+	if cfg.LinkSecret != "" {
+		base := listens[0].reachableURLs(groups[0][0], cfg.Network)[0]
+		if lan >= 0 {
+			base = lanURL(lanHost, listenPort, cfg.Network)
+		}
+		expires := time.Now().Add(cfg.LinkExpiry)
+		link = ShareLink(base, cfg.LinkSecret, expires)
+		log.logf("Share link, valid until %s: %s", expires.Format(time.DateTime), link)
+	}
+	if cfg.QR {
+		url := lanURL(lanHost, listenPort, cfg.Network)
+		if link != "" {
+			url = link
+		}
+		if q, err := encodeQR([]byte(url)); err != nil {
+			log.logf("Error drawing QR code: %v", err)
+		} else {
+			fmt.Print(q.render())
+			log.logf("Scan the QR code to open %s", url)
+		}
+	}
+	var mapping *portMapping
+	if cfg.UPnP {
+		var publicURL string
+		mapping, publicURL, err = mapPublicPort(listenPort, log)
+		if err != nil {
+			log.logf("Error mapping a public port, the server is only reachable locally: %v", err)
+		} else {
+			log.logf("Port %d forwarded by %v, public URL: %s", listenPort, mapping.mapper, publicURL)
+		}
+	}
+	var tunnel *tunnelListener
+	if cfg.Expose != "" {
+		tunnel, err = openTunnel(cfg.Expose, cfg.ExposeSubdomain, log)
+		if err != nil {
+			log.logf("Error opening a tunnel, the server is only reachable locally: %v", err)
+		} else {
+			// Requests come over the tunnel as over any other connection
+			go func() {
+				if err := servers[0].Serve(tunnel); err != http.ErrServerClosed {
+					fail(fmt.Errorf("serving the tunnel to %s: %v", cfg.Expose, err))
+				}
+			}()
+			log.logf("Exposed through %s at %s", cfg.Expose, tunnel.url)
+			if cfg.LinkSecret != "" {
+				log.logf("Public share link: %s", ShareLink(strings.TrimSuffix(tunnel.url, "/")+"/", cfg.LinkSecret, time.Now().Add(cfg.LinkExpiry)))
+			}
+		}
+	}
+	var mdns *mdnsResponder
+	if cfg.MDNS != "" {
+		mdns, err = newMDNSResponder(cfg.MDNS, listenPort, log)
+		if err != nil {
+			return fmt.Errorf("starting mDNS: %v", err)
+		}
+		go mdns.run()
+		log.logf("Advertising %q over mDNS as %s", cfg.MDNS, strings.TrimSuffix(mdns.host.String(), "."))
+	}
+	var adminHTTP *http.Server
+	if cfg.AdminAddr != "" {
+		adminHTTP = &http.Server{Addr: cfg.AdminAddr, Handler: admin, ReadHeaderTimeout: cfg.ReadHeaderTimeout, IdleTimeout: cfg.IdleTimeout}
+		for _, ln := range groups[len(listens)] {
+			listeners = append(listeners, ln)
+			go func() {
+				if err := adminHTTP.Serve(ln); err != http.ErrServerClosed {
+					fail(fmt.Errorf("starting admin server: %v", err))
+				}
+			}()
+		}
+		log.logf("Serving the admin API on %s", groups[len(listens)][0].Addr())
+	} else if admin != nil {
+		log.logf("Serving the admin API at %s", adminPrefix)
+	}
+	var grpcServer *http.Server
+	if cfg.GRPCAddr != "" {
+		grpcServer = &http.Server{
+			Addr: cfg.GRPCAddr,
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r = withRequestID(w, r)
+				if !s.files.handles(r) {
+					renderError(w, r, http.StatusNotFound, s.ui)
+					return
+				}
+				s.files.ServeHTTP(w, r)
+			}),
+			ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+			IdleTimeout:       cfg.IdleTimeout,
+			Protocols:         new(http.Protocols),
+		}
+		grpcServer.Protocols.SetUnencryptedHTTP2(true)
+		ln, err := net.Listen(cfg.Network, cfg.GRPCAddr)
+		if err != nil {
+			return &ListenError{fmt.Errorf("starting gRPC server: %v", err)}
+		}
+		go func() {
+			if err := grpcServer.Serve(ln); err != http.ErrServerClosed {
+				fail(fmt.Errorf("starting gRPC server: %v", err))
+			}
+		}()
+		log.logf("Serving gRPC on %s", ln.Addr())
+	}
+	if s.ftp != nil {
+		ln, err := net.Listen(cfg.Network, cfg.FTP)
+		if err != nil {
+			return &ListenError{fmt.Errorf("starting FTP server: %v", err)}
+		}
+		go s.ftp.serve(ln)
+		log.logf("Serving FTP on %s", ln.Addr())
+	}
+	if cfg.ReadyFile != "" || cfg.ReadyFD > 0 {
+		var bound []string
+		for i := range listens {
+			for _, ln := range groups[i] {
+				bound = append(bound, ln.Addr().String())
+			}
+		}
+		if err := signalReady(cfg, bound); err != nil {
+			return fmt.Errorf("signaling readiness: %v", err)
+		}
+		if cfg.ReadyFile != "" {
+			defer os.Remove(cfg.ReadyFile)
+		}
+	}
+
+	// Set up graceful shutdown, and graceful restart on SIGUSR2
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	restart := handleRestarts(listeners, log)
+	finishRestart(log)
+	var adminStop chan time.Duration
+	if admin != nil {
+		admin.restart = restart
+		adminStop = admin.stop
+	}
+
+	// Wait for CTRL+C, the admin API, or for a listener to fail
+	var timeout time.Duration
+	select {
+	case <-stop:
+		err = nil
+	case timeout = <-adminStop:
+		err = nil
+	case <-tuiStop:
+		err = nil
+	case err = <-failed:
+	}
+	signal.Stop(stop)
+	if tui != nil {
+		tui.close()
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	log.logf("Shutting down server...")
+	if mdns != nil {
+		mdns.close()
+	}
+	if mapping != nil {
+		mapping.close()
+	}
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				log.logf("Error shutting down server on %s: %v", server.Addr, err)
+				server.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	if adminHTTP != nil {
+		adminHTTP.Shutdown(ctx)
+	}
+	if grpcServer != nil {
+		grpcServer.Shutdown(context.Background())
+	}
+	if s.ftp != nil {
+		s.ftp.close()
+	}
+	s.plugins.close()
+	if s.recorder != nil {
+		s.recorder.close()
+	}
+	log.logf("Server stopped")
+	return err
+}
+
+// loggingResponseWrite is a custom ResponseWriter that captures the status code
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	written    int64
+	buffers    *bufferPool
+	body       string
+	note       string
+	user       string
+	transfer   *transfer // the progress shown by --tui, nil without it
+}
+
+// WriteHeader captures the status code before writing it
+func (lrw *loggingResponseWriter) WriteHeader(code int) {
+	lrw.statusCode = code
+	if lrw.transfer != nil {
+		lrw.transfer.noteSize(lrw.Header())
+	}
+	lrw.ResponseWriter.WriteHeader(code)
+}
+
+// Write counts the bytes of the response body
+func (lrw *loggingResponseWriter) Write(b []byte) (int, error) {
+	n, err := lrw.ResponseWriter.Write(b)
+	lrw.written += int64(n)
+	if lrw.transfer != nil {
+		lrw.transfer.sent.Store(lrw.written)
+	}
+	if lrw.body == bodyNone {
+		lrw.body = bodyWrite
+	}
+	return n, err
+}
+
+// ReadFrom hands file bodies to the underlying writer, which sends them
+// with sendfile, and copies anything else through a pooled buffer.
+// Watched transfers send files in chunks to report their progress.
+func (lrw *loggingResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	var n int64
+	var err error
+	switch {
+	case isFileSource(src) && lrw.transfer != nil:
+		lrw.body = bodySendfile
+		n, err = copyChunks(lrw.ResponseWriter, src, func(sent int64) error {
+			lrw.transfer.sent.Store(lrw.written + sent)
+			return nil
+		})
+	case isFileSource(src):
+		lrw.body = bodySendfile
+		n, err = readFrom(lrw.ResponseWriter, src)
+	default:
+		lrw.body = bodyBuffered
+		n, err = lrw.buffers.copy(lrw.ResponseWriter, src)
+	}
+	lrw.written += n
+	if lrw.transfer != nil {
+		lrw.transfer.sent.Store(lrw.written)
+	}
+	return n, err
+}
+
+// Flush sends buffered data to the client, so streamed pages render as
+// they are written
+func (lrw *loggingResponseWriter) Flush() {
+	if f, ok := lrw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (lrw *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return lrw.ResponseWriter
+}
@@ -0,0 +1,414 @@
+package httpserve
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Settings the admin API changes while the server runs, as named in the
+// journal
+const (
+	settingLogLevel    = "log_level"
+	settingRateLimit   = "rate_limit"
+	settingMaintenance = "maintenance"
+	settingDeny        = "deny"
+)
+
+// rateSetting is the value of the rate_limit setting, a rate of 0 turning
+// rate limiting off
+type rateSetting struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// denyRule answers 403 to the requests of a client address or network, or
+// to the paths under a prefix, until it expires
+type denyRule struct {
+	ID      int       `json:"id"`
+	Client  string    `json:"client,omitempty"`
+	Path    string    `json:"path,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+	Expires time.Time `json:"expires,omitzero"`
+
+	network netip.Prefix
+}
+
+// settingsChange is an entry of the journal
+type settingsChange struct {
+	ID      int             `json:"id"`
+	Time    time.Time       `json:"time"`
+	Setting string          `json:"setting"`
+	Old     json.RawMessage `json:"old"`
+	New     json.RawMessage `json:"new"`
+	Reverts int             `json:"reverts,omitempty"` // the change undone by this one
+	Remote  string          `json:"remote,omitempty"`
+}
+
+// settingsView is the body of GET /settings
+type settingsView struct {
+	LogLevel        string      `json:"log_level"`
+	RateLimit       rateSetting `json:"rate_limit"`
+	Maintenance     bool        `json:"maintenance"`
+	MaintenanceFile bool        `json:"maintenance_file"` // whether .maintenance turns it on regardless
+	Deny            []denyRule  `json:"deny"`
+}
+
+// runtimeSettings holds the settings changed through the admin API, read
+// by the settings and rate limit stages on every request. Each change is
+// journaled, to --admin-journal when given, so it can be reverted and is
+// applied again on the next start.
+type runtimeSettings struct {
+	limiter     atomic.Pointer[rateLimiter]
+	maintenance atomic.Bool
+	deny        atomic.Pointer[[]denyRule]
+	marker      *maintenanceMarker // nil when the files are not on disk
+	log         *serverLog         // whose level is the log_level setting
+
+	mu       sync.Mutex // serializes changes
+	rate     rateSetting
+	nextRule int
+	journal  []settingsChange
+	file     *os.File
+}
+
+func newRuntimeSettings(limiter *rateLimiter, rate rateSetting, log *serverLog) *runtimeSettings {
+	s := &runtimeSettings{rate: rate, log: log, nextRule: 1}
+	s.limiter.Store(limiter)
+	s.deny.Store(&[]denyRule{})
+	return s
+}
+
+// rateLimiter returns the current limiter, nil when rate limiting is off
+func (s *runtimeSettings) rateLimiter() *rateLimiter {
+	return s.limiter.Load()
+}
+
+// denied returns the rule matching the request
+func (s *runtimeSettings) denied(r *http.Request, now time.Time) (denyRule, bool) {
+	rules := *s.deny.Load()
+	if len(rules) == 0 {
+		return denyRule{}, false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, addrErr := netip.ParseAddr(host)
+	addr = addr.Unmap()
+	for _, rule := range rules {
+		if !rule.Expires.IsZero() && now.After(rule.Expires) {
+			continue
+		}
+		if rule.Client != "" && addrErr == nil && rule.network.Contains(addr) {
+			return rule, true
+		}
+		if rule.Path != "" && (r.URL.Path == rule.Path || strings.HasPrefix(r.URL.Path, strings.TrimSuffix(rule.Path, "/")+"/")) {
+			return rule, true
+		}
+	}
+	return denyRule{}, false
+}
+
+// view returns the current settings, leaving out expired deny rules
+func (s *runtimeSettings) view() settingsView {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v := settingsView{LogLevel: s.log.level.get(), RateLimit: s.rate, Maintenance: s.maintenance.Load(), Deny: []denyRule{}}
+	now := time.Now()
+	v.MaintenanceFile = s.marker != nil && s.marker.exists(now)
+	for _, rule := range *s.deny.Load() {
+		if rule.Expires.IsZero() || now.Before(rule.Expires) {
+			v.Deny = append(v.Deny, rule)
+		}
+	}
+	return v
+}
+
+// history returns the journal, oldest change first
+func (s *runtimeSettings) history() []settingsChange {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.journal)
+}
+
+// current returns the value of a setting
+func (s *runtimeSettings) current(setting string) any {
+	switch setting {
+	case settingLogLevel:
+		return s.log.level.get()
+	case settingRateLimit:
+		return s.rate
+	case settingMaintenance:
+		return s.maintenance.Load()
+	}
+	return nil
+}
+
+// set changes a setting other than deny to value, journaling the change
+func (s *runtimeSettings) set(setting string, value json.RawMessage, reverts int, remote string) (settingsChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if setting == settingDeny {
+		return settingsChange{}, errors.New("deny rules are added and removed, not set")
+	}
+	old, err := json.Marshal(s.current(setting))
+	if err != nil {
+		return settingsChange{}, err
+	}
+	if err := s.applyLocked(setting, old, value); err != nil {
+		return settingsChange{}, err
+	}
+	return s.recordLocked(setting, old, value, reverts, remote)
+}
+
+// addDeny adds a deny rule, journaling the change
+func (s *runtimeSettings) addDeny(rule denyRule, remote string) (denyRule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rule.ID = s.nextRule
+	value, err := json.Marshal(rule)
+	if err != nil {
+		return denyRule{}, err
+	}
+	if err := s.applyLocked(settingDeny, nil, value); err != nil {
+		return denyRule{}, err
+	}
+	_, err = s.recordLocked(settingDeny, json.RawMessage("null"), value, 0, remote)
+	return rule, err
+}
+
+// removeDeny removes the deny rule with the id, journaling the change
+func (s *runtimeSettings) removeDeny(id int, reverts int, remote string) (settingsChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.IndexFunc(*s.deny.Load(), func(rule denyRule) bool { return rule.ID == id })
+	if i < 0 {
+		return settingsChange{}, fmt.Errorf("no deny rule %d", id)
+	}
+	old, err := json.Marshal((*s.deny.Load())[i])
+	if err != nil {
+		return settingsChange{}, err
+	}
+	if err := s.applyLocked(settingDeny, old, nil); err != nil {
+		return settingsChange{}, err
+	}
+	return s.recordLocked(settingDeny, old, json.RawMessage("null"), reverts, remote)
+}
+
+// revert undoes the change with the id, journaling it as a new change
+func (s *runtimeSettings) revert(id int, remote string) (settingsChange, error) {
+	s.mu.Lock()
+	i := slices.IndexFunc(s.journal, func(c settingsChange) bool { return c.ID == id })
+	var change settingsChange
+	if i >= 0 {
+		change = s.journal[i]
+	}
+	s.mu.Unlock()
+	switch {
+	case i < 0:
+		return settingsChange{}, fmt.Errorf("no change %d in the journal", id)
+	case change.Setting != settingDeny:
+		return s.set(change.Setting, change.Old, id, remote)
+	case isJSONNull(change.Old):
+		// Undo adding a rule
+		var rule denyRule
+		if err := json.Unmarshal(change.New, &rule); err != nil {
+			return settingsChange{}, err
+		}
+		return s.removeDeny(rule.ID, id, remote)
+	}
+	// Undo removing a rule, under its old id
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.applyLocked(settingDeny, nil, change.Old); err != nil {
+		return settingsChange{}, err
+	}
+	return s.recordLocked(settingDeny, json.RawMessage("null"), change.Old, id, remote)
+}
+
+// applyLocked changes a setting from old to value. Deny rules are added
+// when value holds one and removed when it is null.
+func (s *runtimeSettings) applyLocked(setting string, old, value json.RawMessage) error {
+	switch setting {
+	case settingLogLevel:
+		var level string
+		if err := json.Unmarshal(value, &level); err != nil {
+			return fmt.Errorf("invalid log_level: %v", err)
+		}
+		return s.log.level.set(level)
+	case settingRateLimit:
+		var rate rateSetting
+		if err := json.Unmarshal(value, &rate); err != nil {
+			return fmt.Errorf("invalid rate_limit: %v", err)
+		}
+		if rate.Burst == 0 {
+			rate.Burst = s.rate.Burst
+		}
+		limiter, err := newRateLimiter(rate.Rate, rate.Burst)
+		if err != nil {
+			return err
+		}
+		s.rate = rate
+		s.limiter.Store(limiter)
+		return nil
+	case settingMaintenance:
+		var on bool
+		if err := json.Unmarshal(value, &on); err != nil {
+			return fmt.Errorf("invalid maintenance: %v", err)
+		}
+		s.maintenance.Store(on)
+		return nil
+	case settingDeny:
+		rules := slices.Clone(*s.deny.Load())
+		if isJSONNull(value) {
+			var rule denyRule
+			if err := json.Unmarshal(old, &rule); err != nil {
+				return fmt.Errorf("invalid deny rule: %v", err)
+			}
+			rules = slices.DeleteFunc(rules, func(r denyRule) bool { return r.ID == rule.ID })
+		} else {
+			rule, err := parseDenyRule(value)
+			if err != nil {
+				return err
+			}
+			if slices.ContainsFunc(rules, func(r denyRule) bool { return r.ID == rule.ID }) {
+				return fmt.Errorf("deny rule %d already exists", rule.ID)
+			}
+			rules = append(rules, rule)
+			s.nextRule = max(s.nextRule, rule.ID+1)
+		}
+		// Expired rules are dropped on the way
+		now := time.Now()
+		rules = slices.DeleteFunc(rules, func(r denyRule) bool { return !r.Expires.IsZero() && now.After(r.Expires) })
+		s.deny.Store(&rules)
+		return nil
+	}
+	return fmt.Errorf("unknown setting %q", setting)
+}
+
+// recordLocked appends a change to the journal
+func (s *runtimeSettings) recordLocked(setting string, old, value json.RawMessage, reverts int, remote string) (settingsChange, error) {
+	id := 1
+	if n := len(s.journal); n > 0 {
+		id = s.journal[n-1].ID + 1
+	}
+	change := settingsChange{ID: id, Time: time.Now().UTC(), Setting: setting, Old: old, New: value, Reverts: reverts, Remote: remote}
+	s.journal = append(s.journal, change)
+	s.log.logf("Setting %s changed from %s to %s", setting, old, value)
+	if s.file == nil {
+		return change, nil
+	}
+	line, err := json.Marshal(change)
+	if err != nil {
+		return change, err
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		s.log.logf("Error writing the settings journal: %v", err)
+		return change, fmt.Errorf("changed, but not journaled: %v", err)
+	}
+	return change, nil
+}
+
+// openJournal applies the changes of the journal at path again, then
+// appends the next ones to it
+func (s *runtimeSettings) openJournal(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var change settingsChange
+		if err := json.Unmarshal(scanner.Bytes(), &change); err != nil {
+			f.Close()
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if err := s.applyLocked(change.Setting, change.Old, change.New); err != nil {
+			// A rule may have expired or the change been superseded, the
+			// journal still records it
+			s.log.logf("Error applying change %d of the settings journal again: %v", change.ID, err)
+		}
+		s.journal = append(s.journal, change)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	s.file = f
+	if len(s.journal) > 0 {
+		s.log.logf("Applied %d change(s) from the settings journal %s", len(s.journal), path)
+	}
+	return nil
+}
+
+// parseDenyRule parses a rule given as JSON, matching either a client
+// address or network or a path prefix
+func parseDenyRule(value json.RawMessage) (denyRule, error) {
+	var rule denyRule
+	if err := json.Unmarshal(value, &rule); err != nil {
+		return rule, fmt.Errorf("invalid deny rule: %v", err)
+	}
+	switch {
+	case (rule.Client == "") == (rule.Path == ""):
+		return rule, errors.New("a deny rule needs either a client or a path")
+	case rule.Path != "" && !strings.HasPrefix(rule.Path, "/"):
+		return rule, fmt.Errorf("deny path %q must start with /", rule.Path)
+	case rule.Client != "":
+		network, err := netip.ParsePrefix(rule.Client)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(rule.Client)
+			if addrErr != nil {
+				return rule, fmt.Errorf("deny client %q is not an address or network", rule.Client)
+			}
+			addr = addr.Unmap()
+			network = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		rule.network = network.Masked()
+	}
+	return rule, nil
+}
+
+func isJSONNull(value json.RawMessage) bool {
+	return len(value) == 0 || string(value) == "null"
+}
+
+// applySettings is the settings stage, answering 403 to requests matching
+// a deny rule and 503 to every request in maintenance mode
+func applySettings(settings *runtimeSettings, maintenance maintenanceOptions, ui uiOptions) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if rule, ok := settings.denied(r, time.Now()); ok {
+				if lrw := loggedResponse(r); lrw != nil {
+					lrw.note = "denied by rule " + strconv.Itoa(rule.ID)
+				}
+				renderError(w, r, http.StatusForbidden, ui)
+				return
+			}
+			if settings.inMaintenance() {
+				serveMaintenance(w, r, maintenance, ui)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
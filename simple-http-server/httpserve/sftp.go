@@ -0,0 +1,656 @@
+package httpserve
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SFTP version 3 packet types and constants used by the client
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRealpath = 16
+	sftpStat     = 17
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+
+	sftpReadFlag    = 0x1
+	sftpStatusEOF   = 1
+	sftpNoSuchFile  = 2
+	sftpDenied      = 3
+	sftpAttrSize    = 0x1
+	sftpAttrUIDGID  = 0x2
+	sftpAttrPerms   = 0x4
+	sftpAttrTimes   = 0x8
+	sftpAttrExt     = 0x80000000
+	sftpMaxRead     = 32 << 10
+	sftpMaxPacket   = 256 << 10
+	sftpConnections = 4
+)
+
+// errSFTPConnLost reports that the ssh process of a connection exited; the
+// request can be retried on a new connection
+var errSFTPConnLost = errors.New("sftp connection lost")
+
+// sftpFS serves a remote directory over SFTP, running the sftp subsystem
+// through the system ssh client so ~/.ssh/config, agents and known_hosts
+// apply as usual. Requests are spread over a small pool of connections
+// that are re-established when they drop.
+type sftpFS struct {
+	root    string
+	command []string
+	target  string
+	log     *serverLog
+
+	mu    sync.Mutex
+	conns []*sftpConn
+	next  int
+}
+
+// openSFTPFS serves the directory of an sftp://user@host:port/path URL.
+// Paths starting with /~ are relative to the home directory. The
+// connections and command URL parameters set the pool size and the ssh
+// program, e.g. "ssh -i key".
+func openSFTPFS(u *url.URL, log *serverLog) (fs.FS, error) {
+	q := u.Query()
+	size := sftpConnections
+	if v := q.Get("connections"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid connections %q", v)
+		}
+		size = n
+	}
+	command := strings.Fields(firstNonEmpty(q.Get("command"), "ssh"))
+	command = append(command, "-oBatchMode=yes", "-oServerAliveInterval=15")
+	if port := u.Port(); port != "" {
+		command = append(command, "-p", port)
+	}
+	if u.User != nil {
+		command = append(command, "-l", u.User.Username())
+	}
+	command = append(command, "-s", u.Hostname(), "sftp")
+	s := &sftpFS{command: command, target: u.Host, log: log, conns: make([]*sftpConn, size)}
+
+	root := u.Path
+	if root == "/~" || strings.HasPrefix(root, "/~/") {
+		root = "." + strings.TrimPrefix(root, "/~")
+	} else if root == "" {
+		root = "/"
+	}
+	var resolved string
+	err := s.do(func(c *sftpConn) error {
+		var err error
+		resolved, err = c.realpath(root)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("resolving %s on %s: %v", root, u.Host, err)
+	}
+	s.root = resolved
+	info, err := fs.Stat(s, ".")
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s on %s is not a directory", resolved, u.Host)
+	}
+	log.logf("Serving %s from %s over SFTP with up to %d connections", resolved, u.Host, size)
+	return s, nil
+}
+
+// conn returns a live connection from the pool, starting one in an empty
+// or dropped slot
+func (s *sftpFS) conn() (*sftpConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.next
+	s.next = (s.next + 1) % len(s.conns)
+	if c := s.conns[i]; c != nil && !c.closed() {
+		return c, nil
+	}
+	c, err := dialSFTP(s.command)
+	if err != nil {
+		return nil, err
+	}
+	if s.conns[i] != nil {
+		s.log.logf("Reconnected to %s over SFTP", s.target)
+	}
+	s.conns[i] = c
+	return c, nil
+}
+
+// do runs op on a pooled connection, retrying once on a new connection
+// when the one used drops
+func (s *sftpFS) do(op func(c *sftpConn) error) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var c *sftpConn
+		if c, err = s.conn(); err != nil {
+			return err
+		}
+		if err = op(c); !errors.Is(err, errSFTPConnLost) {
+			return err
+		}
+	}
+	return err
+}
+
+// remotePath returns the remote path of a file system path
+func (s *sftpFS) remotePath(name string) string {
+	return path.Join(s.root, name)
+}
+
+// Open returns the file or directory at name
+func (s *sftpFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	var info objectInfo
+	err := s.do(func(c *sftpConn) error {
+		var err error
+		info, err = c.stat(s.remotePath(name))
+		return err
+	})
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	info.name = path.Base(name)
+	if info.dir {
+		return &sftpDir{fs: s, name: name, info: info}, nil
+	}
+	return &sftpFile{fs: s, name: name, info: info}, nil
+}
+
+// sftpFile reads a remote file, opening a handle on first read and again
+// after its connection drops
+type sftpFile struct {
+	fs     *sftpFS
+	name   string
+	info   objectInfo
+	offset int64
+	conn   *sftpConn
+	handle string
+}
+
+func (f *sftpFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+// Read reads from the current offset
+func (f *sftpFile) Read(p []byte) (int, error) {
+	if f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+	var n int
+	err := f.fs.do(func(c *sftpConn) error {
+		if f.handle == "" || f.conn != c && f.conn.closed() {
+			handle, err := c.open(f.fs.remotePath(f.name))
+			if err != nil {
+				return err
+			}
+			f.conn, f.handle = c, handle
+		}
+		var err error
+		n, err = f.conn.read(f.handle, f.offset, p)
+		if errors.Is(err, errSFTPConnLost) {
+			f.handle = ""
+		}
+		return err
+	})
+	f.offset += int64(n)
+	return n, err
+}
+
+// Seek moves the read position
+func (f *sftpFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Close releases the remote handle
+func (f *sftpFile) Close() error {
+	if f.handle != "" && !f.conn.closed() {
+		return f.conn.close(f.handle)
+	}
+	return nil
+}
+
+// sftpDir lists a remote directory
+type sftpDir struct {
+	fs      *sftpFS
+	name    string
+	info    objectInfo
+	pending []fs.DirEntry
+	done    bool
+	listed  bool
+}
+
+func (d *sftpDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *sftpDir) Close() error               { return nil }
+
+// Read fails, as directories have no contents of their own
+func (d *sftpDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir returns the next n entries, or all remaining ones when n <= 0.
+// The whole listing is fetched on the first call so a dropped connection
+// never leaves it half read.
+func (d *sftpDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.listed {
+		err := d.fs.do(func(c *sftpConn) error {
+			entries, err := c.readDir(d.fs.remotePath(d.name))
+			d.pending = entries
+			return err
+		})
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: d.name, Err: err}
+		}
+		d.listed = true
+	}
+	if n > 0 && len(d.pending) == 0 {
+		return nil, io.EOF
+	}
+	if n <= 0 || n > len(d.pending) {
+		n = len(d.pending)
+	}
+	entries := d.pending[:n:n]
+	d.pending = d.pending[n:]
+	return entries, nil
+}
+
+// sftpPacket is a response, with the request id already taken off
+type sftpPacket struct {
+	kind byte
+	data []byte
+}
+
+// sftpConn is one ssh process running the sftp subsystem. Requests from
+// any goroutine are matched to their responses by id.
+type sftpConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	lastID atomic.Uint32
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	pending map[uint32]chan sftpPacket
+	done    chan struct{}
+}
+
+// dialSFTP starts ssh and performs the SFTP version negotiation
+func dialSFTP(command []string) (*sftpConn, error) {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	c := &sftpConn{cmd: cmd, stdin: stdin, pending: make(map[uint32]chan sftpPacket), done: make(chan struct{})}
+	r := bufio.NewReaderSize(stdout, 64<<10)
+
+	// The version exchange has no request id
+	init := binary.BigEndian.AppendUint32([]byte{sftpInit}, 3)
+	if err := c.writePacket(init); err != nil {
+		c.shutdown()
+		return nil, err
+	}
+	kind, _, err := readSFTPPacket(r)
+	if err != nil || kind != sftpVersion {
+		c.shutdown()
+		return nil, fmt.Errorf("sftp handshake failed: %v", firstError(err, errors.New("unexpected reply")))
+	}
+	go c.readLoop(r)
+	return c, nil
+}
+
+// firstError returns the first non-nil error
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSFTPPacket reads one length prefixed packet
+func readSFTPPacket(r io.Reader) (byte, []byte, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return 0, nil, err
+	}
+	if length == 0 || length > sftpMaxPacket {
+		return 0, nil, fmt.Errorf("invalid sftp packet length %d", length)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, nil, err
+	}
+	return buf[0], buf[1:], nil
+}
+
+// readLoop delivers responses to the waiting requests until ssh exits
+func (c *sftpConn) readLoop(r io.Reader) {
+	defer c.shutdown()
+	for {
+		kind, data, err := readSFTPPacket(r)
+		if err != nil || len(data) < 4 {
+			return
+		}
+		id := binary.BigEndian.Uint32(data)
+		c.mu.Lock()
+		ch := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if ch != nil {
+			ch <- sftpPacket{kind: kind, data: data[4:]}
+		}
+	}
+}
+
+// shutdown stops the ssh process and fails the pending requests
+func (c *sftpConn) shutdown() {
+	c.mu.Lock()
+	select {
+	case <-c.done:
+		c.mu.Unlock()
+		return
+	default:
+	}
+	close(c.done)
+	c.mu.Unlock()
+	c.stdin.Close()
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+}
+
+// closed reports whether the connection has dropped
+func (c *sftpConn) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// writePacket sends a packet with its length prefix
+func (c *sftpConn) writePacket(payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	buf := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(payload)), uint32(len(payload)))
+	_, err := c.stdin.Write(append(buf, payload...))
+	return err
+}
+
+// request sends a request of the given type and waits for its response
+func (c *sftpConn) request(kind byte, args ...any) (sftpPacket, error) {
+	id := c.lastID.Add(1)
+	payload := binary.BigEndian.AppendUint32([]byte{kind}, id)
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case string:
+			payload = binary.BigEndian.AppendUint32(payload, uint32(len(v)))
+			payload = append(payload, v...)
+		case uint32:
+			payload = binary.BigEndian.AppendUint32(payload, v)
+		case uint64:
+			payload = binary.BigEndian.AppendUint64(payload, v)
+		}
+	}
+	ch := make(chan sftpPacket, 1)
+	c.mu.Lock()
+	if c.closed() {
+		c.mu.Unlock()
+		return sftpPacket{}, errSFTPConnLost
+	}
+	c.pending[id] = ch
+	c.mu.Unlock()
+	if err := c.writePacket(payload); err != nil {
+		c.shutdown()
+		return sftpPacket{}, errSFTPConnLost
+	}
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-c.done:
+		return sftpPacket{}, errSFTPConnLost
+	}
+}
+
+// statusError converts a STATUS response to an error, nil for success
+func statusError(p sftpPacket) error {
+	if p.kind != sftpStatus {
+		return fmt.Errorf("unexpected sftp response type %d", p.kind)
+	}
+	d := sftpDecoder{data: p.data}
+	code := d.uint32()
+	msg := d.string()
+	switch code {
+	case 0:
+		return nil
+	case sftpStatusEOF:
+		return io.EOF
+	case sftpNoSuchFile:
+		return fs.ErrNotExist
+	case sftpDenied:
+		return fs.ErrPermission
+	}
+	return fmt.Errorf("sftp error %d: %s", code, msg)
+}
+
+// realpath canonicalizes a remote path
+func (c *sftpConn) realpath(p string) (string, error) {
+	resp, err := c.request(sftpRealpath, p)
+	if err != nil {
+		return "", err
+	}
+	if resp.kind != sftpName {
+		return "", statusError(resp)
+	}
+	d := sftpDecoder{data: resp.data}
+	if d.uint32() < 1 {
+		return "", errors.New("empty realpath response")
+	}
+	return d.string(), d.err
+}
+
+// stat returns the attributes of a remote path, following symlinks
+func (c *sftpConn) stat(p string) (objectInfo, error) {
+	resp, err := c.request(sftpStat, p)
+	if err != nil {
+		return objectInfo{}, err
+	}
+	if resp.kind != sftpAttrs {
+		return objectInfo{}, statusError(resp)
+	}
+	d := sftpDecoder{data: resp.data}
+	info, _ := d.attrs()
+	return info, d.err
+}
+
+// open opens a remote file for reading and returns its handle
+func (c *sftpConn) open(p string) (string, error) {
+	resp, err := c.request(sftpOpen, p, uint32(sftpReadFlag), uint32(0))
+	if err != nil {
+		return "", err
+	}
+	if resp.kind != sftpHandle {
+		return "", statusError(resp)
+	}
+	d := sftpDecoder{data: resp.data}
+	return d.string(), d.err
+}
+
+// read reads up to len(p) bytes at offset from an open handle
+func (c *sftpConn) read(handle string, offset int64, p []byte) (int, error) {
+	resp, err := c.request(sftpRead, handle, uint64(offset), uint32(min(len(p), sftpMaxRead)))
+	if err != nil {
+		return 0, err
+	}
+	if resp.kind != sftpData {
+		return 0, statusError(resp)
+	}
+	d := sftpDecoder{data: resp.data}
+	data := d.string()
+	return copy(p, data), d.err
+}
+
+// close releases a handle
+func (c *sftpConn) close(handle string) error {
+	resp, err := c.request(sftpClose, handle)
+	if err != nil {
+		return err
+	}
+	return statusError(resp)
+}
+
+// readDir lists a remote directory, resolving symlinks among its entries
+func (c *sftpConn) readDir(p string) ([]fs.DirEntry, error) {
+	resp, err := c.request(sftpOpendir, p)
+	if err != nil {
+		return nil, err
+	}
+	if resp.kind != sftpHandle {
+		return nil, statusError(resp)
+	}
+	handle := (&sftpDecoder{data: resp.data}).string()
+	defer c.close(handle)
+
+	var entries []fs.DirEntry
+	for {
+		resp, err := c.request(sftpReaddir, handle)
+		if err != nil {
+			return nil, err
+		}
+		if resp.kind != sftpName {
+			if err := statusError(resp); err != io.EOF {
+				return nil, err
+			}
+			return entries, nil
+		}
+		d := sftpDecoder{data: resp.data}
+		for count := d.uint32(); count > 0 && d.err == nil; count-- {
+			name := d.string()
+			d.string() // long name
+			info, symlink := d.attrs()
+			if name == "." || name == ".." {
+				continue
+			}
+			if symlink {
+				if info, err = c.stat(path.Join(p, name)); err != nil {
+					continue
+				}
+			}
+			info.name = name
+			entries = append(entries, info)
+		}
+		if d.err != nil {
+			return nil, d.err
+		}
+	}
+}
+
+// sftpDecoder reads the fields of a response, remembering the first error
+type sftpDecoder struct {
+	data []byte
+	err  error
+}
+
+// take returns the next n bytes, or nil once the response has run short:
+// n comes from the server, so it must not size an allocation
+func (d *sftpDecoder) take(n int) []byte {
+	if d.err != nil || len(d.data) < n {
+		d.err = firstError(d.err, errors.New("short sftp response"))
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *sftpDecoder) uint32() uint32 {
+	if b := d.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *sftpDecoder) uint64() uint64 {
+	if b := d.take(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *sftpDecoder) string() string { return string(d.take(int(d.uint32()))) }
+
+// attrs decodes file attributes, reporting whether they describe a symlink
+func (d *sftpDecoder) attrs() (objectInfo, bool) {
+	var info objectInfo
+	var symlink bool
+	flags := d.uint32()
+	if flags&sftpAttrSize != 0 {
+		info.size = int64(d.uint64())
+	}
+	if flags&sftpAttrUIDGID != 0 {
+		d.uint32()
+		d.uint32()
+	}
+	if flags&sftpAttrPerms != 0 {
+		switch d.uint32() & 0o170000 {
+		case 0o040000:
+			info.dir = true
+		case 0o120000:
+			symlink = true
+		}
+	}
+	if flags&sftpAttrTimes != 0 {
+		d.uint32() // access time
+		info.modTime = time.Unix(int64(d.uint32()), 0)
+	}
+	if flags&sftpAttrExt != 0 {
+		for count := d.uint32(); count > 0 && d.err == nil; count-- {
+			d.string()
+			d.string()
+		}
+	}
+	return info, symlink
+}
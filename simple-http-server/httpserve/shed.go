@@ -0,0 +1,96 @@
+package httpserve
+
+import (
+	"net/http"
+	"runtime/metrics"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// sheddingOptions are the thresholds of the admission controller
+type sheddingOptions struct {
+	maxInFlight  int
+	queueTimeout time.Duration
+	maxMemory    int64
+	retryAfter   time.Duration
+}
+
+// loadShedder admits requests while the server has capacity and rejects
+// the rest with 503 Service Unavailable. When every in-flight slot is busy
+// a request waits up to the queue timeout for one to free up.
+type loadShedder struct {
+	opts     sheddingOptions
+	slots    chan struct{}
+	memory   atomic.Int64
+	rejected atomic.Int64
+	log      *serverLog
+}
+
+// newLoadShedder returns an admission controller, or nil when no threshold
+// is set
+func newLoadShedder(opts sheddingOptions, log *serverLog) *loadShedder {
+	if opts.maxInFlight <= 0 && opts.maxMemory <= 0 {
+		return nil
+	}
+	s := &loadShedder{opts: opts, log: log}
+	if opts.maxInFlight > 0 {
+		s.slots = make(chan struct{}, opts.maxInFlight)
+	}
+	go s.monitor()
+	return s
+}
+
+// monitor samples the memory in use by the process and reports shed
+// requests once a second rather than per request
+func (s *loadShedder) monitor() {
+	sample := []metrics.Sample{{Name: "/memory/classes/total:bytes"}}
+	for range time.Tick(time.Second) {
+		metrics.Read(sample)
+		if sample[0].Value.Kind() == metrics.KindUint64 {
+			s.memory.Store(int64(sample[0].Value.Uint64()))
+		}
+		if n := s.rejected.Swap(0); n > 0 {
+			s.log.logf("Load shedding: rejected %d requests in the last second (memory %s)", n, FormatSize(s.memory.Load()))
+		}
+	}
+}
+
+// admit reserves capacity for a request, writing a 503 response and
+// returning false when it is shed. The returned function releases the slot.
+func (s *loadShedder) admit(w http.ResponseWriter, r *http.Request, ui uiOptions) (func(), bool) {
+	if s == nil {
+		return func() {}, true
+	}
+	if s.opts.maxMemory > 0 && s.memory.Load() > s.opts.maxMemory {
+		s.reject(w, r, ui)
+		return nil, false
+	}
+	if s.slots == nil {
+		return func() {}, true
+	}
+	release := func() { <-s.slots }
+	select {
+	case s.slots <- struct{}{}:
+		return release, true
+	default:
+	}
+	if s.opts.queueTimeout > 0 {
+		timer := time.NewTimer(s.opts.queueTimeout)
+		defer timer.Stop()
+		select {
+		case s.slots <- struct{}{}:
+			return release, true
+		case <-timer.C:
+		case <-r.Context().Done():
+		}
+	}
+	s.reject(w, r, ui)
+	return nil, false
+}
+
+func (s *loadShedder) reject(w http.ResponseWriter, r *http.Request, ui uiOptions) {
+	s.rejected.Add(1)
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(s.opts.retryAfter.Seconds()))))
+	renderErrorMessage(w, r, http.StatusServiceUnavailable, ui, "error.overloaded")
+}
@@ -0,0 +1,311 @@
+package httpserve
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errSlowBody is returned by request bodies arriving below --min-read-rate
+var errSlowBody = errors.New("request body arrived too slowly")
+
+// readRateCheck is how often the guard compares the bytes read with the
+// minimum rate
+const readRateCheck = time.Second
+
+// http2Preface starts the connections of clients speaking HTTP/2 without
+// TLS, which multiplex requests and ping while idle, so the header guard
+// leaves them alone
+var http2Preface = []byte("PRI * HTTP/2.0\r\n")
+
+// timeoutResponse answers a client whose headers trickle in, written on
+// the connection itself since no request exists yet
+const timeoutResponse = "HTTP/1.1 408 Request Timeout\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: 16\r\nConnection: close\r\n\r\nRequest Timeout\n"
+
+// readRateGuard aborts the requests whose headers or body arrive slower
+// than rate bytes per second once grace has passed, so a client trickling
+// bytes in can't hold a connection and its handler open
+type readRateGuard struct {
+	rate  float64
+	grace time.Duration
+	log   *serverLog
+}
+
+// newReadRateGuard returns the guard of --min-read-rate, or nil when rate
+// is 0
+func newReadRateGuard(rate int64, grace time.Duration, log *serverLog) (*readRateGuard, error) {
+	switch {
+	case rate < 0:
+		return nil, fmt.Errorf("--min-read-rate must not be negative")
+	case rate == 0:
+		return nil, nil
+	case grace <= 0:
+		return nil, fmt.Errorf("--min-read-rate-grace must be positive")
+	}
+	return &readRateGuard{rate: float64(rate), grace: grace, log: log}, nil
+}
+
+// tooSlow reports whether n bytes since start are below the rate
+func (g *readRateGuard) tooSlow(n int64, start time.Time) bool {
+	elapsed := time.Since(start)
+	return elapsed >= g.grace && float64(n) < g.rate*elapsed.Seconds()
+}
+
+// listener guards the headers of the connections accepted by ln, which
+// must serve plain HTTP: the 408 is written unencrypted
+func (g *readRateGuard) listener(ln net.Listener) net.Listener {
+	if g == nil {
+		return ln
+	}
+	return guardedListener{Listener: ln, guard: g}
+}
+
+// guardedListener wraps accepted connections in a guardedConn
+type guardedListener struct {
+	net.Listener
+	guard *readRateGuard
+}
+
+// Accept waits for a connection and starts guarding it
+func (l guardedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return c, err
+	}
+	return &guardedConn{Conn: c, guard: l.guard}, nil
+}
+
+// guardedConn watches the headers of each request: from the first byte
+// read while idle until the request reaches the pipeline
+type guardedConn struct {
+	net.Conn
+	guard *readRateGuard
+
+	mu       sync.Mutex
+	started  bool // read a first byte, to spot HTTP/2
+	detached bool // HTTP/2 or hijacked
+	active   int  // requests in the pipeline
+	reading  bool // reading headers
+	start    time.Time
+	read     int64
+	timer    *time.Timer
+}
+
+// Read counts the bytes of the headers being read
+func (c *guardedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n == 0 {
+		return n, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.started {
+		c.started = true
+		c.detached = bytes.HasPrefix(b[:n], http2Preface)
+	}
+	if c.detached || c.active > 0 {
+		return n, err
+	}
+	if !c.reading {
+		c.reading, c.start, c.read = true, time.Now(), 0
+		c.timer = time.AfterFunc(readRateCheck, c.check)
+	}
+	c.read += int64(n)
+	return n, err
+}
+
+// check answers 408 and closes the connection when the headers arrive
+// too slowly
+func (c *guardedConn) check() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.reading {
+		return
+	}
+	if !c.guard.tooSlow(c.read, c.start) {
+		c.timer.Reset(readRateCheck)
+		return
+	}
+	c.reading = false
+	c.guard.log.logf("Closing connection from %s: headers arrived at %d bytes in %s", c.RemoteAddr(), c.read, time.Since(c.start).Round(time.Millisecond))
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	io.WriteString(c.Conn, timeoutResponse)
+	c.Conn.Close()
+}
+
+// serving marks the headers of a request as read
+func (c *guardedConn) serving() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active++
+	c.stopLocked()
+}
+
+// served marks the end of a request; the bytes read next start another
+func (c *guardedConn) served() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active--
+}
+
+// detach stops guarding a connection taken over by its handler
+func (c *guardedConn) detach() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.detached = true
+	c.stopLocked()
+}
+
+func (c *guardedConn) stopLocked() {
+	c.reading = false
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
+
+// ReadFrom keeps the sendfile path of the underlying connection
+func (c *guardedConn) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(c.Conn, r)
+}
+
+// CloseWrite lets the server finish the response before closing
+func (c *guardedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// connState stops guarding hijacked and closed connections, and the
+// headers of requests the server answered without the pipeline, such as
+// OPTIONS *, once it waits for the next one
+func (g *readRateGuard) connState(c net.Conn, state http.ConnState) {
+	gc, ok := c.(*guardedConn)
+	if !ok {
+		return
+	}
+	switch state {
+	case http.StateIdle:
+		gc.mu.Lock()
+		gc.stopLocked()
+		gc.mu.Unlock()
+	case http.StateHijacked, http.StateClosed:
+		gc.detach()
+	}
+}
+
+// guardedBody aborts the read of a request body arriving too slowly,
+// counted from the handler's first read
+type guardedBody struct {
+	io.ReadCloser
+	guard  *readRateGuard
+	rc     *http.ResponseController
+	remote string
+
+	mu    sync.Mutex
+	start time.Time
+	read  int64
+	done  bool
+	slow  bool
+	timer *time.Timer
+}
+
+// Read reads the body, failing with errSlowBody once it is too slow
+func (b *guardedBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	if b.slow {
+		b.mu.Unlock()
+		return 0, errSlowBody
+	}
+	if b.timer == nil && !b.done {
+		b.start = time.Now()
+		b.timer = time.AfterFunc(readRateCheck, b.check)
+	}
+	b.mu.Unlock()
+
+	n, err := b.ReadCloser.Read(p)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.read += int64(n)
+	if b.slow {
+		return n, errSlowBody
+	}
+	if err != nil {
+		b.stopLocked()
+	}
+	return n, err
+}
+
+// check interrupts the body read when it is too slow
+func (b *guardedBody) check() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done {
+		return
+	}
+	if !b.guard.tooSlow(b.read, b.start) {
+		b.timer.Reset(readRateCheck)
+		return
+	}
+	b.slow = true
+	b.stopLocked()
+	b.guard.log.logf("Aborting request body from %s: %d bytes in %s", b.remote, b.read, time.Since(b.start).Round(time.Millisecond))
+	b.rc.SetReadDeadline(time.Now())
+}
+
+// tooSlow reports whether the body was aborted
+func (b *guardedBody) tooSlow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.slow
+}
+
+// stop ends the checks once the handler is done
+func (b *guardedBody) stop() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stopLocked()
+	return b.slow
+}
+
+func (b *guardedBody) stopLocked() {
+	b.done = true
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+}
+
+// guardReadRate is the read-rate stage. It marks the headers of guarded
+// connections as read and guards the request body, whose readers fail with
+// errSlowBody, answered with 408, when it arrives too slowly.
+func guardReadRate(g *readRateGuard) Middleware {
+	if g == nil {
+		return nil
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if info, ok := r.Context().Value(connInfoKey{}).(*connInfo); ok && info.guarded != nil {
+				info.guarded.serving()
+				defer info.guarded.served()
+			}
+			if r.Body == nil || r.Body == http.NoBody {
+				next.ServeHTTP(w, r)
+				return
+			}
+			body := &guardedBody{ReadCloser: r.Body, guard: g, rc: http.NewResponseController(w), remote: r.RemoteAddr}
+			r.Body = body
+			next.ServeHTTP(w, r)
+			if body.stop() {
+				// The request timeout clears deadlines on its way out, while
+				// the rest of the body must not be read either
+				body.rc.SetReadDeadline(time.Now())
+			}
+		})
+	}
+}
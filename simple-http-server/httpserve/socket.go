@@ -0,0 +1,115 @@
+package httpserve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// socketOptions picks the network of the listeners (tcp for dual-stack,
+// tcp4 or tcp6) and tunes the TCP sockets of client connections
+type socketOptions struct {
+	network           string
+	noDelay           bool
+	sendBuffer        int
+	receiveBuffer     int
+	keepAlive         bool
+	keepAliveIdle     time.Duration
+	keepAliveInterval time.Duration
+	keepAliveCount    int
+	log               *serverLog // where the errors tuning connections go
+}
+
+// listen opens a TCP listener on addr of opts.network whose socket is set up by
+// controlSocket, with SO_REUSEPORT when reusePort is set
+func listen(addr string, opts socketOptions, reusePort bool) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: controlSocket(opts, reusePort),
+		// Keep-alives are configured per connection by tunedListener
+		KeepAlive: -1,
+	}
+	ln, err := lc.Listen(context.Background(), opts.network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return tunedListener{ln, opts}, nil
+}
+
+// listenUnix opens a Unix domain socket at path with the given
+// permissions, replacing a socket left behind by a server that is no
+// longer running. The socket file is removed when the listener closes.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use by another server", path)
+		} else if !errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, err
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// tunedListener applies the per-connection socket options to every
+// accepted connection
+type tunedListener struct {
+	net.Listener
+	opts socketOptions
+}
+
+// Accept waits for a connection and tunes its socket
+func (l tunedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return c, err
+	}
+	tcp, ok := c.(*net.TCPConn)
+	if !ok {
+		return c, nil
+	}
+	errs := []error{
+		tcp.SetNoDelay(l.opts.noDelay),
+		tcp.SetKeepAliveConfig(net.KeepAliveConfig{
+			Enable:   l.opts.keepAlive,
+			Idle:     l.opts.keepAliveIdle,
+			Interval: l.opts.keepAliveInterval,
+			Count:    l.opts.keepAliveCount,
+		}),
+	}
+	// Buffers set on the listening socket are inherited where supported,
+	// which also lets the receive window scale during the handshake
+	if !listenerBuffers {
+		if l.opts.sendBuffer > 0 {
+			errs = append(errs, tcp.SetWriteBuffer(l.opts.sendBuffer))
+		}
+		if l.opts.receiveBuffer > 0 {
+			errs = append(errs, tcp.SetReadBuffer(l.opts.receiveBuffer))
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			l.opts.log.logf("Error tuning connection from %s: %v", c.RemoteAddr(), err)
+			break
+		}
+	}
+	return c, nil
+}
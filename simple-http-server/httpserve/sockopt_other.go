@@ -0,0 +1,21 @@
+//go:build !(linux || darwin || freebsd)
+
+package httpserve
+
+import (
+	"errors"
+	"syscall"
+)
+
+// listenerBuffers reports that buffer sizes are set on each connection
+const listenerBuffers = false
+
+// controlSocket refuses SO_REUSEPORT, which is unavailable here
+func controlSocket(opts socketOptions, reusePort bool) func(network, address string, c syscall.RawConn) error {
+	if !reusePort {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.New("SO_REUSEPORT is not supported on this platform")
+	}
+}
@@ -0,0 +1,40 @@
+//go:build linux || darwin || freebsd
+
+package httpserve
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenerBuffers reports that buffer sizes are set on the listening socket
+const listenerBuffers = true
+
+// controlSocket sets SO_REUSEPORT and the buffer sizes on a listening
+// socket before it is bound
+func controlSocket(opts socketOptions, reusePort bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		set := func(fd uintptr, opt, value int) {
+			if sockErr == nil {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, opt, value)
+			}
+		}
+		err := c.Control(func(fd uintptr) {
+			if reusePort {
+				set(fd, unix.SO_REUSEPORT, 1)
+			}
+			if opts.sendBuffer > 0 {
+				set(fd, unix.SO_SNDBUF, opts.sendBuffer)
+			}
+			if opts.receiveBuffer > 0 {
+				set(fd, unix.SO_RCVBUF, opts.receiveBuffer)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
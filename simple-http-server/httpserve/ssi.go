@@ -0,0 +1,283 @@
+package httpserve
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ssiExtensions are the pages whose directives are processed with --ssi
+var ssiExtensions = map[string]bool{".html": true, ".htm": true, ".shtml": true}
+
+// ssiMaxDepth bounds nested includes, in case a cycle goes unnoticed
+// through differently written paths
+const ssiMaxDepth = 16
+
+// ssiMaxCached bounds the parsed files kept
+const ssiMaxCached = 1024
+
+// ssiErrorMessage replaces a directive that failed, as Apache's does
+const ssiErrorMessage = "[an error occurred while processing this directive]"
+
+// ssiPart is literal text or a directive of a page
+type ssiPart struct {
+	text      string
+	directive string // empty for text
+	params    map[string]string
+}
+
+// ssiDoc is a parsed page, valid while the file keeps its size and time
+type ssiDoc struct {
+	size    int64
+	modTime time.Time
+	parts   []ssiPart
+}
+
+// ssiProcessor expands the server-side includes of the pages of a site,
+// keeping each file parsed until it changes
+type ssiProcessor struct {
+	root http.FileSystem
+	log  *serverLog
+
+	mu     sync.Mutex
+	parsed map[string]*ssiDoc
+}
+
+func newSSIProcessor(root http.FileSystem, log *serverLog) *ssiProcessor {
+	return &ssiProcessor{root: root, log: log, parsed: make(map[string]*ssiDoc)}
+}
+
+// load returns the parsed file, parsing it again when it changed
+func (s *ssiProcessor) load(name string) (*ssiDoc, error) {
+	f, err := s.root.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a file", name)
+	}
+	s.mu.Lock()
+	doc, ok := s.parsed[name]
+	s.mu.Unlock()
+	if ok && doc.size == info.Size() && doc.modTime.Equal(info.ModTime()) {
+		return doc, nil
+	}
+	src, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	doc = &ssiDoc{size: info.Size(), modTime: info.ModTime(), parts: parseSSI(string(src))}
+	s.mu.Lock()
+	if len(s.parsed) >= ssiMaxCached {
+		clear(s.parsed)
+	}
+	s.parsed[name] = doc
+	s.mu.Unlock()
+	return doc, nil
+}
+
+// parseSSI splits a page into text and <!--#directive param="value" -->
+// directives
+func parseSSI(src string) []ssiPart {
+	var parts []ssiPart
+	for {
+		start := strings.Index(src, "<!--#")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(src[start:], "-->")
+		if end < 0 {
+			break
+		}
+		if start > 0 {
+			parts = append(parts, ssiPart{text: src[:start]})
+		}
+		parts = append(parts, parseSSIDirective(src[start+len("<!--#"):start+end]))
+		src = src[start+end+len("-->"):]
+	}
+	if src != "" {
+		parts = append(parts, ssiPart{text: src})
+	}
+	return parts
+}
+
+// parseSSIDirective parses the inside of a directive, its name then its
+// parameters
+func parseSSIDirective(s string) ssiPart {
+	s = strings.TrimSpace(s)
+	name, rest, _ := strings.Cut(s, " ")
+	part := ssiPart{directive: strings.ToLower(name), params: make(map[string]string)}
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimSpace(rest) {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			part.params["?"] = rest
+			break
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimLeft(value, " ")
+		if value == "" {
+			part.params[key] = ""
+			break
+		}
+		quote := value[0]
+		if quote != '"' && quote != '\'' {
+			v, after, _ := strings.Cut(value, " ")
+			part.params[key], rest = v, after
+			continue
+		}
+		end := strings.IndexByte(value[1:], quote)
+		if end < 0 {
+			part.params["?"] = rest
+			break
+		}
+		part.params[key], rest = value[1:end+1], value[end+2:]
+	}
+	return part
+}
+
+// render writes the page name with its directives expanded. chain holds the
+// pages including it, to catch cycles.
+func (s *ssiProcessor) render(out *bytes.Buffer, r *http.Request, name string, chain []string) error {
+	doc, err := s.load(name)
+	if err != nil {
+		return err
+	}
+	chain = append(chain, name)
+	for _, part := range doc.parts {
+		if part.directive == "" {
+			out.WriteString(part.text)
+			continue
+		}
+		if err := s.directive(out, r, name, doc, part, chain); err != nil {
+			s.log.logf("Error in server-side include of %s: %v", name, err)
+			out.WriteString(ssiErrorMessage)
+		}
+	}
+	return nil
+}
+
+// directive expands a directive of the page name
+func (s *ssiProcessor) directive(out *bytes.Buffer, r *http.Request, name string, doc *ssiDoc, part ssiPart, chain []string) error {
+	switch part.directive {
+	case "include":
+		var target string
+		if file, ok := part.params["file"]; ok {
+			// As with Apache, file is relative to the page and can't go up
+			if file == "" || path.IsAbs(file) || slices.Contains(strings.Split(file, "/"), "..") {
+				return fmt.Errorf("invalid include file %q", file)
+			}
+			target = path.Join(path.Dir(name), file)
+		} else if virtual, ok := part.params["virtual"]; ok {
+			virtual, _, _ = strings.Cut(virtual, "?")
+			if !path.IsAbs(virtual) {
+				virtual = path.Join(path.Dir(name), virtual)
+			}
+			target = path.Clean(virtual)
+		} else {
+			return errors.New("include needs a file or virtual parameter")
+		}
+		if isTrashPath(target) {
+			return fmt.Errorf("invalid include %q", target)
+		}
+		if slices.Contains(chain, target) {
+			return fmt.Errorf("include cycle %s -> %s", strings.Join(chain, " -> "), target)
+		}
+		if len(chain) >= ssiMaxDepth {
+			return fmt.Errorf("includes nested deeper than %d", ssiMaxDepth)
+		}
+		return s.render(out, r, target, chain)
+	case "echo":
+		value, err := ssiVariable(part.params["var"], r, doc)
+		if err != nil {
+			return err
+		}
+		if part.params["encoding"] == "none" {
+			out.WriteString(value)
+		} else {
+			out.WriteString(html.EscapeString(value))
+		}
+		return nil
+	case "config":
+		// Only the formats of the (none) stock messages exist, so there is
+		// nothing to configure
+		return nil
+	}
+	return fmt.Errorf("unsupported directive %q", part.directive)
+}
+
+// ssiVariable returns the value of a variable of the echo directive
+func ssiVariable(name string, r *http.Request, doc *ssiDoc) (string, error) {
+	now := time.Now()
+	switch name {
+	case "DOCUMENT_NAME":
+		return path.Base(r.URL.Path), nil
+	case "DOCUMENT_URI":
+		return r.URL.Path, nil
+	case "QUERY_STRING":
+		return r.URL.RawQuery, nil
+	case "DATE_LOCAL":
+		return now.Format(time.RFC1123), nil
+	case "DATE_GMT":
+		return now.UTC().Format(time.RFC1123), nil
+	case "LAST_MODIFIED":
+		return doc.modTime.Format(time.RFC1123), nil
+	}
+	return "", fmt.Errorf("unknown variable %q", name)
+}
+
+// serveSSI answers an HTML page with its server-side includes expanded,
+// reporting whether the request was for one
+func (h *fileHandler) serveSSI(w http.ResponseWriter, r *http.Request) bool {
+	name := r.URL.Path
+	if strings.HasSuffix(name, "/index.html") {
+		// Leave the redirect to the directory to the file server
+		return false
+	}
+	if strings.HasSuffix(name, "/") {
+		name = path.Join(name, "index.html")
+	}
+	if !ssiExtensions[strings.ToLower(path.Ext(name))] {
+		return false
+	}
+	if f, err := h.root.Open(name); err != nil {
+		return false
+	} else {
+		info, err := f.Stat()
+		f.Close()
+		if err != nil || !info.Mode().IsRegular() {
+			return false
+		}
+	}
+	var out bytes.Buffer
+	if err := h.ssi.render(&out, r, name, nil); err != nil {
+		h.log.logf("Error in server-side includes of %s: %v", name, err)
+		renderError(w, r, http.StatusInternalServerError, h.ui)
+		return true
+	}
+	header := w.Header()
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	header.Set("Content-Length", strconv.Itoa(out.Len()))
+	// The includes can change without the page changing
+	header.Set("Cache-Control", "no-cache")
+	if lrw := loggedResponse(r); lrw != nil {
+		lrw.note = "server-side includes"
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(out.Bytes())
+	}
+	return true
+}
@@ -0,0 +1,352 @@
+package httpserve
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backendOpeners create the file system of a remote storage backend from
+// its URL, logging to log, keyed by URL scheme
+var backendOpeners = map[string]func(u *url.URL, log *serverLog) (fs.FS, error){
+	"s3":     openS3FS,
+	"gs":     openGCSFS,
+	"azblob": openAzureFS,
+	"sftp":   openSFTPFS,
+}
+
+// openBackend returns the file system for a --backend URL
+func openBackend(location string, log *serverLog) (fs.FS, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend URL %q: %v", location, err)
+	}
+	open, ok := backendOpeners[u.Scheme]
+	if !ok {
+		schemes := make([]string, 0, len(backendOpeners))
+		for scheme := range backendOpeners {
+			schemes = append(schemes, scheme+"://")
+		}
+		sort.Strings(schemes)
+		return nil, fmt.Errorf("unsupported backend %q (available: %s)", location, strings.Join(schemes, ", "))
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("backend URL %q has no bucket", location)
+	}
+	return open(u, log)
+}
+
+// objectInfo describes an object, or a common key prefix standing in for a
+// directory, of an object store. It is both an fs.FileInfo and fs.DirEntry.
+type objectInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (o objectInfo) Name() string               { return o.name }
+func (o objectInfo) Size() int64                { return o.size }
+func (o objectInfo) ModTime() time.Time         { return o.modTime }
+func (o objectInfo) IsDir() bool                { return o.dir }
+func (o objectInfo) Sys() any                   { return nil }
+func (o objectInfo) Type() fs.FileMode          { return o.Mode().Type() }
+func (o objectInfo) Info() (fs.FileInfo, error) { return o, nil }
+
+// Mode reports objects as read-only files and prefixes as directories
+func (o objectInfo) Mode() fs.FileMode {
+	if o.dir {
+		return fs.ModeDir | 0o555
+	}
+	return 0o444
+}
+
+// objectPage is one page of a delimited listing. Objects are named by
+// their full key and prefixes end in a slash.
+type objectPage struct {
+	objects  []objectInfo
+	prefixes []string
+	next     string
+}
+
+// objectStore is the small set of operations a bucket must support to be
+// served. Missing objects are reported as fs.ErrNotExist.
+type objectStore interface {
+	// head returns the size and modification time of the object at key
+	head(key string) (objectInfo, error)
+	// list returns up to limit keys below prefix, continuing at token, with
+	// deeper keys collapsed into prefixes
+	list(prefix, token string, limit int) (objectPage, error)
+	// get streams the object at key from offset on
+	get(key string, offset int64) (io.ReadCloser, error)
+}
+
+// objectFS presents the keys below a prefix of an object store as a
+// read-only file system, with slashes in keys separating directories
+type objectFS struct {
+	store  objectStore
+	prefix string
+}
+
+// key returns the object key of a file system path
+func (o *objectFS) key(name string) string {
+	if name == "." {
+		return o.prefix
+	}
+	if o.prefix == "" {
+		return name
+	}
+	return o.prefix + "/" + name
+}
+
+// Open returns the object at name, or a directory when objects exist below
+// it
+func (o *objectFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	key := o.key(name)
+	if name != "." {
+		info, err := o.store.head(key)
+		if err == nil {
+			info.name = path.Base(name)
+			return &objectFile{store: o.store, key: key, info: info}, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+	dirPrefix := key + "/"
+	if key == "" {
+		dirPrefix = ""
+	}
+	if name != "." {
+		page, err := o.store.list(dirPrefix, "", 1)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		if len(page.objects) == 0 && len(page.prefixes) == 0 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+	}
+	return &objectDir{store: o.store, prefix: dirPrefix, info: objectInfo{name: path.Base(name), dir: true}}, nil
+}
+
+// objectFile reads an object with ranged requests, reopening the stream
+// only when a seek moves the position
+type objectFile struct {
+	store  objectStore
+	key    string
+	info   objectInfo
+	offset int64
+	body   io.ReadCloser
+}
+
+func (f *objectFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+// Read streams the object from the current offset
+func (f *objectFile) Read(p []byte) (int, error) {
+	if f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		body, err := f.store.get(f.key, f.offset)
+		if err != nil {
+			return 0, err
+		}
+		f.body = body
+	}
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+// Seek moves the read position, dropping the open stream if it changes
+func (f *objectFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.key, Err: fs.ErrInvalid}
+	}
+	if offset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Close releases the open stream, if any
+func (f *objectFile) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+// objectDir lists the keys directly below a prefix, fetching them a page
+// at a time as they are read
+type objectDir struct {
+	store   objectStore
+	prefix  string
+	info    objectInfo
+	pending []fs.DirEntry
+	token   string
+	done    bool
+}
+
+func (d *objectDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *objectDir) Close() error               { return nil }
+
+// Read fails, as directories have no contents of their own
+func (d *objectDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.prefix, Err: errors.New("is a directory")}
+}
+
+// ReadDir returns the next n entries, or all remaining ones when n <= 0
+func (d *objectDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	for !d.done && (n <= 0 || len(d.pending) < n) {
+		if err := d.fetch(); err != nil {
+			return nil, err
+		}
+	}
+	if n > 0 && len(d.pending) == 0 {
+		return nil, io.EOF
+	}
+	if n <= 0 || n > len(d.pending) {
+		n = len(d.pending)
+	}
+	entries := d.pending[:n:n]
+	d.pending = d.pending[n:]
+	return entries, nil
+}
+
+// fetch appends the next page of the listing to the pending entries
+func (d *objectDir) fetch() error {
+	page, err := d.store.list(d.prefix, d.token, 0)
+	if err != nil {
+		return err
+	}
+	for _, p := range page.prefixes {
+		name := strings.TrimSuffix(strings.TrimPrefix(p, d.prefix), "/")
+		if name != "" {
+			d.pending = append(d.pending, objectInfo{name: name, dir: true})
+		}
+	}
+	for _, obj := range page.objects {
+		// Skip the empty placeholder objects consoles create for folders
+		obj.name = strings.TrimPrefix(obj.name, d.prefix)
+		if obj.name != "" {
+			d.pending = append(d.pending, obj)
+		}
+	}
+	d.token = page.next
+	d.done = page.next == ""
+	return nil
+}
+
+// bearerToken caches an OAuth access token until shortly before it
+// expires, fetching a new one on demand
+type bearerToken struct {
+	fetch func() (string, time.Duration, error)
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// get returns a valid access token
+func (b *bearerToken) get() (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.token != "" && time.Now().Before(b.expiry) {
+		return b.token, nil
+	}
+	token, lifetime, err := b.fetch()
+	if err != nil {
+		return "", fmt.Errorf("fetching access token: %v", err)
+	}
+	b.token = token
+	b.expiry = time.Now().Add(lifetime - time.Minute)
+	return token, nil
+}
+
+// requestToken sends a request to an OAuth token or instance metadata
+// endpoint and decodes the access token from its JSON response
+func requestToken(client *http.Client, req *http.Request) (string, time.Duration, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", 0, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var token struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   json.Number `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", 0, err
+	}
+	if token.AccessToken == "" {
+		return "", 0, errors.New("response has no access token")
+	}
+	seconds, err := token.ExpiresIn.Int64()
+	if err != nil {
+		seconds = 300
+	}
+	return token.AccessToken, time.Duration(seconds) * time.Second, nil
+}
+
+// storageClient returns the HTTP client used for a backend's requests.
+// Bodies stream for as long as a download takes, so only waiting for the
+// response headers is bounded.
+func storageClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = 30 * time.Second
+	return &http.Client{Transport: transport}
+}
+
+// probeMetadata reports whether an instance metadata service answers at
+// url, which tells whether the server runs on that cloud
+func probeMetadata(url string, header http.Header) bool {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return false
+	}
+	req.Header = header
+	client := &http.Client{Timeout: time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode < 500
+}
+
+// storageStatusError maps an error response of a storage API to an error,
+// using the fs errors for missing objects and denied access
+func storageStatusError(resp *http.Response, op string, detail string) error {
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return fs.ErrNotExist
+	case http.StatusForbidden, http.StatusUnauthorized:
+		return fs.ErrPermission
+	}
+	return fmt.Errorf("%s: %s %s", op, resp.Status, detail)
+}
@@ -0,0 +1,173 @@
+package httpserve
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateIndexes are the directory index pages rendered with --templates,
+// looked for after index.html
+var templateIndexes = []string{"index.gohtml", "index.html.tmpl"}
+
+// templateOptions controls rendering .tmpl and .gohtml files
+type templateOptions struct {
+	enabled   bool
+	dataFile  string // YAML or JSON file given to the templates as .Data
+	envPrefix string // environment variables given as .Env, none when empty
+}
+
+// templateData is the data of a rendered template
+type templateData struct {
+	Query   url.Values
+	Env     map[string]string
+	Data    any
+	Request templateRequest
+	Now     time.Time
+}
+
+// templateRequest describes the request rendering a template
+type templateRequest struct {
+	Method string
+	Path   string
+	Host   string
+	Remote string
+	User   string
+	Header http.Header
+}
+
+// isTemplate reports whether a file is rendered with --templates
+func isTemplate(name string) bool {
+	return strings.HasSuffix(name, ".tmpl") || strings.HasSuffix(name, ".gohtml")
+}
+
+// templateType returns the content type of what a template renders: that
+// of the name without .tmpl, HTML for .gohtml
+func templateType(name string) string {
+	if strings.HasSuffix(name, ".gohtml") {
+		return "text/html; charset=utf-8"
+	}
+	if t := mime.TypeByExtension(path.Ext(strings.TrimSuffix(name, ".tmpl"))); t != "" {
+		return t
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// serveTemplate renders the template a request names, or the template index
+// of a directory, reporting whether it did
+func (h *fileHandler) serveTemplate(w http.ResponseWriter, r *http.Request) bool {
+	name := r.URL.Path
+	if strings.HasSuffix(name, "/") {
+		if f, err := h.root.Open(path.Join(name, "index.html")); err == nil {
+			f.Close()
+			return false
+		}
+		name = ""
+		for _, index := range templateIndexes {
+			if f, err := h.root.Open(path.Join(r.URL.Path, index)); err == nil {
+				f.Close()
+				name = path.Join(r.URL.Path, index)
+				break
+			}
+		}
+	}
+	if !isTemplate(name) {
+		return false
+	}
+	f, err := h.root.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	src, err := io.ReadAll(f)
+	if err != nil {
+		h.log.logf("Error reading template %s: %v", name, err)
+		renderError(w, r, http.StatusInternalServerError, h.ui)
+		return true
+	}
+	data, err := h.templateData(r)
+	if err != nil {
+		h.log.logf("Error reading template data %s: %v", h.templates.dataFile, err)
+		renderError(w, r, http.StatusInternalServerError, h.ui)
+		return true
+	}
+	contentType := templateType(name)
+	var out bytes.Buffer
+	// HTML is escaped by context, anything else rendered as is
+	if strings.HasPrefix(contentType, "text/html") {
+		var t *htmltemplate.Template
+		if t, err = htmltemplate.New(path.Base(name)).Parse(string(src)); err == nil {
+			err = t.Execute(&out, data)
+		}
+	} else {
+		var t *template.Template
+		if t, err = template.New(path.Base(name)).Parse(string(src)); err == nil {
+			err = t.Execute(&out, data)
+		}
+	}
+	if err != nil {
+		h.log.logf("Error rendering template %s: %v", name, err)
+		renderError(w, r, http.StatusInternalServerError, h.ui)
+		return true
+	}
+	header := w.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Length", strconv.Itoa(out.Len()))
+	// The page depends on the query and the data, not just on the file
+	header.Set("Cache-Control", "no-cache")
+	if lrw := loggedResponse(r); lrw != nil {
+		lrw.note = "rendered " + strings.TrimPrefix(name, "/")
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(out.Bytes())
+	}
+	return true
+}
+
+// templateData gathers the data of a template rendered for r, reading the
+// data file again so changes to it show on the next request
+func (h *fileHandler) templateData(r *http.Request) (templateData, error) {
+	data := templateData{
+		Query: r.URL.Query(),
+		Env:   make(map[string]string),
+		Request: templateRequest{
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Host:   r.Host,
+			Remote: r.RemoteAddr,
+			User:   RequestUser(r),
+			Header: r.Header,
+		},
+		Now: time.Now(),
+	}
+	if prefix := h.templates.envPrefix; prefix != "" {
+		for _, kv := range os.Environ() {
+			if name, value, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(name, prefix) {
+				data.Env[name] = value
+			}
+		}
+	}
+	if h.templates.dataFile != "" {
+		src, err := os.ReadFile(h.templates.dataFile)
+		if err != nil {
+			return data, err
+		}
+		if data.Data, err = parseYAML(src); err != nil {
+			return data, err
+		}
+	}
+	return data, nil
+}
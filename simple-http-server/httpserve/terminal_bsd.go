@@ -0,0 +1,11 @@
+//go:build darwin || freebsd
+
+package httpserve
+
+import "syscall"
+
+// Requests reading and setting the terminal mode
+const (
+	ioctlGetTermios = syscall.TIOCGETA
+	ioctlSetTermios = syscall.TIOCSETA
+)
@@ -0,0 +1,9 @@
+package httpserve
+
+import "syscall"
+
+// Requests reading and setting the terminal mode
+const (
+	ioctlGetTermios = syscall.TCGETS
+	ioctlSetTermios = syscall.TCSETS
+)
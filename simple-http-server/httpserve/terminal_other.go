@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || freebsd)
+
+package httpserve
+
+import "errors"
+
+// The terminal dashboard needs termios, unavailable on this platform
+
+func cbreakTerminal(fd int) (func(), error) {
+	return nil, errors.New("terminal control is not supported on this platform")
+}
+
+func terminalSize(fd int) (int, int, bool) { return 0, 0, false }
@@ -0,0 +1,43 @@
+//go:build linux || darwin || freebsd
+
+package httpserve
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// cbreakTerminal switches the terminal on fd to reading single keys without
+// echoing them, returning the function restoring its previous mode.
+// Ctrl-C still raises SIGINT.
+func cbreakTerminal(fd int) (func(), error) {
+	var old syscall.Termios
+	if err := termiosIoctl(fd, ioctlGetTermios, &old); err != nil {
+		return nil, err
+	}
+	mode := old
+	mode.Lflag &^= syscall.ICANON | syscall.ECHO
+	mode.Cc[syscall.VMIN], mode.Cc[syscall.VTIME] = 1, 0
+	if err := termiosIoctl(fd, ioctlSetTermios, &mode); err != nil {
+		return nil, err
+	}
+	return func() { termiosIoctl(fd, ioctlSetTermios, &old) }, nil
+}
+
+// terminalSize returns the columns and rows of the terminal on fd
+func terminalSize(fd int) (int, int, bool) {
+	var ws struct{ rows, cols, x, y uint16 }
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws)))
+	if errno != 0 || ws.cols == 0 || ws.rows == 0 {
+		return 0, 0, false
+	}
+	return int(ws.cols), int(ws.rows), true
+}
+
+func termiosIoctl(fd int, request uintptr, t *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), request, uintptr(unsafe.Pointer(t)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package httpserve
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// timeoutWriter gives the handler its own header map, so the 503 of an
+// expired request can be written while the handler still runs, and stops
+// the response once the request context is done
+type timeoutWriter struct {
+	http.ResponseWriter
+	r      *http.Request
+	ctx    context.Context
+	cancel context.CancelFunc
+	header http.Header
+	ui     uiOptions
+
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+	finished    bool
+	detached    bool // streaming or hijacked, out of the timeout's reach
+}
+
+// requestTimeout is the timeout stage. It cancels the request context after
+// d, which stops file copies and the stages waiting on it, answers 503 if
+// nothing was written yet, and sets the connection deadlines so a client
+// that stops reading or sending can't hold the handler past it. Streams
+// that clear their write deadline, such as live reload, and hijacked
+// connections are left alone.
+func requestTimeout(d time.Duration, ui uiOptions) Middleware {
+	if d <= 0 {
+		return nil
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithCancel(r.Context())
+			defer cancel()
+			tw := &timeoutWriter{ResponseWriter: w, ctx: ctx, cancel: cancel, header: w.Header().Clone(), ui: ui}
+			tw.r = r.WithContext(ctx)
+			rc := http.NewResponseController(w)
+			deadline := time.Now().Add(d)
+			rc.SetReadDeadline(deadline)
+			rc.SetWriteDeadline(deadline)
+			timer := time.AfterFunc(d, tw.expire)
+
+			next.ServeHTTP(tw, tw.r)
+
+			timer.Stop()
+			tw.mu.Lock()
+			tw.finished = true
+			timedOut, detached := tw.timedOut, tw.detached
+			tw.mu.Unlock()
+			if !detached {
+				// Deadlines outlive the request on a keep-alive connection
+				rc.SetReadDeadline(time.Time{})
+				rc.SetWriteDeadline(time.Time{})
+			}
+			if lrw := loggedResponse(r); lrw != nil && timedOut && lrw.note == "" {
+				lrw.note = fmt.Sprintf("timed out after %s", d)
+			}
+		})
+	}
+}
+
+// expire cancels the request, answering it with 503 when the handler has
+// not written a response yet
+func (tw *timeoutWriter) expire() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.finished || tw.detached {
+		return
+	}
+	tw.timedOut = true
+	tw.cancel()
+	if !tw.wroteHeader {
+		tw.wroteHeader = true
+		renderError(tw.ResponseWriter, tw.r, http.StatusServiceUnavailable, tw.ui)
+	}
+}
+
+// Header returns the handler's header map, copied out when the headers are
+// written
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+// WriteHeader writes the handler's headers unless the request timed out
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.writeHeaderLocked(code)
+}
+
+func (tw *timeoutWriter) writeHeaderLocked(code int) {
+	if tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader = true
+	h := tw.ResponseWriter.Header()
+	clear(h)
+	for name, values := range tw.header {
+		h[name] = values
+	}
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+// begin writes the headers ahead of the body, failing once the request
+// timed out or was canceled
+func (tw *timeoutWriter) begin() error {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return http.ErrHandlerTimeout
+	}
+	if err := tw.ctx.Err(); err != nil {
+		return err
+	}
+	tw.writeHeaderLocked(http.StatusOK)
+	return nil
+}
+
+// Write writes the body while the request is live
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	if err := tw.begin(); err != nil {
+		return 0, err
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+// ReadFrom sends src in chunks, keeping the sendfile path and stopping the
+// copy once the request context is done
+func (tw *timeoutWriter) ReadFrom(src io.Reader) (int64, error) {
+	return copyChunks(tw.ResponseWriter, src, func(int64) error { return tw.begin() })
+}
+
+// Flush sends buffered data to the client
+func (tw *timeoutWriter) Flush() {
+	if tw.begin() == nil {
+		http.NewResponseController(tw.ResponseWriter).Flush()
+	}
+}
+
+// SetWriteDeadline passes deadlines on, a cleared one marking a stream that
+// the request timeout no longer applies to
+func (tw *timeoutWriter) SetWriteDeadline(deadline time.Time) error {
+	if deadline.IsZero() {
+		tw.detach()
+		http.NewResponseController(tw.ResponseWriter).SetReadDeadline(time.Time{})
+	}
+	return http.NewResponseController(tw.ResponseWriter).SetWriteDeadline(deadline)
+}
+
+// Hijack hands the connection over, out of the timeout's reach
+func (tw *timeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	tw.detach()
+	return http.NewResponseController(tw.ResponseWriter).Hijack()
+}
+
+// detach takes the request out of the timeout's reach, unless it already
+// expired
+func (tw *timeoutWriter) detach() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if !tw.timedOut {
+		tw.detached = true
+	}
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
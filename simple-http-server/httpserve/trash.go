@@ -0,0 +1,187 @@
+package httpserve
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// trashDir is the hidden directory at the top of a served tree holding
+// deleted files until they are restored or purged
+const trashDir = ".trash"
+
+// trashItem describes a deleted file kept in the recycle bin
+type trashItem struct {
+	ID      string    `json:"id"`
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	Deleted time.Time `json:"deleted"`
+	User    string    `json:"user,omitempty"`
+}
+
+// trashBin moves deleted files into trashDir and purges them once the
+// retention period has passed
+type trashBin struct {
+	dir       string
+	retention time.Duration
+	log       *serverLog
+}
+
+// newTrashBin creates the recycle bin of the served directory root and
+// starts purging expired items
+func newTrashBin(root string, retention time.Duration, log *serverLog) (*trashBin, error) {
+	t := &trashBin{dir: filepath.Join(root, trashDir), retention: retention, log: log}
+	if err := os.MkdirAll(t.dir, 0o700); err != nil {
+		return nil, err
+	}
+	go func() {
+		t.purgeExpired()
+		ticker := time.NewTicker(max(retention/24, time.Minute))
+		defer ticker.Stop()
+		for range ticker.C {
+			t.purgeExpired()
+		}
+	}()
+	return t, nil
+}
+
+func (t *trashBin) dataPath(id string) string { return filepath.Join(t.dir, id) }
+func (t *trashBin) infoPath(id string) string { return filepath.Join(t.dir, id+".json") }
+
+// isTrashPath reports whether a request path points into the recycle bin
+func isTrashPath(urlPath string) bool {
+	first, _, _ := strings.Cut(strings.TrimPrefix(urlPath, "/"), "/")
+	return strings.EqualFold(first, trashDir)
+}
+
+// put moves the file at target, served at urlPath, into the bin
+func (t *trashBin) put(target, urlPath string, size int64, r *http.Request) (trashItem, error) {
+	b := make([]byte, 8)
+	rand.Read(b)
+	item := trashItem{
+		ID:      time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b),
+		Path:    urlPath,
+		Size:    size,
+		Deleted: time.Now().UTC(),
+	}
+	if user := RequestUser(r); user != "-" {
+		item.User = user
+	}
+	data, _ := json.Marshal(item)
+	if err := os.WriteFile(t.infoPath(item.ID), data, 0o600); err != nil {
+		return item, err
+	}
+	if err := os.Rename(target, t.dataPath(item.ID)); err != nil {
+		os.Remove(t.infoPath(item.ID))
+		return item, err
+	}
+	return item, nil
+}
+
+// load reads the description of a trashed file
+func (t *trashBin) load(id string) (trashItem, error) {
+	var item trashItem
+	if strings.ContainsAny(id, `/\.`) || id == "" {
+		return item, fs.ErrNotExist
+	}
+	data, err := os.ReadFile(t.infoPath(id))
+	if err != nil {
+		return item, err
+	}
+	err = json.Unmarshal(data, &item)
+	return item, err
+}
+
+// items lists the bin, most recently deleted first
+func (t *trashBin) items() ([]trashItem, error) {
+	entries, err := os.ReadDir(t.dir)
+	if err != nil {
+		return nil, err
+	}
+	items := []trashItem{}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		if item, err := t.load(id); err == nil {
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Deleted.After(items[j].Deleted) })
+	return items, nil
+}
+
+// restore moves a trashed file back to target, which must not exist
+func (t *trashBin) restore(item trashItem, target string) error {
+	if info, err := os.Stat(filepath.Dir(target)); err != nil || !info.IsDir() {
+		return errUploadNoParent
+	}
+	// Link rather than rename so an existing file is never replaced
+	if err := os.Link(t.dataPath(item.ID), target); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return errUploadExists
+		}
+		return err
+	}
+	os.Remove(t.dataPath(item.ID))
+	os.Remove(t.infoPath(item.ID))
+	return nil
+}
+
+// purgeExpired permanently removes items older than the retention period
+func (t *trashBin) purgeExpired() {
+	items, err := t.items()
+	if err != nil {
+		t.log.logf("Error listing trash: %v", err)
+		return
+	}
+	for _, item := range items {
+		if time.Since(item.Deleted) > t.retention {
+			os.Remove(t.dataPath(item.ID))
+			os.Remove(t.infoPath(item.ID))
+			t.log.logf("Purged %s (%d bytes) from trash", item.Path, item.Size)
+		}
+	}
+}
+
+// serveAPITrash lists the recycle bin (GET trash) and restores an item to
+// its original path (POST trash/<id>/restore)
+func (h *fileHandler) serveAPITrash(w http.ResponseWriter, r *http.Request, rest string) {
+	if rest == "" && r.Method == http.MethodGet {
+		items, err := h.trash.items()
+		if err != nil {
+			h.log.logf("Error listing trash: %v", err)
+			renderError(w, r, http.StatusInternalServerError, h.ui)
+			return
+		}
+		writeJSON(w, http.StatusOK, items)
+		return
+	}
+	id, ok := strings.CutSuffix(rest, "/restore")
+	if !ok || r.Method != http.MethodPost {
+		renderError(w, r, http.StatusNotFound, h.ui)
+		return
+	}
+	item, err := h.trash.load(id)
+	if err != nil {
+		renderError(w, r, http.StatusNotFound, h.ui)
+		return
+	}
+	if err := h.trash.restore(item, h.localPath(item.Path)); err != nil {
+		h.log.logf("audit: %s failed to restore %s from %s: %v", RequestUser(r), item.Path, r.RemoteAddr, err)
+		renderError(w, apiRequest(r, item.Path), uploadStatus(err), h.ui)
+		return
+	}
+	h.log.logf("audit: %s restored %s (%d bytes) from %s", RequestUser(r), item.Path, item.Size, r.RemoteAddr)
+	w.Header().Set("Location", userdirMount(r)+item.Path)
+	w.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,386 @@
+package httpserve
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// tuiRefresh is how often the terminal dashboard is redrawn
+const tuiRefresh = 250 * time.Millisecond
+
+// tuiFeedSize is how many lines of the request feed are kept
+const tuiFeedSize = 500
+
+// tuiRateWindow is how many seconds the request rate is averaged over
+const tuiRateWindow = 10
+
+// ANSI escape sequences drawing the dashboard
+const (
+	ansiAltScreen  = "\x1b[?1049h\x1b[?25l"
+	ansiMainScreen = "\x1b[?25h\x1b[?1049l"
+	ansiHome       = "\x1b[H"
+	ansiClearLine  = "\x1b[K"
+	ansiClearBelow = "\x1b[J"
+	ansiReset      = "\x1b[0m"
+	ansiBold       = "\x1b[1m"
+	ansiInverse    = "\x1b[7m"
+	ansiDim        = "\x1b[2m"
+	ansiRed        = "\x1b[31m"
+	ansiGreen      = "\x1b[32m"
+	ansiYellow     = "\x1b[33m"
+	ansiCyan       = "\x1b[36m"
+)
+
+// transferWatcher is implemented by Loggers following the requests in
+// flight, which the logging stage then tells about each request
+type transferWatcher interface {
+	started(t *transfer)
+	finished(t *transfer)
+}
+
+// transfer is a request in flight, its progress updated by the logging
+// stage as the response goes out
+type transfer struct {
+	method string
+	path   string
+	remote string
+	start  time.Time
+	size   atomic.Int64 // Content-Length of the response, -1 until known
+	sent   atomic.Int64
+}
+
+// discardLogger is the Logger below the terminal dashboard when it replaces
+// the log output
+type discardLogger struct{}
+
+func (discardLogger) Printf(string, ...any) {}
+func (discardLogger) Access(AccessEntry)    {}
+
+// tuiLine is a line of the request feed
+type tuiLine struct {
+	time  time.Time
+	text  string
+	color string
+}
+
+// terminalUI is the --tui dashboard: the Logger drawing the requests, the
+// counters and the transfers in flight on the terminal, then passing
+// everything on to next
+type terminalUI struct {
+	next    Logger
+	out     io.Writer
+	since   time.Time
+	quit    chan struct{} // closed when q is pressed
+	restore func()        // the terminal mode, nil when keys are not read
+	done    chan struct{}
+	dir     atomic.Value
+	drawMu  sync.Mutex // held while a frame is written
+
+	mu        sync.Mutex
+	closed    bool
+	feed      []tuiLine
+	frozen    []tuiLine // the feed shown while paused
+	paused    bool
+	transfers map[*transfer]bool
+	requests  int64
+	bytes     int64
+	classes   [6]int64 // by status class, 1xx to 5xx
+	seconds   [tuiRateWindow]int64
+	counts    [tuiRateWindow]int64
+	quitOnce  sync.Once
+	closeOnce sync.Once
+}
+
+// startTerminalUI takes over the terminal, drawing the dashboard until
+// close is called
+func startTerminalUI(next Logger) (*terminalUI, error) {
+	if _, _, ok := terminalSize(int(os.Stdout.Fd())); !ok {
+		return nil, errors.New("--tui needs a terminal on stdout")
+	}
+	t := &terminalUI{
+		next:      next,
+		out:       os.Stdout,
+		since:     time.Now(),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+		transfers: make(map[*transfer]bool),
+	}
+	t.dir.Store("")
+	// Without a terminal on stdin the dashboard is only drawn
+	if restore, err := cbreakTerminal(int(os.Stdin.Fd())); err == nil {
+		t.restore = restore
+		go t.readKeys()
+	}
+	io.WriteString(t.out, ansiAltScreen)
+	go t.run()
+	return t, nil
+}
+
+// setDir sets the served directory shown in the title bar
+func (t *terminalUI) setDir(dir string) {
+	t.dir.Store(dir)
+}
+
+// close stops drawing and gives the terminal back, later messages being
+// logged as plain lines
+func (t *terminalUI) close() {
+	t.closeOnce.Do(func() {
+		t.mu.Lock()
+		t.closed = true
+		t.mu.Unlock()
+		close(t.done)
+		t.drawMu.Lock()
+		defer t.drawMu.Unlock()
+		io.WriteString(t.out, ansiMainScreen)
+		if t.restore != nil {
+			t.restore()
+		}
+	})
+}
+
+// Printf adds a message to the feed
+func (t *terminalUI) Printf(format string, args ...any) {
+	t.next.Printf(format, args...)
+	message := fmt.Sprintf(format, args...)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		if _, discarded := t.next.(discardLogger); discarded {
+			StdLogger{}.Printf("%s", message)
+		}
+		return
+	}
+	color := ansiDim
+	if strings.HasPrefix(format, "Error") {
+		color = ansiRed
+	}
+	t.addLocked(tuiLine{time: time.Now(), text: message, color: color})
+}
+
+// Access adds a request to the feed and the counters
+func (t *terminalUI) Access(e AccessEntry) {
+	t.next.Access(e)
+	text := fmt.Sprintf("%s %s %d %s %s %s", e.Method, e.Path, e.Status, FormatSize(e.Bytes), e.Duration.Round(time.Millisecond), e.Remote)
+	if e.User != "-" && e.User != "" {
+		text += " " + e.User
+	}
+	if e.Note != "" {
+		text += " (" + e.Note + ")"
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.requests++
+	t.bytes += e.Bytes
+	if class := e.Status / 100; class >= 1 && class <= 5 {
+		t.classes[class]++
+	}
+	second := e.Time.Unix()
+	if i := second % tuiRateWindow; t.seconds[i] != second {
+		t.seconds[i], t.counts[i] = second, 1
+	} else {
+		t.counts[i]++
+	}
+	t.addLocked(tuiLine{time: e.Time, text: text, color: statusColor(e.Status)})
+}
+
+func (t *terminalUI) addLocked(line tuiLine) {
+	if len(t.feed) == tuiFeedSize {
+		t.feed = append(t.feed[:0], t.feed[1:]...)
+	}
+	t.feed = append(t.feed, line)
+}
+
+func (t *terminalUI) started(tr *transfer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.transfers[tr] = true
+}
+
+func (t *terminalUI) finished(tr *transfer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.transfers, tr)
+}
+
+// readKeys handles the keys: q quits, p pauses the feed and c clears it
+func (t *terminalUI) readKeys() {
+	b := make([]byte, 1)
+	for {
+		if _, err := os.Stdin.Read(b); err != nil {
+			return
+		}
+		t.mu.Lock()
+		switch b[0] {
+		case 'q', 'Q':
+			t.quitOnce.Do(func() { close(t.quit) })
+		case 'p', 'P':
+			t.paused = !t.paused
+			t.frozen = append([]tuiLine(nil), t.feed...)
+		case 'c', 'C':
+			t.feed, t.frozen = nil, nil
+		}
+		t.mu.Unlock()
+	}
+}
+
+// run redraws the dashboard until closed
+func (t *terminalUI) run() {
+	ticker := time.NewTicker(tuiRefresh)
+	defer ticker.Stop()
+	for {
+		t.draw()
+		select {
+		case <-ticker.C:
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// draw renders a frame sized to the terminal
+func (t *terminalUI) draw() {
+	width, height, ok := terminalSize(int(os.Stdout.Fd()))
+	if !ok {
+		width, height = 80, 24
+	}
+	now := time.Now()
+	t.drawMu.Lock()
+	defer t.drawMu.Unlock()
+	var lines []string
+	add := func(color, text string) {
+		lines = append(lines, color+truncateRunes(cleanTerminalText(text), width)+ansiReset)
+	}
+
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+	title := fmt.Sprintf(" simple-http-server  %s  up %s", t.dir.Load(), now.Sub(t.since).Round(time.Second))
+	add(ansiInverse+ansiBold, title+strings.Repeat(" ", max(0, width-utf8.RuneCountInString(title))))
+	var recent int64
+	for i, second := range t.seconds {
+		if now.Unix()-second < tuiRateWindow {
+			recent += t.counts[i]
+		}
+	}
+	add(ansiBold, fmt.Sprintf(" Requests %d  %.1f/s   Sent %s   2xx %d  3xx %d  4xx %d  5xx %d",
+		t.requests, float64(recent)/tuiRateWindow, FormatSize(t.bytes), t.classes[2], t.classes[3], t.classes[4], t.classes[5]))
+	add("", "")
+	transfers := make([]*transfer, 0, len(t.transfers))
+	for tr := range t.transfers {
+		transfers = append(transfers, tr)
+	}
+	feed := t.feed
+	if t.paused {
+		feed = t.frozen
+	}
+	feed = slices.Clone(feed[max(0, len(feed)-height):])
+	paused := t.paused
+	t.mu.Unlock()
+
+	slices.SortFunc(transfers, func(a, b *transfer) int { return a.start.Compare(b.start) })
+	add(ansiBold, fmt.Sprintf(" Transfers (%d)", len(transfers)))
+	shown := min(len(transfers), max(1, height/3))
+	for _, tr := range transfers[:shown] {
+		add("", " "+transferLine(tr, now))
+	}
+	if len(transfers) > shown {
+		add(ansiDim, fmt.Sprintf(" and %d more", len(transfers)-shown))
+	}
+	add("", "")
+	keys := " Requests   [p] pause  [c] clear  [q] quit"
+	if paused {
+		keys = " Requests (paused)   [p] resume  [c] clear  [q] quit"
+	}
+	add(ansiBold, keys)
+	rows := max(0, height-len(lines))
+	for _, line := range feed[max(0, len(feed)-rows):] {
+		add(line.color, " "+line.time.Format("15:04:05")+" "+line.text)
+	}
+
+	var b strings.Builder
+	b.WriteString(ansiHome)
+	for i, line := range lines[:min(len(lines), height)] {
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(line)
+		b.WriteString(ansiClearLine)
+	}
+	b.WriteString(ansiClearBelow)
+	io.WriteString(t.out, b.String())
+}
+
+// transferLine describes a transfer with a progress bar when its size is
+// known
+func transferLine(tr *transfer, now time.Time) string {
+	sent, size := tr.sent.Load(), tr.size.Load()
+	elapsed := now.Sub(tr.start)
+	speed := FormatSize(int64(float64(sent)/max(elapsed.Seconds(), 0.001))) + "/s"
+	progress := FormatSize(sent)
+	if size > 0 {
+		const barWidth = 20
+		filled := int(min(sent, size) * barWidth / size)
+		progress = fmt.Sprintf("[%s%s] %3d%%  %s / %s", strings.Repeat("#", filled), strings.Repeat(".", barWidth-filled), min(sent, size)*100/size, FormatSize(sent), FormatSize(size))
+	}
+	return fmt.Sprintf("%s %s  %s  %s  %s  %s", tr.method, tr.path, tr.remote, progress, speed, elapsed.Round(time.Second))
+}
+
+// statusColor is the color of a status code in the feed
+func statusColor(status int) string {
+	switch {
+	case status >= 500:
+		return ansiRed
+	case status >= 400:
+		return ansiYellow
+	case status >= 300:
+		return ansiCyan
+	default:
+		return ansiGreen
+	}
+}
+
+// cleanTerminalText replaces control characters, so request paths can't
+// send escape sequences to the terminal
+func cleanTerminalText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || (r >= 0x7f && r < 0xa0) {
+			return '?'
+		}
+		return r
+	}, s)
+}
+
+// truncateRunes cuts s to at most n characters
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:max(0, n)])
+}
+
+// watchTransfer starts following the request of lrw for watcher
+func watchTransfer(watcher transferWatcher, lrw *loggingResponseWriter, r *http.Request, start time.Time) {
+	lrw.transfer = &transfer{method: r.Method, path: r.URL.Path, remote: r.RemoteAddr, start: start}
+	lrw.transfer.size.Store(-1)
+	watcher.started(lrw.transfer)
+}
+
+// noteSize records the Content-Length of a watched response
+func (tr *transfer) noteSize(h http.Header) {
+	if n, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil {
+		tr.size.Store(n)
+	}
+}
@@ -0,0 +1,197 @@
+package httpserve
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tunnelDefaultConns is how many connections are kept open to a relay that
+// does not say how many it takes
+const tunnelDefaultConns = 10
+
+// tunnelInfo is the relay's answer to a tunnel request, in the localtunnel
+// protocol
+type tunnelInfo struct {
+	ID           string `json:"id"`
+	Port         int    `json:"port"`
+	MaxConnCount int    `json:"max_conn_count"`
+	URL          string `json:"url"`
+	Message      string `json:"message"`
+}
+
+// tunnelListener accepts the connections held open to a relay, over which
+// it forwards the requests the public URL receives
+type tunnelListener struct {
+	relay string // host:port the connections are made to
+	url   string // public URL
+	log   *serverLog
+
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+
+	mu   sync.Mutex
+	open map[*tunnelConn]bool
+}
+
+// tunnelConn is a relay connection, reporting when it is closed so another
+// one takes its place
+type tunnelConn struct {
+	net.Conn
+	t      *tunnelListener
+	used   atomic.Bool // a request came over it
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *tunnelConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.used.Store(true)
+	}
+	return n, err
+}
+
+func (c *tunnelConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		close(c.closed)
+		c.t.mu.Lock()
+		delete(c.t.open, c)
+		c.t.mu.Unlock()
+	})
+	return err
+}
+
+// openTunnel asks the relay for a tunnel, with the subdomain when given,
+// and starts connecting to it
+func openTunnel(relay, subdomain string, log *serverLog) (*tunnelListener, error) {
+	u, err := url.Parse(relay)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid relay %q, expected an http or https URL", relay)
+	}
+	endpoint := *u
+	endpoint.Path, endpoint.RawQuery = "/", "new"
+	if subdomain != "" {
+		endpoint.Path, endpoint.RawQuery = "/"+subdomain, ""
+	}
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Get(endpoint.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var info tunnelInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("relay answered %s without a tunnel: %v", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || info.Port == 0 || info.URL == "" {
+		if info.Message != "" {
+			return nil, fmt.Errorf("relay answered %s: %s", resp.Status, info.Message)
+		}
+		return nil, fmt.Errorf("relay answered %s without a tunnel", resp.Status)
+	}
+	n := info.MaxConnCount
+	if n < 1 {
+		n = tunnelDefaultConns
+	}
+	t := &tunnelListener{
+		relay: net.JoinHostPort(u.Hostname(), strconv.Itoa(info.Port)),
+		url:   info.URL,
+		log:   log,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+		open:  make(map[*tunnelConn]bool),
+	}
+	for range n {
+		go t.keepConnected()
+	}
+	return t, nil
+}
+
+// keepConnected holds a connection open to the relay, opening another one
+// whenever it is closed
+func (t *tunnelListener) keepConnected() {
+	backoff := time.Second
+	for {
+		conn, err := net.DialTimeout("tcp", t.relay, 10*time.Second)
+		if err != nil {
+			select {
+			case <-t.done:
+				return
+			default:
+			}
+			t.log.logf("Error connecting to the tunnel relay %s, retrying in %s: %v", t.relay, backoff, err)
+			select {
+			case <-t.done:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, time.Minute)
+			continue
+		}
+		backoff = time.Second
+		c := &tunnelConn{Conn: conn, t: t, closed: make(chan struct{})}
+		t.mu.Lock()
+		t.open[c] = true
+		t.mu.Unlock()
+		select {
+		case t.conns <- c:
+		case <-t.done:
+			c.Close()
+			return
+		}
+		select {
+		case <-c.closed:
+		case <-t.done:
+			return
+		}
+	}
+}
+
+func (t *tunnelListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-t.conns:
+		return c, nil
+	case <-t.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections and closes the ones waiting for a
+// request, which the server would otherwise wait for when shutting down.
+// Those serving requests are left to it.
+func (t *tunnelListener) Close() error {
+	t.once.Do(func() {
+		close(t.done)
+		t.mu.Lock()
+		var idle []*tunnelConn
+		for c := range t.open {
+			if !c.used.Load() {
+				idle = append(idle, c)
+			}
+		}
+		t.mu.Unlock()
+		for _, c := range idle {
+			c.Close()
+		}
+	})
+	return nil
+}
+
+func (t *tunnelListener) Addr() net.Addr {
+	return tunnelAddr(t.relay)
+}
+
+// tunnelAddr is the address of a tunnel listener, that of its relay
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "tunnel" }
+func (a tunnelAddr) String() string  { return string(a) }
@@ -0,0 +1,366 @@
+package httpserve
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// tusPrefix is the URL prefix of the tus resumable upload endpoints
+const tusPrefix = "/_tus/"
+
+const tusVersion = "1.0.0"
+
+// tusInfo is the state of an upload, persisted next to its data file
+type tusInfo struct {
+	Length  int64     `json:"length"`
+	Target  string    `json:"target"`
+	URLPath string    `json:"url_path"`
+	Type    string    `json:"type"`
+	Created time.Time `json:"created"`
+}
+
+// tusStore keeps in-progress resumable uploads in a chunk directory
+type tusStore struct {
+	dir    string
+	expire time.Duration
+	log    *serverLog
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// newTusStore creates the chunk directory and starts purging uploads that
+// have not completed within expire
+func newTusStore(dir string, expire time.Duration, log *serverLog) (*tusStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	s := &tusStore{dir: dir, expire: expire, log: log, locks: make(map[string]*sync.Mutex)}
+	go func() {
+		ticker := time.NewTicker(max(expire/4, time.Minute))
+		defer ticker.Stop()
+		for range ticker.C {
+			s.purgeExpired()
+		}
+	}()
+	return s, nil
+}
+
+// lock serializes access to a single upload
+func (s *tusStore) lock(id string) func() {
+	s.mu.Lock()
+	l, ok := s.locks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		s.locks[id] = l
+	}
+	s.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+func (s *tusStore) dataPath(id string) string { return filepath.Join(s.dir, id+".bin") }
+func (s *tusStore) infoPath(id string) string { return filepath.Join(s.dir, id+".json") }
+
+// load reads the state and current offset of an upload
+func (s *tusStore) load(id string) (tusInfo, int64, error) {
+	var info tusInfo
+	data, err := os.ReadFile(s.infoPath(id))
+	if err != nil {
+		return info, 0, err
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return info, 0, err
+	}
+	stat, err := os.Stat(s.dataPath(id))
+	if err != nil {
+		return info, 0, err
+	}
+	return info, stat.Size(), nil
+}
+
+// remove deletes an upload's files
+func (s *tusStore) remove(id string) {
+	os.Remove(s.dataPath(id))
+	os.Remove(s.infoPath(id))
+	s.mu.Lock()
+	delete(s.locks, id)
+	s.mu.Unlock()
+}
+
+// purgeExpired removes abandoned uploads older than the expiry
+func (s *tusStore) purgeExpired() {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		s.log.logf("Error listing tus uploads: %v", err)
+		return
+	}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		unlock := s.lock(id)
+		info, _, err := s.load(id)
+		if err != nil || time.Since(info.Created) > s.expire {
+			s.remove(id)
+			s.log.logf("Purged abandoned tus upload %s %s", id, info.URLPath)
+		}
+		unlock()
+	}
+}
+
+// validTusID reports whether id looks like an ID generated by serveTusCreate
+func validTusID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// serveTus implements the tus core protocol with the creation, termination
+// and expiration extensions
+func (h *fileHandler) serveTus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,termination,expiration")
+		if h.upload.maxSize > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.upload.maxSize, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		renderError(w, r, http.StatusPreconditionFailed, h.ui)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, tusPrefix)
+	if id == "" {
+		if r.Method != http.MethodPost {
+			renderError(w, r, http.StatusMethodNotAllowed, h.ui)
+			return
+		}
+		h.serveTusCreate(w, r)
+		return
+	}
+	if !validTusID(id) {
+		renderError(w, r, http.StatusNotFound, h.ui)
+		return
+	}
+
+	unlock := h.tus.lock(id)
+	defer unlock()
+	info, offset, err := h.tus.load(id)
+	if err != nil {
+		renderError(w, r, http.StatusNotFound, h.ui)
+		return
+	}
+	w.Header().Set("Upload-Expires", info.Created.Add(h.tus.expire).UTC().Format(http.TimeFormat))
+
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(info.Length, 10))
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		h.serveTusPatch(w, r, id, info, offset)
+	case http.MethodDelete:
+		h.tus.remove(id)
+		h.log.logf("Terminated tus upload %s %s from %s", id, info.URLPath, r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		renderError(w, r, http.StatusMethodNotAllowed, h.ui)
+	}
+}
+
+// serveTusCreate registers a new upload. The target is taken from the
+// "filename" metadata and the optional "dir" metadata, a directory path
+// relative to the served root.
+func (h *fileHandler) serveTusCreate(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		renderError(w, r, http.StatusBadRequest, h.ui)
+		return
+	}
+	if h.upload.maxSize > 0 && length > h.upload.maxSize {
+		renderError(w, r, http.StatusRequestEntityTooLarge, h.ui)
+		return
+	}
+	meta := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	name, err := uploadFileName(meta["filename"])
+	if err != nil {
+		renderError(w, r, http.StatusBadRequest, h.ui)
+		return
+	}
+	urlPath := path.Join("/", meta["dir"], name)
+	if isTrashPath(urlPath) || isMaintenancePath(urlPath) {
+		renderError(w, r, http.StatusForbidden, h.ui)
+		return
+	}
+	target := h.localPath(urlPath)
+	if info, err := os.Stat(filepath.Dir(target)); err != nil || !info.IsDir() {
+		renderError(w, r, http.StatusConflict, h.ui)
+		return
+	}
+	if _, err := os.Lstat(target); err == nil && !h.upload.overwrite {
+		renderError(w, r, http.StatusConflict, h.ui)
+		return
+	}
+	if budget, err := h.quota.budget(filepath.Dir(target)); err != nil || length > budget {
+		if err == nil {
+			err = h.quota.exceeded(filepath.Dir(target))
+		}
+		h.renderUploadError(w, r, err)
+		return
+	}
+	if h.upload.filter.deniedName(name) {
+		h.renderUploadError(w, r, errUploadType)
+		return
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	info := tusInfo{Length: length, Target: target, URLPath: urlPath, Type: meta["filetype"], Created: time.Now()}
+	data, _ := json.Marshal(info)
+	if err := os.WriteFile(h.tus.dataPath(id), nil, 0o600); err != nil {
+		h.log.logf("Error creating tus upload: %v", err)
+		renderError(w, r, http.StatusInternalServerError, h.ui)
+		return
+	}
+	if err := os.WriteFile(h.tus.infoPath(id), data, 0o600); err != nil {
+		h.tus.remove(id)
+		h.log.logf("Error creating tus upload: %v", err)
+		renderError(w, r, http.StatusInternalServerError, h.ui)
+		return
+	}
+	h.log.logf("Created tus upload %s for %s (%d bytes) from %s", id, urlPath, length, r.RemoteAddr)
+
+	// Zero-length uploads are complete as soon as they are created
+	if length == 0 {
+		if err := h.finishTus(id, info); err != nil {
+			h.renderUploadError(w, r, err)
+			return
+		}
+	}
+	w.Header().Set("Location", userdirMount(r)+tusPrefix+id)
+	w.Header().Set("Upload-Expires", info.Created.Add(h.tus.expire).UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// serveTusPatch appends a chunk at the client's offset
+func (h *fileHandler) serveTusPatch(w http.ResponseWriter, r *http.Request, id string, info tusInfo, offset int64) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		renderError(w, r, http.StatusUnsupportedMediaType, h.ui)
+		return
+	}
+	clientOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || clientOffset != offset {
+		renderError(w, r, http.StatusConflict, h.ui)
+		return
+	}
+
+	f, err := os.OpenFile(h.tus.dataPath(id), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		renderError(w, r, http.StatusNotFound, h.ui)
+		return
+	}
+	// Keep whatever arrived before a dropped connection, so the client can
+	// resume from there
+	n, copyErr := io.Copy(f, io.LimitReader(r.Body, info.Length-offset))
+	closeErr := f.Close()
+	offset += n
+	if copyErr != nil || closeErr != nil {
+		h.log.logf("tus upload %s interrupted at %d/%d bytes: %v", id, offset, info.Length, errors.Join(copyErr, closeErr))
+		if copyErr == nil {
+			renderError(w, r, http.StatusInternalServerError, h.ui)
+		}
+		return
+	}
+
+	if offset == info.Length {
+		if err := h.finishTus(id, info); err != nil {
+			h.log.logf("Error completing tus upload %s: %v", id, err)
+			h.renderUploadError(w, r, err)
+			return
+		}
+		h.log.logf("Uploaded %s (%d bytes) from %s", info.URLPath, info.Length, r.RemoteAddr)
+		h.webhook.notify(r, eventUpload, info.URLPath, info.Length)
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishTus moves a completed upload into the served directory, copying it
+// when the chunk directory lives on another filesystem
+func (h *fileHandler) finishTus(id string, info tusInfo) error {
+	defer h.tus.remove(id)
+	if err := h.checkTusContent(id, info); err != nil {
+		return err
+	}
+	_, err := h.commitFile(h.tus.dataPath(id), info.Target, h.upload.overwrite)
+	if err == nil {
+		h.quota.add(info.Length)
+	}
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	f, err := os.Open(h.tus.dataPath(id))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, _, err = h.storeFile(info.Target, info.Type, f)
+	return err
+}
+
+// checkTusContent runs the upload filter over a completed upload
+func (h *fileHandler) checkTusContent(id string, info tusInfo) error {
+	f, err := os.Open(h.tus.dataPath(id))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	return h.upload.filter.checkHead(filepath.Base(info.Target), info.Type, head[:n])
+}
+
+// parseTusMetadata decodes the Upload-Metadata header, a comma separated
+// list of keys with optional base64 encoded values
+func parseTusMetadata(header string) map[string]string {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		meta[key] = string(decoded)
+	}
+	return meta
+}
@@ -0,0 +1,198 @@
+package httpserve
+
+import (
+	"html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// uiOptions holds the branding shared by listing and error pages
+type uiOptions struct {
+	Title    string
+	Logo     string
+	ReadOnly bool
+	lang     string
+	log      *serverLog // where errors rendering the pages go
+}
+
+// errorPage holds everything the error template needs
+type errorPage struct {
+	UI         uiOptions
+	Msg        catalog
+	Status     int
+	StatusText string
+	Path       string
+	MessageKey string
+}
+
+// jsonError is the error body returned to clients preferring JSON
+type jsonError struct {
+	Error     string `json:"error"`
+	Status    int    `json:"status"`
+	Path      string `json:"path"`
+	RequestID string `json:"request_id"`
+}
+
+// renderError writes a themed HTML error page for the given status code, or
+// a JSON error body when the client prefers application/json
+func renderError(w http.ResponseWriter, r *http.Request, code int, ui uiOptions) {
+	renderErrorMessage(w, r, code, ui, "")
+}
+
+// renderErrorMessage is renderError with an explanation, given as the key
+// of a catalog message
+func renderErrorMessage(w http.ResponseWriter, r *http.Request, code int, ui uiOptions, messageKey string) {
+	h := w.Header()
+	h.Del("Content-Length")
+	if prefersJSON(r) {
+		message := http.StatusText(code)
+		if messageKey != "" {
+			message = catalogs["en"].T(messageKey)
+		}
+		writeJSON(w, code, jsonError{
+			Error:     message,
+			Status:    code,
+			Path:      r.URL.Path,
+			RequestID: RequestID(r),
+		})
+		return
+	}
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("X-Content-Type-Options", "nosniff")
+	msg := negotiateCatalog(r, ui.lang)
+	h.Set("Content-Language", msg.Lang)
+	w.WriteHeader(code)
+	data := errorPage{
+		UI:         ui,
+		Msg:        msg,
+		Status:     code,
+		StatusText: msg.StatusText(code),
+		Path:       r.URL.Path,
+		MessageKey: messageKey,
+	}
+	if err := errorTemplate.Execute(w, data); err != nil {
+		ui.log.logf("Error rendering error page for %s: %v", r.URL.Path, err)
+	}
+}
+
+// prefersJSON reports whether the Accept header ranks application/json
+// above text/html
+func prefersJSON(r *http.Request) bool {
+	jsonQ, htmlQ := -1.0, -1.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case "application/json":
+			jsonQ = max(jsonQ, q)
+		case "text/html":
+			htmlQ = max(htmlQ, q)
+		}
+	}
+	return jsonQ > 0 && jsonQ > htmlQ
+}
+
+// errorPageWriter replaces the plain text errors written by http.FileServer
+// with the themed HTML error page
+type errorPageWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	ui       uiOptions
+	replaced bool
+}
+
+// WriteHeader renders the error page instead of plain text error responses
+func (e *errorPageWriter) WriteHeader(code int) {
+	if code >= 400 && strings.HasPrefix(e.Header().Get("Content-Type"), "text/plain") {
+		e.replaced = true
+		renderError(e.ResponseWriter, e.r, code, e.ui)
+		return
+	}
+	e.ResponseWriter.WriteHeader(code)
+}
+
+// Write discards the original body once the error page has been rendered
+func (e *errorPageWriter) Write(b []byte) (int, error) {
+	if e.replaced {
+		return len(b), nil
+	}
+	return e.ResponseWriter.Write(b)
+}
+
+// ReadFrom passes file bodies through so they can still be sent with
+// sendfile
+func (e *errorPageWriter) ReadFrom(src io.Reader) (int64, error) {
+	if e.replaced {
+		return io.Copy(io.Discard, src)
+	}
+	return readFrom(e.ResponseWriter, src)
+}
+
+// uiTemplates holds the layout pieces shared by every page
+var uiTemplates = template.Must(template.New("ui").Parse(`
+{{define "head"}}<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="color-scheme" content="light dark">
+<style>
+:root { --bg: #ffffff; --fg: #1f2328; --muted: #656d76; --link: #0969da; --border: #d0d7de; }
+@media (prefers-color-scheme: dark) {
+  :root { --bg: #0d1117; --fg: #e6edf3; --muted: #8d96a0; --link: #4493f8; --border: #30363d; }
+}
+:root[data-theme="light"] { --bg: #ffffff; --fg: #1f2328; --muted: #656d76; --link: #0969da; --border: #d0d7de; }
+:root[data-theme="dark"] { --bg: #0d1117; --fg: #e6edf3; --muted: #8d96a0; --link: #4493f8; --border: #30363d; }
+body { font-family: sans-serif; margin: 2em; background: var(--bg); color: var(--fg); }
+a { color: var(--link); }
+header.brand { display: flex; align-items: center; gap: 0.75em; border-bottom: 1px solid var(--border); padding-bottom: 0.5em; margin-bottom: 1em; }
+header.brand img { max-height: 2.5em; }
+header.brand .title { font-size: 1.25em; font-weight: bold; flex: 1; }
+header.brand .badge { font-size: 0.8em; border: 1px solid var(--border); border-radius: 4px; padding: 0 0.4em; }
+header.brand button { background: none; border: 1px solid var(--border); color: var(--fg); border-radius: 4px; cursor: pointer; }
+.muted { color: var(--muted); }
+</style>
+<script>
+(function () {
+  var t = localStorage.getItem("theme");
+  if (t) document.documentElement.setAttribute("data-theme", t);
+})();
+</script>{{end}}
+
+{{define "header"}}<header class="brand">
+{{if .UI.Logo}}<img src="{{.UI.Logo}}" alt="">{{end}}
+<span class="title">{{.UI.Title}}</span>
+{{if .UI.ReadOnly}}<span class="badge muted">{{.Msg.T "ui.readonly"}}</span>{{end}}
+<button type="button" id="theme-toggle" title="{{.Msg.T "ui.theme"}}">&#9680;</button>
+</header>
+<script>
+document.getElementById("theme-toggle").addEventListener("click", function () {
+  var root = document.documentElement;
+  var current = root.getAttribute("data-theme") ||
+    (window.matchMedia("(prefers-color-scheme: dark)").matches ? "dark" : "light");
+  var next = current === "dark" ? "light" : "dark";
+  root.setAttribute("data-theme", next);
+  localStorage.setItem("theme", next);
+});
+</script>{{end}}
+`))
+
+var errorTemplate = template.Must(template.Must(uiTemplates.Clone()).New("error").Parse(`<!DOCTYPE html>
+<html lang="{{.Msg.Lang}}">
+<head>
+{{template "head"}}
+<title>{{.Status}} {{.StatusText}}{{if .UI.Title}} - {{.UI.Title}}{{end}}</title>
+</head>
+<body>
+{{template "header" .}}
+<h1>{{.Status}} {{.StatusText}}</h1>
+{{if .MessageKey}}<p>{{.Msg.T .MessageKey}}</p>{{end}}
+<p class="muted">{{.Path}}</p>
+<p><a href="/">{{.Msg.T "error.back"}}</a></p>
+</body>
+</html>
+`))
@@ -0,0 +1,251 @@
+package httpserve
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// uploadOptions controls how files can be written into the served directory
+type uploadOptions struct {
+	enabled   bool
+	overwrite bool
+	maxSize   int64
+	filter    uploadFilter
+}
+
+var (
+	errUploadExists   = errors.New("file already exists")
+	errUploadTooLarge = errors.New("upload exceeds the maximum size")
+	errUploadNoParent = errors.New("parent directory does not exist")
+	errUploadName     = errors.New("invalid file name")
+)
+
+// uploadStatus maps upload errors to HTTP status codes
+func uploadStatus(err error) int {
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, errUploadExists), errors.Is(err, errUploadNoParent):
+		return http.StatusConflict
+	case errors.Is(err, errUploadTooLarge), errors.As(err, &maxErr):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errUploadName):
+		return http.StatusBadRequest
+	case errors.Is(err, errSlowBody):
+		return http.StatusRequestTimeout
+	case errors.Is(err, errUploadType):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, errUploadInfected):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, errUploadRejected):
+		return http.StatusForbidden
+	case errors.Is(err, errScanFailed), errors.Is(err, errPluginFailed):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// renderUploadError reports a failed upload, explaining storage refusals
+func (h *fileHandler) renderUploadError(w http.ResponseWriter, r *http.Request, err error) {
+	var se *storageError
+	if errors.As(err, &se) {
+		renderErrorMessage(w, r, http.StatusInsufficientStorage, h.ui, se.messageKey)
+		return
+	}
+	renderError(w, r, uploadStatus(err), h.ui)
+}
+
+// localPath maps a sanitized request path to a path inside the root directory
+func (h *fileHandler) localPath(urlPath string) string {
+	return filepath.Join(h.dir, filepath.FromSlash(path.Clean("/"+urlPath)))
+}
+
+// servePut stores the request body at the request path
+func (h *fileHandler) servePut(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/") {
+		renderError(w, r, http.StatusBadRequest, h.ui)
+		return
+	}
+	if h.upload.maxSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, h.upload.maxSize)
+	}
+	target := h.localPath(r.URL.Path)
+	n, existed, err := h.storeFile(target, r.Header.Get("Content-Type"), r.Body)
+	if err != nil {
+		h.log.logf("Upload of %s from %s failed: %v", r.URL.Path, r.RemoteAddr, err)
+		h.renderUploadError(w, r, err)
+		return
+	}
+	h.log.logf("Uploaded %s (%d bytes) from %s", r.URL.Path, n, r.RemoteAddr)
+	h.webhook.notify(r, eventUpload, r.URL.Path, n)
+	if existed {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Location", userdirMount(r)+r.URL.Path)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// servePost stores every file of a multipart/form-data body in the
+// directory at the request path
+func (h *fileHandler) servePost(w http.ResponseWriter, r *http.Request) {
+	dir := h.localPath(r.URL.Path)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		renderError(w, r, http.StatusNotFound, h.ui)
+		return
+	}
+	if h.upload.maxSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, h.upload.maxSize)
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		renderError(w, r, http.StatusBadRequest, h.ui)
+		return
+	}
+
+	var stored []string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			h.log.logf("Upload to %s from %s failed: %v", r.URL.Path, r.RemoteAddr, err)
+			h.renderUploadError(w, r, err)
+			return
+		}
+		if part.FileName() == "" {
+			part.Close()
+			continue
+		}
+		name, err := uploadFileName(part.FileName())
+		if err != nil {
+			part.Close()
+			h.renderUploadError(w, r, err)
+			return
+		}
+		urlPath := path.Join(r.URL.Path, name)
+		if isMaintenancePath(urlPath) {
+			part.Close()
+			renderError(w, r, http.StatusForbidden, h.ui)
+			return
+		}
+		n, _, err := h.storeFile(filepath.Join(dir, name), part.Header.Get("Content-Type"), part)
+		part.Close()
+		if err != nil {
+			h.log.logf("Upload of %s from %s failed: %v", urlPath, r.RemoteAddr, err)
+			h.renderUploadError(w, r, err)
+			return
+		}
+		h.log.logf("Uploaded %s (%d bytes) from %s", urlPath, n, r.RemoteAddr)
+		h.webhook.notify(r, eventUpload, urlPath, n)
+		stored = append(stored, urlPath)
+	}
+
+	// Send browsers submitting the listing's upload form back to the listing
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, userdirMount(r)+r.URL.Path, http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	for _, p := range stored {
+		fmt.Fprintln(w, p)
+	}
+}
+
+// uploadFileName validates the client supplied name of a multipart file
+func uploadFileName(name string) (string, error) {
+	// Some browsers send the full client path, keep only the last element
+	name = name[strings.LastIndexAny(name, `/\`)+1:]
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, 0) {
+		return "", errUploadName
+	}
+	return name, nil
+}
+
+// storeFile writes src to a temporary file next to target and moves it into
+// place once complete, so partial uploads are never visible. The declared
+// Content-Type and sniffed content are checked against the upload filter
+// first. It reports the number of bytes written and whether an existing
+// file was replaced.
+func (h *fileHandler) storeFile(target, declared string, src io.Reader) (int64, bool, error) {
+	parent := filepath.Dir(target)
+	if info, err := os.Stat(parent); err != nil || !info.IsDir() {
+		return 0, false, errUploadNoParent
+	}
+	// Fail early rather than after receiving the whole body
+	if existing, err := os.Lstat(target); err == nil && (existing.IsDir() || !h.upload.overwrite) {
+		return 0, false, errUploadExists
+	}
+
+	src, err := h.upload.filter.check(filepath.Base(target), declared, src)
+	if err != nil {
+		return 0, false, err
+	}
+	budget, err := h.quota.budget(parent)
+	if err != nil {
+		return 0, false, err
+	}
+
+	tmp, err := os.CreateTemp(parent, ".upload-*")
+	if err != nil {
+		return 0, false, err
+	}
+	defer os.Remove(tmp.Name())
+	// Read one byte past the budget to detect uploads that exceed it
+	n, err := io.Copy(tmp, io.LimitReader(src, budget+1))
+	if err == nil && n > budget {
+		err = h.quota.exceeded(parent)
+	}
+	if err != nil {
+		tmp.Close()
+		return n, false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return n, false, err
+	}
+	existed, err := h.commitFile(tmp.Name(), target, h.upload.overwrite)
+	if err == nil {
+		h.quota.add(n)
+	}
+	return n, existed, err
+}
+
+// commitFile scans a completely written file and moves it to target,
+// replacing an existing file only with overwrite, and reports whether one
+// was replaced
+func (h *fileHandler) commitFile(tmpName, target string, overwrite bool) (bool, error) {
+	if err := h.scanUpload(tmpName, target); err != nil {
+		return false, err
+	}
+	rel, _ := filepath.Rel(h.dir, target)
+	if err := h.plugins.vetUpload(tmpName, "/"+filepath.ToSlash(rel), h.log); err != nil {
+		return false, err
+	}
+	if err := os.Chmod(tmpName, 0o644); err != nil {
+		return false, err
+	}
+	existing, err := os.Lstat(target)
+	existed := err == nil
+	if existed && (existing.IsDir() || !overwrite) {
+		return false, errUploadExists
+	}
+	if overwrite {
+		return existed, os.Rename(tmpName, target)
+	}
+	// Linking fails if the target appeared meanwhile, unlike rename
+	if err := os.Link(tmpName, target); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return false, errUploadExists
+		}
+		return false, err
+	}
+	return false, nil
+}
@@ -0,0 +1,137 @@
+package httpserve
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+var errUploadType = errors.New("file type not allowed")
+
+// executableExts are rejected by default since an open upload directory is
+// otherwise an easy way to distribute malware or plant server-side scripts
+var executableExts = map[string]bool{
+	".exe": true, ".dll": true, ".com": true, ".scr": true, ".msi": true, ".bat": true,
+	".cmd": true, ".ps1": true, ".vbs": true, ".jar": true, ".sh": true, ".bash": true,
+	".php": true, ".phtml": true, ".asp": true, ".aspx": true, ".jsp": true, ".cgi": true,
+	".pl": true, ".py": true, ".rb": true, ".elf": true, ".bin": true, ".app": true,
+}
+
+// executableMagic are the leading bytes of native executables and scripts
+var executableMagic = [][]byte{
+	[]byte("MZ"),             // Windows PE
+	[]byte("\x7fELF"),        // ELF
+	{0xfe, 0xed, 0xfa, 0xce}, // Mach-O 32-bit
+	{0xfe, 0xed, 0xfa, 0xcf}, // Mach-O 64-bit
+	{0xce, 0xfa, 0xed, 0xfe}, // Mach-O 32-bit, reversed
+	{0xcf, 0xfa, 0xed, 0xfe}, // Mach-O 64-bit, reversed
+	{0xca, 0xfe, 0xba, 0xbe}, // Mach-O universal
+	[]byte("#!"),             // interpreter scripts
+	[]byte("<?php"),          // PHP
+}
+
+// uploadFilter decides which files uploads may store
+type uploadFilter struct {
+	exts            map[string]bool
+	types           []string
+	denyExecutables bool
+}
+
+// parseUploadFilter parses a comma separated allowlist of extensions such
+// as .png and MIME types or patterns such as application/pdf and image/*
+func parseUploadFilter(allow string, denyExecutables bool) (uploadFilter, error) {
+	f := uploadFilter{exts: make(map[string]bool), denyExecutables: denyExecutables}
+	for _, item := range strings.Split(allow, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		switch {
+		case item == "":
+		case strings.HasPrefix(item, "."):
+			f.exts[item] = true
+		case strings.Contains(item, "/"):
+			f.types = append(f.types, item)
+		default:
+			return f, fmt.Errorf("invalid upload allowlist entry %q (expected .ext or type/subtype)", item)
+		}
+	}
+	return f, nil
+}
+
+// check validates a file by name, declared Content-Type and a sniff of its
+// first bytes, returning a reader that still yields the complete content
+func (f uploadFilter) check(name, declared string, src io.Reader) (io.Reader, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+	if err := f.checkHead(name, declared, head); err != nil {
+		return nil, err
+	}
+	return io.MultiReader(bytes.NewReader(head), src), nil
+}
+
+// deniedName reports whether the file name alone rules out the upload
+func (f uploadFilter) deniedName(name string) bool {
+	return f.denyExecutables && executableExts[strings.ToLower(path.Ext(name))]
+}
+
+// checkHead validates a file given its leading bytes
+func (f uploadFilter) checkHead(name, declared string, head []byte) error {
+	ext := strings.ToLower(path.Ext(name))
+	if f.denyExecutables {
+		if executableExts[ext] {
+			return errUploadType
+		}
+		for _, magic := range executableMagic {
+			if bytes.HasPrefix(head, magic) {
+				return errUploadType
+			}
+		}
+	}
+	if len(f.exts) == 0 && len(f.types) == 0 {
+		return nil
+	}
+	if f.exts[ext] {
+		return nil
+	}
+
+	// Both what the client claims and what the content looks like must be
+	// allowed; generic declared types carry no information and are skipped
+	sniffed := mediaType(http.DetectContentType(head))
+	declared = mediaType(declared)
+	if declared != "" && declared != "application/octet-stream" && !f.typeAllowed(declared) {
+		return errUploadType
+	}
+	if !f.typeAllowed(sniffed) {
+		return errUploadType
+	}
+	return nil
+}
+
+// typeAllowed matches a media type against the allowlisted patterns
+func (f uploadFilter) typeAllowed(mediaType string) bool {
+	for _, pattern := range f.types {
+		if pattern == mediaType || pattern == "*/*" {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// mediaType strips parameters from a Content-Type value
+func mediaType(contentType string) string {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mt
+}
@@ -0,0 +1,413 @@
+package httpserve
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// portMappingLifetime is how long mappings are requested for; they are
+// renewed halfway through
+const portMappingLifetime = time.Hour
+
+// portMapper asks a router to forward an external TCP port to this machine
+type portMapper interface {
+	// mapPort forwards external (a suggestion the router may not follow)
+	// to internal, returning the external port it got
+	mapPort(internal, external int, lifetime time.Duration) (int, error)
+	unmapPort(internal, external int) error
+	externalIP() (net.IP, error)
+	String() string
+}
+
+// portMapping keeps a router forwarding a port for as long as the server
+// runs
+type portMapping struct {
+	mapper   portMapper
+	internal int
+	external int
+	log      *serverLog
+	stop     chan struct{}
+}
+
+// mapPublicPort requests a mapping for the TCP port from the router, with
+// NAT-PMP first and UPnP IGD otherwise, and returns it with the public URL
+func mapPublicPort(port int, log *serverLog) (*portMapping, string, error) {
+	var errs []string
+	for _, discover := range []func(*serverLog) (portMapper, error){discoverNATPMP, discoverUPnP} {
+		mapper, err := discover(log)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		external, err := mapper.mapPort(port, port, portMappingLifetime)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", mapper, err))
+			continue
+		}
+		m := &portMapping{mapper: mapper, internal: port, external: external, log: log, stop: make(chan struct{})}
+		go m.renew()
+		host := "<external address>"
+		if ip, err := mapper.externalIP(); err != nil {
+			log.logf("Port mapping: cannot get the external address from %v: %v", mapper, err)
+		} else {
+			host = ip.String()
+			if ip.IsPrivate() {
+				log.logf("Port mapping: the router's external address %s is private, so the server is likely behind another NAT", ip)
+			}
+		}
+		return m, fmt.Sprintf("http://%s/", net.JoinHostPort(host, fmt.Sprint(external))), nil
+	}
+	return nil, "", errors.New(strings.Join(errs, "; "))
+}
+
+// renew refreshes the mapping before it expires
+func (m *portMapping) renew() {
+	ticker := time.NewTicker(portMappingLifetime / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			external, err := m.mapper.mapPort(m.internal, m.external, portMappingLifetime)
+			if err != nil {
+				m.log.logf("Error renewing port mapping with %v: %v", m.mapper, err)
+			} else if external != m.external {
+				m.log.logf("Port mapping moved from external port %d to %d", m.external, external)
+				m.external = external
+			}
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// close removes the mapping from the router
+func (m *portMapping) close() {
+	close(m.stop)
+	if err := m.mapper.unmapPort(m.internal, m.external); err != nil {
+		m.log.logf("Error removing port mapping: %v", err)
+	}
+}
+
+// defaultGateway returns the IPv4 default gateway from the Linux routing
+// table, or guesses the .1 address of the local network elsewhere
+func defaultGateway() (net.IP, error) {
+	if f, err := os.Open("/proc/net/route"); err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 3 || fields[1] != "00000000" {
+				continue
+			}
+			raw, err := hex.DecodeString(fields[2])
+			if err != nil || len(raw) != 4 {
+				continue
+			}
+			// The table holds addresses in host (little endian) order
+			return net.IPv4(raw[3], raw[2], raw[1], raw[0]), nil
+		}
+	}
+	for _, ip := range localIPs() {
+		if ip4 := ip.To4(); ip4 != nil && ip4.IsPrivate() {
+			return net.IPv4(ip4[0], ip4[1], ip4[2], 1), nil
+		}
+	}
+	return nil, errors.New("cannot find the default gateway")
+}
+
+// natPMP maps ports with NAT-PMP (RFC 6886), spoken by most consumer
+// routers and answered by PCP ones for compatibility
+type natPMP struct {
+	gateway *net.UDPAddr
+}
+
+// discoverNATPMP checks that the default gateway answers NAT-PMP
+func discoverNATPMP(*serverLog) (portMapper, error) {
+	gateway, err := defaultGateway()
+	if err != nil {
+		return nil, err
+	}
+	n := &natPMP{gateway: &net.UDPAddr{IP: gateway, Port: 5351}}
+	if _, err := n.externalIP(); err != nil {
+		return nil, fmt.Errorf("NAT-PMP at %s: %v", gateway, err)
+	}
+	return n, nil
+}
+
+func (n *natPMP) String() string { return "NAT-PMP gateway " + n.gateway.IP.String() }
+
+// request sends a request, retrying with backoff, and returns the response
+// after checking its opcode and result code
+func (n *natPMP) request(msg []byte, size int) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, n.gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	buf := make([]byte, 16)
+	timeout := 250 * time.Millisecond
+	for range 4 {
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		got, err := conn.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			timeout *= 2
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if got < size || buf[0] != 0 || buf[1] != msg[1]|0x80 {
+			continue
+		}
+		if code := binary.BigEndian.Uint16(buf[2:4]); code != 0 {
+			return nil, fmt.Errorf("result code %d", code)
+		}
+		return buf[:got], nil
+	}
+	return nil, errors.New("no answer")
+}
+
+func (n *natPMP) externalIP() (net.IP, error) {
+	resp, err := n.request([]byte{0, 0}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IPv4(resp[8], resp[9], resp[10], resp[11]), nil
+}
+
+func (n *natPMP) mapPort(internal, external int, lifetime time.Duration) (int, error) {
+	msg := []byte{0, 2, 0, 0}
+	msg = binary.BigEndian.AppendUint16(msg, uint16(internal))
+	msg = binary.BigEndian.AppendUint16(msg, uint16(external))
+	msg = binary.BigEndian.AppendUint32(msg, uint32(lifetime/time.Second))
+	resp, err := n.request(msg, 16)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(resp[10:12])), nil
+}
+
+func (n *natPMP) unmapPort(internal, external int) error {
+	_, err := n.mapPort(internal, 0, 0)
+	return err
+}
+
+// upnpIGD maps ports through the WANIPConnection or WANPPPConnection
+// service of a UPnP Internet Gateway Device
+type upnpIGD struct {
+	controlURL  string
+	serviceType string
+	localIP     net.IP
+	client      *http.Client
+}
+
+// discoverUPnP finds an Internet Gateway Device with SSDP
+func discoverUPnP(log *serverLog) (portMapper, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	group := &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+	search := "M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nMAN: \"ssdp:discover\"\r\nMX: 2\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n\r\n"
+	if _, err := conn.WriteToUDP([]byte(search), group); err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	deadline := time.Now().Add(3 * time.Second)
+	buf := make([]byte, 2048)
+	for {
+		conn.SetReadDeadline(deadline)
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, errors.New("UPnP: no Internet Gateway Device answered")
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		location := resp.Header.Get("Location")
+		if location == "" {
+			continue
+		}
+		igd, err := newUPnPIGD(client, location)
+		if err != nil {
+			log.logf("UPnP: skipping %s: %v", from.IP, err)
+			continue
+		}
+		return igd, nil
+	}
+}
+
+// upnpDevice is a device of a UPnP description, with its embedded devices
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// newUPnPIGD reads the device description at location to find its
+// connection service
+func newUPnPIGD(client *http.Client, location string) (*upnpIGD, error) {
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var root struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&root); err != nil {
+		return nil, fmt.Errorf("reading description: %v", err)
+	}
+	if root.URLBase != "" {
+		if u, err := url.Parse(root.URLBase); err == nil {
+			base = u
+		}
+	}
+	queue := []upnpDevice{root.Device}
+	for len(queue) > 0 {
+		device := queue[0]
+		queue = append(queue[1:], device.Devices...)
+		for _, service := range device.Services {
+			if !strings.Contains(service.ServiceType, ":WANIPConnection:") && !strings.Contains(service.ServiceType, ":WANPPPConnection:") {
+				continue
+			}
+			control, err := base.Parse(service.ControlURL)
+			if err != nil {
+				continue
+			}
+			// The router sees this machine at the address used to reach it
+			probe, err := net.Dial("udp4", control.Host)
+			if err != nil {
+				return nil, err
+			}
+			localIP := probe.LocalAddr().(*net.UDPAddr).IP
+			probe.Close()
+			return &upnpIGD{controlURL: control.String(), serviceType: service.ServiceType, localIP: localIP, client: client}, nil
+		}
+	}
+	return nil, errors.New("no WAN connection service")
+}
+
+func (u *upnpIGD) String() string {
+	host := u.controlURL
+	if parsed, err := url.Parse(u.controlURL); err == nil {
+		host = parsed.Hostname()
+	}
+	return "UPnP gateway " + host
+}
+
+// call invokes a SOAP action with the arguments, given as name and value
+// pairs, and returns the text of the response elements by name
+func (u *upnpIGD) call(action string, args ...string) (map[string]string, error) {
+	var body strings.Builder
+	fmt.Fprintf(&body, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><u:%s xmlns:u="%s">`, action, u.serviceType)
+	for i := 0; i+1 < len(args); i += 2 {
+		body.WriteString("<" + args[i] + ">")
+		xml.EscapeText(&body, []byte(args[i+1]))
+		body.WriteString("</" + args[i] + ">")
+	}
+	fmt.Fprintf(&body, "</u:%s></s:Body></s:Envelope>", action)
+	req, err := http.NewRequest(http.MethodPost, u.controlURL, strings.NewReader(body.String()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, u.serviceType, action))
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	values := make(map[string]string)
+	decoder := xml.NewDecoder(io.LimitReader(resp.Body, 1<<20))
+	var element string
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			element = tok.Name.Local
+		case xml.CharData:
+			if element != "" {
+				values[element] += string(tok)
+			}
+		case xml.EndElement:
+			element = ""
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		if code := values["errorCode"]; code != "" {
+			return nil, fmt.Errorf("%s failed with UPnP error %s %s", action, code, values["errorDescription"])
+		}
+		return nil, fmt.Errorf("%s failed with status %s", action, resp.Status)
+	}
+	return values, nil
+}
+
+func (u *upnpIGD) externalIP() (net.IP, error) {
+	values, err := u.call("GetExternalIPAddress")
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(values["NewExternalIPAddress"]))
+	if ip == nil {
+		return nil, errors.New("no external address in the answer")
+	}
+	return ip, nil
+}
+
+func (u *upnpIGD) mapPort(internal, external int, lifetime time.Duration) (int, error) {
+	add := func(lease time.Duration) error {
+		_, err := u.call("AddPortMapping",
+			"NewRemoteHost", "",
+			"NewExternalPort", fmt.Sprint(external),
+			"NewProtocol", "TCP",
+			"NewInternalPort", fmt.Sprint(internal),
+			"NewInternalClient", u.localIP.String(),
+			"NewEnabled", "1",
+			"NewPortMappingDescription", "simple-http-server",
+			"NewLeaseDuration", fmt.Sprint(int(lease/time.Second)))
+		return err
+	}
+	err := add(lifetime)
+	if err != nil && strings.Contains(err.Error(), "error 725") {
+		// OnlyPermanentLeasesSupported: the mapping is removed on shutdown
+		err = add(0)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return external, nil
+}
+
+func (u *upnpIGD) unmapPort(internal, external int) error {
+	_, err := u.call("DeletePortMapping", "NewRemoteHost", "", "NewExternalPort", fmt.Sprint(external), "NewProtocol", "TCP")
+	return err
+}
@@ -0,0 +1,197 @@
+package httpserve
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// userdirOptions gives each user a home served at /~name/
+type userdirOptions struct {
+	dir     string // the homes, one subdirectory per user
+	quota   int64  // default upload quota of each home
+	private bool   // only the owner may read a home
+}
+
+// userHome is the directory and quota of a user
+type userHome struct {
+	dir   string
+	quota int64
+	site  *fileHandler // created on the first request
+}
+
+// userdirRouter serves /~name/ from the home of name, and everything else
+// from the fallback site. Only the owner, authenticated as name, may
+// change a home, or read it with --userdir-private.
+type userdirRouter struct {
+	opts     userdirOptions
+	listed   bool // homes come from --userdir-users, not from the subdirectories
+	newSite  func(home userHome) (*fileHandler, error)
+	ui       uiOptions
+	fallback http.Handler
+	log      *serverLog
+
+	mu    sync.Mutex
+	homes map[string]*userHome
+}
+
+type userdirMountKey struct{}
+
+// parseUsersFile reads the --userdir-users file: a line per user of
+// name:password, then optionally root=dir and quota=size separated by
+// spaces. Homes default to the user's name inside the --userdir directory,
+// which relative roots are resolved against too. # starts a comment.
+//
+//	alice:s3cret quota=1G
+//	bob:hunter2 root=/srv/bob
+func parseUsersFile(name, dir string, quota int64) (credentials, map[string]*userHome, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	creds := make(credentials)
+	homes := make(map[string]*userHome)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		user, password, ok := strings.Cut(fields[0], ":")
+		if !ok || password == "" || !validUserName(user) {
+			return nil, nil, fmt.Errorf("%s:%d: expected name:password, with a name of letters, digits, '.', '-' and '_'", name, n)
+		}
+		if _, dup := homes[user]; dup {
+			return nil, nil, fmt.Errorf("%s:%d: user %s listed twice", name, n, user)
+		}
+		home := &userHome{dir: filepath.Join(dir, user), quota: quota}
+		for _, field := range fields[1:] {
+			key, value, _ := strings.Cut(field, "=")
+			switch key {
+			case "root":
+				if !filepath.IsAbs(value) {
+					value = filepath.Join(dir, value)
+				}
+				home.dir = filepath.Clean(value)
+			case "quota":
+				var size byteSize
+				if err := size.Set(value); err != nil {
+					return nil, nil, fmt.Errorf("%s:%d: %v", name, n, err)
+				}
+				home.quota = int64(size)
+			default:
+				return nil, nil, fmt.Errorf("%s:%d: unknown setting %q, expected root= or quota=", name, n, field)
+			}
+		}
+		creds[user] = sha256.Sum256([]byte(password))
+		homes[user] = home
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return creds, homes, nil
+}
+
+// validUserName reports whether name can be a home: no separators, and no
+// leading dot so it can't be . or .. or hidden
+func validUserName(name string) bool {
+	if name == "" || len(name) > 64 || name[0] == '.' {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// ServeHTTP hands /~name/ requests to the home of name with the prefix
+// stripped, redirecting /~name to /~name/
+func (u *userdirRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rest, ok := strings.CutPrefix(r.URL.Path, "/~")
+	if !ok {
+		u.fallback.ServeHTTP(w, r)
+		return
+	}
+	name, sub, hasSlash := strings.Cut(rest, "/")
+	site, err := u.home(name)
+	if err != nil {
+		u.log.logf("Error opening the home of %s: %v", name, err)
+		renderError(w, r, http.StatusInternalServerError, u.ui)
+		return
+	}
+	if site == nil {
+		renderError(w, r, http.StatusNotFound, u.ui)
+		return
+	}
+	if !hasSlash {
+		target := url.URL{Path: r.URL.Path + "/", RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+		return
+	}
+	if (u.opts.private || !readOnlyMethod(r.Method)) && RequestUser(r) != name {
+		renderError(w, r, http.StatusForbidden, u.ui)
+		return
+	}
+	mount := "/~" + name
+	r = r.Clone(context.WithValue(r.Context(), userdirMountKey{}, mount))
+	r.URL.Path, r.URL.RawPath = "/"+sub, ""
+	site.ServeHTTP(w, r)
+}
+
+// home returns the site of a user's home, or nil when there is none
+func (u *userdirRouter) home(name string) (*fileHandler, error) {
+	if !validUserName(name) {
+		return nil, nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	h, ok := u.homes[name]
+	if !ok {
+		if u.listed {
+			return nil, nil
+		}
+		// Without a users file any subdirectory is a home, so users added
+		// later are served without a restart
+		dir := filepath.Join(u.opts.dir, name)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return nil, nil
+		}
+		h = &userHome{dir: dir, quota: u.opts.quota}
+		u.homes[name] = h
+	}
+	if h.site == nil {
+		site, err := u.newSite(*h)
+		if err != nil {
+			return nil, err
+		}
+		h.site = site
+	}
+	return h.site, nil
+}
+
+// readOnlyMethod reports whether a method only reads
+func readOnlyMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+		return true
+	}
+	return false
+}
+
+// userdirMount returns the /~name prefix stripped from the request, or ""
+// outside a home
+func userdirMount(r *http.Request) string {
+	mount, _ := r.Context().Value(userdirMountKey{}).(string)
+	return mount
+}
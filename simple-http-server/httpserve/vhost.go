@@ -0,0 +1,42 @@
+package httpserve
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// vhostRouter dispatches requests to a site handler based on the Host header
+type vhostRouter struct {
+	hosts    map[string]http.Handler
+	fallback http.Handler
+}
+
+// parseVhost splits a --vhost value of the form host=/path/to/dir
+func parseVhost(value string) (host, dir string, err error) {
+	host, dir, ok := strings.Cut(value, "=")
+	if !ok || host == "" || dir == "" {
+		return "", "", fmt.Errorf("invalid vhost %q (expected host=dir)", value)
+	}
+	return strings.ToLower(host), dir, nil
+}
+
+// ServeHTTP routes the request to the handler registered for its host,
+// falling back to the default site for unknown hosts
+func (v *vhostRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h, ok := v.hosts[requestHost(r)]; ok {
+		h.ServeHTTP(w, r)
+		return
+	}
+	v.fallback.ServeHTTP(w, r)
+}
+
+// requestHost returns the lowercased Host header without its port
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
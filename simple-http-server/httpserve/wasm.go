@@ -0,0 +1,1363 @@
+package httpserve
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"slices"
+)
+
+// This file is a small WebAssembly interpreter for the request filters of
+// wasmfilter.go: the MVP instruction set with the sign extension,
+// saturating conversion, bulk memory and multi-value extensions, without
+// SIMD, threads or reference types beyond funcref tables. It leans on Go's
+// bounds checks for memory safety, turning any fault into a trap, and runs
+// every call on a budget of instructions.
+
+const (
+	wasmPageSize = 64 << 10
+	wasmMaxPages = 1 << 16
+	wasmMaxStack = 1 << 20 // values on the operand stack
+	wasmMaxDepth = 10000   // nested calls
+)
+
+// wasmFuncType is a function signature, value types being one byte each
+type wasmFuncType struct {
+	params, results []byte
+}
+
+// wasmImport is an imported function
+type wasmImport struct {
+	module, name string
+	typ          uint32
+}
+
+// wasmConst is a constant expression initializing a global or giving the
+// offset of a segment
+type wasmConst struct {
+	value  uint64
+	global int // read the imported global instead, unsupported, or -1
+}
+
+// wasmGlobal is a global of the module
+type wasmGlobal struct {
+	init wasmConst
+}
+
+// wasmElem is an element segment filling the table with functions
+type wasmElem struct {
+	active bool
+	offset wasmConst
+	funcs  []int64 // -1 for null
+}
+
+// wasmData is a data segment initializing memory
+type wasmData struct {
+	active bool
+	offset wasmConst
+	data   []byte
+}
+
+// wasmInstr is a decoded instruction. Blocks hold their end and else
+// positions, so branches need not scan the code.
+type wasmInstr struct {
+	op      uint16 // the opcode, or 0xFC00 plus the secondary opcode
+	params  uint16 // values taken by a block
+	results uint16 // values left by a block
+	x       uint32 // end of a block, label depth, index
+	y       uint32 // else of an if, second index
+	v       uint64 // constant or memory offset
+}
+
+// wasmCode is the decoded body of a function
+type wasmCode struct {
+	typ    uint32
+	locals int // besides the parameters
+	body   []wasmInstr
+	tables [][]uint32 // label depths of br_table, the default last
+}
+
+// wasmModule is a decoded module, instantiated once per filter VM
+type wasmModule struct {
+	types    []wasmFuncType
+	imports  []wasmImport
+	codes    []wasmCode
+	tableMin uint32
+	hasTable bool
+	memMin   uint32
+	memMax   uint32
+	hasMem   bool
+	globals  []wasmGlobal
+	exports  map[string]uint32 // functions
+	start    int64
+	elems    []wasmElem
+	datas    []wasmData
+}
+
+// wasmFormatError reports a malformed module while decoding
+type wasmFormatError string
+
+// wasmTrap aborts the execution of an instance
+type wasmTrap struct{ msg string }
+
+func (t wasmTrap) Error() string { return "wasm trap: " + t.msg }
+
+// wasmReader decodes the binary format, panicking with a wasmFormatError
+// on malformed input
+type wasmReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *wasmReader) fail(format string, args ...any) {
+	panic(wasmFormatError(fmt.Sprintf("offset %d: ", r.pos) + fmt.Sprintf(format, args...)))
+}
+
+func (r *wasmReader) byte() byte {
+	if r.pos >= len(r.b) {
+		r.fail("unexpected end")
+	}
+	c := r.b[r.pos]
+	r.pos++
+	return c
+}
+
+func (r *wasmReader) bytes(n uint32) []byte {
+	if uint64(r.pos)+uint64(n) > uint64(len(r.b)) {
+		r.fail("unexpected end")
+	}
+	b := r.b[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b
+}
+
+// u32 reads an unsigned LEB128 integer
+func (r *wasmReader) u32() uint32 {
+	var v uint64
+	for shift := 0; ; shift += 7 {
+		c := r.byte()
+		v |= uint64(c&0x7f) << shift
+		if c < 0x80 {
+			break
+		}
+		if shift >= 28 {
+			r.fail("integer too long")
+		}
+	}
+	if v > math.MaxUint32 {
+		r.fail("integer too large")
+	}
+	return uint32(v)
+}
+
+// sleb reads a signed LEB128 integer of the given size
+func (r *wasmReader) sleb(size int) int64 {
+	var v int64
+	for shift := 0; ; {
+		c := r.byte()
+		v |= int64(c&0x7f) << shift
+		shift += 7
+		if c < 0x80 {
+			if shift < 64 && c&0x40 != 0 {
+				v |= -1 << shift
+			}
+			return v
+		}
+		if shift >= (size+6)/7*7 {
+			r.fail("integer too long")
+		}
+	}
+}
+
+func (r *wasmReader) name() string {
+	return string(r.bytes(r.u32()))
+}
+
+// limits reads the minimum and optional maximum of a table or memory
+func (r *wasmReader) limits() (uint32, uint32, bool) {
+	switch r.byte() {
+	case 0:
+		return r.u32(), 0, false
+	case 1:
+		return r.u32(), r.u32(), true
+	}
+	r.fail("unsupported limits, shared or 64-bit memories are not supported")
+	return 0, 0, false
+}
+
+// constExpr reads a constant expression
+func (r *wasmReader) constExpr() wasmConst {
+	c := wasmConst{global: -1}
+	switch op := r.byte(); op {
+	case 0x41:
+		c.value = uint64(uint32(r.sleb(32)))
+	case 0x42:
+		c.value = uint64(r.sleb(64))
+	case 0x43:
+		c.value = uint64(binary.LittleEndian.Uint32(r.bytes(4)))
+	case 0x44:
+		c.value = binary.LittleEndian.Uint64(r.bytes(8))
+	case 0x23:
+		c.global = int(r.u32())
+	case 0xD0:
+		r.byte()
+		c.value = math.MaxUint64
+	case 0xD2:
+		c.value = uint64(r.u32())
+	default:
+		r.fail("unsupported constant expression 0x%02x", op)
+	}
+	if r.byte() != 0x0B {
+		r.fail("constant expression is not terminated")
+	}
+	return c
+}
+
+// parseWasm decodes a binary module
+func parseWasm(b []byte) (m *wasmModule, err error) {
+	defer func() {
+		r := recover()
+		if e, ok := r.(wasmFormatError); ok {
+			m, err = nil, errors.New(string(e))
+		} else if r != nil {
+			panic(r)
+		}
+	}()
+	r := &wasmReader{b: b}
+	if string(r.bytes(4)) != "\x00asm" || binary.LittleEndian.Uint32(r.bytes(4)) != 1 {
+		return nil, errors.New("not a WebAssembly 1.0 binary module")
+	}
+	m = &wasmModule{exports: make(map[string]uint32), start: -1}
+	var funcTypes []uint32
+	for r.pos < len(r.b) {
+		id := r.byte()
+		s := &wasmReader{b: r.bytes(r.u32())}
+		switch id {
+		case 0: // custom
+		case 1: // type
+			for n := s.u32(); n > 0; n-- {
+				if s.byte() != 0x60 {
+					s.fail("invalid function type")
+				}
+				var t wasmFuncType
+				t.params = slices.Clone(s.bytes(s.u32()))
+				t.results = slices.Clone(s.bytes(s.u32()))
+				m.types = append(m.types, t)
+			}
+		case 2: // import
+			for n := s.u32(); n > 0; n-- {
+				imp := wasmImport{module: s.name(), name: s.name()}
+				if kind := s.byte(); kind != 0 {
+					s.fail("import %s.%s: only functions can be imported", imp.module, imp.name)
+				}
+				imp.typ = s.u32()
+				m.imports = append(m.imports, imp)
+			}
+		case 3: // function
+			for n := s.u32(); n > 0; n-- {
+				funcTypes = append(funcTypes, s.u32())
+			}
+		case 4: // table
+			if s.u32() != 1 || s.byte() != 0x70 {
+				s.fail("only a single funcref table is supported")
+			}
+			m.tableMin, _, _ = s.limits()
+			m.hasTable = true
+		case 5: // memory
+			if n := s.u32(); n > 1 {
+				s.fail("multiple memories are not supported")
+			} else if n == 1 {
+				var hasMax bool
+				m.memMin, m.memMax, hasMax = s.limits()
+				if !hasMax {
+					m.memMax = wasmMaxPages
+				}
+				m.hasMem = true
+			}
+		case 6: // global
+			for n := s.u32(); n > 0; n-- {
+				s.byte() // value type
+				s.byte() // mutability
+				m.globals = append(m.globals, wasmGlobal{init: s.constExpr()})
+			}
+		case 7: // export
+			for n := s.u32(); n > 0; n-- {
+				name := s.name()
+				kind, index := s.byte(), s.u32()
+				if kind == 0 {
+					m.exports[name] = index
+				}
+			}
+		case 8: // start
+			m.start = int64(s.u32())
+		case 9: // element
+			for n := s.u32(); n > 0; n-- {
+				m.elems = append(m.elems, s.elem())
+			}
+		case 10: // code
+			n := s.u32()
+			if int(n) != len(funcTypes) {
+				s.fail("%d function bodies for %d functions", n, len(funcTypes))
+			}
+			for i := range funcTypes {
+				if funcTypes[i] >= uint32(len(m.types)) {
+					s.fail("invalid type index")
+				}
+				code := decodeWasmCode(s.bytes(s.u32()), m)
+				code.typ = funcTypes[i]
+				m.codes = append(m.codes, code)
+			}
+		case 11: // data
+			for n := s.u32(); n > 0; n-- {
+				var d wasmData
+				switch flags := s.u32(); flags {
+				case 0:
+					d.active, d.offset = true, s.constExpr()
+				case 1:
+				case 2:
+					s.u32()
+					d.active, d.offset = true, s.constExpr()
+				default:
+					s.fail("invalid data segment")
+				}
+				d.data = s.bytes(s.u32())
+				m.datas = append(m.datas, d)
+			}
+		case 12: // data count
+		default:
+			r.fail("unknown section %d", id)
+		}
+	}
+	if len(m.codes) != len(funcTypes) {
+		return nil, errors.New("missing code section")
+	}
+	for _, imp := range m.imports {
+		if imp.typ >= uint32(len(m.types)) {
+			return nil, errors.New("invalid import type index")
+		}
+	}
+	return m, nil
+}
+
+// elem reads an element segment in any of its eight encodings
+func (r *wasmReader) elem() wasmElem {
+	var e wasmElem
+	flags := r.u32()
+	if flags > 7 {
+		r.fail("invalid element segment")
+	}
+	if flags&1 == 0 {
+		e.active = true
+		if flags&2 != 0 && r.u32() != 0 {
+			r.fail("only table 0 is supported")
+		}
+		e.offset = r.constExpr()
+	}
+	if flags&3 != 0 {
+		r.byte() // element kind or reference type
+	}
+	for n := r.u32(); n > 0; n-- {
+		if flags&4 == 0 {
+			e.funcs = append(e.funcs, int64(r.u32()))
+			continue
+		}
+		c := r.constExpr()
+		if c.value == math.MaxUint64 {
+			e.funcs = append(e.funcs, -1)
+		} else {
+			e.funcs = append(e.funcs, int64(c.value))
+		}
+	}
+	return e
+}
+
+// blockType reads the signature of a block as its parameter and result
+// counts
+func (r *wasmReader) blockType(m *wasmModule) (uint16, uint16) {
+	switch r.byte() {
+	case 0x40:
+		return 0, 0
+	case 0x7F, 0x7E, 0x7D, 0x7C, 0x70, 0x6F:
+		return 0, 1
+	}
+	r.pos--
+	i := r.sleb(33)
+	if i < 0 || i >= int64(len(m.types)) {
+		r.fail("invalid block type")
+	}
+	t := m.types[i]
+	return uint16(len(t.params)), uint16(len(t.results))
+}
+
+// decodeWasmCode decodes a function body, matching each block with its
+// end
+func decodeWasmCode(b []byte, m *wasmModule) wasmCode {
+	r := &wasmReader{b: b}
+	var code wasmCode
+	for n := r.u32(); n > 0; n-- {
+		count := r.u32()
+		r.byte()
+		code.locals += int(count)
+		if code.locals > 50000 {
+			r.fail("too many locals")
+		}
+	}
+	var open []int // blocks without their end yet
+	for {
+		op := uint16(r.byte())
+		in := wasmInstr{op: op}
+		switch {
+		case op == 0x02, op == 0x03, op == 0x04: // block, loop, if
+			in.params, in.results = r.blockType(m)
+			open = append(open, len(code.body))
+		case op == 0x05: // else
+			if len(open) == 0 || code.body[open[len(open)-1]].op != 0x04 {
+				r.fail("else outside of an if")
+			}
+			code.body[open[len(open)-1]].y = uint32(len(code.body))
+		case op == 0x0B: // end
+			if len(open) == 0 {
+				// The end of the function returns
+				code.body = append(code.body, wasmInstr{op: 0x0F})
+				if r.pos != len(r.b) {
+					r.fail("code after the end of the function")
+				}
+				return code
+			}
+			start := open[len(open)-1]
+			open = open[:len(open)-1]
+			code.body[start].x = uint32(len(code.body))
+			if e := code.body[start].y; e != 0 {
+				code.body[e].x = uint32(len(code.body))
+			}
+		case op == 0x0C, op == 0x0D: // br, br_if
+			in.x = r.u32()
+		case op == 0x0E: // br_table
+			n := r.u32()
+			if n > 1<<16 {
+				r.fail("br_table too large")
+			}
+			table := make([]uint32, n+1)
+			for i := range table {
+				table[i] = r.u32()
+			}
+			in.x = uint32(len(code.tables))
+			code.tables = append(code.tables, table)
+		case op == 0x10: // call
+			in.x = r.u32()
+		case op == 0x11: // call_indirect
+			in.x = r.u32()
+			if r.u32() != 0 || in.x >= uint32(len(m.types)) {
+				r.fail("invalid call_indirect")
+			}
+		case op == 0x1C: // typed select
+			r.bytes(r.u32())
+			in.op = 0x1B
+		case op >= 0x20 && op <= 0x24: // local and global access
+			in.x = r.u32()
+		case op >= 0x28 && op <= 0x3E: // loads and stores
+			r.u32()
+			in.v = uint64(r.u32())
+		case op == 0x3F, op == 0x40: // memory.size, memory.grow
+			r.byte()
+		case op == 0x41:
+			in.v = uint64(uint32(r.sleb(32)))
+		case op == 0x42:
+			in.v = uint64(r.sleb(64))
+		case op == 0x43:
+			in.v = uint64(binary.LittleEndian.Uint32(r.bytes(4)))
+		case op == 0x44:
+			in.v = binary.LittleEndian.Uint64(r.bytes(8))
+		case op == 0x00, op == 0x01, op == 0x0F, op == 0x1A, op == 0x1B, op >= 0x45 && op <= 0xC4:
+		case op == 0xFC:
+			sub := r.u32()
+			in.op = 0xFC00 | uint16(sub)
+			switch sub {
+			case 0, 1, 2, 3, 4, 5, 6, 7: // saturating truncations
+			case 8: // memory.init
+				in.x = r.u32()
+				r.byte()
+			case 9: // data.drop
+				in.x = r.u32()
+			case 10: // memory.copy
+				r.byte()
+				r.byte()
+			case 11: // memory.fill
+				r.byte()
+			default:
+				r.fail("unsupported instruction 0xfc %d", sub)
+			}
+		default:
+			r.fail("unsupported instruction 0x%02x", op)
+		}
+		code.body = append(code.body, in)
+	}
+}
+
+// wasmHostFunc implements an imported function, returning its result when
+// its type has one
+type wasmHostFunc func(in *wasmInstance, args []uint64) (uint64, error)
+
+// wasmLabel is the target of branches out of a block
+type wasmLabel struct {
+	height int // operand stack height at the start of the block
+	arity  int // values carried by a branch
+	cont   int // where a branch continues
+	loop   bool
+}
+
+// wasmFrame is a function call in progress
+type wasmFrame struct {
+	code    *wasmCode
+	pc      int
+	locals  int // stack index of the first parameter
+	labels  int
+	results int
+}
+
+// wasmInstance is a module instantiated with its own memory
+type wasmInstance struct {
+	module   *wasmModule
+	host     []wasmHostFunc
+	mem      []byte
+	memMax   uint32
+	globals  []uint64
+	table    []int64
+	dropped  []bool
+	stack    []uint64
+	fuel     int64
+	maxFuel  int64
+	depth    int
+	trapped  bool
+	userData any
+}
+
+// instantiate creates an instance with the host functions named
+// module.name, limiting its memory to maxMemory bytes and each call from
+// the host to fuel instructions
+func (m *wasmModule) instantiate(host map[string]wasmHostFunc, maxMemory, fuel int64, userData any) (*wasmInstance, error) {
+	in := &wasmInstance{module: m, maxFuel: fuel, userData: userData, dropped: make([]bool, len(m.datas))}
+	for _, imp := range m.imports {
+		fn, ok := host[imp.module+"."+imp.name]
+		if !ok {
+			fn = func(*wasmInstance, []uint64) (uint64, error) {
+				return 0, fmt.Errorf("unimplemented import %s.%s", imp.module, imp.name)
+			}
+		}
+		in.host = append(in.host, fn)
+	}
+	if m.hasMem {
+		in.memMax = min(m.memMax, uint32(maxMemory/wasmPageSize))
+		if m.memMin > in.memMax {
+			return nil, fmt.Errorf("the module needs %d bytes of memory, more than the limit", int64(m.memMin)*wasmPageSize)
+		}
+		in.mem = make([]byte, int(m.memMin)*wasmPageSize)
+	}
+	for _, g := range m.globals {
+		if g.init.global >= 0 {
+			return nil, errors.New("globals initialized from imported globals are not supported")
+		}
+		in.globals = append(in.globals, g.init.value)
+	}
+	if m.tableMin > 1<<20 {
+		return nil, errors.New("table too large")
+	}
+	in.table = make([]int64, m.tableMin)
+	for i := range in.table {
+		in.table[i] = -1
+	}
+	for _, e := range m.elems {
+		if !e.active {
+			continue
+		}
+		off := int(uint32(e.offset.value))
+		if off+len(e.funcs) > len(in.table) {
+			return nil, errors.New("element segment out of the table")
+		}
+		copy(in.table[off:], e.funcs)
+	}
+	for i, d := range m.datas {
+		if !d.active {
+			continue
+		}
+		off := uint64(uint32(d.offset.value))
+		if off+uint64(len(d.data)) > uint64(len(in.mem)) {
+			return nil, errors.New("data segment out of memory")
+		}
+		copy(in.mem[off:], d.data)
+		in.dropped[i] = true
+	}
+	if m.start >= 0 {
+		if _, err := in.call(uint32(m.start)); err != nil {
+			return nil, err
+		}
+	}
+	return in, nil
+}
+
+// export returns the index of an exported function
+func (in *wasmInstance) export(name string) (uint32, bool) {
+	i, ok := in.module.exports[name]
+	return i, ok
+}
+
+// funcType returns the signature of function f, or nil for an invalid index
+func (in *wasmInstance) funcType(f uint32) *wasmFuncType {
+	m := in.module
+	switch {
+	case f < uint32(len(m.imports)):
+		return &m.types[m.imports[f].typ]
+	case f-uint32(len(m.imports)) < uint32(len(m.codes)):
+		return &m.types[m.codes[f-uint32(len(m.imports))].typ]
+	}
+	return nil
+}
+
+// call runs function f with args, returning its results. Called from a
+// host function, it runs on the fuel left of the outer call.
+func (in *wasmInstance) call(f uint32, args ...uint64) (results []uint64, err error) {
+	if in.trapped {
+		return nil, errors.New("wasm: the instance trapped earlier")
+	}
+	t := in.funcType(f)
+	if t == nil || len(args) != len(t.params) {
+		return nil, fmt.Errorf("wasm: invalid call of function %d", f)
+	}
+	if in.depth == 0 {
+		in.fuel = in.maxFuel
+	} else if in.depth > 8 {
+		return nil, errors.New("wasm: too many nested calls from the host")
+	}
+	base := len(in.stack)
+	in.depth++
+	defer func() {
+		in.depth--
+		if r := recover(); r != nil {
+			in.trapped = true
+			if t, ok := r.(wasmTrap); ok {
+				err = t
+			} else {
+				err = wasmTrap{fmt.Sprint(r)}
+			}
+		}
+	}()
+	in.stack = append(in.stack, args...)
+	if f < uint32(len(in.module.imports)) {
+		in.stack = in.callHost(in.stack, f)
+	} else {
+		in.execute(f)
+	}
+	results = slices.Clone(in.stack[len(in.stack)-len(t.results):])
+	in.stack = in.stack[:base]
+	return results, nil
+}
+
+// callHost calls the imported function f with its arguments on top of st
+func (in *wasmInstance) callHost(st []uint64, f uint32) []uint64 {
+	t := in.module.types[in.module.imports[f].typ]
+	args := slices.Clone(st[len(st)-len(t.params):])
+	in.stack = st[:len(st)-len(t.params)]
+	r, err := in.host[f](in, args)
+	if err != nil {
+		panic(wasmTrap{err.Error()})
+	}
+	st = in.stack
+	if len(t.results) > 0 {
+		st = append(st, r)
+	}
+	return st
+}
+
+// addr returns the memory index of an access of size bytes at base plus
+// offset, trapping when it is out of bounds
+func (in *wasmInstance) addr(base, offset, size uint64) uint64 {
+	ea := uint64(uint32(base)) + offset
+	if ea+size > uint64(len(in.mem)) {
+		panic(wasmTrap{"out of bounds memory access"})
+	}
+	return ea
+}
+
+// branch unwinds the operand and label stacks to the label depth d above
+// the top, carrying its values, and returns where execution continues
+func wasmBranch(st []uint64, labels []wasmLabel, d uint32) ([]uint64, []wasmLabel, int) {
+	i := len(labels) - 1 - int(d)
+	l := labels[i]
+	copy(st[l.height:], st[len(st)-l.arity:])
+	st = st[:l.height+l.arity]
+	if l.loop {
+		return st, labels[:i+1], l.cont
+	}
+	return st, labels[:i], l.cont
+}
+
+// b2i converts a comparison result to an i32
+func b2i(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// execute runs the defined function f, its arguments being on top of the
+// stack, leaving its results there
+func (in *wasmInstance) execute(f uint32) {
+	m := in.module
+	nimports := uint32(len(m.imports))
+	st := in.stack
+	var frames []wasmFrame
+	var labels []wasmLabel
+	var body []wasmInstr
+	var pc, locals int
+	callee := int64(f)
+	for {
+		if callee >= 0 {
+			f := uint32(callee)
+			callee = -1
+			if f < nimports {
+				st = in.callHost(st, f)
+				continue
+			}
+			if f-nimports >= uint32(len(m.codes)) {
+				panic(wasmTrap{"call of an invalid function"})
+			}
+			code := &m.codes[f-nimports]
+			t := &m.types[code.typ]
+			if len(frames) >= wasmMaxDepth || len(st) > wasmMaxStack {
+				panic(wasmTrap{"call stack exhausted"})
+			}
+			if len(frames) > 0 {
+				frames[len(frames)-1].pc = pc
+			}
+			locals = len(st) - len(t.params)
+			for range code.locals {
+				st = append(st, 0)
+			}
+			frames = append(frames, wasmFrame{code: code, locals: locals, labels: len(labels), results: len(t.results)})
+			labels = append(labels, wasmLabel{height: len(st), arity: len(t.results), cont: len(code.body) - 1})
+			body, pc = code.body, 0
+		}
+		in.fuel--
+		if in.fuel < 0 {
+			panic(wasmTrap{"instruction budget exhausted"})
+		}
+		ins := &body[pc]
+		pc++
+		switch ins.op {
+		case 0x00:
+			panic(wasmTrap{"unreachable executed"})
+		case 0x01: // nop
+		case 0x02: // block
+			labels = append(labels, wasmLabel{height: len(st) - int(ins.params), arity: int(ins.results), cont: int(ins.x) + 1})
+		case 0x03: // loop
+			labels = append(labels, wasmLabel{height: len(st) - int(ins.params), arity: int(ins.params), cont: pc, loop: true})
+		case 0x04: // if
+			cond := uint32(st[len(st)-1])
+			st = st[:len(st)-1]
+			switch {
+			case cond != 0:
+				labels = append(labels, wasmLabel{height: len(st) - int(ins.params), arity: int(ins.results), cont: int(ins.x) + 1})
+			case ins.y != 0:
+				labels = append(labels, wasmLabel{height: len(st) - int(ins.params), arity: int(ins.results), cont: int(ins.x) + 1})
+				pc = int(ins.y) + 1
+			default:
+				pc = int(ins.x) + 1
+			}
+		case 0x05: // else, reached at the end of the then branch
+			labels = labels[:len(labels)-1]
+			pc = int(ins.x) + 1
+		case 0x0B: // end
+			labels = labels[:len(labels)-1]
+		case 0x0C: // br
+			st, labels, pc = wasmBranch(st, labels, ins.x)
+		case 0x0D: // br_if
+			cond := uint32(st[len(st)-1])
+			st = st[:len(st)-1]
+			if cond != 0 {
+				st, labels, pc = wasmBranch(st, labels, ins.x)
+			}
+		case 0x0E: // br_table
+			i := uint32(st[len(st)-1])
+			st = st[:len(st)-1]
+			table := frames[len(frames)-1].code.tables[ins.x]
+			st, labels, pc = wasmBranch(st, labels, table[min(int(i), len(table)-1)])
+		case 0x0F: // return
+			fr := frames[len(frames)-1]
+			copy(st[fr.locals:], st[len(st)-fr.results:])
+			st = st[:fr.locals+fr.results]
+			labels = labels[:fr.labels]
+			frames = frames[:len(frames)-1]
+			if len(frames) == 0 {
+				in.stack = st
+				return
+			}
+			caller := &frames[len(frames)-1]
+			body, pc, locals = caller.code.body, caller.pc, caller.locals
+		case 0x10: // call
+			callee = int64(ins.x)
+		case 0x11: // call_indirect
+			i := uint32(st[len(st)-1])
+			st = st[:len(st)-1]
+			if i >= uint32(len(in.table)) || in.table[i] < 0 {
+				panic(wasmTrap{"undefined table element"})
+			}
+			want, got := &m.types[ins.x], in.funcType(uint32(in.table[i]))
+			if got == nil || !slices.Equal(want.params, got.params) || !slices.Equal(want.results, got.results) {
+				panic(wasmTrap{"indirect call type mismatch"})
+			}
+			callee = in.table[i]
+		case 0x1A: // drop
+			st = st[:len(st)-1]
+		case 0x1B: // select
+			cond := uint32(st[len(st)-1])
+			if cond == 0 {
+				st[len(st)-3] = st[len(st)-2]
+			}
+			st = st[:len(st)-2]
+		case 0x20: // local.get
+			st = append(st, st[locals+int(ins.x)])
+		case 0x21: // local.set
+			st[locals+int(ins.x)] = st[len(st)-1]
+			st = st[:len(st)-1]
+		case 0x22: // local.tee
+			st[locals+int(ins.x)] = st[len(st)-1]
+		case 0x23: // global.get
+			st = append(st, in.globals[ins.x])
+		case 0x24: // global.set
+			in.globals[ins.x] = st[len(st)-1]
+			st = st[:len(st)-1]
+
+		// Loads
+		case 0x28, 0x2A: // i32.load, f32.load
+			a := in.addr(st[len(st)-1], ins.v, 4)
+			st[len(st)-1] = uint64(binary.LittleEndian.Uint32(in.mem[a:]))
+		case 0x29, 0x2B: // i64.load, f64.load
+			a := in.addr(st[len(st)-1], ins.v, 8)
+			st[len(st)-1] = binary.LittleEndian.Uint64(in.mem[a:])
+		case 0x2C: // i32.load8_s
+			a := in.addr(st[len(st)-1], ins.v, 1)
+			st[len(st)-1] = uint64(uint32(int32(int8(in.mem[a]))))
+		case 0x2D: // i32.load8_u
+			a := in.addr(st[len(st)-1], ins.v, 1)
+			st[len(st)-1] = uint64(in.mem[a])
+		case 0x2E: // i32.load16_s
+			a := in.addr(st[len(st)-1], ins.v, 2)
+			st[len(st)-1] = uint64(uint32(int32(int16(binary.LittleEndian.Uint16(in.mem[a:])))))
+		case 0x2F: // i32.load16_u
+			a := in.addr(st[len(st)-1], ins.v, 2)
+			st[len(st)-1] = uint64(binary.LittleEndian.Uint16(in.mem[a:]))
+		case 0x30: // i64.load8_s
+			a := in.addr(st[len(st)-1], ins.v, 1)
+			st[len(st)-1] = uint64(int64(int8(in.mem[a])))
+		case 0x31: // i64.load8_u
+			a := in.addr(st[len(st)-1], ins.v, 1)
+			st[len(st)-1] = uint64(in.mem[a])
+		case 0x32: // i64.load16_s
+			a := in.addr(st[len(st)-1], ins.v, 2)
+			st[len(st)-1] = uint64(int64(int16(binary.LittleEndian.Uint16(in.mem[a:]))))
+		case 0x33: // i64.load16_u
+			a := in.addr(st[len(st)-1], ins.v, 2)
+			st[len(st)-1] = uint64(binary.LittleEndian.Uint16(in.mem[a:]))
+		case 0x34: // i64.load32_s
+			a := in.addr(st[len(st)-1], ins.v, 4)
+			st[len(st)-1] = uint64(int64(int32(binary.LittleEndian.Uint32(in.mem[a:]))))
+		case 0x35: // i64.load32_u
+			a := in.addr(st[len(st)-1], ins.v, 4)
+			st[len(st)-1] = uint64(binary.LittleEndian.Uint32(in.mem[a:]))
+
+		// Stores
+		case 0x36, 0x38, 0x3E: // i32.store, f32.store, i64.store32
+			a := in.addr(st[len(st)-2], ins.v, 4)
+			binary.LittleEndian.PutUint32(in.mem[a:], uint32(st[len(st)-1]))
+			st = st[:len(st)-2]
+		case 0x37, 0x39: // i64.store, f64.store
+			a := in.addr(st[len(st)-2], ins.v, 8)
+			binary.LittleEndian.PutUint64(in.mem[a:], st[len(st)-1])
+			st = st[:len(st)-2]
+		case 0x3A, 0x3C: // i32.store8, i64.store8
+			a := in.addr(st[len(st)-2], ins.v, 1)
+			in.mem[a] = byte(st[len(st)-1])
+			st = st[:len(st)-2]
+		case 0x3B, 0x3D: // i32.store16, i64.store16
+			a := in.addr(st[len(st)-2], ins.v, 2)
+			binary.LittleEndian.PutUint16(in.mem[a:], uint16(st[len(st)-1]))
+			st = st[:len(st)-2]
+
+		case 0x3F: // memory.size
+			st = append(st, uint64(len(in.mem)/wasmPageSize))
+		case 0x40: // memory.grow
+			pages := uint64(len(in.mem) / wasmPageSize)
+			delta := uint64(uint32(st[len(st)-1]))
+			if pages+delta > uint64(in.memMax) {
+				st[len(st)-1] = math.MaxUint32
+			} else {
+				in.mem = append(in.mem, make([]byte, delta*wasmPageSize)...)
+				st[len(st)-1] = pages
+			}
+
+		case 0x41, 0x42, 0x43, 0x44: // constants
+			st = append(st, ins.v)
+
+		case 0x45: // i32.eqz
+			st[len(st)-1] = b2i(uint32(st[len(st)-1]) == 0)
+		case 0x50: // i64.eqz
+			st[len(st)-1] = b2i(st[len(st)-1] == 0)
+		case 0x46, 0x47, 0x48, 0x49, 0x4A, 0x4B, 0x4C, 0x4D, 0x4E, 0x4F:
+			a, b := uint32(st[len(st)-2]), uint32(st[len(st)-1])
+			st = st[:len(st)-1]
+			st[len(st)-1] = b2i(wasmCompare(ins.op-0x46, uint64(a), uint64(b), int64(int32(a)), int64(int32(b))))
+		case 0x51, 0x52, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5A:
+			a, b := st[len(st)-2], st[len(st)-1]
+			st = st[:len(st)-1]
+			st[len(st)-1] = b2i(wasmCompare(ins.op-0x51, a, b, int64(a), int64(b)))
+		case 0x5B, 0x5C, 0x5D, 0x5E, 0x5F, 0x60:
+			a, b := math.Float32frombits(uint32(st[len(st)-2])), math.Float32frombits(uint32(st[len(st)-1]))
+			st = st[:len(st)-1]
+			st[len(st)-1] = b2i(wasmCompareFloat(ins.op-0x5B, float64(a), float64(b)))
+		case 0x61, 0x62, 0x63, 0x64, 0x65, 0x66:
+			a, b := math.Float64frombits(st[len(st)-2]), math.Float64frombits(st[len(st)-1])
+			st = st[:len(st)-1]
+			st[len(st)-1] = b2i(wasmCompareFloat(ins.op-0x61, a, b))
+
+		case 0x67: // i32.clz
+			st[len(st)-1] = uint64(bits.LeadingZeros32(uint32(st[len(st)-1])))
+		case 0x68: // i32.ctz
+			st[len(st)-1] = uint64(bits.TrailingZeros32(uint32(st[len(st)-1])))
+		case 0x69: // i32.popcnt
+			st[len(st)-1] = uint64(bits.OnesCount32(uint32(st[len(st)-1])))
+		case 0x6A, 0x6B, 0x6C, 0x6D, 0x6E, 0x6F, 0x70, 0x71, 0x72, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78:
+			a, b := uint32(st[len(st)-2]), uint32(st[len(st)-1])
+			st = st[:len(st)-1]
+			st[len(st)-1] = uint64(wasmI32(ins.op, a, b))
+		case 0x79: // i64.clz
+			st[len(st)-1] = uint64(bits.LeadingZeros64(st[len(st)-1]))
+		case 0x7A: // i64.ctz
+			st[len(st)-1] = uint64(bits.TrailingZeros64(st[len(st)-1]))
+		case 0x7B: // i64.popcnt
+			st[len(st)-1] = uint64(bits.OnesCount64(st[len(st)-1]))
+		case 0x7C, 0x7D, 0x7E, 0x7F, 0x80, 0x81, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89, 0x8A:
+			a, b := st[len(st)-2], st[len(st)-1]
+			st = st[:len(st)-1]
+			st[len(st)-1] = wasmI64(ins.op, a, b)
+
+		case 0x8B, 0x8C, 0x8D, 0x8E, 0x8F, 0x90, 0x91: // f32 unary
+			x := math.Float32frombits(uint32(st[len(st)-1]))
+			st[len(st)-1] = uint64(math.Float32bits(wasmF32Unary(ins.op, x)))
+		case 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98: // f32 binary
+			a, b := math.Float32frombits(uint32(st[len(st)-2])), math.Float32frombits(uint32(st[len(st)-1]))
+			st = st[:len(st)-1]
+			st[len(st)-1] = uint64(math.Float32bits(wasmF32Binary(ins.op, a, b)))
+		case 0x99, 0x9A, 0x9B, 0x9C, 0x9D, 0x9E, 0x9F: // f64 unary
+			x := math.Float64frombits(st[len(st)-1])
+			st[len(st)-1] = math.Float64bits(wasmF64Unary(ins.op, x))
+		case 0xA0, 0xA1, 0xA2, 0xA3, 0xA4, 0xA5, 0xA6: // f64 binary
+			a, b := math.Float64frombits(st[len(st)-2]), math.Float64frombits(st[len(st)-1])
+			st = st[:len(st)-1]
+			st[len(st)-1] = math.Float64bits(wasmF64Binary(ins.op, a, b))
+
+		case 0xFC0A: // memory.copy
+			dst, src, n := st[len(st)-3], st[len(st)-2], uint64(uint32(st[len(st)-1]))
+			st = st[:len(st)-3]
+			d, s := in.addr(dst, 0, n), in.addr(src, 0, n)
+			copy(in.mem[d:d+n], in.mem[s:s+n])
+		case 0xFC0B: // memory.fill
+			dst, v, n := st[len(st)-3], byte(st[len(st)-2]), uint64(uint32(st[len(st)-1]))
+			st = st[:len(st)-3]
+			d := in.addr(dst, 0, n)
+			clear(in.mem[d : d+n])
+			if v != 0 {
+				for i := range in.mem[d : d+n] {
+					in.mem[d+uint64(i)] = v
+				}
+			}
+		case 0xFC08: // memory.init
+			dst, src, n := st[len(st)-3], uint64(uint32(st[len(st)-2])), uint64(uint32(st[len(st)-1]))
+			st = st[:len(st)-3]
+			var data []byte
+			if !in.dropped[ins.x] {
+				data = m.datas[ins.x].data
+			}
+			if src+n > uint64(len(data)) {
+				panic(wasmTrap{"out of bounds memory.init"})
+			}
+			d := in.addr(dst, 0, n)
+			copy(in.mem[d:], data[src:src+n])
+		case 0xFC09: // data.drop
+			in.dropped[ins.x] = true
+
+		default:
+			// Conversions
+			st[len(st)-1] = wasmConvert(ins.op, st[len(st)-1])
+		}
+	}
+}
+
+// wasmCompare evaluates the integer comparison i of eq, ne, lt_s, lt_u,
+// gt_s, gt_u, le_s, le_u, ge_s and ge_u
+func wasmCompare(i uint16, a, b uint64, sa, sb int64) bool {
+	switch i {
+	case 0:
+		return a == b
+	case 1:
+		return a != b
+	case 2:
+		return sa < sb
+	case 3:
+		return a < b
+	case 4:
+		return sa > sb
+	case 5:
+		return a > b
+	case 6:
+		return sa <= sb
+	case 7:
+		return a <= b
+	case 8:
+		return sa >= sb
+	}
+	return a >= b
+}
+
+// wasmCompareFloat evaluates the comparison i of eq, ne, lt, gt, le and ge
+func wasmCompareFloat(i uint16, a, b float64) bool {
+	switch i {
+	case 0:
+		return a == b
+	case 1:
+		return a != b
+	case 2:
+		return a < b
+	case 3:
+		return a > b
+	case 4:
+		return a <= b
+	}
+	return a >= b
+}
+
+// wasmI32 evaluates an i32 binary operator
+func wasmI32(op uint16, a, b uint32) uint32 {
+	switch op {
+	case 0x6A:
+		return a + b
+	case 0x6B:
+		return a - b
+	case 0x6C:
+		return a * b
+	case 0x6D, 0x6F: // div_s, rem_s
+		if b == 0 {
+			panic(wasmTrap{"integer divide by zero"})
+		}
+		if int32(a) == math.MinInt32 && int32(b) == -1 {
+			if op == 0x6D {
+				panic(wasmTrap{"integer overflow"})
+			}
+			return 0
+		}
+		if op == 0x6D {
+			return uint32(int32(a) / int32(b))
+		}
+		return uint32(int32(a) % int32(b))
+	case 0x6E, 0x70: // div_u, rem_u
+		if b == 0 {
+			panic(wasmTrap{"integer divide by zero"})
+		}
+		if op == 0x6E {
+			return a / b
+		}
+		return a % b
+	case 0x71:
+		return a & b
+	case 0x72:
+		return a | b
+	case 0x73:
+		return a ^ b
+	case 0x74:
+		return a << (b & 31)
+	case 0x75:
+		return uint32(int32(a) >> (b & 31))
+	case 0x76:
+		return a >> (b & 31)
+	case 0x77:
+		return bits.RotateLeft32(a, int(b&31))
+	}
+	return bits.RotateLeft32(a, -int(b&31))
+}
+
+// wasmI64 evaluates an i64 binary operator
+func wasmI64(op uint16, a, b uint64) uint64 {
+	switch op {
+	case 0x7C:
+		return a + b
+	case 0x7D:
+		return a - b
+	case 0x7E:
+		return a * b
+	case 0x7F, 0x81: // div_s, rem_s
+		if b == 0 {
+			panic(wasmTrap{"integer divide by zero"})
+		}
+		if int64(a) == math.MinInt64 && int64(b) == -1 {
+			if op == 0x7F {
+				panic(wasmTrap{"integer overflow"})
+			}
+			return 0
+		}
+		if op == 0x7F {
+			return uint64(int64(a) / int64(b))
+		}
+		return uint64(int64(a) % int64(b))
+	case 0x80, 0x82: // div_u, rem_u
+		if b == 0 {
+			panic(wasmTrap{"integer divide by zero"})
+		}
+		if op == 0x80 {
+			return a / b
+		}
+		return a % b
+	case 0x83:
+		return a & b
+	case 0x84:
+		return a | b
+	case 0x85:
+		return a ^ b
+	case 0x86:
+		return a << (b & 63)
+	case 0x87:
+		return uint64(int64(a) >> (b & 63))
+	case 0x88:
+		return a >> (b & 63)
+	case 0x89:
+		return bits.RotateLeft64(a, int(b&63))
+	}
+	return bits.RotateLeft64(a, -int(b&63))
+}
+
+// wasmF32Unary evaluates abs, neg, ceil, floor, trunc, nearest and sqrt
+func wasmF32Unary(op uint16, x float32) float32 {
+	switch op {
+	case 0x8B:
+		return math.Float32frombits(math.Float32bits(x) &^ (1 << 31))
+	case 0x8C:
+		return math.Float32frombits(math.Float32bits(x) ^ (1 << 31))
+	}
+	return float32(wasmF64Unary(op+0x99-0x8B, float64(x)))
+}
+
+// wasmF64Unary evaluates abs, neg, ceil, floor, trunc, nearest and sqrt
+func wasmF64Unary(op uint16, x float64) float64 {
+	switch op {
+	case 0x99:
+		return math.Float64frombits(math.Float64bits(x) &^ (1 << 63))
+	case 0x9A:
+		return math.Float64frombits(math.Float64bits(x) ^ (1 << 63))
+	case 0x9B:
+		return math.Ceil(x)
+	case 0x9C:
+		return math.Floor(x)
+	case 0x9D:
+		return math.Trunc(x)
+	case 0x9E:
+		return math.RoundToEven(x)
+	}
+	return math.Sqrt(x)
+}
+
+// wasmF32Binary evaluates add, sub, mul, div, min, max and copysign
+func wasmF32Binary(op uint16, a, b float32) float32 {
+	switch op {
+	case 0x92:
+		return a + b
+	case 0x93:
+		return a - b
+	case 0x94:
+		return a * b
+	case 0x95:
+		return a / b
+	case 0x96:
+		return min(a, b)
+	case 0x97:
+		return max(a, b)
+	}
+	return math.Float32frombits(math.Float32bits(a)&^(1<<31) | math.Float32bits(b)&(1<<31))
+}
+
+// wasmF64Binary evaluates add, sub, mul, div, min, max and copysign
+func wasmF64Binary(op uint16, a, b float64) float64 {
+	switch op {
+	case 0xA0:
+		return a + b
+	case 0xA1:
+		return a - b
+	case 0xA2:
+		return a * b
+	case 0xA3:
+		return a / b
+	case 0xA4:
+		return min(a, b)
+	case 0xA5:
+		return max(a, b)
+	}
+	return math.Copysign(a, b)
+}
+
+// wasmTrunc truncates x to an integer of the given size and signedness,
+// reporting whether it fits
+func wasmTrunc(x float64, size int, signed bool) (uint64, bool) {
+	t := math.Trunc(x)
+	if math.IsNaN(t) {
+		return 0, false
+	}
+	switch {
+	case signed && size == 32:
+		return uint64(uint32(int32(t))), t >= math.MinInt32 && t <= math.MaxInt32
+	case size == 32:
+		return uint64(uint32(t)), t >= 0 && t <= math.MaxUint32
+	case signed:
+		return uint64(int64(t)), t >= math.MinInt64 && t < 1<<63
+	}
+	return uint64(t), t >= 0 && t < 1<<64
+}
+
+// wasmTruncSat truncates x, saturating instead of trapping
+func wasmTruncSat(x float64, size int, signed bool) uint64 {
+	if v, ok := wasmTrunc(x, size, signed); ok {
+		return v
+	}
+	switch {
+	case math.IsNaN(x):
+		return 0
+	case signed && size == 32:
+		if x < 0 {
+			return 1 << 31
+		}
+		return math.MaxInt32
+	case size == 32:
+		if x < 0 {
+			return 0
+		}
+		return math.MaxUint32
+	case signed:
+		if x < 0 {
+			return 1 << 63
+		}
+		return math.MaxInt64
+	}
+	if x < 0 {
+		return 0
+	}
+	return math.MaxUint64
+}
+
+// wasmConvert evaluates a conversion or sign extension of v
+func wasmConvert(op uint16, v uint64) uint64 {
+	f32 := func() float64 { return float64(math.Float32frombits(uint32(v))) }
+	f64 := func() float64 { return math.Float64frombits(v) }
+	trunc := func(x float64, size int, signed bool) uint64 {
+		r, ok := wasmTrunc(x, size, signed)
+		if !ok {
+			if math.IsNaN(x) {
+				panic(wasmTrap{"invalid conversion to integer"})
+			}
+			panic(wasmTrap{"integer overflow"})
+		}
+		return r
+	}
+	switch op {
+	case 0xA7: // i32.wrap_i64
+		return uint64(uint32(v))
+	case 0xA8:
+		return trunc(f32(), 32, true)
+	case 0xA9:
+		return trunc(f32(), 32, false)
+	case 0xAA:
+		return trunc(f64(), 32, true)
+	case 0xAB:
+		return trunc(f64(), 32, false)
+	case 0xAC: // i64.extend_i32_s
+		return uint64(int64(int32(v)))
+	case 0xAD: // i64.extend_i32_u
+		return uint64(uint32(v))
+	case 0xAE:
+		return trunc(f32(), 64, true)
+	case 0xAF:
+		return trunc(f32(), 64, false)
+	case 0xB0:
+		return trunc(f64(), 64, true)
+	case 0xB1:
+		return trunc(f64(), 64, false)
+	case 0xB2:
+		return uint64(math.Float32bits(float32(int32(v))))
+	case 0xB3:
+		return uint64(math.Float32bits(float32(uint32(v))))
+	case 0xB4:
+		return uint64(math.Float32bits(float32(int64(v))))
+	case 0xB5:
+		return uint64(math.Float32bits(float32(v)))
+	case 0xB6: // f32.demote_f64
+		return uint64(math.Float32bits(float32(f64())))
+	case 0xB7:
+		return math.Float64bits(float64(int32(v)))
+	case 0xB8:
+		return math.Float64bits(float64(uint32(v)))
+	case 0xB9:
+		return math.Float64bits(float64(int64(v)))
+	case 0xBA:
+		return math.Float64bits(float64(v))
+	case 0xBB: // f64.promote_f32
+		return math.Float64bits(f32())
+	case 0xBC, 0xBD, 0xBE, 0xBF: // reinterpretations
+		return v
+	case 0xC0:
+		return uint64(uint32(int32(int8(v))))
+	case 0xC1:
+		return uint64(uint32(int32(int16(v))))
+	case 0xC2:
+		return uint64(int64(int8(v)))
+	case 0xC3:
+		return uint64(int64(int16(v)))
+	case 0xC4:
+		return uint64(int64(int32(v)))
+	case 0xFC00:
+		return wasmTruncSat(f32(), 32, true)
+	case 0xFC01:
+		return wasmTruncSat(f32(), 32, false)
+	case 0xFC02:
+		return wasmTruncSat(f64(), 32, true)
+	case 0xFC03:
+		return wasmTruncSat(f64(), 32, false)
+	case 0xFC04:
+		return wasmTruncSat(f32(), 64, true)
+	case 0xFC05:
+		return wasmTruncSat(f32(), 64, false)
+	case 0xFC06:
+		return wasmTruncSat(f64(), 64, true)
+	case 0xFC07:
+		return wasmTruncSat(f64(), 64, false)
+	}
+	panic(wasmTrap{fmt.Sprintf("invalid instruction 0x%x", op)})
+}
+
+// read returns a copy of size bytes of memory at ptr
+func (in *wasmInstance) read(ptr, size uint32) ([]byte, bool) {
+	if uint64(ptr)+uint64(size) > uint64(len(in.mem)) {
+		return nil, false
+	}
+	return slices.Clone(in.mem[ptr : ptr+size]), true
+}
+
+// write copies b into memory at ptr
+func (in *wasmInstance) write(ptr uint32, b []byte) bool {
+	if uint64(ptr)+uint64(len(b)) > uint64(len(in.mem)) {
+		return false
+	}
+	copy(in.mem[ptr:], b)
+	return true
+}
+
+// putUint32 stores v in memory at ptr
+func (in *wasmInstance) putUint32(ptr, v uint32) bool {
+	return in.write(ptr, binary.LittleEndian.AppendUint32(nil, v))
+}
@@ -0,0 +1,171 @@
+package httpserve
+
+import (
+	"strings"
+	"testing"
+)
+
+// testWasm assembles a module from its sections, each given as its id
+// followed by its contents; the length prefixes are added here
+func testWasm(sections ...[]byte) []byte {
+	b := []byte("\x00asm\x01\x00\x00\x00")
+	for _, s := range sections {
+		b = append(b, s[0], byte(len(s)-1))
+		b = append(b, s[1:]...)
+	}
+	return b
+}
+
+// testWasmCode is a code section holding a single function body
+func testWasmCode(body ...byte) []byte {
+	return append([]byte{10, 1, byte(len(body) + 1), 0}, body...)
+}
+
+var (
+	// (i32, i32) -> i32, () -> i32 and (i32) -> i32
+	testWasmTypes = []byte{1, 3, 0x60, 2, 0x7f, 0x7f, 1, 0x7f, 0x60, 0, 1, 0x7f, 0x60, 1, 0x7f, 1, 0x7f}
+	// exports function 0 as "f"
+	testWasmExport = []byte{7, 1, 1, 'f', 0, 0}
+)
+
+func TestWasmCall(t *testing.T) {
+	tests := []struct {
+		name    string
+		module  []byte
+		args    []uint64
+		want    uint64
+		wantErr string
+	}{
+		{
+			name:   "add",
+			module: testWasm(testWasmTypes, []byte{3, 1, 0}, testWasmExport, testWasmCode(0x20, 0, 0x20, 1, 0x6a, 0x0b)),
+			args:   []uint64{40, 2},
+			want:   42,
+		},
+		{
+			name: "host import",
+			// imports env.double as function 0 and exports function 1
+			module: testWasm(testWasmTypes,
+				[]byte{2, 1, 3, 'e', 'n', 'v', 6, 'd', 'o', 'u', 'b', 'l', 'e', 0, 2},
+				[]byte{3, 1, 0},
+				[]byte{7, 1, 1, 'f', 0, 1},
+				testWasmCode(0x20, 0, 0x20, 1, 0x6a, 0x10, 0, 0x0b)),
+			args: []uint64{3, 4},
+			want: 14,
+		},
+		{
+			name:   "memory",
+			module: testWasm(testWasmTypes, []byte{3, 1, 1}, []byte{5, 1, 0, 1}, testWasmExport, []byte{11, 1, 0, 0x41, 8, 0x0b, 1, 7}, testWasmCode(0x41, 8, 0x2d, 0, 0, 0x0b)),
+			want:   7,
+		},
+		{
+			name:    "out of bounds load",
+			module:  testWasm(testWasmTypes, []byte{3, 1, 1}, []byte{5, 1, 0, 1}, testWasmExport, testWasmCode(0x41, 0x80, 0x80, 0x04, 0x28, 2, 0, 0x0b)),
+			wantErr: "out of bounds memory access",
+		},
+		{
+			name:    "division by zero",
+			module:  testWasm(testWasmTypes, []byte{3, 1, 1}, testWasmExport, testWasmCode(0x41, 1, 0x41, 0, 0x6d, 0x0b)),
+			wantErr: "integer divide by zero",
+		},
+		{
+			name:    "unreachable",
+			module:  testWasm(testWasmTypes, []byte{3, 1, 1}, testWasmExport, testWasmCode(0x00, 0x0b)),
+			wantErr: "unreachable executed",
+		},
+		{
+			name:    "fuel",
+			module:  testWasm(testWasmTypes, []byte{3, 1, 1}, testWasmExport, testWasmCode(0x03, 0x40, 0x0c, 0, 0x0b, 0x41, 0, 0x0b)),
+			wantErr: "instruction budget exhausted",
+		},
+		{
+			name:    "unbounded recursion",
+			module:  testWasm(testWasmTypes, []byte{3, 1, 1}, testWasmExport, testWasmCode(0x10, 0, 0x0b)),
+			wantErr: "call stack exhausted",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := parseWasm(tt.module)
+			if err != nil {
+				t.Fatal(err)
+			}
+			host := map[string]wasmHostFunc{"env.double": func(in *wasmInstance, args []uint64) (uint64, error) {
+				return args[0] * 2, nil
+			}}
+			in, err := m.instantiate(host, 1<<20, 1e6, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, ok := in.export("f")
+			if !ok {
+				t.Fatal("f is not exported")
+			}
+			results, err := in.call(f, tt.args...)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				if _, err := in.call(f, tt.args...); err == nil {
+					t.Error("the instance ran again after a trap")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != 1 || uint32(results[0]) != uint32(tt.want) {
+				t.Errorf("got %v, want %d", results, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseWasmErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		module []byte
+		want   string
+	}{
+		{"empty", nil, "unexpected end"},
+		{"text format", []byte("(module)"), "not a WebAssembly"},
+		{"version 2", []byte("\x00asm\x02\x00\x00\x00"), "not a WebAssembly"},
+		{"unknown section", testWasm([]byte{13}), "unknown section"},
+		{"truncated section", testWasm(testWasmTypes)[:12], "unexpected end"},
+		{"bad function type", testWasm([]byte{1, 1, 0x61, 0, 0}), "invalid function type"},
+		{"missing code", testWasm(testWasmTypes, []byte{3, 1, 0}), "missing code section"},
+		{"body count", testWasm(testWasmTypes, []byte{3, 2, 0, 0}, testWasmCode(0x0b)), "1 function bodies for 2"},
+		{"type index", testWasm(testWasmTypes, []byte{3, 1, 9}, testWasmCode(0x0b)), "invalid type index"},
+		{"table import", testWasm(testWasmTypes, []byte{2, 1, 1, 'e', 1, 't', 1, 0x70, 0, 0}), "only functions can be imported"},
+		{"unsupported instruction", testWasm(testWasmTypes, []byte{3, 1, 1}, testWasmCode(0xfd, 0, 0x0b)), "unsupported instruction"},
+		{"unterminated body", testWasm(testWasmTypes, []byte{3, 1, 1}, testWasmCode(0x41, 0)), "unexpected end"},
+		{"huge integer", testWasm([]byte{1, 0xff, 0xff, 0xff, 0xff, 0x7f}), "integer too large"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseWasm(tt.module)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestWasmInstantiateLimits(t *testing.T) {
+	// Two pages of memory against a one page limit
+	m, err := parseWasm(testWasm([]byte{5, 1, 0, 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.instantiate(nil, wasmPageSize, 1000, nil); err == nil || !strings.Contains(err.Error(), "more than the limit") {
+		t.Errorf("got error %v for memory past the limit", err)
+	}
+	// A data segment past the end of memory
+	m, err = parseWasm(testWasm([]byte{5, 1, 0, 1}, []byte{11, 1, 0, 0x41, 0x80, 0x80, 0x04, 0x0b, 1, 7}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.instantiate(nil, 1<<20, 1000, nil); err == nil || !strings.Contains(err.Error(), "data segment") {
+		t.Errorf("got error %v for a data segment out of memory", err)
+	}
+}
@@ -0,0 +1,829 @@
+package httpserve
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WASM filters are proxy-wasm modules, as built with the Rust, Go or C++
+// proxy-wasm SDKs, given the headers of every request and response. A
+// filter may read and change them, or answer the request itself with
+// proxy_send_local_response. Bodies, HTTP calls, timers, metrics and shared
+// data are not available; their host functions return Unimplemented. The
+// modules run in the interpreter of wasm.go, each callback on the
+// --wasm-fuel budget and within --wasm-max-memory.
+
+// wasmMaxVMs bounds the instances of a filter, each one serving a single
+// request from its headers to its end
+const wasmMaxVMs = 256
+
+// wasmRootContext is the id of the root context of every instance
+const wasmRootContext = 1
+
+// proxy-wasm statuses, actions, header maps and buffers
+const (
+	wasmOK            = 0
+	wasmNotFound      = 1
+	wasmBadArgument   = 2
+	wasmInvalidMemory = 6
+	wasmUnimplemented = 12
+
+	wasmActionContinue = 0
+
+	wasmMapRequestHeaders  = 0
+	wasmMapResponseHeaders = 2
+
+	wasmBufferVMConfig     = 6
+	wasmBufferPluginConfig = 7
+)
+
+var wasmLogLevels = []string{"trace", "debug", "info", "warn", "error", "critical"}
+
+// wasmFilter is a loaded --wasm module with its pool of instances
+type wasmFilter struct {
+	name      string
+	module    *wasmModule
+	config    []byte
+	host      map[string]wasmHostFunc
+	fuel      int64
+	maxMemory int64
+	log       *serverLog
+
+	pool chan *wasmVM
+	mu   sync.Mutex
+	vms  int
+}
+
+// wasmVM is an instance of a filter module and the request it is handling
+type wasmVM struct {
+	filter *wasmFilter
+	inst   *wasmInstance
+	nextID uint64
+	output map[uint64][]byte // unfinished lines written to stdout and stderr
+
+	r       *http.Request
+	w       http.ResponseWriter
+	status  int
+	local   *wasmLocalResponse
+	rewrite string
+}
+
+// wasmLocalResponse is a response sent by a filter instead of the server
+type wasmLocalResponse struct {
+	status  int
+	details string
+	headers [][2]string
+	body    []byte
+}
+
+// loadWasmFilters loads the --wasm filters, given as FILE or
+// FILE,config=FILE, starting an instance of each to check it configures
+func loadWasmFilters(specs []string, fuel, maxMemory int64, log *serverLog) ([]*wasmFilter, error) {
+	var filters []*wasmFilter
+	for _, spec := range specs {
+		file, options, _ := strings.Cut(spec, ",")
+		f := &wasmFilter{name: filepath.Base(file), fuel: fuel, maxMemory: maxMemory, log: log, pool: make(chan *wasmVM, wasmMaxVMs)}
+		if options != "" {
+			for _, option := range strings.Split(options, ",") {
+				key, val, _ := strings.Cut(option, "=")
+				if key != "config" {
+					return nil, fmt.Errorf("unknown wasm option %q, expected config=FILE", option)
+				}
+				config, err := os.ReadFile(val)
+				if err != nil {
+					return nil, err
+				}
+				f.config = config
+			}
+		}
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if f.module, err = parseWasm(b); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		if !f.module.proxyWasm() {
+			return nil, fmt.Errorf("%s: not a proxy-wasm module, it exports no proxy_abi_version_0_2_x function", file)
+		}
+		f.host = wasmHostFuncs(f.module)
+		vm, err := f.newVM()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		f.vms = 1
+		f.pool <- vm
+		f.log.logf("Loaded wasm filter %s", f.name)
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+// proxyWasm reports whether the module targets a proxy-wasm ABI this host
+// speaks
+func (m *wasmModule) proxyWasm() bool {
+	for _, name := range []string{"proxy_abi_version_0_2_0", "proxy_abi_version_0_2_1"} {
+		if _, ok := m.exports[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// newVM instantiates the module and starts its root context
+func (f *wasmFilter) newVM() (*wasmVM, error) {
+	vm := &wasmVM{filter: f, nextID: wasmRootContext + 1, output: make(map[uint64][]byte)}
+	inst, err := f.module.instantiate(f.host, f.maxMemory, f.fuel, vm)
+	if err != nil {
+		return nil, err
+	}
+	vm.inst = inst
+	for _, name := range []string{"_initialize", "_start"} {
+		if _, ok := inst.export(name); ok {
+			if _, _, err := vm.callback(name); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	if _, _, err := vm.callback("proxy_on_context_create", wasmRootContext, 0); err != nil {
+		return nil, err
+	}
+	if ok, found, err := vm.callback("proxy_on_vm_start", wasmRootContext, 0); err != nil {
+		return nil, err
+	} else if found && ok == 0 {
+		return nil, errors.New("the module failed to start")
+	}
+	if ok, found, err := vm.callback("proxy_on_configure", wasmRootContext, uint64(len(f.config))); err != nil {
+		return nil, err
+	} else if found && ok == 0 {
+		return nil, errors.New("the module rejected its configuration")
+	}
+	return vm, nil
+}
+
+// get takes an idle instance, starting one while under wasmMaxVMs
+func (f *wasmFilter) get(r *http.Request) (*wasmVM, error) {
+	select {
+	case vm := <-f.pool:
+		return vm, nil
+	default:
+	}
+	f.mu.Lock()
+	if f.vms < wasmMaxVMs {
+		f.vms++
+		f.mu.Unlock()
+		vm, err := f.newVM()
+		if err != nil {
+			f.mu.Lock()
+			f.vms--
+			f.mu.Unlock()
+		}
+		return vm, err
+	}
+	f.mu.Unlock()
+	select {
+	case vm := <-f.pool:
+		return vm, nil
+	case <-r.Context().Done():
+		return nil, r.Context().Err()
+	}
+}
+
+// put returns an instance to the pool, dropping it if it trapped
+func (f *wasmFilter) put(vm *wasmVM) {
+	vm.r, vm.w, vm.local, vm.rewrite, vm.status = nil, nil, nil, "", 0
+	if vm.inst.trapped {
+		f.mu.Lock()
+		f.vms--
+		f.mu.Unlock()
+		return
+	}
+	f.pool <- vm
+}
+
+// callback calls an exported function, passing as many of args as it
+// takes, and reports whether the module exports it
+func (vm *wasmVM) callback(name string, args ...uint64) (uint64, bool, error) {
+	fn, ok := vm.inst.export(name)
+	if !ok {
+		return 0, false, nil
+	}
+	t := vm.inst.funcType(fn)
+	results, err := vm.inst.call(fn, args[:min(len(args), len(t.params))]...)
+	if err != nil || len(results) == 0 {
+		return 0, true, err
+	}
+	return results[0], true, nil
+}
+
+// alloc allocates size bytes in the module's memory
+func (vm *wasmVM) alloc(size int) (uint32, error) {
+	for _, name := range []string{"proxy_on_memory_allocate", "malloc"} {
+		if ptr, ok, err := vm.callback(name, uint64(size)); ok {
+			if err == nil && ptr == 0 && size > 0 {
+				err = errors.New("the module is out of memory")
+			}
+			return uint32(ptr), err
+		}
+	}
+	return 0, errors.New("the module exports no proxy_on_memory_allocate or malloc")
+}
+
+// give copies b into memory allocated in the module, storing its address
+// and size at ptrPtr and sizePtr
+func (vm *wasmVM) give(b []byte, ptrPtr, sizePtr uint64) (uint64, error) {
+	ptr, err := vm.alloc(len(b))
+	if err != nil {
+		return 0, err
+	}
+	if !vm.inst.write(ptr, b) || !vm.inst.putUint32(uint32(ptrPtr), ptr) || !vm.inst.putUint32(uint32(sizePtr), uint32(len(b))) {
+		return wasmInvalidMemory, nil
+	}
+	return wasmOK, nil
+}
+
+// readString reads size bytes at ptr
+func (vm *wasmVM) readString(ptr, size uint64) (string, bool) {
+	b, ok := vm.inst.read(uint32(ptr), uint32(size))
+	return string(b), ok
+}
+
+// headerPairs returns the pairs of a header map, pseudo-headers first
+func (vm *wasmVM) headerPairs(mapType uint64) ([][2]string, bool) {
+	var pairs [][2]string
+	var header http.Header
+	switch mapType {
+	case wasmMapRequestHeaders:
+		r := vm.r
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		pairs = [][2]string{{":method", r.Method}, {":path", r.URL.RequestURI()}, {":authority", r.Host}, {":scheme", scheme}}
+		header = r.Header
+	case wasmMapResponseHeaders:
+		if vm.status != 0 {
+			pairs = [][2]string{{":status", strconv.Itoa(vm.status)}}
+		}
+		header = vm.w.Header()
+	default:
+		return nil, false
+	}
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range header[name] {
+			pairs = append(pairs, [2]string{strings.ToLower(name), value})
+		}
+	}
+	return pairs, true
+}
+
+// header returns the header map of mapType for changes
+func (vm *wasmVM) header(mapType uint64) (http.Header, bool) {
+	switch mapType {
+	case wasmMapRequestHeaders:
+		return vm.r.Header, true
+	case wasmMapResponseHeaders:
+		return vm.w.Header(), true
+	}
+	return nil, false
+}
+
+// setPseudo changes a pseudo-header, of which only the request :path can
+// be changed
+func (vm *wasmVM) setPseudo(mapType uint64, name, value string) uint64 {
+	if mapType == wasmMapRequestHeaders && name == ":path" {
+		vm.rewrite = value
+		return wasmOK
+	}
+	return wasmBadArgument
+}
+
+// encodeWasmPairs serializes header pairs as proxy-wasm does: their count,
+// the size of each key and value, then each key and value NUL-terminated
+func encodeWasmPairs(pairs [][2]string) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, uint32(len(pairs)))
+	for _, p := range pairs {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(p[0])))
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(p[1])))
+	}
+	for _, p := range pairs {
+		b = append(append(append(b, p[0]...), 0), append([]byte(p[1]), 0)...)
+	}
+	return b
+}
+
+// decodeWasmPairs parses serialized header pairs
+func decodeWasmPairs(b []byte) ([][2]string, bool) {
+	if len(b) < 4 {
+		return nil, len(b) == 0
+	}
+	n := int(binary.LittleEndian.Uint32(b))
+	if n > len(b)/8 {
+		return nil, false
+	}
+	sizes, data := b[4:], b[4+8*n:]
+	pairs := make([][2]string, n)
+	for i := range pairs {
+		for j := range 2 {
+			size := int(binary.LittleEndian.Uint32(sizes[8*i+4*j:]))
+			if size+1 > len(data) || data[size] != 0 {
+				return nil, false
+			}
+			pairs[i][j], data = string(data[:size]), data[size+1:]
+		}
+	}
+	return pairs, true
+}
+
+// property returns a request attribute by its path, given as segments
+// separated by NULs
+func (vm *wasmVM) property(path string) (string, bool) {
+	r := vm.r
+	key := strings.ReplaceAll(path, "\x00", ".")
+	switch key {
+	case "plugin_name", "plugin_vm_id":
+		return vm.filter.name, true
+	case "plugin_root_id":
+		return "", true
+	}
+	if r == nil {
+		return "", false
+	}
+	switch key {
+	case "request.path":
+		return r.URL.RequestURI(), true
+	case "request.url_path":
+		return r.URL.Path, true
+	case "request.query":
+		return r.URL.RawQuery, true
+	case "request.host":
+		return r.Host, true
+	case "request.method":
+		return r.Method, true
+	case "request.scheme":
+		if r.TLS != nil {
+			return "https", true
+		}
+		return "http", true
+	case "request.protocol":
+		return r.Proto, true
+	case "request.id":
+		return RequestID(r), true
+	case "request.useragent":
+		return r.UserAgent(), true
+	case "request.referer":
+		return r.Referer(), true
+	case "request.user":
+		return RequestUser(r), true
+	case "source.address":
+		return r.RemoteAddr, true
+	case "source.port":
+		_, port, _ := net.SplitHostPort(r.RemoteAddr)
+		return port, true
+	case "response.code":
+		if vm.status != 0 {
+			return strconv.Itoa(vm.status), true
+		}
+	}
+	return "", false
+}
+
+// logOutput logs the complete lines written to a WASI file descriptor
+func (vm *wasmVM) logOutput(fd uint64, b []byte) {
+	buf := append(vm.output[fd], b...)
+	for {
+		line, rest, ok := bytes.Cut(buf, []byte("\n"))
+		if !ok {
+			break
+		}
+		vm.filter.log.logf("wasm %s: %s", vm.filter.name, line)
+		buf = rest
+	}
+	if len(buf) > 64<<10 {
+		vm.filter.log.logf("wasm %s: %s", vm.filter.name, buf)
+		buf = nil
+	}
+	vm.output[fd] = buf
+}
+
+// wasmHostFuncs returns the proxy-wasm and WASI functions given to m,
+// stubbing the other proxy_* and WASI imports it has
+func wasmHostFuncs(m *wasmModule) map[string]wasmHostFunc {
+	vmOf := func(in *wasmInstance) *wasmVM { return in.userData.(*wasmVM) }
+	host := map[string]wasmHostFunc{
+		"env.proxy_log": func(in *wasmInstance, a []uint64) (uint64, error) {
+			msg, ok := vmOf(in).readString(a[1], a[2])
+			if !ok {
+				return wasmInvalidMemory, nil
+			}
+			if a[0] >= 2 && a[0] < uint64(len(wasmLogLevels)) {
+				vmOf(in).filter.log.logf("wasm %s: %s: %s", vmOf(in).filter.name, wasmLogLevels[a[0]], msg)
+			}
+			return wasmOK, nil
+		},
+		"env.proxy_get_log_level": func(in *wasmInstance, a []uint64) (uint64, error) {
+			if !in.putUint32(uint32(a[0]), 2) {
+				return wasmInvalidMemory, nil
+			}
+			return wasmOK, nil
+		},
+		"env.proxy_get_current_time_nanoseconds": func(in *wasmInstance, a []uint64) (uint64, error) {
+			if !in.write(uint32(a[0]), binary.LittleEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))) {
+				return wasmInvalidMemory, nil
+			}
+			return wasmOK, nil
+		},
+		"env.proxy_set_effective_context": func(*wasmInstance, []uint64) (uint64, error) { return wasmOK, nil },
+		"env.proxy_set_tick_period_milliseconds": func(*wasmInstance, []uint64) (uint64, error) {
+			return wasmOK, nil
+		},
+		"env.proxy_done": func(*wasmInstance, []uint64) (uint64, error) { return wasmOK, nil },
+		"env.proxy_get_buffer_bytes": func(in *wasmInstance, a []uint64) (uint64, error) {
+			vm := vmOf(in)
+			var buf []byte
+			switch a[0] {
+			case wasmBufferVMConfig:
+			case wasmBufferPluginConfig:
+				buf = vm.filter.config
+			default:
+				return wasmNotFound, nil
+			}
+			start := min(a[1], uint64(len(buf)))
+			end := min(start+a[2], uint64(len(buf)))
+			return vm.give(buf[start:end], a[3], a[4])
+		},
+		"env.proxy_get_buffer_status": func(in *wasmInstance, a []uint64) (uint64, error) {
+			if a[0] != wasmBufferVMConfig && a[0] != wasmBufferPluginConfig {
+				return wasmNotFound, nil
+			}
+			size := 0
+			if a[0] == wasmBufferPluginConfig {
+				size = len(vmOf(in).filter.config)
+			}
+			if !in.putUint32(uint32(a[1]), uint32(size)) || !in.putUint32(uint32(a[2]), 0) {
+				return wasmInvalidMemory, nil
+			}
+			return wasmOK, nil
+		},
+		"env.proxy_get_property": func(in *wasmInstance, a []uint64) (uint64, error) {
+			vm := vmOf(in)
+			path, ok := vm.readString(a[0], a[1])
+			if !ok {
+				return wasmInvalidMemory, nil
+			}
+			value, ok := vm.property(path)
+			if !ok {
+				return wasmNotFound, nil
+			}
+			return vm.give([]byte(value), a[2], a[3])
+		},
+		"env.proxy_get_header_map_pairs": func(in *wasmInstance, a []uint64) (uint64, error) {
+			vm := vmOf(in)
+			pairs, ok := vm.headerPairs(a[0])
+			if !ok {
+				return wasmBadArgument, nil
+			}
+			return vm.give(encodeWasmPairs(pairs), a[1], a[2])
+		},
+		"env.proxy_get_header_map_size": func(in *wasmInstance, a []uint64) (uint64, error) {
+			pairs, ok := vmOf(in).headerPairs(a[0])
+			if !ok {
+				return wasmBadArgument, nil
+			}
+			if !in.putUint32(uint32(a[1]), uint32(len(encodeWasmPairs(pairs)))) {
+				return wasmInvalidMemory, nil
+			}
+			return wasmOK, nil
+		},
+		"env.proxy_get_header_map_value": func(in *wasmInstance, a []uint64) (uint64, error) {
+			vm := vmOf(in)
+			name, ok := vm.readString(a[1], a[2])
+			if !ok {
+				return wasmInvalidMemory, nil
+			}
+			pairs, ok := vm.headerPairs(a[0])
+			if !ok {
+				return wasmBadArgument, nil
+			}
+			var values []string
+			for _, p := range pairs {
+				if p[0] == strings.ToLower(name) {
+					values = append(values, p[1])
+				}
+			}
+			if len(values) == 0 {
+				return wasmNotFound, nil
+			}
+			return vm.give([]byte(strings.Join(values, ",")), a[3], a[4])
+		},
+		"env.proxy_add_header_map_value":     wasmSetHeader(func(h http.Header, name, value string) { h.Add(name, value) }),
+		"env.proxy_replace_header_map_value": wasmSetHeader(func(h http.Header, name, value string) { h.Set(name, value) }),
+		"env.proxy_remove_header_map_value": func(in *wasmInstance, a []uint64) (uint64, error) {
+			vm := vmOf(in)
+			name, ok := vm.readString(a[1], a[2])
+			if !ok {
+				return wasmInvalidMemory, nil
+			}
+			h, ok := vm.header(a[0])
+			if !ok || strings.HasPrefix(name, ":") {
+				return wasmBadArgument, nil
+			}
+			h.Del(name)
+			return wasmOK, nil
+		},
+		"env.proxy_set_header_map_pairs": func(in *wasmInstance, a []uint64) (uint64, error) {
+			vm := vmOf(in)
+			b, ok := in.read(uint32(a[1]), uint32(a[2]))
+			if !ok {
+				return wasmInvalidMemory, nil
+			}
+			pairs, ok := decodeWasmPairs(b)
+			h, known := vm.header(a[0])
+			if !ok || !known {
+				return wasmBadArgument, nil
+			}
+			clear(h)
+			for _, p := range pairs {
+				if strings.HasPrefix(p[0], ":") {
+					vm.setPseudo(a[0], p[0], p[1])
+				} else {
+					h.Add(p[0], p[1])
+				}
+			}
+			return wasmOK, nil
+		},
+		"env.proxy_send_local_response": func(in *wasmInstance, a []uint64) (uint64, error) {
+			vm := vmOf(in)
+			if vm.r == nil || vm.status != 0 {
+				return wasmBadArgument, nil
+			}
+			details, ok1 := vm.readString(a[1], a[2])
+			body, ok2 := in.read(uint32(a[3]), uint32(a[4]))
+			b, ok3 := in.read(uint32(a[5]), uint32(a[6]))
+			if !ok1 || !ok2 || !ok3 {
+				return wasmInvalidMemory, nil
+			}
+			headers, ok := decodeWasmPairs(b)
+			if !ok {
+				return wasmBadArgument, nil
+			}
+			vm.local = &wasmLocalResponse{status: int(uint32(a[0])), details: details, headers: headers, body: body}
+			return wasmOK, nil
+		},
+
+		// The WASI functions runtimes built for wasip1 need
+		"wasi_snapshot_preview1.fd_write": func(in *wasmInstance, a []uint64) (uint64, error) {
+			if a[0] != 1 && a[0] != 2 {
+				return 8, nil // EBADF
+			}
+			var total uint32
+			for i := range uint32(a[2]) {
+				iov, ok := in.read(uint32(a[1])+8*i, 8)
+				if !ok {
+					return 21, nil // EFAULT
+				}
+				b, ok := in.read(binary.LittleEndian.Uint32(iov), binary.LittleEndian.Uint32(iov[4:]))
+				if !ok {
+					return 21, nil
+				}
+				vmOf(in).logOutput(a[0], b)
+				total += uint32(len(b))
+			}
+			if !in.putUint32(uint32(a[3]), total) {
+				return 21, nil
+			}
+			return 0, nil
+		},
+		"wasi_snapshot_preview1.proc_exit": func(in *wasmInstance, a []uint64) (uint64, error) {
+			return 0, fmt.Errorf("the module exited with status %d", uint32(a[0]))
+		},
+		"wasi_snapshot_preview1.clock_time_get": func(in *wasmInstance, a []uint64) (uint64, error) {
+			if !in.write(uint32(a[2]), binary.LittleEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))) {
+				return 21, nil
+			}
+			return 0, nil
+		},
+		"wasi_snapshot_preview1.random_get": func(in *wasmInstance, a []uint64) (uint64, error) {
+			b := make([]byte, uint32(a[1]))
+			rand.Read(b)
+			if !in.write(uint32(a[0]), b) {
+				return 21, nil
+			}
+			return 0, nil
+		},
+		"wasi_snapshot_preview1.sched_yield": func(*wasmInstance, []uint64) (uint64, error) { return 0, nil },
+	}
+	// No environment and no arguments
+	for _, name := range []string{"environ", "args"} {
+		host["wasi_snapshot_preview1."+name+"_sizes_get"] = func(in *wasmInstance, a []uint64) (uint64, error) {
+			if !in.putUint32(uint32(a[0]), 0) || !in.putUint32(uint32(a[1]), 0) {
+				return 21, nil
+			}
+			return 0, nil
+		}
+		host["wasi_snapshot_preview1."+name+"_get"] = func(*wasmInstance, []uint64) (uint64, error) { return 0, nil }
+	}
+	for _, imp := range m.imports {
+		key := imp.module + "." + imp.name
+		if _, ok := host[key]; ok {
+			continue
+		}
+		switch {
+		case imp.module == "env" && strings.HasPrefix(imp.name, "proxy_"):
+			host[key] = func(*wasmInstance, []uint64) (uint64, error) { return wasmUnimplemented, nil }
+		case imp.module == "wasi_snapshot_preview1" && strings.HasPrefix(imp.name, "fd_"):
+			host[key] = func(*wasmInstance, []uint64) (uint64, error) { return 8, nil } // EBADF
+		case imp.module == "wasi_snapshot_preview1":
+			host[key] = func(*wasmInstance, []uint64) (uint64, error) { return 52, nil } // ENOSYS
+		}
+	}
+	return host
+}
+
+// wasmSetHeader implements proxy_add_header_map_value and
+// proxy_replace_header_map_value with set
+func wasmSetHeader(set func(h http.Header, name, value string)) wasmHostFunc {
+	return func(in *wasmInstance, a []uint64) (uint64, error) {
+		vm := in.userData.(*wasmVM)
+		name, ok1 := vm.readString(a[1], a[2])
+		value, ok2 := vm.readString(a[3], a[4])
+		if !ok1 || !ok2 {
+			return wasmInvalidMemory, nil
+		}
+		if strings.HasPrefix(name, ":") {
+			return vm.setPseudo(a[0], name, value), nil
+		}
+		h, ok := vm.header(a[0])
+		if !ok {
+			return wasmBadArgument, nil
+		}
+		set(h, name, value)
+		return wasmOK, nil
+	}
+}
+
+// wasmResponseWriter gives the response headers to the filter before they
+// are written
+type wasmResponseWriter struct {
+	http.ResponseWriter
+	vm          *wasmVM
+	id          uint64
+	wroteHeader bool
+}
+
+// WriteHeader calls proxy_on_response_headers, then writes the headers as
+// the filter left them
+func (ww *wasmResponseWriter) WriteHeader(code int) {
+	if !ww.wroteHeader {
+		ww.wroteHeader = true
+		ww.vm.status = code
+		pairs, _ := ww.vm.headerPairs(wasmMapResponseHeaders)
+		if _, _, err := ww.vm.callback("proxy_on_response_headers", ww.id, uint64(len(pairs)), 0); err != nil {
+			ww.vm.filter.log.logf("Error in wasm filter %s for %s: %v", ww.vm.filter.name, ww.vm.r.URL.Path, err)
+		}
+	}
+	ww.ResponseWriter.WriteHeader(code)
+}
+
+// Write writes the headers first if needed
+func (ww *wasmResponseWriter) Write(b []byte) (int, error) {
+	if !ww.wroteHeader {
+		ww.WriteHeader(http.StatusOK)
+	}
+	return ww.ResponseWriter.Write(b)
+}
+
+// ReadFrom keeps the sendfile path
+func (ww *wasmResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !ww.wroteHeader {
+		ww.WriteHeader(http.StatusOK)
+	}
+	return readFrom(ww.ResponseWriter, src)
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (ww *wasmResponseWriter) Unwrap() http.ResponseWriter {
+	return ww.ResponseWriter
+}
+
+// serve runs a request through the filter, then on to next unless the
+// filter answered it
+func (f *wasmFilter) serve(next http.Handler, w http.ResponseWriter, r *http.Request, policy pathPolicy, ui uiOptions) {
+	fail := func(err error) {
+		f.log.logf("Error in wasm filter %s for %s: %v", f.name, r.URL.Path, err)
+		renderError(w, r, http.StatusInternalServerError, ui)
+	}
+	vm, err := f.get(r)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer f.put(vm)
+	id := vm.nextID
+	vm.nextID++
+	vm.r, vm.w = r, w
+	if _, _, err := vm.callback("proxy_on_context_create", id, wasmRootContext); err != nil {
+		fail(err)
+		return
+	}
+	defer func() {
+		for _, name := range []string{"proxy_on_done", "proxy_on_log", "proxy_on_delete"} {
+			if _, _, err := vm.callback(name, id); err != nil {
+				f.log.logf("Error in wasm filter %s for %s: %v", f.name, r.URL.Path, err)
+				return
+			}
+		}
+	}()
+
+	pairs, _ := vm.headerPairs(wasmMapRequestHeaders)
+	endOfStream := b2i(r.ContentLength == 0 && len(r.TransferEncoding) == 0)
+	action, _, err := vm.callback("proxy_on_request_headers", id, uint64(len(pairs)), endOfStream)
+	switch {
+	case err != nil:
+		fail(err)
+		return
+	case vm.local != nil:
+		vm.respond(w, r, ui)
+		return
+	case uint32(action) != wasmActionContinue:
+		fail(errors.New("the filter paused the request, which is not supported"))
+		return
+	}
+	if vm.rewrite != "" {
+		target, err := url.Parse(vm.rewrite)
+		if err == nil {
+			var cleanPath string
+			if cleanPath, err = sanitizePath(target, policy); err == nil {
+				r.URL.Path, r.URL.RawPath, r.URL.RawQuery = cleanPath, "", target.RawQuery
+			}
+		}
+		if err != nil {
+			fail(fmt.Errorf("rewrite to %q: %v", vm.rewrite, err))
+			return
+		}
+	}
+	if _, ok := vm.inst.export("proxy_on_response_headers"); ok {
+		w = &wasmResponseWriter{ResponseWriter: w, vm: vm, id: id}
+		vm.w = w
+	}
+	next.ServeHTTP(w, r)
+}
+
+// respond writes the local response of the filter
+func (vm *wasmVM) respond(w http.ResponseWriter, r *http.Request, ui uiOptions) {
+	local := vm.local
+	vm.filter.log.logf("audit: wasm filter %s answered %s with %d: %s", vm.filter.name, r.URL.Path, local.status, local.details)
+	for _, h := range local.headers {
+		w.Header().Add(h[0], h[1])
+	}
+	status := local.status
+	if status < 200 || status > 599 {
+		status = http.StatusForbidden
+	}
+	if len(local.body) == 0 {
+		renderError(w, r, status, ui)
+		return
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.WriteHeader(status)
+	w.Write(local.body)
+}
+
+// filterWasm is the wasm stage, running the filters in the order given
+func filterWasm(filters []*wasmFilter, policy pathPolicy, ui uiOptions) Middleware {
+	if len(filters) == 0 {
+		return nil
+	}
+	return func(next http.Handler) http.Handler {
+		for _, f := range slices.Backward(filters) {
+			inner := next
+			next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				f.serve(inner, w, r, policy, ui)
+			})
+		}
+		return next
+	}
+}
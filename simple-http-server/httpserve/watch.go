@@ -0,0 +1,286 @@
+package httpserve
+
+import (
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchPrefix is where --watch streams file changes over WebSocket, for
+// the whole tree or the subtree below it
+const watchPrefix = "/_watch"
+
+// watchBatchDelay is how long changes are gathered before being sent, so
+// saving a file yields a single event
+const watchBatchDelay = 100 * time.Millisecond
+
+// watchEvent is a change below the served directory
+type watchEvent struct {
+	Type  string `json:"type"` // created, modified or deleted
+	Path  string `json:"path"`
+	IsDir bool   `json:"isDir,omitempty"`
+}
+
+// watchSubscription receives the batches of changes below prefix
+type watchSubscription struct {
+	prefix  string
+	batches chan []watchEvent
+	// lost is set when the subscriber fell behind and batches was closed
+	lost bool
+}
+
+// treeWatcher watches every directory of a tree with fsnotify, adding
+// directories as they appear, and fans changes out to subscribers
+type treeWatcher struct {
+	root    string
+	watcher *fsnotify.Watcher
+	log     *serverLog
+
+	mu   sync.Mutex
+	subs map[*watchSubscription]bool
+}
+
+// newTreeWatcher starts watching the tree at root
+func newTreeWatcher(root string, log *serverLog) (*treeWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	t := &treeWatcher{root: root, watcher: watcher, log: log, subs: make(map[*watchSubscription]bool)}
+	start := time.Now()
+	n := t.addTree("/", nil)
+	t.log.logf("Watching %d directories in %s (%v)", n, root, time.Since(start).Round(time.Millisecond))
+	go t.run()
+	return t, nil
+}
+
+// addTree watches the directory at urlPath and those below it, returning
+// how many were added. Entries found are appended to created, when given,
+// so files written into a new directory before it was watched are reported.
+func (t *treeWatcher) addTree(urlPath string, created *[]watchEvent) int {
+	n := 0
+	filepath.WalkDir(filepath.Join(t.root, filepath.FromSlash(urlPath)), func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(t.root, name)
+		entryPath := path.Clean("/" + filepath.ToSlash(rel))
+		if hiddenEntry(path.Dir(entryPath), d.Name()) {
+			return filepath.SkipDir
+		}
+		if created != nil && entryPath != urlPath {
+			*created = append(*created, watchEvent{Type: "created", Path: entryPath, IsDir: d.IsDir()})
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if err := t.watcher.Add(name); err != nil {
+			t.log.logf("Error watching %s: %v", name, err)
+			return filepath.SkipDir
+		}
+		n++
+		return nil
+	})
+	return n
+}
+
+// subscribe returns a subscription to the changes below prefix
+func (t *treeWatcher) subscribe(prefix string) *watchSubscription {
+	sub := &watchSubscription{prefix: prefix, batches: make(chan []watchEvent, 16)}
+	t.mu.Lock()
+	t.subs[sub] = true
+	t.mu.Unlock()
+	return sub
+}
+
+// unsubscribe stops delivering changes to sub
+func (t *treeWatcher) unsubscribe(sub *watchSubscription) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.subs[sub] {
+		delete(t.subs, sub)
+		close(sub.batches)
+	}
+}
+
+// run gathers fsnotify events into batches and publishes them
+func (t *treeWatcher) run() {
+	var pending []watchEvent
+	index := make(map[string]int)
+	flush := time.NewTimer(0)
+	<-flush.C
+	for {
+		select {
+		case ev, ok := <-t.watcher.Events:
+			if !ok {
+				return
+			}
+			rel, err := filepath.Rel(t.root, ev.Name)
+			if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+				continue
+			}
+			urlPath := path.Clean("/" + filepath.ToSlash(rel))
+			if isTrashPath(urlPath) || isMirrorPath(urlPath) {
+				continue
+			}
+			var changes []watchEvent
+			switch {
+			case ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename):
+				changes = append(changes, watchEvent{Type: "deleted", Path: urlPath})
+			case ev.Has(fsnotify.Create):
+				info, err := os.Lstat(ev.Name)
+				if err != nil {
+					continue
+				}
+				changes = append(changes, watchEvent{Type: "created", Path: urlPath, IsDir: info.IsDir()})
+				if info.IsDir() {
+					t.addTree(urlPath, &changes)
+				}
+			case ev.Has(fsnotify.Write) || ev.Has(fsnotify.Chmod):
+				changes = append(changes, watchEvent{Type: "modified", Path: urlPath})
+			}
+			if len(pending) == 0 && len(changes) > 0 {
+				flush.Reset(watchBatchDelay)
+			}
+			for _, change := range changes {
+				pending = mergeWatchEvent(pending, index, change)
+			}
+		case err, ok := <-t.watcher.Errors:
+			if !ok {
+				return
+			}
+			t.log.logf("Watch error, changes may have been missed: %v", err)
+		case <-flush.C:
+			var batch []watchEvent
+			for _, ev := range pending {
+				if ev.Type != "" {
+					batch = append(batch, ev)
+				}
+			}
+			pending, index = nil, make(map[string]int)
+			t.publish(batch)
+		}
+	}
+}
+
+// mergeWatchEvent folds a change into the pending batch, keeping one event
+// per path: a file created then written is still created, one deleted and
+// created again was modified, and one created then deleted never existed
+func mergeWatchEvent(pending []watchEvent, index map[string]int, ev watchEvent) []watchEvent {
+	i, ok := index[ev.Path]
+	if !ok {
+		index[ev.Path] = len(pending)
+		return append(pending, ev)
+	}
+	prev := &pending[i]
+	switch {
+	case prev.Type == "created" && ev.Type == "modified":
+	case prev.Type == "created" && ev.Type == "deleted":
+		prev.Type = ""
+	case prev.Type == "deleted" && ev.Type == "created":
+		prev.Type, prev.IsDir = "modified", ev.IsDir
+	case prev.Type == "":
+		*prev = ev
+	default:
+		prev.Type = ev.Type
+	}
+	return pending
+}
+
+// publish sends the events of a batch to the subscribers they concern.
+// Subscribers that fell behind are dropped rather than holding up others.
+func (t *treeWatcher) publish(batch []watchEvent) {
+	if len(batch) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for sub := range t.subs {
+		var events []watchEvent
+		for _, ev := range batch {
+			if sub.prefix == "/" || ev.Path == sub.prefix || strings.HasPrefix(ev.Path, sub.prefix+"/") {
+				events = append(events, ev)
+			}
+		}
+		if len(events) == 0 {
+			continue
+		}
+		select {
+		case sub.batches <- events:
+		default:
+			sub.lost = true
+			delete(t.subs, sub)
+			close(sub.batches)
+		}
+	}
+}
+
+// serveWatch upgrades to a WebSocket streaming the changes below the
+// subtree named by the rest of the path, as JSON messages:
+//
+//	{"type":"ready","path":"/docs"}
+//	{"type":"modified","path":"/docs/index.html"}
+func (h *fileHandler) serveWatch(w http.ResponseWriter, r *http.Request) {
+	subtree := path.Clean("/" + strings.TrimPrefix(r.URL.Path, watchPrefix))
+	if info, err := os.Stat(filepath.Join(h.dir, filepath.FromSlash(subtree))); err != nil || !info.IsDir() || isTrashPath(subtree) || isMirrorPath(subtree) {
+		renderError(w, r, http.StatusNotFound, h.ui)
+		return
+	}
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		w.Header().Set("Upgrade", "websocket")
+		renderError(w, r, http.StatusUpgradeRequired, h.ui)
+		return
+	}
+	sub := h.watcher.subscribe(subtree)
+	defer h.watcher.unsubscribe(sub)
+
+	// Reading answers pings and notices when the client goes away
+	closed := make(chan struct{})
+	go func() {
+		for {
+			if _, _, err := ws.readMessage(); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+	if err := ws.writeJSON(watchEvent{Type: "ready", Path: subtree}); err != nil {
+		ws.conn.Close()
+		return
+	}
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case batch, ok := <-sub.batches:
+			if !ok {
+				if sub.lost {
+					ws.close(1013, "too many changes, reconnect")
+				}
+				return
+			}
+			for _, ev := range batch {
+				if err := ws.writeJSON(ev); err != nil {
+					ws.conn.Close()
+					return
+				}
+			}
+		case <-keepAlive.C:
+			if err := ws.writeMessage(wsPing, nil); err != nil {
+				ws.conn.Close()
+				return
+			}
+		case <-closed:
+			ws.conn.Close()
+			return
+		}
+	}
+}
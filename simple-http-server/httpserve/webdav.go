@@ -0,0 +1,159 @@
+package httpserve
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/net/webdav"
+)
+
+// webdavMethods are the methods routed to the WebDAV handler
+var webdavMethods = []string{
+	http.MethodOptions, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete,
+	"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK",
+}
+
+// webdavWriteMethods are the WebDAV methods that modify the tree
+var webdavWriteMethods = map[string]bool{
+	http.MethodPut: true, http.MethodDelete: true, "PROPPATCH": true,
+	"MKCOL": true, "COPY": true, "MOVE": true, "LOCK": true, "UNLOCK": true,
+}
+
+// newWebDAVHandler exposes the directory of h over WebDAV below prefix,
+// hiding the trash and, when mirrored, the mirror metadata. Files written
+// go through the checks of uploads.
+func newWebDAVHandler(h *fileHandler, prefix string, readOnly bool) http.Handler {
+	var fs webdav.FileSystem = webdav.Dir(h.dir)
+	if !readOnly {
+		fs = uploadFS{FileSystem: fs, h: h}
+	}
+	fs = hiddenFS{FileSystem: fs, mirrored: h.mirror != nil}
+	if readOnly {
+		fs = readOnlyFS{fs}
+	}
+	ui := h.ui
+	dav := &webdav.Handler{
+		Prefix:     strings.TrimSuffix(prefix, "/"),
+		FileSystem: fs,
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				h.log.logf("WebDAV %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+			}
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if readOnly && webdavWriteMethods[r.Method] {
+			renderError(w, r, http.StatusMethodNotAllowed, ui)
+			return
+		}
+		if webdavWriteMethods[r.Method] && r.Method != "LOCK" && r.Method != "UNLOCK" {
+			h.log.logf("audit: %s WebDAV %s %s from %s", RequestUser(r), r.Method, r.URL.Path, r.RemoteAddr)
+			// Refused writes are answered like uploads, rather than with
+			// the generic status the WebDAV handler picks
+			refusal := new(error)
+			r = r.WithContext(context.WithValue(r.Context(), webdavRefusalKey{}, refusal))
+			w = &webdavRefusalWriter{ResponseWriter: w, r: r, h: h, refusal: refusal}
+		}
+		dav.ServeHTTP(w, r)
+	})
+}
+
+// readOnlyFS rejects every WebDAV operation that would modify the tree
+type readOnlyFS struct {
+	webdav.FileSystem
+}
+
+func (readOnlyFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (readOnlyFS) RemoveAll(ctx context.Context, name string) error {
+	return os.ErrPermission
+}
+
+func (readOnlyFS) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+// OpenFile only allows opening files for reading
+func (f readOnlyFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, os.ErrPermission
+	}
+	return f.FileSystem.OpenFile(ctx, name, flag, perm)
+}
+
+// hiddenFS keeps the directories the file handler answers 404 for out of
+// WebDAV: they are left out of listings, and every operation on them fails
+// as if they did not exist
+type hiddenFS struct {
+	webdav.FileSystem
+	mirrored bool
+}
+
+func (f hiddenFS) hidden(name string) bool {
+	return isTrashPath(name) || isMaintenancePath(name) || f.mirrored && isMirrorPath(name)
+}
+
+func (f hiddenFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if f.hidden(name) {
+		return os.ErrNotExist
+	}
+	return f.FileSystem.Mkdir(ctx, name, perm)
+}
+
+func (f hiddenFS) RemoveAll(ctx context.Context, name string) error {
+	if f.hidden(name) {
+		return os.ErrNotExist
+	}
+	return f.FileSystem.RemoveAll(ctx, name)
+}
+
+func (f hiddenFS) Rename(ctx context.Context, oldName, newName string) error {
+	if f.hidden(oldName) || f.hidden(newName) {
+		return os.ErrNotExist
+	}
+	return f.FileSystem.Rename(ctx, oldName, newName)
+}
+
+func (f hiddenFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if f.hidden(name) {
+		return nil, os.ErrNotExist
+	}
+	return f.FileSystem.Stat(ctx, name)
+}
+
+// OpenFile opens the files that aren't hidden, whose directory listings
+// leave out the hidden entries
+func (f hiddenFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if f.hidden(name) {
+		return nil, os.ErrNotExist
+	}
+	file, err := f.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return hiddenDir{File: file, fs: f, name: name}, nil
+}
+
+// hiddenDir filters the hidden entries out of a directory listing
+type hiddenDir struct {
+	webdav.File
+	fs   hiddenFS
+	name string
+}
+
+func (d hiddenDir) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := d.File.Readdir(count)
+	visible := infos[:0]
+	for _, info := range infos {
+		if !d.fs.hidden(path.Join(d.name, info.Name())) {
+			visible = append(visible, info)
+		}
+	}
+	return visible, err
+}
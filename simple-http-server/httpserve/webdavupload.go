@@ -0,0 +1,179 @@
+package httpserve
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/webdav"
+)
+
+// webdavRefusalKey is the context key of the error refusing a WebDAV write
+type webdavRefusalKey struct{}
+
+// uploadFS sends the files written over WebDAV, by PUT or COPY, through the
+// upload filter, the quotas, the scanner and the plugins, as uploads are.
+// Files are written to a temporary file and only replace the target once
+// every check passed.
+type uploadFS struct {
+	webdav.FileSystem
+	h *fileHandler
+}
+
+// OpenFile opens files for reading as they are, and files for writing as
+// a temporary file committed on Close
+func (f uploadFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 {
+		return f.FileSystem.OpenFile(ctx, name, flag, perm)
+	}
+	// The WebDAV handler only ever replaces whole files
+	if flag&os.O_TRUNC == 0 {
+		return nil, refuseWebDAV(ctx, os.ErrPermission)
+	}
+	if f.h.upload.filter.deniedName(name) {
+		return nil, refuseWebDAV(ctx, errUploadType)
+	}
+	target := f.h.localPath(name)
+	parent := filepath.Dir(target)
+	if info, err := os.Stat(target); err == nil && info.IsDir() {
+		return nil, os.ErrInvalid
+	}
+	budget, err := f.h.quota.budget(parent)
+	if err != nil {
+		return nil, refuseWebDAV(ctx, err)
+	}
+	tmp, err := os.CreateTemp(parent, ".upload-*")
+	if err != nil {
+		return nil, err
+	}
+	return &spooledFile{File: tmp, ctx: ctx, h: f.h, target: target, budget: budget}, nil
+}
+
+// Rename checks the new name of a file against the upload filter, so a
+// file can't be made executable by moving it
+func (f uploadFS) Rename(ctx context.Context, oldName, newName string) error {
+	info, err := f.FileSystem.Stat(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	if info.Mode().IsRegular() {
+		head, err := readHead(f.h.localPath(oldName))
+		if err != nil {
+			return err
+		}
+		if err := f.h.upload.filter.checkHead(newName, "", head); err != nil {
+			return refuseWebDAV(ctx, err)
+		}
+	}
+	return f.FileSystem.Rename(ctx, oldName, newName)
+}
+
+// spooledFile is a file being written over WebDAV
+type spooledFile struct {
+	*os.File
+	ctx     context.Context
+	h       *fileHandler
+	target  string
+	budget  int64
+	written int64
+	head    []byte
+	err     error
+}
+
+// Write writes to the temporary file, failing past the quota
+func (f *spooledFile) Write(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	if f.written+int64(len(p)) > f.budget {
+		if f.err = f.h.quota.exceeded(filepath.Dir(f.target)); f.err == nil {
+			f.err = errUploadTooLarge
+		}
+		return 0, refuseWebDAV(f.ctx, f.err)
+	}
+	if len(f.head) < 512 {
+		f.head = append(f.head, p[:min(len(p), 512-len(f.head))]...)
+	}
+	n, err := f.File.Write(p)
+	f.written += int64(n)
+	if err != nil {
+		f.err = err
+	}
+	return n, err
+}
+
+// Close checks the file written and moves it to its target
+func (f *spooledFile) Close() error {
+	defer os.Remove(f.File.Name())
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	if f.err != nil {
+		return f.err
+	}
+	if err := f.h.upload.filter.checkHead(f.target, "", f.head); err != nil {
+		return refuseWebDAV(f.ctx, err)
+	}
+	if _, err := f.h.commitFile(f.File.Name(), f.target, true); err != nil {
+		return refuseWebDAV(f.ctx, err)
+	}
+	f.h.quota.add(f.written)
+	return nil
+}
+
+// readHead returns the leading bytes of a file the upload filter sniffs
+func readHead(name string) ([]byte, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
+// refuseWebDAV records why a write was refused for webdavRefusalWriter,
+// returning err
+func refuseWebDAV(ctx context.Context, err error) error {
+	if refusal, ok := ctx.Value(webdavRefusalKey{}).(*error); ok && *refusal == nil {
+		*refusal = err
+	}
+	return err
+}
+
+// webdavRefusalWriter answers a refused WebDAV write with the status of
+// the refused upload, in place of the error the WebDAV handler writes
+type webdavRefusalWriter struct {
+	http.ResponseWriter
+	r       *http.Request
+	h       *fileHandler
+	refusal *error
+	refused bool
+}
+
+func (w *webdavRefusalWriter) WriteHeader(code int) {
+	if code >= http.StatusBadRequest && *w.refusal != nil {
+		w.refused = true
+		w.h.renderUploadError(w.ResponseWriter, w.r, *w.refusal)
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *webdavRefusalWriter) Write(b []byte) (int, error) {
+	if w.refused {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (w *webdavRefusalWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,117 @@
+package httpserve
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Webhook event names
+const (
+	eventUpload   = "upload"
+	eventDelete   = "delete"
+	eventDownload = "download"
+)
+
+// webhookEvent is the JSON body posted for each file event
+type webhookEvent struct {
+	Event     string    `json:"event"`
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	Client    string    `json:"client"`
+	User      string    `json:"user,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// webhookNotifier delivers file events to a URL in the background
+type webhookNotifier struct {
+	url             string
+	secret          []byte
+	minDownloadSize int64
+	client          *http.Client
+	events          chan webhookEvent
+	log             *serverLog
+}
+
+// newWebhookNotifier starts the delivery worker, returning nil when no URL
+// is configured
+func newWebhookNotifier(url, secret string, minDownloadSize int64, log *serverLog) *webhookNotifier {
+	if url == "" {
+		return nil
+	}
+	n := &webhookNotifier{
+		url:             url,
+		secret:          []byte(secret),
+		minDownloadSize: minDownloadSize,
+		client:          &http.Client{Timeout: 10 * time.Second},
+		log:             log,
+		events:          make(chan webhookEvent, 256),
+	}
+	go n.run()
+	return n
+}
+
+// notify queues an event without blocking the request, dropping it when the
+// queue is full
+func (n *webhookNotifier) notify(r *http.Request, event, path string, size int64) {
+	if n == nil {
+		return
+	}
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	user := RequestUser(r)
+	if user == "-" {
+		user = ""
+	}
+	e := webhookEvent{Event: event, Path: path, Size: size, Client: client, User: user, Timestamp: time.Now().UTC()}
+	select {
+	case n.events <- e:
+	default:
+		n.log.logf("Webhook queue full, dropping %s event for %s", event, path)
+	}
+}
+
+// notifyDownload reports completed downloads of at least the configured size
+func (n *webhookNotifier) notifyDownload(r *http.Request, status int, written int64) {
+	if n == nil || r.Method != http.MethodGet || written < n.minDownloadSize {
+		return
+	}
+	if status == http.StatusOK || status == http.StatusPartialContent {
+		n.notify(r, eventDownload, r.URL.Path, written)
+	}
+}
+
+// run delivers queued events one at a time
+func (n *webhookNotifier) run() {
+	for e := range n.events {
+		body, _ := json.Marshal(e)
+		req, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(body))
+		if err != nil {
+			n.log.logf("Error creating webhook request: %v", err)
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "simple-http-server")
+		if len(n.secret) > 0 {
+			mac := hmac.New(sha256.New, n.secret)
+			mac.Write(body)
+			req.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+		resp, err := n.client.Do(req)
+		if err != nil {
+			n.log.logf("Error delivering %s webhook for %s: %v", e.Event, e.Path, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			n.log.logf("Webhook for %s %s returned %d", e.Event, e.Path, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package httpserve
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webSocketGUID is appended to the client key to prove the handshake was
+// understood (RFC 6455 section 1.3)
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// wsMaxMessage bounds the messages read from clients
+const wsMaxMessage = 1 << 20
+
+// webSocket is the server side of a WebSocket connection. Writes may come
+// from several goroutines; reads from one.
+type webSocket struct {
+	conn net.Conn
+	r    *bufio.Reader
+	mu   sync.Mutex
+}
+
+// isWebSocketUpgrade reports whether a request asks for a WebSocket
+func isWebSocketUpgrade(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeWebSocket completes the opening handshake and takes over the
+// connection. On error nothing has been written, so callers can still
+// answer with an error page.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*webSocket, error) {
+	if r.Method != http.MethodGet || !isWebSocketUpgrade(r) {
+		return nil, errors.New("not a WebSocket handshake")
+	}
+	if r.ProtoMajor != 1 {
+		// HTTP/2 connections cannot be taken over
+		return nil, errors.New("WebSocket needs HTTP/1.1")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, errors.New("unsupported WebSocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, errors.New("invalid Sec-WebSocket-Key")
+	}
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	h := w.Header()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", base64.StdEncoding.EncodeToString(sum[:]))
+	w.WriteHeader(http.StatusSwitchingProtocols)
+	conn, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// The server timeouts no longer apply to the connection
+	conn.SetDeadline(time.Time{})
+	return &webSocket{conn: conn, r: buffered.Reader}, nil
+}
+
+// writeMessage sends one unfragmented frame
+func (ws *webSocket) writeMessage(opcode byte, payload []byte) error {
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := ws.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// writeJSON sends v as a text message
+func (ws *webSocket) writeJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ws.writeMessage(wsText, data)
+}
+
+// readMessage returns the next text or binary message, answering pings on
+// the way. It returns io.EOF once the client closed the connection.
+func (ws *webSocket) readMessage() (byte, []byte, error) {
+	var opcode byte
+	var message []byte
+	for {
+		fin, op, payload, err := ws.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch op {
+		case wsPing:
+			if err := ws.writeMessage(wsPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			// Echo the status code, as the closing handshake requires
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			ws.writeMessage(wsClose, payload)
+			return 0, nil, io.EOF
+		case wsContinuation:
+			if opcode == 0 {
+				return 0, nil, errors.New("unexpected continuation frame")
+			}
+		case wsText, wsBinary:
+			if opcode != 0 {
+				return 0, nil, errors.New("interleaved data frames")
+			}
+			opcode = op
+		default:
+			return 0, nil, fmt.Errorf("unknown opcode %#x", op)
+		}
+		if len(message)+len(payload) > wsMaxMessage {
+			return 0, nil, errors.New("message too large")
+		}
+		message = append(message, payload...)
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+// readFrame reads and unmasks one frame
+func (ws *webSocket) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(ws.r, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, opcode = header[0]&0x80 != 0, header[0]&0x0f
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, errors.New("unmasked client frame")
+	}
+	n := uint64(header[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > wsMaxMessage || opcode >= wsClose && n > 125 {
+		return false, 0, nil, errors.New("frame too large")
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.r, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(ws.r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// close sends a close frame with the status code and reason, then drops
+// the connection
+func (ws *webSocket) close(code uint16, reason string) {
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	ws.writeMessage(wsClose, append(payload, reason...))
+	ws.conn.Close()
+}
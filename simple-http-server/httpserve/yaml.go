@@ -0,0 +1,547 @@
+package httpserve
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseYAML parses the subset of YAML the configuration files need: block
+// mappings and sequences, flow collections, plain and quoted scalars,
+// literal and folded block scalars, and comments. Anchors, tags and
+// multiple documents are not supported. Mappings become map[string]any,
+// sequences []any, and scalars string, int64, float64, bool or nil.
+func parseYAML(data []byte) (any, error) {
+	text := strings.ReplaceAll(strings.TrimPrefix(string(data), "\ufeff"), "\r\n", "\n")
+	p := &yamlParser{lines: strings.Split(text, "\n")}
+	// --- may start the document and ... end it, though nothing may follow
+	content, ended := false, false
+	for i, line := range p.lines {
+		switch strings.TrimSpace(stripYAMLComment(line)) {
+		case "":
+		case "---":
+			if content || ended {
+				return nil, fmt.Errorf("line %d: multiple documents are not supported", i+1)
+			}
+			p.lines[i] = ""
+		case "...":
+			ended = true
+			p.lines[i] = ""
+		default:
+			if ended {
+				return nil, fmt.Errorf("line %d: multiple documents are not supported", i+1)
+			}
+			content = true
+		}
+	}
+	v, err := p.node(0)
+	if err != nil {
+		return nil, err
+	}
+	if indent, _, ok := p.peek(); ok {
+		return nil, fmt.Errorf("line %d: unexpected indentation %d", p.pos+1, indent)
+	}
+	return v, nil
+}
+
+// decodeYAML parses YAML into v as encoding/json would the same document
+// written as JSON
+func decodeYAML(data []byte, v any) error {
+	doc, err := parseYAML(data)
+	if err != nil {
+		return err
+	}
+	asJSON, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(strings.NewReader(string(asJSON)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		// The document was not written as JSON
+		return errors.New(strings.TrimPrefix(err.Error(), "json: "))
+	}
+	return nil
+}
+
+type yamlParser struct {
+	lines []string
+	pos   int
+}
+
+// peek returns the indentation and text of the next line holding more than
+// a comment, without consuming it
+func (p *yamlParser) peek() (indent int, text string, ok bool) {
+	for ; p.pos < len(p.lines); p.pos++ {
+		line := p.lines[p.pos]
+		body := strings.TrimLeft(line, " ")
+		if body == "" || body[0] == '#' {
+			continue
+		}
+		if body[0] == '\t' {
+			// A tab can't indent YAML, but is only an error on a line with
+			// content
+			if strings.TrimSpace(body) == "" {
+				continue
+			}
+			return len(line) - len(body), body, true
+		}
+		return len(line) - len(body), strings.TrimRight(body, " \t"), true
+	}
+	return 0, "", false
+}
+
+func (p *yamlParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("line %d: %s", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+// node parses the value starting on the next line, indented at least
+// minIndent
+func (p *yamlParser) node(minIndent int) (any, error) {
+	indent, text, ok := p.peek()
+	if !ok || indent < minIndent {
+		return nil, nil
+	}
+	if text[0] == '\t' {
+		return nil, p.errorf("tabs cannot indent YAML")
+	}
+	if isYAMLSequenceItem(text) {
+		return p.sequence(indent)
+	}
+	if _, _, isKey, err := splitYAMLKey(text); err != nil {
+		return nil, p.errorf("%v", err)
+	} else if isKey {
+		return p.mapping(indent)
+	}
+	p.pos++
+	return p.inline(indent, text)
+}
+
+// mapping parses the keys indented by indent
+func (p *yamlParser) mapping(indent int) (any, error) {
+	m := make(map[string]any)
+	for {
+		lineIndent, text, ok := p.peek()
+		if !ok || lineIndent < indent {
+			return m, nil
+		}
+		if lineIndent > indent {
+			return nil, p.errorf("unexpected indentation")
+		}
+		if text[0] == '\t' {
+			return nil, p.errorf("tabs cannot indent YAML")
+		}
+		key, rest, isKey, err := splitYAMLKey(text)
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		if !isKey {
+			return nil, p.errorf("expected a key, found %q", text)
+		}
+		if _, dup := m[key]; dup {
+			return nil, p.errorf("duplicate key %q", key)
+		}
+		p.pos++
+		var value any
+		switch rest = strings.TrimSpace(stripYAMLComment(rest)); {
+		case rest != "":
+			value, err = p.inline(indent, rest)
+		default:
+			// A sequence may sit at the indentation of its key
+			if next, nextText, ok := p.peek(); ok && next == indent && isYAMLSequenceItem(nextText) {
+				value, err = p.sequence(indent)
+			} else {
+				value, err = p.node(indent + 1)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		m[key] = value
+	}
+}
+
+// sequence parses the items indented by indent
+func (p *yamlParser) sequence(indent int) (any, error) {
+	s := []any{}
+	for {
+		lineIndent, text, ok := p.peek()
+		if !ok || lineIndent < indent {
+			return s, nil
+		}
+		if lineIndent > indent {
+			return nil, p.errorf("unexpected indentation")
+		}
+		if !isYAMLSequenceItem(text) {
+			return s, nil
+		}
+		rest := strings.TrimLeft(text[1:], " ")
+		var item any
+		var err error
+		if rest == "" || rest[0] == '#' {
+			p.pos++
+			item, err = p.node(indent + 1)
+		} else {
+			// The item goes on as if its first line started where its
+			// content does, which nests the mappings written as "- key: v"
+			p.lines[p.pos] = strings.Repeat(" ", indent+len(text)-len(rest)) + rest
+			item, err = p.node(indent + 1)
+		}
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, item)
+	}
+}
+
+// inline parses the value written after a key or on its own line: a block
+// scalar header, a flow collection, possibly over several lines, or a
+// scalar
+func (p *yamlParser) inline(indent int, text string) (any, error) {
+	// The line of the value was consumed already
+	line := p.pos
+	errorf := func(format string, args ...any) error {
+		return fmt.Errorf("line %d: %s", line, fmt.Sprintf(format, args...))
+	}
+	text = strings.TrimSpace(stripYAMLComment(text))
+	if text == "" {
+		return nil, nil
+	}
+	switch text[0] {
+	case '|', '>':
+		return p.blockScalar(indent, text)
+	case '{', '[':
+		// A flow collection ends where its brackets balance
+		for !yamlFlowClosed(text) {
+			if p.pos >= len(p.lines) {
+				return nil, errorf("unterminated flow collection")
+			}
+			text += " " + strings.TrimSpace(stripYAMLComment(p.lines[p.pos]))
+			p.pos++
+		}
+		f := &yamlFlow{s: text}
+		v, err := f.value()
+		if err != nil {
+			return nil, errorf("%v", err)
+		}
+		if f.skipSpace(); f.i < len(f.s) {
+			return nil, errorf("unexpected %q after flow collection", f.s[f.i:])
+		}
+		return v, nil
+	case '&', '*', '!':
+		return nil, errorf("anchors, aliases and tags are not supported")
+	}
+	v, err := yamlScalar(text)
+	if err != nil {
+		return nil, errorf("%v", err)
+	}
+	return v, nil
+}
+
+// blockScalar parses a literal (|) or folded (>) block scalar, the lines
+// indented deeper than its key
+func (p *yamlParser) blockScalar(indent int, header string) (any, error) {
+	style, chomp := header[0], byte(0)
+	if len(header) > 1 {
+		chomp = header[1]
+		if len(header) > 2 || (chomp != '-' && chomp != '+') {
+			return nil, fmt.Errorf("line %d: unsupported block scalar header %q", p.pos, header)
+		}
+	}
+	var lines []string
+	blockIndent := -1
+	for ; p.pos < len(p.lines); p.pos++ {
+		line := p.lines[p.pos]
+		body := strings.TrimLeft(line, " ")
+		if body == "" {
+			lines = append(lines, "")
+			continue
+		}
+		lineIndent := len(line) - len(body)
+		if blockIndent < 0 {
+			if lineIndent <= indent {
+				break
+			}
+			blockIndent = lineIndent
+		}
+		if lineIndent < blockIndent {
+			break
+		}
+		lines = append(lines, line[blockIndent:])
+	}
+	// Trailing blank lines belong to the chomping, and lines after them to
+	// whatever comes next
+	content := len(lines)
+	for content > 0 && lines[content-1] == "" {
+		content--
+	}
+	trailing := len(lines) - content
+	lines = lines[:content]
+	var b strings.Builder
+	for i, line := range lines {
+		switch {
+		case i == 0:
+		case style == '|' || line == "" || lines[i-1] == "" || strings.HasPrefix(line, " "):
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(' ')
+		}
+		b.WriteString(line)
+	}
+	s := b.String()
+	if style == '>' {
+		// Folded blank lines stand for the line breaks themselves
+		s = strings.ReplaceAll(s, "\n\n", "\n")
+	}
+	switch {
+	case chomp == '-' || s == "":
+	case chomp == '+':
+		s += strings.Repeat("\n", trailing+1)
+	default:
+		s += "\n"
+	}
+	return s, nil
+}
+
+// isYAMLSequenceItem reports whether a line starts a sequence item
+func isYAMLSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// splitYAMLKey splits a "key: value" line, reporting whether it is one
+func splitYAMLKey(text string) (key, rest string, ok bool, err error) {
+	if text[0] == '"' || text[0] == '\'' {
+		end := yamlQuoteEnd(text)
+		if end < 0 {
+			return "", "", false, errors.New("unterminated quoted string")
+		}
+		after := text[end+1:]
+		if after != ":" && !strings.HasPrefix(after, ": ") {
+			return "", "", false, nil
+		}
+		v, err := yamlScalar(text[:end+1])
+		if err != nil {
+			return "", "", false, err
+		}
+		return v.(string), strings.TrimSpace(after[1:]), true, nil
+	}
+	if text[0] == '{' || text[0] == '[' || text[0] == '#' {
+		return "", "", false, nil
+	}
+	for i := 0; i < len(text); i++ {
+		switch {
+		case text[i] == '#' && i > 0 && text[i-1] == ' ':
+			return "", "", false, nil
+		case text[i] == ':' && (i == len(text)-1 || text[i+1] == ' '):
+			return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), true, nil
+		}
+	}
+	return "", "", false, nil
+}
+
+// yamlQuoteEnd returns the index of the quote closing the string s starts
+// with, or -1
+func yamlQuoteEnd(s string) int {
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case quote == '"' && s[i] == '\\':
+			i++
+		case s[i] == quote && quote == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			i++
+		case s[i] == quote:
+			return i
+		}
+	}
+	return -1
+}
+
+// stripYAMLComment cuts a comment off a line, leaving # in quoted strings
+func stripYAMLComment(line string) string {
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '"', '\'':
+			if i > 0 && line[i-1] != ' ' && !strings.ContainsRune("[{,:", rune(line[i-1])) {
+				continue
+			}
+			if end := yamlQuoteEnd(line[i:]); end >= 0 {
+				i += end
+			}
+		case '#':
+			if i == 0 || line[i-1] == ' ' || line[i-1] == '\t' {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+// yamlFlowClosed reports whether the brackets of a flow collection balance
+func yamlFlowClosed(s string) bool {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"', '\'':
+			end := yamlQuoteEnd(s[i:])
+			if end < 0 {
+				return false
+			}
+			i += end
+		case '{', '[':
+			depth++
+		case '}', ']':
+			depth--
+		}
+	}
+	return depth <= 0
+}
+
+// yamlScalar parses a scalar: quoted strings, null, booleans, numbers and
+// plain strings
+func yamlScalar(s string) (any, error) {
+	switch s[0] {
+	case '"':
+		if yamlQuoteEnd(s) != len(s)-1 {
+			return nil, fmt.Errorf("invalid quoted string %s", s)
+		}
+		var v string
+		if err := json.Unmarshal([]byte(s), &v); err == nil {
+			return v, nil
+		}
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quoted string %s", s)
+		}
+		return v, nil
+	case '\'':
+		if yamlQuoteEnd(s) != len(s)-1 {
+			return nil, fmt.Errorf("invalid quoted string %s", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	}
+	switch s {
+	case "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if c := s[0]; c >= '0' && c <= '9' || c == '-' || c == '+' || c == '.' {
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n, nil
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil && !strings.ContainsAny(s, "_xXpP") {
+			return f, nil
+		}
+	}
+	return s, nil
+}
+
+// yamlFlow parses a flow collection such as {a: 1, b: [x, y]}, JSON
+// included
+type yamlFlow struct {
+	s string
+	i int
+}
+
+func (f *yamlFlow) skipSpace() {
+	for f.i < len(f.s) && (f.s[f.i] == ' ' || f.s[f.i] == '\t') {
+		f.i++
+	}
+}
+
+func (f *yamlFlow) value() (any, error) {
+	f.skipSpace()
+	if f.i >= len(f.s) {
+		return nil, errors.New("unexpected end of flow collection")
+	}
+	switch f.s[f.i] {
+	case '{':
+		return f.collection('}')
+	case '[':
+		return f.collection(']')
+	}
+	return f.scalar(false)
+}
+
+// collection parses a mapping or sequence up to its closing bracket
+func (f *yamlFlow) collection(closing byte) (any, error) {
+	f.i++
+	m := make(map[string]any)
+	s := []any{}
+	for {
+		f.skipSpace()
+		if f.i < len(f.s) && f.s[f.i] == closing {
+			f.i++
+			if closing == '}' {
+				return m, nil
+			}
+			return s, nil
+		}
+		if closing == '}' {
+			k, err := f.scalar(true)
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				key = fmt.Sprint(k)
+			}
+			f.skipSpace()
+			if f.i >= len(f.s) || f.s[f.i] != ':' {
+				return nil, fmt.Errorf("expected : after key %q", key)
+			}
+			f.i++
+			v, err := f.value()
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+		} else {
+			v, err := f.value()
+			if err != nil {
+				return nil, err
+			}
+			s = append(s, v)
+		}
+		f.skipSpace()
+		switch {
+		case f.i < len(f.s) && f.s[f.i] == ',':
+			f.i++
+		case f.i < len(f.s) && f.s[f.i] == closing:
+		default:
+			return nil, fmt.Errorf("expected , or %c in flow collection", closing)
+		}
+	}
+}
+
+// scalar parses a quoted or plain scalar, a plain key ending at a colon
+func (f *yamlFlow) scalar(key bool) (any, error) {
+	f.skipSpace()
+	start := f.i
+	if f.i < len(f.s) && (f.s[f.i] == '"' || f.s[f.i] == '\'') {
+		end := yamlQuoteEnd(f.s[f.i:])
+		if end < 0 {
+			return nil, errors.New("unterminated quoted string")
+		}
+		f.i += end + 1
+		return yamlScalar(f.s[start:f.i])
+	}
+	for f.i < len(f.s) && !strings.ContainsRune(",]}", rune(f.s[f.i])) {
+		if f.s[f.i] == ':' && (key || f.i+1 == len(f.s) || f.s[f.i+1] == ' ') {
+			break
+		}
+		f.i++
+	}
+	text := strings.TrimSpace(f.s[start:f.i])
+	if text == "" {
+		if key {
+			return nil, errors.New("empty key in flow collection")
+		}
+		return nil, nil
+	}
+	return yamlScalar(text)
+}
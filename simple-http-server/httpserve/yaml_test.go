@@ -0,0 +1,85 @@
+package httpserve
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name, src string
+		want      any
+	}{
+		{"scalars", "a: 1\nb: -2.5\nc: true\nd: ~\ne: hello world\nf: '0123'\ng: \"tab\\t\"",
+			map[string]any{"a": int64(1), "b": -2.5, "c": true, "d": nil, "e": "hello world", "f": "0123", "g": "tab\t"}},
+		{"nested mapping", "server:\n  port: 8080\n  tls:\n    enabled: false",
+			map[string]any{"server": map[string]any{"port": int64(8080), "tls": map[string]any{"enabled": false}}}},
+		{"sequence of mappings", "routes:\n  - path: /a\n    status: 200\n  - path: /b",
+			map[string]any{"routes": []any{map[string]any{"path": "/a", "status": int64(200)}, map[string]any{"path": "/b"}}}},
+		{"sequence at the top", "- a\n- b # comment\n- 'c # not a comment'",
+			[]any{"a", "b", "c # not a comment"}},
+		{"flow collections", "a: {x: 1, y: [2, \"three\"]}\nb: []",
+			map[string]any{"a": map[string]any{"x": int64(1), "y": []any{int64(2), "three"}}, "b": []any{}}},
+		{"flow over several lines", "a: [1,\n  2,\n  3]",
+			map[string]any{"a": []any{int64(1), int64(2), int64(3)}}},
+		{"literal block", "body: |\n  line one\n  line two\nnext: 1",
+			map[string]any{"body": "line one\nline two\n", "next": int64(1)}},
+		{"folded block", "body: >\n  one\n  two\n",
+			map[string]any{"body": "one two\n"}},
+		{"document markers and CRLF", "---\r\na: 1\r\n...\r\n",
+			map[string]any{"a": int64(1)}},
+		{"colon inside a value", "url: http://example.com:8080/x",
+			map[string]any{"url": "http://example.com:8080/x"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseYAML([]byte(tt.src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name, src, want string
+	}{
+		{"multiple documents", "a: 1\n---\nb: 2", "multiple documents"},
+		{"content after the end", "a: 1\n...\nb: 2", "multiple documents"},
+		{"bad indentation", "a:\n    b: 1\n  c: 2", "indentation"},
+		{"unterminated quote", "a: \"open", "quoted string"},
+		{"unclosed flow", "a: [1, 2", "flow"},
+		{"missing flow separator", "a: {x: 1 y: 2}", "expected"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseYAML([]byte(tt.src))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeYAML(t *testing.T) {
+	var v struct {
+		Routes []struct {
+			Path   string `json:"path"`
+			Status int    `json:"status"`
+		} `json:"routes"`
+	}
+	if err := decodeYAML([]byte("routes:\n  - path: /a\n    status: 201"), &v); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Routes) != 1 || v.Routes[0].Path != "/a" || v.Routes[0].Status != 201 {
+		t.Errorf("got %+v", v)
+	}
+	if err := decodeYAML([]byte("unknown: 1"), &v); err == nil || strings.HasPrefix(err.Error(), "json:") {
+		t.Errorf("got error %v for an unknown field", err)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jeffersfp/golang-studies/simple-http-server/httpserve"
+)
+
+// harFile is the part of a HAR file the replay subcommand reads, from
+// --record or from a browser
+type harFile struct {
+	Log struct {
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	Request         struct {
+		Method  string `json:"method"`
+		URL     string `json:"url"`
+		Headers []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"headers"`
+		PostData *struct {
+			MimeType  string `json:"mimeType"`
+			Text      string `json:"text"`
+			Encoding  string `json:"_encoding"`
+			Truncated bool   `json:"_truncated"`
+		} `json:"postData"`
+	} `json:"request"`
+	Response struct {
+		Status int `json:"status"`
+	} `json:"response"`
+}
+
+// replayedHeaders are the recorded headers left for the client to set
+var replayedHeaders = map[string]bool{
+	"host": true, "content-length": true, "connection": true, "keep-alive": true,
+	"transfer-encoding": true, "upgrade": true, "te": true, "accept-encoding": true,
+}
+
+// runReplay implements the replay subcommand, which sends the requests of a
+// HAR file to another server and compares the statuses with the recorded
+// ones
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	target := fs.String("target", "", "Base URL of the server to send the requests to, e.g. https://cdn.example.com (required)")
+	keepHost := fs.Bool("keep-host", false, "Send the recorded Host header instead of the host of --target")
+	pace := fs.Bool("pace", false, "Wait between requests as long as between the recorded ones")
+	timeout := fs.Duration("timeout", 30*time.Second, "Timeout of each request")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s replay --target URL [options] FILE.har\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *target == "" || fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	base, err := url.Parse(*target)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		fmt.Fprintf(os.Stderr, "Error in replay options: invalid --target %q, expected an http or https URL\n", *target)
+		return 2
+	}
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading HAR file: %v\n", err)
+		return 1
+	}
+	var har harFile
+	if err := json.Unmarshal(data, &har); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading HAR file: %v\n", err)
+		return 1
+	}
+
+	client := &http.Client{
+		Timeout:   *timeout,
+		Transport: &http.Transport{DisableCompression: true},
+		// Redirects are compared as recorded, not followed
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	fmt.Printf("Replaying %d requests against %s\n", len(har.Log.Entries), base)
+	var matched, mismatched, failed, skipped int
+	var received int64
+	start := time.Now()
+	for i, e := range har.Log.Entries {
+		if *pace && i > 0 {
+			wait := e.StartedDateTime.Sub(har.Log.Entries[0].StartedDateTime) - time.Since(start)
+			time.Sleep(max(wait, 0))
+		}
+		req, err := replayRequest(e, base, *keepHost)
+		if err != nil {
+			fmt.Printf("skip  %s %s: %v\n", e.Request.Method, e.Request.URL, err)
+			skipped++
+			continue
+		}
+		began := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			fmt.Printf("FAIL  %s %s: %v\n", req.Method, req.URL, err)
+			failed++
+			continue
+		}
+		n, _ := io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		received += n
+		elapsed := time.Since(began).Round(time.Millisecond)
+		if resp.StatusCode == e.Response.Status {
+			fmt.Printf("ok    %s %s %d %s\n", req.Method, req.URL.RequestURI(), resp.StatusCode, elapsed)
+			matched++
+		} else {
+			fmt.Printf("DIFF  %s %s %d, recorded %d %s\n", req.Method, req.URL.RequestURI(), resp.StatusCode, e.Response.Status, elapsed)
+			mismatched++
+		}
+	}
+	fmt.Printf("\n%d matched, %d differed, %d failed, %d skipped in %s (%s received)\n",
+		matched, mismatched, failed, skipped, time.Since(start).Round(time.Millisecond), httpserve.FormatSize(received))
+	if mismatched > 0 || failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// replayRequest rebuilds a recorded request for the target server
+func replayRequest(e harEntry, base *url.URL, keepHost bool) (*http.Request, error) {
+	recorded, err := url.Parse(e.Request.URL)
+	if err != nil {
+		return nil, err
+	}
+	u := *base
+	u.Path = strings.TrimSuffix(base.Path, "/") + recorded.Path
+	u.RawPath = ""
+	if recorded.RawPath != "" {
+		u.RawPath = strings.TrimSuffix(base.EscapedPath(), "/") + recorded.RawPath
+	}
+	u.RawQuery = recorded.RawQuery
+	var body io.Reader
+	if p := e.Request.PostData; p != nil {
+		if p.Truncated {
+			return nil, errors.New("the body was only recorded in part")
+		}
+		raw := []byte(p.Text)
+		if p.Encoding == "base64" {
+			if raw, err = base64.StdEncoding.DecodeString(p.Text); err != nil {
+				return nil, err
+			}
+		}
+		body = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequest(e.Request.Method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range e.Request.Headers {
+		name := strings.ToLower(h.Name)
+		switch {
+		case name == "host" && keepHost:
+			req.Host = h.Value
+		case replayedHeaders[name] || strings.HasPrefix(name, ":"):
+		case h.Value == "***":
+			// Redacted by --record without --record-credentials
+		default:
+			req.Header.Add(h.Name, h.Value)
+		}
+	}
+	if keepHost && req.Host == "" {
+		req.Host = recorded.Host
+	}
+	return req, nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jeffersfp/golang-studies/simple-http-server/httpserve"
+)
+
+// shareAlphabet is what generated passwords are made of, leaving out the
+// letters and digits easily mistaken for one another on a phone
+const shareAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// sharePrompter asks questions on the terminal, taking the default answer
+// for a question left empty
+type sharePrompter struct {
+	in  *bufio.Reader
+	eof bool
+}
+
+// ask prints a question and returns the answer, or def
+func (p *sharePrompter) ask(question, def string) string {
+	if def != "" {
+		fmt.Printf("%s [%s]: ", question, def)
+	} else {
+		fmt.Printf("%s: ", question)
+	}
+	if p.eof {
+		fmt.Println()
+		return def
+	}
+	line, err := p.in.ReadString('\n')
+	if err == io.EOF {
+		p.eof = true
+		fmt.Println()
+	}
+	if line = strings.TrimSpace(line); line == "" {
+		return def
+	}
+	return line
+}
+
+// askUntil asks again until valid accepts the answer, failing once the
+// input ended on an invalid one
+func (p *sharePrompter) askUntil(question, def string, valid func(string) error) (string, error) {
+	for {
+		answer := p.ask(question, def)
+		err := valid(answer)
+		if err == nil {
+			return answer, nil
+		}
+		if p.eof {
+			return "", err
+		}
+		fmt.Printf("  %v\n", err)
+	}
+}
+
+// runShare implements the share subcommand, which asks what to share and
+// how to protect it, then serves it with a QR code of the URL
+func runShare(args []string) int {
+	fs := flag.NewFlagSet("share", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s share [DIR]\n\nAsks which directory to share, how to protect it and on which port, then serves it.\n", os.Args[0])
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+	defaultDir := "."
+	if fs.NArg() == 1 {
+		defaultDir = fs.Arg(0)
+	}
+	p := &sharePrompter{in: bufio.NewReader(os.Stdin)}
+	cfg := httpserve.DefaultConfig()
+	fail := func(err error) int {
+		fmt.Fprintf(os.Stderr, "Error in share options: %v\n", err)
+		return 1
+	}
+
+	dir, err := p.askUntil("Directory to share", defaultDir, func(dir string) error {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+		return nil
+	})
+	if err != nil {
+		return fail(err)
+	}
+	if cfg.Dir, err = filepath.Abs(dir); err != nil {
+		return fail(err)
+	}
+
+	fmt.Println("How should visitors get in?")
+	fmt.Println("  1) with a user name and a generated password")
+	fmt.Println("  2) with a link that expires")
+	fmt.Println("  3) freely, anyone on the network can open it")
+	access, err := p.askUntil("Choice", "1", func(s string) error {
+		if s != "1" && s != "2" && s != "3" {
+			return errors.New("answer 1, 2 or 3")
+		}
+		return nil
+	})
+	if err != nil {
+		return fail(err)
+	}
+	var user, password string
+	switch access {
+	case "1":
+		user = p.ask("User name", "share")
+		if password, err = sharePassword(12); err != nil {
+			return fail(err)
+		}
+		cfg.Auth = []string{user + ":" + password}
+	case "2":
+		expiry, err := p.askUntil("Link valid for", "24h", func(s string) error {
+			if d, err := time.ParseDuration(s); err != nil || d <= 0 {
+				return errors.New("answer a duration such as 30m, 24h or 168h")
+			}
+			return nil
+		})
+		if err != nil {
+			return fail(err)
+		}
+		cfg.LinkExpiry, _ = time.ParseDuration(expiry)
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return fail(err)
+		}
+		cfg.LinkSecret = hex.EncodeToString(secret)
+	}
+
+	upload, err := p.askUntil("Let visitors upload files? (y/n)", "n", func(s string) error {
+		if s = strings.ToLower(s); s != "y" && s != "yes" && s != "n" && s != "no" {
+			return errors.New("answer y or n")
+		}
+		return nil
+	})
+	if err != nil {
+		return fail(err)
+	}
+	if strings.HasPrefix(strings.ToLower(upload), "y") {
+		cfg.Upload = true
+		cfg.Mode = "rw"
+	}
+
+	port, err := p.askUntil("Port", strconv.Itoa(freeSharePort(8080)), func(s string) error {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 65535 {
+			return errors.New("answer a port number from 1 to 65535")
+		}
+		ln, err := net.Listen("tcp", net.JoinHostPort(cfg.Addr, s))
+		if err != nil {
+			return fmt.Errorf("port %s is not free, try %d", s, freeSharePort(n+1))
+		}
+		ln.Close()
+		return nil
+	})
+	if err != nil {
+		return fail(err)
+	}
+	cfg.Port = port
+	cfg.QR = true
+
+	fmt.Println()
+	fmt.Printf("Sharing %s", cfg.Dir)
+	if cfg.Upload {
+		fmt.Print(", uploads allowed")
+	}
+	fmt.Println()
+	switch access {
+	case "1":
+		fmt.Printf("User: %s\nPassword: %s\n", user, password)
+	case "2":
+		fmt.Printf("Only the link below lets visitors in, for %s\n", cfg.LinkExpiry)
+	}
+	fmt.Println("Press Ctrl+C to stop sharing")
+	fmt.Println()
+	if err := httpserve.Run(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// sharePassword generates a password of n characters of shareAlphabet
+func sharePassword(n int) (string, error) {
+	// Bytes past the last whole multiple of the alphabet would favor its
+	// first letters
+	limit := 256 - 256%len(shareAlphabet)
+	password := make([]byte, 0, n)
+	b := make([]byte, 1)
+	for len(password) < n {
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		if int(b[0]) < limit {
+			password = append(password, shareAlphabet[int(b[0])%len(shareAlphabet)])
+		}
+	}
+	return string(password), nil
+}
+
+// freeSharePort returns the first port from port up that can be listened
+// on, or port itself when none of the next ones can
+func freeSharePort(port int) int {
+	for p := port; p < port+100 && p <= 65535; p++ {
+		if ln, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(p))); err == nil {
+			ln.Close()
+			return p
+		}
+	}
+	return port
+}
@@ -1,87 +1,49 @@
 package main
 
 import (
-	"context"
+	"errors"
 	"flag"
-	"fmt"
 	"log"
-	"net/http"
 	"os"
-	"os/signal"
-	"path/filepath"
-	"syscall"
+
+	"github.com/jeffersfp/golang-studies/simple-http-server/httpserve"
 )
 
 func main() {
-	// Parse CLI arguments
-	addr := flag.String("addr", "0.0.0.0", "IP Address to bind to")
-	port := flag.String("port", "8080", "Port to bind to")
-	dir := flag.String("dir", ".", "Directory to serve files from")
-	flag.Parse()
-
-	// Validate directory
-	absDir, err := filepath.Abs(*dir)
-	if err != nil {
-		log.Fatalf("Error resolving directory path: %v", err)
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		os.Exit(runBench(os.Args[2:]))
 	}
-	if _, err := os.Stat(absDir); os.IsNotExist(err) {
-		log.Fatalf("Directory does not exist: %s", absDir)
+	if len(os.Args) > 1 && os.Args[1] == "bundle" {
+		os.Exit(runBundle(os.Args[2:]))
 	}
-
-	// Create custom file server handler
-	fileServer := http.FileServer(http.Dir(absDir))
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
-			log.Printf("%s %s %d", r.Method, r.URL.Path, http.StatusMethodNotAllowed)
-			return
-		}
-
-		// Create a custom ResponseWriter to capture the status code
-		lrw := &loggingResponseWriter{
-			ResponseWriter: w,
-			statusCode:     http.StatusOK,
-		}
-		fileServer.ServeHTTP(lrw, r)
-		log.Printf("%s %s %d", r.Method, r.URL.Path, lrw.statusCode)
-	})
-
-	// Configure server
-	server := &http.Server{
-		Addr:    fmt.Sprintf("%s:%s", *addr, *port),
-		Handler: handler,
+	if len(os.Args) > 1 && os.Args[1] == "get" {
+		os.Exit(runGet(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "sync" {
+		os.Exit(runSync(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "share" {
+		os.Exit(runShare(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
 	}
 
-	// Start server in a goroutine
-	go func() {
-		log.Printf("Starting server on %s:%s serving files from %s", *addr, *port, absDir)
-		if err := server.ListenAndServe(); err != http.ErrServerClosed {
-			log.Fatalf("Error starting server: %v", err)
+	// Parse CLI arguments
+	cfg := httpserve.DefaultConfig()
+	cfg.RegisterFlags(flag.CommandLine)
+	flag.CommandLine.Parse(append(bundledArgs, os.Args[1:]...))
+	cfg.Content = bundledContent
+
+	// Exit with 3 when the server could not listen, so test harnesses can
+	// tell a taken port from a failure of the running server
+	if err := httpserve.Run(cfg); err != nil {
+		log.Printf("Error: %v", err)
+		var listenErr *httpserve.ListenError
+		if errors.As(err, &listenErr) {
+			os.Exit(3)
 		}
-	}()
-
-	// Set up graceful shutdown
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
-
-	// Wait for CTRL+C
-	<-stop
-
-	log.Println("Shutting down server...")
-	if err := server.Shutdown(context.Background()); err != nil {
-		log.Fatalf("Error shutting down server: %v", err)
+		os.Exit(1)
 	}
-	log.Println("Server stopped")
-}
-
-// loggingResponseWrite is a custom ResponseWriter that captures the status code
-type loggingResponseWriter struct {
-	http.ResponseWriter
-	statusCode int
-}
-
-// WriteHeader captures the status code before writing it
-func (lrw *loggingResponseWriter) WriteHeader(code int) {
-	lrw.statusCode = code
-	lrw.ResponseWriter.WriteHeader(code)
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// maxRequestSize is the largest job a POST accepts
+const maxRequestSize = 1 << 20
+
+// api serves the queue:
+//
+//	POST /jobs               enqueue {"task": "sleep", "payload": {...}, "max_attempts": 3}
+//	GET  /jobs?status=failed list the jobs, optionally in one state
+//	GET  /jobs/{id}          read a job
+//	GET  /status             count the jobs in each state
+type api struct {
+	queue       *queue
+	workers     int
+	maxAttempts int // when a job gives none
+}
+
+type jsonError struct {
+	Error string `json:"error"`
+}
+
+type enqueueRequest struct {
+	Task        string          `json:"task"`
+	Payload     json.RawMessage `json:"payload"`
+	MaxAttempts int             `json:"max_attempts"`
+}
+
+func (a *api) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /jobs", a.enqueue)
+	mux.HandleFunc("GET /jobs", a.list)
+	mux.HandleFunc("GET /jobs/{id}", a.get)
+	mux.HandleFunc("GET /status", a.status)
+	return mux
+}
+
+func (a *api) enqueue(w http.ResponseWriter, r *http.Request) {
+	var req enqueueRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, jsonError{Error: "invalid job: " + err.Error()})
+		return
+	}
+	if req.MaxAttempts < 0 {
+		writeJSON(w, http.StatusBadRequest, jsonError{Error: "max_attempts must be positive"})
+		return
+	}
+	if req.MaxAttempts == 0 {
+		req.MaxAttempts = a.maxAttempts
+	}
+	j, err := a.queue.enqueue(req.Task, req.Payload, req.MaxAttempts)
+	switch {
+	case errors.Is(err, errQueueFull):
+		w.Header().Set("Retry-After", "1")
+		writeJSON(w, http.StatusServiceUnavailable, jsonError{Error: err.Error()})
+		return
+	case err != nil:
+		writeJSON(w, http.StatusBadRequest, jsonError{Error: err.Error()})
+		return
+	}
+	w.Header().Set("Location", "/jobs/"+j.ID)
+	writeJSON(w, http.StatusAccepted, j)
+}
+
+func (a *api) list(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", statusQueued, statusRunning, statusRetrying, statusSucceeded, statusFailed:
+	default:
+		writeJSON(w, http.StatusBadRequest, jsonError{Error: "unknown status " + status})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]job{"jobs": a.queue.list(status)})
+}
+
+func (a *api) get(w http.ResponseWriter, r *http.Request) {
+	j, ok := a.queue.get(r.PathValue("id"))
+	if !ok {
+		writeJSON(w, http.StatusNotFound, jsonError{Error: "job not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, j)
+}
+
+func (a *api) status(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"workers": a.workers,
+		"waiting": len(a.queue.pending),
+		"jobs":    a.queue.counts(),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
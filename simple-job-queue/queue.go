@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Job states
+const (
+	statusQueued    = "queued"
+	statusRunning   = "running"
+	statusRetrying  = "retrying"
+	statusSucceeded = "succeeded"
+	statusFailed    = "failed"
+)
+
+// errQueueFull is returned by enqueue when no more jobs can wait
+var errQueueFull = errors.New("queue full")
+
+// task runs a job of a kind, given its payload
+type task func(ctx context.Context, payload json.RawMessage) error
+
+// job is a unit of work and the record of its attempts
+type job struct {
+	ID          string          `json:"id"`
+	Task        string          `json:"task"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	LastError   string          `json:"last_error,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+	NextAttempt *time.Time      `json:"next_attempt,omitempty"`
+}
+
+// queue hands the jobs to its workers over a channel: the HTTP handlers are
+// the producers and the workers the consumers. Failed attempts go back on
+// the channel after an exponential backoff.
+type queue struct {
+	tasks       map[string]task
+	pending     chan *job
+	timeout     time.Duration // of each attempt
+	backoff     time.Duration // before the first retry, doubling after
+	maxBackoff  time.Duration
+	workersDone sync.WaitGroup
+
+	mu     sync.Mutex
+	jobs   map[string]*job
+	nextID int
+	timers map[string]*time.Timer // retries waiting for their backoff
+}
+
+func newQueue(tasks map[string]task, size int, timeout, backoff, maxBackoff time.Duration) *queue {
+	return &queue{
+		tasks:      tasks,
+		pending:    make(chan *job, size),
+		timeout:    timeout,
+		backoff:    backoff,
+		maxBackoff: maxBackoff,
+		jobs:       make(map[string]*job),
+		timers:     make(map[string]*time.Timer),
+	}
+}
+
+// enqueue adds a job, failing with errQueueFull rather than blocking the
+// request when the workers are behind
+func (q *queue) enqueue(name string, payload json.RawMessage, maxAttempts int) (job, error) {
+	if _, ok := q.tasks[name]; !ok {
+		return job{}, fmt.Errorf("unknown task %q", name)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now().UTC()
+	q.nextID++
+	j := &job{
+		ID:          strconv.Itoa(q.nextID),
+		Task:        name,
+		Payload:     payload,
+		Status:      statusQueued,
+		MaxAttempts: maxAttempts,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	select {
+	case q.pending <- j:
+	default:
+		q.nextID--
+		return job{}, errQueueFull
+	}
+	q.jobs[j.ID] = j
+	return *j, nil
+}
+
+// get returns a copy of a job
+func (q *queue) get(id string) (job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.jobs[id]
+	if !ok {
+		return job{}, false
+	}
+	return *j, true
+}
+
+// list returns copies of the jobs in a state, or of all of them, oldest
+// first
+func (q *queue) list(status string) []job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := make([]job, 0, len(q.jobs))
+	for _, j := range q.jobs {
+		if status == "" || j.Status == status {
+			jobs = append(jobs, *j)
+		}
+	}
+	sort.Slice(jobs, func(a, b int) bool {
+		x, _ := strconv.Atoi(jobs[a].ID)
+		y, _ := strconv.Atoi(jobs[b].ID)
+		return x < y
+	})
+	return jobs
+}
+
+// counts returns the number of jobs in each state
+func (q *queue) counts() map[string]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	counts := map[string]int{statusQueued: 0, statusRunning: 0, statusRetrying: 0, statusSucceeded: 0, statusFailed: 0}
+	for _, j := range q.jobs {
+		counts[j.Status]++
+	}
+	return counts
+}
+
+// start runs n workers until stop is cancelled. Running attempts get ctx,
+// cancelled separately so they may finish while the workers stop.
+func (q *queue) start(stop, ctx context.Context, n int) {
+	for i := 1; i <= n; i++ {
+		q.workersDone.Add(1)
+		go func() {
+			defer q.workersDone.Done()
+			for {
+				select {
+				case <-stop.Done():
+					return
+				case j := <-q.pending:
+					q.run(ctx, i, j)
+				}
+			}
+		}()
+	}
+}
+
+// wait blocks until the workers stopped, then drops the pending retries,
+// returning how many jobs were left unfinished
+func (q *queue) wait() int {
+	q.workersDone.Wait()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, t := range q.timers {
+		t.Stop()
+	}
+	n := 0
+	for _, j := range q.jobs {
+		if j.Status != statusSucceeded && j.Status != statusFailed {
+			n++
+		}
+	}
+	return n
+}
+
+// run makes one attempt at a job, scheduling a retry when it fails with
+// attempts left
+func (q *queue) run(ctx context.Context, worker int, j *job) {
+	q.mu.Lock()
+	j.Status, j.Attempts, j.NextAttempt, j.UpdatedAt = statusRunning, j.Attempts+1, nil, time.Now().UTC()
+	delete(q.timers, j.ID)
+	attempt, name, payload := j.Attempts, j.Task, j.Payload
+	q.mu.Unlock()
+
+	start := time.Now()
+	attemptCtx, cancel := context.WithTimeout(ctx, q.timeout)
+	err := runTask(attemptCtx, q.tasks[name], payload)
+	cancel()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j.UpdatedAt = time.Now().UTC()
+	switch {
+	case err == nil:
+		j.Status, j.LastError = statusSucceeded, ""
+		log.Printf("worker %d: job %s (%s) succeeded on attempt %d in %s", worker, j.ID, name, attempt, time.Since(start).Round(time.Millisecond))
+	case attempt >= j.MaxAttempts || ctx.Err() != nil:
+		j.Status, j.LastError = statusFailed, err.Error()
+		log.Printf("worker %d: job %s (%s) failed on attempt %d/%d: %v", worker, j.ID, name, attempt, j.MaxAttempts, err)
+	default:
+		delay := q.delay(attempt)
+		next := j.UpdatedAt.Add(delay)
+		j.Status, j.LastError, j.NextAttempt = statusRetrying, err.Error(), &next
+		q.timers[j.ID] = time.AfterFunc(delay, func() {
+			// Waiting on a full channel here would only hold the timer's
+			// goroutine, never a worker
+			q.pending <- j
+		})
+		log.Printf("worker %d: job %s (%s) failed on attempt %d/%d, retrying in %s: %v", worker, j.ID, name, attempt, j.MaxAttempts, delay.Round(time.Millisecond), err)
+	}
+}
+
+// delay returns the backoff after a failed attempt: doubling each time up
+// to maxBackoff, with up to 20% of jitter so failed jobs do not all come
+// back at once
+func (q *queue) delay(attempt int) time.Duration {
+	d := q.backoff
+	for i := 1; i < attempt && d < q.maxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, q.maxBackoff)
+	return d - time.Duration(rand.Int64N(int64(d)/5+1))
+}
+
+// runTask runs a task, turning a panic into an error
+func runTask(ctx context.Context, t task, payload json.RawMessage) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("panic: %v", v)
+		}
+	}()
+	return t(ctx, payload)
+}
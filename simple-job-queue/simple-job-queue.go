@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	// Parse CLI arguments
+	addr := flag.String("addr", "0.0.0.0", "IP Address to bind to")
+	port := flag.String("port", "8080", "Port to bind to")
+	workers := flag.Int("workers", 4, "Number of jobs run at once")
+	size := flag.Int("queue", 100, "Number of jobs waiting for a worker before enqueueing fails with 503")
+	maxAttempts := flag.Int("max-attempts", 3, "Attempts of a job that gives no max_attempts")
+	timeout := flag.Duration("timeout", 30*time.Second, "Time limit of each attempt")
+	backoff := flag.Duration("backoff", time.Second, "Wait before the first retry, doubling after each failure")
+	maxBackoff := flag.Duration("max-backoff", time.Minute, "Longest wait between retries")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "How long running jobs may finish on shutdown before they are cancelled")
+	flag.Parse()
+
+	if *workers < 1 || *size < 1 || *maxAttempts < 1 {
+		log.Fatalf("Error in queue options: --workers, --queue and --max-attempts must be positive")
+	}
+	if *timeout <= 0 || *backoff <= 0 || *maxBackoff < *backoff {
+		log.Fatalf("Error in queue options: --timeout and --backoff must be positive, and --max-backoff at least --backoff")
+	}
+
+	// Start the workers: stop ends their loop, while cancel aborts the jobs
+	// they are running
+	q := newQueue(demoTasks, *size, *timeout, *backoff, *maxBackoff)
+	stop, stopWorkers := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	q.start(stop, ctx, *workers)
+
+	// Configure server
+	a := &api{queue: q, workers: *workers, maxAttempts: *maxAttempts}
+	mux := a.routes()
+	server := &http.Server{
+		Addr: fmt.Sprintf("%s:%s", *addr, *port),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Create a custom ResponseWriter to capture the status code
+			lrw := &loggingResponseWriter{
+				ResponseWriter: w,
+				statusCode:     http.StatusOK,
+			}
+			mux.ServeHTTP(lrw, r)
+			log.Printf("%s %s %d", r.Method, r.URL.Path, lrw.statusCode)
+		}),
+	}
+
+	// Start server in a goroutine
+	go func() {
+		log.Printf("Starting job queue on %s:%s with %d workers", *addr, *port, *workers)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalf("Error starting server: %v", err)
+		}
+	}()
+
+	// Set up graceful shutdown
+	stopSignal := make(chan os.Signal, 1)
+	signal.Notify(stopSignal, os.Interrupt, syscall.SIGTERM)
+
+	// Wait for CTRL+C
+	<-stopSignal
+
+	log.Println("Shutting down server...")
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down server: %v", err)
+	}
+
+	// Let the running jobs finish, cancelling them past the timeout
+	stopWorkers()
+	done := make(chan int)
+	go func() { done <- q.wait() }()
+	var unfinished int
+	select {
+	case unfinished = <-done:
+	case <-shutdownCtx.Done():
+		log.Println("Cancelling running jobs")
+		cancel()
+		unfinished = <-done
+	}
+	cancel()
+	if unfinished > 0 {
+		log.Printf("Dropped %d unfinished jobs", unfinished)
+	}
+	log.Println("Server stopped")
+}
+
+// loggingResponseWrite is a custom ResponseWriter that captures the status code
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+// WriteHeader captures the status code before writing it
+func (lrw *loggingResponseWriter) WriteHeader(code int) {
+	lrw.statusCode = code
+	lrw.ResponseWriter.WriteHeader(code)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// demoTasks are the kinds of jobs the queue runs, standing in for real
+// work such as sending mail or resizing images
+var demoTasks = map[string]task{
+	"sleep": sleepTask,
+	"flaky": flakyTask,
+}
+
+// sleepPayload is the payload of both tasks; every field is optional
+type sleepPayload struct {
+	Duration string  `json:"duration"`  // how long the work takes, 1s by default
+	FailRate float64 `json:"fail_rate"` // chance of an attempt failing, for flaky
+}
+
+func parsePayload(payload json.RawMessage) (time.Duration, float64, error) {
+	var p sleepPayload
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return 0, 0, fmt.Errorf("invalid payload: %v", err)
+		}
+	}
+	d := time.Second
+	if p.Duration != "" {
+		var err error
+		if d, err = time.ParseDuration(p.Duration); err != nil || d < 0 {
+			return 0, 0, fmt.Errorf("invalid duration %q", p.Duration)
+		}
+	}
+	if p.FailRate < 0 || p.FailRate > 1 {
+		return 0, 0, fmt.Errorf("fail_rate must be between 0 and 1")
+	}
+	return d, p.FailRate, nil
+}
+
+// sleepTask waits for the duration, or until its context is done
+func sleepTask(ctx context.Context, payload json.RawMessage) error {
+	d, _, err := parsePayload(payload)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flakyTask is sleepTask failing at random, to watch the retries
+func flakyTask(ctx context.Context, payload json.RawMessage) error {
+	_, rate, err := parsePayload(payload)
+	if err != nil {
+		return err
+	}
+	if err := sleepTask(ctx, payload); err != nil {
+		return err
+	}
+	if rand.Float64() < rate {
+		return errors.New("simulated failure")
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// maxValueSize is the largest value a PUT accepts
+const maxValueSize = 1 << 20
+
+// api serves the store under /keys:
+//
+//	GET    /keys              list the keys
+//	GET    /keys/{key}        read a value
+//	PUT    /keys/{key}?ttl=1h store the JSON body, optionally expiring
+//	DELETE /keys/{key}        remove a key
+type api struct {
+	store *store
+}
+
+type jsonError struct {
+	Error string `json:"error"`
+}
+
+type entry struct {
+	Key       string          `json:"key"`
+	Value     json.RawMessage `json:"value"`
+	ExpiresAt *time.Time      `json:"expires_at,omitempty"`
+}
+
+func entryOf(key string, it item) entry {
+	e := entry{Key: key, Value: it.Value}
+	if !it.ExpiresAt.IsZero() {
+		e.ExpiresAt = &it.ExpiresAt
+	}
+	return e
+}
+
+func (a *api) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /keys", a.list)
+	mux.HandleFunc("GET /keys/{key}", a.get)
+	mux.HandleFunc("PUT /keys/{key}", a.put)
+	mux.HandleFunc("DELETE /keys/{key}", a.delete)
+	return mux
+}
+
+func (a *api) list(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string][]string{"keys": a.store.keys()})
+}
+
+func (a *api) get(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	it, ok := a.store.get(key)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, jsonError{Error: "key not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, entryOf(key, it))
+}
+
+func (a *api) put(w http.ResponseWriter, r *http.Request) {
+	var ttl time.Duration
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeJSON(w, http.StatusBadRequest, jsonError{Error: "ttl must be a positive duration, such as 30s or 1h"})
+			return
+		}
+		ttl = d
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxValueSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSON(w, http.StatusRequestEntityTooLarge, jsonError{Error: "value too large"})
+			return
+		}
+		writeJSON(w, http.StatusBadRequest, jsonError{Error: "error reading value"})
+		return
+	}
+	if !json.Valid(body) {
+		writeJSON(w, http.StatusBadRequest, jsonError{Error: "value must be valid JSON"})
+		return
+	}
+	key := r.PathValue("key")
+	it, created := a.store.set(key, json.RawMessage(body), ttl)
+	code := http.StatusOK
+	if created {
+		code = http.StatusCreated
+	}
+	writeJSON(w, code, entryOf(key, it))
+}
+
+func (a *api) delete(w http.ResponseWriter, r *http.Request) {
+	if !a.store.delete(r.PathValue("key")) {
+		writeJSON(w, http.StatusNotFound, jsonError{Error: "key not found"})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
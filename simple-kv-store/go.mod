@@ -0,0 +1,3 @@
+module github.com/jeffersfp/golang-studies/simple-kv-store
+
+go 1.26.0
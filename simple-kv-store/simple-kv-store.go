@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	// Parse CLI arguments
+	addr := flag.String("addr", "0.0.0.0", "IP Address to bind to")
+	port := flag.String("port", "8080", "Port to bind to")
+	data := flag.String("data", "kv.json", "Snapshot file, loaded at startup and written periodically and on shutdown (empty keeps the store in memory only)")
+	snapshotInterval := flag.Duration("snapshot-interval", 30*time.Second, "How often to write the snapshot, when the store changed")
+	sweepInterval := flag.Duration("sweep-interval", 10*time.Second, "How often to remove the expired keys")
+	flag.Parse()
+
+	if *snapshotInterval <= 0 || *sweepInterval <= 0 {
+		log.Fatalf("Error in interval options: intervals must be positive")
+	}
+
+	// Load the last snapshot
+	s := newStore()
+	if *data != "" {
+		if err := s.load(*data); err != nil {
+			log.Fatalf("Error loading snapshot: %v", err)
+		}
+	}
+	var saved uint64 // version of the last snapshot; the loaded one is 0
+
+	// Configure server
+	a := &api{store: s}
+	mux := a.routes()
+	server := &http.Server{
+		Addr: fmt.Sprintf("%s:%s", *addr, *port),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			// Create a custom ResponseWriter to capture the status code
+			lrw := &loggingResponseWriter{
+				ResponseWriter: w,
+				statusCode:     http.StatusOK,
+			}
+			mux.ServeHTTP(lrw, r)
+			log.Printf("%s %s %d %s", r.Method, r.URL.Path, lrw.statusCode, time.Since(start).Round(time.Microsecond))
+		}),
+	}
+
+	// Start server in a goroutine
+	go func() {
+		log.Printf("Starting key-value store on %s:%s with %d keys", *addr, *port, len(s.keys()))
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalf("Error starting server: %v", err)
+		}
+	}()
+
+	// Set up graceful shutdown
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	// Sweep and snapshot until CTRL+C
+	sweep := time.NewTicker(*sweepInterval)
+	defer sweep.Stop()
+	snapshot := time.NewTicker(*snapshotInterval)
+	defer snapshot.Stop()
+	for waiting := true; waiting; {
+		select {
+		case <-sweep.C:
+			if n := s.sweep(); n > 0 {
+				log.Printf("Removed %d expired keys", n)
+			}
+		case <-snapshot.C:
+			if *data == "" {
+				continue
+			}
+			v, err := s.save(*data, saved)
+			if err != nil {
+				log.Printf("Error writing snapshot: %v", err)
+				continue
+			}
+			saved = v
+		case <-stop:
+			waiting = false
+		}
+	}
+
+	log.Println("Shutting down server...")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Fatalf("Error shutting down server: %v", err)
+	}
+	if *data != "" {
+		if _, err := s.save(*data, saved); err != nil {
+			log.Fatalf("Error writing snapshot: %v", err)
+		}
+		log.Printf("Snapshot written to %s", *data)
+	}
+	log.Println("Server stopped")
+}
+
+// loggingResponseWrite is a custom ResponseWriter that captures the status code
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+// WriteHeader captures the status code before writing it
+func (lrw *loggingResponseWriter) WriteHeader(code int) {
+	lrw.statusCode = code
+	lrw.ResponseWriter.WriteHeader(code)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// item is a stored value; a zero ExpiresAt never expires
+type item struct {
+	Value     json.RawMessage `json:"value"`
+	ExpiresAt time.Time       `json:"expires_at,omitzero"`
+}
+
+func (it item) expired(now time.Time) bool {
+	return !it.ExpiresAt.IsZero() && !now.Before(it.ExpiresAt)
+}
+
+// store is an in-memory map of keys to JSON values, safe for concurrent
+// use. Expired items are invisible right away and removed by sweep.
+type store struct {
+	mu      sync.RWMutex
+	items   map[string]item
+	version uint64 // bumped by every change, to skip needless snapshots
+}
+
+func newStore() *store {
+	return &store{items: make(map[string]item)}
+}
+
+// get returns the item of a key, unless missing or expired
+func (s *store) get(key string) (item, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	it, ok := s.items[key]
+	if !ok || it.expired(time.Now()) {
+		return item{}, false
+	}
+	return it, true
+}
+
+// set stores a value, expiring after ttl unless it is zero, and reports
+// whether the key was new
+func (s *store) set(key string, value json.RawMessage, ttl time.Duration) (item, bool) {
+	it := item{Value: value}
+	if ttl > 0 {
+		it.ExpiresAt = time.Now().Add(ttl).UTC()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, exists := s.items[key]
+	s.items[key] = it
+	s.version++
+	return it, !exists || old.expired(time.Now())
+}
+
+// delete removes a key, reporting whether it was there
+func (s *store) delete(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it, ok := s.items[key]
+	if !ok {
+		return false
+	}
+	delete(s.items, key)
+	s.version++
+	return !it.expired(time.Now())
+}
+
+// keys returns the live keys, sorted
+func (s *store) keys() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	keys := make([]string, 0, len(s.items))
+	for key, it := range s.items {
+		if !it.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sweep removes the expired items, returning how many went
+func (s *store) sweep() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	n := 0
+	for key, it := range s.items {
+		if it.expired(now) {
+			delete(s.items, key)
+			n++
+		}
+	}
+	if n > 0 {
+		s.version++
+	}
+	return n
+}
+
+// save writes the live items to a JSON snapshot, through a temporary file
+// renamed over the previous one so a crash never leaves half a snapshot.
+// It returns the version saved, to pass as since next time: nothing is
+// written when the store has not changed.
+func (s *store) save(name string, since uint64) (uint64, error) {
+	s.mu.RLock()
+	version := s.version
+	if version == since {
+		s.mu.RUnlock()
+		return version, nil
+	}
+	now := time.Now()
+	items := make(map[string]item, len(s.items))
+	for key, it := range s.items {
+		if !it.expired(now) {
+			items[key] = it
+		}
+	}
+	data, err := json.MarshalIndent(items, "", "  ")
+	s.mu.RUnlock()
+	if err != nil {
+		return since, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return since, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return since, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return since, err
+	}
+	if err := tmp.Close(); err != nil {
+		return since, err
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return since, err
+	}
+	return version, nil
+}
+
+// load reads a snapshot written by save, skipping the items that expired
+// meanwhile. A missing file is an empty store.
+func (s *store) load(name string) error {
+	data, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var items map[string]item
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for key, it := range items {
+		if !it.expired(now) {
+			s.items[key] = it
+		}
+	}
+	return nil
+}
@@ -0,0 +1,3 @@
+module github.com/jeffersfp/golang-studies/simple-reverse-proxy
+
+go 1.26.0
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// route forwards the requests for a host and path prefix to an upstream
+// server
+type route struct {
+	host   string // empty for any host, or *.example.com for its subdomains
+	prefix string
+	target *url.URL
+	proxy  *httputil.ReverseProxy
+}
+
+// routes are the --route rules, the most specific first
+type routes []*route
+
+// headerRule sets a header to a value, or removes it when the value is
+// empty
+type headerRule struct {
+	name, value string
+}
+
+// parseRoutes parses [host]/prefix=URL values. A target without a path
+// receives the full request path, while a target with one, even just "/",
+// gets it in place of the prefix.
+func parseRoutes(values []string, requestHeaders, responseHeaders []headerRule) (routes, error) {
+	var rs routes
+	for _, value := range values {
+		rule, target, ok := strings.Cut(value, "=")
+		if !ok || rule == "" || target == "" {
+			return nil, fmt.Errorf("invalid route %q, expected [host]/prefix=http://host:port", value)
+		}
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid route target %q, expected an http or https URL", target)
+		}
+		host, prefix := rule, "/"
+		if i := strings.Index(rule, "/"); i >= 0 {
+			host, prefix = rule[:i], rule[i:]
+		}
+		r := &route{host: strings.ToLower(host), prefix: "/" + strings.Trim(prefix, "/"), target: u}
+		r.proxy = &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				r.rewrite(pr)
+				applyHeaders(pr.Out.Header, requestHeaders)
+			},
+			ModifyResponse: func(resp *http.Response) error {
+				applyHeaders(resp.Header, responseHeaders)
+				return r.rewriteResponse(resp)
+			},
+			// Stream server-sent events and chunked responses as they come
+			FlushInterval: -1,
+			ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+				log.Printf("Error proxying %s %s to %s: %v", req.Method, req.URL.Path, u.Host, err)
+				http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			},
+		}
+		rs = append(rs, r)
+	}
+	// Exact hosts before wildcards before any host, then longest prefix
+	rank := func(r *route) int {
+		switch {
+		case r.host == "":
+			return 2
+		case strings.HasPrefix(r.host, "*."):
+			return 1
+		}
+		return 0
+	}
+	sort.SliceStable(rs, func(i, j int) bool {
+		if a, b := rank(rs[i]), rank(rs[j]); a != b {
+			return a < b
+		}
+		return len(rs[i].prefix) > len(rs[j].prefix)
+	})
+	return rs, nil
+}
+
+// parseHeaderRules parses 'Name: value' values
+func parseHeaderRules(values []string) ([]headerRule, error) {
+	var rules []headerRule
+	for _, value := range values {
+		name, v, ok := strings.Cut(value, ":")
+		if name = strings.TrimSpace(name); !ok || name == "" {
+			return nil, fmt.Errorf("invalid header %q, expected 'Name: value'", value)
+		}
+		rules = append(rules, headerRule{name: http.CanonicalHeaderKey(name), value: strings.TrimSpace(v)})
+	}
+	return rules, nil
+}
+
+func applyHeaders(h http.Header, rules []headerRule) {
+	for _, rule := range rules {
+		if rule.value == "" {
+			h.Del(rule.name)
+		} else {
+			h.Set(rule.name, rule.value)
+		}
+	}
+}
+
+// match returns the route of a request, or nil when none applies
+func (rs routes) match(r *http.Request) *route {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, rt := range rs {
+		switch {
+		case rt.host == "":
+		case strings.HasPrefix(rt.host, "*."):
+			if !strings.HasSuffix(host, rt.host[1:]) {
+				continue
+			}
+		case rt.host != host:
+			continue
+		}
+		if rt.prefix == "/" || r.URL.Path == rt.prefix || strings.HasPrefix(r.URL.Path, rt.prefix+"/") {
+			return rt
+		}
+	}
+	return nil
+}
+
+// rewrite points the outgoing request at the target, telling it where the
+// request came from
+func (rt *route) rewrite(pr *httputil.ProxyRequest) {
+	out := pr.Out.URL
+	out.Scheme, out.Host = rt.target.Scheme, rt.target.Host
+	if rt.target.Path != "" {
+		rest := strings.TrimPrefix(pr.In.URL.Path, strings.TrimSuffix(rt.prefix, "/"))
+		out.Path = path.Join(rt.target.Path, rest)
+		if strings.HasSuffix(rest, "/") || rest == "" && strings.HasSuffix(rt.target.Path, "/") {
+			out.Path += "/"
+		}
+		out.RawPath = ""
+	}
+	switch {
+	case rt.target.RawQuery == "":
+	case out.RawQuery == "":
+		out.RawQuery = rt.target.RawQuery
+	default:
+		out.RawQuery = rt.target.RawQuery + "&" + out.RawQuery
+	}
+	pr.Out.Host = ""
+	pr.SetXForwarded()
+}
+
+// rewriteResponse maps redirects to the target back under the prefix, so
+// clients stay on the proxy
+func (rt *route) rewriteResponse(resp *http.Response) error {
+	location, err := resp.Location()
+	if err != nil || location.Host != rt.target.Host {
+		return nil
+	}
+	rest := location.Path
+	if rt.target.Path != "" {
+		base := strings.TrimSuffix(rt.target.Path, "/")
+		if rest != base && !strings.HasPrefix(rest, base+"/") {
+			return nil
+		}
+		rest = strings.TrimSuffix(rt.prefix, "/") + strings.TrimPrefix(rest, base)
+	}
+	local := url.URL{Path: rest, RawQuery: location.RawQuery, Fragment: location.Fragment}
+	resp.Header.Set("Location", local.String())
+	return nil
+}
+
+// String describes the route for the startup log
+func (rt *route) String() string {
+	host := rt.host
+	if host == "" {
+		host = "*"
+	}
+	return host + rt.prefix + " -> " + rt.target.String()
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// stringList is a flag.Value collecting every occurrence of a flag
+type stringList []string
+
+// String returns the collected values separated by commas
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+// Set appends a value each time the flag is given
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+func main() {
+	// Parse CLI arguments
+	addr := flag.String("addr", "0.0.0.0", "IP Address to bind to")
+	port := flag.String("port", "8080", "Port to bind to")
+	var routeFlags, requestHeaderFlags, responseHeaderFlags stringList
+	flag.Var(&routeFlags, "route", "Forward [host]/prefix to an upstream URL, e.g. /api=http://127.0.0.1:9000/ or *.example.com=http://127.0.0.1:9001 (repeatable; a target path such as http://host:port/ replaces the prefix)")
+	flag.Var(&requestHeaderFlags, "request-header", "Set a header on proxied requests, as 'Name: value', or remove it with 'Name:' (repeatable)")
+	flag.Var(&responseHeaderFlags, "response-header", "Set a header on proxied responses, as 'Name: value', or remove it with 'Name:' (repeatable)")
+	flag.Parse()
+
+	// Validate routes
+	requestHeaders, err := parseHeaderRules(requestHeaderFlags)
+	if err != nil {
+		log.Fatalf("Error in header options: %v", err)
+	}
+	responseHeaders, err := parseHeaderRules(responseHeaderFlags)
+	if err != nil {
+		log.Fatalf("Error in header options: %v", err)
+	}
+	rs, err := parseRoutes(routeFlags, requestHeaders, responseHeaders)
+	if err != nil {
+		log.Fatalf("Error in route options: %v", err)
+	}
+	if len(rs) == 0 {
+		log.Fatalf("No routes, give at least one --route")
+	}
+
+	// Create the proxying handler
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		// Create a custom ResponseWriter to capture the status code
+		lrw := &loggingResponseWriter{
+			ResponseWriter: w,
+			statusCode:     http.StatusOK,
+		}
+		rt := rs.match(r)
+		if rt == nil {
+			http.NotFound(lrw, r)
+			log.Printf("%s %s%s %d (no route)", r.Method, r.Host, r.URL.Path, lrw.statusCode)
+			return
+		}
+		rt.proxy.ServeHTTP(lrw, r)
+		log.Printf("%s %s%s %d %s (%s)", r.Method, r.Host, r.URL.Path, lrw.statusCode, time.Since(start).Round(time.Millisecond), rt.target.Host)
+	})
+
+	// Configure server
+	server := &http.Server{
+		Addr:    fmt.Sprintf("%s:%s", *addr, *port),
+		Handler: handler,
+	}
+
+	// Start server in a goroutine
+	go func() {
+		log.Printf("Starting reverse proxy on %s:%s", *addr, *port)
+		for _, rt := range rs {
+			log.Printf("Route %s", rt)
+		}
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalf("Error starting server: %v", err)
+		}
+	}()
+
+	// Set up graceful shutdown
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	// Wait for CTRL+C
+	<-stop
+
+	log.Println("Shutting down server...")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Fatalf("Error shutting down server: %v", err)
+	}
+	log.Println("Server stopped")
+}
+
+// loggingResponseWrite is a custom ResponseWriter that captures the status code
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+// WriteHeader captures the status code before writing it
+func (lrw *loggingResponseWriter) WriteHeader(code int) {
+	lrw.statusCode = code
+	lrw.ResponseWriter.WriteHeader(code)
+}
+
+// Flush sends buffered data to the client, so streamed responses arrive
+// as the upstream writes them
+func (lrw *loggingResponseWriter) Flush() {
+	if f, ok := lrw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer,
+// which the proxy needs to hijack upgraded connections
+func (lrw *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return lrw.ResponseWriter
+}
@@ -0,0 +1,3 @@
+module github.com/jeffersfp/golang-studies/simple-tcp-echo
+
+go 1.26.0
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+func main() {
+	// Parse CLI arguments
+	addr := flag.String("addr", "0.0.0.0", "IP Address to bind to")
+	port := flag.String("port", "9000", "Port to bind to")
+	maxConns := flag.Int("max-conns", 100, "Turn away connections beyond this many open at once (0 for no limit)")
+	idleTimeout := flag.Duration("idle-timeout", time.Minute, "Close connections that send nothing for this long (0 for no limit)")
+	writeTimeout := flag.Duration("write-timeout", 10*time.Second, "Close connections that take longer than this to accept an echo")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 5*time.Second, "How long to let connections finish their echo when shutting down")
+	flag.Parse()
+
+	// Start listening
+	ln, err := net.Listen("tcp", net.JoinHostPort(*addr, *port))
+	if err != nil {
+		log.Fatalf("Error starting server: %v", err)
+	}
+	s := &echoServer{
+		ln:           ln,
+		maxConns:     *maxConns,
+		idleTimeout:  *idleTimeout,
+		writeTimeout: *writeTimeout,
+		conns:        make(map[net.Conn]struct{}),
+	}
+
+	// Accept connections in a goroutine
+	go func() {
+		log.Printf("Starting echo server on %s", ln.Addr())
+		if err := s.serve(); err != nil {
+			log.Fatalf("Error accepting connections: %v", err)
+		}
+	}()
+
+	// Set up graceful shutdown
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	// Wait for CTRL+C
+	<-stop
+
+	log.Println("Shutting down server...")
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := s.shutdown(ctx); err != nil {
+		log.Printf("Error shutting down server: %v", err)
+	}
+	log.Println("Server stopped")
+}
+
+// echoServer writes back whatever its clients send, each connection in a
+// goroutine of its own
+type echoServer struct {
+	ln           net.Listener
+	maxConns     int
+	idleTimeout  time.Duration
+	writeTimeout time.Duration
+	closing      atomic.Bool
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// serve accepts connections until the listener is closed, returning nil
+// then
+func (s *echoServer) serve() error {
+	backoff := 5 * time.Millisecond
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if s.closing.Load() {
+				return nil
+			}
+			// Running out of file descriptors passes; wait and try again
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() || errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+				log.Printf("Error accepting connection, retrying in %s: %v", backoff, err)
+				time.Sleep(backoff)
+				backoff = min(2*backoff, time.Second)
+				continue
+			}
+			return err
+		}
+		backoff = 5 * time.Millisecond
+		if !s.track(conn) {
+			// Tell the client why before hanging up
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			io.WriteString(conn, "server busy, try again later\n")
+			conn.Close()
+			log.Printf("%s rejected: %d connections open", conn.RemoteAddr(), s.maxConns)
+			continue
+		}
+		go s.handle(conn)
+	}
+}
+
+// track adds a connection to the open ones, unless the limit is reached
+// or the server is shutting down
+func (s *echoServer) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing.Load() || s.maxConns > 0 && len(s.conns) >= s.maxConns {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *echoServer) untrack(conn net.Conn) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+	s.wg.Done()
+	return len(s.conns)
+}
+
+// handle echoes a connection until the client hangs up, goes idle or
+// stops reading
+func (s *echoServer) handle(conn net.Conn) {
+	start := time.Now()
+	log.Printf("%s connected", conn.RemoteAddr())
+	var echoed int64
+	reason := "client closed"
+	buf := make([]byte, 32<<10)
+	for {
+		if s.closing.Load() {
+			// The deadline set by shutdown would be replaced below
+			reason = "server shutting down"
+			break
+		}
+		if s.idleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
+		}
+		n, err := conn.Read(buf)
+		if n > 0 {
+			conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+			if _, werr := conn.Write(buf[:n]); werr != nil {
+				reason = fmt.Sprintf("write failed: %v", werr)
+				break
+			}
+			echoed += int64(n)
+		}
+		if err != nil {
+			var ne net.Error
+			switch {
+			case err == io.EOF:
+			case s.closing.Load():
+				reason = "server shutting down"
+			case errors.As(err, &ne) && ne.Timeout():
+				reason = "idle timeout"
+			default:
+				reason = fmt.Sprintf("read failed: %v", err)
+			}
+			break
+		}
+	}
+	conn.Close()
+	open := s.untrack(conn)
+	log.Printf("%s disconnected after %s, %d bytes echoed (%s, %d open)", conn.RemoteAddr(), time.Since(start).Round(time.Millisecond), echoed, reason, open)
+}
+
+// shutdown stops accepting connections and interrupts the reads of the
+// open ones, letting them finish the echo under way. Those still open
+// when ctx is done are closed.
+func (s *echoServer) shutdown(ctx context.Context) error {
+	s.closing.Store(true)
+	err := s.ln.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,5 @@
+module github.com/jeffersfp/golang-studies/simple-udp-broadcast
+
+go 1.26.0
+
+require golang.org/x/sys v0.48.0
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Kinds of datagrams
+const (
+	kindHello = "hello" // announces a peer, sent every interval
+	kindBye   = "bye"   // sent on shutdown, so others need not wait for the timeout
+	kindText  = "text"  // a message typed by the user
+)
+
+// maxDatagram is the largest datagram read; messages are kept well below
+// it, and below the usual MTU, since a lost fragment loses the datagram
+const maxDatagram = 2048
+
+// maxText is the longest message sent, in bytes
+const maxText = 1024
+
+// datagram is the JSON sent to every peer
+type datagram struct {
+	Kind string    `json:"kind"`
+	ID   string    `json:"id"` // random per run, so restarts and equal names are told apart
+	Name string    `json:"name"`
+	Text string    `json:"text,omitempty"`
+	Sent time.Time `json:"sent"`
+}
+
+// peer is another instance heard from
+type peer struct {
+	id       string
+	name     string
+	addr     *net.UDPAddr
+	lastSeen time.Time
+}
+
+// peers are the instances heard from lately, by ID
+type peers struct {
+	mu     sync.Mutex
+	byID   map[string]*peer
+	maxAge time.Duration
+}
+
+// seen records a datagram, returning the peer and whether it is new
+func (p *peers) seen(d datagram, from *net.UDPAddr) (peer, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pr, ok := p.byID[d.ID]
+	if !ok {
+		pr = &peer{id: d.ID}
+		p.byID[d.ID] = pr
+	}
+	pr.name, pr.addr, pr.lastSeen = d.Name, from, time.Now()
+	return *pr, !ok
+}
+
+// remove forgets a peer that said bye, reporting whether it was known
+func (p *peers) remove(id string) (peer, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pr, ok := p.byID[id]
+	if !ok {
+		return peer{}, false
+	}
+	delete(p.byID, id)
+	return *pr, true
+}
+
+// expire forgets the peers not heard from for maxAge, returning them
+func (p *peers) expire() []peer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var gone []peer
+	for id, pr := range p.byID {
+		if time.Since(pr.lastSeen) > p.maxAge {
+			gone = append(gone, *pr)
+			delete(p.byID, id)
+		}
+	}
+	return gone
+}
+
+// list returns the peers sorted by name
+func (p *peers) list() []peer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	list := make([]peer, 0, len(p.byID))
+	for _, pr := range p.byID {
+		list = append(list, *pr)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].name != list[j].name {
+			return list[i].name < list[j].name
+		}
+		return list[i].id < list[j].id
+	})
+	return list
+}
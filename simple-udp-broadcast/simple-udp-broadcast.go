@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+func main() {
+	// Parse CLI arguments
+	hostname, _ := os.Hostname()
+	name := flag.String("name", hostname, "Name shown to the other peers")
+	mode := flag.String("mode", "multicast", "How to reach the peers: multicast, to the peers that joined --group, or broadcast, to every host of the LAN")
+	group := flag.String("group", "239.255.77.77", "Multicast group, in multicast mode")
+	iface := flag.String("iface", "", "Network interface to join the multicast group on (default: chosen by the system)")
+	broadcast := flag.String("broadcast", "255.255.255.255", "Broadcast address, in broadcast mode, e.g. 192.168.1.255 for a single subnet")
+	port := flag.Int("port", 9999, "UDP port every peer listens and sends on")
+	interval := flag.Duration("interval", 5*time.Second, "How often to announce this peer")
+	flag.Parse()
+
+	if *interval <= 0 {
+		log.Fatalf("Error in interval options: --interval must be positive")
+	}
+
+	// Listen on the port, joining the group or allowing broadcasts
+	var conn *net.UDPConn
+	var dest *net.UDPAddr
+	switch *mode {
+	case "multicast":
+		ip := net.ParseIP(*group)
+		if ip == nil || ip.To4() == nil || !ip.IsMulticast() {
+			log.Fatalf("Error in multicast options: invalid IPv4 multicast group %q", *group)
+		}
+		var ifi *net.Interface
+		if *iface != "" {
+			var err error
+			if ifi, err = net.InterfaceByName(*iface); err != nil {
+				log.Fatalf("Error in multicast options: %v", err)
+			}
+		}
+		dest = &net.UDPAddr{IP: ip, Port: *port}
+		var err error
+		if conn, err = net.ListenMulticastUDP("udp4", ifi, dest); err != nil {
+			log.Fatalf("Error starting peer: %v", err)
+		}
+		if err := enableMulticastLoopback(conn); err != nil {
+			log.Fatalf("Error starting peer: %v", err)
+		}
+	case "broadcast":
+		ip := net.ParseIP(*broadcast)
+		if ip == nil || ip.To4() == nil {
+			log.Fatalf("Error in broadcast options: invalid IPv4 broadcast address %q", *broadcast)
+		}
+		dest = &net.UDPAddr{IP: ip, Port: *port}
+		lc := net.ListenConfig{Control: controlSocket}
+		pc, err := lc.ListenPacket(context.Background(), "udp4", ":"+strconv.Itoa(*port))
+		if err != nil {
+			log.Fatalf("Error starting peer: %v", err)
+		}
+		conn = pc.(*net.UDPConn)
+	default:
+		log.Fatalf("Error in mode options: unknown mode %q, expected multicast or broadcast", *mode)
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	p := &node{
+		conn:  conn,
+		dest:  dest,
+		id:    hex.EncodeToString(id),
+		name:  *name,
+		peers: &peers{byID: make(map[string]*peer), maxAge: 3 * *interval},
+	}
+
+	// Start listening in a goroutine
+	log.Printf("Starting peer %q on %s, %s to %s", p.name, conn.LocalAddr(), *mode, dest)
+	log.Println("Type a line to send it to every peer, or /peers to list them")
+	go p.receive()
+	go p.readInput(os.Stdin)
+	p.send(nil, kindHello, "")
+
+	// Set up graceful shutdown
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	// Announce this peer and forget the silent ones until CTRL+C
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for waiting := true; waiting; {
+		select {
+		case <-ticker.C:
+			p.send(nil, kindHello, "")
+			for _, pr := range p.peers.expire() {
+				log.Printf("Peer %q at %s timed out", pr.name, pr.addr)
+			}
+		case <-stop:
+			waiting = false
+		}
+	}
+
+	log.Println("Shutting down peer...")
+	p.send(nil, kindBye, "")
+	conn.Close()
+	log.Println("Peer stopped")
+}
+
+// node is this peer: it announces itself, and keeps track of the others
+type node struct {
+	conn  *net.UDPConn
+	dest  *net.UDPAddr // the group or broadcast address
+	id    string
+	name  string
+	peers *peers
+}
+
+// send writes a datagram to a peer, or to all of them when to is nil
+func (p *node) send(to *net.UDPAddr, kind, text string) {
+	if to == nil {
+		to = p.dest
+	}
+	data, err := json.Marshal(datagram{Kind: kind, ID: p.id, Name: p.name, Text: text, Sent: time.Now().UTC()})
+	if err != nil {
+		log.Printf("Error encoding %s: %v", kind, err)
+		return
+	}
+	if _, err := p.conn.WriteToUDP(data, to); err != nil {
+		log.Printf("Error sending %s to %s: %v", kind, to, err)
+	}
+}
+
+// receive handles the datagrams of the other peers until the socket is
+// closed
+func (p *node) receive() {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, from, err := p.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Error receiving: %v", err)
+			}
+			return
+		}
+		var d datagram
+		if err := json.Unmarshal(buf[:n], &d); err != nil || d.ID == "" {
+			log.Printf("Ignoring invalid datagram from %s", from)
+			continue
+		}
+		// Our own datagrams come back through the loopback
+		if d.ID == p.id {
+			continue
+		}
+		if d.Kind == kindBye {
+			if pr, ok := p.peers.remove(d.ID); ok {
+				log.Printf("Peer %q at %s left", pr.name, pr.addr)
+			}
+			continue
+		}
+		pr, joined := p.peers.seen(d, from)
+		if joined {
+			log.Printf("Peer %q joined from %s", pr.name, pr.addr)
+			// Answer right away, rather than leaving the newcomer to wait
+			// for our next announcement
+			p.send(from, kindHello, "")
+		}
+		if d.Kind == kindText {
+			log.Printf("<%s> %s", pr.name, d.Text)
+		}
+	}
+}
+
+// readInput sends the lines typed by the user, and lists the peers on
+// /peers
+func (p *node) readInput(f *os.File) {
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case line == "/peers":
+			list := p.peers.list()
+			log.Printf("%d peers", len(list))
+			for _, pr := range list {
+				log.Printf("  %q at %s, seen %s ago", pr.name, pr.addr, time.Since(pr.lastSeen).Round(time.Second))
+			}
+		default:
+			p.send(nil, kindText, truncate(line, maxText))
+		}
+	}
+}
+
+// truncate cuts a text to at most n bytes without splitting a character
+func truncate(text string, n int) string {
+	if len(text) <= n {
+		return text
+	}
+	for n > 0 && !utf8.RuneStart(text[n]) {
+		n--
+	}
+	return text[:n]
+}
@@ -0,0 +1,20 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// controlSocket leaves the socket as is: only one peer per host can listen
+// on the port here
+func controlSocket(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+// enableMulticastLoopback leaves loopback off: the peers on this host do
+// not hear each other in multicast mode here
+func enableMulticastLoopback(conn *net.UDPConn) error {
+	return nil
+}
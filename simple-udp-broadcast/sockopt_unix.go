@@ -0,0 +1,45 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// controlSocket sets SO_REUSEADDR and SO_REUSEPORT before the socket is
+// bound, so several peers on one host can all listen on the port and each
+// receive the broadcasts
+func controlSocket(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		for _, opt := range []int{unix.SO_REUSEADDR, unix.SO_REUSEPORT} {
+			if sockErr == nil {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, opt, 1)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// enableMulticastLoopback has the datagrams sent to the group delivered to
+// the peers on this host too, which net.ListenMulticastUDP turns off
+func enableMulticastLoopback(conn *net.UDPConn) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MULTICAST_LOOP, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
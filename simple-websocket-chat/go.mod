@@ -0,0 +1,3 @@
+module github.com/jeffersfp/golang-studies/simple-websocket-chat
+
+go 1.26.0
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// clientSendBuffer is how many messages may wait for a slow client before
+// it is dropped
+const clientSendBuffer = 32
+
+// message is what the hub broadcasts, as JSON
+type message struct {
+	Type   string    `json:"type"` // message, join or leave
+	Name   string    `json:"name"`
+	Text   string    `json:"text,omitempty"`
+	Online int       `json:"online"`
+	Time   time.Time `json:"time"`
+}
+
+// client is a browser connected to the hub, with the messages waiting to
+// be written to it
+type client struct {
+	hub  *hub
+	ws   *webSocket
+	name string
+	send chan []byte
+}
+
+// hub keeps the connected clients and broadcasts every message to all of
+// them. Its maps are only touched by run, the other goroutines talk to it
+// over the channels.
+type hub struct {
+	clients    map[*client]bool
+	register   chan *client
+	unregister chan *client
+	broadcast  chan message
+	quit       chan struct{}
+	stopped    chan struct{}
+	wg         sync.WaitGroup // the write loops of the clients
+}
+
+func newHub() *hub {
+	return &hub{
+		clients:    make(map[*client]bool),
+		register:   make(chan *client),
+		unregister: make(chan *client),
+		broadcast:  make(chan message),
+		quit:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+}
+
+// run dispatches the messages until close is called
+func (h *hub) run() {
+	defer close(h.stopped)
+	for {
+		select {
+		case c := <-h.register:
+			h.clients[c] = true
+			log.Printf("%s joined (%d online)", c.name, len(h.clients))
+			h.send(message{Type: "join", Name: c.name})
+		case c := <-h.unregister:
+			if h.clients[c] {
+				h.drop(c)
+				log.Printf("%s left (%d online)", c.name, len(h.clients))
+				h.send(message{Type: "leave", Name: c.name})
+			}
+		case m := <-h.broadcast:
+			h.send(m)
+		case <-h.quit:
+			// Closing the send channels tells the write loops to say
+			// goodbye to their clients
+			for c := range h.clients {
+				h.drop(c)
+			}
+			return
+		}
+	}
+}
+
+// send writes a message to every client, dropping those too slow to keep up
+func (h *hub) send(m message) {
+	m.Online, m.Time = len(h.clients), time.Now().UTC()
+	data, err := json.Marshal(m)
+	if err != nil {
+		log.Printf("Error encoding message: %v", err)
+		return
+	}
+	for c := range h.clients {
+		select {
+		case c.send <- data:
+		default:
+			log.Printf("Dropping %s, too slow to keep up", c.name)
+			h.drop(c)
+		}
+	}
+}
+
+func (h *hub) drop(c *client) {
+	delete(h.clients, c)
+	close(c.send)
+}
+
+// close disconnects every client and waits for them to be told
+func (h *hub) close() {
+	close(h.quit)
+	<-h.stopped
+	h.wg.Wait()
+}
+
+// join registers a client and serves it until it leaves, returning false
+// when the hub is shutting down
+func (h *hub) join(c *client, pingInterval time.Duration) bool {
+	// Count the write loop before registering, so close can't be waiting
+	// already when it's added
+	h.wg.Add(1)
+	select {
+	case h.register <- c:
+	case <-h.quit:
+		h.wg.Done()
+		return false
+	}
+	go func() {
+		defer h.wg.Done()
+		c.writeLoop(pingInterval)
+	}()
+	c.readLoop()
+	return true
+}
+
+// readLoop broadcasts the text messages of the client until it goes away
+// or stops answering pings
+func (c *client) readLoop() {
+	defer func() {
+		select {
+		case c.hub.unregister <- c:
+		case <-c.hub.stopped:
+		}
+		c.ws.conn.Close()
+	}()
+	for {
+		opcode, data, err := c.ws.readMessage()
+		if err != nil {
+			return
+		}
+		if opcode != wsText || len(data) == 0 {
+			continue
+		}
+		select {
+		case c.hub.broadcast <- message{Type: "message", Name: c.name, Text: string(data)}:
+		case <-c.hub.stopped:
+			return
+		}
+	}
+}
+
+// writeLoop writes the broadcast messages to the client and pings it,
+// closing the connection once the hub drops it
+func (c *client) writeLoop(pingInterval time.Duration) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case data, ok := <-c.send:
+			if !ok {
+				c.ws.close(1001, "going away")
+				return
+			}
+			if err := c.ws.writeMessage(wsText, data); err != nil {
+				c.ws.conn.Close()
+				return
+			}
+		case <-ticker.C:
+			if err := c.ws.writeMessage(wsPing, nil); err != nil {
+				c.ws.conn.Close()
+				return
+			}
+		}
+	}
+}
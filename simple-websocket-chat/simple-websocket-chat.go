@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// indexHTML is the chat client served at /
+//
+//go:embed index.html
+var indexHTML []byte
+
+// maxNameLength bounds the names clients pick
+const maxNameLength = 32
+
+func main() {
+	// Parse CLI arguments
+	addr := flag.String("addr", "0.0.0.0", "IP Address to bind to")
+	port := flag.String("port", "8080", "Port to bind to")
+	pingInterval := flag.Duration("ping-interval", 30*time.Second, "Ping clients this often, dropping those not heard from for two intervals")
+	flag.Parse()
+	if *pingInterval <= 0 {
+		log.Fatalf("Invalid ping interval: %s", *pingInterval)
+	}
+
+	hub := newHub()
+	go hub.run()
+
+	var guests atomic.Int64
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(indexHTML)
+		log.Printf("%s %s %d", r.Method, r.URL.Path, http.StatusOK)
+	})
+	mux.HandleFunc("GET /ws", func(w http.ResponseWriter, r *http.Request) {
+		// Browsers send the page's origin, which must be this server's
+		if origin := r.Header.Get("Origin"); origin != "" {
+			if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				log.Printf("%s %s %d (origin %s)", r.Method, r.URL.Path, http.StatusForbidden, origin)
+				return
+			}
+		}
+		ws, err := upgradeWebSocket(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Printf("%s %s %d", r.Method, r.URL.Path, http.StatusBadRequest)
+			return
+		}
+		log.Printf("%s %s %d", r.Method, r.URL.Path, http.StatusSwitchingProtocols)
+		ws.readTimeout = 2 * *pingInterval
+		name := []rune(r.URL.Query().Get("name"))
+		if len(name) > maxNameLength {
+			name = name[:maxNameLength]
+		}
+		if len(name) == 0 {
+			name = []rune(fmt.Sprintf("guest-%d", guests.Add(1)))
+		}
+		c := &client{hub: hub, ws: ws, name: string(name), send: make(chan []byte, clientSendBuffer)}
+		if !hub.join(c, *pingInterval) {
+			ws.close(1001, "going away")
+		}
+	})
+
+	// Configure server
+	server := &http.Server{
+		Addr:    fmt.Sprintf("%s:%s", *addr, *port),
+		Handler: mux,
+	}
+
+	// Start server in a goroutine
+	go func() {
+		log.Printf("Starting chat server on %s:%s", *addr, *port)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalf("Error starting server: %v", err)
+		}
+	}()
+
+	// Set up graceful shutdown
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	// Wait for CTRL+C
+	<-stop
+
+	// The server no longer tracks the hijacked WebSocket connections, so
+	// the hub closes them after the listener is
+	log.Println("Shutting down server...")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down server: %v", err)
+	}
+	hub.close()
+	log.Println("Server stopped")
+}
@@ -0,0 +1,3 @@
+module github.com/jeffersfp/golang-studies/worker-pool
+
+go 1.26.0
@@ -0,0 +1,196 @@
+// Package pool runs jobs on a bounded number of workers fed from a bounded
+// queue, recovering their panics and reporting a result for every job.
+//
+// Submit jobs, read the results while doing so, then Close the pool: the
+// results channel is closed once the last job is done.
+//
+//	p := pool.New[int](ctx, 4, 16)
+//	go func() {
+//		for _, n := range inputs {
+//			p.Submit(ctx, square(n))
+//		}
+//		p.Close()
+//	}()
+//	for r := range p.Results() {
+//		...
+//	}
+//
+// Run does the same for a known list of jobs.
+package pool
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrClosed is returned by Submit once the pool is closed
+var ErrClosed = errors.New("pool closed")
+
+// Job is a unit of work, which should return early when ctx is done
+type Job[T any] func(ctx context.Context) (T, error)
+
+// Result is the outcome of a job, identified by the number Submit gave it
+type Result[T any] struct {
+	ID       int
+	Value    T
+	Err      error // a *PanicError when the job panicked
+	Duration time.Duration
+}
+
+// PanicError is the error of a job that panicked, with the stack of the
+// worker at the time
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("job panicked: %v", e.Value)
+}
+
+// Pool runs the submitted jobs on its workers
+type Pool[T any] struct {
+	ctx     context.Context
+	queue   chan queued[T]
+	results chan Result[T]
+	quit    chan struct{} // closed by Close, to release blocked Submits
+
+	mu     sync.RWMutex // held by Submit, so Close waits for it to close the queue
+	closed bool
+	nextID atomic.Int64
+	wg     sync.WaitGroup
+	once   sync.Once
+}
+
+type queued[T any] struct {
+	id  int
+	job Job[T]
+}
+
+// New starts a pool of the given number of workers, with room for
+// queueSize jobs waiting for one. The jobs are given ctx; once it is done
+// those not started yet fail with its error instead of running.
+func New[T any](ctx context.Context, workers, queueSize int) *Pool[T] {
+	workers = max(workers, 1)
+	p := &Pool[T]{
+		ctx:     ctx,
+		queue:   make(chan queued[T], max(queueSize, 0)),
+		results: make(chan Result[T], max(queueSize, workers)),
+		quit:    make(chan struct{}),
+	}
+	p.wg.Add(workers)
+	for range workers {
+		go p.work()
+	}
+	go func() {
+		p.wg.Wait()
+		close(p.results)
+	}()
+	return p
+}
+
+// Submit queues a job, waiting while the queue is full, and returns its
+// ID, counting from 1 in the order of submission. It fails when ctx or the
+// context of the pool is done first, or with ErrClosed once the pool is
+// closed.
+func (p *Pool[T]) Submit(ctx context.Context, job Job[T]) (int, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return 0, ErrClosed
+	}
+	q := queued[T]{id: int(p.nextID.Add(1)), job: job}
+	// A queue with room takes the job even when a context is done, the
+	// job then failing with its error
+	select {
+	case p.queue <- q:
+		return q.id, nil
+	default:
+	}
+	select {
+	case p.queue <- q:
+		return q.id, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-p.ctx.Done():
+		return 0, p.ctx.Err()
+	case <-p.quit:
+		return 0, ErrClosed
+	}
+}
+
+// Results returns the channel of the results, in the order the jobs end.
+// It must be read until closed, as full workers wait for it.
+func (p *Pool[T]) Results() <-chan Result[T] {
+	return p.results
+}
+
+// Close stops accepting jobs. The queued ones still run, and the results
+// channel is closed after the last of them.
+func (p *Pool[T]) Close() {
+	p.once.Do(func() {
+		close(p.quit)
+		p.mu.Lock()
+		p.closed = true
+		close(p.queue)
+		p.mu.Unlock()
+	})
+}
+
+// work runs queued jobs until the queue is closed and empty
+func (p *Pool[T]) work() {
+	defer p.wg.Done()
+	for q := range p.queue {
+		if err := p.ctx.Err(); err != nil {
+			p.results <- Result[T]{ID: q.id, Err: err}
+			continue
+		}
+		p.results <- p.run(q)
+	}
+}
+
+// run runs a job, turning a panic into its error
+func (p *Pool[T]) run(q queued[T]) (r Result[T]) {
+	r.ID = q.id
+	start := time.Now()
+	defer func() {
+		r.Duration = time.Since(start)
+		if v := recover(); v != nil {
+			var zero T
+			r.Value, r.Err = zero, &PanicError{Value: v, Stack: debug.Stack()}
+		}
+	}()
+	r.Value, r.Err = q.job(p.ctx)
+	return r
+}
+
+// Run runs jobs on a pool of the given number of workers and returns
+// their results in the order of jobs. The error joins those of the failed
+// jobs, nil when all succeeded.
+func Run[T any](ctx context.Context, workers int, jobs []Job[T]) ([]Result[T], error) {
+	p := New[T](ctx, workers, len(jobs))
+	for _, job := range jobs {
+		// The queue has room for every job, so none is refused
+		p.Submit(ctx, job)
+	}
+	p.Close()
+	results := make([]Result[T], 0, len(jobs))
+	var errs []error
+	for r := range p.Results() {
+		results = append(results, r)
+	}
+	slices.SortFunc(results, func(a, b Result[T]) int { return cmp.Compare(a.ID, b.ID) })
+	for _, r := range results {
+		if r.Err != nil {
+			errs = append(errs, fmt.Errorf("job %d: %w", r.ID, r.Err))
+		}
+	}
+	return results, errors.Join(errs...)
+}
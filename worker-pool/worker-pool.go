@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/jeffersfp/golang-studies/worker-pool/pool"
+)
+
+// errUnlucky is the failure the demo jobs draw with --fail-rate
+var errUnlucky = errors.New("unlucky draw")
+
+func main() {
+	// Parse CLI arguments
+	workers := flag.Int("workers", 4, "Number of workers running jobs at once")
+	jobs := flag.Int("jobs", 20, "Number of jobs to run")
+	queue := flag.Int("queue", 8, "Number of jobs that can wait for a worker before submitting blocks")
+	maxDuration := flag.Duration("max-duration", 500*time.Millisecond, "Longest a job works for, each drawing a duration up to this")
+	timeout := flag.Duration("timeout", 0, "Cancel the jobs still running or queued after this long (0 for no limit)")
+	failRate := flag.Float64("fail-rate", 0.1, "Fraction of jobs returning an error")
+	panicRate := flag.Float64("panic-rate", 0.05, "Fraction of jobs panicking, recovered by the pool")
+	flag.Parse()
+	if *maxDuration <= 0 {
+		log.Fatalf("Invalid job duration: %s", *maxDuration)
+	}
+
+	// CTRL+C cancels the jobs, as does the timeout
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	// Submit the jobs while reading the results, as a producer would
+	start := time.Now()
+	p := pool.New[int](ctx, *workers, *queue)
+	go func() {
+		defer p.Close()
+		for n := 1; n <= *jobs; n++ {
+			job := square(n, rand.N(*maxDuration), *failRate, *panicRate)
+			if _, err := p.Submit(ctx, job); err != nil {
+				log.Printf("Stopped submitting after %d jobs: %v", n-1, err)
+				return
+			}
+		}
+	}()
+
+	// Aggregate the results as they come
+	var succeeded, failed, panicked, canceled, sum int
+	for r := range p.Results() {
+		var perr *pool.PanicError
+		switch {
+		case r.Err == nil:
+			succeeded++
+			sum += r.Value
+			log.Printf("Job %d done in %s: %d", r.ID, r.Duration.Round(time.Millisecond), r.Value)
+		case errors.As(r.Err, &perr):
+			panicked++
+			log.Printf("Job %d panicked after %s: %v", r.ID, r.Duration.Round(time.Millisecond), perr.Value)
+		case errors.Is(r.Err, context.Canceled) || errors.Is(r.Err, context.DeadlineExceeded):
+			canceled++
+			log.Printf("Job %d canceled: %v", r.ID, r.Err)
+		default:
+			failed++
+			log.Printf("Job %d failed after %s: %v", r.ID, r.Duration.Round(time.Millisecond), r.Err)
+		}
+	}
+	fmt.Printf("%d succeeded, %d failed, %d panicked, %d canceled in %s, sum of squares %d\n",
+		succeeded, failed, panicked, canceled, time.Since(start).Round(time.Millisecond), sum)
+	if failed+panicked+canceled > 0 {
+		os.Exit(1)
+	}
+}
+
+// square returns a job squaring n after working for d, unless it draws a
+// failure or a panic
+func square(n int, d time.Duration, failRate, panicRate float64) pool.Job[int] {
+	return func(ctx context.Context) (int, error) {
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+		switch draw := rand.Float64(); {
+		case draw < panicRate:
+			panic(fmt.Sprintf("job %d lost its footing", n))
+		case draw < panicRate+failRate:
+			return 0, errUnlucky
+		}
+		return n * n, nil
+	}
+}